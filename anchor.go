@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const (
+	defaultAnchorLookback = time.Hour
+	anchorSearchStep      = 15 * time.Minute
+)
+
+// anchor is the START of a request which other requests are looked at from
+type anchor struct {
+	RequestID string
+	LogStream string
+	Timestamp int64
+}
+
+// resolveAnchor finds the START of the request by searching backwards from now in windows of step,
+// up to lookback, so a recent request is found without scanning the whole lookback.
+func resolveAnchor(ctx context.Context, logs logsAPI, logGroupName, requestID string, now time.Time, lookback, step time.Duration) (*anchor, error) {
+	oldest := now.Add(-lookback)
+	for end := now; end.After(oldest); end = end.Add(-step) {
+		start := end.Add(-step)
+		if start.Before(oldest) {
+			start = oldest
+		}
+		input := &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName:  aws.String(logGroupName),
+			StartTime:     aws.Int64(aws.TimeUnixMilli(start)),
+			EndTime:       aws.Int64(aws.TimeUnixMilli(end)),
+			FilterPattern: aws.String(fmt.Sprintf("%q", requestID)),
+		}
+		var found *anchor
+		fn := func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			for _, event := range res.Events {
+				kind, id, _ := parseLifecycle(aws.StringValue(event.Message))
+				if kind == lifecycleStart && id == requestID {
+					found = &anchor{
+						RequestID: requestID,
+						LogStream: aws.StringValue(event.LogStreamName),
+						Timestamp: aws.Int64Value(event.Timestamp),
+					}
+					return false
+				}
+			}
+			return true
+		}
+		if err := logs.FilterLogEventsPagesWithContext(ctx, input, fn); err != nil {
+			return nil, fmt.Errorf("FilterLogEventsPages, %s: %w", logGroupName, err)
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, fmt.Errorf("START of request %s is not found in %s, searched back %s to %s",
+		requestID, logGroupName, lookback, oldest.UTC().Format(time.RFC3339))
+}
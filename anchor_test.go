@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// groupLogs serves the events of a log group by the time window and the quoted term of FilterPattern
+type groupLogs struct {
+	fakeLogs
+	events  []*cloudwatchlogs.FilteredLogEvent
+	windows [][2]int64
+}
+
+func (l *groupLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	start, end := aws.Int64Value(input.StartTime), aws.Int64Value(input.EndTime)
+	l.windows = append(l.windows, [2]int64{start, end})
+	term := strings.Trim(aws.StringValue(input.FilterPattern), `"`)
+	var events []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events {
+		ts := aws.Int64Value(e.Timestamp)
+		if ts < start || (end > 0 && ts > end) || !strings.Contains(aws.StringValue(e.Message), term) {
+			continue
+		}
+		events = append(events, e)
+	}
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: events}, true)
+	return nil
+}
+
+func (l *groupLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	return nil
+}
+
+func (l *groupLogs) add(id, stream, message string, ts time.Time) {
+	l.events = append(l.events, &cloudwatchlogs.FilteredLogEvent{
+		EventId:       aws.String(id),
+		LogStreamName: aws.String(stream),
+		Message:       aws.String(message),
+		Timestamp:     aws.Int64(aws.TimeUnixMilli(ts)),
+	})
+}
+
+func TestResolveAnchor(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	logs := &groupLogs{}
+	logs.add("1", "s1", "START RequestId: req-1 Version: $LATEST", now.Add(-40*time.Minute))
+	logs.add("2", "s1", "2021-01-01T11:20:00Z\treq-1\tINFO\tmentions req-1", now.Add(-40*time.Minute+time.Second))
+
+	a, err := resolveAnchor(context.Background(), logs, "/aws/lambda/f", "req-1", now, time.Hour, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.LogStream != "s1" || a.Timestamp != aws.TimeUnixMilli(now.Add(-40*time.Minute)) {
+		t.Errorf("got %+v", a)
+	}
+	if len(logs.windows) != 3 {
+		t.Errorf("must stop at the window which has the START, searched %v", logs.windows)
+	}
+
+	logs.windows = nil
+	_, err = resolveAnchor(context.Background(), logs, "/aws/lambda/f", "req-2", now, time.Hour, 25*time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "searched back 1h0m0s to 2021-01-01T11:00:00Z") {
+		t.Errorf("got %v", err)
+	}
+	if len(logs.windows) != 3 || logs.windows[2][0] != aws.TimeUnixMilli(now.Add(-time.Hour)) {
+		t.Errorf("the last window must be cut at the lookback, got %v", logs.windows)
+	}
+}
+
+func TestLogStreamerMarksAnchor(t *testing.T) {
+	obs := setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Minute)
+	logs := &groupLogs{}
+	logs.add("1", "s1", "START RequestId: req-1 Version: $LATEST", start)
+	logs.add("2", "s1", "anchor line", start.Add(time.Second))
+	logs.add("3", "s2", "START RequestId: req-2 Version: $LATEST", start.Add(2*time.Second))
+	logs.add("4", "s2", "other line", start.Add(3*time.Second))
+	logs.add("5", "s1", "START RequestId: req-3 Version: $LATEST", start.Add(4*time.Second))
+
+	s := &logStreamer{
+		logs:         logs,
+		emitter:      em,
+		logGroupName: "/aws/lambda/f",
+		anchor:       &anchor{RequestID: "req-1", LogStream: "s1", Timestamp: aws.TimeUnixMilli(start)},
+		current:      map[string]string{},
+		lastSeen:     aws.TimeUnixMilli(start),
+	}
+	if err := s.streamLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range obs.All() {
+		got = append(got, e.Message)
+	}
+	want := []string{
+		anchorMark + "START RequestId: req-1 Version: $LATEST",
+		anchorMark + "anchor line",
+		"START RequestId: req-2 Version: $LATEST",
+		"other line",
+		"START RequestId: req-3 Version: $LATEST",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q", got)
+	}
+}
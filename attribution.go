@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxClientContextSize is the limit of the base64-encoded ClientContext of Invoke
+	maxClientContextSize = 3583
+	// maxAttributionValue is the max bytes of an attribution value
+	maxAttributionValue = 256
+	// clientContextFilePrefix makes -client-context the path of a file, ex: @context.json
+	clientContextFilePrefix = "@"
+)
+
+// attribution keys in the custom map of the ClientContext, in the order they are dropped to fit the size
+var attributionKeys = []string{
+	"nodeless_ci_url",
+	"nodeless_git_dirty",
+	"nodeless_git_branch",
+	"nodeless_git_repo",
+	"nodeless_host",
+	"nodeless_user",
+}
+
+// correlationIDKeys are the keys of the custom map of the ClientContext which carry the id a mobile client
+// correlates its requests by, the first one found is logged with each log line
+var correlationIDKeys = []string{"correlation_id", "correlationId", "trace_id", "traceId"}
+
+// attributionEnv is what attribution reads from the environment, replaced by tests
+type attributionEnv struct {
+	getenv   func(string) string
+	username func() string
+	hostname func() (string, error)
+	dir      string // where the git repository is looked for
+}
+
+func defaultAttributionEnv() attributionEnv {
+	dir, _ := os.Getwd()
+	return attributionEnv{
+		getenv: os.Getenv,
+		username: func() string {
+			if u, err := user.Current(); err == nil {
+				return u.Username
+			}
+			return os.Getenv("USER")
+		},
+		hostname: os.Hostname,
+		dir:      dir,
+	}
+}
+
+// collectAttribution returns who runs the tool and where: the user, the host, the git repository
+// and the CI job. What can not be found is omitted.
+func collectAttribution(env attributionEnv) map[string]string {
+	ret := make(map[string]string)
+	set := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if len(value) > maxAttributionValue {
+			value = value[:maxAttributionValue]
+			for !utf8.ValidString(value) {
+				value = value[:len(value)-1]
+			}
+		}
+		ret[key] = value
+	}
+	set("nodeless_user", env.username())
+	if host, err := env.hostname(); err == nil {
+		set("nodeless_host", host)
+	}
+	if info, err := readGitInfo(env.dir); err != nil {
+		logger.Debugf("git repository is not attributed: %s", err)
+	} else if info != nil {
+		set("nodeless_git_repo", info.Repo)
+		set("nodeless_git_branch", info.Branch)
+		if info.Dirty != nil {
+			set("nodeless_git_dirty", strconv.FormatBool(*info.Dirty))
+		}
+	}
+	set("nodeless_ci_url", ciJobURL(env.getenv))
+	return ret
+}
+
+// ciJobURL returns the URL of the CI job from the variables of well-known CI services, or ""
+func ciJobURL(getenv func(string) string) string {
+	if server, repo, run := getenv("GITHUB_SERVER_URL"), getenv("GITHUB_REPOSITORY"), getenv("GITHUB_RUN_ID"); server != "" && repo != "" && run != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, run)
+	}
+	for _, name := range []string{
+		"CI_JOB_URL",           // GitLab
+		"CIRCLE_BUILD_URL",     // CircleCI
+		"BUILDKITE_BUILD_URL",  // Buildkite
+		"TRAVIS_BUILD_WEB_URL", // Travis CI
+		"BUILD_URL",            // Jenkins
+	} {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ciInstance returns the repository or the pipeline of the CI job, which is the same across its runs, or ""
+func ciInstance(getenv func(string) string) string {
+	if user, repo := getenv("CIRCLE_PROJECT_USERNAME"), getenv("CIRCLE_PROJECT_REPONAME"); user != "" && repo != "" {
+		return user + "/" + repo
+	}
+	for _, name := range []string{
+		"GITHUB_REPOSITORY",       // GitHub Actions
+		"CI_PROJECT_PATH",         // GitLab
+		"BUILDKITE_PIPELINE_SLUG", // Buildkite
+		"TRAVIS_REPO_SLUG",        // Travis CI
+		"JOB_NAME",                // Jenkins
+	} {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readClientContext returns -client-context, or the content of the file of @PATH
+func readClientContext(spec string, getenv func(string) string) (string, error) {
+	if !strings.HasPrefix(spec, clientContextFilePrefix) {
+		return spec, nil
+	}
+	path, err := expandPath(strings.TrimPrefix(spec, clientContextFilePrefix), getenv)
+	if err != nil {
+		return "", fmt.Errorf("client-context: %w", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("client-context: %w", err)
+	}
+	return string(b), nil
+}
+
+// parseClientContext parses -client-context, a JSON object of the ClientContext, ex: {"custom": {"k": "v"}}
+func parseClientContext(s string) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	if s == "" {
+		return ret, nil
+	}
+	if err := json.Unmarshal([]byte(s), &ret); err != nil {
+		return nil, fmt.Errorf("client-context must be a JSON object: %w", err)
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("client-context must be a JSON object, %s", s)
+	}
+	if custom, ok := ret["custom"]; ok {
+		if _, ok := custom.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("custom of client-context must be an object, %s", s)
+		}
+	}
+	return ret, nil
+}
+
+// correlationID returns the correlation id in the custom map of the ClientContext, or ""
+func correlationID(cc map[string]interface{}) string {
+	custom, _ := cc["custom"].(map[string]interface{})
+	for _, k := range correlationIDKeys {
+		if v, ok := custom[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// buildClientContext merges attribution into the custom map of the user's ClientContext, where
+// the user's values win, and returns it base64-encoded. Attribution is dropped key by key until it fits
+// maxClientContextSize; the user's ClientContext alone must fit.
+func buildClientContext(userContext map[string]interface{}, attribution map[string]string) (string, error) {
+	cc := make(map[string]interface{}, len(userContext)+1)
+	for k, v := range userContext {
+		cc[k] = v
+	}
+	custom := make(map[string]interface{})
+	if c, ok := userContext["custom"].(map[string]interface{}); ok {
+		for k, v := range c {
+			custom[k] = v
+		}
+	}
+	var added []string
+	for _, k := range attributionKeys {
+		if v, ok := attribution[k]; ok {
+			if _, exists := custom[k]; !exists {
+				custom[k] = v
+				added = append(added, k)
+			}
+		}
+	}
+	if len(custom) > 0 {
+		cc["custom"] = custom
+	}
+
+	for {
+		encoded, err := encodeClientContext(cc)
+		if err != nil {
+			return "", err
+		}
+		if len(encoded) <= maxClientContextSize {
+			return encoded, nil
+		}
+		if len(added) == 0 {
+			return "", fmt.Errorf("client-context is %d bytes base64-encoded, exceeds %d", len(encoded), maxClientContextSize)
+		}
+		delete(custom, added[0])
+		added = added[1:]
+		if len(custom) == 0 {
+			delete(cc, "custom")
+		}
+	}
+}
+
+// encodeClientContext returns the ClientContext as Invoke takes it, or "" if it is empty
+func encodeClientContext(cc map[string]interface{}) (string, error) {
+	if len(cc) == 0 {
+		return "", nil
+	}
+	buf, err := json.Marshal(cc)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
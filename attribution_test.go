@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testAttributionEnv(dir string, env map[string]string) attributionEnv {
+	return attributionEnv{
+		getenv:   func(k string) string { return env[k] },
+		username: func() string { return "alice" },
+		hostname: func() (string, error) { return "build-01", nil },
+		dir:      dir,
+	}
+}
+
+func TestCollectAttribution(t *testing.T) {
+	setTestLogger(t)
+	worktree := fixtureRepo(t, "ref: refs/heads/main\n", "[remote \"origin\"]\n\turl = https://github.com/shirou/k8s-nodeless.git\n")
+	got := collectAttribution(testAttributionEnv(worktree, map[string]string{
+		"GITHUB_SERVER_URL": "https://github.com",
+		"GITHUB_REPOSITORY": "shirou/k8s-nodeless",
+		"GITHUB_RUN_ID":     "42",
+	}))
+	want := map[string]string{
+		"nodeless_user":       "alice",
+		"nodeless_host":       "build-01",
+		"nodeless_git_repo":   "k8s-nodeless",
+		"nodeless_git_branch": "main",
+		"nodeless_git_dirty":  "false",
+		"nodeless_ci_url":     "https://github.com/shirou/k8s-nodeless/actions/runs/42",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %q, want %q", k, got[k], v)
+		}
+	}
+
+	// outside of a repository, without CI and a hostname
+	env := testAttributionEnv(t.TempDir(), nil)
+	env.hostname = func() (string, error) { return "", errors.New("no hostname") }
+	env.username = func() string { return strings.Repeat("あ", 100) }
+	got = collectAttribution(env)
+	if len(got) != 1 {
+		t.Errorf("got %v", got)
+	}
+	if u := got["nodeless_user"]; len(u) > maxAttributionValue || !strings.HasPrefix(strings.Repeat("あ", 100), u) {
+		t.Errorf("a long value must be cut at a rune, got %d bytes", len(u))
+	}
+}
+
+func TestCIJobURL(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"CI_JOB_URL": "https://gitlab.example.com/g/p/-/jobs/1"}, "https://gitlab.example.com/g/p/-/jobs/1"},
+		{map[string]string{"CIRCLE_BUILD_URL": "https://circleci.com/gh/o/r/1"}, "https://circleci.com/gh/o/r/1"},
+		{map[string]string{"BUILD_URL": "https://jenkins.example.com/job/x/1/"}, "https://jenkins.example.com/job/x/1/"},
+		// GitHub Actions needs all of them
+		{map[string]string{"GITHUB_REPOSITORY": "o/r", "GITHUB_RUN_ID": "1"}, ""},
+		{map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		if got := ciJobURL(func(k string) string { return tt.env[k] }); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestCIInstance(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"GITHUB_REPOSITORY": "o/r", "GITHUB_RUN_ID": "1"}, "o/r"},
+		{map[string]string{"CI_PROJECT_PATH": "g/p"}, "g/p"},
+		{map[string]string{"CIRCLE_PROJECT_USERNAME": "o", "CIRCLE_PROJECT_REPONAME": "r"}, "o/r"},
+		{map[string]string{"JOB_NAME": "deploy"}, "deploy"},
+		{map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		if got := ciInstance(func(k string) string { return tt.env[k] }); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func decodeClientContext(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret map[string]interface{}
+	if err := json.Unmarshal(buf, &ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestBuildClientContext(t *testing.T) {
+	user, err := parseClientContext(`{"custom": {"nodeless_user": "bot", "k": "v"}, "env": {"locale": "ja"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attribution := map[string]string{"nodeless_user": "alice", "nodeless_host": "build-01"}
+	encoded, err := buildClientContext(user, attribution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := decodeClientContext(t, encoded)
+	custom := cc["custom"].(map[string]interface{})
+	if custom["nodeless_user"] != "bot" || custom["k"] != "v" || custom["nodeless_host"] != "build-01" {
+		t.Errorf("the user's values must win, got %v", custom)
+	}
+	if cc["env"].(map[string]interface{})["locale"] != "ja" {
+		t.Errorf("got %v", cc)
+	}
+	if _, ok := user["custom"].(map[string]interface{})["nodeless_host"]; ok {
+		t.Errorf("the user's ClientContext must not be modified")
+	}
+
+	// nothing to send
+	encoded, err = buildClientContext(map[string]interface{}{}, nil)
+	if err != nil || encoded != "" {
+		t.Errorf("got %q, %v", encoded, err)
+	}
+	encoded, err = buildClientContext(map[string]interface{}{}, attribution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeClientContext(t, encoded)["custom"].(map[string]interface{}); len(got) != 2 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestBuildClientContextSize(t *testing.T) {
+	attribution := map[string]string{
+		"nodeless_user":   "alice",
+		"nodeless_ci_url": strings.Repeat("u", maxAttributionValue),
+	}
+	// leaves room for the user but not for the CI URL
+	big := map[string]interface{}{"custom": map[string]interface{}{"big": strings.Repeat("x", 2500)}}
+	encoded, err := buildClientContext(big, attribution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) > maxClientContextSize {
+		t.Errorf("got %d bytes", len(encoded))
+	}
+	custom := decodeClientContext(t, encoded)["custom"].(map[string]interface{})
+	if _, ok := custom["nodeless_ci_url"]; ok {
+		t.Errorf("the CI URL must be dropped first, got %v", custom)
+	}
+	if custom["nodeless_user"] != "alice" {
+		t.Errorf("got %v", custom)
+	}
+
+	tooBig := map[string]interface{}{"custom": map[string]interface{}{"big": strings.Repeat("x", 3000)}}
+	if _, err := buildClientContext(tooBig, attribution); err == nil {
+		t.Errorf("the user's ClientContext over the limit must be an error")
+	}
+}
+
+func TestParseClientContext(t *testing.T) {
+	for _, s := range []string{`[]`, `"s"`, `null`, `{"custom": "s"}`, `{`} {
+		if _, err := parseClientContext(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-client-context", `{"custom": {"k": "v"}}`, "-no-attribution"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.noAttribution || config.clientContext["custom"].(map[string]interface{})["k"] != "v" {
+		t.Errorf("got %+v", config)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-client-context", `{"custom": {"k": "` + strings.Repeat("x", 3000) + `"}}`}, noenv); err == nil {
+		t.Errorf("a ClientContext over the limit must be an error")
+	}
+
+	path := filepath.Join(t.TempDir(), "context.json")
+	if err := ioutil.WriteFile(path, []byte(`{"custom": {"correlation_id": "c-1"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err = parseArgs([]string{"-func", "f", "-client-context", "@" + path}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := correlationID(config.clientContext); got != "c-1" {
+		t.Errorf("got %s", got)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-client-context", "@" + path + ".missing"}, noenv); err == nil || !strings.Contains(err.Error(), "client-context") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	for _, tt := range []struct {
+		cc   string
+		want string
+	}{
+		{`{}`, ""},
+		{`{"custom": {"k": "v"}}`, ""},
+		{`{"custom": {"traceId": "t-1", "correlationId": "c-1"}}`, "c-1"},
+		{`{"custom": {"trace_id": "t-1"}}`, "t-1"},
+		{`{"custom": {"correlation_id": 1, "trace_id": "t-1"}}`, "t-1"},
+	} {
+		cc, err := parseClientContext(tt.cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := correlationID(cc); got != tt.want {
+			t.Errorf("%s: got %q", tt.cc, got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureDefaultAuthorityHost = "https://login.microsoftonline.com/"
+	azureDefaultIMDSHost      = "169.254.169.254"
+	azureTokenExpiryWindow    = time.Minute // a token expiring sooner is refreshed
+)
+
+// azureCredentials get Microsoft Entra ID tokens, like DefaultAzureCredential of the Azure SDKs
+type azureCredentials interface {
+	// token returns an access token of the resource, ex: https://api.applicationinsights.io
+	token(ctx context.Context, resource string) (azureToken, error)
+	// kind returns the kind of the credentials, ex: "workload_identity"
+	kind() string
+}
+
+// azureToken is an access token of Entra ID
+type azureToken struct {
+	value  string
+	expiry time.Time
+}
+
+// findAzureCredentials returns the credentials of the environment: the federated token of AKS
+// workload identity, a client secret of a service principal, or else the managed identity of IMDS
+func findAzureCredentials(getenv func(string) string, client *http.Client) azureCredentials {
+	tenant, clientID := getenv("AZURE_TENANT_ID"), getenv("AZURE_CLIENT_ID")
+	authority := getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = azureDefaultAuthorityHost
+	}
+	tokenURL := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+	if file := getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" && tenant != "" && clientID != "" {
+		return &azureClientCredentials{tokenURL: tokenURL, clientID: clientID, assertionFile: file, client: client}
+	}
+	if secret := getenv("AZURE_CLIENT_SECRET"); secret != "" && tenant != "" && clientID != "" {
+		return &azureClientCredentials{tokenURL: tokenURL, clientID: clientID, secret: secret, client: client}
+	}
+	host := getenv("AZURE_IMDS_HOST")
+	if host == "" {
+		host = azureDefaultIMDSHost
+	}
+	return &azureManagedIdentity{host: host, clientID: clientID, client: client}
+}
+
+// azureTokenResponse is the response of the token endpoints. IMDS returns the numbers as strings.
+type azureTokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func (r *azureTokenResponse) token(now time.Time) azureToken {
+	seconds, _ := strconv.ParseInt(r.ExpiresIn.String(), 10, 64)
+	return azureToken{value: r.AccessToken, expiry: now.Add(time.Duration(seconds) * time.Second)}
+}
+
+// readAzureTokenResponse reads the token of a response, or its error
+func readAzureTokenResponse(resp *http.Response, what string) (azureToken, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return azureToken{}, fmt.Errorf("%s: %w", what, err)
+	}
+	var r azureTokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return azureToken{}, fmt.Errorf("%s: %s: %s", what, resp.Status, truncateMiddle(string(body), 512))
+	}
+	if resp.StatusCode != http.StatusOK || r.AccessToken == "" {
+		return azureToken{}, fmt.Errorf("%s: %s: %s %s", what, resp.Status, r.Error, r.ErrorDescription)
+	}
+	return r.token(time.Now()), nil
+}
+
+// azureClientCredentials are a service principal, authenticated by a secret or by the federated
+// token which AKS workload identity projects into the pod
+type azureClientCredentials struct {
+	tokenURL      string
+	clientID      string
+	secret        string
+	assertionFile string
+	client        *http.Client
+}
+
+func (c *azureClientCredentials) kind() string {
+	if c.assertionFile != "" {
+		return "workload_identity"
+	}
+	return "client_secret"
+}
+
+func (c *azureClientCredentials) token(ctx context.Context, resource string) (azureToken, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {c.clientID},
+		"scope":      {strings.TrimSuffix(resource, "/") + "/.default"},
+	}
+	if c.assertionFile != "" {
+		// the file is rotated by kubelet, so it is read every time
+		assertion, err := ioutil.ReadFile(c.assertionFile)
+		if err != nil {
+			return azureToken{}, fmt.Errorf("AZURE_FEDERATED_TOKEN_FILE: %w", err)
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	} else {
+		form.Set("client_secret", c.secret)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return azureToken{}, fmt.Errorf("entra id token: %w", err)
+	}
+	return readAzureTokenResponse(resp, "entra id token")
+}
+
+// azureManagedIdentity is the managed identity of the VM or the node, by the instance metadata service
+type azureManagedIdentity struct {
+	host     string
+	clientID string // of a user-assigned identity, "" for the system-assigned one
+	client   *http.Client
+}
+
+func (c *azureManagedIdentity) kind() string { return "managed_identity" }
+
+func (c *azureManagedIdentity) token(ctx context.Context, resource string) (azureToken, error) {
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+	if c.clientID != "" {
+		q.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.host+"/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return azureToken{}, fmt.Errorf("no Azure credentials, set AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or use workload identity: %w", err)
+	}
+	return readAzureTokenResponse(resp, "managed identity token")
+}
+
+// azureTokenCache reuses the token of a resource until it is about to expire
+type azureTokenCache struct {
+	creds azureCredentials
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]azureToken
+}
+
+func newAzureTokenCache(creds azureCredentials) *azureTokenCache {
+	return &azureTokenCache{creds: creds, now: time.Now, tokens: make(map[string]azureToken)}
+}
+
+func (c *azureTokenCache) token(ctx context.Context, resource string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[resource]; ok && c.now().Add(azureTokenExpiryWindow).Before(t.expiry) {
+		return t.value, nil
+	}
+	t, err := c.creds.token(ctx, resource)
+	if err != nil {
+		return "", err
+	}
+	c.tokens[resource] = t
+	return t.value, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindAzureCredentials(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	if c := findAzureCredentials(getenv, http.DefaultClient); c.kind() != "managed_identity" || c.(*azureManagedIdentity).host != azureDefaultIMDSHost {
+		t.Errorf("got %+v", c)
+	}
+	env["AZURE_TENANT_ID"], env["AZURE_CLIENT_ID"], env["AZURE_CLIENT_SECRET"] = "tenant", "client", "secret"
+	c := findAzureCredentials(getenv, http.DefaultClient)
+	if c.kind() != "client_secret" || c.(*azureClientCredentials).tokenURL != "https://login.microsoftonline.com/tenant/oauth2/v2.0/token" {
+		t.Errorf("got %+v", c)
+	}
+	// workload identity wins, as DefaultAzureCredential
+	env["AZURE_FEDERATED_TOKEN_FILE"], env["AZURE_AUTHORITY_HOST"] = "/var/run/secrets/azure/tokens/azure-identity-token", "https://login.example/"
+	c = findAzureCredentials(getenv, http.DefaultClient)
+	if c.kind() != "workload_identity" || c.(*azureClientCredentials).tokenURL != "https://login.example/tenant/oauth2/v2.0/token" {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestAzureClientCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("federated-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests++
+		if r.Form.Get("scope") != "https://api.applicationinsights.io/.default" || r.Form.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_scope", "error_description": "AADSTS70011"}`)
+			return
+		}
+		if r.Form.Get("client_secret") != "secret" && r.Form.Get("client_assertion") != "federated-jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client", "error_description": "AADSTS7000215"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "eyJ.entra", "expires_in": 3599, "token_type": "Bearer"}`)
+	}))
+	defer ts.Close()
+
+	for _, c := range []*azureClientCredentials{
+		{tokenURL: ts.URL, clientID: "client", secret: "secret", client: ts.Client()},
+		{tokenURL: ts.URL, clientID: "client", assertionFile: tokenFile, client: ts.Client()},
+	} {
+		cache := newAzureTokenCache(c)
+		for i := 0; i < 2; i++ {
+			if tok, err := cache.token(context.Background(), azureAppInsightsEndpoint); err != nil || tok != "eyJ.entra" {
+				t.Errorf("%s: got %s, %v", c.kind(), tok, err)
+			}
+		}
+	}
+	if requests != 2 {
+		t.Errorf("the token is cached, got %d requests", requests)
+	}
+
+	c := &azureClientCredentials{tokenURL: ts.URL, clientID: "client", secret: "wrong", client: ts.Client()}
+	if _, err := c.token(context.Background(), azureAppInsightsEndpoint); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Path != "/metadata/identity/oauth2/token" || r.URL.Query().Get("client_id") != "uami" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// IMDS returns the numbers as strings
+		fmt.Fprintf(w, `{"access_token": "eyJ.mi", "expires_in": "86399", "resource": %q}`, r.URL.Query().Get("resource"))
+	}))
+	defer ts.Close()
+
+	c := &azureManagedIdentity{host: strings.TrimPrefix(ts.URL, "http://"), clientID: "uami", client: ts.Client()}
+	tok, err := c.token(context.Background(), azureAppInsightsEndpoint)
+	if err != nil || tok.value != "eyJ.mi" || tok.expiry.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("got %+v, %v", tok, err)
+	}
+
+	ts.Close()
+	if _, err := c.token(context.Background(), azureAppInsightsEndpoint); err == nil || !strings.Contains(err.Error(), "AZURE_CLIENT_SECRET") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestReadAzureTokenResponse reads the sample responses of the Microsoft identity platform and of
+// the managed identity documentation. There is no signature to check, a token is a bearer token.
+func TestReadAzureTokenResponse(t *testing.T) {
+	respond := func(status int, body string) *http.Response {
+		return &http.Response{StatusCode: status, Status: fmt.Sprintf("%d %s", status, http.StatusText(status)), Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+	for _, tc := range []struct {
+		name, body string
+		status     int
+		expiresIn  time.Duration
+		err        string
+	}{
+		{
+			name:      "client credentials",
+			status:    http.StatusOK,
+			body:      `{"token_type": "Bearer", "expires_in": 3599, "access_token": "eyJ0eXAiOiJKV1QiLCJhbGciOiJSUzI1NiIsIng1dCI6Ik1uQ19WWmNBVGZNNXBP"}`,
+			expiresIn: 3599 * time.Second,
+		},
+		{
+			name:   "managed identity",
+			status: http.StatusOK,
+			body: `{"access_token": "eyJ0eXAi", "refresh_token": "", "expires_in": "3599", "expires_on": "1506484173",
+				"not_before": "1506480273", "resource": "https://management.azure.com/", "token_type": "Bearer"}`,
+			expiresIn: 3599 * time.Second,
+		},
+		{
+			name:   "invalid scope",
+			status: http.StatusBadRequest,
+			body: `{"error": "invalid_scope", "error_description": "AADSTS70011: The provided value for the input parameter 'scope' is not valid.",
+				"error_codes": [70011], "timestamp": "2016-01-09 02:02:12Z", "trace_id": "255d1aef-8c98-452f-ac51-23d051240864"}`,
+			err: "400 Bad Request: invalid_scope AADSTS70011",
+		},
+	} {
+		before := time.Now()
+		tok, err := readAzureTokenResponse(respond(tc.status, tc.body), "token")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || tok.value == "" || tok.expiry.Before(before.Add(tc.expiresIn)) || tok.expiry.After(time.Now().Add(tc.expiresIn)) {
+			t.Errorf("%s: got %+v, %v", tc.name, tok, err)
+		}
+	}
+}
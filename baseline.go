@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// baselineVersion is the version of the baseline file format
+const baselineVersion = schema.BaselineVersion
+
+const defaultBaselineTolerance = "10%"
+
+// percentiles of a metric over the samples of a run
+type percentiles = schema.Percentiles
+
+// baselineEntry is the summary metrics of a run which later runs are compared against
+type baselineEntry = schema.BaselineEntry
+
+// baselineFile holds the baselines of several functions and payloads, keyed by baselineKey
+type baselineFile = schema.BaselineFile
+
+// baselineKey returns the key of a baseline. A run is only compared with a run of the same payload.
+func baselineKey(function, qualifier, payloadSHA256 string) string {
+	name := function
+	if qualifier != "" {
+		name += ":" + qualifier
+	}
+	return name + "@sha256:" + payloadSHA256
+}
+
+// entryKey returns the key of the baseline of e
+func entryKey(e *baselineEntry) string {
+	return baselineKey(e.Function, e.Qualifier, e.PayloadSHA256)
+}
+
+// newBaselineEntry summarizes the REPORT metrics of the requests of a run
+func newBaselineEntry(function, qualifier, payloadSHA256 string, reports []reportMetrics) *baselineEntry {
+	var duration, billed, memory, restore []float64
+	cold := 0
+	for _, r := range reports {
+		duration = append(duration, r.Duration)
+		billed = append(billed, r.BilledDuration)
+		memory = append(memory, r.MaxMemoryUsed)
+		switch startType(&r) {
+		case startCold:
+			cold++
+		case startSnapStartRestore:
+			restore = append(restore, r.RestoreDuration)
+		}
+	}
+	e := &baselineEntry{
+		Function:       function,
+		Qualifier:      qualifier,
+		PayloadSHA256:  payloadSHA256,
+		Samples:        len(reports),
+		Duration:       percentilesOf(duration),
+		BilledDuration: percentilesOf(billed),
+		MaxMemoryUsed:  percentilesOf(memory),
+		ColdStarts:     cold,
+		Restores:       len(restore),
+		SavedAt:        time.Now().UTC(),
+	}
+	if len(restore) > 0 {
+		p := percentilesOf(restore)
+		e.RestoreDuration = &p
+	}
+	return e
+}
+
+func percentilesOf(values []float64) percentiles {
+	return percentiles{P50: percentile(values, 50), P90: percentile(values, 90)}
+}
+
+// percentile returns the p-th percentile of values by the nearest rank. A single sample is every percentile.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// coldStartRatio returns the ratio of the samples which were cold starts
+func coldStartRatio(e *baselineEntry) float64 {
+	if e.Samples == 0 {
+		return 0
+	}
+	return float64(e.ColdStarts) / float64(e.Samples)
+}
+
+// parseTolerance parses a tolerance in percent, ex: "20%" or "20", and returns it as a ratio
+func parseTolerance(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("tolerance must be a percentage, ex: 20%%, %q", s)
+	}
+	if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("tolerance must not be negative, %q", s)
+	}
+	return v / 100, nil
+}
+
+// baselineComparison is a metric of the current run compared with the baseline
+type baselineComparison struct {
+	Metric    string
+	Baseline  float64
+	Current   float64
+	Regressed bool
+}
+
+func (c baselineComparison) String() string {
+	change := "n/a"
+	if c.Baseline != 0 {
+		change = fmt.Sprintf("%+.1f%%", (c.Current-c.Baseline)/c.Baseline*100)
+	}
+	return fmt.Sprintf("%s %.2f -> %.2f (%s)", c.Metric, c.Baseline, c.Current, change)
+}
+
+// compareBaseline compares every metric of cur with base. A metric regresses when it grows beyond
+// tolerance, and the cold start ratio regresses when it grows at all.
+func compareBaseline(base, cur *baselineEntry, tolerance float64) []baselineComparison {
+	var ret []baselineComparison
+	add := func(metric string, b, c percentiles) {
+		for _, p := range []struct {
+			name string
+			b, c float64
+		}{{"p50", b.P50, c.P50}, {"p90", b.P90, c.P90}} {
+			ret = append(ret, baselineComparison{
+				Metric:    metric + " " + p.name,
+				Baseline:  p.b,
+				Current:   p.c,
+				Regressed: p.c > p.b*(1+tolerance),
+			})
+		}
+	}
+	add("duration_ms", base.Duration, cur.Duration)
+	add("billed_duration_ms", base.BilledDuration, cur.BilledDuration)
+	add("max_memory_used_mb", base.MaxMemoryUsed, cur.MaxMemoryUsed)
+	if base.RestoreDuration != nil && cur.RestoreDuration != nil {
+		add("restore_duration_ms", *base.RestoreDuration, *cur.RestoreDuration)
+	}
+	ret = append(ret, baselineComparison{
+		Metric:    "cold_start_ratio",
+		Baseline:  coldStartRatio(base),
+		Current:   coldStartRatio(cur),
+		Regressed: coldStartRatio(cur) > coldStartRatio(base),
+	})
+	return ret
+}
+
+// loadBaselineFile reads the baseline file. A missing file has no baselines.
+func loadBaselineFile(path string) (*baselineFile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &baselineFile{Version: baselineVersion, Baselines: make(map[string]*baselineEntry)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read baseline, %s: %w", path, err)
+	}
+	var f baselineFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, fmt.Errorf("baseline %s: %w", path, err)
+	}
+	if f.Version != baselineVersion {
+		return nil, fmt.Errorf("baseline %s: unsupported version %d", path, f.Version)
+	}
+	if f.Baselines == nil {
+		f.Baselines = make(map[string]*baselineEntry)
+	}
+	return &f, nil
+}
+
+// saveBaselineEntry records e into the baseline file at path, keeping the baselines of other keys
+func saveBaselineEntry(path string, e *baselineEntry) error {
+	f, err := loadBaselineFile(path)
+	if err != nil {
+		return err
+	}
+	f.Baselines[entryKey(e)] = e
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("write baseline, %s: %w", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// baselineCheck compares a run with the baseline file and saves baselines, from -baseline and friends
+type baselineCheck struct {
+	path      string  // compared with, -baseline
+	tolerance float64 // ratio a metric may grow
+	savePath  string  // written without comparing, -save-baseline
+	update    bool    // rewrite path with the run instead of failing
+}
+
+// apply compares cur with its baseline and saves it as requested. A regression is a function error
+// which lists the regressed metrics.
+func (c *baselineCheck) apply(cur *baselineEntry) error {
+	if cur.Samples == 0 {
+		logger.Warnf("no REPORT of the run, the baseline is not compared nor saved")
+		return nil
+	}
+	if c.savePath != "" {
+		if err := saveBaselineEntry(c.savePath, cur); err != nil {
+			return err
+		}
+		logger.Infof("baseline of %s is saved to %s", entryKey(cur), c.savePath)
+	}
+	if c.path == "" {
+		return nil
+	}
+
+	f, err := loadBaselineFile(c.path)
+	if err != nil {
+		return err
+	}
+	base, ok := f.Baselines[entryKey(cur)]
+	if !ok {
+		if c.update {
+			if err := saveBaselineEntry(c.path, cur); err != nil {
+				return err
+			}
+			logger.Infof("baseline of %s is recorded to %s", entryKey(cur), c.path)
+			return nil
+		}
+		logger.Warnf("no baseline of %s in %s, use -update-baseline to record it", entryKey(cur), c.path)
+		return nil
+	}
+
+	var regressed []string
+	for _, cmp := range compareBaseline(base, cur, c.tolerance) {
+		if cmp.Regressed {
+			regressed = append(regressed, cmp.String())
+			logger.Warnf("baseline %s, regressed", cmp)
+		} else {
+			logger.Infof("baseline %s", cmp)
+		}
+	}
+	if c.update {
+		if err := saveBaselineEntry(c.path, cur); err != nil {
+			return err
+		}
+		logger.Infof("baseline of %s is updated in %s", entryKey(cur), c.path)
+		return nil
+	}
+	if len(regressed) > 0 {
+		return &functionError{fmt.Errorf("regressed against the baseline %s beyond %s%%: %s",
+			c.path, strconv.FormatFloat(c.tolerance*100, 'f', -1, 64), strings.Join(regressed, ", "))}
+	}
+	return nil
+}
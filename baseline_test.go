@@ -0,0 +1,235 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTolerance(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"20%", 0.2, false},
+		{"20", 0.2, false},
+		{" 5.5% ", 0.055, false},
+		{"0%", 0, false},
+		{"150%", 1.5, false},
+		{"-1%", 0, true},
+		{"20%%", 0, true},
+		{"twenty", 0, true},
+		{"", 0, true},
+		{"NaN", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTolerance(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if !tt.wantErr && (got-tt.want > 1e-9 || tt.want-got > 1e-9) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{5, 1, 4, 2, 3, 10, 9, 8, 7, 6}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{50, 5},
+		{90, 9},
+		{100, 10},
+		{0, 1},
+	}
+	for _, tt := range tests {
+		if got := percentile(values, tt.p); got != tt.want {
+			t.Errorf("p%v: got %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile([]float64{42}, 90); got != 42 {
+		t.Errorf("a single sample is every percentile, got %v", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("got %v", got)
+	}
+	if values[0] != 5 {
+		t.Errorf("values must not be sorted in place")
+	}
+}
+
+func TestBaselineKey(t *testing.T) {
+	if got := baselineKey("f", "live", "abc"); got != "f:live@sha256:abc" {
+		t.Errorf("got %s", got)
+	}
+	if got := baselineKey("f", "", "abc"); got != "f@sha256:abc" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func regressedMetrics(cmps []baselineComparison) []string {
+	var ret []string
+	for _, c := range cmps {
+		if c.Regressed {
+			ret = append(ret, c.Metric)
+		}
+	}
+	return ret
+}
+
+func TestCompareBaseline(t *testing.T) {
+	report := func(duration, memory float64, cold bool) reportMetrics {
+		return reportMetrics{Duration: duration, BilledDuration: duration, MaxMemoryUsed: memory, ColdStart: cold}
+	}
+	base := newBaselineEntry("f", "", "h", []reportMetrics{report(100, 64, false)})
+
+	tests := []struct {
+		name    string
+		reports []reportMetrics
+		want    string
+	}{
+		{"same", []reportMetrics{report(100, 64, false)}, ""},
+		{"faster", []reportMetrics{report(50, 32, false)}, ""},
+		{"within tolerance", []reportMetrics{report(120, 76, false)}, ""},
+		{"slower", []reportMetrics{report(121, 64, false)}, "duration_ms p50,duration_ms p90,billed_duration_ms p50,billed_duration_ms p90"},
+		{"more memory", []reportMetrics{report(100, 80, false)}, "max_memory_used_mb p50,max_memory_used_mb p90"},
+		{"cold", []reportMetrics{report(100, 64, true)}, "cold_start_ratio"},
+		// one slow sample in ten moves p90 only
+		{"tail", []reportMetrics{
+			report(100, 64, false), report(100, 64, false), report(100, 64, false), report(100, 64, false), report(100, 64, false),
+			report(100, 64, false), report(100, 64, false), report(100, 64, false), report(300, 64, false), report(300, 64, false),
+		}, "duration_ms p90,billed_duration_ms p90"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := newBaselineEntry("f", "", "h", tt.reports)
+			got := strings.Join(regressedMetrics(compareBaseline(base, cur, 0.2)), ",")
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// a cold start in the baseline allows a cold start
+	coldBase := newBaselineEntry("f", "", "h", []reportMetrics{report(100, 64, true)})
+	if got := regressedMetrics(compareBaseline(coldBase, newBaselineEntry("f", "", "h", []reportMetrics{report(100, 64, true)}), 0.2)); len(got) > 0 {
+		t.Errorf("got %v", got)
+	}
+
+	// a restore is not a cold start, and its duration is compared with the restores of the baseline
+	restore := func(d float64) reportMetrics {
+		return reportMetrics{Duration: 100, BilledDuration: 100, MaxMemoryUsed: 64, RestoreDuration: d}
+	}
+	restoreBase := newBaselineEntry("f", "", "h", []reportMetrics{restore(300)})
+	if restoreBase.ColdStarts != 0 || restoreBase.Restores != 1 {
+		t.Errorf("got %+v", restoreBase)
+	}
+	if got := regressedMetrics(compareBaseline(restoreBase, newBaselineEntry("f", "", "h", []reportMetrics{restore(320)}), 0.2)); len(got) > 0 {
+		t.Errorf("got %v", got)
+	}
+	got := strings.Join(regressedMetrics(compareBaseline(restoreBase, newBaselineEntry("f", "", "h", []reportMetrics{restore(400)}), 0.2)), ",")
+	if got != "restore_duration_ms p50,restore_duration_ms p90" {
+		t.Errorf("got %q", got)
+	}
+	if got := regressedMetrics(compareBaseline(base, newBaselineEntry("f", "", "h", []reportMetrics{restore(400)}), 0.2)); len(got) > 0 {
+		t.Errorf("no restore in the baseline compares no restore duration, got %v", got)
+	}
+}
+
+func TestBaselineComparisonString(t *testing.T) {
+	c := baselineComparison{Metric: "duration_ms p50", Baseline: 100, Current: 125}
+	if got := c.String(); got != "duration_ms p50 100.00 -> 125.00 (+25.0%)" {
+		t.Errorf("got %s", got)
+	}
+	c = baselineComparison{Metric: "cold_start_ratio", Baseline: 0, Current: 1}
+	if got := c.String(); got != "cold_start_ratio 0.00 -> 1.00 (n/a)" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestBaselineCheckApply(t *testing.T) {
+	setTestLogger(t)
+	path := filepath.Join(t.TempDir(), "perf", "baseline.json")
+	entry := func(function string, duration float64) *baselineEntry {
+		return newBaselineEntry(function, "live", "h", []reportMetrics{{Duration: duration, BilledDuration: duration, MaxMemoryUsed: 64}})
+	}
+
+	// saved without comparing
+	save := &baselineCheck{savePath: path, tolerance: 0.2}
+	if err := save.apply(entry("f", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := save.apply(entry("g", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadBaselineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Baselines) != 2 || f.Baselines["f:live@sha256:h"].Duration.P50 != 100 {
+		t.Fatalf("baselines of other keys must be kept, got %+v", f.Baselines)
+	}
+
+	check := &baselineCheck{path: path, tolerance: 0.2}
+	if err := check.apply(entry("f", 110)); err != nil {
+		t.Errorf("within tolerance, got %s", err)
+	}
+	err = check.apply(entry("f", 200))
+	if err == nil || !isFunctionError(err) {
+		t.Fatalf("a regression must be a function error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "duration_ms p50 100.00 -> 200.00 (+100.0%)") || !strings.Contains(err.Error(), "beyond 20%") {
+		t.Errorf("the regressed metrics must be reported, got %s", err)
+	}
+	// an unknown key is not compared
+	if err := check.apply(entry("h", 200)); err != nil {
+		t.Errorf("got %s", err)
+	}
+	// no REPORT
+	if err := check.apply(newBaselineEntry("f", "live", "h", nil)); err != nil {
+		t.Errorf("got %s", err)
+	}
+
+	update := &baselineCheck{path: path, tolerance: 0.2, update: true}
+	if err := update.apply(entry("f", 200)); err != nil {
+		t.Fatalf("-update-baseline must not fail, got %s", err)
+	}
+	if err := update.apply(entry("h", 50)); err != nil {
+		t.Fatal(err)
+	}
+	f, err = loadBaselineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Baselines) != 3 || f.Baselines["f:live@sha256:h"].Duration.P50 != 200 {
+		t.Errorf("got %+v", f.Baselines)
+	}
+	if err := check.apply(entry("f", 200)); err != nil {
+		t.Errorf("the updated baseline must be compared, got %s", err)
+	}
+}
+
+func TestParseArgsBaseline(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-baseline", "b.json", "-baseline-tolerance", "25%"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.baseline == nil || config.baseline.path != "b.json" || config.baseline.tolerance != 0.25 {
+		t.Errorf("got %+v", config.baseline)
+	}
+	config, err = parseArgs([]string{"-func", "f"}, noenv)
+	if err != nil || config.baseline != nil {
+		t.Errorf("got %+v, %v", config.baseline, err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-update-baseline"}, noenv); err == nil {
+		t.Errorf("-update-baseline without -baseline must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-baseline", "b.json", "-baseline-tolerance", "x"}, noenv); err == nil {
+		t.Errorf("invalid tolerance must be an error")
+	}
+}
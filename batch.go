@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// loadPayloadNDJSON returns the payloads of -payload-ndjson, one by line, with their line numbers.
+// Blank lines are skipped, and every other line must be a JSON value.
+func loadPayloadNDJSON(path string) ([]string, []int, error) {
+	if err := checkPayloadFile(path); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, payloadPathError(path, err)
+	}
+	defer f.Close()
+
+	var payloads []string
+	var lines []int
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), maxSyncPayloadSize+1)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return nil, nil, fmt.Errorf("line %d of %s is not JSON", n, path)
+		}
+		payloads = append(payloads, line)
+		lines = append(lines, n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read payload file, %s: %w", path, err)
+	}
+	if len(payloads) == 0 {
+		return nil, nil, fmt.Errorf("payload file %s has no line to invoke", path)
+	}
+	return payloads, lines, nil
+}
+
+// payloadSize returns the size of the largest payload, which decides the invocation type
+func (sl *AWSServerless) payloadSize() int {
+	if sl.concurrent == nil || sl.concurrent.payloads == nil {
+		return len(sl.payload)
+	}
+	ret := 0
+	for _, p := range sl.concurrent.payloads {
+		if len(p) > ret {
+			ret = len(p)
+		}
+	}
+	return ret
+}
+
+// writeReport writes the result of each line of -payload-ndjson to -batch-report
+func (c *concurrentRun) writeReport(functionName string, summary *summaryBuilder) error {
+	if c == nil || c.reportPath == "" {
+		return nil
+	}
+	report := schema.BatchReport{
+		Version:      schema.BatchReportVersion,
+		FunctionName: functionName,
+		PayloadFile:  c.payloadFile,
+		Items:        c.requestsOf(summary),
+	}
+	if report.Items == nil {
+		// the run stopped before invoking
+		return nil
+	}
+	for _, r := range report.Items {
+		switch r.Status {
+		case requestSucceeded:
+			report.Succeeded++
+		case requestFailed:
+			report.Failed++
+		case requestSkipped:
+			report.Skipped++
+		}
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.reportPath, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("write batch report, %s: %w", c.reportPath, err)
+	}
+	logger.Infof("%d succeeded, %d failed and %d skipped of %d lines, the report is written to %s", report.Succeeded, report.Failed, report.Skipped, len(report.Items), c.reportPath)
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+func TestLoadPayloadNDJSON(t *testing.T) {
+	payloads, lines, err := loadPayloadNDJSON(filepath.Join("testdata", "batch", "orders.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 3 || payloads[2] != `{"id": 3, "note": "the third order"}` || len(lines) != 3 || lines[2] != 4 {
+		t.Errorf("got %q %v", payloads, lines)
+	}
+
+	dir := t.TempDir()
+	for content, want := range map[string]string{
+		"{\"id\": 1}\n{\"id\": \n": "line 2 of",
+		"\n  \n":                   "has no line to invoke",
+	} {
+		path := filepath.Join(dir, "in.ndjson")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadPayloadNDJSON(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v", content, err)
+		}
+	}
+}
+
+func TestPayloadNDJSONFailFast(t *testing.T) {
+	setTestLogger(t)
+	report := filepath.Join(t.TempDir(), "report.json")
+	c := &concurrentRun{
+		n:          3,
+		payloads:   []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`},
+		lines:      []int{1, 2, 4},
+		workers:    1,
+		failFast:   true,
+		reportPath: report,
+		timeout:    time.Minute,
+	}
+	sl := &AWSServerless{funcName: "orders-fn", phases: newPhaseTracker(time.Now()), concurrent: c}
+	api := &countingInvoke{fail: map[int]error{2: awserr.New(lambda.ErrCodeInvalidRequestContentException, "Could not parse request body", nil)}}
+	if err := sl.invokeConcurrently(context.Background(), api, lambda.InvocationTypeEvent); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(api.payloads, ",") != `{"id": 1},{"id": 2}` {
+		t.Errorf("the line after the failure must not be invoked, got %v", api.payloads)
+	}
+	var fe *functionError
+	if !errors.As(sl.responseErr, &fe) || !strings.Contains(sl.responseErr.Error(), "line 2: ") || !strings.Contains(sl.responseErr.Error(), "1 are skipped") {
+		t.Errorf("got %v", sl.responseErr)
+	}
+
+	summary := newSummaryBuilder()
+	for _, line := range lifecycleLines("r1") {
+		c.tracker.ObserveLine("s1", line)
+	}
+	if err := c.writeReport("orders-fn", summary); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got schema.BatchReport
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Succeeded != 1 || got.Failed != 1 || got.Skipped != 1 || len(got.Items) != 3 {
+		t.Fatalf("got %s", buf)
+	}
+	want := []schema.ConcurrentRequest{
+		{Line: 1, RequestID: "r1", Status: requestSucceeded, State: "Reported"},
+		{Line: 2, Status: requestFailed},
+		{Line: 4, Status: requestSkipped},
+	}
+	for i, w := range want {
+		r := got.Items[i]
+		if r.Line != w.Line || r.RequestID != w.RequestID || r.Status != w.Status || r.State != w.State || (w.Status == requestFailed) != (r.Error != "") {
+			t.Errorf("item %d: got %+v", i, r)
+		}
+	}
+}
+
+func TestPayloadNDJSONWorkers(t *testing.T) {
+	setTestLogger(t)
+	payloads := []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`, `{"id": 4}`}
+	c := &concurrentRun{n: 4, payloads: payloads, lines: []int{1, 2, 3, 4}, workers: 2, timeout: time.Minute}
+	sl := &AWSServerless{funcName: "orders-fn", phases: newPhaseTracker(time.Now()), concurrent: c}
+	api := &countingInvoke{fail: map[int]error{1: errors.New("connection reset")}}
+	if err := sl.invokeConcurrently(context.Background(), api, lambda.InvocationTypeEvent); err != nil {
+		t.Fatal(err)
+	}
+	// a failure does not stop the other lines without -fail-fast
+	if len(api.payloads) != 4 || len(c.tracker.ids) != 3 || !strings.Contains(sl.responseErr.Error(), "1 of 4 invocations failed") {
+		t.Errorf("got %v %v %v", api.payloads, c.tracker.ids, sl.responseErr)
+	}
+	seen := make(map[string]bool)
+	for _, p := range api.payloads {
+		seen[p] = true
+	}
+	for _, p := range payloads {
+		if !seen[p] {
+			t.Errorf("%s is not invoked", p)
+		}
+	}
+}
+
+// TestPayloadNDJSONLabels runs five lines at once, one of which is not invoked, and checks that the label of
+// each invocation is the same on the console, in the JSON records, in the failures, the summary and the report
+func TestPayloadNDJSONLabels(t *testing.T) {
+	logs := setTestLogger(t)
+	report := filepath.Join(t.TempDir(), "report.json")
+	c := &concurrentRun{
+		n:          5,
+		payloads:   []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`, `{"id": 4}`, `{"id": 5}`},
+		lines:      []int{1, 2, 3, 5, 6},
+		workers:    5,
+		reportPath: report,
+		timeout:    time.Minute,
+	}
+	text, textLines := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	records, recordLines := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	records.json = true
+	sl := &AWSServerless{
+		funcName:   "orders-fn",
+		startTime:  time.Now(),
+		emitter:    text,
+		bus:        newBus(),
+		summary:    newSummaryBuilder(),
+		phases:     newPhaseTracker(time.Now()),
+		concurrent: c,
+	}
+	sl.bus.subscribe("console", text, subscribeOptions{})
+	sl.bus.subscribe("records", records, subscribeOptions{})
+	sl.bus.subscribe("summary", sl.summary, subscribeOptions{})
+	api := &countingInvoke{fail: map[int]error{3: awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.", nil)}}
+	if err := sl.invokeConcurrently(context.Background(), api, lambda.InvocationTypeEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	// the workers call in any order, the label follows the line whatever request id it gets
+	labels := map[string]string{}
+	failed := ""
+	for n, payload := range api.payloads {
+		for i, p := range c.payloads {
+			if p != payload {
+				continue
+			}
+			if n+1 == 3 {
+				failed = c.item(i)
+				continue
+			}
+			labels[fmt.Sprintf("r%d", n+1)] = c.label(i)
+		}
+	}
+	if len(labels) != 4 || failed == "" {
+		t.Fatalf("got %v %q", labels, failed)
+	}
+	if !strings.Contains(sl.responseErr.Error(), failed+": ") {
+		t.Errorf("the failure is not labeled %s: %v", failed, sl.responseErr)
+	}
+
+	// a stream runs one invocation after another
+	streams := map[string][]string{}
+	for n := 1; n <= 5; n++ {
+		if id := fmt.Sprintf("r%d", n); labels[id] != "" {
+			stream := []string{"s1", "s2"}[n%2]
+			streams[stream] = append(streams[stream], lifecycleLines(id)...)
+		}
+	}
+	sl.logClient = &deniedLogs{streams: streams}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/orders-fn"); err != nil {
+		t.Fatal(err)
+	}
+	for id, label := range labels {
+		if got := textLines.FilterMessage(label + " processing " + id).All(); len(got) != 1 || got[0].ContextMap()["label"] != label {
+			t.Errorf("%s: the console line is not prefixed with %s: %v", id, label, got)
+		}
+		if got := recordLines.FilterMessage("processing " + id).All(); len(got) != 1 || got[0].ContextMap()["label"] != label {
+			t.Errorf("%s: the record is not tagged with %s: %v", id, label, got)
+		}
+	}
+
+	if err := c.logRequests(sl.summary); err != nil {
+		t.Error(err)
+	}
+	if err := c.writeReport("orders-fn", sl.summary); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got schema.BatchReport
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	requests := c.requestsOf(sl.summary)
+	if len(got.Items) != 5 || len(requests) != 5 {
+		t.Fatalf("got %d items, %d requests", len(got.Items), len(requests))
+	}
+	for i, r := range requests {
+		want := []string{"#01", "#02", "#03", "#04", "#05"}[i]
+		if r.Label != want || got.Items[i].Label != want || got.Items[i].RequestID != r.RequestID {
+			t.Errorf("item %d: got %+v in the summary, %+v in the report", i, r, got.Items[i])
+		}
+		if r.RequestID == "" {
+			if r.Status != requestFailed || c.item(i) != failed {
+				t.Errorf("got %+v", r)
+			}
+			continue
+		}
+		if labels[r.RequestID] != want {
+			t.Errorf("%s is labeled %s on the console, %s in the summary", r.RequestID, labels[r.RequestID], want)
+		}
+		if logs.FilterMessageSnippet(want+" "+r.RequestID+": Reported").Len() != 1 {
+			t.Errorf("the duration of %s is not labeled %s", r.RequestID, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// busEvent is one of the events below published by the tailer
+type busEvent interface{}
+
+// logEvent is a log line of the function
+type logEvent struct {
+	FunctionName  string
+	RequestID     string
+	LogStream     string
+	Message       string
+	Timestamp     int64  // milliseconds since the epoch
+	CorrelationID string // correlation id of the ClientContext, "" if none
+	Label         string // of the invocation when a run invokes several times, ex: "#03"
+	Foreign       bool   // the line is not of our requests, ex: of another request running in the stream
+}
+
+// lifecycleEvent is START or END of our request
+type lifecycleEvent struct {
+	Kind      string // "START" or "END"
+	RequestID string
+	LogStream string
+	Timestamp int64
+}
+
+// reportEvent is REPORT of our request
+type reportEvent struct {
+	Report    reportMetrics
+	LogStream string
+	Timestamp int64
+}
+
+// runCompleted is published once when the run is finished
+type runCompleted struct {
+	Err error
+}
+
+// subscriber is an output sink of the bus
+type subscriber interface {
+	handle(ev busEvent) error
+}
+
+// subscribeOptions are options of a subscription
+type subscribeOptions struct {
+	// buffer is the number of events queued for the subscriber. 0 means the subscriber
+	// is called synchronously by the publisher, which keeps the order with the console.
+	buffer int
+	// required subscribers block the publisher instead of dropping events when the buffer is full,
+	// and their failure is returned by close.
+	required bool
+}
+
+type subscription struct {
+	name string
+	sub  subscriber
+	opts subscribeOptions
+	ch   chan busEvent
+	done chan struct{}
+
+	failed  int32 // set atomically once the subscriber fails
+	err     error // the first error, written before failed is set
+	dropped int64 // accessed atomically
+}
+
+// bus dispatches events to subscribers. A failure or slowness of a subscriber
+// does not affect other subscribers.
+type bus struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+func newBus() *bus {
+	return &bus{}
+}
+
+// subscribe adds the subscriber. It must be called before publishing.
+func (b *bus) subscribe(name string, s subscriber, opts subscribeOptions) {
+	sub := &subscription{
+		name: name,
+		sub:  s,
+		opts: opts,
+	}
+	if opts.buffer > 0 {
+		sub.ch = make(chan busEvent, opts.buffer)
+		sub.done = make(chan struct{})
+		go func() {
+			defer close(sub.done)
+			for ev := range sub.ch {
+				sub.deliver(ev)
+			}
+		}()
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+}
+
+func (sub *subscription) deliver(ev busEvent) {
+	if atomic.LoadInt32(&sub.failed) == 1 {
+		return
+	}
+	if err := sub.sub.handle(ev); err != nil {
+		sub.err = err
+		atomic.StoreInt32(&sub.failed, 1)
+		logger.Warnf("output %s failed and is disabled: %s", sub.name, err)
+	}
+}
+
+// publish sends the event to all subscribers
+func (b *bus) publish(ev busEvent) {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.ch == nil {
+			sub.deliver(ev)
+			continue
+		}
+		if sub.opts.required {
+			sub.ch <- ev
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// close publishes runCompleted, waits for all subscribers to drain,
+// and returns the first error of required subscribers.
+func (b *bus) close(runErr error) error {
+	b.publish(runCompleted{Err: runErr})
+
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+
+	var firstErr error
+	for _, sub := range subs {
+		if sub.ch != nil {
+			close(sub.ch)
+			<-sub.done
+		}
+		if n := atomic.LoadInt64(&sub.dropped); n > 0 {
+			logger.Warnf("output %s dropped %d events because it was too slow", sub.name, n)
+		}
+		if atomic.LoadInt32(&sub.failed) == 1 && sub.opts.required && firstErr == nil {
+			firstErr = fmt.Errorf("output %s: %w", sub.name, sub.err)
+		}
+	}
+	return firstErr
+}
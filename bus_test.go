@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type recordingSubscriber struct {
+	mu     sync.Mutex
+	events []busEvent
+	block  chan struct{} // if not nil, handle waits for it
+	failAt int           // fail on the n-th event if > 0
+	calls  int32
+}
+
+func (s *recordingSubscriber) handle(ev busEvent) error {
+	n := atomic.AddInt32(&s.calls, 1)
+	if s.block != nil {
+		<-s.block
+	}
+	if s.failAt > 0 && int(n) >= s.failAt {
+		return errors.New("broken")
+	}
+	s.mu.Lock()
+	s.events = append(s.events, ev)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *recordingSubscriber) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func setTestLogger(t *testing.T) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zapcore.DebugLevel)
+	old := logger
+	logger = zap.New(core).Sugar()
+	t.Cleanup(func() { logger = old })
+	return logs
+}
+
+func TestBusSlowSubscriber(t *testing.T) {
+	logs := setTestLogger(t)
+	b := newBus()
+	console := &recordingSubscriber{}
+	slow := &recordingSubscriber{block: make(chan struct{})}
+	b.subscribe("console", console, subscribeOptions{})
+	b.subscribe("webhook", slow, subscribeOptions{buffer: 2})
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			b.publish(logEvent{Message: "line"})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow subscriber stalls the publisher")
+	}
+	if console.len() != 10 {
+		t.Errorf("console got %d events", console.len())
+	}
+
+	close(slow.block)
+	if err := b.close(nil); err != nil {
+		t.Fatal(err)
+	}
+	if slow.len() == 0 || slow.len() >= 10 {
+		t.Errorf("slow subscriber got %d events, expected some to be dropped", slow.len())
+	}
+	if logs.FilterMessageSnippet("output webhook dropped").Len() != 1 {
+		t.Errorf("dropped events are not reported")
+	}
+}
+
+func TestBusFailureIsolated(t *testing.T) {
+	logs := setTestLogger(t)
+	b := newBus()
+	console := &recordingSubscriber{}
+	broken := &recordingSubscriber{failAt: 2}
+	b.subscribe("broken", broken, subscribeOptions{buffer: 10})
+	b.subscribe("console", console, subscribeOptions{})
+
+	for i := 0; i < 5; i++ {
+		b.publish(logEvent{Message: "line"})
+	}
+	if err := b.close(nil); err != nil {
+		t.Errorf("a failure of an optional subscriber must not be returned, %s", err)
+	}
+	if console.len() != 6 { // 5 lines and runCompleted
+		t.Errorf("console got %d events", console.len())
+	}
+	if n := atomic.LoadInt32(&broken.calls); n != 2 {
+		t.Errorf("a failed subscriber is called %d times", n)
+	}
+	if logs.FilterMessageSnippet("output broken failed").Len() != 1 {
+		t.Errorf("a failure must be reported once")
+	}
+}
+
+func TestBusRequired(t *testing.T) {
+	setTestLogger(t)
+	b := newBus()
+	sub := &recordingSubscriber{}
+	b.subscribe("ndjson", sub, subscribeOptions{buffer: 1, required: true})
+	for i := 0; i < 100; i++ {
+		b.publish(logEvent{Message: "line"})
+	}
+	if err := b.close(nil); err != nil {
+		t.Fatal(err)
+	}
+	if sub.len() != 101 {
+		t.Errorf("a required subscriber must not drop events, got %d", sub.len())
+	}
+	if _, ok := sub.events[100].(runCompleted); !ok {
+		t.Errorf("the last event must be runCompleted, %#v", sub.events[100])
+	}
+
+	b = newBus()
+	b.subscribe("ndjson", &recordingSubscriber{failAt: 1}, subscribeOptions{buffer: 1, required: true})
+	b.publish(logEvent{Message: "line"})
+	if err := b.close(nil); err == nil {
+		t.Errorf("a failure of a required subscriber must be returned")
+	}
+}
+
+func TestSummaryBuilder(t *testing.T) {
+	s := newSummaryBuilder()
+	s.handle(lifecycleEvent{Kind: "START", RequestID: "r1", LogStream: "b", Timestamp: 200})
+	s.handle(reportEvent{Report: reportMetrics{RequestID: "r1", Duration: 1.5}, LogStream: "a", Timestamp: 100})
+	s.handle(lifecycleEvent{Kind: "END", RequestID: "r1", LogStream: "b", Timestamp: 300})
+
+	streams, start := s.streams()
+	if len(streams) != 2 || streams[0] != "b" || streams[1] != "a" || start != 100 {
+		t.Errorf("got %v %d", streams, start)
+	}
+	if r := s.report("r1"); r == nil || r.Duration != 1.5 {
+		t.Errorf("got %+v", r)
+	}
+	if s.report("r2") != nil {
+		t.Errorf("unknown request must be nil")
+	}
+}
+
+func TestSummaryBuilderRestore(t *testing.T) {
+	s := newSummaryBuilder()
+	s.handle(logEvent{Message: "RESTORE_REPORT Restore Duration: 571.67 ms", LogStream: "a"})
+	s.handle(reportEvent{Report: reportMetrics{RequestID: "r0", Duration: 1}, LogStream: "b"})
+	s.handle(reportEvent{Report: reportMetrics{RequestID: "r1", Duration: 1}, LogStream: "a"})
+	s.handle(reportEvent{Report: reportMetrics{RequestID: "r2", Duration: 1}, LogStream: "a"})
+
+	if r := s.report("r0"); startType(r) != startWarm {
+		t.Errorf("a restore of another stream must not be applied, got %+v", r)
+	}
+	if r := s.report("r1"); r.RestoreDuration != 571.67 || startType(r) != startSnapStartRestore {
+		t.Errorf("got %+v", r)
+	}
+	if r := s.report("r2"); startType(r) != startWarm {
+		t.Errorf("only the first request after a restore is a restore, got %+v", r)
+	}
+}
+
+func benchmarkEmitter(b *testing.B) *emitter {
+	e, err := newEmitter(zap.NewNop().Sugar(), nil, defaultLimits.EventsWindow)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return e
+}
+
+// BenchmarkConsoleDirect and BenchmarkConsoleBus compare the console-only path with and without the bus
+func BenchmarkConsoleDirect(b *testing.B) {
+	e := benchmarkEmitter(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e.emit("2021-01-01T00:00:00.000Z\tINFO\thello world", zap.String("function_name", "f"), zap.String("request_id", "r"))
+	}
+}
+
+func BenchmarkConsoleBus(b *testing.B) {
+	e := benchmarkEmitter(b)
+	bus := newBus()
+	bus.subscribe("console", e, subscribeOptions{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bus.publish(logEvent{FunctionName: "f", RequestID: "r", Message: "2021-01-01T00:00:00.000Z\tINFO\thello world"})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultCanaryPoll           = 10 * time.Second
+	defaultCanaryMaxErrorRate   = 0.05
+	defaultCanaryMinInvocations = 5
+)
+
+var startVersionRe = regexp.MustCompile(`START RequestId: (\S+) Version: (\S+)`)
+
+// deploymentAPI is the part of the CodeDeploy API canary-watch uses
+type deploymentAPI interface {
+	GetDeploymentWithContext(ctx aws.Context, input *codedeploy.GetDeploymentInput, opts ...request.Option) (*codedeploy.GetDeploymentOutput, error)
+}
+
+// aliasAPI is the part of the Lambda API canary-watch uses
+type aliasAPI interface {
+	GetAliasWithContext(ctx aws.Context, input *lambda.GetAliasInput, opts ...request.Option) (*lambda.AliasConfiguration, error)
+}
+
+// versionStats is the error count of a version
+type versionStats = schema.VersionStats
+
+// errorRate returns errors per invocation
+func errorRate(s versionStats) float64 {
+	if s.Invocations == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Invocations)
+}
+
+// canaryTracker attributes requests to the versions which served them and counts their errors.
+// An execution environment serves one request at a time, so a line belongs to the request
+// which started last in its log stream.
+type canaryTracker struct {
+	streams map[string]*canaryRequest // log stream to its current request
+	stats   map[string]*versionStats
+}
+
+type canaryRequest struct {
+	id      string
+	version string
+	failed  bool
+}
+
+func newCanaryTracker() *canaryTracker {
+	return &canaryTracker{
+		streams: make(map[string]*canaryRequest),
+		stats:   make(map[string]*versionStats),
+	}
+}
+
+// parseStartVersion returns the request id and the version of a START line
+func parseStartVersion(message string) (string, string, bool) {
+	if strings.HasPrefix(message, `{"time":`) {
+		var rec platformRecord
+		if json.Unmarshal([]byte(message), &rec) != nil || rec.Type != "platform.start" || rec.Record.Version == "" {
+			return "", "", false
+		}
+		return rec.Record.RequestID, rec.Record.Version, true
+	}
+	if m := startVersionRe.FindStringSubmatch(message); m != nil {
+		return m[1], m[2], true
+	}
+	return "", "", false
+}
+
+// observe feeds a log line, and returns the version of the request the line belongs to, or "" if unknown
+func (c *canaryTracker) observe(stream, message string) string {
+	if id, version, ok := parseStartVersion(message); ok {
+		c.streams[stream] = &canaryRequest{id: id, version: version}
+		c.statsOf(version).Invocations++
+		return version
+	}
+	req := c.streams[stream]
+	if req == nil {
+		return ""
+	}
+	if !req.failed && (errorLineRe.MatchString(message) || taskTimeoutRe.MatchString(message)) {
+		req.failed = true
+		c.statsOf(req.version).Errors++
+	}
+	return req.version
+}
+
+func (c *canaryTracker) statsOf(version string) *versionStats {
+	s, ok := c.stats[version]
+	if !ok {
+		s = &versionStats{Version: version}
+		c.stats[version] = s
+	}
+	return s
+}
+
+// snapshot returns the stats of every version sorted by version
+func (c *canaryTracker) snapshot() []versionStats {
+	ret := make([]versionStats, 0, len(c.stats))
+	for _, s := range c.stats {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret
+}
+
+// exceeded returns an error if the version has enough invocations and its error rate is over maxRate
+func (c *canaryTracker) exceeded(version string, maxRate float64, minInvocations int) error {
+	s, ok := c.stats[version]
+	if !ok || s.Invocations < minInvocations {
+		return nil
+	}
+	if rate := errorRate(*s); rate > maxRate {
+		return fmt.Errorf("error rate of version %s is %.1f%% (%d/%d), exceeds %.1f%%",
+			version, rate*100, s.Errors, s.Invocations, maxRate*100)
+	}
+	return nil
+}
+
+// aliasVersions returns the old and the new version of an alias which is shifting traffic
+func aliasVersions(ctx context.Context, svc aliasAPI, function, alias string) (string, string, error) {
+	res, err := svc.GetAliasWithContext(ctx, &lambda.GetAliasInput{
+		FunctionName: aws.String(function),
+		Name:         aws.String(alias),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("GetAlias, %s:%s: %w", function, alias, err)
+	}
+	old := aws.StringValue(res.FunctionVersion)
+	if res.RoutingConfig != nil {
+		for version := range res.RoutingConfig.AdditionalVersionWeights {
+			return old, version, nil
+		}
+	}
+	return old, "", nil
+}
+
+// deploymentStatus returns the status of the deployment, and an error if it failed or was stopped
+func deploymentStatus(ctx context.Context, svc deploymentAPI, id string) (string, error) {
+	res, err := svc.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{DeploymentId: aws.String(id)})
+	if err != nil {
+		return "", fmt.Errorf("GetDeployment, %s: %w", id, err)
+	}
+	if res.DeploymentInfo == nil {
+		return "", fmt.Errorf("GetDeployment, %s: no deployment info", id)
+	}
+	status := aws.StringValue(res.DeploymentInfo.Status)
+	switch status {
+	case codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+		msg := ""
+		if e := res.DeploymentInfo.ErrorInformation; e != nil {
+			msg = fmt.Sprintf(": %s %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
+		return status, fmt.Errorf("deployment %s is %s%s", id, status, msg)
+	}
+	return status, nil
+}
+
+// canaryWatch follows a deployment and the logs of the function
+type canaryWatch struct {
+	deployments deploymentAPI
+	logs        *logStreamer // feeds the lines to tracker
+
+	deploymentID   string
+	newVersion     string
+	maxErrorRate   float64
+	minInvocations int
+	poll           time.Duration
+
+	tracker *canaryTracker
+}
+
+// run polls the deployment and the logs until the deployment ends or the new version fails too much
+func (w *canaryWatch) run(ctx context.Context) error {
+	ticker := time.NewTicker(w.poll)
+	defer ticker.Stop()
+	lastReport := ""
+	for {
+		if err := w.logs.pollOnce(ctx); err != nil {
+			return err
+		}
+		if report := w.report(); report != lastReport {
+			logger.Infow("canary", recordFields(schema.Canary{SchemaVersion: schema.CanaryVersion, Versions: w.tracker.snapshot(), NewVersion: w.newVersion})...)
+			lastReport = report
+		}
+		// the new version fails, as a function does
+		if err := w.tracker.exceeded(w.newVersion, w.maxErrorRate, w.minInvocations); err != nil {
+			return &functionError{err}
+		}
+
+		status, err := deploymentStatus(ctx, w.deployments, w.deploymentID)
+		if err != nil {
+			return err
+		}
+		if status == codedeploy.DeploymentStatusSucceeded {
+			logger.Infof("deployment %s succeeded", w.deploymentID)
+			return nil
+		}
+		logger.Debugf("deployment %s is %s", w.deploymentID, status)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *canaryWatch) report() string {
+	var b strings.Builder
+	for _, s := range w.tracker.snapshot() {
+		fmt.Fprintf(&b, "%s:%d/%d ", s.Version, s.Errors, s.Invocations)
+	}
+	return b.String()
+}
+
+// newCanaryStreamer returns a streamer which feeds every line of the log group from the time to the tracker
+func newCanaryStreamer(logs logsAPI, em *emitter, logGroupName string, from time.Time, tracker *canaryTracker) *logStreamer {
+	s := newTailStreamer(logs, em, logGroupName, from, 0)
+	s.versionOf = tracker.observe
+	return s
+}
+
+// runCanaryWatch runs the canary-watch subcommand
+func runCanaryWatch(args []string) error {
+	var funcName string
+	var deploymentID string
+	var newVersion string
+	var maxErrorRate float64
+	var minInvocations int
+	var poll time.Duration
+	var jsonFormat bool
+
+	fs := flag.NewFlagSet("canary-watch", flag.ContinueOnError)
+	fs.StringVar(&funcName, "func", "", "function name with the alias, ex: my-fn:live")
+	fs.StringVar(&deploymentID, "deployment", "", "CodeDeploy deployment id")
+	fs.StringVar(&newVersion, "new-version", "", "the version being deployed. found from the routing config of the alias by default")
+	fs.Float64Var(&maxErrorRate, "max-error-rate", defaultCanaryMaxErrorRate, "fail when the error rate of the new version exceeds this ratio")
+	fs.IntVar(&minInvocations, "min-invocations", defaultCanaryMinInvocations, "invocations of the new version needed before the error rate is judged")
+	fs.DurationVar(&poll, "poll", defaultCanaryPoll, "interval to poll the deployment and the logs")
+	fs.BoolVar(&jsonFormat, "json", false, "enable JSON log format")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{json: jsonFormat})
+	defer logger.Sync()
+
+	ref, err := ParseFunctionRef(funcName)
+	if err != nil {
+		return &configError{err}
+	}
+	if ref.Qualifier == "" || deploymentID == "" {
+		return &configError{fmt.Errorf("-func with an alias and -deployment are required")}
+	}
+
+	awsOpts, err := newAWSSessionOptions(ref.Region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	ctx := context.Background()
+
+	oldVersion, routed, err := aliasVersions(ctx, lambda.New(sess), ref.Name, ref.Qualifier)
+	if err != nil {
+		return err
+	}
+	if newVersion == "" {
+		newVersion = routed
+	}
+	if newVersion == "" {
+		return &configError{fmt.Errorf("%s does not shift traffic now, specify -new-version", funcName)}
+	}
+	logger.Infof("watching deployment %s of %s, version %s to %s", deploymentID, funcName, oldVersion, newVersion)
+
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		return err
+	}
+	tracker := newCanaryTracker()
+	w := &canaryWatch{
+		deployments:    codedeploy.New(sess),
+		logs:           newCanaryStreamer(cloudwatchlogs.New(sess), em, ref.LogGroup(), time.Now(), tracker),
+		deploymentID:   deploymentID,
+		newVersion:     newVersion,
+		maxErrorRate:   maxErrorRate,
+		minInvocations: minInvocations,
+		poll:           poll,
+		tracker:        tracker,
+	}
+	return w.run(ctx)
+}
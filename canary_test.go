@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+)
+
+func TestCanaryTracker(t *testing.T) {
+	c := newCanaryTracker()
+	lines := []struct{ stream, message, version string }{
+		{"s1", "START RequestId: r1 Version: 3", "3"},
+		{"s2", `{"time":"2021-01-01T00:00:00Z","type":"platform.start","record":{"requestId":"r2","version":"4"}}`, "4"},
+		{"s1", "2021-01-01T00:00:00Z\tr1\tINFO\thello", "3"},
+		{"s2", "2021-01-01T00:00:00Z\tr2\tERROR\tboom", "4"},
+		{"s2", "2021-01-01T00:00:00Z\tr2\tERROR\tboom again", "4"},
+		{"s1", "END RequestId: r1", "3"},
+		{"s1", "START RequestId: r3 Version: 4", "4"},
+		{"s1", "2021-01-01T00:00:01Z r3 Task timed out after 3.00 seconds", "4"},
+		{"s3", "a line of an unknown request", ""},
+	}
+	for _, l := range lines {
+		if got := c.observe(l.stream, l.message); got != l.version {
+			t.Errorf("%q: got version %q, want %q", l.message, got, l.version)
+		}
+	}
+	got := c.snapshot()
+	want := []versionStats{{Version: "3", Invocations: 1}, {Version: "4", Invocations: 2, Errors: 2}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := c.exceeded("4", 0.5, 3); err != nil {
+		t.Errorf("too few invocations to judge, got %v", err)
+	}
+	if err := c.exceeded("4", 0.5, 2); err == nil || !strings.Contains(err.Error(), "100.0%") {
+		t.Errorf("got %v", err)
+	}
+	if err := c.exceeded("3", 0, 1); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+// fixtureDeployments returns the GetDeployment responses in order, and the last one after that
+type fixtureDeployments struct {
+	responses []string
+	calls     int
+}
+
+func (f *fixtureDeployments) GetDeploymentWithContext(ctx aws.Context, input *codedeploy.GetDeploymentInput, opts ...request.Option) (*codedeploy.GetDeploymentOutput, error) {
+	i := f.calls
+	if i >= len(f.responses) {
+		i = len(f.responses) - 1
+	}
+	f.calls++
+	var out codedeploy.GetDeploymentOutput
+	if err := json.Unmarshal([]byte(f.responses[i]), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// scriptedLogs returns the events of the n-th FilterLogEvents call
+type scriptedLogs struct {
+	fakeLogs
+	polls [][]string // "stream|message"
+	calls int
+}
+
+func (l *scriptedLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	var events []*cloudwatchlogs.FilteredLogEvent
+	if l.calls < len(l.polls) {
+		for i, line := range l.polls[l.calls] {
+			p := strings.SplitN(line, "|", 2)
+			events = append(events, &cloudwatchlogs.FilteredLogEvent{
+				EventId:       aws.String(strings.Repeat("x", l.calls+1) + string(rune('a'+i))),
+				LogStreamName: aws.String(p[0]),
+				Message:       aws.String(p[1]),
+				Timestamp:     aws.Int64(int64(l.calls*100 + i + 1)),
+			})
+		}
+	}
+	l.calls++
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: events}, true)
+	return nil
+}
+
+func (l *scriptedLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	return nil
+}
+
+func TestCanaryWatch(t *testing.T) {
+	inProgress := `{"DeploymentInfo":{"DeploymentId":"d-1","Status":"InProgress"}}`
+	tests := []struct {
+		name        string
+		deployments []string
+		polls       [][]string
+		err         string
+		code        int
+	}{
+		{
+			name:        "succeeded",
+			deployments: []string{`{"DeploymentInfo":{"DeploymentId":"d-1","Status":"Created"}}`, inProgress, `{"DeploymentInfo":{"DeploymentId":"d-1","Status":"Succeeded"}}`},
+			polls:       [][]string{{"s1|START RequestId: r1 Version: 4"}, {"s1|END RequestId: r1"}},
+		},
+		{
+			name:        "failed",
+			deployments: []string{inProgress, `{"DeploymentInfo":{"DeploymentId":"d-1","Status":"Failed","ErrorInformation":{"Code":"ALARM_ACTIVE","Message":"alarm is active"}}}`},
+			err:         "ALARM_ACTIVE alarm is active",
+			code:        exitRunError,
+		},
+		{
+			name:        "error rate",
+			deployments: []string{inProgress},
+			polls: [][]string{
+				{"s1|START RequestId: r1 Version: 4", "s1|x\tr1\tERROR\tboom", "s2|START RequestId: r2 Version: 3", "s2|x\tr2\tERROR\tboom"},
+				{"s1|START RequestId: r3 Version: 4"},
+			},
+			err:  "error rate of version 4 is 50.0% (1/2)",
+			code: exitFunctionError,
+		},
+	}
+	for _, tt := range tests {
+		setTestLogger(t)
+		em, lines := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+		tracker := newCanaryTracker()
+		w := &canaryWatch{
+			deployments:    &fixtureDeployments{responses: tt.deployments},
+			logs:           newCanaryStreamer(&scriptedLogs{polls: tt.polls}, em, "/aws/lambda/f", time.Unix(0, 0), tracker),
+			deploymentID:   "d-1",
+			newVersion:     "4",
+			maxErrorRate:   0.1,
+			minInvocations: 2,
+			poll:           time.Millisecond,
+			tracker:        tracker,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := w.run(ctx)
+		cancel()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+		if code := exitCode(err); code != tt.code {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.code)
+		}
+		for _, e := range lines.FilterMessageSnippet("RequestId: r1").All() {
+			if e.ContextMap()["version"] != "4" || e.ContextMap()["request_id"] != "r1" {
+				t.Errorf("%s: %s is tagged with %v", tt.name, e.Message, e.ContextMap())
+			}
+		}
+	}
+}
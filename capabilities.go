@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Capabilities declares which vendor-specific options an invoker supports
+type Capabilities struct {
+	Flags []string // names of the supported flags in vendorFlags
+}
+
+// supports returns true if the flag is supported. Flags which are not vendor-specific are always supported.
+func (c Capabilities) supports(name string) bool {
+	if !vendorFlags[name] {
+		return true
+	}
+	for _, f := range c.Flags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// vendorFlags are flags which only some vendors support
+var vendorFlags = map[string]bool{
+	"invocation-type":           true,
+	"via":                       true,
+	"eventbridge-bus":           true,
+	"eventbridge-source":        true,
+	"eventbridge-detail-type":   true,
+	"eventbridge-start-timeout": true,
+	"queue":                     true,
+	"sqs-match-timeout":         true,
+	"sqs-enqueued-timeout":      true,
+	"sqs-consumed-timeout":      true,
+	"dry-run":                   true,
+	"no-logs":                   true,
+	"qualifier":                 true,
+	"invoke-max-attempts":       true,
+	"invoke-max-elapsed":        true,
+	"concurrency":               true,
+	"concurrency-timeout":       true,
+	"payload-ndjson":            true,
+	"batch-workers":             true,
+	"fail-fast":                 true,
+	"batch-report":              true,
+	"warmup":                    true,
+	"wait-active":               true,
+	"wait-active-timeout":       true,
+	"no-preflight":              true,
+	"warmup-payload":            true,
+	"output":                    true,
+	"retry-if-response":         true,
+	"max-attempts":              true,
+	"retry-on-failure":          true,
+	"retry-delay":               true,
+	"show-extension-logs":       true,
+	"timeline":                  true,
+	"with-env":                  true,
+	"local-timeout":             true,
+	"local-rie":                 true,
+	"cancel-execution":          true,
+	"azure-function-key":        true,
+	"appinsights-app-id":        true,
+	"knative-external":          true,
+	"openfaas-url":              true,
+	"openfaas-user":             true,
+	"openfaas-password":         true,
+	"ecs-cluster":               true,
+	"ecs-subnets":               true,
+	"ecs-security-groups":       true,
+	"ecs-assign-public-ip":      true,
+	"ecs-container":             true,
+	"job-queue":                 true,
+	"batch-parameters":          true,
+	"discover-region":           true,
+	"read-only":                 true,
+	"no-metadata-cache":         true,
+	"dualstack":                 true,
+	"no-credential-cache":       true,
+	"prefer-ipv6":               true,
+	"client-context":            true,
+	"no-attribution":            true,
+	"plan":                      true,
+	"stream-prefix-margin":      true,
+	"ship-to":                   true,
+	"ship-max-line-length":      true,
+
+	"tuning":                 true,
+	"poll-interval":          true,
+	"throttle-cool-down":     true,
+	"max-throttle-cool-down": true,
+	"events-cache":           true,
+	"events-window":          true,
+	"report-grace":           true,
+	"fallback-streams":       true,
+
+	"expect-sqs-message":   true,
+	"expect-dynamodb-item": true,
+	"expect-filter":        true,
+	"consume":              true,
+	"expect-timeout":       true,
+	"completion-strategy":  true,
+	"set-retention":        true,
+	"expect-response-file": true,
+	"update-golden":        true,
+	"response-tolerance":   true,
+	"response-ignore":      true,
+
+	"insights-metrics": true,
+	"with-log-level":   true,
+	"xray":             true,
+
+	"check-destination":   true,
+	"destination-timeout": true,
+
+	"openwhisk-apihost":        true,
+	"openwhisk-auth":           true,
+	"alibaba-cloud-account-id": true,
+	"alibaba-cloud-region-id":  true,
+	"oci-auth":                 true,
+	"oci-config-file":          true,
+	"oci-profile":              true,
+	"cloudflare-api-token":     true,
+	"cloudflare-account-id":    true,
+	"cloudflare-script":        true,
+}
+
+// vendorCapabilities are the capabilities of each vendor, consulted before an invoker is created
+var vendorCapabilities = map[Vendor]Capabilities{
+	VendorAWS: {
+		Flags: []string{"invocation-type", "via", "eventbridge-bus", "eventbridge-source", "eventbridge-detail-type", "eventbridge-start-timeout", "queue", "sqs-match-timeout", "sqs-enqueued-timeout", "sqs-consumed-timeout", "dry-run", "no-logs", "qualifier", "invoke-max-attempts", "invoke-max-elapsed", "concurrency", "concurrency-timeout", "payload-ndjson", "batch-workers", "fail-fast", "batch-report", "warmup", "warmup-payload", "wait-active", "wait-active-timeout", "no-preflight", "output", "retry-if-response", "max-attempts", "retry-on-failure", "retry-delay", "show-extension-logs", "timeline", "discover-region", "read-only", "no-metadata-cache", "dualstack", "prefer-ipv6", "no-credential-cache", "client-context", "no-attribution", "plan", "stream-prefix-margin", "tuning", "poll-interval", "throttle-cool-down", "max-throttle-cool-down", "events-cache", "events-window", "report-grace", "fallback-streams", "expect-sqs-message", "expect-dynamodb-item", "expect-filter", "consume", "expect-timeout", "completion-strategy", "set-retention", "expect-response-file", "update-golden", "response-tolerance", "response-ignore", "cancel-execution", "insights-metrics", "with-log-level", "xray", "check-destination", "destination-timeout", "ship-to", "ship-max-line-length"},
+	},
+	VendorGCP: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "cancel-execution"},
+	},
+	VendorAzure: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "azure-function-key", "appinsights-app-id"},
+	},
+	VendorKnative: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "knative-external"},
+	},
+	VendorOpenFaaS: {
+		Flags: []string{"invocation-type", "expect-response-file", "update-golden", "response-tolerance", "response-ignore", "openfaas-url", "openfaas-user", "openfaas-password"},
+	},
+	VendorOpenWhisk: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "openwhisk-apihost", "openwhisk-auth"},
+	},
+	VendorAlibaba: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "alibaba-cloud-account-id", "alibaba-cloud-region-id"},
+	},
+	VendorOCI: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "oci-auth", "oci-config-file", "oci-profile"},
+	},
+	VendorCloudflare: {
+		Flags: []string{"expect-response-file", "update-golden", "response-tolerance", "response-ignore", "cloudflare-api-token", "cloudflare-account-id", "cloudflare-script"},
+	},
+	VendorECS: {
+		Flags: []string{"ecs-cluster", "ecs-subnets", "ecs-security-groups", "ecs-assign-public-ip", "ecs-container", "cancel-execution", "dualstack", "prefer-ipv6", "no-credential-cache", "tuning", "poll-interval", "throttle-cool-down", "max-throttle-cool-down", "events-cache", "events-window"},
+	},
+	VendorAWSBatch: {
+		Flags: []string{"job-queue", "batch-parameters", "cancel-execution", "dualstack", "prefer-ipv6", "no-credential-cache", "tuning", "poll-interval", "throttle-cool-down", "max-throttle-cool-down", "events-cache", "events-window"},
+	},
+	VendorLocal: {
+		Flags: []string{"with-env", "local-timeout", "local-rie"},
+	},
+}
+
+// unsupportedFlags returns the flags in set which the vendor does not support
+func unsupportedFlags(vendor Vendor, set []string) ([]string, error) {
+	caps, ok := vendorCapabilities[vendor]
+	if !ok {
+		return nil, fmt.Errorf("unknown vendor, %s", vendor)
+	}
+	var ret []string
+	for _, name := range set {
+		if !caps.supports(name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// printUsage prints the flags, grouping vendor-specific flags by vendor
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage of %s:\n", fs.Name())
+	printFlags(w, fs, func(name string) bool { return !vendorFlags[name] })
+
+	vendors := make([]string, 0, len(vendorCapabilities))
+	for v := range vendorCapabilities {
+		vendors = append(vendors, string(v))
+	}
+	sort.Strings(vendors)
+	for _, v := range vendors {
+		caps := vendorCapabilities[Vendor(v)]
+		if len(caps.Flags) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s options:\n", v)
+		printFlags(w, fs, func(name string) bool { return vendorFlags[name] && caps.supports(name) })
+	}
+}
+
+func printFlags(w io.Writer, fs *flag.FlagSet, filter func(string) bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if !filter(f.Name) {
+			return
+		}
+		line := "  -" + f.Name
+		name, usage := flag.UnquoteUsage(f)
+		if name != "" {
+			line += " " + name
+		}
+		fmt.Fprintf(w, "%s\n    \t%s", line, strings.Replace(usage, "\n", "\n    \t", -1))
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" {
+			fmt.Fprintf(w, " (default %q)", f.DefValue)
+		}
+		fmt.Fprintln(w)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestVendorCapabilities(t *testing.T) {
+	args := map[string][]string{
+		"invocation-type":           {"-invocation-type", "event"},
+		"via":                       {"-via", "url"},
+		"eventbridge-bus":           {"-eventbridge-bus", "orders"},
+		"eventbridge-source":        {"-eventbridge-source", "orders.api"},
+		"eventbridge-detail-type":   {"-eventbridge-detail-type", "OrderPlaced"},
+		"eventbridge-start-timeout": {"-eventbridge-start-timeout", "30s"},
+		"queue":                     {"-queue", "https://sqs.us-east-1.amazonaws.com/123456789012/orders"},
+		"sqs-match-timeout":         {"-sqs-match-timeout", "30s"},
+		"sqs-enqueued-timeout":      {"-sqs-enqueued-timeout", "1m"},
+		"sqs-consumed-timeout":      {"-sqs-consumed-timeout", "1m"},
+		"dry-run":                   {"-dry-run"},
+		"no-logs":                   {"-no-logs"},
+		"qualifier":                 {"-qualifier", "live"},
+		"invoke-max-attempts":       {"-invoke-max-attempts", "3"},
+		"invoke-max-elapsed":        {"-invoke-max-elapsed", "1m"},
+		"concurrency":               {"-concurrency", "2"},
+		"concurrency-timeout":       {"-concurrency-timeout", "1m"},
+		"payload-ndjson":            {"-payload-ndjson", "testdata/batch/orders.ndjson"},
+		"batch-workers":             {"-payload-ndjson", "testdata/batch/orders.ndjson", "-batch-workers", "2"},
+		"fail-fast":                 {"-payload-ndjson", "testdata/batch/orders.ndjson", "-fail-fast"},
+		"batch-report":              {"-payload-ndjson", "testdata/batch/orders.ndjson", "-batch-report", "report.json"},
+		"warmup":                    {"-warmup", "5"},
+		"wait-active":               {"-wait-active"},
+		"wait-active-timeout":       {"-wait-active", "-wait-active-timeout", "1m"},
+		"no-preflight":              {"-no-preflight"},
+		"warmup-payload":            {"-warmup", "5", "-warmup-payload", "{}"},
+		"output":                    {"-output", "response.json"},
+		"retry-if-response":         {"-retry-if-response", ".retry"},
+		"max-attempts":              {"-max-attempts", "5"},
+		"retry-on-failure":          {"-retry-on-failure"},
+		"retry-delay":               {"-retry-on-failure", "-retry-delay", "30s"},
+		"show-extension-logs":       {"-show-extension-logs"},
+		"timeline":                  {"-timeline"},
+		"with-env":                  {"-with-env", "A=1"},
+		"local-timeout":             {"-local-timeout", "5s"},
+		"local-rie":                 {"-local-rie", "http://localhost:8080/"},
+		"cancel-execution":          {"-cancel-execution"},
+		"azure-function-key":        {"-azure-function-key", "key"},
+		"appinsights-app-id":        {"-appinsights-app-id", "00000000-0000-0000-0000-000000000000"},
+		"knative-external":          {"-knative-external"},
+		"openfaas-url":              {"-openfaas-url", "http://gateway.openfaas:8080"},
+		"openfaas-user":             {"-openfaas-user", "admin"},
+		"openfaas-password":         {"-openfaas-password", "secret"},
+		"ecs-cluster":               {"-ecs-cluster", "jobs"},
+		"ecs-subnets":               {"-ecs-subnets", "subnet-1,subnet-2"},
+		"ecs-security-groups":       {"-ecs-security-groups", "sg-1"},
+		"ecs-assign-public-ip":      {"-ecs-assign-public-ip"},
+		"ecs-container":             {"-ecs-container", "app"},
+		"job-queue":                 {"-job-queue", "jobs"},
+		"batch-parameters":          {"-batch-parameters"},
+		"discover-region":           {"-discover-region"},
+		"read-only":                 {"-read-only"},
+		"no-metadata-cache":         {"-no-metadata-cache"},
+		"dualstack":                 {"-dualstack"},
+		"no-credential-cache":       {"-no-credential-cache"},
+		"expect-response-file":      {"-expect-response-file", "golden.json"},
+		"update-golden":             {"-expect-response-file", "golden.json", "-update-golden"},
+		"response-tolerance":        {"-expect-response-file", "golden.json", "-response-tolerance", "0.01"},
+		"response-ignore":           {"-expect-response-file", "golden.json", "-response-ignore", "/id"},
+		"prefer-ipv6":               {"-prefer-ipv6"},
+		"client-context":            {"-client-context", `{"custom": {"k": "v"}}`},
+		"no-attribution":            {"-no-attribution"},
+		"plan":                      {"-plan"},
+		"stream-prefix-margin":      {"-stream-prefix-margin", "1h"},
+		"ship-to":                   {"-ship-to", "https://collector.example.com/ingest"},
+		"ship-max-line-length":      {"-ship-to", "https://collector.example.com/ingest", "-ship-max-line-length", "1024"},
+
+		"tuning":                 {"-tuning", "gentle"},
+		"poll-interval":          {"-poll-interval", "1s"},
+		"throttle-cool-down":     {"-throttle-cool-down", "1s"},
+		"max-throttle-cool-down": {"-max-throttle-cool-down", "10s"},
+		"events-cache":           {"-events-cache", "1000"},
+		"events-window":          {"-events-window", "1m"},
+		"report-grace":           {"-report-grace", "1s"},
+		"fallback-streams":       {"-fallback-streams", "3"},
+
+		"expect-sqs-message":   {"-expect-sqs-message", "https://sqs.us-east-1.amazonaws.com/123456789012/out"},
+		"expect-dynamodb-item": {"-expect-dynamodb-item", `orders:{"id": "o-1"}`},
+		"expect-filter":        {"-expect-filter", ".ok", "-expect-sqs-message", "https://sqs.us-east-1.amazonaws.com/123456789012/out"},
+		"consume":              {"-consume", "-expect-sqs-message", "https://sqs.us-east-1.amazonaws.com/123456789012/out"},
+		"expect-timeout":       {"-expect-timeout", "1m"},
+		"completion-strategy":  {"-completion-strategy", "metrics"},
+		"set-retention":        {"-set-retention", "14"},
+
+		"insights-metrics": {"-insights-metrics"},
+		"with-log-level":   {"-with-log-level", "DEBUG"},
+		"xray":             {"-xray"},
+
+		"check-destination":   {"-invocation-type", "event", "-check-destination"},
+		"destination-timeout": {"-destination-timeout", "1m"},
+
+		"openwhisk-apihost":        {"-openwhisk-apihost", "us-south.functions.cloud.ibm.com"},
+		"openwhisk-auth":           {"-openwhisk-auth", "00000000-0000-0000-0000-000000000000:key"},
+		"alibaba-cloud-account-id": {"-alibaba-cloud-account-id", "1234567890123456"},
+		"alibaba-cloud-region-id":  {"-alibaba-cloud-region-id", "cn-hangzhou"},
+		"oci-auth":                 {"-oci-auth", "instance_principal"},
+		"oci-config-file":          {"-oci-config-file", "oci.config"},
+		"oci-profile":              {"-oci-profile", "CI"},
+		"cloudflare-api-token":     {"-cloudflare-api-token", "token"},
+		"cloudflare-account-id":    {"-cloudflare-account-id", "0123456789abcdef0123456789abcdef"},
+		"cloudflare-script":        {"-cloudflare-script", "hello"},
+	}
+	noenv := func(string) string { return "" }
+	for vendor, caps := range vendorCapabilities {
+		for name := range vendorFlags {
+			a, ok := args[name]
+			if !ok {
+				t.Fatalf("no test args for -%s", name)
+			}
+			base := []string{"-func", "f", "-vendor", string(vendor)}
+			_, err := parseArgs(append(base, a...), noenv)
+			if caps.supports(name) != (err == nil) {
+				t.Errorf("%s -%s: supported %v, got %v", vendor, name, caps.supports(name), err)
+			}
+			if err != nil && (!strings.Contains(err.Error(), name) || !strings.Contains(err.Error(), string(vendor))) {
+				t.Errorf("error must name the flag and the vendor, %s", err)
+			}
+
+			config, err := parseArgs(append(append(base, "-ignore-unsupported-flags"), a...), noenv)
+			if err != nil {
+				t.Errorf("%s -%s with -ignore-unsupported-flags: %s", vendor, name, err)
+				continue
+			}
+			for _, e := range config.entries {
+				if e.name == name && e.unsupported == caps.supports(name) {
+					t.Errorf("%s -%s: unsupported is %v", vendor, name, e.unsupported)
+				}
+			}
+		}
+	}
+}
+
+func TestIgnoreUnsupportedFlagsReset(t *testing.T) {
+	args := []string{"-func", "f", "-vendor", "gcp", "-ignore-unsupported-flags", "-set-retention", "14", "-with-env", "A=1", "-dry-run"}
+	config, err := parseArgs(args, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.setRetention != 0 || len(config.withEnv) != 0 || config.dryRun {
+		t.Errorf("an ignored flag is applied: %d %v %v", config.setRetention, config.withEnv, config.dryRun)
+	}
+	for _, e := range config.entries {
+		if e.unsupported && (e.value != "" && e.value != "false" || e.source != sourceDefault) {
+			t.Errorf("-%s is ignored, but %s from %s", e.name, e.value, e.source)
+		}
+	}
+}
+
+func TestUnknownVendor(t *testing.T) {
+	if _, err := parseArgs([]string{"-func", "f", "-vendor", "nowhere"}, func(string) string { return "" }); err == nil {
+		t.Errorf("unknown vendor must be an error")
+	}
+}
+
+func TestPrintUsageGroupsByVendor(t *testing.T) {
+	fs := flag.NewFlagSet("nodeless", flag.ContinueOnError)
+	fs.String("func", "", "function name")
+	fs.String("invocation-type", "auto", "invocation type")
+	var buf bytes.Buffer
+	printUsage(&buf, fs)
+
+	out := buf.String()
+	aws := strings.Index(out, "aws options:")
+	if aws < 0 || strings.Index(out, "-func") > aws || strings.Index(out, "-invocation-type") < aws {
+		t.Errorf("got %s", out)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+)
+
+// lineClass is a class of a log line
+type lineClass int
+
+const (
+	lineApplication lineClass = iota
+	lineLifecycle             // START, END, REPORT and other platform lines of the invocation
+	lineExtension             // lines of extensions and telemetry agents
+)
+
+// lineRule classifies a line matching the pattern
+type lineRule struct {
+	name    string
+	class   lineClass
+	pattern *regexp.Regexp
+}
+
+// lifecycleRules are checked before any other rules, so that lifecycle lines are never hidden
+var lifecycleRules = []lineRule{
+	{"request", lineLifecycle, regexp.MustCompile(`^(START|END|REPORT) RequestId: `)},
+	{"init", lineLifecycle, regexp.MustCompile(`^(INIT_START|INIT_REPORT|INIT_RUNTIME_DONE|RESTORE_START|RESTORE_REPORT|RESTORE_RUNTIME_DONE)\s`)},
+	{"fc-request", lineLifecycle, regexp.MustCompile(`^FC (Invoke|Initialize) (Start|End) RequestId: `)},
+	{"json-platform", lineLifecycle, regexp.MustCompile(`^\{"time":"[^"]*","type":"platform\.(start|runtimeDone|report|initStart|initReport|initRuntimeDone|restoreStart|restoreReport)"`)},
+}
+
+// knownExtensionRules are lines of known extensions and agents
+var knownExtensionRules = []lineRule{
+	{"extension", lineExtension, regexp.MustCompile(`^(EXTENSION|TELEMETRY|LOGS)\s+Name:`)},
+	{"json-telemetry", lineExtension, regexp.MustCompile(`^\{"time":"[^"]*","type":"(platform\.(extension|telemetrySubscription|logsSubscription|logsDropped)|extension)"`)},
+	{"datadog", lineExtension, regexp.MustCompile(`^DD_EXTENSION \| `)},
+	{"newrelic", lineExtension, regexp.MustCompile(`^\[NR_EXT\]`)},
+	{"opentelemetry", lineExtension, regexp.MustCompile(`^\{.*"(msg|message)":"[^"]*(?i:opentelemetry|otelcol|telemetryapi)`)},
+	{"parameters-secrets", lineExtension, regexp.MustCompile(`^\[AWS Parameters and Secrets Lambda Extension\]`)},
+	{"appconfig", lineExtension, regexp.MustCompile(`^\[appconfig agent\]`)},
+}
+
+// classifyLine returns the class of the line. extra rules are checked after the built-in ones.
+func classifyLine(line string, extra []lineRule) lineClass {
+	for _, r := range lifecycleRules {
+		if r.pattern.MatchString(line) {
+			return r.class
+		}
+	}
+	for _, rules := range [][]lineRule{knownExtensionRules, extra} {
+		for _, r := range rules {
+			if r.pattern.MatchString(line) {
+				return r.class
+			}
+		}
+	}
+	return lineApplication
+}
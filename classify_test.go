@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestClassifyLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want lineClass
+	}{
+		// lifecycle
+		{"START RequestId: 2e3c63b7-0681-4e60-9767-b025b0714db1 Version: $LATEST", lineLifecycle},
+		{"END RequestId: 2e3c63b7-0681-4e60-9767-b025b0714db1", lineLifecycle},
+		{"REPORT RequestId: 2e3c63b7-0681-4e60-9767-b025b0714db1\tDuration: 1.85 ms", lineLifecycle},
+		{"INIT_START Runtime Version: python:3.12.v18\tRuntime Version ARN: arn:aws:lambda:us-east-1::runtime:abc", lineLifecycle},
+		{"RESTORE_START Runtime Version: java:21.v12", lineLifecycle},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.start","record":{"requestId":"abc","version":"$LATEST"}}`, lineLifecycle},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.report","record":{"requestId":"abc"}}`, lineLifecycle},
+		{"FC Invoke Start RequestId: 1-6666a1b2-3c4d5e6f7a8b9c0d1e2f3a4b", lineLifecycle},
+		// extensions
+		{"EXTENSION\tName: datadog-agent\tState: Ready\tEvents: [INVOKE,SHUTDOWN]", lineExtension},
+		{"TELEMETRY\tName: collector\tState: Subscribed\tTypes: [Platform, Function]", lineExtension},
+		{"LOGS\tName: datadog-agent\tState: Subscribed\tTypes: [function,platform]", lineExtension},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.extension","record":{"name":"collector","state":"Ready"}}`, lineExtension},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.telemetrySubscription","record":{"name":"collector"}}`, lineExtension},
+		{"DD_EXTENSION | DEBUG | Received invocation event...", lineExtension},
+		{"[NR_EXT] New Relic Lambda Extension starting up", lineExtension},
+		{`{"level":"info","ts":1700474400.123,"msg":"Launching OpenTelemetry Lambda extension","version":"v0.35.0"}`, lineExtension},
+		{`{"level":"info","msg":"Everything is ready","kind":"exporter","name":"otlp","caller":"otelcol/collector.go:123"}`, lineApplication},
+		{"[AWS Parameters and Secrets Lambda Extension] 2023/11/20 10:00:00 INFO ready to serve traffic", lineExtension},
+		// application
+		{"2023-11-20T10:00:00.000Z\tabc\tINFO\thello world", lineApplication},
+		{`{"level":"info","msg":"order processed","order_id":"123"}`, lineApplication},
+		{"START processing the batch", lineApplication},
+	}
+	for _, tt := range tests {
+		if got := classifyLine(tt.line, nil); got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyLineExtra(t *testing.T) {
+	extra := []lineRule{
+		{"custom", lineExtension, regexp.MustCompile(`^\[my-agent\]`)},
+		{"greedy", lineExtension, regexp.MustCompile(`.*`)},
+	}
+	if got := classifyLine("[my-agent] flushed", extra); got != lineExtension {
+		t.Errorf("got %d", got)
+	}
+	// lifecycle lines are never hidden even by a greedy rule
+	if got := classifyLine("END RequestId: abc", extra); got != lineLifecycle {
+		t.Errorf("got %d", got)
+	}
+}
+
+func TestEmitterHidesExtensionLines(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	e.emit("DD_EXTENSION | DEBUG | flushing")
+	e.emit("hello")
+	if logs.Len() != 1 {
+		t.Errorf("extension line should be hidden, got %d lines", logs.Len())
+	}
+	lines, bytes := e.extensionStats()
+	if lines != 1 || bytes != int64(len("DD_EXTENSION | DEBUG | flushing")) {
+		t.Errorf("got %d %d", lines, bytes)
+	}
+
+	e.showExtension = true
+	e.emit("DD_EXTENSION | DEBUG | flushing")
+	if logs.Len() != 2 {
+		t.Errorf("extension line should be printed")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// awsReversers returns reversers of mutations made to AWS, keyed by the kind of journalEntry
+func awsReversers(sess *session.Session) map[string]reverser {
+	return map[string]reverser{
+		kindLogGroupRetention: newRetentionReverser(sess),
+		kindFunctionLogLevel:  newLogLevelReverser(sess),
+	}
+}
+
+// runCleanup runs the cleanup subcommand, which reverts mutations left in the journal
+func runCleanup(args []string) error {
+	var journalPath string
+	var yes bool
+	var json bool
+
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	fs.StringVar(&journalPath, "journal", defaultJournalPath(), "journal file of mutations")
+	fs.BoolVar(&yes, "yes", false, "revert without confirmation")
+	fs.BoolVar(&json, "json", false, "enable JSON log format")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{json: json})
+	defer logger.Sync()
+
+	awsOpts, err := newAWSSessionOptions("", *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	confirm := func(e journalEntry) bool {
+		if yes {
+			return true
+		}
+		fmt.Printf("revert %s %s recorded at %s? [y/N]: ", e.Kind, e.Resource, e.Time.Format("2006-01-02 15:04:05"))
+		answer, _ := stdin.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+
+	return cleanupJournal(context.Background(), newJournal(journalPath), awsReversers(sess), confirm)
+}
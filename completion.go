@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// completion strategies, how the end and the outcome of an invocation are known
+const (
+	completionAuto     = "auto"     // logs, unless logging of the function is off
+	completionLogs     = "logs"     // END and REPORT in the tail
+	completionMetrics  = "metrics"  // the datapoints of Invocations and Errors
+	completionResponse = "response" // only the response of a sync invocation, never selected explicitly
+)
+
+const (
+	metricsPollInterval = 30 * time.Second
+	metricsInferTimeout = 5 * time.Minute
+	metricsPeriod       = 60 // seconds, the finest period of the Lambda metrics
+)
+
+// metricDataAPI is the part of CloudWatch API used to infer the outcome from the metrics
+type metricDataAPI interface {
+	GetMetricDataWithContext(aws.Context, *cloudwatch.GetMetricDataInput, ...request.Option) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+// resolveCompletion returns the strategy which decides the outcome of an invocation of the type
+func resolveCompletion(strategy string, loggingOff bool, invocationType string) string {
+	if strategy != completionAuto {
+		return strategy
+	}
+	if !loggingOff {
+		return completionLogs
+	}
+	if invocationType == lambda.InvocationTypeRequestResponse {
+		return completionResponse
+	}
+	return completionMetrics
+}
+
+// metricPoint is a one-minute datapoint of the metrics of a function
+type metricPoint struct {
+	Invocations float64
+	Errors      float64
+	DurationMin float64 // milliseconds
+	DurationMax float64
+}
+
+// metricQueryIDs are the ids of the queries of the metric points
+var metricQueryIDs = []struct {
+	id, metric, stat string
+}{
+	{"invocations", "Invocations", "Sum"},
+	{"errors", "Errors", "Sum"},
+	{"duration_min", "Duration", "Minimum"},
+	{"duration_max", "Duration", "Maximum"},
+}
+
+// metricDimensions returns the dimensions of the metrics of the function, of the alias or the version if any
+func metricDimensions(ref FunctionRef) []*cloudwatch.Dimension {
+	dims := []*cloudwatch.Dimension{{Name: aws.String("FunctionName"), Value: aws.String(ref.Name)}}
+	if ref.Qualifier != "" {
+		dims = append(dims, &cloudwatch.Dimension{Name: aws.String("Resource"), Value: aws.String(ref.Name + ":" + ref.Qualifier)})
+	}
+	return dims
+}
+
+// fetchMetricPoints returns the one-minute datapoints of the function in [start, end) by minute
+func fetchMetricPoints(ctx context.Context, api metricDataAPI, ref FunctionRef, start, end time.Time) (map[time.Time]*metricPoint, error) {
+	queries := make([]*cloudwatch.MetricDataQuery, len(metricQueryIDs))
+	for i, q := range metricQueryIDs {
+		queries[i] = &cloudwatch.MetricDataQuery{
+			Id: aws.String(q.id),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					Namespace:  aws.String("AWS/Lambda"),
+					MetricName: aws.String(q.metric),
+					Dimensions: metricDimensions(ref),
+				},
+				Period: aws.Int64(metricsPeriod),
+				Stat:   aws.String(q.stat),
+			},
+		}
+	}
+	out, err := api.GetMetricDataWithContext(ctx, &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		MetricDataQueries: queries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetMetricData: %w", err)
+	}
+	ret := make(map[time.Time]*metricPoint)
+	for _, r := range out.MetricDataResults {
+		for i, ts := range r.Timestamps {
+			if i >= len(r.Values) {
+				break
+			}
+			minute := aws.TimeValue(ts).UTC().Truncate(time.Minute)
+			p := ret[minute]
+			if p == nil {
+				p = &metricPoint{}
+				ret[minute] = p
+			}
+			v := aws.Float64Value(r.Values[i])
+			switch aws.StringValue(r.Id) {
+			case "invocations":
+				p.Invocations = v
+			case "errors":
+				p.Errors = v
+			case "duration_min":
+				p.DurationMin = v
+			case "duration_max":
+				p.DurationMax = v
+			}
+		}
+	}
+	return ret, nil
+}
+
+// metricsCompletion is the outcome of an invocation inferred from the metrics of the function
+type metricsCompletion = schema.MetricsCompletion
+
+// metricsFailed returns true if the errors of the minute are attributed to the request. When other
+// invocations share the minute, any error is, as it may be ours.
+func metricsFailed(m *metricsCompletion) bool {
+	return m.Errors > 0
+}
+
+// durationRange returns the duration range, ex: "812ms" or "120ms-340ms"
+func durationRange(m *metricsCompletion) string {
+	lo, hi := int64(math.Round(m.DurationMin)), int64(math.Round(m.DurationMax))
+	if lo == hi {
+		return fmt.Sprintf("%dms", lo)
+	}
+	return fmt.Sprintf("%dms-%dms", lo, hi)
+}
+
+// attributeDatapoint attributes the first datapoint since the minute of the invocation which counts
+// more invocations than the baseline of the minute taken before invoking. It returns false if none does.
+func attributeDatapoint(points map[time.Time]*metricPoint, baseline metricPoint, invoked time.Time) (metricsCompletion, bool) {
+	since := invoked.UTC().Truncate(time.Minute)
+	minutes := make([]time.Time, 0, len(points))
+	for t := range points {
+		if !t.Before(since) {
+			minutes = append(minutes, t)
+		}
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i].Before(minutes[j]) })
+
+	for _, t := range minutes {
+		p := *points[t]
+		before := metricPoint{}
+		if t.Equal(since) {
+			before = baseline
+		}
+		invocations := p.Invocations - before.Invocations
+		if invocations <= 0 {
+			continue
+		}
+		ret := metricsCompletion{
+			Minute:      t,
+			Invocations: invocations,
+			Errors:      math.Max(p.Errors-before.Errors, 0),
+			DurationMin: p.DurationMin,
+			DurationMax: p.DurationMax,
+		}
+		if invocations > 1 {
+			ret.Ambiguous = true
+			ret.Caveats = append(ret.Caveats, fmt.Sprintf("%g invocations are counted in the minute of ours, the errors and the duration may be of the others", invocations))
+		} else if p.Invocations > 1 {
+			ret.Caveats = append(ret.Caveats, fmt.Sprintf("the duration range is of all the %g invocations in the minute", p.Invocations))
+		}
+		return ret, true
+	}
+	return metricsCompletion{}, false
+}
+
+// metricsBaseline returns the datapoint of the minute of the invocation before invoking, so that the
+// invocations of others earlier in the minute are not attributed to ours. A datapoint published late
+// is missed, which the caveat of an ambiguous attribution tells.
+func metricsBaseline(ctx context.Context, api metricDataAPI, ref FunctionRef, now time.Time) metricPoint {
+	minute := now.UTC().Truncate(time.Minute)
+	points, err := fetchMetricPoints(ctx, api, ref, minute, minute.Add(time.Minute))
+	if err != nil {
+		logger.Debugf("no baseline of the metrics of %s: %s", ref.Name, err)
+		return metricPoint{}
+	}
+	if p := points[minute]; p != nil {
+		return *p
+	}
+	return metricPoint{}
+}
+
+// completeFromMetrics polls the metrics of the function since the invocation until a datapoint is
+// attributed to it or the timeout expires
+func completeFromMetrics(ctx context.Context, api metricDataAPI, ref FunctionRef, baseline metricPoint, invoked time.Time, timeout, interval time.Duration, now func() time.Time) (metricsCompletion, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	since := invoked.UTC().Truncate(time.Minute)
+	unknown := &timeoutError{fmt.Errorf("no datapoint of %s is attributed to the invocation in %s, the outcome is unknown", ref.Name, timeout)}
+	for polls := 1; ; polls++ {
+		points, err := fetchMetricPoints(ctx, api, ref, since, now().UTC().Add(time.Minute).Truncate(time.Minute))
+		if ctx.Err() != nil {
+			return metricsCompletion{Polls: polls}, unknown
+		}
+		if err != nil {
+			return metricsCompletion{Polls: polls}, err
+		}
+		if m, ok := attributeDatapoint(points, baseline, invoked); ok {
+			m.Polls = polls
+			return m, nil
+		}
+		if sleepContext(ctx, interval) != nil {
+			return metricsCompletion{Polls: polls}, unknown
+		}
+	}
+}
+
+// completeByMetrics decides the outcome of the invocation by the metrics strategy
+func (sl *AWSServerless) completeByMetrics(ctx context.Context) error {
+	logger.Infof("waiting for the metrics of %s up to %s", sl.funcName, metricsInferTimeout)
+	m, err := completeFromMetrics(ctx, sl.metricsClient, sl.ref, sl.metricsBaseline, sl.invokedAt, metricsInferTimeout, metricsPollInterval, sl.now)
+	sl.inference = &m
+	if err != nil {
+		return err
+	}
+	for _, c := range m.Caveats {
+		logger.Warnf("%s", c)
+	}
+	if metricsFailed(&m) {
+		return &functionError{fmt.Errorf("%g errors of %g invocations in the metrics of %s, inferred from metrics", m.Errors, m.Invocations, sl.funcName)}
+	}
+	return nil
+}
+
+// outcomeNote returns how the outcome is known when it is not from the logs
+func (sl *AWSServerless) outcomeNote() string {
+	if sl.dryRun {
+		return fmt.Sprintf("dry run, status %d", sl.statusCode)
+	}
+	if w := sl.warmup.summary(); w != nil {
+		return "warmup, " + warmupLine(w)
+	}
+	if sl.noLogs {
+		return fmt.Sprintf("invoked asynchronously, status %d, the outcome is not known without the logs", sl.statusCode)
+	}
+	switch sl.completion {
+	case completionResponse:
+		return "outcome from the response, logging is off"
+	case completionMetrics:
+		if sl.inference == nil {
+			return "inferred from metrics"
+		}
+		note := "inferred from metrics, " + durationRange(sl.inference)
+		if sl.inference.Ambiguous {
+			note += ", ambiguous"
+		}
+		return note
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// fakeMetrics serves the datapoints of each poll by minute
+type fakeMetrics struct {
+	polls  []map[time.Time]metricPoint
+	inputs []*cloudwatch.GetMetricDataInput
+}
+
+func (f *fakeMetrics) GetMetricDataWithContext(ctx aws.Context, input *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	f.inputs = append(f.inputs, input)
+	var points map[time.Time]metricPoint
+	if len(f.polls) > 0 {
+		points = f.polls[0]
+		f.polls = f.polls[1:]
+	}
+	results := make(map[string]*cloudwatch.MetricDataResult)
+	for _, q := range input.MetricDataQueries {
+		results[aws.StringValue(q.Id)] = &cloudwatch.MetricDataResult{Id: q.Id}
+	}
+	for t, p := range points {
+		if t.Before(aws.TimeValue(input.StartTime)) || !t.Before(aws.TimeValue(input.EndTime)) {
+			continue
+		}
+		for id, v := range map[string]float64{"invocations": p.Invocations, "errors": p.Errors, "duration_min": p.DurationMin, "duration_max": p.DurationMax} {
+			r := results[id]
+			r.Timestamps = append(r.Timestamps, aws.Time(t))
+			r.Values = append(r.Values, aws.Float64(v))
+		}
+	}
+	out := &cloudwatch.GetMetricDataOutput{}
+	for _, r := range results {
+		out.MetricDataResults = append(out.MetricDataResults, r)
+	}
+	return out, nil
+}
+
+func TestResolveCompletion(t *testing.T) {
+	sync, async := lambda.InvocationTypeRequestResponse, lambda.InvocationTypeEvent
+	tests := []struct {
+		strategy   string
+		loggingOff bool
+		typ        string
+		want       string
+	}{
+		{completionAuto, false, async, completionLogs},
+		{completionAuto, true, async, completionMetrics},
+		{completionAuto, true, sync, completionResponse},
+		{completionLogs, true, async, completionLogs},
+		{completionMetrics, false, sync, completionMetrics},
+	}
+	for _, tt := range tests {
+		if got := resolveCompletion(tt.strategy, tt.loggingOff, tt.typ); got != tt.want {
+			t.Errorf("%+v: got %s", tt, got)
+		}
+	}
+}
+
+func TestAttributeDatapoint(t *testing.T) {
+	invoked := time.Date(2020, 12, 20, 10, 15, 42, 0, time.UTC)
+	minute := invoked.Truncate(time.Minute)
+
+	// ours is the only one since the baseline
+	m, ok := attributeDatapoint(map[time.Time]*metricPoint{
+		minute.Add(-time.Minute): {Invocations: 5, Errors: 5},
+		minute:                   {Invocations: 3, Errors: 1, DurationMin: 100, DurationMax: 900},
+	}, metricPoint{Invocations: 2, Errors: 1}, invoked)
+	if !ok || m.Invocations != 1 || m.Errors != 0 || m.Ambiguous || metricsFailed(&m) {
+		t.Errorf("got %+v", m)
+	}
+	if len(m.Caveats) != 1 || !strings.Contains(m.Caveats[0], "duration range") || durationRange(&m) != "100ms-900ms" {
+		t.Errorf("the duration of the minute includes the others, got %+v", m)
+	}
+
+	// other invocations in the same minute
+	m, ok = attributeDatapoint(map[time.Time]*metricPoint{
+		minute: {Invocations: 3, Errors: 1, DurationMin: 120, DurationMax: 340},
+	}, metricPoint{}, invoked)
+	if !ok || !m.Ambiguous || m.Invocations != 3 || !metricsFailed(&m) || len(m.Caveats) != 1 || !strings.Contains(m.Caveats[0], "3 invocations") {
+		t.Errorf("got %+v", m)
+	}
+
+	// the invocation is counted in the next minute
+	m, ok = attributeDatapoint(map[time.Time]*metricPoint{
+		minute:                  {Invocations: 1},
+		minute.Add(time.Minute): {Invocations: 1, DurationMin: 812, DurationMax: 812},
+	}, metricPoint{Invocations: 1}, invoked)
+	if !ok || !m.Minute.Equal(minute.Add(time.Minute)) || m.Ambiguous || len(m.Caveats) != 0 || durationRange(&m) != "812ms" {
+		t.Errorf("got %+v", m)
+	}
+
+	if _, ok := attributeDatapoint(map[time.Time]*metricPoint{minute: {Invocations: 2}}, metricPoint{Invocations: 2}, invoked); ok {
+		t.Errorf("only the baseline is counted")
+	}
+}
+
+func TestCompleteFromMetrics(t *testing.T) {
+	invoked := time.Date(2020, 12, 20, 10, 15, 42, 0, time.UTC)
+	minute := invoked.Truncate(time.Minute)
+	now := func() time.Time { return invoked.Add(30 * time.Second) }
+	ref := FunctionRef{Name: "orders-fn", Qualifier: "live"}
+
+	api := &fakeMetrics{polls: []map[time.Time]metricPoint{
+		{},
+		{minute: {Invocations: 4}},
+		{minute: {Invocations: 5, DurationMin: 200, DurationMax: 200}},
+	}}
+	m, err := completeFromMetrics(context.Background(), api, ref, metricPoint{Invocations: 4}, invoked, time.Minute, time.Millisecond, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Polls != 3 || m.Invocations != 1 || m.Ambiguous || metricsFailed(&m) {
+		t.Errorf("got %+v", m)
+	}
+	in := api.inputs[0]
+	if !aws.TimeValue(in.StartTime).Equal(minute) || !aws.TimeValue(in.EndTime).Equal(minute.Add(2*time.Minute)) {
+		t.Errorf("got %s - %s", in.StartTime, in.EndTime)
+	}
+	dims := in.MetricDataQueries[0].MetricStat.Metric.Dimensions
+	if len(dims) != 2 || aws.StringValue(dims[1].Value) != "orders-fn:live" {
+		t.Errorf("got %v", dims)
+	}
+
+	// no datapoint until the timeout
+	m, err = completeFromMetrics(context.Background(), &fakeMetrics{}, ref, metricPoint{}, invoked, 20*time.Millisecond, time.Millisecond, now)
+	if err == nil || !strings.Contains(err.Error(), "outcome is unknown") || isFunctionError(err) || m.Polls < 2 {
+		t.Errorf("got %+v, %v", m, err)
+	}
+}
+
+func TestMetricsBaseline(t *testing.T) {
+	setTestLogger(t)
+	now := time.Date(2020, 12, 20, 10, 15, 42, 0, time.UTC)
+	api := &fakeMetrics{polls: []map[time.Time]metricPoint{{now.Truncate(time.Minute): {Invocations: 7, Errors: 2}}}}
+	if b := metricsBaseline(context.Background(), api, FunctionRef{Name: "orders-fn"}, now); b.Invocations != 7 || b.Errors != 2 {
+		t.Errorf("got %+v", b)
+	}
+}
+
+func TestCompletionStrategyOutcome(t *testing.T) {
+	setTestLogger(t)
+	invoked := time.Now()
+	newServerless := func(api metricDataAPI) *AWSServerless {
+		return &AWSServerless{funcName: "orders-fn", ref: FunctionRef{Name: "orders-fn"}, completion: completionMetrics, metricsClient: api, invokedAt: invoked}
+	}
+	minute := invoked.UTC().Truncate(time.Minute)
+
+	sl := newServerless(&fakeMetrics{polls: []map[time.Time]metricPoint{{minute: {Invocations: 1, Errors: 1, DurationMin: 30, DurationMax: 30}}}})
+	if err := sl.completeByMetrics(context.Background()); !isFunctionError(err) {
+		t.Errorf("an error in the metrics is a failure, got %v", err)
+	}
+
+	sl = newServerless(&fakeMetrics{polls: []map[time.Time]metricPoint{{minute: {Invocations: 2, DurationMin: 30, DurationMax: 45}}}})
+	if err := sl.completeByMetrics(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	v := formatVerdict(verdictInput{Function: "orders-fn", Note: sl.outcomeNote()})
+	if v.Outcome != outcomeSuccess || v.Line != "✅ orders-fn finished, inferred from metrics, 30ms-45ms, ambiguous" {
+		t.Errorf("got %+v", v)
+	}
+
+	sl = &AWSServerless{completion: completionResponse}
+	if v := formatVerdict(verdictInput{Function: "orders-fn", Note: sl.outcomeNote()}); v.Line != "✅ orders-fn finished, outcome from the response, logging is off" {
+		t.Errorf("got %+v", v)
+	}
+	if sl := (&AWSServerless{completion: completionLogs}); sl.outcomeNote() != "" {
+		t.Errorf("the logs need no note")
+	}
+}
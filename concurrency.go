@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// defaultConcurrencyTimeout is how long each invocation of -concurrency is tailed, the max timeout of Lambda
+const defaultConcurrencyTimeout = 15 * time.Minute
+
+// concurrentRun is the invocations of -concurrency or -payload-ndjson, which are tailed together
+type concurrentRun struct {
+	n           int
+	payloads    []string // of -payload-ndjson by item, nil invokes the payload n times
+	lines       []int    // of the payloads in payloadFile
+	payloadFile string
+	workers     int  // invocations in flight at once
+	failFast    bool // no invocation is made after one fails
+	reportPath  string
+	timeout     time.Duration // of each invocation, from the invocations to its END
+
+	mu      sync.Mutex
+	results []concurrentResult // by item
+	stopped bool               // by -fail-fast
+	tracker *requestSetTracker // set when the invocations are done
+	labels  map[string]string  // label by request id, set with tracker
+}
+
+// concurrentResult is the response of one of the invocations
+type concurrentResult struct {
+	invoked       bool // false when the invocation is skipped by -fail-fast or a cancellation
+	requestID     string
+	functionError string // FunctionError of a sync invocation, "" if none
+	payload       []byte
+	err           error // the invocation was not made
+}
+
+func (r concurrentResult) failed() bool {
+	return r.err != nil || r.functionError != ""
+}
+
+// label returns the ordinal of the invocation, ex: "#03". The items are dispatched in their order, the lines
+// of -payload-ndjson in the order of the file, so the same inputs give the same labels.
+func (c *concurrentRun) label(i int) string {
+	return ordinalLabel(i, c.n)
+}
+
+// labelOf returns the label of the request, "" if it is not ours
+func (c *concurrentRun) labelOf(requestID string) string {
+	return c.labels[requestID]
+}
+
+// item returns the name of the invocation in the logs, ex: "#03 line 5" of -payload-ndjson
+func (c *concurrentRun) item(i int) string {
+	if c.payloads == nil {
+		return c.label(i)
+	}
+	return fmt.Sprintf("%s line %d", c.label(i), c.lines[i])
+}
+
+// invokeConcurrently invokes the function n times by c.workers at once, with the same payload or with each
+// payload of -payload-ndjson. Failed invocations are returned after the tail, which follows every request
+// which was invoked.
+func (sl *AWSServerless) invokeConcurrently(ctx context.Context, svc invokeAPI, invocationType string) error {
+	c := sl.concurrent
+	sl.invokedType = invocationType
+	if c.payloads != nil {
+		logger.Infof("invoke %s by each of %d lines of %s, %d at once", sl.funcName, c.n, c.payloadFile, c.workers)
+	} else {
+		logger.Infof("invoke %s %d times at once", sl.funcName, c.n)
+	}
+
+	c.results = make([]concurrentResult, c.n)
+	items := make(chan int)
+	go func() {
+		defer close(items)
+		for i := 0; i < c.n; i++ {
+			select {
+			case items <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	versions := make(map[string]bool)
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				c.mu.Lock()
+				stopped := c.stopped
+				c.mu.Unlock()
+				if stopped {
+					continue
+				}
+				input := sl.invokeInput(invocationType)
+				if c.payloads != nil {
+					input.Payload = []byte(c.payloads[i])
+				}
+				resp, requestID, err := sl.callInvoke(ctx, svc, input)
+				r := concurrentResult{invoked: true, requestID: requestID, err: err}
+				if err == nil {
+					r.functionError, r.payload = aws.StringValue(resp.FunctionError), resp.Payload
+					if err := checkInvokeStatus(invocationType, int(aws.Int64Value(resp.StatusCode))); err != nil {
+						r.err = err
+					}
+				}
+				c.mu.Lock()
+				c.results[i] = r
+				if r.failed() && c.failFast && !c.stopped {
+					c.stopped = true
+					logger.Warnf("%s failed, no more invocation is made by -fail-fast", c.item(i))
+				}
+				if resp != nil && resp.ExecutedVersion != nil {
+					versions[aws.StringValue(resp.ExecutedVersion)] = true
+				}
+				c.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+
+	var ids []string
+	var failed []string
+	c.labels = make(map[string]string, c.n)
+	skipped := 0
+	for i, r := range c.results {
+		switch {
+		case !r.invoked:
+			skipped++
+			continue
+		case r.err != nil:
+			logger.Warnf("%s failed: %s", c.item(i), r.err)
+			failed = append(failed, fmt.Sprintf("%s: %s", c.item(i), r.err))
+			continue
+		case r.functionError != "":
+			failed = append(failed, fmt.Sprintf("%s: %s: %s: %s", c.item(i), r.requestID, r.functionError, string(r.payload)))
+		}
+		if len(r.payload) > 0 {
+			logger.Infof("response of %s %s: %s", c.label(i), r.requestID, truncateMiddle(string(r.payload), functionURLResponseLimit))
+		}
+		ids = append(ids, r.requestID)
+		c.labels[r.requestID] = c.label(i)
+	}
+	if len(ids) == 0 {
+		if len(failed) == 0 {
+			return fmt.Errorf("none of %d invocations of %s was made: %w", c.n, sl.funcName, ctx.Err())
+		}
+		return fmt.Errorf("none of %d invocations of %s was made: %s", c.n, sl.funcName, failed[0])
+	}
+	// an alias may route the invocations to two versions
+	if sl.streamVersions != nil && len(versions) > 0 {
+		sl.streamVersions = sl.streamVersions[:0]
+		for v := range versions {
+			sl.streamVersions = append(sl.streamVersions, v)
+		}
+	}
+	c.tracker = newRequestSetTracker(ids, time.Now().Add(c.timeout))
+	logger.Infof("%d of %d invocations are made: %s", len(ids), c.n, strings.Join(ids, ", "))
+	if len(failed) > 0 {
+		err := fmt.Errorf("%d of %d invocations failed: %s", len(failed), c.n, strings.Join(failed, "; "))
+		if skipped > 0 {
+			err = fmt.Errorf("%w; %d are skipped", err, skipped)
+		}
+		sl.responseErr = &functionError{err}
+	}
+	return nil
+}
+
+// request statuses of schema.ConcurrentRequest
+const (
+	requestSucceeded = "succeeded"
+	requestFailed    = "failed"
+	requestSkipped   = "skipped"
+)
+
+// requestsOf returns the result of each invocation with its REPORT in the order of the items, nil for a
+// single invocation. A request succeeds when it is invoked, has no function error and ends in the timeout.
+func (c *concurrentRun) requestsOf(summary *summaryBuilder) []schema.ConcurrentRequest {
+	if c == nil || c.results == nil {
+		return nil
+	}
+	ret := make([]schema.ConcurrentRequest, 0, len(c.results))
+	for i, r := range c.results {
+		req := schema.ConcurrentRequest{Label: c.label(i), RequestID: r.requestID, Status: requestSucceeded}
+		if c.payloads != nil {
+			req.Line = c.lines[i]
+		}
+		switch {
+		case !r.invoked:
+			req.Status = requestSkipped
+		case r.err != nil:
+			req.Status, req.Error = requestFailed, r.err.Error()
+		default:
+			if r.functionError != "" {
+				req.Status, req.Error = requestFailed, r.functionError
+			}
+			if c.tracker != nil {
+				s := c.tracker.trackers[r.requestID].State()
+				req.State, req.Report = s.String(), summary.report(r.requestID)
+				if s < stateEnded || s == stateTimedOut {
+					req.Status = requestFailed
+					if req.Error == "" {
+						req.Error = fmt.Sprintf("not ended in %s", c.timeout)
+					}
+				}
+			}
+		}
+		ret = append(ret, req)
+	}
+	return ret
+}
+
+// logRequests prints the duration of each request from its REPORT, and returns an error if any is not ended
+func (c *concurrentRun) logRequests(summary *summaryBuilder) error {
+	var unfinished []string
+	for _, r := range c.requestsOf(summary) {
+		if r.State == "" {
+			continue
+		}
+		if r.Report == nil {
+			logger.Infof("%s %s: %s, no REPORT", r.Label, r.RequestID, r.State)
+		} else {
+			logger.Infof("%s %s: %s, duration %.2f ms, billed %.0f ms, max memory %.0f MB", r.Label, r.RequestID, r.State, r.Report.Duration, r.Report.BilledDuration, r.Report.MaxMemoryUsed)
+		}
+		if s := c.tracker.trackers[r.RequestID].State(); s < stateEnded || s == stateTimedOut {
+			unfinished = append(unfinished, r.Label+" "+r.RequestID)
+		}
+	}
+	if len(unfinished) > 0 {
+		return &timeoutError{fmt.Errorf("%d of %d requests did not end in %s: %s", len(unfinished), len(c.tracker.ids), c.timeout, strings.Join(unfinished, ", "))}
+	}
+	return nil
+}
+
+// requestSetTracker follows the lifecycles of several invocations, each by its own InvocationTracker.
+// A log stream runs one invocation at a time, so a line belongs to the request of the last START in its stream.
+type requestSetTracker struct {
+	ids      []string
+	trackers map[string]*InvocationTracker
+	running  map[string]string // request id by log stream
+	deadline time.Time         // the requests which have not ended by then are timed out
+	now      func() time.Time
+}
+
+func newRequestSetTracker(ids []string, deadline time.Time) *requestSetTracker {
+	t := &requestSetTracker{
+		ids:      ids,
+		trackers: make(map[string]*InvocationTracker, len(ids)),
+		running:  make(map[string]string),
+		deadline: deadline,
+		now:      time.Now,
+	}
+	for _, id := range ids {
+		t.trackers[id] = NewInvocationTracker(id)
+	}
+	return t
+}
+
+// ObserveLine feeds a log line to the tracker of its request
+func (t *requestSetTracker) ObserveLine(stream, message string) observation {
+	kind, requestID, _ := parseLifecycle(message)
+	if kind == "" {
+		return observation{Decision: t.decision()}
+	}
+	rt, ok := t.trackers[requestID]
+	if !ok {
+		if kind == lifecycleStart {
+			delete(t.running, stream)
+		}
+		return observation{Kind: kind, RequestID: requestID, Foreign: true, Decision: t.decision()}
+	}
+	if kind == lifecycleStart {
+		t.running[stream] = requestID
+	}
+	obs := rt.Observe(message)
+	obs.Decision = t.decision()
+	return obs
+}
+
+// LineRequestID returns the request running in the stream, "" if it is not ours
+func (t *requestSetTracker) LineRequestID(stream string) string {
+	return t.running[stream]
+}
+
+// RequestID returns "", no single request is ours
+func (t *requestSetTracker) RequestID() string {
+	return ""
+}
+
+// stateRanks orders the states from the worst, which the state of the set is
+var stateRanks = map[invocationState]int{stateAbandoned: 0, stateTimedOut: 1, statePending: 2, stateStarted: 3, stateEnded: 4, stateReported: 5}
+
+// State returns the worst state of the requests, ex: TimedOut if any request timed out
+func (t *requestSetTracker) State() invocationState {
+	ret := stateReported
+	for _, rt := range t.trackers {
+		if s := rt.State(); stateRanks[s] < stateRanks[ret] {
+			ret = s
+		}
+	}
+	return ret
+}
+
+// Abandon abandons every request which has not ended
+func (t *requestSetTracker) Abandon() {
+	for _, rt := range t.trackers {
+		rt.Abandon()
+	}
+}
+
+// decision completes the tail when every request is reported, or timed out after the deadline
+func (t *requestSetTracker) decision() trackerDecision {
+	if t.now().After(t.deadline) {
+		for _, rt := range t.trackers {
+			rt.Timeout()
+		}
+	}
+	ret := decisionComplete
+	for _, rt := range t.trackers {
+		switch rt.decision() {
+		case decisionContinue:
+			return decisionContinue
+		case decisionAwaitReport:
+			ret = decisionAwaitReport
+		}
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// countingInvoke answers each Invoke with the next request id in x-amzn-RequestId, failing the ones in fail
+type countingInvoke struct {
+	mu       sync.Mutex
+	calls    int
+	fail     map[int]error
+	payloads []string // in the order of the calls
+}
+
+func (f *countingInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.mu.Lock()
+	f.calls++
+	n := f.calls
+	f.payloads = append(f.payloads, string(input.Payload))
+	f.mu.Unlock()
+	if err := f.fail[n]; err != nil {
+		return nil, err
+	}
+	r := &request.Request{HTTPResponse: &http.Response{Header: http.Header{}}}
+	r.HTTPResponse.Header.Set("X-Amzn-Requestid", fmt.Sprintf("r%d", n))
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.Handlers.Complete.Run(r)
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+}
+
+func lifecycleLines(requestID string) []string {
+	return []string{
+		"START RequestId: " + requestID + " Version: $LATEST",
+		"processing " + requestID,
+		"END RequestId: " + requestID,
+		"REPORT RequestId: " + requestID + "\tDuration: 12.50 ms\tBilled Duration: 13 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB",
+	}
+}
+
+func TestConcurrentTail(t *testing.T) {
+	setTestLogger(t)
+	em, lines := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	sl := &AWSServerless{
+		funcName:   "orders-fn",
+		startTime:  time.Now(),
+		emitter:    em,
+		bus:        newBus(),
+		summary:    newSummaryBuilder(),
+		phases:     newPhaseTracker(time.Now()),
+		concurrent: &concurrentRun{n: 2, workers: 2, timeout: time.Minute},
+	}
+	sl.bus.subscribe("console", em, subscribeOptions{})
+	sl.bus.subscribe("summary", sl.summary, subscribeOptions{})
+	if err := sl.invokeConcurrently(context.Background(), &countingInvoke{}, lambda.InvocationTypeEvent); err != nil {
+		t.Fatal(err)
+	}
+	// another invocation runs in s1 before ours
+	sl.logClient = &deniedLogs{streams: map[string][]string{
+		"s1": append(lifecycleLines("r9"), lifecycleLines("r2")...),
+		"s2": lifecycleLines("r1"),
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/orders-fn"); err != nil {
+		t.Fatal(err)
+	}
+	if sl.invocationState != stateReported {
+		t.Errorf("got %s", sl.invocationState)
+	}
+	if err := sl.concurrent.logRequests(sl.summary); err != nil {
+		t.Error(err)
+	}
+	for _, r := range sl.concurrent.requestsOf(sl.summary) {
+		if r.State != "Reported" || r.Report == nil || r.Report.Duration != 12.5 {
+			t.Errorf("got %+v", r)
+		}
+	}
+	processing := lines.FilterMessageSnippet("processing")
+	if processing.Len() != 3 {
+		t.Errorf("got %d lines", processing.Len())
+	}
+	for _, e := range processing.All() {
+		if want := e.Message[strings.LastIndex(e.Message, " ")+1:]; want != "r9" && e.ContextMap()["request_id"] != want {
+			t.Errorf("%s: tagged with %v", e.Message, e.ContextMap()["request_id"])
+		}
+	}
+}
+
+func TestConcurrentTimeout(t *testing.T) {
+	setTestLogger(t)
+	tracker := newRequestSetTracker([]string{"r1", "r2"}, time.Now().Add(time.Minute))
+	for _, line := range lifecycleLines("r1") {
+		tracker.ObserveLine("s1", line)
+	}
+	tracker.ObserveLine("s2", "START RequestId: r2 Version: $LATEST")
+	if tracker.LineRequestID("s2") != "r2" || tracker.decision() != decisionContinue || tracker.State() != stateStarted {
+		t.Errorf("got %s %s", tracker.LineRequestID("s2"), tracker.State())
+	}
+	tracker.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if tracker.decision() != decisionComplete || tracker.State() != stateTimedOut {
+		t.Errorf("got %s", tracker.State())
+	}
+	c := &concurrentRun{n: 2, timeout: time.Minute, tracker: tracker, results: []concurrentResult{{invoked: true, requestID: "r1"}, {invoked: true, requestID: "r2"}}}
+	if err := c.logRequests(newSummaryBuilder()); err == nil || !strings.Contains(err.Error(), "1 of 2 requests did not end in 1m0s: #02 r2") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestInvokeConcurrentlyFailures(t *testing.T) {
+	setTestLogger(t)
+	sl := &AWSServerless{funcName: "orders-fn", phases: newPhaseTracker(time.Now()), concurrent: &concurrentRun{n: 3, workers: 3, timeout: time.Minute}}
+	api := &countingInvoke{fail: map[int]error{2: awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)}}
+	if err := sl.invokeConcurrently(context.Background(), api, lambda.InvocationTypeEvent); err != nil {
+		t.Fatal(err)
+	}
+	var fe *functionError
+	if len(sl.concurrent.tracker.ids) != 2 || !errors.As(sl.responseErr, &fe) || !strings.Contains(sl.responseErr.Error(), "1 of 3 invocations failed") {
+		t.Errorf("got %v %v", sl.concurrent.tracker.ids, sl.responseErr)
+	}
+
+	sl.concurrent = &concurrentRun{n: 2, workers: 2, timeout: time.Minute}
+	api = &countingInvoke{fail: map[int]error{1: errors.New("connection reset"), 2: errors.New("connection reset")}}
+	if err := sl.invokeConcurrently(context.Background(), api, lambda.InvocationTypeEvent); err == nil || !strings.Contains(err.Error(), "none of 2 invocations") {
+		t.Errorf("got %v", err)
+	}
+}
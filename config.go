@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -13,11 +17,146 @@ import (
 
 // Config struct
 type Config struct {
-	funcName string
-	vendor   Vendor
-	json     bool
+	funcName   string
+	qualifier  string // version or alias of -qualifier, "" to keep the one in -func
+	vendor     Vendor
+	json       bool
+	debug      bool
+	showConfig bool
+	plan       bool // print the calls of the run and exit without calling anything
 
-	payload string // request payload
+	payload     string // request payload
+	payloadFile string
+
+	payloadSource  string   // the flags the payload came from, "" when no payload flag is given
+	payloadWarning string   // why the payload looks like a failed expansion
+	strictPayload  bool     // fail instead of warning about such a payload
+	showPayload    bool     // log the payload as it is sent
+	rulesFile      string   // grep/grep-v/redact rules, reloaded when changed
+	rules          *ruleSet // the rules of rulesFile as loaded for the run, see invokeOnce
+
+	payloadTemplate *payloadTemplate // renders the payload, nil unless -payload-template
+
+	maxLineLength     int // max length of a log line printed to the console
+	shipMaxLineLength int // max length of a log line posted by -ship-to
+
+	showExtensionLogs bool // print log lines of extensions and telemetry agents
+	timeline          bool // print the phases and the log bursts of the run after it
+
+	retryIf     *expr // re-invoke synchronously while the response matches
+	maxAttempts int
+
+	retryOnFailure bool          // re-invoke synchronously while the function fails
+	retryDelay     time.Duration // between the attempts, 0 for the backoff
+
+	invocationType string             // invocationAuto, invocationEvent or invocationRequestResponse
+	via            string             // viaInvoke, viaURL, viaEventBridge or viaSQS
+	eventBridge    *eventBridgeTarget // the event of -via eventbridge
+	sqs            *sqsTarget         // the queue of -via sqs
+	dryRun         bool               // invoke with the DryRun invocation type, which checks the permission without running
+	noLogs         bool               // only invoke asynchronously, without a call to CloudWatch Logs
+	invokeRetry    invokeRetryPolicy  // of an invocation rejected by throttling
+	concurrent     *concurrentRun     // the invocations of -concurrency or -payload-ndjson, nil for a single invocation
+	warmup         *warmupRun         // the invocations of -warmup, nil unless warming up
+	output         string             // the file the response is written to, - for stdout
+	runTimeout     time.Duration      // bounds the whole run, 0 for no limit
+
+	waitActiveTimeout time.Duration // how long the function is waited for to be active before invoking, 0 not to wait
+	noPreflight       bool          // do not check that the function exists before invoking
+
+	xray bool // trace the invocation by X-Ray and print its segments
+
+	destinationTimeout time.Duration // how long the record of an async invocation is waited for in its destination, 0 not to check
+
+	requirePayloadIntegrity bool // fail unless the function echoes the same payload hash
+
+	deadlineMargin    float64        // an invocation is at risk when less than this ratio of time was remaining
+	remainingTimeExpr *regexp.Regexp // finds remaining milliseconds in a text log line
+
+	withEnv      []string      // KEY=VALUE environment variables of a local function
+	localTimeout time.Duration // timeout of a local function
+	localRIE     string        // URL of the Runtime Interface Emulator served by a local function
+
+	cancelExecution bool // cancel the execution of a Cloud Run job, a state machine or an ECS task when the run is interrupted
+
+	azureFunctionKey string // sent as x-functions-key
+	appInsightsAppID string // Application Insights which has the logs of the function app
+
+	knativeExternal bool // invoke a Knative Service at its external URL instead of the cluster-local one
+
+	openfaasURL      string // of the gateway
+	openfaasUser     string // of the basic auth of the gateway
+	openfaasPassword string
+
+	openwhiskAPIHost string // as wsk takes it, a host or a URL
+	openwhiskAuth    string // the auth key, UUID:KEY
+
+	alibabaAccountID string // the host of the Function Compute endpoint
+	alibabaRegion    string
+
+	ociAuth       string // "api_key" or "instance_principal"
+	ociConfigFile string // of the api_key auth
+	ociProfile    string
+
+	cloudflareAPIToken  string
+	cloudflareAccountID string
+	cloudflareScript    string // of the Worker of a route, looked up from the routes of the zone if empty
+
+	ecsCluster        string
+	ecsSubnets        []string // of the awsvpc network of the task
+	ecsSecurityGroups []string
+	ecsAssignPublicIP bool
+	ecsContainer      string // whose logs are tailed and whose exit code is the outcome, the first essential one if empty
+
+	jobQueue        string // an AWS Batch job is submitted to
+	batchParameters bool   // the payload is given as the parameters of the job instead of NODELESS_PAYLOAD
+
+	watch         bool          // re-invoke when the payload file is changed
+	watchDebounce time.Duration // wait for the file to settle
+
+	every time.Duration // invoke on the interval, 0 to invoke once
+	count int           // runs of -every, 0 for no limit
+
+	githubStatus *githubStatus // posts the verdict as a commit status
+
+	discoverRegion bool // find the region which has the function
+
+	readOnly bool // reject mutating API calls
+
+	noMetadataCache bool // call GetFunctionConfiguration every time
+
+	baseline *baselineCheck // compares the run with a baseline file
+
+	network networkOptions // how the AWS endpoints are reached
+
+	noCredentialCache bool // assume the role of the profile without the shared cache
+
+	pushgateway *pushgateway // pushes the metrics of the run
+
+	shipTo *shipTarget // the collector the log events are posted to, nil if none
+
+	publisher *resultPublisher // writes the result of the run to SSM or S3
+
+	streamPrefixMargin time.Duration // how long after UTC midnight the streams of the previous date are filtered too
+
+	limits Limits // intervals and sizes of the tail, of -tuning and its overrides
+
+	expect *sideEffectExpectation // side effects polled after the invocation, nil if none
+
+	completionStrategy string // how the outcome of an invocation is decided
+
+	setRetention int64 // days the retention of the log group is set to, 0 to leave it
+
+	responseGolden *responseGolden // compares the response with a golden file, nil if none
+
+	insightsMetrics string // whether the Lambda Insights metrics are read, "auto", "on" or "off"
+
+	withLogLevel string // application log level of the function during the run, "" to leave it
+
+	clientContext map[string]interface{} // ClientContext given by the user
+	noAttribution bool                   // do not add who invokes to the ClientContext
+
+	entries []configEntry // effective configuration with its source
 }
 
 // Vendor describe vendor string
@@ -28,82 +167,1244 @@ const (
 	VendorAWS Vendor = "aws"
 	// VendorGCP is a GCP vendor name
 	VendorGCP Vendor = "gcp"
+	// VendorAzure is an Azure vendor name
+	VendorAzure Vendor = "azure"
+	// VendorKnative is a Knative Serving vendor name
+	VendorKnative Vendor = "knative"
+	// VendorOpenFaaS is an OpenFaaS vendor name
+	VendorOpenFaaS Vendor = "openfaas"
+	// VendorOpenWhisk is an Apache OpenWhisk vendor name, which IBM Cloud Functions is too
+	VendorOpenWhisk Vendor = "openwhisk"
+	// VendorAlibaba is an Alibaba Cloud Function Compute vendor name
+	VendorAlibaba Vendor = "alibaba"
+	// VendorOCI is an Oracle Cloud Infrastructure Functions vendor name
+	VendorOCI Vendor = "oci"
+	// VendorCloudflare is a Cloudflare Workers vendor name
+	VendorCloudflare Vendor = "cloudflare"
+	// VendorECS runs an ECS task on Fargate as the function
+	VendorECS Vendor = "ecs"
+	// VendorAWSBatch submits an AWS Batch job as the function
+	VendorAWSBatch Vendor = "batch"
+	// VendorLocal runs a local program as the function
+	VendorLocal Vendor = "local"
 )
 
+// preferences of the invocation type
+const (
+	invocationAuto            = "auto"             // chosen by the payload size
+	invocationEvent           = "event"            // always async
+	invocationRequestResponse = "request-response" // always sync
+)
+
+// how a Lambda function is invoked
+const (
+	viaInvoke      = "invoke"      // the Invoke API
+	viaURL         = "url"         // an HTTP request to the Function URL
+	viaEventBridge = "eventbridge" // an event which a rule of the bus routes to the function
+	viaSQS         = "sqs"         // a message which the event source mapping of the queue delivers to the function
+)
+
+// configSource describes where a config value came from
+type configSource string
+
+const (
+	sourceDefault configSource = "default"
+	sourceEnv     configSource = "env"
+	sourceFlag    configSource = "flag"
+)
+
+// configEntry is a config value with its source
+type configEntry struct {
+	name   string
+	value  string
+	source configSource
+
+	overridesEnv bool // flag is given while the environment variable is also set
+	unsupported  bool // the vendor does not support the flag, ignored by -ignore-unsupported-flags
+}
+
+// secretFlags are never echoed, only summarized by hash and length
+var secretFlags = map[string]bool{
+	"payload": true,
+	"p":       true,
+	"var":     true,
+
+	"azure-function-key": true,
+	"openfaas-password":  true,
+	"openwhisk-auth":     true,
+
+	"cloudflare-api-token": true,
+}
+
+// deprecatedFlags are still accepted so that the existing scripts run, but ignored, with the reason
+var deprecatedFlags = map[string]string{
+	"events-cache": "the event ids of the last -events-window are remembered instead",
+}
+
+// envName returns the environment variable name for the flag name
+func envName(flagName string) string {
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
 func parseConfig() (*Config, error) {
+	return parseArgs(os.Args[1:], os.Getenv)
+}
+
+// parseFlags parses the args by fs, whose error of an invalid flag is a configError. -h is flag.ErrHelp
+// wrapped alike, after the usage is printed.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return &configError{err}
+	}
+	return nil
+}
+
+func parseArgs(args []string, getenv func(string) string) (*Config, error) {
 	var funcName string
 	var vendor string
 	var json bool
+	var debug bool
+	var showConfig bool
+	var plan bool
 	var payload string
 	var payloadFile string
+	var items payloadItems
+	var rulesFile string
+	var maxLineLength int
+	var showExtensionLogs bool
+	var timeline bool
+	var retryIf string
+	var retryOnFailure bool
+	var retryDelay time.Duration
+	var maxAttempts int
+	var invocationType string
+	var via string
+	var eventBridge eventBridgeTarget
+	var queue sqsTarget
+	var dryRun bool
+	var noLogs bool
+	invokeRetry := defaultInvokeRetryPolicy()
+	var concurrency int
+	var concurrencyTimeout time.Duration
+	var payloadNDJSON string
+	var batchWorkers int
+	var failFast bool
+	var batchReport string
+	var warmup int
+	var warmupPayload string
+	var waitActive bool
+	var waitActiveTimeout time.Duration
+	var noPreflight bool
+	var xray bool
+	var checkDestination bool
+	var destinationTimeout time.Duration
+	var output string
+	var runTimeout time.Duration
+	var qualifier string
+	var watch bool
+	var every time.Duration
+	var count int
+	var watchDebounce time.Duration
+	var ignoreUnsupportedFlags bool
+	var requirePayloadIntegrity bool
+	var withEnv envItems
+	var mergePayloadFlags bool
+	var stdinPayload bool
+	var strictPayload bool
+	var renderPayload bool
+	templateVarFlags := templateVars{}
+	var showPayload bool
+	var deadlineMargin float64
+	var remainingTimeExpr string
+	var localTimeout time.Duration
+	var localRIE string
+	var cancelExecution bool
+	var azureFunctionKey string
+	var appInsightsAppID string
+	var knativeExternal bool
+	var openfaasURL, openfaasUser, openfaasPassword string
+	var openwhiskAPIHost, openwhiskAuth string
+	var ecsCluster, ecsSubnets, ecsSecurityGroups, ecsContainer string
+	var ecsAssignPublicIP bool
+	var jobQueue string
+	var alibabaAccountID string
+	var alibabaRegion string
+	var ociAuth, ociConfigFile, ociProfile string
+	var cloudflareAPIToken, cloudflareAccountID, cloudflareScript string
+	var batchParameters bool
+	var githubStatusFlag string
+	var discoverRegion bool
+	var readOnly bool
+	var noMetadataCache bool
+	var baselinePath string
+	var baselineTolerance string
+	var saveBaseline string
+	var updateBaseline bool
+	var clientContext string
+	var noAttribution bool
+	var streamPrefixMargin time.Duration
+	var tuning string
+	var overrides Limits
+	var pushgatewayURL string
+	var shipTo string
+	var shipMaxLineLength int
+	var pushgatewayDeleteOnSuccess bool
+	var publishResult string
+	var publishOverwrite bool
+	var publishSecureString bool
+	var publishSpill string
+	var publishRequired bool
+	var expectSQSMessage string
+	var expectDynamoDBItem string
+	var expectFilter string
+	var consume bool
+	var expectTimeout time.Duration
+	var completionStrategy string
+	var setRetention string
+	var expectResponseFile string
+	var updateGolden bool
+	var responseTolerance float64
+	var responseIgnore jsonPointers
+	var insightsMetrics bool
+	var withLogLevel string
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&funcName, "func", "", "function name")
+	fs.StringVar(&qualifier, "qualifier", "", "version or alias of the function to invoke, the same as the :qualifier suffix of -func")
+	fs.StringVar(&vendor, "vendor", "aws", `vendor name, "aws", "gcp", "azure", "knative", "openfaas", "openwhisk", "alibaba", "oci", "cloudflare", "ecs", "batch" or "local"`)
+	fs.BoolVar(&ignoreUnsupportedFlags, "ignore-unsupported-flags", false, "warn instead of failing when a flag is not supported by the vendor")
+	fs.BoolVar(&json, "json", false, "enable JSON log format")
+	fs.BoolVar(&debug, "debug", false, "enable debug log")
+	fs.BoolVar(&showConfig, "show-config", false, "print the effective configuration and exit")
+	fs.BoolVar(&plan, "plan", false, "print every AWS call the run would make and exit without calling AWS")
+	fs.BoolVar(&dryRun, "dry-run", false, "invoke with the DryRun invocation type, which checks that the function exists and the credentials may invoke it without running it")
+	fs.BoolVar(&noLogs, "no-logs", false, "invoke asynchronously and exit with the status code and the request id, without reading the logs, for credentials which may not read them")
+	fs.StringVar(&payload, "payload", "", "request payload. higher priority than file")
+	fs.StringVar(&payloadFile, "payload_file", "", "speficy request payload file. ~ and $VAR are expanded, @latest:DIR is the most recently modified *.json of DIR, and - reads stdin")
+	fs.BoolVar(&stdinPayload, "payload-stdin", false, "read the payload from stdin until EOF, same as -payload_file -")
+	fs.BoolVar(&mergePayloadFlags, "merge-payloads", false, "deep-merge -payload onto -payload_file instead of ignoring the file")
+	fs.BoolVar(&renderPayload, "payload-template", false, `render the payload as a Go text/template with {{ env "NAME" }}, {{ var "key" }} of -var and {{ now }}`)
+	fs.Var(templateVarFlags, "var", "key=value variable of -payload-template. can be repeated")
+	fs.BoolVar(&showPayload, "show-payload", false, "log the payload as it is sent")
+	fs.BoolVar(&strictPayload, "strict-payload", false, `fail instead of warning when a payload flag is given but the payload is empty, whitespace only, "null", "undefined" or "{}"`)
+	fs.Var(&items, "p", "payload item, key=value or key:=json. can be repeated to build a JSON object")
+	fs.StringVar(&rulesFile, "rules-file", "", "grep/grep-v/redact rules file. reloaded when changed")
+	fs.BoolVar(&showExtensionLogs, "show-extension-logs", false, "print log lines of extensions and telemetry agents, which are hidden by default")
+	fs.BoolVar(&timeline, "timeline", false, "print a timeline of the phases and the log bursts after the run, or a timeline record with -json")
+	fs.StringVar(&retryIf, "retry-if-response", "", `invoke synchronously and re-invoke while the response matches the expression, ex: '.retry == true'`)
+	fs.IntVar(&maxAttempts, "max-attempts", 3, "max attempts of -retry-if-response and -retry-on-failure")
+	fs.BoolVar(&retryOnFailure, "retry-on-failure", false, "invoke synchronously and re-invoke with the same payload while the function fails, up to -max-attempts")
+	fs.DurationVar(&retryDelay, "retry-delay", 0, "wait between the attempts of -retry-if-response and -retry-on-failure. 0 backs off from 1s, doubling up to 30s")
+	fs.IntVar(&invokeRetry.maxAttempts, "invoke-max-attempts", defaultInvokeMaxAttempts, "max attempts of an invocation rejected by TooManyRequestsException or another transient error, 1 does not retry")
+	fs.IntVar(&concurrency, "concurrency", 1, "invoke the function the number of times at once with the same payload, and tail all of the requests")
+	fs.DurationVar(&concurrencyTimeout, "concurrency-timeout", defaultConcurrencyTimeout, "each request of -concurrency or -payload-ndjson which has not ended in the duration after the invocations is timed out")
+	fs.BoolVar(&waitActive, "wait-active", false, "wait until the function is Active and its last update is Successful before invoking, for a run right after a deploy")
+	fs.DurationVar(&waitActiveTimeout, "wait-active-timeout", defaultWaitActiveTimeout, "how long -wait-active waits")
+	fs.BoolVar(&noPreflight, "no-preflight", false, "do not check by GetFunction that the function exists before invoking")
+	fs.IntVar(&warmup, "warmup", 0, "invoke the function the number of times at once synchronously with -warmup-payload only to start as many execution environments, and report the cold starts instead of tailing the logs")
+	fs.StringVar(&warmupPayload, "warmup-payload", "", "payload of -warmup, "+defaultWarmupPayload+" if empty")
+	fs.DurationVar(&runTimeout, "timeout", 0, "stop the run when it has not finished in the duration, from the invocation to the end of the log tail, and exit with 4. 0 for no limit")
+	fs.StringVar(&output, "output", "", "write the response payload of a sync invocation, or its error document, to the file atomically, - for stdout. ~ and $VAR are expanded")
+	fs.StringVar(&payloadNDJSON, "payload-ndjson", "", "invoke the function once by each line of the file as the payload, and tail all of the requests. ~ and $VAR are expanded")
+	fs.IntVar(&batchWorkers, "batch-workers", 1, "invocations of -payload-ndjson in flight at once")
+	fs.BoolVar(&failFast, "fail-fast", false, "make no more invocation of -payload-ndjson after one fails")
+	fs.StringVar(&batchReport, "batch-report", "", "write the result of each line of -payload-ndjson to the file as JSON at the end")
+	fs.DurationVar(&invokeRetry.maxElapsed, "invoke-max-elapsed", defaultInvokeMaxElapsed, "no invocation is retried later than the duration after the first attempt")
+	fs.StringVar(&invocationType, "invocation-type", invocationAuto, `"auto", "event" or "request-response". auto invokes asynchronously unless the payload exceeds the async limit`)
+	fs.StringVar(&via, "via", viaInvoke, `"invoke", "url", "eventbridge" or "sqs". url posts the payload to the Function URL of the function, signed with SigV4 for the AWS_IAM auth type, eventbridge puts it as the detail of an event, and sqs sends it as a message to -queue, instead of calling the Invoke API`)
+	fs.StringVar(&eventBridge.bus, "eventbridge-bus", "default", "the name or the ARN of the event bus of -via eventbridge")
+	fs.StringVar(&eventBridge.source, "eventbridge-source", "", "the source of the event of -via eventbridge, which the rule matches")
+	fs.StringVar(&eventBridge.detailType, "eventbridge-detail-type", "", "the detail-type of the event of -via eventbridge, which the rule matches")
+	fs.DurationVar(&eventBridge.startTimeout, "eventbridge-start-timeout", defaultEventBridgeStartTimeout, "fail when START of the function does not appear in the duration after the event of -via eventbridge")
+	fs.StringVar(&queue.queueURL, "queue", "", "the URL of the queue of -via sqs, whose event source mapping invokes the function")
+	fs.DurationVar(&queue.enqueuedTimeout, "sqs-enqueued-timeout", defaultSQSEnqueuedTimeout, "fail when the message of -via sqs waits in the queue longer than the duration before it is received. 0 for no limit")
+	fs.DurationVar(&queue.matchTimeout, "sqs-match-timeout", defaultSQSMatchTimeout, "fail when no log line of the function mentions the message id in the duration after the message of -via sqs is received")
+	fs.DurationVar(&queue.consumedTimeout, "sqs-consumed-timeout", 0, "after the invocation, wait up to the duration for the message of -via sqs to be deleted from the queue, and fail if it is not. 0 not to wait")
+	fs.BoolVar(&requirePayloadIntegrity, "require-payload-integrity", false, "fail unless the function logs NODELESS_PAYLOAD_SHA256=<hash> with the hash of the sent payload")
+	fs.Float64Var(&deadlineMargin, "deadline-margin", defaultDeadlineMargin, "an invocation is at risk when the remaining time at the last log is less than this ratio of its time budget")
+	fs.StringVar(&remainingTimeExpr, "remaining-time-regex", defaultRemainingTimeExpr, "regexp which finds remaining milliseconds logged by the function. the first group is milliseconds")
+	fs.Var(&withEnv, "with-env", "KEY=VALUE environment variable of the function. can be repeated")
+	fs.DurationVar(&localTimeout, "local-timeout", defaultLocalTimeout, "timeout of a local function")
+	fs.StringVar(&localRIE, "local-rie", "", "post the payload to the Runtime Interface Emulator served by the local function at the URL, ex: http://localhost:8080/2015-03-31/functions/function/invocations")
+	fs.BoolVar(&cancelExecution, "cancel-execution", false, "cancel the execution of a Cloud Run job, or stop that of a Step Functions state machine or an ECS task, or terminate an AWS Batch job, when the run is interrupted, instead of leaving it running")
+	fs.StringVar(&azureFunctionKey, "azure-function-key", "", "function key of an Azure function, sent as x-functions-key. not needed by an anonymous function")
+	fs.StringVar(&appInsightsAppID, "appinsights-app-id", "", "Application ID of the Application Insights of the Azure function app, whose logs are tailed")
+	fs.BoolVar(&knativeExternal, "knative-external", false, "invoke a Knative Service at its external URL instead of the cluster-local one")
+	fs.StringVar(&openfaasURL, "openfaas-url", openfaasDefaultGateway, "URL of the OpenFaaS gateway")
+	fs.StringVar(&openfaasUser, "openfaas-user", openfaasDefaultUser, "user of the basic auth of the OpenFaaS gateway")
+	fs.StringVar(&openfaasPassword, "openfaas-password", "", "password of the basic auth of the OpenFaaS gateway, basic-auth-password of the basic-auth secret. no auth if empty")
+	fs.StringVar(&ecsCluster, "ecs-cluster", ecsDefaultCluster, "cluster the ECS task runs in")
+	fs.StringVar(&ecsSubnets, "ecs-subnets", "", "subnet ids of the ECS task, comma separated. required by Fargate")
+	fs.StringVar(&ecsSecurityGroups, "ecs-security-groups", "", "security group ids of the ECS task, comma separated. the default security group of the VPC if empty")
+	fs.BoolVar(&ecsAssignPublicIP, "ecs-assign-public-ip", false, "assign a public IP to the ECS task, needed to pull the image in a public subnet without a NAT gateway")
+	fs.StringVar(&ecsContainer, "ecs-container", "", "container of the ECS task whose logs are tailed and whose exit code is the outcome. the first essential container if empty")
+	fs.StringVar(&openwhiskAPIHost, "openwhisk-apihost", "", "API host of OpenWhisk, a host as wsk property get --apihost prints or a URL")
+	fs.StringVar(&openwhiskAuth, "openwhisk-auth", "", "auth key of OpenWhisk, UUID:KEY as wsk property get --auth prints")
+	fs.StringVar(&alibabaAccountID, "alibaba-cloud-account-id", "", "account id of Alibaba Cloud, the host of the Function Compute endpoint")
+	fs.StringVar(&alibabaRegion, "alibaba-cloud-region-id", "", "region of the Alibaba Cloud function, ex: cn-hangzhou")
+	fs.StringVar(&ociAuth, "oci-auth", ociAuthAPIKey, `auth of OCI, "api_key" of a profile of the OCI config file or "instance_principal" of the instance, a node of OKE`)
+	fs.StringVar(&ociConfigFile, "oci-config-file", ociDefaultConfigFile, "OCI config file of the api_key auth")
+	fs.StringVar(&ociProfile, "oci-profile", ociDefaultProfile, "profile of the OCI config file of the api_key auth")
+	fs.StringVar(&cloudflareAPIToken, "cloudflare-api-token", "", "API token of Cloudflare which can read the tails of Workers, and the routes of the zone of a route URL")
+	fs.StringVar(&cloudflareAccountID, "cloudflare-account-id", "", "account id of Cloudflare of the Worker")
+	fs.StringVar(&cloudflareScript, "cloudflare-script", "", "script name of the Worker of a route URL. looked up from the routes of the zone if empty")
+	fs.StringVar(&jobQueue, "job-queue", "", "job queue an AWS Batch job is submitted to, its name or ARN")
+	fs.BoolVar(&batchParameters, "batch-parameters", false, "give the payload, a JSON object, as the parameters of the AWS Batch job instead of the environment variable NODELESS_PAYLOAD")
+	fs.BoolVar(&watch, "watch", false, "re-invoke when the content of -payload_file is changed")
+	fs.DurationVar(&watchDebounce, "watch-debounce", defaultWatchDebounce, "wait for the payload file to settle before re-invoking")
+	fs.DurationVar(&every, "every", 0, "invoke the function on the interval, ex: 5m, tailing the logs of each run and logging its outcome in a line. an interrupt finishes the run in flight")
+	fs.IntVar(&count, "count", 0, "runs of -every, 0 for no limit")
+	fs.BoolVar(&discoverRegion, "discover-region", false, "find the region which has the function when no region is configured or the function is not in it")
+	fs.BoolVar(&readOnly, "read-only", false, "reject any mutating API call before it is sent")
+	fs.BoolVar(&noMetadataCache, "no-metadata-cache", false, "do not cache the function configuration within a run")
+	fs.StringVar(&baselinePath, "baseline", "", "compare the metrics of the run with the baseline file and fail when any regresses beyond -baseline-tolerance")
+	fs.StringVar(&baselineTolerance, "baseline-tolerance", defaultBaselineTolerance, "how much a metric may grow over the baseline, ex: 20%")
+	fs.StringVar(&saveBaseline, "save-baseline", "", "save the metrics of the run to the baseline file")
+	fs.BoolVar(&updateBaseline, "update-baseline", false, "rewrite the -baseline file with the run instead of failing")
+	fs.StringVar(&githubStatusFlag, "github-status", "", "post the verdict as the status of the commit, owner/repo@sha. the token is read from "+githubTokenEnv)
+	fs.StringVar(&pushgatewayURL, "pushgateway-url", "", "push the metrics of the run to the Prometheus Pushgateway at the URL, ex: http://pushgateway:9091")
+	fs.BoolVar(&pushgatewayDeleteOnSuccess, "pushgateway-delete-on-success", false, "delete the metrics of the function from the Pushgateway when the run succeeds, instead of pushing them")
+	fs.StringVar(&shipTo, "ship-to", "", "post the log events to the HTTP collector at the URL as gzipped NDJSON while the run goes on. the Authorization header is read from "+shipAuthorizationEnv)
+	fs.IntVar(&shipMaxLineLength, "ship-max-line-length", defaultShipMaxLineLength, "max bytes of a log line posted by -ship-to. the middle of a longer line is truncated. 0 means no limit")
+	fs.StringVar(&publishResult, "publish-result", "", "write the result of the run as JSON to an SSM parameter, ssm:/path/to/param, or an S3 object, s3://bucket/key, also when it fails")
+	fs.BoolVar(&publishOverwrite, "publish-overwrite", true, "overwrite the -publish-result parameter or object when it exists")
+	fs.BoolVar(&publishSecureString, "publish-secure-string", false, "write the -publish-result parameter as a SecureString")
+	fs.StringVar(&publishSpill, "publish-spill", "", "write a result larger than an SSM parameter to an object under the S3 prefix, s3://bucket/prefix, and its location to the parameter")
+	fs.BoolVar(&publishRequired, "publish-required", false, "fail a run which succeeded when -publish-result fails")
+	network := addNetworkFlags(fs)
+	noCredentialCache := addCredentialCacheFlag(fs)
+	fs.StringVar(&clientContext, "client-context", "", `ClientContext of the invocation as a JSON object, ex: '{"custom": {"k": "v"}}', or @PATH of a file of it`)
+	fs.BoolVar(&noAttribution, "no-attribution", false, "do not add the user, the host, the git repository and the CI job to the ClientContext")
+	fs.DurationVar(&streamPrefixMargin, "stream-prefix-margin", defaultStreamPrefixMargin, "how long after UTC midnight a run also filters the log streams of the previous date")
+	fs.StringVar(&tuning, "tuning", tuningDefault, `"default", "aggressive" or "gentle". preset of the intervals and the sizes of the tail below. aggressive suits a huge noisy function, gentle a tiny rare one sharing the CloudWatch Logs TPS`)
+	fs.DurationVar(&overrides.PollInterval, "poll-interval", defaultLimits.PollInterval, "interval of the polls of the log streams and events. shorter shows the lines sooner but makes more API calls")
+	fs.DurationVar(&overrides.ThrottleCoolDown, "throttle-cool-down", defaultLimits.ThrottleCoolDown, "first pause of the calls after a throttling, doubled by each next throttling")
+	fs.DurationVar(&overrides.MaxCoolDown, "max-throttle-cool-down", defaultLimits.MaxCoolDown, "longest pause of the calls after throttlings. longer spares the TPS of the account but delays the lines")
+	fs.DurationVar(&overrides.EventsWindow, "events-window", defaultLimits.EventsWindow, "event time during which an event id is remembered to drop the duplicates of the overlapping polls. a poll re-reading older events may print a line twice")
+	fs.Int("events-cache", 0, "deprecated and ignored, see -events-window")
+	fs.DurationVar(&overrides.ReportGrace, "report-grace", defaultLimits.ReportGrace, "how long the tail waits for REPORT after END before it finishes without the report")
+	fs.IntVar(&overrides.FallbackStreams, "fallback-streams", defaultLimits.FallbackStreams, "most recently active log streams read in each poll when FilterLogEvents is denied. more makes more GetLogEvents calls")
+	fs.StringVar(&expectSQSMessage, "expect-sqs-message", "", "after the invocation, poll the SQS queue at the URL for a message matching -expect-filter")
+	fs.StringVar(&expectDynamoDBItem, "expect-dynamodb-item", "", `after the invocation, poll the DynamoDB item matching -expect-filter, table:key-json, ex: 'orders:{"id": "o-1"}'`)
+	fs.StringVar(&expectFilter, "expect-filter", "", "expression the message body or the item must match, ex: '.status == \"done\"'. anything matches without it")
+	fs.BoolVar(&consume, "consume", false, "delete the matching SQS message instead of returning it to the queue")
+	fs.DurationVar(&expectTimeout, "expect-timeout", defaultExpectTimeout, "how long the side effects are polled")
+	fs.StringVar(&completionStrategy, "completion-strategy", completionAuto, `"auto", "logs" or "metrics". how the end and the outcome of the invocation are known. auto uses the metrics only when the function does not log`)
+	fs.StringVar(&setRetention, "set-retention", "", "set the retention of the log group of the function to the days, recorded in the journal for the cleanup subcommand")
+	fs.StringVar(&expectResponseFile, "expect-response-file", "", "invoke synchronously and fail unless the JSON response equals the golden file, regardless of the key order")
+	fs.BoolVar(&updateGolden, "update-golden", false, "rewrite the -expect-response-file from the response instead of comparing")
+	fs.Float64Var(&responseTolerance, "response-tolerance", 0, "absolute difference a number of the response may have from the golden file")
+	fs.Var(&responseIgnore, "response-ignore", "JSON pointer of a volatile field of the response which is not compared, ex: /createdAt or /items/*/id. can be repeated")
+	fs.BoolVar(&insightsMetrics, "insights-metrics", false, "read the cpu, memory, /tmp and network metrics of the invocation from Lambda Insights into the summary. on by default when the function has the Lambda Insights extension layer, -insights-metrics=false turns it off")
+	fs.StringVar(&withLogLevel, "with-log-level", "", "application log level of a function in the JSON log format during the run, ex: DEBUG. it is restored after the run, and recorded in the journal for the cleanup subcommand")
+	fs.BoolVar(&xray, "xray", false, "send the invocation with a new X-Ray trace id, and print the segments of the trace after the logs")
+	fs.BoolVar(&checkDestination, "check-destination", false, "with -invocation-type event, find the record of the invocation in the SQS queue of its OnSuccess or OnFailure destination, and report its condition, retries and response")
+	fs.DurationVar(&destinationTimeout, "destination-timeout", defaultDestinationTimeout, "how long -check-destination waits for the record, which comes after all the retries of a failing invocation")
+	fs.IntVar(&maxLineLength, "max-line-length", defaultMaxLineLength, "max bytes of a log line printed to the console. the middle of a longer line is truncated. 0 means no limit")
 
-	flag.StringVar(&funcName, "func", "", "function name")
-	flag.StringVar(&vendor, "vendor", "aws", `vendor name(currently only "aws")`)
-	flag.BoolVar(&json, "json", false, "enable JSON log format")
-	flag.StringVar(&payload, "payload", "", "request payload. higher priority than file")
-	flag.StringVar(&payloadFile, "payload_file", "", "speficy request payload file")
+	fs.Usage = func() { printUsage(fs.Output(), fs) }
+
+	sources := make(map[string]configSource)
+	envValues := make(map[string]string)
 	// convert Environment Variables to flags
-	flag.VisitAll(func(f *flag.Flag) {
-		if s := os.Getenv(strings.ToUpper(f.Name)); s != "" {
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = sourceDefault
+		if s := getenv(envName(f.Name)); s != "" {
 			f.Value.Set(s)
+			sources[f.Name] = sourceEnv
+			envValues[f.Name] = f.Value.String()
+		}
+	})
+
+	if err := parseFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	overridden := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if sources[f.Name] == sourceEnv && envValues[f.Name] != f.Value.String() {
+			overridden[f.Name] = true
 		}
+		sources[f.Name] = sourceFlag
 	})
 
-	flag.Parse()
+	var given []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != sourceDefault {
+			given = append(given, f.Name)
+		}
+	})
+	unsupported, err := unsupportedFlags(Vendor(strings.ToLower(vendor)), given)
+	if err != nil {
+		return nil, err
+	}
+	if len(unsupported) > 0 && !ignoreUnsupportedFlags {
+		// a flag may come with the flags it needs, so all of them are named
+		verb := "is"
+		if len(unsupported) > 1 {
+			verb = "are"
+		}
+		return nil, fmt.Errorf("-%s %s not supported by vendor %s", strings.Join(unsupported, ", -"), verb, strings.ToLower(vendor))
+	}
+	isUnsupported := make(map[string]bool)
+	for _, name := range unsupported {
+		// an ignored flag takes no effect, as if it were not given
+		isUnsupported[name] = true
+		resetFlag(fs.Lookup(name))
+		sources[name] = sourceDefault
+	}
 
-	if funcName == "" {
+	if funcName == "" && !showConfig {
 		return nil, fmt.Errorf("func required")
 	}
+	if qualifier != "" && !qualifierRe.MatchString(qualifier) {
+		return nil, fmt.Errorf("-qualifier must be $LATEST, a version or an alias, %s", qualifier)
+	}
+
+	if stdinPayload {
+		if payloadFile != "" && payloadFile != stdinPayloadFile {
+			return nil, fmt.Errorf("-payload-stdin can not be used with -payload_file %s", payloadFile)
+		}
+		payloadFile = stdinPayloadFile
+	}
+	// the path is expanded and checked once, -watch watches the file picked here.
+	// a file which -payload overrides is not read, as before.
+	payloadFileSpec := payloadFile
+	if payloadFile != "" && (payload == "" || mergePayloadFlags) {
+		resolved, err := resolvePayloadFile(payloadFile, getenv)
+		if err != nil {
+			return nil, err
+		}
+		payloadFile = resolved
+	}
 
 	config := &Config{
-		funcName: funcName,
-		vendor:   Vendor(strings.ToLower(vendor)),
-		json:     json,
+		funcName:   funcName,
+		qualifier:  qualifier,
+		vendor:     Vendor(strings.ToLower(vendor)),
+		json:       json,
+		debug:      debug,
+		showConfig: showConfig,
+		plan:       plan,
+		rulesFile:  rulesFile,
+
+		maxLineLength:     maxLineLength,
+		shipMaxLineLength: shipMaxLineLength,
+		maxAttempts:       maxAttempts,
+
+		showExtensionLogs: showExtensionLogs,
+		timeline:          timeline,
+		invocationType:    strings.ToLower(invocationType),
+		via:               strings.ToLower(via),
+
+		requirePayloadIntegrity: requirePayloadIntegrity,
+
+		deadlineMargin: deadlineMargin,
+
+		withEnv:      withEnv,
+		localTimeout: localTimeout,
+		localRIE:     localRIE,
+
+		cancelExecution: cancelExecution,
+
+		azureFunctionKey: azureFunctionKey,
+		appInsightsAppID: appInsightsAppID,
+		knativeExternal:  knativeExternal,
+		openfaasURL:      openfaasURL,
+		openfaasUser:     openfaasUser,
+		openfaasPassword: openfaasPassword,
+		openwhiskAPIHost: openwhiskAPIHost,
+		openwhiskAuth:    openwhiskAuth,
+		alibabaAccountID: alibabaAccountID,
+		alibabaRegion:    alibabaRegion,
+		ociAuth:          ociAuth,
+		ociConfigFile:    ociConfigFile,
+		ociProfile:       ociProfile,
+
+		cloudflareAPIToken:  cloudflareAPIToken,
+		cloudflareAccountID: cloudflareAccountID,
+		cloudflareScript:    cloudflareScript,
+
+		ecsCluster:        ecsCluster,
+		ecsSubnets:        parseIDList(ecsSubnets),
+		ecsSecurityGroups: parseIDList(ecsSecurityGroups),
+		ecsAssignPublicIP: ecsAssignPublicIP,
+		ecsContainer:      ecsContainer,
+
+		jobQueue:        jobQueue,
+		batchParameters: batchParameters,
+
+		payloadFile:   payloadFile,
+		watch:         watch,
+		watchDebounce: watchDebounce,
+
+		every: every,
+		count: count,
+
+		discoverRegion: discoverRegion,
+		readOnly:       readOnly,
+
+		noMetadataCache:   noMetadataCache,
+		network:           *network,
+		noCredentialCache: *noCredentialCache,
+		noAttribution:     noAttribution,
+
+		streamPrefixMargin: streamPrefixMargin,
+	}
+
+	// the option of the retry mode, which invokes synchronously, "" if none
+	retryOption := ""
+	switch {
+	case retryIf != "":
+		retryOption = "-retry-if-response"
+	case retryOnFailure:
+		retryOption = "-retry-on-failure"
+	}
+
+	switch config.invocationType {
+	case invocationAuto, invocationEvent, invocationRequestResponse:
+	default:
+		return nil, fmt.Errorf("invocation-type must be auto, event or request-response, %s", invocationType)
+	}
+	switch config.via {
+	case viaInvoke:
+	case viaURL:
+		if config.invocationType == invocationEvent {
+			return nil, fmt.Errorf("-via url is synchronous, can not be used with -invocation-type event")
+		}
+		if retryOption != "" {
+			return nil, fmt.Errorf("%s can not be used with -via url", retryOption)
+		}
+		if clientContext != "" {
+			return nil, fmt.Errorf("a Function URL has no ClientContext, -client-context can not be used with -via url")
+		}
+	case viaEventBridge:
+		if config.invocationType == invocationRequestResponse {
+			return nil, fmt.Errorf("-via eventbridge is asynchronous, can not be used with -invocation-type request-response")
+		}
+		if retryOption != "" {
+			return nil, fmt.Errorf("%s needs the response, can not be used with -via eventbridge", retryOption)
+		}
+		if clientContext != "" {
+			return nil, fmt.Errorf("an event has no ClientContext, -client-context can not be used with -via eventbridge")
+		}
+		if eventBridge.source == "" || eventBridge.detailType == "" {
+			return nil, fmt.Errorf("-via eventbridge needs -eventbridge-source and -eventbridge-detail-type, which the rule matches")
+		}
+		if eventBridge.startTimeout <= 0 {
+			return nil, fmt.Errorf("eventbridge-start-timeout must be positive")
+		}
+		config.eventBridge = &eventBridge
+	case viaSQS:
+		if config.invocationType == invocationRequestResponse {
+			return nil, fmt.Errorf("-via sqs is asynchronous, can not be used with -invocation-type request-response")
+		}
+		if retryOption != "" {
+			return nil, fmt.Errorf("%s needs the response, can not be used with -via sqs", retryOption)
+		}
+		if clientContext != "" {
+			return nil, fmt.Errorf("a message has no ClientContext, -client-context can not be used with -via sqs")
+		}
+		if queue.queueURL == "" {
+			return nil, fmt.Errorf("-via sqs needs -queue, the URL of the queue")
+		}
+		if queue.matchTimeout <= 0 {
+			return nil, fmt.Errorf("sqs-match-timeout must be positive")
+		}
+		if queue.enqueuedTimeout < 0 || queue.consumedTimeout < 0 {
+			return nil, fmt.Errorf("sqs-enqueued-timeout and sqs-consumed-timeout must not be negative")
+		}
+		if readOnly {
+			return nil, fmt.Errorf("-via sqs receives and returns the messages of the DLQ, can not be used with -read-only")
+		}
+		config.sqs = &queue
+	default:
+		return nil, fmt.Errorf("via must be invoke, url, eventbridge or sqs, %s", via)
+	}
+
+	if retryIf != "" {
+		e, err := parseExpr(retryIf)
+		if err != nil {
+			return nil, fmt.Errorf("retry-if-response: %w", err)
+		}
+		config.retryIf = e
+	}
+	if retryOption != "" {
+		if maxAttempts < 1 {
+			return nil, fmt.Errorf("max-attempts must be positive")
+		}
+		if retryDelay < 0 {
+			return nil, fmt.Errorf("retry-delay must not be negative")
+		}
+		if config.invocationType == invocationEvent {
+			// Lambda retries a failed async invocation by itself
+			return nil, fmt.Errorf("%s needs the response, can not be used with -invocation-type event", retryOption[1:])
+		}
+		config.retryOnFailure = retryOnFailure
+		config.retryDelay = retryDelay
+	}
+
+	if invokeRetry.maxAttempts < 1 {
+		return nil, fmt.Errorf("invoke-max-attempts must be positive")
+	}
+	if invokeRetry.maxElapsed <= 0 {
+		return nil, fmt.Errorf("invoke-max-elapsed must be positive")
+	}
+	config.invokeRetry = invokeRetry
+
+	if streamPrefixMargin < 0 {
+		return nil, fmt.Errorf("stream-prefix-margin must not be negative")
+	}
+	config.limits, err = resolveLimits(tuning, overrides, func(name string) bool { return sources[name] != sourceDefault })
+	if err != nil {
+		return nil, err
+	}
+	switch completionStrategy {
+	case completionAuto, completionLogs:
+	case completionMetrics:
+		if retryOption != "" {
+			return nil, fmt.Errorf("-completion-strategy metrics takes minutes for an invocation, can not be used with %s", retryOption)
+		}
+	default:
+		return nil, fmt.Errorf("completion-strategy must be auto, logs or metrics, %s", completionStrategy)
+	}
+	config.completionStrategy = completionStrategy
+
+	if config.setRetention, err = parseRetentionDays(setRetention); err != nil {
+		return nil, err
+	}
+	if config.setRetention > 0 && readOnly {
+		return nil, fmt.Errorf("-set-retention changes the log group, can not be used with -read-only")
+	}
+
+	if config.withLogLevel, err = parseLogLevel(withLogLevel); err != nil {
+		return nil, err
+	}
+	if config.withLogLevel != "" && readOnly {
+		return nil, fmt.Errorf("-with-log-level changes the function, can not be used with -read-only")
+	}
+
+	config.insightsMetrics = insightsAuto
+	if sources["insights-metrics"] != sourceDefault {
+		config.insightsMetrics = insightsOff
+		if insightsMetrics {
+			config.insightsMetrics = insightsOn
+		}
+	}
+
+	if runTimeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
+	config.runTimeout = runTimeout
+
+	if output != "" {
+		if config.invocationType == invocationEvent {
+			return nil, fmt.Errorf("-output needs the response, can not be used with -invocation-type event")
+		}
+		if config.via == viaEventBridge || config.via == viaSQS {
+			return nil, fmt.Errorf("-output needs the response, can not be used with -via %s", config.via)
+		}
+		if output == outputStdout && json {
+			return nil, fmt.Errorf("-output - writes the payload between the records of -json, can not be used with -json, whose response record has the payload")
+		}
+		if output != outputStdout {
+			if output, err = expandPath(output, getenv); err != nil {
+				return nil, err
+			}
+		}
+		config.output = output
+	}
+
+	golden, err := parseResponseGolden(expectResponseFile, updateGolden, responseTolerance, responseIgnore)
+	if err != nil {
+		return nil, err
+	}
+	if golden != nil && config.invocationType == invocationEvent {
+		return nil, fmt.Errorf("expect-response-file needs the response, can not be used with -invocation-type event")
+	}
+	if golden != nil && (config.via == viaEventBridge || config.via == viaSQS) {
+		return nil, fmt.Errorf("expect-response-file needs the response, can not be used with -via %s", config.via)
+	}
+	config.responseGolden = golden
+
+	expect, err := parseSideEffectFlags(expectSQSMessage, expectDynamoDBItem, expectFilter, consume, expectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if expect != nil && expect.queueURL != "" && readOnly {
+		return nil, fmt.Errorf("-expect-sqs-message receives and returns messages, can not be used with -read-only")
+	}
+	config.expect = expect
+
+	if deadlineMargin < 0 || deadlineMargin >= 1 {
+		return nil, fmt.Errorf("deadline-margin must be in [0, 1), %v", deadlineMargin)
+	}
+	if remainingTimeExpr != "" {
+		re, err := regexp.Compile(remainingTimeExpr)
+		if err != nil {
+			return nil, fmt.Errorf("remaining-time-regex: %w", err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("remaining-time-regex needs a group of milliseconds")
+		}
+		config.remainingTimeExpr = re
+	}
+
+	if len(items) > 0 {
+		if payload != "" || payloadFile != "" {
+			return nil, fmt.Errorf("-p can not be used with -payload or -payload_file")
+		}
+		p, err := buildPayload(items)
+		if err != nil {
+			return nil, fmt.Errorf("build payload: %w", err)
+		}
+		config.payload = p
+	}
+
+	if watch {
+		if payloadFile == "" || payload != "" || len(items) > 0 {
+			return nil, fmt.Errorf("-watch needs -payload_file, without -payload or -p")
+		}
+		if payloadFile == stdinPayloadFile {
+			return nil, fmt.Errorf("-watch can not watch stdin, it needs a file of -payload_file")
+		}
+		if watchDebounce < 0 {
+			return nil, fmt.Errorf("watch-debounce must not be negative")
+		}
+	}
+
+	if githubStatusFlag != "" {
+		gh, err := parseGitHubStatus(githubStatusFlag, getenv(githubTokenEnv))
+		if err != nil {
+			return nil, err
+		}
+		config.githubStatus = gh
+	}
+
+	if pushgatewayURL != "" {
+		p, err := newPushgateway(pushgatewayURL, pushgatewayDeleteOnSuccess, getenv, os.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		config.pushgateway = p
+	}
+	if pushgatewayDeleteOnSuccess && pushgatewayURL == "" {
+		return nil, fmt.Errorf("-pushgateway-delete-on-success needs -pushgateway-url")
+	}
+
+	if shipTo != "" {
+		target, err := parseShipTarget(shipTo, getenv(shipAuthorizationEnv))
+		if err != nil {
+			return nil, err
+		}
+		config.shipTo = target
+	}
+	if sources["ship-max-line-length"] != sourceDefault && shipTo == "" {
+		return nil, fmt.Errorf("-ship-max-line-length needs -ship-to")
+	}
+
+	if publishResult != "" {
+		p, err := newResultPublisher(publishResult, publishSpill, publishOverwrite, publishSecureString, publishRequired)
+		if err != nil {
+			return nil, err
+		}
+		if readOnly {
+			return nil, fmt.Errorf("-publish-result writes to %s, can not be used with -read-only", p.dest)
+		}
+		p.network, p.noCredsCache = config.network, config.noCredentialCache
+		config.publisher = p
+	}
+	if publishResult == "" && (publishSpill != "" || publishSecureString || publishRequired) {
+		return nil, fmt.Errorf("-publish-spill, -publish-secure-string and -publish-required need -publish-result")
+	}
+
+	clientContext, err = readClientContext(clientContext, getenv)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := parseClientContext(clientContext)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := buildClientContext(cc, nil); err != nil {
+		return nil, err
+	}
+	config.clientContext = cc
+
+	tolerance, err := parseTolerance(baselineTolerance)
+	if err != nil {
+		return nil, fmt.Errorf("baseline-tolerance: %w", err)
+	}
+	if baselinePath != "" || saveBaseline != "" {
+		config.baseline = &baselineCheck{
+			path:      baselinePath,
+			tolerance: tolerance,
+			savePath:  saveBaseline,
+			update:    updateBaseline,
+		}
+	}
+	if updateBaseline && baselinePath == "" {
+		return nil, fmt.Errorf("-update-baseline needs -baseline")
+	}
+
+	if dryRun {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-via " + config.via, config.via != viaInvoke},
+			{"-invocation-type " + config.invocationType, config.invocationType != invocationAuto},
+			{retryOption, retryOption != ""},
+			{"-expect-response-file", config.responseGolden != nil},
+			{"-expect-sqs-message or -expect-dynamodb-item", config.expect != nil},
+			{"-with-log-level", config.withLogLevel != ""},
+			{"-set-retention", config.setRetention > 0},
+			{"-baseline or -save-baseline", config.baseline != nil},
+			{"-output", config.output != ""},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-dry-run does not run the function, can not be used with %s", c.option)
+			}
+		}
+		config.dryRun = true
+	}
+
+	if concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be positive")
+	}
+	if payloadNDJSON == "" && (batchWorkers != 1 || failFast || batchReport != "") {
+		return nil, fmt.Errorf("-batch-workers, -fail-fast and -batch-report need -payload-ndjson")
+	}
+	if concurrency > 1 || payloadNDJSON != "" {
+		option := "-concurrency"
+		if payloadNDJSON != "" {
+			option = "-payload-ndjson"
+		}
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-concurrency", payloadNDJSON != "" && concurrency > 1},
+			{"-payload, -payload_file or -p", payloadNDJSON != "" && (payload != "" || payloadFile != "" || len(items) > 0)},
+			{"-require-payload-integrity", payloadNDJSON != "" && requirePayloadIntegrity},
+			{"-output", config.output != ""},
+			{"-via " + config.via, config.via != viaInvoke},
+			{retryOption, retryOption != ""},
+			{"-expect-response-file", config.responseGolden != nil},
+			{"-expect-sqs-message or -expect-dynamodb-item", config.expect != nil},
+			{"-completion-strategy metrics", config.completionStrategy == completionMetrics},
+			{"-dry-run", config.dryRun},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("%s tails the logs of several invocations, can not be used with %s", option, c.option)
+			}
+		}
+		if concurrencyTimeout <= 0 {
+			return nil, fmt.Errorf("concurrency-timeout must be positive")
+		}
+		config.concurrent = &concurrentRun{n: concurrency, workers: concurrency, timeout: concurrencyTimeout}
+	}
+	if payloadNDJSON != "" {
+		if batchWorkers < 1 {
+			return nil, fmt.Errorf("batch-workers must be positive")
+		}
+		path, err := expandPath(payloadNDJSON, getenv)
+		if err != nil {
+			return nil, err
+		}
+		c := config.concurrent
+		if c.payloads, c.lines, err = loadPayloadNDJSON(path); err != nil {
+			return nil, err
+		}
+		c.n, c.workers, c.failFast, c.payloadFile = len(c.payloads), batchWorkers, failFast, path
+		if batchReport != "" {
+			if c.reportPath, err = expandPath(batchReport, getenv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	config.noPreflight = noPreflight
+	if waitActive {
+		if waitActiveTimeout <= 0 {
+			return nil, fmt.Errorf("wait-active-timeout must be positive")
+		}
+		config.waitActiveTimeout = waitActiveTimeout
+	}
+
+	if xray {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-concurrency or -payload-ndjson", config.concurrent != nil},
+			{"-warmup", warmup > 0},
+			{"-via " + config.via, config.via != viaInvoke},
+			{"-dry-run", config.dryRun},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-xray traces a single invocation by Invoke, can not be used with %s", c.option)
+			}
+		}
+		config.xray = true
+	}
+
+	if checkDestination {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-invocation-type other than event", config.invocationType != invocationEvent},
+			{"-concurrency or -payload-ndjson", config.concurrent != nil},
+			{"-via " + config.via, config.via != viaInvoke},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-check-destination reads the record of a single invocation of -invocation-type event, can not be used with %s", c.option)
+			}
+		}
+		if readOnly {
+			return nil, fmt.Errorf("-check-destination receives and returns the messages of the destination queue, can not be used with -read-only")
+		}
+		if destinationTimeout <= 0 {
+			return nil, fmt.Errorf("destination-timeout must be positive")
+		}
+		config.destinationTimeout = destinationTimeout
+	}
+
+	if every < 0 {
+		return nil, fmt.Errorf("every must not be negative")
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("count must not be negative")
+	}
+	if count > 0 && every == 0 {
+		return nil, fmt.Errorf("-count needs -every")
+	}
+	if every > 0 {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-watch", watch},
+			{"-concurrency or -payload-ndjson", config.concurrent != nil},
+			{"-dry-run", config.dryRun},
+			{"-update-golden", updateGolden},
+			{retryOption, retryOption != ""},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-every repeats a single invocation, can not be used with %s", c.option)
+			}
+		}
+	}
+
+	if noLogs {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-invocation-type request-response", config.invocationType == invocationRequestResponse},
+			{"-via " + config.via, config.via != viaInvoke},
+			{"-concurrency or -payload-ndjson", config.concurrent != nil},
+			{"-warmup", warmup > 0},
+			{"-dry-run", config.dryRun},
+			{retryOption, retryOption != ""},
+			{"-output", config.output != ""},
+			{"-expect-response-file", config.responseGolden != nil},
+			{"-expect-sqs-message or -expect-dynamodb-item", config.expect != nil},
+			{"-check-destination", config.destinationTimeout > 0},
+			{"-xray", config.xray},
+			{"-with-log-level", config.withLogLevel != ""},
+			{"-set-retention", config.setRetention > 0},
+			{"-baseline or -save-baseline", config.baseline != nil},
+			{"-timeline", timeline},
+			{"-require-payload-integrity", requirePayloadIntegrity},
+			{"-completion-strategy " + config.completionStrategy, config.completionStrategy != completionAuto},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-no-logs only invokes asynchronously, can not be used with %s", c.option)
+			}
+		}
+		config.noLogs = true
+	}
+
+	if warmup < 0 {
+		return nil, fmt.Errorf("warmup must not be negative")
+	}
+	if warmupPayload != "" && warmup == 0 {
+		return nil, fmt.Errorf("-warmup-payload needs -warmup")
+	}
+	if warmup > 0 {
+		for _, c := range []struct {
+			option string
+			set    bool
+		}{
+			{"-payload, -payload_file or -p", payload != "" || payloadFile != "" || len(items) > 0},
+			{"-concurrency or -payload-ndjson", config.concurrent != nil},
+			{"-via " + config.via, config.via != viaInvoke},
+			{"-invocation-type event", config.invocationType == invocationEvent},
+			{retryOption, retryOption != ""},
+			{"-output", config.output != ""},
+			{"-dry-run", config.dryRun},
+			{"-require-payload-integrity", requirePayloadIntegrity},
+			{"-expect-response-file", config.responseGolden != nil},
+			{"-expect-sqs-message or -expect-dynamodb-item", config.expect != nil},
+			{"-with-log-level", config.withLogLevel != ""},
+			{"-set-retention", config.setRetention > 0},
+			{"-baseline or -save-baseline", config.baseline != nil},
+		} {
+			if c.set {
+				return nil, fmt.Errorf("-warmup only starts execution environments, can not be used with %s", c.option)
+			}
+		}
+		if warmupPayload == "" {
+			warmupPayload = defaultWarmupPayload
+		}
+		config.warmup = &warmupRun{n: warmup}
+	}
+
+	if len(templateVarFlags) > 0 && !renderPayload {
+		return nil, fmt.Errorf("-var needs -payload-template")
+	}
+	if renderPayload {
+		config.payloadTemplate = &payloadTemplate{vars: templateVarFlags, getenv: getenv, now: time.Now}
+		rendered, err := config.payloadTemplate.render("-payload", payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = rendered
+	}
+
+	if mergePayloadFlags && (payloadFile == "" || payload == "") {
+		return nil, fmt.Errorf("-merge-payloads needs both -payload_file and -payload")
+	}
+	if mergePayloadFlags {
+		base, err := config.readPayloadFile(payloadFile)
+		if err != nil {
+			return nil, err
+		}
+		merged, err := mergePayloads(base, payload)
+		if err != nil {
+			return nil, fmt.Errorf("merge payloads: %w", err)
+		}
+		payload = merged
 	}
 
 	// read payload file if payload is not specified
 	if payloadFile != "" && payload == "" {
-		buf, err := ioutil.ReadFile(payloadFile)
+		p, err := config.readPayloadFile(payloadFile)
 		if err != nil {
-			return nil, fmt.Errorf("read payload file, %s: %w", payloadFile, err)
+			return nil, err
 		}
-		config.payload = string(buf)
+		config.payload = p
 	}
 	if payload != "" {
 		config.payload = payload
 	}
+	if config.warmup != nil {
+		config.payload = warmupPayload
+	}
+
+	if config.eventBridge != nil && !config.watch {
+		if _, err := validateEventDetail(config.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	config.strictPayload = strictPayload
+	config.showPayload = showPayload
+	describedFile := payloadFile
+	switch {
+	case strings.HasPrefix(payloadFileSpec, latestPayloadPrefix):
+		describedFile = fmt.Sprintf("%s (%s)", payloadFileSpec, payloadFile)
+	case payloadFile == stdinPayloadFile:
+		describedFile = stdinPayloadFile + " (stdin)"
+	}
+	config.payloadSource = payloadSource(sources, payload, describedFile, mergePayloadFlags, len(items) > 0)
+	if why := suspiciousPayload(config.payload); why != "" && config.payloadSource != "" {
+		config.payloadWarning = fmt.Sprintf("the payload from %s %s, which looks like a failed expansion", config.payloadSource, why)
+		if strictPayload {
+			return nil, fmt.Errorf("%s (-strict-payload)", config.payloadWarning)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] {
+			value = summarizeSecret(value)
+		}
+		config.entries = append(config.entries, configEntry{
+			name:         f.Name,
+			value:        value,
+			source:       sources[f.Name],
+			overridesEnv: overridden[f.Name],
+			unsupported:  isUnsupported[f.Name],
+		})
+	})
 
 	return config, nil
 }
 
+// readPayloadFile reads the payload file, rendered by -payload-template
+func (config *Config) readPayloadFile(path string) (string, error) {
+	p, err := loadPayloadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return config.payloadTemplate.render(path, p)
+}
+
+// loadPayloadFile reads the payload file
+func loadPayloadFile(path string) (string, error) {
+	if path == stdinPayloadFile {
+		return readStdinPayload(payloadStdin)
+	}
+	if err := checkPayloadFile(path); err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", payloadPathError(path, err)
+	}
+	return string(buf), nil
+}
+
+// flagResetter is a flag value which is reset to none, as a repeatable flag whose Set appends
+type flagResetter interface {
+	reset()
+}
+
+// resetFlag sets the flag back to its default value
+func resetFlag(f *flag.Flag) {
+	if r, ok := f.Value.(flagResetter); ok {
+		r.reset()
+		return
+	}
+	f.Value.Set(f.DefValue)
+}
+
+// payloadSource returns the flags the payload comes from, ex: "-payload_file in.json", or "" when
+// no payload flag is given and the payload is empty on purpose
+func payloadSource(sources map[string]configSource, payload, payloadFile string, merged, items bool) string {
+	flagName := func(name string) string {
+		if sources[name] == sourceEnv {
+			return envName(name)
+		}
+		return "-" + name
+	}
+	switch {
+	case items:
+		return "-p"
+	case merged:
+		return fmt.Sprintf("%s %s and %s", flagName("payload_file"), payloadFile, flagName("payload"))
+	case payload != "":
+		return flagName("payload")
+	case payloadFile != "":
+		return fmt.Sprintf("%s %s", flagName("payload_file"), payloadFile)
+	case sources["payload"] != sourceDefault:
+		return flagName("payload") // given but empty, ex: -payload "$UNSET"
+	}
+	return ""
+}
+
+// suspiciousPayload returns why the payload looks like the result of a failed expansion, ex: an
+// unset CI variable or a template which rendered nothing, or "" if it looks intended
+func suspiciousPayload(payload string) string {
+	s := strings.TrimSpace(payload)
+	switch {
+	case payload == "":
+		return "is empty"
+	case s == "":
+		return fmt.Sprintf("is whitespace only (%d bytes)", len(payload))
+	case s == "null" || s == "undefined" || s == "{}":
+		return fmt.Sprintf("is %q", s)
+	}
+	return ""
+}
+
+// describePayload returns the hash and the length of the payload, ex: "sha256:3a7bd3e2360a (15 bytes)"
+func describePayload(payload string) string {
+	if payload == "" {
+		return "empty (0 bytes)"
+	}
+	return summarizeSecret(payload)
+}
+
+// summarizeSecret returns the hash and length of the value instead of the value itself
+func summarizeSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("sha256:%s (%d bytes)", hex.EncodeToString(sum[:])[:12], len(value))
+}
+
+// logEffectiveConfig logs the effective configuration at debug level
+func (config *Config) logEffectiveConfig(logger *zap.SugaredLogger) {
+	for _, e := range config.entries {
+		logger.Debugw("config", zap.String("name", e.name), zap.String("value", e.value), zap.String("source", string(e.source)))
+		if e.overridesEnv {
+			logger.Warnf("-%s is given by both flag and %s environment variable, the flag is used", e.name, envName(e.name))
+		}
+		if e.unsupported {
+			logger.Warnf("-%s is not supported by vendor %s, ignored", e.name, config.vendor)
+		}
+		if why, ok := deprecatedFlags[e.name]; ok && e.source != sourceDefault {
+			logger.Warnf("-%s is deprecated and ignored, %s", e.name, why)
+		}
+	}
+	source := config.payloadSource
+	if source == "" {
+		source = "none"
+	}
+	logger.Debugw("config", zap.String("name", "effective payload"), zap.String("value", describePayload(config.payload)), zap.String("source", source))
+	if config.payloadWarning != "" {
+		logger.Warnf("%s, use -strict-payload to fail", config.payloadWarning)
+	}
+	// -watch shows the payload of each run
+	if config.showPayload && !config.watch {
+		logger.Infof("payload from %s: %s", source, config.payload)
+	}
+}
+
+// printEffectiveConfig prints the effective configuration
+func (config *Config) printEffectiveConfig() {
+	for _, e := range config.entries {
+		source := string(e.source)
+		if e.overridesEnv {
+			source += fmt.Sprintf(" (overrides %s)", envName(e.name))
+		}
+		fmt.Printf("%-14s %-32q %s\n", e.name, e.value, source)
+	}
+	fmt.Printf("%-14s %-32q %s\n", "(payload)", describePayload(config.payload), config.payloadSource)
+}
+
 func NewLogger(config *Config) *zap.SugaredLogger {
 	level := zap.NewAtomicLevel()
 	level.SetLevel(zapcore.InfoLevel)
+	if config.debug {
+		level.SetLevel(zapcore.DebugLevel)
+	}
 
-	zapConfig := zap.Config{
-		Level: level,
-		EncoderConfig: zapcore.EncoderConfig{
-			MessageKey:  "msg",
-			TimeKey:     "time",
-			EncodeTime:  zapcore.ISO8601TimeEncoder,
-			LevelKey:    "level",
-			EncodeLevel: zapcore.CapitalLevelEncoder,
-			// caller is disabled currently
-			//                      CallerKey:    "caller",
-			//                      EncodeCaller: zapcore.ShortCallerEncoder,
-		},
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stdout"},
+	encoderConfig := zapcore.EncoderConfig{
+		MessageKey:  "msg",
+		TimeKey:     "time",
+		EncodeTime:  zapcore.ISO8601TimeEncoder,
+		LevelKey:    "level",
+		EncodeLevel: zapcore.CapitalLevelEncoder,
+		// caller is disabled currently
+		//                      CallerKey:    "caller",
+		//                      EncodeCaller: zapcore.ShortCallerEncoder,
 	}
+	var encoder zapcore.Encoder
 	if config.json {
-		zapConfig.Encoding = "json"
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
 	} else {
-		zapConfig.Encoding = "console"
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
 	}
 
-	l, err := zapConfig.Build()
-	if err != nil {
-		panic(err)
-	}
-	return l.Sugar()
+	// a JSON record is synced as soon as it is written, so collectors never see a partial line
+	// even if the process is killed
+	out := newRecordWriter(os.Stdout, config.json)
+	core := zapcore.NewCore(encoder, out, level)
+	return zap.New(core, zap.ErrorOutput(out)).Sugar()
 }
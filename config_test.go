@@ -0,0 +1,586 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgsSource(t *testing.T) {
+	env := map[string]string{
+		"FUNC":    "from-env",
+		"PAYLOAD": `{"secret": "value"}`,
+	}
+	config, err := parseArgs([]string{"-func", "from-flag", "-json"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.funcName != "from-flag" {
+		t.Errorf("flag should win, got %s", config.funcName)
+	}
+
+	got := make(map[string]configEntry)
+	for _, e := range config.entries {
+		got[e.name] = e
+	}
+	if e := got["func"]; e.source != sourceFlag || !e.overridesEnv {
+		t.Errorf("func: %+v", e)
+	}
+	if e := got["json"]; e.source != sourceFlag || e.overridesEnv {
+		t.Errorf("json: %+v", e)
+	}
+	if e := got["vendor"]; e.source != sourceDefault || e.value != "aws" {
+		t.Errorf("vendor: %+v", e)
+	}
+	e := got["payload"]
+	if e.source != sourceEnv {
+		t.Errorf("payload: %+v", e)
+	}
+	if strings.Contains(e.value, "secret") || !strings.HasPrefix(e.value, "sha256:") {
+		t.Errorf("payload must not be echoed: %s", e.value)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if s := envName("show-config"); s != "SHOW_CONFIG" {
+		t.Errorf("got %s", s)
+	}
+	if s := envName("payload_file"); s != "PAYLOAD_FILE" {
+		t.Errorf("got %s", s)
+	}
+}
+
+func TestParseArgsInvocationType(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.invocationType != invocationAuto {
+		t.Errorf("default must be auto, got %s", config.invocationType)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-invocation-type", "sync"}, noenv); err == nil {
+		t.Errorf("unknown invocation type must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-invocation-type", "event", "-retry-if-response", ".retry"}, noenv); err == nil {
+		t.Errorf("-retry-if-response with event must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-completion-strategy", "metrics", "-retry-if-response", ".retry"}, noenv); err == nil {
+		t.Errorf("-completion-strategy metrics with -retry-if-response must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-completion-strategy", "report"}, noenv); err == nil {
+		t.Errorf("unknown completion strategy must be an error")
+	}
+}
+
+func TestParseArgsVia(t *testing.T) {
+	noenv := func(string) string { return "" }
+	eb := []string{"-func", "f", "-via", "eventbridge", "-eventbridge-source", "orders.api", "-eventbridge-detail-type", "OrderPlaced"}
+	config, err := parseArgs(append(eb, "-payload", `{"id": 1}`), noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.eventBridge == nil || config.eventBridge.bus != "default" || config.eventBridge.startTimeout != defaultEventBridgeStartTimeout {
+		t.Errorf("got %+v", config.eventBridge)
+	}
+	queue := []string{"-func", "f", "-via", "sqs", "-queue", "https://sqs.us-east-1.amazonaws.com/123456789012/orders"}
+	config, err = parseArgs(queue, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.sqs == nil || config.sqs.matchTimeout != defaultSQSMatchTimeout || config.sqs.enqueuedTimeout != defaultSQSEnqueuedTimeout || config.sqs.consumedTimeout != 0 {
+		t.Errorf("got %+v", config.sqs)
+	}
+	for _, args := range [][]string{
+		{"-func", "f", "-via", "sqs"},
+		append(queue, "-read-only"),
+		append(queue, "-invocation-type", "request-response"),
+		append(queue, "-sqs-match-timeout", "0s"),
+		append(queue, "-sqs-enqueued-timeout", "-1s"),
+		append(queue, "-sqs-consumed-timeout", "-1s"),
+		{"-func", "f", "-via", "url", "-invocation-type", "event"},
+		{"-func", "f", "-via", "url", "-client-context", `{"custom": {}}`},
+		{"-func", "f", "-via", "eventbridge"},
+		append(eb, "-payload", "[1]"),
+		append(eb, "-invocation-type", "request-response"),
+		append(eb, "-retry-if-response", ".retry"),
+	} {
+		if _, err := parseArgs(args, noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+}
+
+func TestParseArgsDryRun(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-dry-run"}, noenv)
+	if err != nil || !config.dryRun {
+		t.Fatalf("got %v", err)
+	}
+	for _, extra := range [][]string{
+		{"-via", "url"},
+		{"-invocation-type", "event"},
+		{"-retry-if-response", ".retry"},
+		{"-with-log-level", "debug"},
+		{"-set-retention", "14"},
+		{"-save-baseline", "baseline.json"},
+	} {
+		args := append([]string{"-func", "f", "-dry-run"}, extra...)
+		if _, err := parseArgs(args, noenv); err == nil || !strings.Contains(err.Error(), "-dry-run") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
+
+func TestParseArgsQualifier(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-qualifier", "live"}, noenv)
+	if err != nil || config.qualifier != "live" {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-qualifier", "live:1"}, noenv); err == nil || !strings.Contains(err.Error(), "-qualifier") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseArgsConcurrency(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-concurrency", "10"}, noenv)
+	if err != nil || config.concurrent == nil || config.concurrent.n != 10 || config.concurrent.timeout != defaultConcurrencyTimeout {
+		t.Fatalf("got %v", err)
+	}
+	if config, err := parseArgs([]string{"-func", "f"}, noenv); err != nil || config.concurrent != nil {
+		t.Errorf("a single invocation must have no concurrent run, got %v", err)
+	}
+	for _, extra := range [][]string{
+		{"-via", "url"},
+		{"-retry-if-response", ".retry"},
+		{"-completion-strategy", "metrics"},
+		{"-dry-run"},
+	} {
+		args := append([]string{"-func", "f", "-concurrency", "2"}, extra...)
+		if _, err := parseArgs(args, noenv); err == nil || !strings.Contains(err.Error(), "-concurrency") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-concurrency", "0"}, noenv); err == nil {
+		t.Errorf("0 must be an error")
+	}
+}
+
+func TestParseArgsPayloadNDJSON(t *testing.T) {
+	env := func(name string) string {
+		if name == "TESTDATA" {
+			return "testdata"
+		}
+		return ""
+	}
+	config, err := parseArgs([]string{"-func", "f", "-payload-ndjson", "$TESTDATA/batch/orders.ndjson", "-batch-workers", "4", "-fail-fast", "-batch-report", "$TESTDATA/report.json"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := config.concurrent; c == nil || c.n != 3 || c.workers != 4 || !c.failFast || c.reportPath != "testdata/report.json" || c.payloadFile != "testdata/batch/orders.ndjson" {
+		t.Errorf("got %+v", config.concurrent)
+	}
+	for _, args := range [][]string{
+		{"-payload", "{}"},
+		{"-concurrency", "2"},
+		{"-via", "sqs", "-queue", "https://sqs.us-east-1.amazonaws.com/123456789012/orders"},
+		{"-batch-workers", "0"},
+	} {
+		args = append([]string{"-func", "f", "-payload-ndjson", "testdata/batch/orders.ndjson"}, args...)
+		if _, err := parseArgs(args, env); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-fail-fast"}, env); err == nil || !strings.Contains(err.Error(), "need -payload-ndjson") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseArgsOutput(t *testing.T) {
+	env := func(name string) string { return map[string]string{"OUT": "out"}[name] }
+	config, err := parseArgs([]string{"-func", "f", "-output", "$OUT/response.json"}, env)
+	if err != nil || config.output != "out/response.json" {
+		t.Fatalf("got %v", err)
+	}
+	if got := (&AWSServerless{output: config.output}).needResponse(); got != "-output" {
+		t.Errorf("-output must invoke synchronously, got %q", got)
+	}
+	if config, err := parseArgs([]string{"-func", "f", "-output", "-"}, env); err != nil || config.output != outputStdout {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-output", "-", "-json"}, env); err == nil || !strings.Contains(err.Error(), "can not be used with -json") {
+		t.Errorf("-output - must be refused with -json, got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-invocation-type", "event"},
+		{"-via", "sqs", "-queue", "https://sqs.us-east-1.amazonaws.com/123456789012/orders"},
+		{"-concurrency", "2"},
+		{"-dry-run"},
+	} {
+		args = append([]string{"-func", "f", "-output", "response.json"}, args...)
+		if _, err := parseArgs(args, env); err == nil || !strings.Contains(err.Error(), "-output") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
+
+func TestParseArgsTimeout(t *testing.T) {
+	noenv := func(string) string { return "" }
+	if config, err := parseArgs([]string{"-func", "f", "-timeout", "5m"}, noenv); err != nil || config.runTimeout != 5*time.Minute {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-timeout", "-1s"}, noenv); err == nil {
+		t.Errorf("a negative -timeout must be an error")
+	}
+}
+
+func TestParseArgsInvalidFlag(t *testing.T) {
+	noenv := func(string) string { return "" }
+	for _, args := range [][]string{
+		{"-func", "f", "-nosuchflag"},
+		{"-func", "f", "-timeout", "bogus"},
+	} {
+		_, err := parseArgs(args, noenv)
+		if err == nil || exitCode(err) != exitConfigError {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+	if _, err := parseArgs([]string{"-h"}, noenv); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSubcommandConfigError(t *testing.T) {
+	setTestLogger(t)
+	for name, args := range map[string][]string{
+		"canary-watch": {"-func", "f"},
+		"describe":     nil,
+		"fleet-logs":   nil,
+		"logs":         {"-func", "f"},
+		"schema":       nil,
+		"tail":         {"-func", "f", "-since", "-1m"},
+	} {
+		err := subcommands[name](args)
+		if err == nil || exitCode(err) != exitConfigError {
+			t.Errorf("%s %v: got %v, exit code %d", name, args, err, exitCode(err))
+		}
+	}
+}
+
+func TestParseArgsWaitActive(t *testing.T) {
+	noenv := func(string) string { return "" }
+	if config, err := parseArgs([]string{"-func", "f", "-wait-active"}, noenv); err != nil || config.waitActiveTimeout != defaultWaitActiveTimeout {
+		t.Errorf("got %v", err)
+	}
+	if config, err := parseArgs([]string{"-func", "f", "-wait-active-timeout", "1m"}, noenv); err != nil || config.waitActiveTimeout != 0 {
+		t.Errorf("-wait-active-timeout alone must not wait, got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-wait-active", "-wait-active-timeout", "0s"}, noenv); err == nil {
+		t.Errorf("a zero -wait-active-timeout must be an error")
+	}
+}
+
+func TestParseArgsXRay(t *testing.T) {
+	noenv := func(string) string { return "" }
+	if config, err := parseArgs([]string{"-func", "f", "-xray"}, noenv); err != nil || !config.xray {
+		t.Errorf("got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-concurrency", "5"},
+		{"-warmup", "3"},
+		{"-dry-run"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f", "-xray"}, args...), noenv); err == nil || !strings.Contains(err.Error(), "-xray traces a single invocation") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
+
+func TestParseArgsCheckDestination(t *testing.T) {
+	noenv := func(string) string { return "" }
+	if config, err := parseArgs([]string{"-func", "f", "-invocation-type", "event", "-check-destination"}, noenv); err != nil || config.destinationTimeout != defaultDestinationTimeout {
+		t.Errorf("got %v", err)
+	}
+	if config, err := parseArgs([]string{"-func", "f", "-destination-timeout", "1m"}, noenv); err != nil || config.destinationTimeout != 0 {
+		t.Errorf("-destination-timeout alone must not check, got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-check-destination"},
+		{"-invocation-type", "event", "-check-destination", "-concurrency", "5"},
+		{"-invocation-type", "event", "-check-destination", "-via", "eventbridge", "-eventbridge-source", "orders.api", "-eventbridge-detail-type", "OrderPlaced"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil || !strings.Contains(err.Error(), "-check-destination reads the record") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-invocation-type", "event", "-check-destination", "-destination-timeout", "0s"}, noenv); err == nil {
+		t.Errorf("a zero -destination-timeout must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-invocation-type", "event", "-check-destination", "-read-only"}, noenv); err == nil || !strings.Contains(err.Error(), "can not be used with -read-only") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseArgsRetryOnFailure(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-retry-on-failure", "-max-attempts", "5", "-retry-delay", "30s"}, noenv)
+	if err != nil || !config.retryOnFailure || config.maxAttempts != 5 || config.retryDelay != 30*time.Second {
+		t.Errorf("got %v", err)
+	}
+	if config, err := parseArgs([]string{"-func", "f", "-retry-delay", "30s"}, noenv); err != nil || config.retryDelay != 0 {
+		t.Errorf("-retry-delay alone must not retry, got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-retry-on-failure", "-invocation-type", "event"},
+		{"-retry-on-failure", "-max-attempts", "0"},
+		{"-retry-on-failure", "-retry-delay", "-1s"},
+		{"-retry-on-failure", "-via", "url"},
+		{"-retry-on-failure", "-completion-strategy", "metrics"},
+		{"-retry-on-failure", "-warmup", "3"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+}
+
+func TestParseArgsEvery(t *testing.T) {
+	noenv := func(string) string { return "" }
+	if config, err := parseArgs([]string{"-func", "f", "-every", "5m", "-count", "3"}, noenv); err != nil || config.every != 5*time.Minute || config.count != 3 {
+		t.Errorf("got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-count", "3"},
+		{"-every", "-1m"},
+		{"-every", "5m", "-count", "-1"},
+		{"-every", "5m", "-concurrency", "5"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+	for _, args := range [][]string{
+		{"-every", "1m", "-count", "2", "-retry-if-response", ".retry == true"},
+		{"-every", "1m", "-retry-on-failure"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil || !strings.Contains(err.Error(), "-every repeats a single invocation, can not be used with -retry-") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
+
+func TestParseArgsExpect(t *testing.T) {
+	noenv := func(string) string { return "" }
+	queue := "https://sqs.us-east-1.amazonaws.com/123456789012/out"
+	config, err := parseArgs([]string{"-func", "f", "-expect-sqs-message", queue, "-expect-filter", ".ok"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.expect.queueURL != queue || config.expect.filter == nil || config.expect.timeout != defaultExpectTimeout {
+		t.Errorf("got %+v", config.expect)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-expect-sqs-message", queue, "-read-only"}, noenv); err == nil {
+		t.Errorf("-expect-sqs-message with -read-only must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-expect-dynamodb-item", `orders:{"id": "o-1"}`, "-read-only"}, noenv); err != nil {
+		t.Errorf("GetItem is a read, got %s", err)
+	}
+}
+
+func TestParseArgsSetRetention(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-set-retention", "14"}, noenv)
+	if err != nil || config.setRetention != 14 {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-set-retention", "10"}, noenv); err == nil || !strings.Contains(err.Error(), "3653") {
+		t.Errorf("10 days is not a retention of CloudWatch Logs, got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-set-retention", "14", "-read-only"}, noenv); err == nil {
+		t.Errorf("-set-retention with -read-only must be an error")
+	}
+}
+
+func TestParseArgsMergePayloads(t *testing.T) {
+	f, err := ioutil.TempFile("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"order":{"id":1,"dryRun":false}}`)
+	f.Close()
+
+	noenv := func(string) string { return "" }
+	args := []string{"-func", "f", "-payload_file", f.Name(), "-payload", `{"order":{"dryRun":true}}`}
+	config, err := parseArgs(args, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.payload != `{"order":{"dryRun":true}}` {
+		t.Errorf("without -merge-payloads, -payload wins, got %s", config.payload)
+	}
+
+	config, err = parseArgs(append(args, "-merge-payloads"), noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.payload != `{"order":{"dryRun":true,"id":1}}` {
+		t.Errorf("got %s", config.payload)
+	}
+
+	if _, err := parseArgs([]string{"-func", "f", "-payload_file", f.Name(), "-payload", `[1]`, "-merge-payloads"}, noenv); err == nil {
+		t.Errorf("an array payload can not be merged")
+	}
+}
+
+func TestParseArgsPayloadStdin(t *testing.T) {
+	noenv := func(string) string { return "" }
+	defer func(orig stdinFile) { payloadStdin = orig }(payloadStdin)
+	for _, args := range [][]string{
+		{"-func", "f", "-payload_file", "-"},
+		{"-func", "f", "-payload-stdin"},
+	} {
+		payloadStdin = fakeStdin{strings.NewReader(`{"id": 1}`), os.ModeNamedPipe}
+		config, err := parseArgs(args, noenv)
+		if err != nil || config.payload != `{"id": 1}` || config.payloadSource != "-payload_file - (stdin)" {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+
+	// -payload overrides stdin, which is not read even on a terminal
+	payloadStdin = fakeStdin{strings.NewReader(""), os.ModeDevice | os.ModeCharDevice}
+	if config, err := parseArgs([]string{"-func", "f", "-payload-stdin", "-payload", "{}"}, noenv); err != nil || config.payload != "{}" {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-payload-stdin"}, noenv); err == nil || !strings.Contains(err.Error(), "terminal") {
+		t.Errorf("got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-func", "f", "-payload-stdin", "-payload_file", "event.json"},
+		{"-func", "f", "-payload_file", "-", "-watch"},
+	} {
+		if _, err := parseArgs(args, noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+}
+
+func TestParseArgsPayloadTemplate(t *testing.T) {
+	env := func(name string) string { return map[string]string{"STAGE": "dev"}[name] }
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := ioutil.WriteFile(path, []byte(`{"stage": "{{ env "STAGE" }}", "build": "{{ .build_id }}"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseArgs([]string{"-func", "f", "-payload_file", path, "-payload-template", "-var", "build_id=b-42", "-show-payload"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.payload != `{"stage": "dev", "build": "b-42"}` || !config.showPayload {
+		t.Errorf("got %s", config.payload)
+	}
+	config, err = parseArgs([]string{"-func", "f", "-payload", `{"stage": "{{ env "STAGE" }}"}`, "-payload-template"}, env)
+	if err != nil || config.payload != `{"stage": "dev"}` {
+		t.Errorf("got %v", err)
+	}
+	// without -payload-template, braces are sent as is
+	config, err = parseArgs([]string{"-func", "f", "-payload_file", path}, env)
+	if err != nil || !strings.Contains(config.payload, "{{ .build_id }}") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-payload_file", path, "-payload-template"}, env); err == nil || !strings.Contains(err.Error(), "payload template "+path+", line 1: ") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-var", "build_id=b-42"}, env); err == nil || !strings.Contains(err.Error(), "-var needs -payload-template") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseArgsSuspiciousPayload(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.json")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	order := filepath.Join(dir, "order.json")
+	if err := ioutil.WriteFile(order, []byte(`{"id": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		args   []string
+		env    map[string]string
+		source string // "" is intentionally empty
+		why    string // "" is not suspicious
+	}{
+		// no payload flag at all, empty on purpose
+		{args: nil, source: "", why: ""},
+		{args: []string{"-payload", `{"id": 1}`}, source: "-payload", why: ""},
+		{args: []string{"-payload_file", order}, source: "-payload_file " + order, why: ""},
+		{args: []string{"-p", "id:=1"}, source: "-p", why: ""},
+		// given, but expanded to nothing
+		{args: []string{"-payload", ""}, source: "-payload", why: "is empty"},
+		{args: []string{"-payload", "   \n"}, source: "-payload", why: "is whitespace only (4 bytes)"},
+		{args: []string{"-payload", "undefined"}, source: "-payload", why: `is "undefined"`},
+		{args: []string{"-payload", " null "}, source: "-payload", why: `is "null"`},
+		{args: []string{"-payload", "{}"}, source: "-payload", why: `is "{}"`},
+		{args: []string{"-payload_file", empty}, source: "-payload_file " + empty, why: "is empty"},
+		{env: map[string]string{"PAYLOAD": "  "}, source: "PAYLOAD", why: "is whitespace only (2 bytes)"},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string { return c.env[k] }
+		args := append([]string{"-func", "f"}, c.args...)
+		config, err := parseArgs(args, getenv)
+		if err != nil {
+			t.Errorf("%v: %s", c.args, err)
+			continue
+		}
+		if config.payloadSource != c.source {
+			t.Errorf("%v: source %q, want %q", c.args, config.payloadSource, c.source)
+		}
+		if (config.payloadWarning == "") != (c.why == "") || !strings.Contains(config.payloadWarning, c.why) {
+			t.Errorf("%v: warning %q, want %q", c.args, config.payloadWarning, c.why)
+		}
+
+		_, err = parseArgs(append(args, "-strict-payload"), getenv)
+		if (err == nil) != (c.why == "") {
+			t.Errorf("%v -strict-payload: got %v", c.args, err)
+		}
+		if err != nil && (!strings.Contains(err.Error(), c.source) || !strings.Contains(err.Error(), c.why)) {
+			t.Errorf("the error must name the source and the reason, got %s", err)
+		}
+	}
+}
+
+func TestDescribePayload(t *testing.T) {
+	if s := describePayload(""); s != "empty (0 bytes)" {
+		t.Errorf("got %s", s)
+	}
+	if s := describePayload(`{"id": 1}`); !strings.HasPrefix(s, "sha256:") || !strings.HasSuffix(s, "(9 bytes)") {
+		t.Errorf("got %s", s)
+	}
+}
+
+func TestParseArgsShipMaxLineLength(t *testing.T) {
+	env := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-ship-to", "https://logs.example.com/ingest"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.shipMaxLineLength != defaultShipMaxLineLength || config.maxLineLength != defaultMaxLineLength {
+		t.Errorf("got %d and %d", config.shipMaxLineLength, config.maxLineLength)
+	}
+	config, err = parseArgs([]string{"-func", "f", "-ship-to", "https://logs.example.com/ingest", "-ship-max-line-length", "0"}, env)
+	if err != nil || config.shipMaxLineLength != 0 {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-ship-max-line-length", "1024"}, env); err == nil || !strings.Contains(err.Error(), "-ship-max-line-length needs -ship-to") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	credsCacheProviderName = "CachedAssumeRoleProvider"
+	credsCacheExpiryMargin = 5 * time.Minute        // cached credentials expiring sooner are not used
+	credsCacheStaleLock    = 5 * time.Minute        // a lock older than this is left by a process which died
+	credsCachePoll         = 100 * time.Millisecond // how often a waiting process checks the lock
+)
+
+// addCredentialCacheFlag defines -no-credential-cache, shared by the subcommands
+func addCredentialCacheFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("no-credential-cache", false, "assume the role of the profile every time instead of sharing the credentials cached by other invocations")
+}
+
+// defaultCredsCacheDir returns the directory of the cached credentials
+func defaultCredsCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".k8s-nodeless", "cache")
+}
+
+// roleProfile is what identifies the credentials of a profile which assumes a role
+type roleProfile struct {
+	Profile         string `json:"profile"`
+	RoleARN         string `json:"role_arn"`
+	SourceProfile   string `json:"source_profile,omitempty"`
+	CredentialSrc   string `json:"credential_source,omitempty"`
+	MFASerial       string `json:"mfa_serial,omitempty"`
+	RoleSessionName string `json:"role_session_name,omitempty"`
+	ExternalID      string `json:"external_id,omitempty"`
+	DurationSeconds string `json:"duration_seconds,omitempty"`
+}
+
+// key returns the name of the cache file of the profile, the sha1 of its fields like the AWS CLI
+func (p roleProfile) key() string {
+	buf, _ := json.Marshal(p)
+	sum := sha1.Sum(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// readProfileSection returns the keys of the section of an ini file, or nil if there is no such file or section
+func readProfileSection(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret map[string]string
+	in := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			in = name == section
+			if in && ret == nil {
+				ret = make(map[string]string)
+			}
+			continue
+		}
+		if !in {
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i > 0 {
+			ret[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ret, sc.Err()
+}
+
+// assumedRoleProfile returns the profile the SDK will use if it assumes a role. Environment variable
+// credentials, and a profile without role_arn, assume no role.
+func assumedRoleProfile(getenv func(string) string) (roleProfile, bool, error) {
+	if getenv("AWS_ACCESS_KEY_ID") != "" {
+		return roleProfile{}, false, nil
+	}
+	name := getenv("AWS_PROFILE")
+	if name == "" {
+		name = getenv("AWS_DEFAULT_PROFILE")
+	}
+	if name == "" {
+		name = "default"
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return roleProfile{}, false, nil
+	}
+	configFile := getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+	credsFile := getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credsFile == "" {
+		credsFile = filepath.Join(home, ".aws", "credentials")
+	}
+
+	section := "profile " + name
+	if name == "default" {
+		section = "default"
+	}
+	keys, err := readProfileSection(configFile, section)
+	if err != nil {
+		return roleProfile{}, false, fmt.Errorf("shared config: %w", err)
+	}
+	// the credentials file takes precedence, as with the SDK
+	creds, err := readProfileSection(credsFile, name)
+	if err != nil {
+		return roleProfile{}, false, fmt.Errorf("shared credentials: %w", err)
+	}
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	for k, v := range creds {
+		keys[k] = v
+	}
+	if keys["role_arn"] == "" {
+		return roleProfile{}, false, nil
+	}
+	return roleProfile{
+		Profile:         name,
+		RoleARN:         keys["role_arn"],
+		SourceProfile:   keys["source_profile"],
+		CredentialSrc:   keys["credential_source"],
+		MFASerial:       keys["mfa_serial"],
+		RoleSessionName: keys["role_session_name"],
+		ExternalID:      keys["external_id"],
+		DurationSeconds: keys["duration_seconds"],
+	}, true, nil
+}
+
+// credsCacheFile is a cache file, in the format of the AWS CLI cache
+type credsCacheFile struct {
+	Credentials struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	}
+	ProviderType string
+}
+
+// credsCache is a directory of credentials shared by concurrent invocations of this tool
+type credsCache struct {
+	dir string
+	now func() time.Time
+}
+
+func newCredsCache(dir string) *credsCache {
+	return &credsCache{dir: dir, now: time.Now}
+}
+
+// load returns the cached credentials of the key, unless they expire within credsCacheExpiryMargin.
+// A corrupted file is removed.
+func (c *credsCache) load(key string) (credentials.Value, time.Time, bool) {
+	path := filepath.Join(c.dir, key+".json")
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Debugf("credential cache: %s", err)
+		}
+		return credentials.Value{}, time.Time{}, false
+	}
+	var f credsCacheFile
+	if err := json.Unmarshal(buf, &f); err != nil || f.Credentials.AccessKeyID == "" || f.Credentials.SecretAccessKey == "" || f.Credentials.Expiration.IsZero() {
+		logger.Warnf("credential cache: %s is corrupted, it is removed", path)
+		os.Remove(path)
+		return credentials.Value{}, time.Time{}, false
+	}
+	exp := f.Credentials.Expiration
+	if exp.Sub(c.now()) <= credsCacheExpiryMargin {
+		logger.Debugf("credential cache: the credentials expire at %s", exp)
+		return credentials.Value{}, time.Time{}, false
+	}
+	return credentials.Value{
+		AccessKeyID:     f.Credentials.AccessKeyID,
+		SecretAccessKey: f.Credentials.SecretAccessKey,
+		SessionToken:    f.Credentials.SessionToken,
+		ProviderName:    credsCacheProviderName,
+	}, exp, true
+}
+
+// save writes the credentials of the key. The file is renamed into place, so that a reader never
+// sees a partial one.
+func (c *credsCache) save(key string, v credentials.Value, exp time.Time) error {
+	var f credsCacheFile
+	f.Credentials.AccessKeyID = v.AccessKeyID
+	f.Credentials.SecretAccessKey = v.SecretAccessKey
+	f.Credentials.SessionToken = v.SessionToken
+	f.Credentials.Expiration = exp.UTC()
+	f.ProviderType = "assume-role"
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, key+".*.tmp") // 0600
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key+".json")); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// tryLock takes the lock of the key, which only one process holds. It returns false if another
+// process holds it. A lock older than credsCacheStaleLock is taken over.
+func (c *credsCache) tryLock(key string) (func(), bool, error) {
+	path := filepath.Join(c.dir, key+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+		f.Close()
+		return func() { os.Remove(path) }, true, nil
+	}
+	if !os.IsExist(err) {
+		return nil, false, err
+	}
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > credsCacheStaleLock {
+		logger.Warnf("credential cache: %s is left since %s, it is taken over", path, info.ModTime())
+		os.Remove(path)
+	}
+	return nil, false, nil
+}
+
+// cachedRoleProvider shares the credentials of a role among the invocations of this tool. Only one
+// of the invocations which find no cached credentials assumes the role, and the others wait for it.
+type cachedRoleProvider struct {
+	credentials.Expiry
+
+	cache  *credsCache
+	key    string
+	assume func() (credentials.Value, time.Time, error) // assumes the role, may prompt for the MFA code
+}
+
+// Retrieve implements credentials.Provider
+func (p *cachedRoleProvider) Retrieve() (credentials.Value, error) {
+	if err := os.MkdirAll(p.cache.dir, 0700); err != nil {
+		logger.Warnf("credential cache: %s, the credentials are not cached", err)
+		return p.assumeRole(false)
+	}
+	waiting := false
+	for {
+		if v, exp, ok := p.cache.load(p.key); ok {
+			logger.Debugf("credential cache: the credentials expiring at %s are used", exp)
+			p.SetExpiration(exp, credsCacheExpiryMargin)
+			return v, nil
+		}
+		unlock, locked, err := p.cache.tryLock(p.key)
+		if err != nil {
+			logger.Warnf("credential cache: %s, the credentials are not cached", err)
+			return p.assumeRole(false)
+		}
+		if locked {
+			defer unlock()
+			// the holder of the lock may have saved them while this one was waiting
+			if v, exp, ok := p.cache.load(p.key); ok {
+				p.SetExpiration(exp, credsCacheExpiryMargin)
+				return v, nil
+			}
+			return p.assumeRole(true)
+		}
+		if !waiting {
+			logger.Infof("credential cache: waiting for another invocation assuming the role")
+			waiting = true
+		}
+		time.Sleep(credsCachePoll)
+	}
+}
+
+func (p *cachedRoleProvider) assumeRole(save bool) (credentials.Value, error) {
+	v, exp, err := p.assume()
+	if err != nil {
+		return v, err
+	}
+	p.SetExpiration(exp, credsCacheExpiryMargin)
+	if save && !exp.IsZero() {
+		if err := p.cache.save(p.key, v, exp); err != nil {
+			logger.Warnf("credential cache: %s", err)
+		}
+	}
+	return v, nil
+}
+
+// assumeRoleOfProfile returns a function which assumes the role of the profile as the SDK does
+func assumeRoleOfProfile(opts session.Options) func() (credentials.Value, time.Time, error) {
+	return func() (credentials.Value, time.Time, error) {
+		sess, err := session.NewSessionWithOptions(opts)
+		if err != nil {
+			return credentials.Value{}, time.Time{}, err
+		}
+		v, err := sess.Config.Credentials.Get()
+		if err != nil {
+			return v, time.Time{}, err
+		}
+		exp, err := sess.Config.Credentials.ExpiresAt()
+		if err != nil {
+			return v, time.Time{}, nil // not cached
+		}
+		return v, exp, nil
+	}
+}
+
+// cachedRoleCredentials returns the credentials of the role of the profile shared through the cache,
+// or nil if the profile assumes no role
+func cachedRoleCredentials(opts session.Options, getenv func(string) string) (*credentials.Credentials, error) {
+	p, ok, err := assumedRoleProfile(getenv)
+	if err != nil || !ok {
+		return nil, err
+	}
+	logger.Debugf("credential cache: the role %s of the profile %s is cached", p.RoleARN, p.Profile)
+	return credentials.NewCredentials(&cachedRoleProvider{
+		cache:  newCredsCache(defaultCredsCacheDir()),
+		key:    p.key(),
+		assume: assumeRoleOfProfile(opts),
+	}), nil
+}
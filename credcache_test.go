@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// setTestEnv sets the environment variable for the test
+func setTestEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// setTestHome makes a temporary HOME with the AWS config file
+func setTestHome(t *testing.T, config string) string {
+	t.Helper()
+	home := t.TempDir()
+	setTestEnv(t, "HOME", home)
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		setTestEnv(t, k, "")
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".aws"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".aws", "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return home
+}
+
+// fakeSTS assumes a role slowly, as a prompt for the MFA code does
+type fakeSTS struct {
+	mu    sync.Mutex
+	calls int
+	ttl   time.Duration
+}
+
+func (f *fakeSTS) assume() (credentials.Value, time.Time, error) {
+	f.mu.Lock()
+	f.calls++
+	n := f.calls
+	f.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("ASIA%d", n),
+		SecretAccessKey: "SECRET",
+		SessionToken:    "TOKEN",
+		ProviderName:    "AssumeRoleProvider",
+	}, time.Now().Add(f.ttl), nil
+}
+
+func (f *fakeSTS) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+const testRoleConfig = `[default]
+region = us-east-1
+
+[profile deploy]
+role_arn = arn:aws:iam::123456789012:role/deploy
+source_profile = default
+mfa_serial = arn:aws:iam::123456789012:mfa/alice
+`
+
+func TestAssumedRoleProfile(t *testing.T) {
+	setTestHome(t, testRoleConfig)
+	env := map[string]string{"AWS_PROFILE": "deploy"}
+	getenv := func(k string) string { return env[k] }
+
+	p, ok, err := assumedRoleProfile(getenv)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if p.RoleARN != "arn:aws:iam::123456789012:role/deploy" || p.MFASerial != "arn:aws:iam::123456789012:mfa/alice" || p.SourceProfile != "default" {
+		t.Errorf("got %+v", p)
+	}
+	other := p
+	other.MFASerial = "arn:aws:iam::123456789012:mfa/bob"
+	if p.key() == other.key() {
+		t.Errorf("another MFA device must not share the credentials")
+	}
+
+	env["AWS_PROFILE"] = ""
+	if _, ok, _ := assumedRoleProfile(getenv); ok {
+		t.Errorf("the default profile assumes no role")
+	}
+	env["AWS_PROFILE"] = "deploy"
+	env["AWS_ACCESS_KEY_ID"] = "AKID"
+	if _, ok, _ := assumedRoleProfile(getenv); ok {
+		t.Errorf("the environment credentials are used")
+	}
+}
+
+func TestCachedRoleProviderSingleFlight(t *testing.T) {
+	setTestLogger(t)
+	dir := t.TempDir()
+	sts := &fakeSTS{ttl: time.Hour}
+
+	// each provider is a process of its own sharing the directory
+	const n = 10
+	values := make([]credentials.Value, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := &cachedRoleProvider{cache: newCredsCache(dir), key: "deploy", assume: sts.assume}
+			values[i], errs[i] = p.Retrieve()
+		}(i)
+	}
+	wg.Wait()
+
+	if got := sts.count(); got != 1 {
+		t.Errorf("the role is assumed %d times", got)
+	}
+	for i := range values {
+		if errs[i] != nil || values[i].AccessKeyID != "ASIA1" {
+			t.Errorf("got %+v, %v", values[i], errs[i])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "deploy.lock")); !os.IsNotExist(err) {
+		t.Errorf("the lock is left, %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "deploy.json"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got %v, %v", info, err)
+	}
+}
+
+func TestCachedRoleProviderExpiry(t *testing.T) {
+	setTestLogger(t)
+	dir := t.TempDir()
+	sts := &fakeSTS{ttl: 4 * time.Minute}
+	p := &cachedRoleProvider{cache: newCredsCache(dir), key: "deploy", assume: sts.assume}
+
+	if _, err := p.Retrieve(); err != nil {
+		t.Fatal(err)
+	}
+	// within the margin, the cached credentials are not used
+	v, err := p.Retrieve()
+	if err != nil || sts.count() != 2 || v.AccessKeyID != "ASIA2" {
+		t.Errorf("got %+v, %v, %d calls", v, err, sts.count())
+	}
+
+	sts.ttl = time.Hour
+	if _, err := p.Retrieve(); err != nil {
+		t.Fatal(err)
+	}
+	v, err = p.Retrieve()
+	if err != nil || sts.count() != 3 || v.ProviderName != credsCacheProviderName {
+		t.Errorf("got %+v, %v, %d calls", v, err, sts.count())
+	}
+
+	// the cache expires with the clock
+	p.cache.now = func() time.Time { return time.Now().Add(56 * time.Minute) }
+	if _, err := p.Retrieve(); err != nil || sts.count() != 4 {
+		t.Errorf("got %v, %d calls", err, sts.count())
+	}
+}
+
+func TestCachedRoleProviderCorrupted(t *testing.T) {
+	logs := setTestLogger(t)
+	dir := t.TempDir()
+	sts := &fakeSTS{ttl: time.Hour}
+	p := &cachedRoleProvider{cache: newCredsCache(dir), key: "deploy", assume: sts.assume}
+
+	for _, content := range []string{`{"Credentials": {"AccessKeyId": "ASIA`, `{"Credentials": {}}`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "deploy.json"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		before := sts.count()
+		if _, err := p.Retrieve(); err != nil || sts.count() != before+1 {
+			t.Errorf("%s: got %v, %d calls", content, err, sts.count())
+		}
+		if _, _, ok := p.cache.load("deploy"); !ok {
+			t.Errorf("%s: the cache is not rewritten", content)
+		}
+	}
+	if got := logs.FilterMessageSnippet("is corrupted").Len(); got != 2 {
+		t.Errorf("got %d warnings", got)
+	}
+}
+
+func TestCachedRoleProviderStaleLock(t *testing.T) {
+	setTestLogger(t)
+	dir := t.TempDir()
+	lock := filepath.Join(dir, "deploy.lock")
+	if err := ioutil.WriteFile(lock, []byte("12345\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * credsCacheStaleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	sts := &fakeSTS{ttl: time.Hour}
+	p := &cachedRoleProvider{cache: newCredsCache(dir), key: "deploy", assume: sts.assume}
+	if _, err := p.Retrieve(); err != nil || sts.count() != 1 {
+		t.Errorf("got %v, %d calls", err, sts.count())
+	}
+}
+
+func TestNewAWSSessionOptionsCredentialCache(t *testing.T) {
+	setTestLogger(t)
+	setTestHome(t, testRoleConfig)
+	setTestEnv(t, "AWS_PROFILE", "deploy")
+
+	opts, err := newAWSSessionOptions("us-east-1", networkOptions{}, false)
+	if err != nil || opts.Config.Credentials == nil {
+		t.Errorf("the cached credentials are expected, got %v", err)
+	}
+	opts, err = newAWSSessionOptions("us-east-1", networkOptions{}, true)
+	if err != nil || opts.Config.Credentials != nil {
+		t.Errorf("-no-credential-cache, got %v", err)
+	}
+}
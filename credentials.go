@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	containerCredsProviderName = "ContainerCredentialsProvider"
+	sharedConfigProviderName   = "SharedConfigProvider"
+	containerCredsTimeout      = 5 * time.Second
+	containerCredsExpiryWindow = 5 * time.Minute
+)
+
+// containerCredsProvider retrieves credentials from the container credential endpoint
+// given by AWS_CONTAINER_CREDENTIALS_FULL_URI, which is used by EKS Pod Identity and ECS.
+// The SDK version we use supports neither the authorization token file nor
+// the link-local address of EKS Pod Identity.
+type containerCredsProvider struct {
+	credentials.Expiry
+
+	uri       string
+	token     string // AWS_CONTAINER_AUTHORIZATION_TOKEN
+	tokenFile string // AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE, read on every retrieval as it is rotated
+	client    *http.Client
+}
+
+type containerCredsResponse struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      *time.Time
+}
+
+// Retrieve implements credentials.Provider
+func (p *containerCredsProvider) Retrieve() (credentials.Value, error) {
+	req, err := http.NewRequest(http.MethodGet, p.uri, nil)
+	if err != nil {
+		return credentials.Value{ProviderName: containerCredsProviderName}, err
+	}
+
+	token := p.token
+	if p.tokenFile != "" {
+		buf, err := ioutil.ReadFile(p.tokenFile)
+		if err != nil {
+			return credentials.Value{ProviderName: containerCredsProviderName}, fmt.Errorf("read authorization token file: %w", err)
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{ProviderName: containerCredsProviderName}, fmt.Errorf("container credentials endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return credentials.Value{ProviderName: containerCredsProviderName}, fmt.Errorf("container credentials endpoint returns %d: %s", resp.StatusCode, string(body))
+	}
+
+	var r containerCredsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return credentials.Value{ProviderName: containerCredsProviderName}, fmt.Errorf("container credentials response: %w", err)
+	}
+	if r.Expiration != nil {
+		p.SetExpiration(*r.Expiration, containerCredsExpiryWindow)
+	}
+	return credentials.Value{
+		AccessKeyID:     r.AccessKeyID,
+		SecretAccessKey: r.SecretAccessKey,
+		SessionToken:    r.Token,
+		ProviderName:    containerCredsProviderName,
+	}, nil
+}
+
+// containerCredsAllowed returns true if the credentials endpoint may be used, which is
+// https, a loopback address, or the link-local addresses of ECS and EKS Pod Identity.
+func containerCredsAllowed(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.Equal(net.ParseIP("169.254.170.2")) || ip.Equal(net.ParseIP("169.254.170.23")) || ip.Equal(net.ParseIP("fd00:ec2::23"))
+}
+
+// credentialProviders returns the credential chain which is used instead of the SDK default
+// when the container credential endpoint is given, or nil to use the SDK default. The chain keeps
+// the default order, the environment variables, the shared config and the web identity token, and
+// only the container endpoint after them is our own provider. opts are of the session, without
+// the credentials.
+func credentialProviders(opts session.Options, getenv func(string) string) ([]credentials.Provider, error) {
+	uri := getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri == "" {
+		return nil, nil
+	}
+	if !containerCredsAllowed(uri) {
+		return nil, fmt.Errorf("AWS_CONTAINER_CREDENTIALS_FULL_URI is not allowed, %s", uri)
+	}
+	return []credentials.Provider{
+		&credentials.EnvProvider{},
+		&sharedConfigProvider{opts: opts},
+		&containerCredsProvider{
+			uri:       uri,
+			token:     getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+			tokenFile: getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+			client:    &http.Client{Timeout: containerCredsTimeout},
+		},
+	}, nil
+}
+
+// sharedConfigProvider retrieves the credentials the SDK resolves from the shared config and the
+// web identity token, as a profile, a credential_process or an assumed role. The credentials the
+// SDK would take from the container endpoint or the instance metadata are left to the providers
+// after it.
+type sharedConfigProvider struct {
+	opts  session.Options
+	creds *credentials.Credentials // of the session, resolved at the first retrieval
+}
+
+// Retrieve implements credentials.Provider
+func (p *sharedConfigProvider) Retrieve() (credentials.Value, error) {
+	if p.creds == nil {
+		sess, err := session.NewSessionWithOptions(p.opts)
+		if err != nil {
+			return credentials.Value{ProviderName: sharedConfigProviderName}, fmt.Errorf("shared config: %w", err)
+		}
+		p.creds = sess.Config.Credentials
+	}
+	v, err := p.creds.Get()
+	if err != nil {
+		return credentials.Value{ProviderName: sharedConfigProviderName}, fmt.Errorf("shared config: %w", err)
+	}
+	switch v.ProviderName {
+	case endpointcreds.ProviderName, ec2rolecreds.ProviderName:
+		return credentials.Value{ProviderName: sharedConfigProviderName}, fmt.Errorf("no credentials in the shared config nor by a web identity token")
+	}
+	return v, nil
+}
+
+// IsExpired implements credentials.Provider
+func (p *sharedConfigProvider) IsExpired() bool {
+	return p.creds == nil || p.creds.IsExpired()
+}
+
+// newAWSSessionOptions returns session options used by every AWS client of this tool. The credentials
+// of a profile which assumes a role are shared through the cache unless noCredsCache.
+func newAWSSessionOptions(region string, network networkOptions, noCredsCache bool) (session.Options, error) {
+	awsConfig := aws.NewConfig()
+	if client := newHTTPClient(network); client != nil {
+		awsConfig = awsConfig.WithHTTPClient(client)
+	}
+	if network.dualStack {
+		awsConfig = awsConfig.WithEndpointResolver(dualStackResolver(endpoints.DefaultResolver()))
+	}
+	if region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	opts := session.Options{
+		SharedConfigState:       session.SharedConfigEnable,
+		Config:                  *awsConfig,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+	providers, err := credentialProviders(opts, os.Getenv)
+	if err != nil {
+		return session.Options{}, err
+	}
+	if providers != nil {
+		opts.Config.Credentials = credentials.NewCredentials(&credentials.ChainProvider{
+			Providers:     providers,
+			VerboseErrors: true,
+		})
+	}
+	if providers == nil && !noCredsCache {
+		creds, err := cachedRoleCredentials(opts, os.Getenv)
+		if err != nil {
+			return session.Options{}, err
+		}
+		if creds != nil {
+			opts.Config.Credentials = creds
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestContainerCredsProviderTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Token": "TOKEN", "Expiration": "2099-01-01T00:00:00Z"}`)
+	}))
+	defer ts.Close()
+
+	env := map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     ts.URL + "/v1/credentials",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": tokenFile,
+	}
+	providers, err := credentialProviders(session.Options{}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 3 {
+		t.Fatalf("providers: %v", providers)
+	}
+	// the default order, only the container endpoint is replaced
+	if _, ok := providers[0].(*credentials.EnvProvider); !ok {
+		t.Errorf("environment provider expected first, got %T", providers[0])
+	}
+	if _, ok := providers[1].(*sharedConfigProvider); !ok {
+		t.Errorf("shared config provider expected second, got %T", providers[1])
+	}
+	p, ok := providers[2].(*containerCredsProvider)
+	if !ok {
+		t.Fatalf("container provider expected, got %T", providers[2])
+	}
+	v, err := p.Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "AKID" || v.SecretAccessKey != "SECRET" || v.SessionToken != "TOKEN" || v.ProviderName != containerCredsProviderName {
+		t.Errorf("got %+v", v)
+	}
+
+	// the token file is rotated
+	if err := ioutil.WriteFile(tokenFile, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Retrieve(); err == nil {
+		t.Error("rotated token should be sent")
+	}
+}
+
+func TestCredentialProvidersDefault(t *testing.T) {
+	providers, err := credentialProviders(session.Options{}, func(string) string { return "" })
+	if err != nil || providers != nil {
+		t.Errorf("SDK default expected, got %v %v", providers, err)
+	}
+}
+
+func TestSharedConfigProvider(t *testing.T) {
+	p := &sharedConfigProvider{creds: credentials.NewCredentials(&credentials.StaticProvider{Value: credentials.Value{
+		AccessKeyID: "AKID", SecretAccessKey: "SECRET", ProviderName: "SharedConfigCredentials: /home/ci/.aws/credentials",
+	}})}
+	if v, err := p.Retrieve(); err != nil || v.AccessKeyID != "AKID" {
+		t.Errorf("the credentials of the profile are not taken, got %+v %v", v, err)
+	}
+
+	// the SDK falls back to the endpoint itself, which is left to the container provider
+	for _, name := range []string{endpointcreds.ProviderName, ec2rolecreds.ProviderName} {
+		p := &sharedConfigProvider{creds: credentials.NewCredentials(&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID: "AKID", SecretAccessKey: "SECRET", ProviderName: name,
+		}})}
+		if v, err := p.Retrieve(); err == nil {
+			t.Errorf("%s: the credentials must be left to the next provider, got %+v", name, v)
+		}
+	}
+}
+
+func TestContainerCredsAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"http://169.254.170.23/v1/credentials": true,
+		"http://169.254.170.2/creds":           true,
+		"http://127.0.0.1:8080/creds":          true,
+		"http://localhost/creds":               true,
+		"http://[fd00:ec2::23]/v1/credentials": true,
+		"https://creds.example.com/":           true,
+		"http://creds.example.com/":            false,
+		"http://10.0.0.1/":                     false,
+	}
+	for uri, want := range tests {
+		if got := containerCredsAllowed(uri); got != want {
+			t.Errorf("%s: got %v", uri, got)
+		}
+	}
+}
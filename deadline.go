@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultDeadlineMargin    = 0.1
+	defaultRemainingTimeExpr = `(?i)remaining[ a-z]*[:=]?\s*([0-9]+)\s*ms`
+)
+
+// deadlineResult is the time left to the deadline of the function observed in its logs
+type deadlineResult = schema.Deadline
+
+// deadlineWatcher is a subscriber which finds the remaining time logged by the function.
+// A text line is matched by textRe, whose first group is milliseconds. A JSON line is checked
+// for remainingTimeInMillis, or deadlineMs which is milliseconds since the epoch.
+type deadlineWatcher struct {
+	textRe *regexp.Regexp
+	margin float64
+
+	mu        sync.Mutex
+	started   int64 // timestamp of START
+	observed  bool
+	remaining int64
+	at        int64 // timestamp of the line which reported remaining
+}
+
+func newDeadlineWatcher(textRe *regexp.Regexp, margin float64) *deadlineWatcher {
+	return &deadlineWatcher{textRe: textRe, margin: margin}
+}
+
+func (d *deadlineWatcher) handle(ev busEvent) error {
+	switch e := ev.(type) {
+	case lifecycleEvent:
+		if e.Kind == "START" {
+			d.mu.Lock()
+			if d.started == 0 {
+				d.started = e.Timestamp
+			}
+			d.mu.Unlock()
+		}
+	case logEvent:
+		remaining, ok := d.parse(e.Message, e.Timestamp)
+		if !ok {
+			return nil
+		}
+		d.mu.Lock()
+		d.observed = true
+		d.remaining = remaining
+		d.at = e.Timestamp
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// parse returns the remaining milliseconds in the line
+func (d *deadlineWatcher) parse(line string, timestamp int64) (int64, bool) {
+	if strings.HasPrefix(line, "{") {
+		var rec struct {
+			RemainingTimeInMillis *float64 `json:"remainingTimeInMillis"`
+			DeadlineMs            *float64 `json:"deadlineMs"`
+		}
+		if json.Unmarshal([]byte(line), &rec) == nil {
+			switch {
+			case rec.RemainingTimeInMillis != nil:
+				return int64(*rec.RemainingTimeInMillis), true
+			case rec.DeadlineMs != nil:
+				return int64(*rec.DeadlineMs) - timestamp, true
+			}
+		}
+	}
+	if d.textRe == nil {
+		return 0, false
+	}
+	m := d.textRe.FindStringSubmatch(line)
+	if len(m) < 2 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// result returns the remaining time at the last log which reported it, or false if none did
+func (d *deadlineWatcher) result() (deadlineResult, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.observed {
+		return deadlineResult{}, false
+	}
+	ret := deadlineResult{RemainingMs: d.remaining, BudgetMs: d.remaining}
+	if d.started > 0 && d.at >= d.started {
+		ret.BudgetMs += d.at - d.started
+	}
+	ret.AtRisk = float64(ret.RemainingMs) < d.margin*float64(ret.BudgetMs)
+	return ret, true
+}
+
+// summary returns the deadline for the summary, or nil if it is not observed, and warns if the
+// invocation is at risk
+func (d *deadlineWatcher) summary() *deadlineResult {
+	r, ok := d.result()
+	if !ok {
+		return nil
+	}
+	if r.AtRisk {
+		logger.Warnf("only %d ms of %d ms were remaining at the last log, the invocation is at risk of timing out", r.RemainingMs, r.BudgetMs)
+	}
+	return &r
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDeadlineWatcher(t *testing.T) {
+	textRe := regexp.MustCompile(defaultRemainingTimeExpr)
+	tests := []struct {
+		name   string
+		lines  []string
+		want   deadlineResult
+		absent bool
+	}{
+		{
+			name:  "text",
+			lines: []string{"2021-01-01T00:00:00Z\tabc\tINFO\tremaining 2500 ms"},
+			want:  deadlineResult{RemainingMs: 2500, BudgetMs: 3000},
+		},
+		{
+			name:  "last one wins",
+			lines: []string{"remaining time: 2500ms", "remaining time: 200ms"},
+			want:  deadlineResult{RemainingMs: 200, BudgetMs: 700, AtRisk: false},
+		},
+		{
+			name:  "json remaining",
+			lines: []string{`{"timestamp":"2021-01-01T00:00:00Z","level":"INFO","remainingTimeInMillis":40}`},
+			want:  deadlineResult{RemainingMs: 40, BudgetMs: 540, AtRisk: true},
+		},
+		{
+			name:  "json deadline",
+			lines: []string{`{"time":"2021-01-01T00:00:00Z","type":"platform.start","deadlineMs":2500}`},
+			want:  deadlineResult{RemainingMs: 1000, BudgetMs: 1500},
+		},
+		{
+			name:   "absent",
+			lines:  []string{"hello", `{"message":"remaining"}`},
+			absent: true,
+		},
+	}
+	for _, tt := range tests {
+		d := newDeadlineWatcher(textRe, defaultDeadlineMargin)
+		d.handle(lifecycleEvent{Kind: "START", Timestamp: 1000})
+		for _, line := range tt.lines {
+			d.handle(logEvent{Message: line, Timestamp: 1500})
+		}
+		got, ok := d.result()
+		if ok == tt.absent {
+			t.Errorf("%s: observed %v", tt.name, ok)
+			continue
+		}
+		if !tt.absent && got != tt.want {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// describeAPI is the part of the Lambda API the describe subcommand uses
+type describeAPI interface {
+	GetFunctionConcurrencyWithContext(ctx aws.Context, input *lambda.GetFunctionConcurrencyInput, opts ...request.Option) (*lambda.GetFunctionConcurrencyOutput, error)
+}
+
+// runDescribe runs the describe subcommand
+func runDescribe(args []string) error {
+	var funcName string
+	var jsonOutput bool
+
+	fs := flag.NewFlagSet("describe", flag.ContinueOnError)
+	fs.StringVar(&funcName, "func", "", "function name or ARN, optionally with a qualifier")
+	fs.BoolVar(&jsonOutput, "json", false, "output JSON")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{})
+	defer logger.Sync()
+
+	if funcName == "" {
+		return &configError{fmt.Errorf("-func is required")}
+	}
+	ref, err := ParseFunctionRef(funcName)
+	if err != nil {
+		return &configError{err}
+	}
+	awsOpts, err := newAWSSessionOptions(ref.Region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+
+	svc := lambda.New(sess)
+	d, err := describeFunction(context.Background(), newMetadataCache(svc, false), svc, strings.TrimSuffix(funcName, ":"+ref.Qualifier), ref)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	printDescription(os.Stdout, d)
+	return nil
+}
+
+// describeFunction returns the configuration of the function, whose name or ARN is without the qualifier.
+// Reserved concurrency is of the function regardless of the qualifier, and is left unknown if the
+// credentials may not read it.
+func describeFunction(ctx context.Context, metadata *metadataCache, api describeAPI, name string, ref FunctionRef) (*schema.FunctionDescription, error) {
+	conf, err := metadata.get(ctx, name, ref.Qualifier)
+	if err != nil {
+		return nil, err
+	}
+	logging := conf.Logging
+
+	d := &schema.FunctionDescription{
+		Name:            aws.StringValue(conf.FunctionName),
+		ARN:             aws.StringValue(conf.FunctionArn),
+		Version:         aws.StringValue(conf.Version),
+		Runtime:         aws.StringValue(conf.Runtime),
+		Handler:         aws.StringValue(conf.Handler),
+		PackageType:     aws.StringValue(conf.PackageType),
+		MemorySize:      aws.Int64Value(conf.MemorySize),
+		Timeout:         aws.Int64Value(conf.Timeout),
+		EnvironmentKeys: []string{},
+		LogGroup:        ref.LogGroup(),
+		State:           aws.StringValue(conf.State),
+		LastModified:    aws.StringValue(conf.LastModified),
+	}
+	if conf.Environment != nil {
+		for k := range conf.Environment.Variables {
+			d.EnvironmentKeys = append(d.EnvironmentKeys, k)
+		}
+		sort.Strings(d.EnvironmentKeys)
+	}
+	if conf.DeadLetterConfig != nil {
+		d.DeadLetterTarget = aws.StringValue(conf.DeadLetterConfig.TargetArn)
+	}
+	if logging != nil {
+		if logging.LogGroup != "" {
+			d.LogGroup = logging.LogGroup
+		}
+		d.LogFormat = logging.LogFormat
+	}
+
+	c, err := api.GetFunctionConcurrencyWithContext(ctx, &lambda.GetFunctionConcurrencyInput{FunctionName: aws.String(name)})
+	switch {
+	case isAccessDenied(err):
+		logger.Warnf("the reserved concurrency of %s is not known, GetFunctionConcurrency is denied: %s", name, err)
+	case err != nil:
+		return nil, fmt.Errorf("GetFunctionConcurrency, %s: %w", name, err)
+	default:
+		d.ReservedConcurrency = c.ReservedConcurrentExecutions
+	}
+	return d, nil
+}
+
+// functionTimeout returns the timeout in the configuration of the function, 0 if it is not known
+func (sl *AWSServerless) functionTimeout(ctx context.Context) time.Duration {
+	meta, err := sl.metadata.get(ctx, sl.funcName, "")
+	if err != nil {
+		logger.Debugf("the timeout of %s is not known, END is waited for without a limit: %s", sl.funcName, err)
+		return 0
+	}
+	return time.Duration(aws.Int64Value(meta.Timeout)) * time.Second
+}
+
+// printDescription prints the configuration a field per line
+func printDescription(out io.Writer, d *schema.FunctionDescription) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	runtime := d.Runtime
+	if runtime == "" {
+		runtime = d.PackageType
+	}
+	env := "-"
+	if len(d.EnvironmentKeys) > 0 {
+		env = strings.Join(d.EnvironmentKeys, ", ")
+	}
+	concurrency := "unreserved"
+	if d.ReservedConcurrency != nil {
+		concurrency = fmt.Sprint(*d.ReservedConcurrency)
+	}
+	dlq := "-"
+	if d.DeadLetterTarget != "" {
+		dlq = d.DeadLetterTarget
+	}
+	rows := [][2]string{
+		{"NAME", d.Name},
+		{"ARN", d.ARN},
+		{"VERSION", d.Version},
+		{"RUNTIME", runtime},
+		{"HANDLER", d.Handler},
+		{"MEMORY", fmt.Sprintf("%d MB", d.MemorySize)},
+		{"TIMEOUT", (time.Duration(d.Timeout) * time.Second).String()},
+		{"ENVIRONMENT", env},
+		{"RESERVED CONCURRENCY", concurrency},
+		{"DEAD-LETTER TARGET", dlq},
+		{"LOG GROUP", d.LogGroup},
+		{"STATE", d.State},
+		{"LAST MODIFIED", d.LastModified},
+	}
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\n", r[0], r[1])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// describedFunction answers the configuration and the reserved concurrency, or denies the latter by concurrencyErr
+type describedFunction struct {
+	noFunctionURL
+	conf           *lambda.FunctionConfiguration
+	reserved       *int64
+	concurrencyErr error
+	input          *lambda.GetFunctionConfigurationInput
+}
+
+func (f *describedFunction) GetFunctionConfigurationWithContext(ctx aws.Context, input *lambda.GetFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	f.input = input
+	return f.conf, nil
+}
+
+func (f *describedFunction) GetFunctionConcurrencyWithContext(ctx aws.Context, input *lambda.GetFunctionConcurrencyInput, opts ...request.Option) (*lambda.GetFunctionConcurrencyOutput, error) {
+	if f.concurrencyErr != nil {
+		return nil, f.concurrencyErr
+	}
+	return &lambda.GetFunctionConcurrencyOutput{ReservedConcurrentExecutions: f.reserved}, nil
+}
+
+func TestDescribeFunction(t *testing.T) {
+	logs := setTestLogger(t)
+	api := &describedFunction{
+		conf: &lambda.FunctionConfiguration{
+			FunctionName: aws.String("orders-fn"),
+			FunctionArn:  aws.String("arn:aws:lambda:eu-west-1:123456789012:function:orders-fn:7"),
+			Version:      aws.String("7"),
+			Runtime:      aws.String("python3.12"),
+			Handler:      aws.String("app.handler"),
+			MemorySize:   aws.Int64(512),
+			Timeout:      aws.Int64(30),
+			Environment: &lambda.EnvironmentResponse{Variables: map[string]*string{
+				"TABLE":   aws.String("orders"),
+				"DB_PASS": aws.String("secret"),
+			}},
+			DeadLetterConfig: &lambda.DeadLetterConfig{TargetArn: aws.String("arn:aws:sqs:eu-west-1:123456789012:orders-dlq")},
+			LastModified:     aws.String("2024-05-01T10:00:00.000+0000"),
+		},
+		reserved: aws.Int64(10),
+	}
+	ref, _ := ParseFunctionRef("orders-fn:live")
+	d, err := describeFunction(context.Background(), newMetadataCache(api, false), api, "orders-fn", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(api.input.FunctionName) != "orders-fn" || aws.StringValue(api.input.Qualifier) != "live" {
+		t.Errorf("input: %v", api.input)
+	}
+	if strings.Join(d.EnvironmentKeys, ",") != "DB_PASS,TABLE" || aws.Int64Value(d.ReservedConcurrency) != 10 || d.LogGroup != "/aws/lambda/orders-fn" {
+		t.Errorf("got %+v", d)
+	}
+
+	var buf bytes.Buffer
+	printDescription(&buf, d)
+	out := buf.String()
+	for _, want := range []string{"TIMEOUT               30s", "ENVIRONMENT           DB_PASS, TABLE", "RESERVED CONCURRENCY  10", "orders-dlq"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q is not in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("the value of an environment variable is printed\n%s", out)
+	}
+
+	api.concurrencyErr = awserr.New("AccessDeniedException", "not authorized to perform: lambda:GetFunctionConcurrency", nil)
+	d, err = describeFunction(context.Background(), newMetadataCache(api, false), api, "orders-fn", ref)
+	if err != nil || d.ReservedConcurrency != nil {
+		t.Errorf("got %v, %v", d, err)
+	}
+	if logs.FilterMessageSnippet("GetFunctionConcurrency is denied").Len() != 1 {
+		t.Errorf("no warning: %v", logs.All())
+	}
+}
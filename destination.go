@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	// defaultDestinationTimeout is how long -check-destination waits; a failing invocation is retried twice
+	// over minutes before its record is sent to OnFailure
+	defaultDestinationTimeout = 5 * time.Minute
+	destinationPollInterval   = 2 * time.Second
+
+	destinationSuccess = "Success" // the condition of a record in OnSuccess
+)
+
+// eventInvokeConfigAPI is the part of the Lambda API -check-destination uses
+type eventInvokeConfigAPI interface {
+	GetFunctionEventInvokeConfigWithContext(ctx aws.Context, input *lambda.GetFunctionEventInvokeConfigInput, opts ...request.Option) (*lambda.GetFunctionEventInvokeConfigOutput, error)
+}
+
+// destinationQueueAPI is the part of SQS API -check-destination uses
+type destinationQueueAPI interface {
+	sqsAPI
+	GetQueueUrlWithContext(aws.Context, *sqs.GetQueueUrlInput, ...request.Option) (*sqs.GetQueueUrlOutput, error)
+}
+
+// destinationCheck is the check of -check-destination
+type destinationCheck struct {
+	requestID string // of the Invoke response, which is the requestId of the record
+	poll      time.Duration
+	timeout   time.Duration
+	result    *schema.Destination
+}
+
+// summary returns the record for the summary, nil unless it is checked
+func (d *destinationCheck) summary() *schema.Destination {
+	if d == nil {
+		return nil
+	}
+	return d.result
+}
+
+// destinationQueue is a destination which is an SQS queue, polled for the record
+type destinationQueue struct {
+	arn     string
+	checker *sqsChecker
+}
+
+// checkDestination finds the record of the async invocation in the SQS queues of the destinations of the
+// function, which Lambda sends after the last attempt. A record in OnFailure fails the run with the error of
+// the function. A function without destinations, or whose destinations are not SQS queues, is only a warning
+// since the outcome is already decided by the logs.
+func (sl *AWSServerless) checkDestination(ctx context.Context, api eventInvokeConfigAPI, queues destinationQueueAPI) error {
+	d := sl.destination
+	if d.requestID == "" {
+		d.requestID = sl.requestID
+	}
+	input := &lambda.GetFunctionEventInvokeConfigInput{FunctionName: aws.String(sl.unqualifiedName())}
+	if sl.ref.Qualifier != "" {
+		input.Qualifier = aws.String(sl.ref.Qualifier)
+	}
+	out, err := api.GetFunctionEventInvokeConfigWithContext(ctx, input)
+	switch {
+	case isResourceNotFound(err):
+		logger.Warnf("%s has no async invocation config, so no destination; the outcome is of the END log line only", sl.qualifiedName())
+		return nil
+	case isAccessDenied(err):
+		logger.Warnf("the destinations of %s are not known, GetFunctionEventInvokeConfig is denied: %s", sl.qualifiedName(), err)
+		return nil
+	case err != nil:
+		return fmt.Errorf("GetFunctionEventInvokeConfig, %s: %w", sl.qualifiedName(), err)
+	}
+
+	d.result = &schema.Destination{}
+	if c := out.DestinationConfig; c != nil {
+		if c.OnSuccess != nil {
+			d.result.OnSuccess = aws.StringValue(c.OnSuccess.Destination)
+		}
+		if c.OnFailure != nil {
+			d.result.OnFailure = aws.StringValue(c.OnFailure.Destination)
+		}
+	}
+	if d.result.OnSuccess == "" && d.result.OnFailure == "" {
+		logger.Warnf("%s has no OnSuccess or OnFailure destination; the outcome is of the END log line only", sl.qualifiedName())
+		return nil
+	}
+
+	if d.requestID == "" {
+		logger.Warnf("the request id of the invocation is not known, its record in the destination is not looked for")
+		return nil
+	}
+	filter, err := parseExpr(fmt.Sprintf(".requestContext.requestId == %q", d.requestID))
+	if err != nil {
+		return fmt.Errorf("the filter of the record of %s: %w", d.requestID, err)
+	}
+	var targets []destinationQueue
+	for _, arn := range []string{d.result.OnSuccess, d.result.OnFailure} {
+		if arn == "" {
+			continue
+		}
+		url, err := destinationQueueURL(ctx, queues, arn)
+		if err != nil {
+			return err
+		}
+		if url == "" {
+			logger.Warnf("the destination %s is not read back, only an SQS queue is; a queue as another destination makes the record readable", arn)
+			continue
+		}
+		targets = append(targets, destinationQueue{arn: arn, checker: &sqsChecker{api: queues, queueURL: url, filter: filter}})
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	logger.Infof("waiting up to %s for the record of %s in %d destination(s)", d.timeout, d.requestID, len(targets))
+	deadline := time.Now().Add(d.timeout)
+	for {
+		for _, q := range targets {
+			found, _, _, err := q.checker.poll(ctx)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				return fmt.Errorf("destination %s: %w", q.arn, err)
+			}
+			if found != nil {
+				return d.record(q.arn, found.(map[string]interface{})["body"])
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return &timeoutError{fmt.Errorf("no record of %s in its destinations in %s", d.requestID, d.timeout)}
+		}
+		if err := sleepContext(ctx, d.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// destinationQueueURL returns the URL of a destination which is an SQS queue, "" for another kind
+func destinationQueueURL(ctx context.Context, api destinationQueueAPI, arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "sqs" {
+		return "", nil
+	}
+	u, err := api.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parts[5]),
+		QueueOwnerAWSAccountId: aws.String(parts[4]),
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetQueueUrl, %s: %w", arn, err)
+	}
+	return aws.StringValue(u.QueueUrl), nil
+}
+
+// record sets the result from the record of the invocation, ex:
+//
+//	{"requestContext": {"requestId": "...", "condition": "RetriesExhausted", "approximateInvokeCount": 3},
+//	 "responseContext": {"statusCode": 200, "functionError": "Unhandled"}, "responsePayload": {...}}
+//
+// and returns a functionError unless its condition is Success
+func (d *destinationCheck) record(arn string, body interface{}) error {
+	doc, _ := body.(map[string]interface{})
+	req, _ := doc["requestContext"].(map[string]interface{})
+	resp, _ := doc["responseContext"].(map[string]interface{})
+	r := d.result
+	r.Found = true
+	r.Target = arn
+	r.Condition, _ = req["condition"].(string)
+	if n, ok := req["approximateInvokeCount"].(float64); ok {
+		r.InvokeCount = int(n)
+		if r.InvokeCount > 1 {
+			r.Retries = r.InvokeCount - 1
+		}
+	}
+	if n, ok := resp["statusCode"].(float64); ok {
+		r.StatusCode = int(n)
+	}
+	r.FunctionError, _ = resp["functionError"].(string)
+	r.ResponsePayload = doc["responsePayload"]
+
+	logger.Infof("the record of %s is in %s: %s after %d attempt(s)", d.requestID, arn, r.Condition, r.InvokeCount)
+	if r.Condition != destinationSuccess {
+		return &functionError{fmt.Errorf("the async invocation %s ended with %s after %d retries, %s: %v", d.requestID, r.Condition, r.Retries, r.FunctionError, r.ResponsePayload)}
+	}
+	return nil
+}
+
+// planDestination describes the check of -check-destination in a plan
+func (sl *AWSServerless) planDestination() ([]plannedCall, error) {
+	params := []planParam{{"FunctionName", sl.unqualifiedName()}}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	return []plannedCall{
+		{Service: "lambda", Operation: "GetFunctionEventInvokeConfig", Params: params, Note: "the OnSuccess and OnFailure destinations"},
+		{Service: "sqs", Operation: "GetQueueUrl", Note: "of each destination which is an SQS queue"},
+		{
+			Service:   "sqs",
+			Operation: "ReceiveMessage",
+			Params:    []planParam{{"QueueUrl", "the queue of each destination"}, {"MaxNumberOfMessages", fmt.Sprint(sqsMaxMessages)}, {"VisibilityTimeout", fmt.Sprint(sqsPeekVisibility)}},
+			Note:      fmt.Sprintf("every %s up to %s until the record of the request id of the invocation, each received message is visible again when its visibility timeout expires", destinationPollInterval, sl.destination.timeout),
+		},
+	}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeEventInvokeConfig has the destinations of the function, or fails by err
+type fakeEventInvokeConfig struct {
+	onSuccess, onFailure string
+	err                  error
+	input                *lambda.GetFunctionEventInvokeConfigInput
+}
+
+func (f *fakeEventInvokeConfig) GetFunctionEventInvokeConfigWithContext(ctx aws.Context, input *lambda.GetFunctionEventInvokeConfigInput, opts ...request.Option) (*lambda.GetFunctionEventInvokeConfigOutput, error) {
+	f.input = input
+	if f.err != nil {
+		return nil, f.err
+	}
+	c := &lambda.DestinationConfig{}
+	if f.onSuccess != "" {
+		c.OnSuccess = &lambda.OnSuccess{Destination: aws.String(f.onSuccess)}
+	}
+	if f.onFailure != "" {
+		c.OnFailure = &lambda.OnFailure{Destination: aws.String(f.onFailure)}
+	}
+	return &lambda.GetFunctionEventInvokeConfigOutput{DestinationConfig: c}, nil
+}
+
+// destinationQueues are the queues of the destinations by name
+type destinationQueues map[string]*fakeSQS
+
+func (q destinationQueues) queue(url *string) *fakeSQS {
+	u := aws.StringValue(url)
+	return q[u[strings.LastIndexByte(u, '/')+1:]]
+}
+
+func (q destinationQueues) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	if _, ok := q[aws.StringValue(input.QueueName)]; !ok {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist", nil)
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.eu-west-1.amazonaws.com/" + aws.StringValue(input.QueueOwnerAWSAccountId) + "/" + aws.StringValue(input.QueueName))}, nil
+}
+
+func (q destinationQueues) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return q.queue(input.QueueUrl).ReceiveMessageWithContext(ctx, input, opts...)
+}
+
+func (q destinationQueues) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return nil, errors.New("a record of a destination must not be deleted")
+}
+
+const (
+	successQueueARN = "arn:aws:sqs:eu-west-1:123456789012:orders-ok"
+	failureQueueARN = "arn:aws:sqs:eu-west-1:123456789012:orders-failed"
+)
+
+func newDestinationTest(requestID string) *AWSServerless {
+	return &AWSServerless{
+		funcName:    "orders-fn:live",
+		ref:         FunctionRef{Name: "orders-fn", Qualifier: "live"},
+		destination: &destinationCheck{requestID: requestID, poll: time.Millisecond, timeout: 50 * time.Millisecond},
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeEventInvokeConfig{onSuccess: successQueueARN, onFailure: failureQueueARN}
+	queues := destinationQueues{
+		"orders-ok": {batches: [][]*sqs.Message{
+			{sqsMessage("m-1", `{"requestContext": {"requestId": "other", "condition": "Success"}}`)},
+		}},
+		"orders-failed": {batches: [][]*sqs.Message{
+			nil,
+			{sqsMessage("m-2", `{"requestContext": {"requestId": "r-1", "condition": "RetriesExhausted", "approximateInvokeCount": 3},
+				"responseContext": {"statusCode": 200, "functionError": "Unhandled"},
+				"responsePayload": {"errorMessage": "out of stock"}}`)},
+		}},
+	}
+	sl := newDestinationTest("r-1")
+	err := sl.checkDestination(context.Background(), api, queues)
+	var fe *functionError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "RetriesExhausted after 2 retries, Unhandled") {
+		t.Fatalf("checkDestination() error = %v", err)
+	}
+	if aws.StringValue(api.input.FunctionName) != "orders-fn" || aws.StringValue(api.input.Qualifier) != "live" {
+		t.Errorf("input %v", api.input)
+	}
+	got := sl.destination.summary()
+	if !got.Found || got.Target != failureQueueARN || got.InvokeCount != 3 || got.Retries != 2 || got.StatusCode != 200 {
+		t.Errorf("got %+v", got)
+	}
+	if p, _ := got.ResponsePayload.(map[string]interface{}); p["errorMessage"] != "out of stock" {
+		t.Errorf("response payload %v", got.ResponsePayload)
+	}
+	for name, q := range queues {
+		for _, v := range q.visibility {
+			if v != sqsPeekVisibility {
+				t.Errorf("every record of %s must be peeked, got %v", name, q.visibility)
+				break
+			}
+		}
+	}
+
+	queues = destinationQueues{"orders-ok": {batches: [][]*sqs.Message{
+		{sqsMessage("m-3", `{"requestContext": {"requestId": "r-2", "condition": "Success", "approximateInvokeCount": 1}, "responsePayload": "ok"}`)},
+	}}, "orders-failed": {}}
+	sl = newDestinationTest("r-2")
+	if err := sl.checkDestination(context.Background(), api, queues); err != nil {
+		t.Fatal(err)
+	}
+	if got := sl.destination.summary(); got.Condition != "Success" || got.Retries != 0 || got.ResponsePayload != "ok" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestCheckDestinationTimeout(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeEventInvokeConfig{onFailure: failureQueueARN}
+	sl := newDestinationTest("r-1")
+	err := sl.checkDestination(context.Background(), api, destinationQueues{"orders-failed": {}})
+	var te *timeoutError
+	if !errors.As(err, &te) || sl.destination.summary().Found {
+		t.Errorf("checkDestination() error = %v", err)
+	}
+}
+
+func TestCheckDestinationNone(t *testing.T) {
+	logs := setTestLogger(t)
+	tests := []struct {
+		name string
+		api  *fakeEventInvokeConfig
+		log  string
+	}{
+		{"no config", &fakeEventInvokeConfig{err: awserr.New(lambda.ErrCodeResourceNotFoundException, "not found", nil)}, "has no async invocation config"},
+		{"no destination", &fakeEventInvokeConfig{}, "has no OnSuccess or OnFailure destination"},
+		{"denied", &fakeEventInvokeConfig{err: awserr.New("AccessDeniedException", "denied", nil)}, "GetFunctionEventInvokeConfig is denied"},
+		{"EventBridge", &fakeEventInvokeConfig{onSuccess: "arn:aws:events:eu-west-1:123456789012:event-bus/orders"}, "is not read back"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := newDestinationTest("r-1").checkDestination(context.Background(), tt.api, destinationQueues{}); err != nil {
+				t.Fatal(err)
+			}
+			if logs.FilterMessageSnippet(tt.log).Len() != 1 {
+				t.Errorf("no warning %q: %v", tt.log, logs.All())
+			}
+		})
+	}
+
+	api := &fakeEventInvokeConfig{err: errors.New("connection reset")}
+	if err := newDestinationTest("r-1").checkDestination(context.Background(), api, destinationQueues{}); err == nil || !strings.Contains(err.Error(), "GetFunctionEventInvokeConfig, orders-fn:live") {
+		t.Errorf("checkDestination() error = %v", err)
+	}
+}
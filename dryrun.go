@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// invokeAPI is the part of Lambda API -dry-run uses
+type invokeAPI interface {
+	InvokeWithContext(aws.Context, *lambda.InvokeInput, ...request.Option) (*lambda.InvokeOutput, error)
+}
+
+// invokeDryRun invokes the function with the DryRun invocation type, which validates the permission and
+// the parameters without running the function, and answers 204
+func (sl *AWSServerless) invokeDryRun(ctx context.Context, api invokeAPI, region string) error {
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(sl.unqualifiedName()),
+		Payload:        []byte(sl.payload),
+		InvocationType: aws.String(lambda.InvocationTypeDryRun),
+	}
+	if sl.ref.Qualifier != "" {
+		input.Qualifier = aws.String(sl.ref.Qualifier)
+	}
+	if sl.clientContext != "" {
+		input.ClientContext = aws.String(sl.clientContext)
+	}
+	sl.invokedType = lambda.InvocationTypeDryRun
+	sl.summarize = true
+	resp, err := api.InvokeWithContext(ctx, input)
+	if err != nil {
+		return sl.dryRunError(err, region)
+	}
+	sl.statusCode = int(aws.Int64Value(resp.StatusCode))
+	if sl.statusCode != http.StatusNoContent {
+		return fmt.Errorf("dry run of function %s in %s returned status %d, %d is expected", sl.qualifiedName(), region, sl.statusCode, http.StatusNoContent)
+	}
+	logger.Infof("dry run of function %s in %s: status %d, the function exists and the credentials may invoke it", sl.qualifiedName(), region, sl.statusCode)
+	return nil
+}
+
+// dryRunError tells what a failed dry run means for the function and the region it resolved to
+func (sl *AWSServerless) dryRunError(err error, region string) error {
+	if isAccessDenied(err) {
+		return fmt.Errorf("the credentials may not invoke function %s in %s, they need lambda:InvokeFunction on it: %w", sl.qualifiedName(), region, err)
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("function %s is not found in %s, check the name, the qualifier and the region: %w", sl.qualifiedName(), region, err)
+	}
+	return fmt.Errorf("dry run of function %s in %s: %w", sl.qualifiedName(), region, err)
+}
+
+// qualifiedName returns the name of the function with its qualifier and its account, if any
+func (sl *AWSServerless) qualifiedName() string {
+	name := sl.ref.Name
+	if sl.ref.Qualifier != "" {
+		name += ":" + sl.ref.Qualifier
+	}
+	if sl.ref.AccountID != "" {
+		name += " of account " + sl.ref.AccountID
+	}
+	return name
+}
+
+func (sl *AWSServerless) planDryRun() ([]plannedCall, error) {
+	params := []planParam{
+		{"FunctionName", sl.unqualifiedName()},
+		{"InvocationType", lambda.InvocationTypeDryRun},
+		{"Payload", fmt.Sprintf("%d bytes, sha256:%s", len(sl.payload), sl.integrity.sent)},
+	}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	if sl.clientContext != "" {
+		params = append(params, planParam{"ClientContext", fmt.Sprintf("%d bytes base64-encoded", len(sl.clientContext))})
+	}
+	return []plannedCall{{Service: "lambda", Operation: "Invoke", Params: params, Note: "validates the permission and the parameters without running the function, no log is tailed"}}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+type fakeInvoke struct {
+	input  *lambda.InvokeInput
+	status int64
+	err    error
+}
+
+func (f *fakeInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.input = input
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(f.status)}, nil
+}
+
+func TestInvokeDryRun(t *testing.T) {
+	setTestLogger(t)
+	ref, err := ParseFunctionRef("123456789012:function:orders-fn:live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := &AWSServerless{funcName: "123456789012:function:orders-fn:live", ref: ref, payload: `{"id": 1}`, dryRun: true}
+	api := &fakeInvoke{status: 204}
+	if err := sl.invokeDryRun(context.Background(), api, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(api.input.InvocationType) != lambda.InvocationTypeDryRun || sl.statusCode != 204 || !sl.summarize {
+		t.Errorf("got %v %d", api.input, sl.statusCode)
+	}
+	if note := sl.outcomeNote(); note != "dry run, status 204" {
+		t.Errorf("got %s", note)
+	}
+
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{awserr.New("AccessDeniedException", "not authorized to perform: lambda:InvokeFunction", nil), "the credentials may not invoke function orders-fn:live of account 123456789012 in eu-west-1, they need lambda:InvokeFunction"},
+		{awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil), "function orders-fn:live of account 123456789012 is not found in eu-west-1"},
+		{awserr.New("InvalidRequestContentException", "Could not parse request body", nil), "dry run of function orders-fn:live of account 123456789012 in eu-west-1: InvalidRequestContentException"},
+	} {
+		api.err = c.err
+		if err := sl.invokeDryRun(context.Background(), api, "eu-west-1"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("got %v", err)
+		}
+	}
+
+	api.err, api.status = nil, 200
+	if err := sl.invokeDryRun(context.Background(), api, "eu-west-1"); err == nil || !strings.Contains(err.Error(), "204 is expected") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// recentWindowSize is the number of recent message+timestamp hashes remembered
+// to detect duplicates which are not suppressed by the seen-set.
+const recentWindowSize = 1000
+
+// dedupStats is the statistics of the duplicate suppression
+type dedupStats struct {
+	received           int // events received from the API
+	suppressed         int // events suppressed by the seen-set
+	evictions          int // event ids forgotten as their generation of the seen-set is dropped
+	possibleDuplicates int // events older than the window, which may have been emitted twice
+	detectedDuplicates int // events emitted although the same message and timestamp was emitted recently
+}
+
+// emitter prints log events of the function after applying the rules
+type emitter struct {
+	logger     *zap.SugaredLogger
+	rules      atomic.Value     // *ruleSet, swapped as a whole on reload
+	lineLimits map[sinkKind]int // max line length of each sink, set before emitting
+
+	showExtension  bool  // print extension lines too
+	json           bool  // the label of a line is a field of the record rather than a prefix of the message
+	extensionLines int64 // accessed atomically
+	extensionBytes int64 // accessed atomically
+	printed        int64 // lines printed after the rules, accessed atomically
+
+	mu              sync.Mutex
+	seen            *seenSet
+	stats           dedupStats
+	recent          [recentWindowSize]uint64
+	recentPos       int
+	recentCount     map[uint64]int
+	duplicateWarned bool
+}
+
+// newEmitter returns an emitter which drops an event id seen again within window of event time,
+// the overlap of the polls of the tail
+func newEmitter(logger *zap.SugaredLogger, rs *ruleSet, window time.Duration) (*emitter, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("events window must be positive, %s", window)
+	}
+	e := &emitter{
+		logger:      logger,
+		lineLimits:  map[sinkKind]int{sinkConsole: defaultMaxLineLength, sinkShip: defaultShipMaxLineLength},
+		seen:        newSeenSet(window),
+		recentCount: make(map[uint64]int),
+	}
+	e.setRules(rs)
+	return e, nil
+}
+
+// setRules replaces the current rules
+func (e *emitter) setRules(rs *ruleSet) {
+	e.rules.Store(rs)
+}
+
+// setLineLimit sets the max line length of the sink. 0 means no limit.
+func (e *emitter) setLineLimit(sink sinkKind, max int) {
+	e.lineLimits[sink] = max
+}
+
+// render returns the message as it is written to the sink
+func (e *emitter) render(sink sinkKind, message string) string {
+	return truncateMiddle(message, e.lineLimits[sink])
+}
+
+// isNew returns false if the event has been already seen
+func (e *emitter) isNew(eventID string, timestamp int64, message string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.received++
+	if !e.seen.add(eventID, timestamp) {
+		e.stats.suppressed++
+		return false
+	}
+	e.stats.evictions = e.seen.forgotten
+	if e.seen.maybeForgotten(timestamp) {
+		e.stats.possibleDuplicates++
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	h.Write([]byte(message))
+	sum := h.Sum64()
+	if e.recentCount[sum] > 0 {
+		e.stats.detectedDuplicates++
+		if !e.duplicateWarned {
+			e.duplicateWarned = true
+			e.logger.Warnf("a duplicated log line was not suppressed (event ids forgotten: %d)", e.stats.evictions)
+		}
+	}
+	if old := e.recent[e.recentPos]; old != 0 {
+		if e.recentCount[old]--; e.recentCount[old] <= 0 {
+			delete(e.recentCount, old)
+		}
+	}
+	e.recent[e.recentPos] = sum
+	e.recentCount[sum]++
+	e.recentPos = (e.recentPos + 1) % recentWindowSize
+
+	return true
+}
+
+// dedupStats returns the statistics of the duplicate suppression
+func (e *emitter) dedupStats() dedupStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+// extensionStats returns the number of lines and bytes of extension lines
+func (e *emitter) extensionStats() (int64, int64) {
+	return atomic.LoadInt64(&e.extensionLines), atomic.LoadInt64(&e.extensionBytes)
+}
+
+// printedLines returns the number of lines printed
+func (e *emitter) printedLines() int64 {
+	return atomic.LoadInt64(&e.printed)
+}
+
+// handle prints log events, so the emitter is the console subscriber of the bus
+func (e *emitter) handle(ev busEvent) error {
+	if le, ok := ev.(logEvent); ok {
+		prefix := ""
+		if le.Label != "" && !e.json {
+			prefix = le.Label + " "
+		}
+		e.emitPrefixed(prefix, le.Message, recordFields(schema.LogLine{FunctionName: le.FunctionName, RequestID: le.RequestID, CorrelationID: le.CorrelationID, Label: le.Label})...)
+	}
+	return nil
+}
+
+// ordinalLabel returns the label of the i-th of n invocations, ex: "#03". The labels of a run are as wide
+// as its largest, at least two digits, so that they line up.
+func ordinalLabel(i, n int) string {
+	width := len(strconv.Itoa(n))
+	if width < 2 {
+		width = 2
+	}
+	return fmt.Sprintf("#%0*d", width, i+1)
+}
+
+// emit prints the message unless the rules drop it or it is an extension line
+func (e *emitter) emit(message string, keysAndValues ...interface{}) {
+	e.emitPrefixed("", message, keysAndValues...)
+}
+
+// emitPrefixed is emit which prints the prefix before the message, after the rules apply to the message
+func (e *emitter) emitPrefixed(prefix, message string, keysAndValues ...interface{}) {
+	rs, _ := e.rules.Load().(*ruleSet)
+	if classifyLine(message, rs.extensionRules()) == lineExtension {
+		atomic.AddInt64(&e.extensionLines, 1)
+		atomic.AddInt64(&e.extensionBytes, int64(len(message)))
+		if !e.showExtension {
+			return
+		}
+	}
+	message, ok := rs.apply(message)
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&e.printed, 1)
+	e.logger.Infow(prefix+e.render(sinkConsole, message), keysAndValues...)
+}
+
+// shown returns the message as emit prints it after the rules, and false if it is not printed. Nothing is counted.
+func (e *emitter) shown(message string) (string, bool) {
+	rs, _ := e.rules.Load().(*ruleSet)
+	if !e.showExtension && classifyLine(message, rs.extensionRules()) == lineExtension {
+		return "", false
+	}
+	return rs.apply(message)
+}
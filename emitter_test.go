@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newTestEmitter(t *testing.T, rs *ruleSet, window time.Duration) (*emitter, *observer.ObservedLogs) {
+	t.Helper()
+	core, logs := observer.New(zapcore.DebugLevel)
+	e, err := newEmitter(zap.New(core).Sugar(), rs, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, logs
+}
+
+func TestEmitterDedup(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+
+	for i := 0; i < 3; i++ {
+		if !e.isNew("id-1", 1000, "hello") == (i == 0) {
+			t.Errorf("%d: unexpected", i)
+		}
+	}
+	st := e.dedupStats()
+	if st.received != 3 || st.suppressed != 2 || st.evictions != 0 || st.detectedDuplicates != 0 {
+		t.Errorf("got %+v", st)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("no warning expected")
+	}
+}
+
+func TestEmitterCorrelationID(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	e.handle(logEvent{FunctionName: "f", RequestID: "r1", Message: "hello", CorrelationID: "c-1"})
+	e.handle(logEvent{FunctionName: "f", RequestID: "r1", Message: "bye"})
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("got %v", entries)
+	}
+	if got := entries[0].ContextMap()["correlation_id"]; got != "c-1" {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := entries[1].ContextMap()["correlation_id"]; ok {
+		t.Errorf("no correlation id must be omitted, got %v", entries[1].ContextMap())
+	}
+}
+
+func TestEmitterDedupEvicted(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, time.Second)
+
+	for _, ts := range []int64{1000, 1001, 2000, 3000} {
+		e.isNew(fmt.Sprintf("id-%d", ts), ts, fmt.Sprintf("line %d", ts))
+	}
+	// id-1000 and id-1001 are more than a window older than the newest event and have been
+	// forgotten, so the same events come through again, while id-2000 is still remembered
+	if !e.isNew("id-1000", 1000, "line 1000") {
+		t.Fatal("forgotten event should not be suppressed")
+	}
+	e.isNew("id-1001", 1001, "line 1001")
+	if e.isNew("id-2000", 2000, "line 2000") {
+		t.Error("an event within the window must be suppressed")
+	}
+
+	st := e.dedupStats()
+	if st.evictions != 2 {
+		t.Errorf("evictions: %+v", st)
+	}
+	if st.possibleDuplicates != 2 || st.detectedDuplicates != 2 {
+		t.Errorf("duplicates: %+v", st)
+	}
+	if n := logs.FilterMessageSnippet("not suppressed").Len(); n != 1 {
+		t.Errorf("warning should be logged once, got %d", n)
+	}
+	if _, err := newEmitter(zap.NewNop().Sugar(), nil, 0); err == nil {
+		t.Error("a window of 0 must be an error")
+	}
+}
+
+func TestEmitterLineLimit(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	e.setLineLimit(sinkConsole, 64)
+
+	line := strings.Repeat("x", 1000)
+	e.emit(line)
+	got := logs.All()[0].Message
+	if len(got) > 64 || !strings.Contains(got, "bytes truncated") {
+		t.Errorf("got %q", got)
+	}
+
+	e.setLineLimit(sinkConsole, 0)
+	e.emit(line)
+	if got := logs.All()[1].Message; got != line {
+		t.Errorf("no limit expected, got %d bytes", len(got))
+	}
+}
+
+func TestEmitterLabel(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, 100)
+	ev := logEvent{FunctionName: "orders-fn", RequestID: "r1", Message: "processing r1", Label: "#03"}
+	if err := e.handle(ev); err != nil {
+		t.Fatal(err)
+	}
+	e.json = true
+	if err := e.handle(ev); err != nil {
+		t.Fatal(err)
+	}
+	got := logs.All()
+	if len(got) != 2 || got[0].Message != "#03 processing r1" || got[1].Message != "processing r1" {
+		t.Fatalf("got %v", got)
+	}
+	for _, entry := range got {
+		if entry.ContextMap()["label"] != "#03" {
+			t.Errorf("%s: not tagged with the label: %v", entry.Message, entry.ContextMap())
+		}
+	}
+}
+
+func TestOrdinalLabel(t *testing.T) {
+	for _, tc := range []struct {
+		i, n int
+		want string
+	}{
+		{0, 1, "#01"},
+		{11, 12, "#12"},
+		{6, 100, "#007"},
+		{99, 1000, "#0100"},
+	} {
+		if got := ordinalLabel(tc.i, tc.n); got != tc.want {
+			t.Errorf("%d of %d: got %s", tc.i, tc.n, got)
+		}
+	}
+}
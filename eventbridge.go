@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const defaultEventBridgeStartTimeout = time.Minute
+
+// eventsAPI is the part of the EventBridge API -via eventbridge uses
+type eventsAPI interface {
+	PutEventsWithContext(aws.Context, *eventbridge.PutEventsInput, ...request.Option) (*eventbridge.PutEventsOutput, error)
+}
+
+// eventBridgeTarget is the event -via eventbridge puts instead of invoking the function
+type eventBridgeTarget struct {
+	bus          string // name or ARN of the event bus
+	source       string
+	detailType   string
+	startTimeout time.Duration // how long START of the function is waited for after the event
+}
+
+// validateEventDetail returns the payload as the Detail of an event, which must be a JSON object
+func validateEventDetail(payload string) (string, error) {
+	if strings.TrimSpace(payload) == "" {
+		return "{}", nil
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &v); err != nil || v == nil {
+		return "", fmt.Errorf("-via eventbridge puts the payload as the detail of the event, which must be a JSON object")
+	}
+	return payload, nil
+}
+
+// putEvent puts the payload as the detail of an event to the bus. PutEvents tells no request id,
+// so the tail takes the first START from the start of the run.
+func (sl *AWSServerless) putEvent(ctx context.Context, api eventsAPI) error {
+	t := sl.eventBridge
+	detail, err := validateEventDetail(sl.payload)
+	if err != nil {
+		return err
+	}
+	sl.invokedType = lambda.InvocationTypeEvent
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	out, err := api.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{Entries: []*eventbridge.PutEventsRequestEntry{{
+		EventBusName: aws.String(t.bus),
+		Source:       aws.String(t.source),
+		DetailType:   aws.String(t.detailType),
+		Detail:       aws.String(detail),
+	}}})
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+	if err != nil {
+		return fmt.Errorf("PutEvents, %s: %w", t.bus, err)
+	}
+	if len(out.Entries) == 0 {
+		return fmt.Errorf("PutEvents, %s: no entry in the response", t.bus)
+	}
+	if e := out.Entries[0]; aws.Int64Value(out.FailedEntryCount) > 0 || aws.StringValue(e.ErrorCode) != "" {
+		return fmt.Errorf("PutEvents, %s: the event is not put, %s: %s", t.bus, aws.StringValue(e.ErrorCode), aws.StringValue(e.ErrorMessage))
+	}
+	sl.eventID = aws.StringValue(out.Entries[0].EventId)
+	logger.Infof("the event %s is put to %s, source %s, detail-type %s. the first START from now is taken as the invocation", sl.eventID, t.bus, t.source, t.detailType)
+	return nil
+}
+
+// noStartError tells why START of the function did not appear after the event
+func (sl *AWSServerless) noStartError() error {
+	t := sl.eventBridge
+	return &timeoutError{fmt.Errorf("no START of %s in %s after the event %s: the rule may not have matched source %q and detail-type %q on %s, or the function is not its target",
+		sl.funcName, t.startTimeout, sl.eventID, t.source, t.detailType, t.bus)}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+)
+
+type fakeEvents struct {
+	input  *eventbridge.PutEventsInput
+	failed bool
+}
+
+func (f *fakeEvents) PutEventsWithContext(ctx aws.Context, input *eventbridge.PutEventsInput, opts ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	f.input = input
+	if f.failed {
+		return &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(1), Entries: []*eventbridge.PutEventsResultEntry{{
+			ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String("try again"),
+		}}}, nil
+	}
+	return &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0), Entries: []*eventbridge.PutEventsResultEntry{{EventId: aws.String("ev-1")}}}, nil
+}
+
+func TestValidateEventDetail(t *testing.T) {
+	for in, want := range map[string]string{"": "{}", `{"id": 1}`: `{"id": 1}`, "[1]": "", `"s"`: "", "null": "", "{": ""} {
+		got, err := validateEventDetail(in)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("%q: got %q %v", in, got, err)
+		}
+	}
+}
+
+func TestPutEvent(t *testing.T) {
+	setTestLogger(t)
+	target := &eventBridgeTarget{bus: "orders", source: "orders.api", detailType: "OrderPlaced", startTimeout: time.Minute}
+	sl := &AWSServerless{funcName: "orders-fn", payload: `{"id": 1}`, eventBridge: target, phases: newPhaseTracker(time.Now())}
+	api := &fakeEvents{}
+	if err := sl.putEvent(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	e := api.input.Entries[0]
+	if aws.StringValue(e.EventBusName) != "orders" || aws.StringValue(e.Source) != "orders.api" || aws.StringValue(e.DetailType) != "OrderPlaced" || aws.StringValue(e.Detail) != `{"id": 1}` {
+		t.Errorf("got %v", e)
+	}
+	if sl.eventID != "ev-1" || sl.invokedType != "Event" {
+		t.Errorf("got %s %s", sl.eventID, sl.invokedType)
+	}
+
+	api.failed = true
+	if err := sl.putEvent(context.Background(), api); err == nil || !strings.Contains(err.Error(), "InternalFailure: try again") {
+		t.Errorf("a failed entry must be an error, got %v", err)
+	}
+}
+
+// quietLogs has no log stream
+type quietLogs struct{ fakeLogs }
+
+func (quietLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	return nil
+}
+
+func (quietLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	fn(&cloudwatchlogs.DescribeLogStreamsOutput{}, true)
+	return nil
+}
+
+func TestLogTailEventBridgeNoStart(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := &AWSServerless{
+		funcName:    "orders-fn",
+		startTime:   time.Now(),
+		logClient:   quietLogs{},
+		emitter:     em,
+		bus:         newBus(),
+		summary:     newSummaryBuilder(),
+		phases:      newPhaseTracker(time.Now()),
+		limits:      Limits{PollInterval: 10 * time.Millisecond},
+		via:         viaEventBridge,
+		eventBridge: &eventBridgeTarget{bus: "default", source: "orders.api", detailType: "OrderPlaced", startTimeout: 50 * time.Millisecond},
+		eventID:     "ev-1",
+	}
+	done := make(chan error, 1)
+	go func() { done <- sl.logTail(context.Background(), "/aws/lambda/orders-fn") }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "rule may not have matched source \"orders.api\" and detail-type \"OrderPlaced\"") {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tail does not give up without START")
+	}
+}
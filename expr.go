@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a small expression evaluated against a JSON document, ex:
+//
+//	.retry == true
+//	.status != "ok" && .count >= 3
+//	!(.items[0].ready)
+//
+// A path starts with a dot and selects a value of the document. A missing path is null.
+// Operators are ==, !=, <, <=, >, >=, &&, || and !.
+type expr struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(doc interface{}) (interface{}, error)
+}
+
+// parseExpr compiles the expression
+func parseExpr(src string) (*expr, error) {
+	p := &exprParser{src: src}
+	if err := p.tokenize(); err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("expression %q: unexpected %q", src, p.tokens[p.pos].text)
+	}
+	return &expr{src: src, root: node}, nil
+}
+
+// evalJSON evaluates the expression against the JSON document as a predicate
+func (e *expr) evalJSON(buf []byte) (bool, error) {
+	var doc interface{}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		return false, fmt.Errorf("expression %q: document is not JSON: %w", e.src, err)
+	}
+	return e.evalBool(doc)
+}
+
+// evalBool evaluates the expression against the decoded JSON document as a predicate
+func (e *expr) evalBool(doc interface{}) (bool, error) {
+	v, err := e.root.eval(doc)
+	if err != nil {
+		return false, fmt.Errorf("expression %q: %w", e.src, err)
+	}
+	return truthy(v), nil
+}
+
+func (e *expr) String() string {
+	return e.src
+}
+
+// truthy returns false for null, false, 0 and ""
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	}
+	return true
+}
+
+type tokenKind int
+
+const (
+	tokenPath tokenKind = iota
+	tokenLiteral
+	tokenOp
+)
+
+type exprToken struct {
+	kind  tokenKind
+	text  string
+	value interface{} // literal value or path segments
+}
+
+type exprParser struct {
+	src    string
+	tokens []exprToken
+	pos    int
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func (p *exprParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '.':
+			j := i + 1
+			for j < len(s) && (isIdentChar(s[j]) || s[j] == '.' || s[j] == '[' || s[j] == ']') {
+				j++
+			}
+			segs, err := parsePathSegments(s[i:j])
+			if err != nil {
+				return err
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenPath, text: s[i:j], value: segs})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("unterminated string")
+			}
+			var v string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &v); err != nil {
+				return fmt.Errorf("invalid string %s", s[i:j+1])
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenLiteral, text: s[i : j+1], value: v})
+			i = j + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' || s[j] == '+' || s[j] == '-') {
+				j++
+			}
+			f, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %s", s[i:j])
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenLiteral, text: s[i:j], value: f})
+			i = j
+		case isIdentChar(s[i]):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			word := s[i:j]
+			var v interface{}
+			switch word {
+			case "true":
+				v = true
+			case "false":
+				v = false
+			case "null":
+				v = nil
+			default:
+				return fmt.Errorf("unknown word %q, paths start with a dot", word)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenLiteral, text: word, value: v})
+			i = j
+		default:
+			found := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(s[i:], op) {
+					p.tokens = append(p.tokens, exprToken{kind: tokenOp, text: op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("unexpected %q", s[i])
+			}
+		}
+	}
+	return nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parsePathSegments parses ".a.b[0]" into ["a", "b", 0]
+func parsePathSegments(path string) ([]interface{}, error) {
+	var segs []interface{}
+	rest := path
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			j := 1
+			for j < len(rest) && isIdentChar(rest[j]) {
+				j++
+			}
+			if j > 1 {
+				segs = append(segs, rest[1:j])
+			} else if len(rest) > 1 && rest[1] != '[' {
+				return nil, fmt.Errorf("invalid path %s", path)
+			}
+			rest = rest[j:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %s", path)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index in path %s", path)
+			}
+			segs = append(segs, n)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+	}
+	return segs, nil
+}
+
+func (p *exprParser) peekOp(ops ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOp {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") != "" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") != "" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peekOp("!") != "" {
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peekOp("==", "!=", "<=", ">=", "<", ">"); op != "" {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenPath:
+		return &pathNode{segs: t.value.([]interface{})}, nil
+	case tokenLiteral:
+		return &literalNode{t.value}, nil
+	}
+	if t.text == "(" {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekOp(")") == "" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+type literalNode struct{ value interface{} }
+
+func (n *literalNode) eval(doc interface{}) (interface{}, error) { return n.value, nil }
+
+type pathNode struct{ segs []interface{} }
+
+func (n *pathNode) eval(doc interface{}) (interface{}, error) {
+	cur := doc
+	for _, seg := range n.segs {
+		switch s := seg.(type) {
+		case string:
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			cur = m[s]
+		case int:
+			a, ok := cur.([]interface{})
+			if !ok || s >= len(a) {
+				return nil, nil
+			}
+			cur = a[s]
+		}
+	}
+	return cur, nil
+}
+
+type notNode struct{ n exprNode }
+
+func (n *notNode) eval(doc interface{}) (interface{}, error) {
+	v, err := n.n.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *logicalNode) eval(doc interface{}) (interface{}, error) {
+	l, err := n.left.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" && !truthy(l) {
+		return false, nil
+	}
+	if n.op == "||" && truthy(l) {
+		return true, nil
+	}
+	r, err := n.right.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(r), nil
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *compareNode) eval(doc interface{}) (interface{}, error) {
+	l, err := n.left.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	}
+
+	var cmp int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can not compare %v %s %v", l, n.op, r)
+		}
+		cmp = compareFloat(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("can not compare %v %s %v", l, n.op, r)
+		}
+		cmp = strings.Compare(lv, rv)
+	default:
+		return nil, fmt.Errorf("can not compare %v %s %v", l, n.op, r)
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	doc := []byte(`{"retry": true, "status": "ok", "count": 3, "items": [{"ready": false}, {"ready": true}], "empty": ""}`)
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{".retry == true", true},
+		{".retry", true},
+		{"!.retry", false},
+		{`.status == "ok"`, true},
+		{`.status != "ok"`, false},
+		{".count >= 3", true},
+		{".count > 3", false},
+		{".count < 3.5", true},
+		{`.status < "pk"`, true},
+		{".items[0].ready", false},
+		{".items[1].ready == true", true},
+		{".items[5].ready == null", true},
+		{".missing == null", true},
+		{".missing", false},
+		{".empty", false},
+		{`.count == 3 && .status == "ok"`, true},
+		{`.count == 4 || .status == "ok"`, true},
+		{`!(.count == 4 || .status == "ng")`, true},
+		{`.items == null`, false},
+		{`-1 < .count`, true},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %s", tt.src, err)
+			continue
+		}
+		got, err := e.evalJSON(doc)
+		if err != nil {
+			t.Errorf("%s: %s", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v", tt.src, got)
+		}
+	}
+}
+
+func TestExprParseError(t *testing.T) {
+	for _, src := range []string{"", "retry == true", ".a ==", "(.a", ".a == \"x", ".a $ 1", ".a[x]", ".a )"} {
+		if _, err := parseExpr(src); err == nil {
+			t.Errorf("%q: error expected", src)
+		}
+	}
+}
+
+func TestExprEvalError(t *testing.T) {
+	e, err := parseExpr(".count > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.evalJSON([]byte(`{"count": "three"}`)); err == nil {
+		t.Error("type mismatch should be an error")
+	}
+	if _, err := e.evalJSON([]byte(`not json`)); err == nil {
+		t.Error("non JSON should be an error")
+	}
+}
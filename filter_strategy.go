@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const (
+	// maxFilterStreams is the max number of LogStreamNames of FilterLogEvents
+	maxFilterStreams = 100
+	// maxFilterWindow is the longest time window a poll filters at once, ex: after a long throttling stall
+	maxFilterWindow = 5 * time.Minute
+	// filterWindowStep is the length of a sub-window of a longer window
+	filterWindowStep = time.Minute
+	// defaultStreamPrefixMargin is how long after UTC midnight a run also filters the streams of the previous day
+	defaultStreamPrefixMargin = 10 * time.Minute
+	// maxStreamPrefixes is the max number of dates filtered by prefix, more dates filter the whole group
+	maxStreamPrefixes = 3
+	// streamDateLayout is the date which Lambda puts at the head of a log stream name, in UTC
+	streamDateLayout = "2006/01/02/"
+)
+
+// filterWindow is a time window of FilterLogEvents in milliseconds. Both ends are inclusive,
+// and End is 0 for the window which is open to the present.
+type filterWindow struct {
+	Start int64
+	End   int64
+}
+
+// splitWindow returns the windows which cover from start to now. A window longer than max is split
+// into sub-windows of step, and only the last one is open, so the watermark can be checkpointed
+// at the end of each closed one.
+func splitWindow(start, now int64, max, step time.Duration) []filterWindow {
+	maxMs := int64(max / time.Millisecond)
+	stepMs := int64(step / time.Millisecond)
+	if now-start <= maxMs || stepMs <= 0 {
+		return []filterWindow{{Start: start}}
+	}
+	var windows []filterWindow
+	for ; now-start > stepMs; start += stepMs {
+		windows = append(windows, filterWindow{Start: start, End: start + stepMs - 1})
+	}
+	return append(windows, filterWindow{Start: start})
+}
+
+// filterStrategy is how FilterLogEvents selects the log events
+type filterStrategy string
+
+const (
+	// strategyStreams filters the log streams updated since the last poll
+	strategyStreams filterStrategy = "log-streams"
+	// strategyGroup filters the whole log group by the stream name prefixes of the dates and our request id,
+	// used when too many log streams are updated
+	strategyGroup filterStrategy = "log-group"
+)
+
+// streamDatePrefixes returns the date prefixes of the log streams which may have our events, the newest first.
+// Lambda names a stream by the UTC date its execution environment started, so an environment started before
+// midnight keeps logging under the previous date. The dates are today's, the previous date when the run started
+// within margin after midnight or before it, and the dates of the updated streams. It returns nil when there are
+// more than maxStreamPrefixes dates, and the whole group must be filtered.
+func streamDatePrefixes(streams []*string, runStart, now time.Time, margin time.Duration) []string {
+	today := now.UTC().Format(streamDateLayout)
+	dates := map[string]bool{today: true}
+	for d := runStart.Add(-margin).UTC(); d.Format(streamDateLayout) < today; d = d.AddDate(0, 0, 1) {
+		dates[d.Format(streamDateLayout)] = true
+		if len(dates) > maxStreamPrefixes {
+			return nil
+		}
+	}
+	for _, s := range streams {
+		name := aws.StringValue(s)
+		if len(name) < len(streamDateLayout) {
+			continue
+		}
+		prefix := name[:len(streamDateLayout)]
+		if _, err := time.Parse(streamDateLayout, prefix); err != nil || prefix > today {
+			continue
+		}
+		dates[prefix] = true
+	}
+	if len(dates) > maxStreamPrefixes {
+		return nil
+	}
+	ret := make([]string, 0, len(dates))
+	for d := range dates {
+		ret = append(ret, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ret)))
+	return ret
+}
+
+// buildFilterInputs returns the FilterLogEvents inputs of a poll cycle and its strategy. The whole group is
+// filtered by an input for each of prefixes, or by one input without a prefix when prefixes is empty.
+func buildFilterInputs(logGroupName string, streams []*string, startTime int64, requestID string, prefixes []string) ([]*cloudwatchlogs.FilterLogEventsInput, filterStrategy) {
+	newInput := func() *cloudwatchlogs.FilterLogEventsInput {
+		return &cloudwatchlogs.FilterLogEventsInput{
+			StartTime:    aws.Int64(startTime),
+			LogGroupName: aws.String(logGroupName),
+		}
+	}
+	if len(streams) <= maxFilterStreams {
+		input := newInput()
+		input.LogStreamNames = streams
+		return []*cloudwatchlogs.FilterLogEventsInput{input}, strategyStreams
+	}
+
+	var inputs []*cloudwatchlogs.FilterLogEventsInput
+	for _, p := range prefixes {
+		input := newInput()
+		input.LogStreamNamePrefix = aws.String(p)
+		inputs = append(inputs, input)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, newInput())
+	}
+	if requestID != "" {
+		for _, input := range inputs {
+			input.FilterPattern = aws.String(fmt.Sprintf("%q", requestID))
+		}
+	}
+	return inputs, strategyGroup
+}
+
+// formatPrefixes returns the prefixes for a log line
+func formatPrefixes(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return "no prefix"
+	}
+	return strings.Join(prefixes, ", ")
+}
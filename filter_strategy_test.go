@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func streamNames(date string, n int) []*string {
+	ret := make([]*string, n)
+	for i := range ret {
+		ret[i] = aws.String(fmt.Sprintf("%s[$LATEST]%032d", date, i))
+	}
+	return ret
+}
+
+func TestBuildFilterInputs(t *testing.T) {
+	streams := streamNames("2020/12/01/", maxFilterStreams+1)
+	inputs, s := buildFilterInputs("/aws/lambda/f", streams[:maxFilterStreams], 1000, "req", []string{"2020/12/01/"})
+	if s != strategyStreams || len(inputs) != 1 || len(inputs[0].LogStreamNames) != maxFilterStreams || inputs[0].LogStreamNamePrefix != nil || inputs[0].FilterPattern != nil {
+		t.Errorf("got %s %+v", s, inputs)
+	}
+
+	inputs, s = buildFilterInputs("/aws/lambda/f", streams, 1000, "req", []string{"2020/12/01/", "2020/11/30/"})
+	if s != strategyGroup || len(inputs) != 2 {
+		t.Fatalf("got %s %+v", s, inputs)
+	}
+	for i, want := range []string{"2020/12/01/", "2020/11/30/"} {
+		input := inputs[i]
+		if p := aws.StringValue(input.LogStreamNamePrefix); p != want || input.LogStreamNames != nil {
+			t.Errorf("got %s, want %s", p, want)
+		}
+		if p := aws.StringValue(input.FilterPattern); p != `"req"` {
+			t.Errorf("got %s", p)
+		}
+		if aws.Int64Value(input.StartTime) != 1000 || aws.StringValue(input.LogGroupName) != "/aws/lambda/f" {
+			t.Errorf("got %+v", input)
+		}
+	}
+
+	// too many dates filter the whole group, and the request id is not known yet
+	inputs, _ = buildFilterInputs("/aws/lambda/f", streams, 1000, "", nil)
+	if len(inputs) != 1 || inputs[0].LogStreamNamePrefix != nil || inputs[0].FilterPattern != nil {
+		t.Errorf("got %+v", inputs)
+	}
+}
+
+func TestStreamDatePrefixes(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	afterMidnight := time.Date(2020, 12, 1, 0, 0, 30, 0, time.UTC)
+	tests := []struct {
+		name     string
+		streams  []*string
+		runStart time.Time
+		now      time.Time
+		want     string
+	}{
+		{"day", streamNames("2020/12/01/", 2), time.Date(2020, 12, 1, 3, 0, 0, 0, time.UTC), time.Date(2020, 12, 1, 3, 1, 0, 0, time.UTC), "2020/12/01/"},
+		{"date in UTC", nil, time.Date(2020, 12, 1, 23, 0, 0, 0, jst), time.Date(2020, 12, 1, 23, 1, 0, 0, jst), "2020/12/01/"},
+		{"within the margin", nil, afterMidnight.Add(-20 * time.Second), afterMidnight, "2020/12/01/,2020/11/30/"},
+		{"straddles midnight", nil, time.Date(2020, 11, 30, 23, 0, 0, 0, time.UTC), afterMidnight, "2020/12/01/,2020/11/30/"},
+		{"older environment", append(streamNames("2020/12/01/", 2), aws.String("2020/11/28/[3]abc")), time.Date(2020, 12, 1, 3, 0, 0, 0, time.UTC), time.Date(2020, 12, 1, 3, 1, 0, 0, time.UTC), "2020/12/01/,2020/11/28/"},
+		{"unknown names", []*string{aws.String("custom"), aws.String("2020/13/01/x"), aws.String("2020/12/02/[1]future")}, afterMidnight.Add(time.Hour), afterMidnight.Add(time.Hour), "2020/12/01/"},
+		{"too many dates", []*string{aws.String("2020/11/01/[1]a"), aws.String("2020/11/02/[1]a")}, afterMidnight.Add(-time.Second), afterMidnight, ""},
+		{"long run", nil, afterMidnight.AddDate(0, 0, -5), afterMidnight, ""},
+	}
+	for _, tt := range tests {
+		got := strings.Join(streamDatePrefixes(tt.streams, tt.runStart, tt.now, defaultStreamPrefixMargin), ",")
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUseFilterStrategy(t *testing.T) {
+	sl := &AWSServerless{}
+	switched := []bool{
+		sl.useFilterStrategy(strategyStreams),
+		sl.useFilterStrategy(strategyStreams),
+		sl.useFilterStrategy(strategyGroup),
+		sl.useFilterStrategy(strategyStreams),
+	}
+	if fmt.Sprint(switched) != "[true false true true]" {
+		t.Errorf("got %v", switched)
+	}
+	if len(sl.filterStrategies) != 2 || sl.filterStrategies[0] != strategyStreams || sl.filterStrategies[1] != strategyGroup {
+		t.Errorf("got %v", sl.filterStrategies)
+	}
+}
+
+func TestSplitWindow(t *testing.T) {
+	minute := int64(60 * 1000)
+	if got := splitWindow(0, 5*minute, maxFilterWindow, filterWindowStep); len(got) != 1 || got[0] != (filterWindow{Start: 0}) {
+		t.Errorf("a short window must not be split, got %v", got)
+	}
+
+	got := splitWindow(1000, 1000+12*minute+500, maxFilterWindow, filterWindowStep)
+	if len(got) != 13 {
+		t.Fatalf("got %d windows, %v", len(got), got)
+	}
+	next := int64(1000)
+	for i, w := range got {
+		if w.Start != next {
+			t.Errorf("window %d starts at %d, want %d", i, w.Start, next)
+		}
+		if i < len(got)-1 && w.End != w.Start+minute-1 {
+			t.Errorf("window %d ends at %d", i, w.End)
+		}
+		next = w.End + 1
+	}
+	if last := got[len(got)-1]; last.End != 0 || last.Start != 1000+12*minute {
+		t.Errorf("the last window must be open, got %v", last)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultFleetSince        = 10 * time.Minute
+	defaultFleetMaxFunctions = 20
+	defaultFleetPoll         = 2 * time.Second
+	defaultFleetMaxTPS       = 5           // the FilterLogEvents quota of an account in a region
+	fleetErrorWindow         = time.Minute // of the rolling error counts of the status line
+	fleetStatusInterval      = time.Second
+)
+
+// fleetColors are the ANSI colors the tags of the functions take in turn
+var fleetColors = []string{"36", "32", "33", "35", "34", "96", "92", "93", "95", "94"}
+
+// matchFleet returns the names of the functions with the prefix. More than max is an error which
+// names some of them, so that the prefix can be narrowed.
+func matchFleet(funcs []functionInfo, prefix string, max int) ([]string, error) {
+	var names []string
+	for _, f := range funcs {
+		if strings.HasPrefix(f.Name, prefix) {
+			names = append(names, f.Name)
+		}
+	}
+	switch {
+	case len(names) == 0:
+		return nil, fmt.Errorf("no function matches -func-prefix %s", prefix)
+	case len(names) > max:
+		shown := names
+		if len(shown) > 3 {
+			shown = shown[:3]
+		}
+		return nil, fmt.Errorf("-func-prefix %s matches %d functions (%s, ...), more than -max-functions %d. narrow the prefix or raise -max-functions",
+			prefix, len(names), strings.Join(shown, ", "), max)
+	}
+	return names, nil
+}
+
+// fleetMember is a function of the fleet and what its tail has seen
+type fleetMember struct {
+	name     string
+	logGroup string
+	tag      string // put before its lines on the console
+	lastSeen int64
+	current  map[string]string // log stream to its current request
+
+	events     int
+	errors     int
+	errorTimes []int64 // timestamps of the error lines of the rolling window
+	missing    bool    // the log group does not exist, the function has not logged yet
+	failed     error   // why its tail stopped
+}
+
+// fleetWatch tails the log groups of many functions at once through one emitter. The calls of
+// all the tails share a rate and the cool-downs of the throttling, as they share the TPS of the account.
+type fleetWatch struct {
+	logs     logsAPI
+	emitter  *emitter
+	throttle *throttleController
+	tokens   <-chan time.Time // a FilterLogEvents call takes one
+	poll     time.Duration
+	json     bool
+	status   io.Writer // the status line is drawn on it, nil without a terminal
+	width    int       // of the status line
+	now      func() time.Time
+
+	mu          sync.Mutex // of the members and the console
+	members     []*fleetMember
+	statusDrawn bool
+}
+
+// newFleetWatch returns a watch of the functions since the time. The tags are padded to align
+// the lines, and colored when color is set.
+func newFleetWatch(logs logsAPI, em *emitter, names []string, since time.Time, color bool) *fleetWatch {
+	w := &fleetWatch{
+		logs:     logs,
+		emitter:  em,
+		throttle: newThrottleController(time.Now, defaultLimits),
+		poll:     defaultFleetPoll,
+		now:      time.Now,
+	}
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for i, name := range names {
+		tag := fmt.Sprintf("%-*s │ ", width, name)
+		if color {
+			tag = "\x1b[" + fleetColors[i%len(fleetColors)] + "m" + tag + "\x1b[0m"
+		}
+		w.members = append(w.members, &fleetMember{
+			name:     name,
+			logGroup: FunctionRef{Name: name}.LogGroup(),
+			tag:      tag,
+			lastSeen: aws.TimeUnixMilli(since),
+			current:  make(map[string]string),
+		})
+	}
+	return w
+}
+
+// run tails every function until ctx is done
+func (w *fleetWatch) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range w.members {
+		wg.Add(1)
+		go func(m *fleetMember) {
+			defer wg.Done()
+			w.tail(ctx, m)
+		}(m)
+	}
+	if w.status != nil {
+		ticker := time.NewTicker(fleetStatusInterval)
+	loop:
+		for {
+			w.drawStatus()
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-ticker.C:
+			}
+		}
+		ticker.Stop()
+	}
+	wg.Wait()
+	w.mu.Lock()
+	w.clearStatus()
+	w.mu.Unlock()
+}
+
+// tail polls the log group of the function until ctx is done or a call fails for good
+func (w *fleetWatch) tail(ctx context.Context, m *fleetMember) {
+	for {
+		if err := w.pollOnce(ctx, m); err != nil {
+			w.mu.Lock()
+			m.failed = err
+			w.clearStatus()
+			w.mu.Unlock()
+			logger.Warnf("%s, the tail of %s stops", err, m.name)
+			return
+		}
+		if sleepContext(ctx, w.poll) != nil {
+			return
+		}
+	}
+}
+
+// pollOnce prints the events of the function since the last poll. Throttling is retried by the
+// next poll after the cool-down, and a log group which does not exist yet too.
+func (w *fleetWatch) pollOnce(ctx context.Context, m *fleetMember) error {
+	if w.throttle.sleep(ctx, opFetchEvents) != nil {
+		return nil
+	}
+	if w.tokens != nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.tokens:
+		}
+	}
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(m.logGroup),
+		StartTime:    aws.Int64(m.lastSeen),
+	}
+	lastSeen := m.lastSeen
+	fn := func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+		for _, event := range res.Events {
+			message := aws.StringValue(event.Message)
+			timestamp := aws.Int64Value(event.Timestamp)
+			// the ids of the events are unique in a log group
+			if !w.emitter.isNew(m.name+"/"+aws.StringValue(event.EventId), timestamp, message) {
+				continue
+			}
+			stream := aws.StringValue(event.LogStreamName)
+			if kind, id, _ := parseLifecycle(message); kind == lifecycleStart {
+				m.current[stream] = id
+			}
+			w.print(m, message, m.current[stream], timestamp)
+			if timestamp > lastSeen {
+				lastSeen = timestamp
+			}
+		}
+		return true
+	}
+	err := w.logs.FilterLogEventsPagesWithContext(ctx, input, fn)
+	w.throttle.observe(opFetchEvents, err)
+	m.lastSeen = lastSeen
+	var awsErr awserr.Error
+	switch {
+	case err == nil, ctx.Err() != nil, isThrottling(err):
+		return nil
+	case errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException:
+		w.mu.Lock()
+		first := !m.missing
+		m.missing = true
+		w.mu.Unlock()
+		if first {
+			logger.Infof("%s does not exist yet, %s has not logged", m.logGroup, m.name)
+		}
+		return nil
+	}
+	return fmt.Errorf("FilterLogEventsPages, %s: %w", m.logGroup, err)
+}
+
+// print prints a line of the function and counts it
+func (w *fleetWatch) print(m *fleetMember, message, requestID string, timestamp int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m.events++
+	m.missing = false
+	if errorLineRe.MatchString(message) || taskTimeoutRe.MatchString(message) {
+		m.errors++
+		m.errorTimes = append(m.errorTimes, timestamp)
+	}
+	w.clearStatus()
+	if w.json {
+		w.emitter.emit(message, recordFields(schema.LogLine{FunctionName: m.name, RequestID: requestID})...)
+		return
+	}
+	w.emitter.emit(m.tag+message, recordFields(schema.LogLine{RequestID: requestID})...)
+}
+
+// recentErrors returns the error lines of the function in the rolling window. w.mu must be held.
+func (w *fleetWatch) recentErrors(m *fleetMember) int {
+	from := aws.TimeUnixMilli(w.now().Add(-fleetErrorWindow))
+	kept := m.errorTimes[:0]
+	for _, ts := range m.errorTimes {
+		if ts >= from {
+			kept = append(kept, ts)
+		}
+	}
+	m.errorTimes = kept
+	return len(kept)
+}
+
+// statusLine returns the line of the rolling error counts, the functions with most errors first.
+// w.mu must be held.
+func (w *fleetWatch) statusLine() string {
+	type count struct {
+		name   string
+		errors int
+	}
+	var counts []count
+	events := 0
+	for _, m := range w.members {
+		events += m.events
+		if n := w.recentErrors(m); n > 0 {
+			counts = append(counts, count{m.name, n})
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].errors > counts[j].errors })
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d functions, %s, errors in %s: ", len(w.members), plural(events, "line"), fleetErrorWindow)
+	if len(counts) == 0 {
+		b.WriteString("none")
+	}
+	for i, c := range counts {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %d", c.name, c.errors)
+	}
+	line := b.String()
+	if w.width > 1 && len([]rune(line)) >= w.width {
+		line = string([]rune(line)[:w.width-2]) + "…"
+	}
+	return line
+}
+
+// drawStatus redraws the status line below the lines
+func (w *fleetWatch) drawStatus() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprint(w.status, "\r\x1b[K"+w.statusLine())
+	w.statusDrawn = true
+}
+
+// clearStatus erases the status line before a line is printed. w.mu must be held.
+func (w *fleetWatch) clearStatus() {
+	if w.statusDrawn {
+		fmt.Fprint(w.status, "\r\x1b[K")
+		w.statusDrawn = false
+	}
+}
+
+// summary returns what the tail of each function has seen
+func (w *fleetWatch) summary(prefix string, since time.Duration) schema.FleetSummary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := schema.FleetSummary{SchemaVersion: schema.FleetSummaryVersion, Prefix: prefix, Since: since}
+	for _, m := range w.members {
+		f := schema.FleetFunction{FunctionName: m.name, LogGroup: m.logGroup, Events: m.events, Errors: m.errors}
+		switch {
+		case m.failed != nil:
+			f.Error = m.failed.Error()
+		case m.missing:
+			f.Error = "the log group does not exist"
+		}
+		s.Functions = append(s.Functions, f)
+	}
+	return s
+}
+
+// printFleetSummary prints the events and the errors of each function
+func printFleetSummary(out io.Writer, s schema.FleetSummary) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "\tFUNCTION\tEVENTS\tERRORS\t")
+	for _, f := range s.Functions {
+		mark := ""
+		if f.Errors > 0 {
+			mark = "!"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", mark, f.FunctionName, f.Events, f.Errors, f.Error)
+	}
+}
+
+// runFleetLogs runs the fleet-logs subcommand, which tails the functions of a prefix at once until interrupted
+func runFleetLogs(args []string) error {
+	var prefix string
+	var region string
+	var since time.Duration
+	var maxFuncs int
+	var poll time.Duration
+	var maxTPS int
+	var json bool
+
+	fs := flag.NewFlagSet("fleet-logs", flag.ContinueOnError)
+	fs.StringVar(&prefix, "func-prefix", "", "tail every function whose name starts with the prefix")
+	fs.StringVar(&region, "region", "", "AWS region")
+	fs.DurationVar(&since, "since", defaultFleetSince, "print the logs from this long ago onwards")
+	fs.IntVar(&maxFuncs, "max-functions", defaultFleetMaxFunctions, "most functions tailed. a prefix which matches more is an error")
+	fs.DurationVar(&poll, "poll-interval", defaultFleetPoll, "interval of the polls of the log group of each function")
+	fs.IntVar(&maxTPS, "max-tps", defaultFleetMaxTPS, "most FilterLogEvents calls a second of all the functions, which share the quota of the account")
+	fs.BoolVar(&json, "json", false, "enable JSON log format")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{json: json})
+	defer logger.Sync()
+
+	if prefix == "" {
+		return &configError{fmt.Errorf("-func-prefix is required")}
+	}
+	if maxFuncs <= 0 || maxTPS <= 0 || poll <= 0 || since < 0 {
+		return &configError{fmt.Errorf("-max-functions, -max-tps and -poll-interval must be positive")}
+	}
+	awsOpts, err := newAWSSessionOptions(region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := cancelOnSignal(ctx, cancel)
+	defer stop()
+
+	funcs, err := listFunctions(ctx, lambda.New(sess))
+	if err != nil {
+		return err
+	}
+	names, err := matchFleet(funcs, prefix, maxFuncs)
+	if err != nil {
+		return &configError{err}
+	}
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		return err
+	}
+	_, stdoutTerminal := terminalWidth(os.Stdout)
+	w := newFleetWatch(cloudwatchlogs.New(sess), em, names, time.Now().Add(-since), stdoutTerminal && !json)
+	w.poll, w.json = poll, json
+	tokens := time.NewTicker(time.Second / time.Duration(maxTPS))
+	defer tokens.Stop()
+	w.tokens = tokens.C
+	if width, ok := terminalWidth(os.Stderr); ok && !json {
+		w.status, w.width = os.Stderr, width
+	}
+	logger.Infof("tailing %s: %s", plural(len(names), "function"), strings.Join(names, ", "))
+
+	w.run(ctx)
+
+	summary := w.summary(prefix, since)
+	if n := w.throttle.throttled(); n > 0 {
+		logger.Infof("%s throttled, waited %s in cool-downs", plural(n, "call"), w.throttle.waited().Round(time.Millisecond))
+	}
+	if json {
+		logger.Infow("summary", recordFields(summary)...)
+		return nil
+	}
+	printFleetSummary(os.Stdout, summary)
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestMatchFleet(t *testing.T) {
+	funcs := []functionInfo{{Name: "billing-a"}, {Name: "orders-create"}, {Name: "orders-pay"}, {Name: "orders-ship"}, {Name: "orders-tax"}}
+
+	names, err := matchFleet(funcs, "orders-", 20)
+	if err != nil || strings.Join(names, ",") != "orders-create,orders-pay,orders-ship,orders-tax" {
+		t.Errorf("got %v %v", names, err)
+	}
+	if _, err := matchFleet(funcs, "users-", 20); err == nil || !strings.Contains(err.Error(), "no function matches") {
+		t.Errorf("got %v", err)
+	}
+	_, err = matchFleet(funcs, "orders-", 3)
+	if err == nil || !strings.Contains(err.Error(), "matches 4 functions (orders-create, orders-pay, orders-ship, ...), more than -max-functions 3") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := matchFleet(funcs, "orders-", 1); err == nil {
+		t.Error("more than the cap must fail")
+	}
+}
+
+// fleetLogs serves the events of each log group, throttles the first call and has no group of missing
+type fleetLogs struct {
+	logsAPI
+	mu        sync.Mutex
+	events    map[string][]*cloudwatchlogs.FilteredLogEvent
+	missing   string
+	throttled bool
+}
+
+func (l *fleetLogs) add(group, id, stream, msg string, ts int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[group] = append(l.events[group], &cloudwatchlogs.FilteredLogEvent{
+		EventId: aws.String(id), LogStreamName: aws.String(stream), Message: aws.String(msg), Timestamp: aws.Int64(ts),
+	})
+}
+
+func (l *fleetLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.mu.Lock()
+	group := aws.StringValue(input.LogGroupName)
+	if group == l.missing {
+		l.mu.Unlock()
+		return awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+	if !l.throttled {
+		l.throttled = true
+		l.mu.Unlock()
+		return awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+	var out []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events[group] {
+		if aws.Int64Value(e.Timestamp) >= aws.Int64Value(input.StartTime) {
+			out = append(out, e)
+		}
+	}
+	l.mu.Unlock()
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: out}, true)
+	return nil
+}
+
+func TestFleetWatch(t *testing.T) {
+	logs := setTestLogger(t)
+	em, lines := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	now := time.Now()
+	start := aws.TimeUnixMilli(now)
+	fake := &fleetLogs{events: make(map[string][]*cloudwatchlogs.FilteredLogEvent), missing: "/aws/lambda/orders-tax"}
+	fake.add("/aws/lambda/orders-pay", "1", "s1", "START RequestId: r-1 Version: $LATEST", start)
+	fake.add("/aws/lambda/orders-pay", "2", "s1", "[ERROR] card declined", start+1)
+	fake.add("/aws/lambda/orders-create", "1", "s2", "created", start)
+	fake.add("/aws/lambda/orders-create", "3", "s2", "too old", start-time.Minute.Milliseconds())
+
+	w := newFleetWatch(fake, em, []string{"orders-create", "orders-pay", "orders-tax"}, now.Add(-time.Second), false)
+	w.throttle = newThrottleController(time.Now, Limits{ThrottleCoolDown: time.Millisecond, MaxCoolDown: 10 * time.Millisecond})
+	w.poll = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+	deadline := time.After(5 * time.Second)
+	for lines.Len() < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("got %d lines", lines.Len())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+
+	var got []string
+	for _, e := range lines.All() {
+		got = append(got, e.Message)
+		if strings.Contains(e.Message, "card declined") && e.ContextMap()["request_id"] != "r-1" {
+			t.Errorf("request id of %q: %v", e.Message, e.ContextMap())
+		}
+	}
+	joined := strings.Join(got, "\n")
+	for _, want := range []string{"orders-pay    │ [ERROR] card declined", "orders-create │ created"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("no %q in\n%s", want, joined)
+		}
+	}
+	if lines.Len() != 3 || strings.Contains(joined, "too old") {
+		t.Errorf("the lines must be printed once from -since:\n%s", joined)
+	}
+	if logs.FilterMessageSnippet("does not exist yet").Len() != 1 {
+		t.Errorf("a missing group must be logged once: %v", logs.All())
+	}
+	if w.throttle.throttled() != 1 {
+		t.Errorf("throttled %d", w.throttle.throttled())
+	}
+
+	s := w.summary("orders-", 10*time.Minute)
+	want := []string{"orders-create 1 0 ", "orders-pay 2 1 ", "orders-tax 0 0 the log group does not exist"}
+	for i, f := range s.Functions {
+		if got := fmt.Sprintf("%s %d %d %s", f.FunctionName, f.Events, f.Errors, f.Error); got != want[i] {
+			t.Errorf("%d: got %q, want %q", i, got, want[i])
+		}
+	}
+	var out bytes.Buffer
+	printFleetSummary(&out, s)
+	if !strings.Contains(out.String(), "!  orders-pay     2       1") {
+		t.Errorf("got\n%s", out.String())
+	}
+}
+
+func TestFleetStatusLine(t *testing.T) {
+	em, _ := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := newFleetWatch(nil, em, []string{"orders-create", "orders-pay"}, now, true)
+	w.now = func() time.Time { return now }
+	var status bytes.Buffer
+	w.status = &status
+
+	if got := w.statusLine(); got != "2 functions, 0 lines, errors in 1m0s: none" {
+		t.Errorf("got %q", got)
+	}
+	ms := aws.TimeUnixMilli(now)
+	w.print(w.members[0], "ERROR a", "", ms-2*time.Minute.Milliseconds())
+	w.print(w.members[0], "ERROR b", "", ms-1000)
+	w.print(w.members[1], "Task timed out after 3.00 seconds", "", ms-1000)
+	w.print(w.members[1], `{"level":"error"}`, "", ms)
+	if got := w.statusLine(); got != "2 functions, 4 lines, errors in 1m0s: orders-pay 2, orders-create 1" {
+		t.Errorf("got %q", got)
+	}
+	now = now.Add(time.Minute)
+	if got := w.statusLine(); got != "2 functions, 4 lines, errors in 1m0s: orders-pay 1" {
+		t.Errorf("the window must roll, got %q", got)
+	}
+	w.width = 20
+	if got := w.statusLine(); len([]rune(got)) != 19 || !strings.HasSuffix(got, "…") {
+		t.Errorf("got %q", got)
+	}
+
+	w.drawStatus()
+	w.print(w.members[0], "hello", "", ms)
+	if got := status.String(); !strings.HasSuffix(got, "…\r\x1b[K") {
+		t.Errorf("the status line must be cleared before a line, got %q", got)
+	}
+	if !strings.HasPrefix(w.members[1].tag, "\x1b[32m") || w.members[0].tag == w.members[1].tag {
+		t.Errorf("tags %q %q", w.members[0].tag, w.members[1].tag)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// maxSuggestions is how many similar names a function which is not found is suggested with
+const maxSuggestions = 3
+
+// functionFinder is the part of the Lambda API the check of the function uses
+type functionFinder interface {
+	functionGetter
+	ListFunctionsPagesWithContext(ctx aws.Context, input *lambda.ListFunctionsInput, fn func(*lambda.ListFunctionsOutput, bool) bool, opts ...request.Option) error
+}
+
+// checkFunction confirms by GetFunction that the function and its qualifier exist in the region, so that a
+// typo fails before the invocation with the names it may be a typo of. where tells how the region was
+// decided. The credentials may not allow GetFunction while they allow Invoke, which is only a warning.
+func checkFunction(ctx context.Context, api functionFinder, name, qualifier, region, where string) error {
+	input := &lambda.GetFunctionInput{FunctionName: aws.String(name)}
+	if qualifier != "" {
+		input.Qualifier = aws.String(qualifier)
+	}
+	_, err := api.GetFunctionWithContext(ctx, input)
+	switch {
+	case err == nil:
+		return nil
+	case isAccessDenied(err):
+		logger.Warnf("the existence of %s is not checked, GetFunction is denied: %s", name, err)
+		return nil
+	case !isResourceNotFound(err):
+		return fmt.Errorf("GetFunction, %s: %w", name, err)
+	}
+
+	if qualifier != "" {
+		if _, err := api.GetFunctionWithContext(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(name)}); err == nil {
+			return fmt.Errorf("function %s in %s has no version or alias %s", name, region, qualifier)
+		}
+	}
+	msg := fmt.Sprintf("function %s is not found in %s, %s", name, region, where)
+	names, lerr := listFunctionNames(ctx, api)
+	if lerr != nil {
+		logger.Debugf("similar names of %s are not listed: %s", name, lerr)
+	}
+	// an unqualified ARN ends with the name
+	if similar := similarNames(name[strings.LastIndexByte(name, ':')+1:], names); len(similar) > 0 {
+		msg += fmt.Sprintf("; did you mean %s?", strings.Join(similar, ", "))
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// isResourceNotFound returns true if err is ResourceNotFoundException of Lambda
+func isResourceNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException
+}
+
+// listFunctionNames returns the names of the functions in the region
+func listFunctionNames(ctx context.Context, api functionFinder) ([]string, error) {
+	var ret []string
+	err := api.ListFunctionsPagesWithContext(ctx, &lambda.ListFunctionsInput{}, func(res *lambda.ListFunctionsOutput, lastPage bool) bool {
+		for _, f := range res.Functions {
+			ret = append(ret, aws.StringValue(f.FunctionName))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListFunctions: %w", err)
+	}
+	return ret, nil
+}
+
+// similarNames returns up to maxSuggestions names which are near misses of name, the nearest first: those
+// which one of them prefixes the other, or within the edit distance of a quarter of the name (at least 2)
+func similarNames(name string, names []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	lower := strings.ToLower(name)
+	limit := len(name) / 4
+	if limit < 2 {
+		limit = 2
+	}
+	var found []candidate
+	for _, n := range names {
+		l := strings.ToLower(n)
+		d := editDistance(lower, l)
+		if d <= limit || strings.HasPrefix(l, lower) || strings.HasPrefix(lower, l) {
+			found = append(found, candidate{n, d})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].name < found[j].name
+	})
+	var ret []string
+	for i := 0; i < len(found) && i < maxSuggestions; i++ {
+		ret = append(ret, found[i].name)
+	}
+	return ret
+}
+
+// editDistance returns the Levenshtein distance of a and b in bytes, which function names are
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// regionSource tells how the region of the function was decided, for the error of a function which is not found
+func (sl *AWSServerless) regionSource() string {
+	switch {
+	case sl.ref.IsARN:
+		return "the region of the ARN"
+	case sl.discoverRegion:
+		return "the region found by -discover-region"
+	}
+	return "the region of the AWS config (AWS_REGION, AWS_DEFAULT_REGION or the profile), -discover-region finds the region which has it"
+}
+
+// planCheckFunction describes the check of the function in a plan
+func (sl *AWSServerless) planCheckFunction() ([]plannedCall, error) {
+	params := []planParam{{"FunctionName", sl.unqualifiedName()}}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	return []plannedCall{
+		{Service: "lambda", Operation: "GetFunction", Params: params, Note: "the function exists in the region, skipped by -no-preflight"},
+		{Service: "lambda", Operation: "ListFunctions", Note: "only if the function is not found, for similar names"},
+	}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// fakeFunctions has the functions by name with their qualifiers, or denies GetFunction by err
+type fakeFunctions struct {
+	functions map[string][]string
+	err       error
+	listed    int
+}
+
+func (f *fakeFunctions) GetFunctionWithContext(ctx aws.Context, input *lambda.GetFunctionInput, opts ...request.Option) (*lambda.GetFunctionOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	qualifiers, ok := f.functions[aws.StringValue(input.FunctionName)]
+	if ok && input.Qualifier != nil {
+		ok = false
+		for _, q := range qualifiers {
+			ok = ok || q == aws.StringValue(input.Qualifier)
+		}
+	}
+	if !ok {
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)
+	}
+	return &lambda.GetFunctionOutput{}, nil
+}
+
+func (f *fakeFunctions) ListFunctionsPagesWithContext(ctx aws.Context, input *lambda.ListFunctionsInput, fn func(*lambda.ListFunctionsOutput, bool) bool, opts ...request.Option) error {
+	f.listed++
+	var page []*lambda.FunctionConfiguration
+	for name := range f.functions {
+		page = append(page, &lambda.FunctionConfiguration{FunctionName: aws.String(name)})
+	}
+	fn(&lambda.ListFunctionsOutput{Functions: page}, true)
+	return nil
+}
+
+func TestCheckFunction(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeFunctions{functions: map[string][]string{
+		"orders-fn":      {"live"},
+		"orders-fn-dev":  nil,
+		"payments-fn":    nil,
+		"order-reporter": nil,
+	}}
+	where := "the region of the AWS config"
+
+	tests := []struct {
+		name      string
+		function  string
+		qualifier string
+		err       string
+	}{
+		{"found", "orders-fn", "", ""},
+		{"found alias", "orders-fn", "live", ""},
+		{"typo", "ordres-fn", "", "function ordres-fn is not found in eu-west-1, the region of the AWS config; did you mean orders-fn?"},
+		{"no alias", "orders-fn", "staging", "function orders-fn in eu-west-1 has no version or alias staging"},
+		{"nothing similar", "inventory", "", "function inventory is not found in eu-west-1, the region of the AWS config: ResourceNotFoundException"},
+		{"ARN", "arn:aws:lambda:eu-west-1:123456789012:function:payment-fn", "", "did you mean payments-fn?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkFunction(context.Background(), api, tt.function, tt.qualifier, "eu-west-1", where)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("checkFunction() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("checkFunction() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckFunctionAccessDenied(t *testing.T) {
+	logs := setTestLogger(t)
+	api := &fakeFunctions{err: awserr.New("AccessDeniedException", "not authorized to perform: lambda:GetFunction", nil)}
+	if err := checkFunction(context.Background(), api, "orders-fn", "", "eu-west-1", ""); err != nil {
+		t.Fatalf("checkFunction() error = %v, want a warning", err)
+	}
+	if api.listed != 0 {
+		t.Errorf("ListFunctions is called %d times", api.listed)
+	}
+	if logs.FilterMessageSnippet("GetFunction is denied").Len() != 1 {
+		t.Errorf("no warning of the denied GetFunction: %v", logs.All())
+	}
+
+	api.err = errors.New("connection reset")
+	if err := checkFunction(context.Background(), api, "orders-fn", "", "eu-west-1", ""); err == nil || !strings.Contains(err.Error(), "GetFunction, orders-fn") {
+		t.Errorf("checkFunction() error = %v", err)
+	}
+}
+
+func TestSimilarNames(t *testing.T) {
+	names := []string{"orders-fn", "orders-fn-dev", "orders", "billing", "ORDERS-FM", "order-fn-v2", "inventory-fn"}
+	got := similarNames("orders-fn", names)
+	want := []string{"orders-fn", "ORDERS-FM", "orders"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("similarNames() = %v, want %v", got, want)
+	}
+	if got := similarNames("xyz", names); got != nil {
+		t.Errorf("similarNames() = %v, want none", got)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"orders-fn", "ordres-fn", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
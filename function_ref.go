@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	functionNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	qualifierRe    = regexp.MustCompile(`^(\$LATEST|[a-zA-Z0-9_-]{1,128})$`)
+	accountIDRe    = regexp.MustCompile(`^[0-9]{12}$`)
+)
+
+// partitionConsoleHosts are the console hosts of the partitions
+var partitionConsoleHosts = map[string]string{
+	"aws":        "console.aws.amazon.com",
+	"aws-cn":     "console.amazonaws.cn",
+	"aws-us-gov": "console.amazonaws-us-gov.com",
+}
+
+// FunctionRef is a reference to a Lambda function
+type FunctionRef struct {
+	Name      string
+	Region    string // only in an ARN
+	AccountID string // in an ARN or a partial ARN
+	Partition string // only in an ARN
+	Qualifier string // version or alias, if any
+	IsARN     bool
+}
+
+// ParseFunctionRef parses a function name. It could be these formats.
+//   - Function name - my-function, or my-function:v1 with a qualifier.
+//   - Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function, optionally with a qualifier.
+//   - Partial ARN - 123456789012:function:my-function, optionally with a qualifier.
+func ParseFunctionRef(s string) (FunctionRef, error) {
+	var ref FunctionRef
+	p := strings.Split(s, ":")
+	var rest []string
+	switch {
+	case p[0] == "arn":
+		if len(p) != 7 && len(p) != 8 {
+			return ref, fmt.Errorf("wrong format function name, %s", s)
+		}
+		if p[2] != "lambda" || p[5] != "function" || !strings.HasPrefix(p[1], "aws") || p[3] == "" {
+			return ref, fmt.Errorf("not a Lambda function ARN, %s", s)
+		}
+		ref.IsARN = true
+		ref.Partition = p[1]
+		ref.Region = p[3]
+		ref.AccountID = p[4]
+		rest = p[6:]
+	case len(p) >= 3 && p[1] == "function":
+		if len(p) > 4 {
+			return ref, fmt.Errorf("wrong format function name, %s", s)
+		}
+		ref.AccountID = p[0]
+		rest = p[2:]
+	default:
+		if len(p) > 2 {
+			return ref, fmt.Errorf("wrong format function name, %s", s)
+		}
+		rest = p
+	}
+
+	if ref.AccountID != "" && !accountIDRe.MatchString(ref.AccountID) {
+		return ref, fmt.Errorf("wrong account ID, %s", s)
+	}
+	ref.Name = rest[0]
+	if !functionNameRe.MatchString(ref.Name) {
+		return ref, fmt.Errorf("wrong format function name, %s", s)
+	}
+	if len(rest) == 2 {
+		ref.Qualifier = rest[1]
+		if !qualifierRe.MatchString(ref.Qualifier) {
+			return ref, fmt.Errorf("wrong qualifier, %s", s)
+		}
+	}
+	return ref, nil
+}
+
+// QualifyFunction parses a function name and puts qualifier on it, which must not differ from the
+// qualifier the name already has. An empty qualifier keeps the name as it is.
+func QualifyFunction(s, qualifier string) (string, FunctionRef, error) {
+	ref, err := ParseFunctionRef(s)
+	if err != nil || qualifier == "" || ref.Qualifier == qualifier {
+		return s, ref, err
+	}
+	if ref.Qualifier != "" {
+		return s, ref, fmt.Errorf("-qualifier %s conflicts with the qualifier %s of %s", qualifier, ref.Qualifier, s)
+	}
+	ref.Qualifier = qualifier
+	return s + ":" + qualifier, ref, nil
+}
+
+// LogGroup returns the CloudWatch Logs group name of the function
+func (ref FunctionRef) LogGroup() string {
+	return fmt.Sprintf("/aws/lambda/%s", ref.Name)
+}
+
+// ConsoleURL returns the URL of the function in the AWS console
+func (ref FunctionRef) ConsoleURL() string {
+	region := ref.Region
+	host, ok := partitionConsoleHosts[ref.Partition]
+	if !ok {
+		host = partitionConsoleHosts["aws"]
+	}
+	u := "https://" + host + "/lambda/home"
+	if region != "" {
+		u = "https://" + region + "." + host + "/lambda/home?region=" + url.QueryEscape(region)
+	}
+	u += "#/functions/" + url.PathEscape(ref.Name)
+	switch {
+	case ref.Qualifier == "" || ref.Qualifier == "$LATEST":
+	case isVersion(ref.Qualifier):
+		u += "/versions/" + ref.Qualifier
+	default:
+		u += "/aliases/" + url.PathEscape(ref.Qualifier)
+	}
+	return u
+}
+
+func isVersion(qualifier string) bool {
+	_, err := strconv.ParseUint(qualifier, 10, 64)
+	return err == nil
+}
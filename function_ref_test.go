@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFunctionRef(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FunctionRef
+	}{
+		{"my-function", FunctionRef{Name: "my-function"}},
+		{"my-function:v1", FunctionRef{Name: "my-function", Qualifier: "v1"}},
+		{"my-function:3", FunctionRef{Name: "my-function", Qualifier: "3"}},
+		{"my-function:$LATEST", FunctionRef{Name: "my-function", Qualifier: "$LATEST"}},
+		{"123456789012:function:my-function", FunctionRef{Name: "my-function", AccountID: "123456789012"}},
+		{"123456789012:function:my-function:prod", FunctionRef{Name: "my-function", AccountID: "123456789012", Qualifier: "prod"}},
+		{"arn:aws:lambda:us-west-2:123456789012:function:my-function",
+			FunctionRef{Name: "my-function", Region: "us-west-2", AccountID: "123456789012", Partition: "aws", IsARN: true}},
+		{"arn:aws:lambda:us-west-2:123456789012:function:my-function:7",
+			FunctionRef{Name: "my-function", Region: "us-west-2", AccountID: "123456789012", Partition: "aws", Qualifier: "7", IsARN: true}},
+		{"arn:aws-us-gov:lambda:us-gov-west-1:123456789012:function:my_function",
+			FunctionRef{Name: "my_function", Region: "us-gov-west-1", AccountID: "123456789012", Partition: "aws-us-gov", IsARN: true}},
+		{"arn:aws-cn:lambda:cn-north-1:123456789012:function:f:live",
+			FunctionRef{Name: "f", Region: "cn-north-1", AccountID: "123456789012", Partition: "aws-cn", Qualifier: "live", IsARN: true}},
+	}
+	for _, tt := range tests {
+		got, err := ParseFunctionRef(tt.in)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v", tt.in, got)
+		}
+		if got.LogGroup() != "/aws/lambda/"+tt.want.Name {
+			t.Errorf("%s: log group %s", tt.in, got.LogGroup())
+		}
+	}
+}
+
+func TestQualifyFunction(t *testing.T) {
+	tests := []struct {
+		in, qualifier string
+		want          string
+		wantErr       bool
+	}{
+		{"my-function", "", "my-function", false},
+		{"my-function", "live", "my-function:live", false},
+		{"my-function:live", "live", "my-function:live", false},
+		{"my-function:live", "", "my-function:live", false},
+		{"my-function:live", "7", "", true},
+		{"arn:aws:lambda:us-west-2:123456789012:function:my-function", "$LATEST", "arn:aws:lambda:us-west-2:123456789012:function:my-function:$LATEST", false},
+		{"arn:aws:lambda:us-west-2:123456789012:function:my-function:7", "", "arn:aws:lambda:us-west-2:123456789012:function:my-function:7", false},
+		{"arn:aws:lambda:us-west-2:123456789012:function:my-function:7", "8", "", true},
+	}
+	for _, tt := range tests {
+		got, ref, err := QualifyFunction(tt.in, tt.qualifier)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s %s: must be an error, got %s", tt.in, tt.qualifier, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %s: got %s, %v", tt.in, tt.qualifier, got, err)
+			continue
+		}
+		if want, _ := ParseFunctionRef(tt.want); ref != want {
+			t.Errorf("%s %s: got %+v", tt.in, tt.qualifier, ref)
+		}
+	}
+}
+
+func TestParseFunctionRefError(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"a:b:c",
+		"my function",
+		"my-function:",
+		"my-function:v1:extra",
+		"12345:function:f",
+		"123456789012:function:f:v1:extra",
+		"arn:aws:lambda:us-west-2:123456789012:function",
+		"arn:aws:s3:us-west-2:123456789012:function:f",
+		"arn:aws:lambda:us-west-2:123456789012:layer:f",
+		"arn:aws:lambda::123456789012:function:f",
+		"arn:aws:lambda:us-west-2:123456789012:function:f:1:2",
+	} {
+		if ref, err := ParseFunctionRef(in); err == nil {
+			t.Errorf("%q: must be an error, got %+v", in, ref)
+		}
+	}
+}
+
+func TestFunctionRefConsoleURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"my-function", "https://console.aws.amazon.com/lambda/home#/functions/my-function"},
+		{"arn:aws:lambda:us-west-2:123456789012:function:f:7", "https://us-west-2.console.aws.amazon.com/lambda/home?region=us-west-2#/functions/f/versions/7"},
+		{"arn:aws:lambda:us-west-2:123456789012:function:f:prod", "https://us-west-2.console.aws.amazon.com/lambda/home?region=us-west-2#/functions/f/aliases/prod"},
+		{"arn:aws-cn:lambda:cn-north-1:123456789012:function:f", "https://cn-north-1.console.amazonaws.cn/lambda/home?region=cn-north-1#/functions/f"},
+		{"arn:aws-us-gov:lambda:us-gov-west-1:123456789012:function:f:$LATEST", "https://us-gov-west-1.console.amazonaws-us-gov.com/lambda/home?region=us-gov-west-1#/functions/f"},
+	}
+	for _, tt := range tests {
+		ref, err := ParseFunctionRef(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ref.ConsoleURL(); got != tt.want {
+			t.Errorf("%s: got %s", tt.in, got)
+		}
+	}
+}
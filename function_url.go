@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const (
+	functionURLAuthIAM       = "AWS_IAM"
+	functionURLResponseLimit = 4096 // bytes of the response body which are logged
+)
+
+// functionURLConfig is the part of the output of GetFunctionUrlConfig the url mode uses
+type functionURLConfig struct {
+	FunctionUrl string
+	AuthType    string // "AWS_IAM" or "NONE"
+}
+
+// functionURLAPI reads the Function URL of a function
+type functionURLAPI interface {
+	functionURL(ctx context.Context, function, qualifier string) (*functionURLConfig, error)
+}
+
+// fetchFunctionURL calls GetFunctionUrlConfig for the metadata cache
+func (c *metadataCache) fetchFunctionURL(ctx context.Context, function, qualifier string) (*functionURLConfig, error) {
+	input := &lambda.GetFunctionUrlConfigInput{FunctionName: aws.String(function)}
+	if qualifier != "" {
+		input.Qualifier = aws.String(qualifier)
+	}
+	out, err := c.api.GetFunctionUrlConfigWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+		return nil, fmt.Errorf("%s has no Function URL: %w", function, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetFunctionUrlConfig, %s: %w", function, err)
+	}
+	if aws.StringValue(out.FunctionUrl) == "" {
+		return nil, fmt.Errorf("GetFunctionUrlConfig, %s: no FunctionUrl in the response", function)
+	}
+	return &functionURLConfig{FunctionUrl: aws.StringValue(out.FunctionUrl), AuthType: aws.StringValue(out.AuthType)}, nil
+}
+
+// invokeURL posts the payload to the Function URL of the function, signed with SigV4 when its auth
+// type is AWS_IAM, and returns the response body with the request id of x-amzn-RequestId. A 5xx
+// status is a function error with its body, other statuses but 2xx are errors of the run.
+func (sl *AWSServerless) invokeURL(ctx context.Context, api functionURLAPI, client *http.Client, signer *v4.Signer, region string) ([]byte, string, error) {
+	conf, err := api.functionURL(ctx, sl.unqualifiedName(), sl.ref.Qualifier)
+	if err != nil {
+		return nil, "", err
+	}
+	sl.functionURL = conf.FunctionUrl
+	logger.Infof("the Function URL of %s is %s, auth type %s", sl.funcName, conf.FunctionUrl, conf.AuthType)
+
+	payload := []byte(sl.payload)
+	req, err := http.NewRequest(http.MethodPost, conf.FunctionUrl, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conf.AuthType == functionURLAuthIAM {
+		if _, err := signer.Sign(req, bytes.NewReader(payload), "lambda", region, time.Now()); err != nil {
+			return nil, "", fmt.Errorf("sign the request to %s: %w", conf.FunctionUrl, err)
+		}
+	}
+
+	sl.invokedType = lambda.InvocationTypeRequestResponse
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	resp, err := client.Do(req.WithContext(ctx))
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+	if err != nil {
+		return nil, "", fmt.Errorf("function URL, %s: %w", sl.funcName, err)
+	}
+	defer resp.Body.Close()
+	// one byte beyond the limit tells a body which is cut
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSyncPayloadSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("function URL, %s: %w", sl.funcName, err)
+	}
+	requestID := resp.Header.Get("X-Amzn-Requestid")
+	sl.statusCode = resp.StatusCode
+	if len(body) > maxSyncPayloadSize {
+		return nil, requestID, fmt.Errorf("function URL, %s: the response body exceeds the limit of %d bytes of a synchronous response", sl.funcName, maxSyncPayloadSize)
+	}
+	logger.Infof("response %s: %s", resp.Status, truncateMiddle(string(body), functionURLResponseLimit))
+
+	switch {
+	case resp.StatusCode >= 500:
+		return body, requestID, &functionError{fmt.Errorf("function URL response error, %s: %s", resp.Status, string(body))}
+	case resp.StatusCode == http.StatusForbidden && conf.AuthType == functionURLAuthIAM:
+		return nil, requestID, fmt.Errorf("function URL, %s: %s, the credentials need lambda:InvokeFunctionUrl: %s", sl.funcName, resp.Status, string(body))
+	case resp.StatusCode >= 300:
+		return nil, requestID, fmt.Errorf("function URL, %s: %s: %s", sl.funcName, resp.Status, string(body))
+	}
+	return body, requestID, nil
+}
+
+// invokeViaURL invokes the function through its Function URL as the invoke step of -via url. The body
+// is printed and written to -output like the response of a sync Invoke, and a 5xx is kept in
+// sl.responseErr, returned after the tail, since the logs of the failed invocation explain it.
+func (sl *AWSServerless) invokeViaURL(ctx context.Context, api functionURLAPI, client *http.Client, signer *v4.Signer, region string, stdout io.Writer) error {
+	body, requestID, err := sl.invokeURL(ctx, api, client, signer, region)
+	sl.requestID = requestID
+	// the error document of a 5xx is printed and written as well
+	if body != nil {
+		if sl.output != outputStdout {
+			printResponse(stdout, body, sl.json)
+		}
+		if err := writeOutput(sl.output, body, stdout); err != nil {
+			return err
+		}
+	}
+	if isFunctionError(err) {
+		sl.responseErr = err
+		sl.summarize = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sl.summarize = true
+	return sl.checkResponse(body)
+}
+
+// unqualifiedName returns -func without the qualifier, which GetFunctionUrlConfig takes apart
+func (sl *AWSServerless) unqualifiedName() string {
+	if sl.ref.Qualifier == "" {
+		return sl.funcName
+	}
+	return strings.TrimSuffix(sl.funcName, ":"+sl.ref.Qualifier)
+}
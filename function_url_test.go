@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+type fakeFunctionURL struct {
+	conf      functionURLConfig
+	function  string
+	qualifier string
+}
+
+func (f *fakeFunctionURL) functionURL(ctx context.Context, function, qualifier string) (*functionURLConfig, error) {
+	f.function, f.qualifier = function, qualifier
+	return &f.conf, nil
+}
+
+func TestInvokeURL(t *testing.T) {
+	setTestLogger(t)
+	var auth, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		auth, body = r.Header.Get("Authorization"), string(buf)
+		w.Header().Set("X-Amzn-Requestid", "req-1")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`{"ok":true}`))
+			return
+		}
+		w.Write([]byte(`{"Message":"failed"}`))
+	}))
+	defer server.Close()
+
+	api := &fakeFunctionURL{conf: functionURLConfig{FunctionUrl: server.URL + "/", AuthType: functionURLAuthIAM}}
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	sl := &AWSServerless{funcName: "orders-fn:live", ref: FunctionRef{Name: "orders-fn", Qualifier: "live"}, payload: `{"id":1}`, phases: newPhaseTracker(time.Now())}
+
+	resp, requestID, err := sl.invokeURL(context.Background(), api, server.Client(), signer, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != `{"ok":true}` || requestID != "req-1" || sl.statusCode != http.StatusOK || sl.functionURL != server.URL+"/" {
+		t.Errorf("got %s %s %d %s", resp, requestID, sl.statusCode, sl.functionURL)
+	}
+	if api.function != "orders-fn" || api.qualifier != "live" {
+		t.Errorf("the URL of %s:%s is looked up", api.function, api.qualifier)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") || !strings.Contains(auth, "/us-east-1/lambda") || body != `{"id":1}` {
+		t.Errorf("got %q %q", auth, body)
+	}
+
+	status = http.StatusBadGateway
+	_, requestID, err = sl.invokeURL(context.Background(), api, server.Client(), signer, "us-east-1")
+	if !isFunctionError(err) || requestID != "req-1" {
+		t.Errorf("a 5xx must be a function error with the request id, got %v %s", err, requestID)
+	}
+	status = http.StatusForbidden
+	if _, _, err := sl.invokeURL(context.Background(), api, server.Client(), signer, "us-east-1"); isFunctionError(err) || err == nil || !strings.Contains(err.Error(), "lambda:InvokeFunctionUrl") {
+		t.Errorf("got %v", err)
+	}
+
+	status = http.StatusOK
+	api.conf.AuthType = "NONE"
+	if _, _, err := sl.invokeURL(context.Background(), api, server.Client(), signer, "us-east-1"); err != nil || auth != "" {
+		t.Errorf("a NONE URL must not be signed, got %q %v", auth, err)
+	}
+}
+
+func TestInvokeViaURL(t *testing.T) {
+	setTestLogger(t)
+	status, body := http.StatusBadGateway, `{"errorMessage":"boom"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-Requestid", "req-1")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	api := &fakeFunctionURL{conf: functionURLConfig{FunctionUrl: server.URL + "/", AuthType: "NONE"}}
+	newRun := func() *AWSServerless {
+		return &AWSServerless{funcName: "orders-fn", ref: FunctionRef{Name: "orders-fn"}, payload: `{"id":1}`, phases: newPhaseTracker(time.Now())}
+	}
+
+	// a 5xx is printed, and its error is kept for after the tail
+	sl := newRun()
+	var stdout bytes.Buffer
+	if err := sl.invokeViaURL(context.Background(), api, server.Client(), nil, "us-east-1", &stdout); err != nil {
+		t.Fatalf("the error must be returned after the tail, got %v", err)
+	}
+	if !isFunctionError(sl.responseErr) || sl.requestID != "req-1" || !sl.summarize {
+		t.Errorf("got %v %s", sl.responseErr, sl.requestID)
+	}
+	if got := stdout.String(); got != "{\n  \"errorMessage\": \"boom\"\n}\n" {
+		t.Errorf("the body is not printed, got %q", got)
+	}
+
+	status = http.StatusOK
+	body = `{"ok":true}`
+	sl, stdout = newRun(), bytes.Buffer{}
+	if err := sl.invokeViaURL(context.Background(), api, server.Client(), nil, "us-east-1", &stdout); err != nil || sl.responseErr != nil {
+		t.Fatalf("got %v %v", err, sl.responseErr)
+	}
+	if got := stdout.String(); got != "{\n  \"ok\": true\n}\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// a body beyond the limit is not cut silently
+	body = `"` + strings.Repeat("x", maxSyncPayloadSize) + `"`
+	sl, stdout = newRun(), bytes.Buffer{}
+	if err := sl.invokeViaURL(context.Background(), api, server.Client(), nil, "us-east-1", &stdout); err == nil || !strings.Contains(err.Error(), "exceeds the limit") || stdout.Len() != 0 {
+		t.Errorf("got %v, %d bytes printed", err, stdout.Len())
+	}
+}
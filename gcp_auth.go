@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpCloudPlatformScope  = "https://www.googleapis.com/auth/cloud-platform"
+	gcpDefaultTokenURL     = "https://oauth2.googleapis.com/token"
+	gcpDefaultMetadataHost = "metadata.google.internal"
+	gcpTokenExpiryWindow   = time.Minute // a token expiring sooner is refreshed
+	gcpJWTLifetime         = time.Hour
+)
+
+// gcpToken is an OAuth2 access token or an ID token
+type gcpToken struct {
+	value  string
+	expiry time.Time
+}
+
+// gcpCredentials are the Application Default Credentials of Google Cloud
+type gcpCredentials interface {
+	// accessToken returns a token of the cloud-platform scope to call the Google APIs
+	accessToken(ctx context.Context) (gcpToken, error)
+	// idToken returns an ID token for the audience, the URL of a function
+	idToken(ctx context.Context, audience string) (gcpToken, error)
+	// kind returns the kind of the credentials, ex: "service_account"
+	kind() string
+}
+
+// gcpCredentialsFile is a credentials file of gcloud or a service account key
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcpTokenResponse is the response of the OAuth2 token endpoint and of the metadata server
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+// findGCPCredentials finds the Application Default Credentials: the file of GOOGLE_APPLICATION_CREDENTIALS,
+// the file of "gcloud auth application-default login", or the metadata server of GCE and GKE, which
+// serves the service account of the workload identity.
+func findGCPCredentials(getenv func(string) string, client *http.Client) (gcpCredentials, error) {
+	if path := getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		creds, err := loadGCPCredentialsFile(path, client)
+		if err != nil {
+			return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+		}
+		return creds, nil
+	}
+	if path := gcloudCredentialsPath(getenv); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			return loadGCPCredentialsFile(path, client)
+		}
+	}
+	host := getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = gcpDefaultMetadataHost
+	}
+	return &gcpMetadataCredentials{host: host, client: client}, nil
+}
+
+// gcloudCredentialsPath returns the path of the credentials file written by gcloud
+func gcloudCredentialsPath(getenv func(string) string) string {
+	if dir := getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	if runtime.GOOS == "windows" {
+		if dir := getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		}
+		return ""
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// loadGCPCredentialsFile loads a credentials file of the user or of a service account
+func loadGCPCredentialsFile(path string, client *http.Client) (gcpCredentials, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f gcpCredentialsFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch f.Type {
+	case "authorized_user":
+		if f.RefreshToken == "" {
+			return nil, fmt.Errorf("%s: no refresh_token", path)
+		}
+		return &gcpUserCredentials{file: f, tokenURL: gcpDefaultTokenURL, client: client}, nil
+	case "service_account":
+		key, err := parseRSAPrivateKey(f.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		tokenURL := f.TokenURI
+		if tokenURL == "" {
+			tokenURL = gcpDefaultTokenURL
+		}
+		return &gcpServiceAccountCredentials{file: f, key: key, tokenURL: tokenURL, client: client, now: time.Now}, nil
+	}
+	return nil, fmt.Errorf("%s: credentials of type %q are not supported", path, f.Type)
+}
+
+// parseRSAPrivateKey parses the PEM private key of a service account key
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("private_key is not PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private_key is not an RSA key")
+	}
+	return key, nil
+}
+
+// postTokenRequest posts the form to the OAuth2 token endpoint
+func postTokenRequest(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (gcpTokenResponse, error) {
+	var ret gcpTokenResponse
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ret, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ret, fmt.Errorf("token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ret, fmt.Errorf("token endpoint: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ret, fmt.Errorf("token endpoint returns %d: %s", resp.StatusCode, truncateMiddle(string(body), 512))
+	}
+	if err := json.Unmarshal(body, &ret); err != nil {
+		return ret, fmt.Errorf("token response: %w", err)
+	}
+	return ret, nil
+}
+
+// expiresIn returns the expiry of a token which expires in seconds
+func expiresIn(now time.Time, seconds int64) time.Time {
+	return now.Add(time.Duration(seconds) * time.Second)
+}
+
+// jwtExpiry returns the exp claim of a JWT, or the zero time if it has none
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(buf, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// gcpUserCredentials are the credentials of "gcloud auth application-default login"
+type gcpUserCredentials struct {
+	file     gcpCredentialsFile
+	tokenURL string
+	client   *http.Client
+}
+
+func (c *gcpUserCredentials) kind() string { return "authorized_user" }
+
+func (c *gcpUserCredentials) refresh(ctx context.Context) (gcpTokenResponse, error) {
+	return postTokenRequest(ctx, c.client, c.tokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {c.file.ClientID},
+		"client_secret": {c.file.ClientSecret},
+		"refresh_token": {c.file.RefreshToken},
+	})
+}
+
+func (c *gcpUserCredentials) accessToken(ctx context.Context) (gcpToken, error) {
+	r, err := c.refresh(ctx)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	return gcpToken{value: r.AccessToken, expiry: expiresIn(time.Now(), r.ExpiresIn)}, nil
+}
+
+// idToken returns the ID token of the user. Its audience is the OAuth client of gcloud, which
+// Cloud Run and Cloud Functions accept as gcloud auth print-identity-token does.
+func (c *gcpUserCredentials) idToken(ctx context.Context, audience string) (gcpToken, error) {
+	r, err := c.refresh(ctx)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	if r.IDToken == "" {
+		return gcpToken{}, fmt.Errorf("no ID token for the user, run gcloud auth application-default login again")
+	}
+	return gcpToken{value: r.IDToken, expiry: jwtExpiry(r.IDToken)}, nil
+}
+
+// gcpServiceAccountCredentials are the credentials of a service account key file
+type gcpServiceAccountCredentials struct {
+	file     gcpCredentialsFile
+	key      *rsa.PrivateKey
+	tokenURL string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func (c *gcpServiceAccountCredentials) kind() string { return "service_account" }
+
+// assertion returns the JWT signed by the key with the claims, which is exchanged for a token
+func (c *gcpServiceAccountCredentials) assertion(claims map[string]interface{}) (string, error) {
+	now := c.now()
+	claims["iss"] = c.file.ClientEmail
+	claims["aud"] = c.tokenURL
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(gcpJWTLifetime).Unix()
+	return signJWT(c.key, c.file.PrivateKeyID, claims)
+}
+
+func (c *gcpServiceAccountCredentials) accessToken(ctx context.Context) (gcpToken, error) {
+	a, err := c.assertion(map[string]interface{}{"scope": gcpCloudPlatformScope})
+	if err != nil {
+		return gcpToken{}, err
+	}
+	r, err := postTokenRequest(ctx, c.client, c.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {a},
+	})
+	if err != nil {
+		return gcpToken{}, err
+	}
+	return gcpToken{value: r.AccessToken, expiry: expiresIn(c.now(), r.ExpiresIn)}, nil
+}
+
+func (c *gcpServiceAccountCredentials) idToken(ctx context.Context, audience string) (gcpToken, error) {
+	a, err := c.assertion(map[string]interface{}{"target_audience": audience})
+	if err != nil {
+		return gcpToken{}, err
+	}
+	r, err := postTokenRequest(ctx, c.client, c.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {a},
+	})
+	if err != nil {
+		return gcpToken{}, err
+	}
+	if r.IDToken == "" {
+		return gcpToken{}, fmt.Errorf("no ID token for %s", c.file.ClientEmail)
+	}
+	return gcpToken{value: r.IDToken, expiry: jwtExpiry(r.IDToken)}, nil
+}
+
+// signJWT returns the JWT of the claims signed by RS256
+func signJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sig, err := signRS256(key, signed)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + sig, nil
+}
+
+// signRS256 returns the base64url RS256 signature of the signing input of a JWS, RFC 7515
+func signRS256(key *rsa.PrivateKey, signingInput string) (string, error) {
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign JWT: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// gcpMetadataCredentials are the credentials of the service account served by the metadata server
+// of GCE and GKE, which is the Google service account of the workload identity on GKE
+type gcpMetadataCredentials struct {
+	host   string
+	client *http.Client
+}
+
+func (c *gcpMetadataCredentials) kind() string { return "metadata" }
+
+func (c *gcpMetadataCredentials) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.host+"/computeMetadata/v1/instance/service-accounts/default/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("no Application Default Credentials, set GOOGLE_APPLICATION_CREDENTIALS or run gcloud auth application-default login: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server returns %d: %s", resp.StatusCode, truncateMiddle(string(body), 512))
+	}
+	return body, nil
+}
+
+func (c *gcpMetadataCredentials) accessToken(ctx context.Context) (gcpToken, error) {
+	body, err := c.get(ctx, "token?scopes="+url.QueryEscape(gcpCloudPlatformScope))
+	if err != nil {
+		return gcpToken{}, err
+	}
+	var r gcpTokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return gcpToken{}, fmt.Errorf("metadata token: %w", err)
+	}
+	return gcpToken{value: r.AccessToken, expiry: expiresIn(time.Now(), r.ExpiresIn)}, nil
+}
+
+func (c *gcpMetadataCredentials) idToken(ctx context.Context, audience string) (gcpToken, error) {
+	body, err := c.get(ctx, "identity?format=full&audience="+url.QueryEscape(audience))
+	if err != nil {
+		return gcpToken{}, err
+	}
+	token := strings.TrimSpace(string(body))
+	return gcpToken{value: token, expiry: jwtExpiry(token)}, nil
+}
+
+// gcpTokenCache reuses the tokens of the credentials until they are about to expire
+type gcpTokenCache struct {
+	creds gcpCredentials
+	now   func() time.Time
+
+	mu     sync.Mutex
+	access gcpToken
+	ids    map[string]gcpToken
+}
+
+func newGCPTokenCache(creds gcpCredentials) *gcpTokenCache {
+	return &gcpTokenCache{creds: creds, now: time.Now, ids: make(map[string]gcpToken)}
+}
+
+func (c *gcpTokenCache) valid(t gcpToken) bool {
+	return t.value != "" && (t.expiry.IsZero() || c.now().Add(gcpTokenExpiryWindow).Before(t.expiry))
+}
+
+func (c *gcpTokenCache) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valid(c.access) {
+		return c.access.value, nil
+	}
+	t, err := c.creds.accessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("access token of %s credentials: %w", c.creds.kind(), err)
+	}
+	c.access = t
+	return t.value, nil
+}
+
+func (c *gcpTokenCache) idToken(ctx context.Context, audience string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.ids[audience]; c.valid(t) {
+		return t.value, nil
+	}
+	t, err := c.creds.idToken(ctx, audience)
+	if err != nil {
+		return "", fmt.Errorf("ID token of %s credentials: %w", c.creds.kind(), err)
+	}
+	c.ids[audience] = t
+	return t.value, nil
+}
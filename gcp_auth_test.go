@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT which expires at exp
+func testJWT(exp time.Time) string {
+	claims, _ := json.Marshal(map[string]interface{}{"exp": exp.Unix()})
+	return "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func writeJSONFile(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindGCPCredentials(t *testing.T) {
+	home := t.TempDir()
+	setTestEnv(t, "HOME", home)
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+	user := map[string]string{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"}
+
+	// no file, the metadata server of GKE
+	creds, err := findGCPCredentials(getenv, http.DefaultClient)
+	if err != nil || creds.kind() != "metadata" || creds.(*gcpMetadataCredentials).host != gcpDefaultMetadataHost {
+		t.Errorf("got %v, %v", creds, err)
+	}
+	env["GCE_METADATA_HOST"] = "127.0.0.1:8080"
+	if creds, _ := findGCPCredentials(getenv, http.DefaultClient); creds.(*gcpMetadataCredentials).host != "127.0.0.1:8080" {
+		t.Errorf("got %+v", creds)
+	}
+
+	// the file of gcloud auth application-default login
+	writeJSONFile(t, filepath.Join(home, ".config", "gcloud", "application_default_credentials.json"), user)
+	if creds, err := findGCPCredentials(getenv, http.DefaultClient); err != nil || creds.kind() != "authorized_user" {
+		t.Errorf("got %v, %v", creds, err)
+	}
+
+	// GOOGLE_APPLICATION_CREDENTIALS wins, and its error is not hidden
+	env["GOOGLE_APPLICATION_CREDENTIALS"] = filepath.Join(home, "missing.json")
+	if _, err := findGCPCredentials(getenv, http.DefaultClient); err == nil || !strings.Contains(err.Error(), "GOOGLE_APPLICATION_CREDENTIALS") {
+		t.Errorf("got %v", err)
+	}
+	unsupported := filepath.Join(home, "external.json")
+	writeJSONFile(t, unsupported, map[string]string{"type": "external_account"})
+	env["GOOGLE_APPLICATION_CREDENTIALS"] = unsupported
+	if _, err := findGCPCredentials(getenv, http.DefaultClient); err == nil || !strings.Contains(err.Error(), "external_account") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestGCPUserCredentials(t *testing.T) {
+	idToken := testJWT(time.Now().Add(time.Hour))
+	var refreshes int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		refreshes++
+		fmt.Fprintf(w, `{"access_token": "ya29.user", "expires_in": 3599, "id_token": %q}`, idToken)
+	}))
+	defer ts.Close()
+
+	c := &gcpUserCredentials{file: gcpCredentialsFile{ClientID: "id", ClientSecret: "secret", RefreshToken: "refresh"}, tokenURL: ts.URL, client: ts.Client()}
+	cache := newGCPTokenCache(c)
+	for i := 0; i < 2; i++ {
+		if tok, err := cache.accessToken(context.Background()); err != nil || tok != "ya29.user" {
+			t.Errorf("got %s, %v", tok, err)
+		}
+		if tok, err := cache.idToken(context.Background(), "https://fn.example"); err != nil || tok != idToken {
+			t.Errorf("got %s, %v", tok, err)
+		}
+	}
+	if refreshes != 2 {
+		t.Errorf("the tokens are cached, got %d refreshes", refreshes)
+	}
+
+	// a token about to expire is refreshed
+	cache.now = func() time.Time { return time.Now().Add(time.Hour - 30*time.Second) }
+	if _, err := cache.accessToken(context.Background()); err != nil || refreshes != 3 {
+		t.Errorf("got %d refreshes, %v", refreshes, err)
+	}
+
+	c.file.RefreshToken = "revoked"
+	if _, err := newGCPTokenCache(c).accessToken(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestGCPServiceAccountCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	idToken := testJWT(time.Now().Add(time.Hour))
+
+	var claims []map[string]interface{}
+	var tokenURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var header map[string]string
+		buf, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		json.Unmarshal(buf, &header)
+		if header["alg"] != "RS256" || header["kid"] != "key-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var c map[string]interface{}
+		buf, _ = base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(buf, &c)
+		claims = append(claims, c)
+		if _, ok := c["target_audience"]; ok {
+			fmt.Fprintf(w, `{"id_token": %q}`, idToken)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "ya29.sa", "expires_in": 3600}`)
+	}))
+	defer ts.Close()
+	tokenURL = ts.URL
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	writeJSONFile(t, path, map[string]string{
+		"type":           "service_account",
+		"client_email":   "invoker@my-proj.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    pemKey,
+		"token_uri":      tokenURL,
+	})
+	creds, err := loadGCPCredentialsFile(path, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := creds.accessToken(context.Background()); err != nil || tok.value != "ya29.sa" {
+		t.Errorf("got %+v, %v", tok, err)
+	}
+	tok, err := creds.idToken(context.Background(), "https://fn.example")
+	if err != nil || tok.value != idToken || tok.expiry.Unix() != jwtExpiry(idToken).Unix() {
+		t.Errorf("got %+v, %v", tok, err)
+	}
+	if len(claims) != 2 {
+		t.Fatalf("got %v", claims)
+	}
+	if claims[0]["scope"] != gcpCloudPlatformScope || claims[0]["iss"] != "invoker@my-proj.iam.gserviceaccount.com" || claims[0]["aud"] != tokenURL {
+		t.Errorf("got %v", claims[0])
+	}
+	if claims[1]["target_audience"] != "https://fn.example" {
+		t.Errorf("got %v", claims[1])
+	}
+
+	writeJSONFile(t, path, map[string]string{"type": "service_account", "private_key": "not a key"})
+	if _, err := loadGCPCredentialsFile(path, ts.Client()); err == nil {
+		t.Errorf("a broken key must be an error")
+	}
+}
+
+func TestGCPMetadataCredentials(t *testing.T) {
+	idToken := testJWT(time.Now().Add(time.Hour))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			fmt.Fprint(w, `{"access_token": "ya29.gke", "expires_in": 3000, "token_type": "Bearer"}`)
+		case "/computeMetadata/v1/instance/service-accounts/default/identity":
+			if r.URL.Query().Get("audience") != "https://fn.example" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, idToken)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := &gcpMetadataCredentials{host: strings.TrimPrefix(ts.URL, "http://"), client: ts.Client()}
+	if tok, err := c.accessToken(context.Background()); err != nil || tok.value != "ya29.gke" {
+		t.Errorf("got %+v, %v", tok, err)
+	}
+	if tok, err := c.idToken(context.Background(), "https://fn.example"); err != nil || tok.value != idToken || tok.expiry.IsZero() {
+		t.Errorf("got %+v, %v", tok, err)
+	}
+
+	ts.Close()
+	if _, err := c.accessToken(context.Background()); err == nil || !strings.Contains(err.Error(), "GOOGLE_APPLICATION_CREDENTIALS") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestSignRS256 signs the example of RFC 7515 Appendix A.2, whose RS256 signature is deterministic
+func TestSignRS256(t *testing.T) {
+	b64 := func(s string) *big.Int {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return new(big.Int).SetBytes(buf)
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: b64("ofgWCuLjybRlzo0tZWJjNiuSfb4p4fAkd_wWJcyQoTbji9k0l8W26mPddxHmfHQp-Vaw-4qPCJrcS2mJPMEzP1Pt0Bm4d4QlL-yRT-SFd2lZS-pCgNMsD1W_YpRPEwOWvG6b32690r2jZ47soMZo9wGzjb_7OMg0LOL-bSf63kpaSHSXndS5z5rexMdbBYUsLA9e-KXBdQOS-UTo7WTBEMa2R2CapHg665xsmtdVMTBQY4uDZlxvb3qCo5ZwKh9kG4LT6_I5IhlJH7aGhyxXFvUK-DWNmoudF8NAco9_h9iaGNj8q2ethFkMLs91kzk2PAcDTW9gb54h4FRWyuXpoQ"),
+			E: 65537,
+		},
+		D: b64("Eq5xpGnNCivDflJsRQBXHx1hdR1k6Ulwe2JZD50LpXyWPEAeP88vLNO97IjlA7_GQ5sLKMgvfTeXZx9SE-7YwVol2NXOoAJe46sui395IW_GO-pWJ1O0BkTGoVEn2bKVRUCgu-GjBVaYLU6f3l9kJfFNS3E0QbVdxzubSu3Mkqzjkn439X0M_V51gfpRLI9JYanrC4D4qAdGcopV_0ZHHzQlBjudU2QvXt4ehNYTCBr6XCLQUShb1juUO1ZdiYoFaFQT5Tw8bGUl_x_jTj3ccPDVZFD9pIuhLhBOneufuBiB4cS98l2SR_RQyGWSeWjnczT0QU91p1DhOVRuOopznQ"),
+		Primes: []*big.Int{
+			b64("4BzEEOtIpmVdVEZNCqS7baC4crd0pqnRH_5IB3jw3bcxGn6QLvnEtfdUdiYrqBdss1l58BQ3KhooKeQTa9AB0Hw_Py5PJdTJNPY8cQn7ouZ2KKDcmnPGBY5t7yLc1QlQ5xHdwW1VhvKn-nXqhJTBgIPgtldC-KDV5z-y2XDwGUc"),
+			b64("uQPEfgmVtjL0Uyyx88GZFF1fOunH3-7cepKmtH4pxhtCoHqpWmT8YAmZxaewHgHAjLYsp1ZSe7zFYHj7C6ul7TjeLQeZD_YwD66t62wDmpe_HlB-TnBA-njbglfIsRLtXlnDzQkv5dTltRJ11BKBBypeeF6689rjcJIDEz9RWdc"),
+		},
+	}
+	if err := key.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	key.Precompute()
+	const signingInput = "eyJhbGciOiJSUzI1NiJ9.eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ"
+	const want = "cC4hiUPoj9Eetdgtv3hF80EGrhuB__dzERat0XF9g2VtQgr9PJbu3XOiZj5RZmh7AAuHIm4Bh-0Qc_lF5YKt_O8W2Fp5jujGbds9uJdbF9CUAr7t1dnZcAcQjbKBYNX4BAynRFdiuB--f_nZLgrnbyTyWzO75vRK5h6xBArLIARNPvkSjtQBMHlb1L07Qe7K0GarZRmB_eSN9383LcOLn6_dO--xi12jzDwusC-eOkHWEsqtFZESc6BfI7noOPqvhJ1phCnvWh6IeYI2w9QOYEUipUTI8np6LbgGY9Fs98rqVt5AXLIhWkWywlVmtVrBp0igcN_IoypGlUPQGe77Rw"
+	got, err := signRS256(key, signingInput)
+	if err != nil || got != want {
+		t.Errorf("got %s, %v", got, err)
+	}
+
+	// a JWT of signJWT is the header and the claims signed the same way
+	jwt, err := signJWT(key, "k1", map[string]interface{}{"iss": "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("got %s", jwt)
+	}
+	if header, _ := base64.RawURLEncoding.DecodeString(parts[0]); string(header) != `{"alg":"RS256","kid":"k1","typ":"JWT"}` {
+		t.Errorf("got the header %s", header)
+	}
+	if sig, _ := signRS256(key, parts[0]+"."+parts[1]); sig != parts[2] {
+		t.Errorf("got the signature %s", parts[2])
+	}
+}
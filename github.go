@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	githubAPIURL         = "https://api.github.com"
+	githubStatusContext  = "k8s-nodeless"
+	githubMaxDescription = 140
+	githubMaxAttempts    = 3
+	githubTokenEnv       = "GITHUB_TOKEN"
+	githubPostTimeout    = 30 * time.Second
+)
+
+// githubStatus posts the verdict to the commit statuses API
+type githubStatus struct {
+	baseURL string
+	owner   string
+	repo    string
+	sha     string
+	token   string
+	client  *http.Client
+	backoff func(attempt int) time.Duration
+}
+
+// parseGitHubStatus parses owner/repo@sha
+func parseGitHubStatus(s, token string) (*githubStatus, error) {
+	at := strings.LastIndexByte(s, '@')
+	if at < 0 {
+		return nil, fmt.Errorf("github-status must be owner/repo@sha, %s", s)
+	}
+	p := strings.Split(s[:at], "/")
+	if len(p) != 2 || p[0] == "" || p[1] == "" || s[at+1:] == "" {
+		return nil, fmt.Errorf("github-status must be owner/repo@sha, %s", s)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("github-status needs a token in %s", githubTokenEnv)
+	}
+	return &githubStatus{
+		baseURL: githubAPIURL,
+		owner:   p[0],
+		repo:    p[1],
+		sha:     s[at+1:],
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: retryBackoff,
+	}, nil
+}
+
+// post sets the commit status. Server errors are retried.
+func (g *githubStatus) post(ctx context.Context, v verdict) error {
+	description := v.Line
+	if r := []rune(description); len(r) > githubMaxDescription {
+		description = string(r[:githubMaxDescription-1]) + "…"
+	}
+	body, err := json.Marshal(map[string]string{
+		"state":       string(v.Outcome),
+		"description": description,
+		"context":     githubStatusContext,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s/statuses/%s", g.baseURL, g.owner, g.repo, g.sha)
+
+	for attempt := 1; ; attempt++ {
+		err := g.postOnce(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*githubPermanentError); ok || attempt >= githubMaxAttempts {
+			return err
+		}
+		if err := sleepContext(ctx, g.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// githubPermanentError is an error which is not retried
+type githubPermanentError struct {
+	msg string
+}
+
+func (e *githubPermanentError) Error() string { return e.msg }
+
+func (g *githubStatus) postOnce(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &githubPermanentError{err.Error()}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "token "+g.token)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("github status: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return &githubPermanentError{fmt.Sprintf("github status: the token in %s is rejected (%s)", githubTokenEnv, resp.Status)}
+	case resp.StatusCode == http.StatusForbidden:
+		return &githubPermanentError{fmt.Sprintf("github status: the token in %s is not allowed to set statuses of %s/%s (%s), repo:status scope is required", githubTokenEnv, g.owner, g.repo, resp.Status)}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity:
+		return &githubPermanentError{fmt.Sprintf("github status: %s/%s@%s is not found or not accessible by the token (%s)", g.owner, g.repo, g.sha, resp.Status)}
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("github status: %s", resp.Status)
+	}
+	return &githubPermanentError{fmt.Sprintf("github status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGitHubStatus(t *testing.T) {
+	gh, err := parseGitHubStatus("shirou/k8s-nodeless@0b752ce", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gh.owner != "shirou" || gh.repo != "k8s-nodeless" || gh.sha != "0b752ce" {
+		t.Errorf("got %s/%s@%s", gh.owner, gh.repo, gh.sha)
+	}
+	for _, s := range []string{"shirou@abc", "shirou/k8s-nodeless", "shirou/k8s-nodeless@", "/repo@abc", "a/b/c@abc"} {
+		if _, err := parseGitHubStatus(s, "tok"); err == nil {
+			t.Errorf("%s must be rejected", s)
+		}
+	}
+	if _, err := parseGitHubStatus("shirou/k8s-nodeless@abc", ""); err == nil || !strings.Contains(err.Error(), githubTokenEnv) {
+		t.Errorf("a missing token must be reported, got %v", err)
+	}
+}
+
+func testGitHubStatus(t *testing.T, handler http.HandlerFunc) *githubStatus {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	gh, err := parseGitHubStatus("shirou/k8s-nodeless@abc", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gh.baseURL = srv.URL
+	gh.backoff = func(int) time.Duration { return 0 }
+	return gh
+}
+
+func TestGitHubStatusPost(t *testing.T) {
+	var got map[string]string
+	calls := 0
+	gh := testGitHubStatus(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/repos/shirou/k8s-nodeless/statuses/abc" || r.Header.Get("Authorization") != "token tok" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	v := verdict{Outcome: outcomeFailure, Line: "❌ orders-fn " + strings.Repeat("x", 200)}
+	if err := gh.post(context.Background(), v); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("a server error must be retried, called %d times", calls)
+	}
+	if got["state"] != "failure" || got["context"] != githubStatusContext {
+		t.Errorf("got %v", got)
+	}
+	if n := len([]rune(got["description"])); n != githubMaxDescription {
+		t.Errorf("description must be truncated to %d, got %d", githubMaxDescription, n)
+	}
+}
+
+func TestGitHubStatusErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		calls  int
+		want   string
+	}{
+		{http.StatusUnauthorized, 1, "is rejected"},
+		{http.StatusForbidden, 1, "repo:status"},
+		{http.StatusNotFound, 1, "not found"},
+		{http.StatusServiceUnavailable, githubMaxAttempts, "503"},
+	}
+	for _, tt := range tests {
+		calls := 0
+		gh := testGitHubStatus(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(tt.status)
+		})
+		err := gh.post(context.Background(), verdict{Outcome: outcomeSuccess, Line: "✅"})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d: got %v, want %q", tt.status, err, tt.want)
+		}
+		if calls != tt.calls {
+			t.Errorf("%d: called %d times, want %d", tt.status, calls, tt.calls)
+		}
+	}
+}
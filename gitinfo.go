@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitInfo is what attribution tells about the git repository the tool runs in
+type gitInfo struct {
+	Repo   string
+	Branch string // the short commit id when HEAD is detached
+	Dirty  *bool  // nil when the index can not be read
+}
+
+// readGitInfo reads the repository which contains dir without running git, or returns nil if there is none
+func readGitInfo(dir string) (*gitInfo, error) {
+	worktree, gitDir, err := findGitDir(dir)
+	if err != nil || gitDir == "" {
+		return nil, err
+	}
+	info := &gitInfo{Repo: filepath.Base(worktree)}
+	if name := originRepoName(gitDir); name != "" {
+		info.Repo = name
+	}
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil, fmt.Errorf("read HEAD: %w", err)
+	}
+	ref := strings.TrimSpace(string(head))
+	if strings.HasPrefix(ref, "ref: ") {
+		info.Branch = strings.TrimPrefix(strings.TrimPrefix(ref, "ref: "), "refs/heads/")
+	} else if len(ref) >= 12 {
+		info.Branch = ref[:12]
+	}
+	if dirty, err := worktreeDirty(worktree, filepath.Join(gitDir, "index")); err == nil {
+		info.Dirty = &dirty
+	}
+	return info, nil
+}
+
+// findGitDir finds the work tree which contains dir and its git directory. A .git file of a linked
+// work tree or a submodule points to the git directory.
+func findGitDir(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		st, err := os.Stat(dotGit)
+		if err == nil && st.IsDir() {
+			return dir, dotGit, nil
+		}
+		if err == nil {
+			buf, err := ioutil.ReadFile(dotGit)
+			if err != nil {
+				return "", "", err
+			}
+			line := strings.TrimSpace(string(buf))
+			if !strings.HasPrefix(line, "gitdir: ") {
+				return "", "", fmt.Errorf("%s: not a gitdir file", dotGit)
+			}
+			gitDir := strings.TrimPrefix(line, "gitdir: ")
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return dir, gitDir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
+
+// originRepoName returns the repository name of the origin remote, ex: "k8s-nodeless" of
+// git@github.com:shirou/k8s-nodeless.git, or "" if there is none. A linked work tree
+// shares the config of the main repository.
+func originRepoName(gitDir string) string {
+	configPath := filepath.Join(gitDir, "config")
+	if buf, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(buf))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		configPath = filepath.Join(common, "config")
+	}
+	f, err := os.Open(configPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	inOrigin := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+		if !inOrigin {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "url" {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(kv[1]), "/"), ".git")
+		if i := strings.LastIndexAny(url, "/:"); i >= 0 {
+			url = url[i+1:]
+		}
+		return url
+	}
+	return ""
+}
+
+// indexEntry is a file recorded in the git index
+type indexEntry struct {
+	path      string
+	mode      uint32
+	mtimeSec  uint32
+	mtimeNsec uint32
+	size      uint32
+	sha       [20]byte
+}
+
+const (
+	gitModeSymlink = 0120000
+	gitModeGitlink = 0160000
+)
+
+var errIndexVersion = errors.New("unsupported index version")
+
+// readIndex reads the entries of the index of version 2 or 3
+func readIndex(r io.Reader) ([]indexEntry, error) {
+	br := bufio.NewReader(r)
+	var header struct {
+		Signature [4]byte
+		Version   uint32
+		Count     uint32
+	}
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Signature[:]) != "DIRC" {
+		return nil, errors.New("not an index file")
+	}
+	if header.Version != 2 && header.Version != 3 {
+		return nil, errIndexVersion
+	}
+	entries := make([]indexEntry, 0, header.Count)
+	for i := uint32(0); i < header.Count; i++ {
+		var fixed struct {
+			CtimeSec, CtimeNsec uint32
+			MtimeSec, MtimeNsec uint32
+			Dev, Ino, Mode      uint32
+			UID, GID, Size      uint32
+			SHA                 [20]byte
+			Flags               uint16
+		}
+		if err := binary.Read(br, binary.BigEndian, &fixed); err != nil {
+			return nil, err
+		}
+		n := 62
+		if fixed.Flags&0x4000 != 0 {
+			var extended uint16
+			if err := binary.Read(br, binary.BigEndian, &extended); err != nil {
+				return nil, err
+			}
+			n += 2
+		}
+		name, err := br.ReadBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		n += len(name)
+		// entries are padded with NULs to a multiple of 8 bytes, the first of which ends the name
+		if pad := (8 - n%8) % 8; pad > 0 {
+			if _, err := br.Discard(pad); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, indexEntry{
+			path:      string(name[:len(name)-1]),
+			mode:      fixed.Mode,
+			mtimeSec:  fixed.MtimeSec,
+			mtimeNsec: fixed.MtimeNsec,
+			size:      fixed.Size,
+			sha:       fixed.SHA,
+		})
+	}
+	return entries, nil
+}
+
+// worktreeDirty returns true if a tracked file is modified or deleted. A file whose size and
+// mtime match the index is clean, otherwise its content is hashed as git does. Untracked files
+// and submodules are not looked at.
+func worktreeDirty(worktree, indexPath string) (bool, error) {
+	f, err := os.Open(indexPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	entries, err := readIndex(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", indexPath, err)
+	}
+	for _, e := range entries {
+		if e.mode&0170000 == gitModeGitlink {
+			continue
+		}
+		modified, err := entryModified(filepath.Join(worktree, filepath.FromSlash(e.path)), e)
+		if err != nil {
+			return false, err
+		}
+		if modified {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func entryModified(p string, e indexEntry) (bool, error) {
+	st, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if uint32(st.Size()) != e.size {
+		return true, nil
+	}
+	mtime := st.ModTime()
+	if uint32(mtime.Unix()) == e.mtimeSec && uint32(mtime.Nanosecond()) == e.mtimeNsec {
+		return false, nil
+	}
+	var content []byte
+	if e.mode&0170000 == gitModeSymlink {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return false, err
+		}
+		content = []byte(target)
+	} else {
+		content, err = ioutil.ReadFile(p)
+		if err != nil {
+			return false, err
+		}
+	}
+	sum := gitBlobSHA(content)
+	return !bytes.Equal(sum[:], e.sha[:]), nil
+}
+
+// gitBlobSHA returns the object id of the content as a blob
+func gitBlobSHA(content []byte) [20]byte {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	var ret [20]byte
+	copy(ret[:], h.Sum(nil))
+	return ret
+}
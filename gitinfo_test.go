@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to dir/name, creating the directories
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeIndex writes a version 2 index of the files in the work tree as they are now
+func writeIndex(t *testing.T, gitDir, worktree string, version uint32, files ...string) {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("DIRC")
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(files)))
+	for _, name := range files {
+		p := filepath.Join(worktree, filepath.FromSlash(name))
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := buf.Len()
+		mtime := st.ModTime()
+		for _, v := range []uint32{
+			uint32(mtime.Unix()), uint32(mtime.Nanosecond()), // ctime
+			uint32(mtime.Unix()), uint32(mtime.Nanosecond()),
+			0, 0, 0100644, 0, 0, uint32(st.Size()),
+		} {
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+		sha := gitBlobSHA(content)
+		buf.Write(sha[:])
+		flags := uint16(len(name))
+		if version == 3 {
+			flags |= 0x4000
+		}
+		binary.Write(&buf, binary.BigEndian, flags)
+		if version == 3 {
+			binary.Write(&buf, binary.BigEndian, uint16(0))
+		}
+		buf.WriteString(name)
+		n := buf.Len() - start
+		buf.Write(make([]byte, 8-n%8))
+	}
+	// the checksum is not verified
+	buf.Write(make([]byte, 20))
+	if err := ioutil.WriteFile(filepath.Join(gitDir, "index"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixtureRepo makes a repository with tracked files in a temp dir and returns the work tree
+func fixtureRepo(t *testing.T, head, config string) string {
+	t.Helper()
+	worktree := filepath.Join(t.TempDir(), "work")
+	gitDir := filepath.Join(worktree, ".git")
+	writeFile(t, gitDir, "HEAD", head)
+	if config != "" {
+		writeFile(t, gitDir, "config", config)
+	}
+	writeFile(t, worktree, "main.go", "package main\n")
+	writeFile(t, worktree, "sub/dir/a.txt", "a")
+	writeIndex(t, gitDir, worktree, 2, "main.go", "sub/dir/a.txt")
+	return worktree
+}
+
+func TestReadGitInfo(t *testing.T) {
+	worktree := fixtureRepo(t, "ref: refs/heads/feature/x\n", `[core]
+	bare = false
+[remote "upstream"]
+	url = https://github.com/other/upstream.git
+[remote "origin"]
+	url = git@github.com:shirou/k8s-nodeless.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+`)
+	info, err := readGitInfo(filepath.Join(worktree, "sub", "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Repo != "k8s-nodeless" || info.Branch != "feature/x" {
+		t.Fatalf("got %+v", info)
+	}
+	if info.Dirty == nil || *info.Dirty {
+		t.Errorf("the work tree is clean, got %v", info.Dirty)
+	}
+}
+
+func TestReadGitInfoNoRemote(t *testing.T) {
+	worktree := fixtureRepo(t, "0123456789abcdef0123456789abcdef01234567\n", "")
+	info, err := readGitInfo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Repo != "work" {
+		t.Errorf("the directory name is the repo without origin, got %s", info.Repo)
+	}
+	if info.Branch != "0123456789ab" {
+		t.Errorf("a detached HEAD is the commit id, got %s", info.Branch)
+	}
+}
+
+func TestReadGitInfoNotRepository(t *testing.T) {
+	info, err := readGitInfo(t.TempDir())
+	if err != nil || info != nil {
+		t.Errorf("got %+v, %v", info, err)
+	}
+}
+
+func TestReadGitInfoGitFile(t *testing.T) {
+	root := t.TempDir()
+	gitDir := filepath.Join(root, "repo.git", "worktrees", "wt")
+	writeFile(t, gitDir, "HEAD", "ref: refs/heads/wt-branch\n")
+	writeFile(t, gitDir, "commondir", "../..\n")
+	writeFile(t, root, "repo.git/config", "[remote \"origin\"]\n\turl = https://example.com/team/service/\n")
+	worktree := filepath.Join(root, "wt")
+	writeFile(t, worktree, ".git", "gitdir: ../repo.git/worktrees/wt\n")
+
+	info, err := readGitInfo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Repo != "service" || info.Branch != "wt-branch" {
+		t.Errorf("got %+v", info)
+	}
+	if info.Dirty == nil || *info.Dirty {
+		t.Errorf("no index is clean, got %v", info.Dirty)
+	}
+}
+
+func TestWorktreeDirty(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, worktree string)
+		want   bool
+	}{
+		{"clean", func(t *testing.T, worktree string) {}, false},
+		{"modified", func(t *testing.T, worktree string) {
+			writeFile(t, worktree, "main.go", "package main\n\nfunc main() {}\n")
+		}, true},
+		{"same size", func(t *testing.T, worktree string) {
+			writeFile(t, worktree, "sub/dir/a.txt", "b")
+		}, true},
+		{"deleted", func(t *testing.T, worktree string) {
+			os.Remove(filepath.Join(worktree, "main.go"))
+		}, true},
+		{"touched", func(t *testing.T, worktree string) {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(filepath.Join(worktree, "main.go"), later, later)
+		}, false},
+		{"untracked", func(t *testing.T, worktree string) {
+			writeFile(t, worktree, "new.txt", "new")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worktree := fixtureRepo(t, "ref: refs/heads/main\n", "")
+			tt.change(t, worktree)
+			got, err := worktreeDirty(worktree, filepath.Join(worktree, ".git", "index"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIndexVersions(t *testing.T) {
+	worktree := t.TempDir()
+	writeFile(t, worktree, "a", "1")
+	writeFile(t, worktree, "long/enough/to/need/padding.txt", "2")
+	for _, version := range []uint32{2, 3} {
+		writeIndex(t, worktree, worktree, version, "a", "long/enough/to/need/padding.txt")
+		f, err := os.Open(filepath.Join(worktree, "index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readIndex(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		if len(entries) != 2 || entries[0].path != "a" || entries[1].path != "long/enough/to/need/padding.txt" || entries[1].size != 1 {
+			t.Errorf("version %d: got %+v", version, entries)
+		}
+	}
+
+	if _, err := readIndex(bytes.NewReader([]byte("DIRC\x00\x00\x00\x04\x00\x00\x00\x00"))); err != errIndexVersion {
+		t.Errorf("got %v", err)
+	}
+	if _, err := readIndex(bytes.NewReader([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00"))); err == nil {
+		t.Errorf("a file which is not an index must be an error")
+	}
+}
+
+// TestReadGitInfoRealRepository checks the reader against a repository made by git, if it is installed
+func TestReadGitInfoRealRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	worktree := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", worktree, "-c", "user.name=t", "-c", "user.email=t@example.com", "-c", "index.version=2"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "topic")
+	git("remote", "add", "origin", "https://github.com/shirou/k8s-nodeless")
+	writeFile(t, worktree, "a.txt", "a")
+	writeFile(t, worktree, "dir/b.txt", "b")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+
+	info, err := readGitInfo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Repo != "k8s-nodeless" || info.Branch != "topic" || info.Dirty == nil || *info.Dirty {
+		t.Errorf("got %+v, dirty %v", info, info.Dirty)
+	}
+
+	writeFile(t, worktree, "dir/b.txt", "c")
+	info, err = readGitInfo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Dirty == nil || !*info.Dirty {
+		t.Errorf("got dirty %v", info.Dirty)
+	}
+}
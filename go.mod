@@ -3,7 +3,8 @@ module github.com/shirou/k8s-nodeless
 go 1.15
 
 require (
-	github.com/aws/aws-sdk-go v1.36.12
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/gorilla/websocket v1.5.3
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/pkg/errors v0.9.1
 	go.uber.org/zap v1.16.0
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// results of -expect-response-file in the summary
+const (
+	goldenMatch    = "match"
+	goldenMismatch = "mismatch"
+	goldenUpdated  = "updated"
+)
+
+// kinds of a difference between the golden file and the response
+const (
+	diffChanged    = "changed"
+	diffMissing    = "missing"    // in the golden file only
+	diffUnexpected = "unexpected" // in the response only
+)
+
+// maxPrintedDiffs is how many differences are printed, the summary has all of them
+const maxPrintedDiffs = 20
+
+// jsonDiff is a difference between the golden file and the response
+type jsonDiff = schema.ResponseDiff
+
+// jsonPointer is a parsed JSON pointer (RFC 6901). A "*" token matches any key or index.
+type jsonPointer []string
+
+// parseJSONPointer parses s, ex: /items/0/id
+func parseJSONPointer(s string) (jsonPointer, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("JSON pointer must start with /, %q", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return jsonPointer(tokens), nil
+}
+
+// matches returns true if the pointer points to the path
+func (p jsonPointer) matches(path []string) bool {
+	if len(p) != len(path) {
+		return false
+	}
+	for i, t := range p {
+		if t != "*" && t != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatJSONPointer returns the JSON pointer of the path
+func formatJSONPointer(path []string) string {
+	var b strings.Builder
+	for _, t := range path {
+		b.WriteByte('/')
+		b.WriteString(strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1))
+	}
+	return b.String()
+}
+
+// jsonPointers is a repeatable flag of JSON pointers
+type jsonPointers []jsonPointer
+
+func (p *jsonPointers) String() string {
+	s := make([]string, len(*p))
+	for i, ptr := range *p {
+		s[i] = formatJSONPointer(ptr)
+	}
+	return strings.Join(s, " ")
+}
+
+func (p *jsonPointers) Set(v string) error {
+	ptr, err := parseJSONPointer(v)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, ptr)
+	return nil
+}
+
+func (p *jsonPointers) reset() {
+	*p = nil
+}
+
+// decodeJSON decodes a JSON document keeping the numbers as written
+func decodeJSON(buf []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("data after the JSON document")
+	}
+	return doc, nil
+}
+
+// canonicalJSON returns the document indented with the keys sorted, as a golden file is written
+func canonicalJSON(doc interface{}) ([]byte, error) {
+	buf, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// jsonDiffer compares two decoded JSON documents
+type jsonDiffer struct {
+	tolerance float64 // absolute difference numbers may have
+	ignore    []jsonPointer
+	diffs     []jsonDiff
+}
+
+// diffJSON returns the differences of actual from expected, ordered by path. Objects are compared
+// regardless of the order of the keys, arrays element by element, and numbers by value.
+func diffJSON(expected, actual interface{}, tolerance float64, ignore []jsonPointer) []jsonDiff {
+	d := &jsonDiffer{tolerance: tolerance, ignore: ignore}
+	d.diff(nil, expected, actual)
+	return d.diffs
+}
+
+func (d *jsonDiffer) ignored(path []string) bool {
+	for _, p := range d.ignore {
+		if p.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *jsonDiffer) add(path []string, kind string, expected, actual interface{}) {
+	d.diffs = append(d.diffs, jsonDiff{Path: formatJSONPointer(path), Kind: kind, Expected: expected, Actual: actual})
+}
+
+func (d *jsonDiffer) diff(path []string, expected, actual interface{}) {
+	if d.ignored(path) {
+		return
+	}
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		if a, ok := actual.(map[string]interface{}); ok {
+			d.diffObject(path, e, a)
+			return
+		}
+	case []interface{}:
+		if a, ok := actual.([]interface{}); ok {
+			d.diffArray(path, e, a)
+			return
+		}
+	case json.Number:
+		if a, ok := actual.(json.Number); ok {
+			if !numbersEqual(e, a, d.tolerance) {
+				d.add(path, diffChanged, expected, actual)
+			}
+			return
+		}
+	default:
+		if expected == actual {
+			return
+		}
+	}
+	d.add(path, diffChanged, expected, actual)
+}
+
+// child returns the path of a key or an index. It does not share the array of path.
+func child(path []string, token string) []string {
+	ret := make([]string, len(path)+1)
+	copy(ret, path)
+	ret[len(path)] = token
+	return ret
+}
+
+func (d *jsonDiffer) diffObject(path []string, expected, actual map[string]interface{}) {
+	keys := make([]string, 0, len(expected)+len(actual))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	for k := range actual {
+		if _, ok := expected[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := child(path, k)
+		e, inExpected := expected[k]
+		a, inActual := actual[k]
+		switch {
+		case !inActual:
+			if !d.ignored(p) {
+				d.add(p, diffMissing, e, nil)
+			}
+		case !inExpected:
+			if !d.ignored(p) {
+				d.add(p, diffUnexpected, nil, a)
+			}
+		default:
+			d.diff(p, e, a)
+		}
+	}
+}
+
+func (d *jsonDiffer) diffArray(path []string, expected, actual []interface{}) {
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		p := child(path, strconv.Itoa(i))
+		switch {
+		case i >= len(actual):
+			if !d.ignored(p) {
+				d.add(p, diffMissing, expected[i], nil)
+			}
+		case i >= len(expected):
+			if !d.ignored(p) {
+				d.add(p, diffUnexpected, nil, actual[i])
+			}
+		default:
+			d.diff(p, expected[i], actual[i])
+		}
+	}
+}
+
+// numbersEqual returns true if the numbers are equal within the tolerance. 1, 1.0 and 1e0 are equal,
+// and integers beyond the precision of float64 are compared exactly.
+func numbersEqual(a, b json.Number, tolerance float64) bool {
+	ra, okA := new(big.Rat).SetString(string(a))
+	rb, okB := new(big.Rat).SetString(string(b))
+	if !okA || !okB {
+		return a == b
+	}
+	if ra.Cmp(rb) == 0 {
+		return true
+	}
+	if tolerance <= 0 {
+		return false
+	}
+	diff, _ := new(big.Rat).Sub(ra, rb).Float64()
+	return math.Abs(diff) <= tolerance
+}
+
+// formatJSONValue returns the value as compact JSON for a diff
+func formatJSONValue(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return truncateMiddle(string(buf), 200)
+}
+
+// formatJSONDiffs returns the differences one per line, ex:
+//
+//	~ /items/0/price: 10 → 12
+//	- /items/2: {"id":3}
+//	+ /extra: "x"
+func formatJSONDiffs(diffs []jsonDiff) string {
+	var lines []string
+	for i, d := range diffs {
+		if i == maxPrintedDiffs {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(diffs)-i))
+			break
+		}
+		path := d.Path
+		if path == "" {
+			path = "(root)"
+		}
+		switch d.Kind {
+		case diffMissing:
+			lines = append(lines, fmt.Sprintf("  - %s: %s", path, formatJSONValue(d.Expected)))
+		case diffUnexpected:
+			lines = append(lines, fmt.Sprintf("  + %s: %s", path, formatJSONValue(d.Actual)))
+		default:
+			lines = append(lines, fmt.Sprintf("  ~ %s: %s → %s", path, formatJSONValue(d.Expected), formatJSONValue(d.Actual)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// responseGolden compares the response of a sync invocation with a golden file, -expect-response-file
+type responseGolden struct {
+	path      string
+	update    bool    // rewrite the golden file from the response instead of comparing
+	tolerance float64 // absolute difference numbers may have
+	ignore    []jsonPointer
+}
+
+// parseResponseGolden returns the comparison of -expect-response-file, or nil if path is empty
+func parseResponseGolden(path string, update bool, tolerance float64, ignore []jsonPointer) (*responseGolden, error) {
+	if path == "" {
+		if update || tolerance != 0 || len(ignore) > 0 {
+			return nil, fmt.Errorf("-update-golden, -response-tolerance and -response-ignore need -expect-response-file")
+		}
+		return nil, nil
+	}
+	if tolerance < 0 || math.IsNaN(tolerance) {
+		return nil, fmt.Errorf("response-tolerance must not be negative, %v", tolerance)
+	}
+	return &responseGolden{path: path, update: update, tolerance: tolerance, ignore: ignore}, nil
+}
+
+// check compares the response with the golden file, or rewrites the file with -update-golden.
+// It returns the result and the differences. A mismatch is an error of the function.
+func (g *responseGolden) check(payload []byte) (string, []jsonDiff, error) {
+	actual, err := decodeJSON(payload)
+	if err != nil {
+		return goldenMismatch, nil, &functionError{fmt.Errorf("the response is not JSON, %s: %w", truncateMiddle(string(payload), 200), err)}
+	}
+	if g.update {
+		buf, err := canonicalJSON(actual)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(g.path), 0755); err != nil {
+			return "", nil, fmt.Errorf("update-golden: %w", err)
+		}
+		if err := ioutil.WriteFile(g.path, buf, 0644); err != nil {
+			return "", nil, fmt.Errorf("update-golden: %w", err)
+		}
+		logger.Infof("the golden file %s is updated from the response", g.path)
+		return goldenUpdated, nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("expect-response-file: %s does not exist, use -update-golden to write it from the response", g.path)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("expect-response-file: %w", err)
+	}
+	expected, err := decodeJSON(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("expect-response-file: %s is not JSON: %w", g.path, err)
+	}
+
+	diffs := diffJSON(expected, actual, g.tolerance, g.ignore)
+	if len(diffs) == 0 {
+		logger.Infof("the response matches %s", g.path)
+		return goldenMatch, nil, nil
+	}
+	logger.Errorf("the response differs from %s (- expected, + got):\n%s", g.path, formatJSONDiffs(diffs))
+	return goldenMismatch, diffs, &functionError{fmt.Errorf("the response differs from %s at %s", g.path, plural(len(diffs), "path"))}
+}
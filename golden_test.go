@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := decodeJSON([]byte(s))
+	if err != nil {
+		t.Fatalf("%s: %s", s, err)
+	}
+	return v
+}
+
+func mustPointers(t *testing.T, ss ...string) []jsonPointer {
+	t.Helper()
+	var ret jsonPointers
+	for _, s := range ss {
+		if err := ret.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ret
+}
+
+// diffSummary returns the differences as "kind path" for comparison
+func diffSummary(diffs []jsonDiff) []string {
+	var ret []string
+	for _, d := range diffs {
+		ret = append(ret, d.Kind+" "+d.Path)
+	}
+	return ret
+}
+
+func TestParseJSONPointer(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    jsonPointer
+		wantErr bool
+	}{
+		{"/a/b", jsonPointer{"a", "b"}, false},
+		{"/items/0/id", jsonPointer{"items", "0", "id"}, false},
+		{"/a~1b/c~0d", jsonPointer{"a/b", "c~d"}, false},
+		{"/~01", jsonPointer{"~1"}, false}, // ~0 is unescaped after ~1
+		{"/", jsonPointer{""}, false},
+		{"a/b", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONPointer(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q", tt.in, got)
+		}
+		if err == nil && formatJSONPointer(got) != tt.in {
+			t.Errorf("%q: formatted %q", tt.in, formatJSONPointer(got))
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	if _, err := decodeJSON([]byte(`{"a": 1} {"b": 2}`)); err == nil {
+		t.Errorf("data after the document must be an error")
+	}
+	if _, err := decodeJSON([]byte(`{"a": `)); err == nil {
+		t.Errorf("a truncated document must be an error")
+	}
+	v := mustDecodeJSON(t, " {\"n\": 1.50}\n")
+	if n := v.(map[string]interface{})["n"]; n != json.Number("1.50") {
+		t.Errorf("the number must be kept as written, got %#v", n)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	a, err := canonicalJSON(mustDecodeJSON(t, `{"b": [3, {"z": 1, "y": 2}], "a": 1.0, "c": 12345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := canonicalJSON(mustDecodeJSON(t, `{"c":12345678901234567890,"a":1.0,"b":[3,{"y":2,"z":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "a": 1.0,
+  "b": [
+    3,
+    {
+      "y": 2,
+      "z": 1
+    }
+  ],
+  "c": 12345678901234567890
+}
+`
+	if string(a) != want || string(b) != want {
+		t.Errorf("got %s and %s", a, b)
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		expected  string
+		actual    string
+		tolerance float64
+		ignore    []string
+		want      []string
+	}{
+		{"equal", `{"a": 1, "b": [1, 2]}`, `{"b": [1, 2], "a": 1}`, 0, nil, nil},
+		{"changed", `{"a": 1, "b": "x"}`, `{"a": 2, "b": "x"}`, 0, nil, []string{"changed /a"}},
+		{"missing and unexpected", `{"a": 1, "b": 2}`, `{"b": 2, "c": 3}`, 0, nil, []string{"missing /a", "unexpected /c"}},
+		{"type", `{"a": 1}`, `{"a": "1"}`, 0, nil, []string{"changed /a"}},
+		{"null", `{"a": null}`, `{"a": false}`, 0, nil, []string{"changed /a"}},
+		{"null equal", `{"a": null, "b": true}`, `{"a": null, "b": true}`, 0, nil, nil},
+		{"object and array", `{"a": {}}`, `{"a": []}`, 0, nil, []string{"changed /a"}},
+		{"root", `[1]`, `{"a": 1}`, 0, nil, []string{"changed "}},
+		{"root scalar", `"ok"`, `"ng"`, 0, nil, []string{"changed "}},
+
+		{"nested arrays", `{"m": [[1, 2], [3, [4, 5]]]}`, `{"m": [[1, 2], [3, [4, 6]]]}`, 0, nil, []string{"changed /m/1/1/1"}},
+		{"longer array", `[1, 2]`, `[1, 2, 3, 4]`, 0, nil, []string{"unexpected /2", "unexpected /3"}},
+		{"shorter array", `[{"id": 1}, {"id": 2}]`, `[{"id": 1}]`, 0, nil, []string{"missing /1"}},
+		{"array order", `[1, 2]`, `[2, 1]`, 0, nil, []string{"changed /0", "changed /1"}},
+		{"objects in arrays", `[{"a": 1, "b": 2}]`, `[{"b": 2, "a": 1}]`, 0, nil, nil},
+
+		{"number formats", `[1, 1.0, 100, 0.5, -0, 1E2]`, `[1.00, 1, 1e2, 5e-1, 0, 100]`, 0, nil, nil},
+		{"big integers", `[12345678901234567890]`, `[12345678901234567891]`, 0, nil, []string{"changed /0"}},
+		{"big integers equal", `[12345678901234567890]`, `[1.2345678901234567890e19]`, 0, nil, nil},
+		{"beyond float64", `[9007199254740993]`, `[9007199254740992]`, 0, nil, []string{"changed /0"}},
+		{"within tolerance", `{"p": 0.1, "q": 10}`, `{"p": 0.1000001, "q": 10.001}`, 0.01, nil, nil},
+		{"beyond tolerance", `{"p": 0.1}`, `{"p": 0.2}`, 0.01, nil, []string{"changed /p"}},
+		{"tolerance on numbers only", `{"p": "0.1"}`, `{"p": "0.1000001"}`, 0.01, nil, []string{"changed /p"}},
+
+		{"ignore", `{"id": "a", "at": "2024", "v": 1}`, `{"id": "b", "at": "2025", "v": 1}`, 0, []string{"/id", "/at"}, nil},
+		{"ignore missing", `{"id": "a", "v": 1}`, `{"v": 1}`, 0, []string{"/id"}, nil},
+		{"ignore unexpected", `{"v": 1}`, `{"id": "b", "v": 1}`, 0, []string{"/id"}, nil},
+		{"ignore nested", `{"o": {"id": 1, "n": 1}}`, `{"o": {"id": 2, "n": 2}}`, 0, []string{"/o/id"}, []string{"changed /o/n"}},
+		{"ignore subtree", `{"meta": {"t": 1, "u": [1]}, "v": 1}`, `{"meta": {"t": 2}, "v": 1}`, 0, []string{"/meta"}, nil},
+		{"ignore index", `[1, 2, 3]`, `[1, 9, 3]`, 0, []string{"/1"}, nil},
+		{"ignore wildcard", `{"items": [{"id": 1, "n": "a"}, {"id": 2, "n": "b"}]}`, `{"items": [{"id": 7, "n": "a"}, {"id": 8, "n": "c"}]}`, 0, []string{"/items/*/id"}, []string{"changed /items/1/n"}},
+		{"ignore wildcard key", `{"a": {"t": 1}, "b": {"t": 2}}`, `{"a": {"t": 3}, "b": {"t": 4}}`, 0, []string{"/*/t"}, nil},
+		{"ignore exact depth", `{"a": {"id": {"id": 1}}}`, `{"a": {"id": {"id": 2}}}`, 0, []string{"/id"}, []string{"changed /a/id/id"}},
+		{"ignore escaped", `{"a/b": 1, "c~d": 1}`, `{"a/b": 2, "c~d": 2}`, 0, []string{"/a~1b"}, []string{"changed /c~0d"}},
+		{"ignore absent path", `{"v": 1}`, `{"v": 2}`, 0, []string{"/nothing/here"}, []string{"changed /v"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffSummary(diffJSON(mustDecodeJSON(t, tt.expected), mustDecodeJSON(t, tt.actual), tt.tolerance, mustPointers(t, tt.ignore...)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffJSONValues(t *testing.T) {
+	diffs := diffJSON(mustDecodeJSON(t, `{"a": {"x": [1]}, "b": 1}`), mustDecodeJSON(t, `{"b": 2.5, "c": null}`), 0, nil)
+	if len(diffs) != 3 {
+		t.Fatalf("got %+v", diffs)
+	}
+	if d := diffs[0]; d.Kind != diffMissing || formatJSONValue(d.Expected) != `{"x":[1]}` {
+		t.Errorf("got %+v", d)
+	}
+	if d := diffs[1]; d.Kind != diffChanged || d.Expected != json.Number("1") || d.Actual != json.Number("2.5") {
+		t.Errorf("got %+v", d)
+	}
+	if d := diffs[2]; d.Kind != diffUnexpected || d.Actual != nil {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestFormatJSONDiffs(t *testing.T) {
+	diffs := diffJSON(
+		mustDecodeJSON(t, `{"items": [{"price": 10}, {"id": 2}, {"id": 3}], "name": "x"}`),
+		mustDecodeJSON(t, `{"items": [{"price": 12}, {"id": 2}], "name": "x", "extra": "y"}`),
+		0, nil)
+	want := strings.Join([]string{
+		`  + /extra: "y"`,
+		`  ~ /items/0/price: 10 → 12`,
+		`  - /items/2: {"id":3}`,
+	}, "\n")
+	if got := formatJSONDiffs(diffs); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	root := diffJSON(mustDecodeJSON(t, `1`), mustDecodeJSON(t, `"1"`), 0, nil)
+	if got := formatJSONDiffs(root); got != `  ~ (root): 1 → "1"` {
+		t.Errorf("got %s", got)
+	}
+
+	var many []jsonDiff
+	for i := 0; i < maxPrintedDiffs+5; i++ {
+		many = append(many, jsonDiff{Path: "/a", Kind: diffChanged, Expected: 1, Actual: 2})
+	}
+	lines := strings.Split(formatJSONDiffs(many), "\n")
+	if len(lines) != maxPrintedDiffs+1 || lines[maxPrintedDiffs] != "  ... and 5 more" {
+		t.Errorf("got %q", lines[len(lines)-1])
+	}
+}
+
+func TestParseResponseGolden(t *testing.T) {
+	if g, err := parseResponseGolden("", false, 0, nil); g != nil || err != nil {
+		t.Errorf("got %v, %v", g, err)
+	}
+	for _, tt := range []struct {
+		update    bool
+		tolerance float64
+		ignore    []jsonPointer
+	}{{true, 0, nil}, {false, 0.1, nil}, {false, 0, mustPointers(t, "/id")}} {
+		if _, err := parseResponseGolden("", tt.update, tt.tolerance, tt.ignore); err == nil {
+			t.Errorf("%+v needs -expect-response-file", tt)
+		}
+	}
+	if _, err := parseResponseGolden("golden.json", false, -1, nil); err == nil {
+		t.Errorf("a negative tolerance must be an error")
+	}
+}
+
+func TestResponseGoldenCheck(t *testing.T) {
+	setTestLogger(t)
+	path := filepath.Join(t.TempDir(), "golden", "response.json")
+	g := &responseGolden{path: path, ignore: mustPointers(t, "/requestId")}
+
+	if _, _, err := g.check([]byte(`{"ok": true}`)); err == nil || isFunctionError(err) || !strings.Contains(err.Error(), "-update-golden") {
+		t.Errorf("a missing golden file is an error of the run, got %v", err)
+	}
+
+	g.update = true
+	if result, _, err := g.check([]byte(`{"requestId": "r-1", "ok": true, "total": 1.50}`)); err != nil || result != goldenUpdated {
+		t.Fatalf("got %s, %v", result, err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\n  \"ok\": true,\n  \"requestId\": \"r-1\",\n  \"total\": 1.50\n}\n"; string(buf) != want {
+		t.Errorf("got %s", buf)
+	}
+
+	g.update = false
+	if result, diffs, err := g.check([]byte(`{"total": 1.5, "ok": true, "requestId": "r-2"}`)); err != nil || result != goldenMatch || diffs != nil {
+		t.Errorf("got %s, %v, %v", result, diffs, err)
+	}
+	result, diffs, err := g.check([]byte(`{"total": 2, "ok": true, "requestId": "r-3"}`))
+	if result != goldenMismatch || len(diffs) != 1 || !isFunctionError(err) || !strings.Contains(err.Error(), "at 1 path") {
+		t.Errorf("got %s, %+v, %v", result, diffs, err)
+	}
+	if result, _, err := g.check([]byte(`not json`)); result != goldenMismatch || !isFunctionError(err) {
+		t.Errorf("a response which is not JSON fails the function, got %s, %v", result, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"ok": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.check([]byte(`{"ok": true}`)); err == nil || isFunctionError(err) {
+		t.Errorf("a broken golden file is an error of the run, got %v", err)
+	}
+}
+
+func TestParseArgsExpectResponseFile(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-expect-response-file", "golden.json", "-response-ignore", "/id", "-response-ignore", "/items/*/at", "-response-tolerance", "0.5"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := config.responseGolden
+	if g == nil || g.path != "golden.json" || g.tolerance != 0.5 || len(g.ignore) != 2 || g.update {
+		t.Errorf("got %+v", g)
+	}
+	for _, args := range [][]string{
+		{"-update-golden"},
+		{"-expect-response-file", "golden.json", "-invocation-type", "event"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil {
+			t.Errorf("%v: an error expected", args)
+		}
+	}
+}
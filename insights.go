@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// modes of -insights-metrics
+const (
+	insightsAuto = "auto" // read when the function has the extension layer
+	insightsOn   = "on"
+	insightsOff  = "off"
+)
+
+const (
+	insightsLogGroup     = "/aws/lambda-insights"
+	insightsLayerName    = "LambdaInsightsExtension" // in the ARN of the layer of the extension
+	insightsPollInterval = 2 * time.Second
+	insightsTimeout      = 30 * time.Second // the extension writes the event after the invocation
+)
+
+type insightsMetrics = schema.InsightsMetrics
+
+// insightsEvent is the performance event of an invocation, which the extension writes in the
+// embedded metric format
+type insightsEvent struct {
+	EventType    string `json:"event_type"`
+	FunctionName string `json:"function_name"`
+	RequestID    string `json:"request_id"`
+	insightsMetrics
+}
+
+// parseInsightsEvent parses a line of the log group of Lambda Insights. ok is false unless it is
+// the performance event of an invocation.
+func parseInsightsEvent(message string) (insightsEvent, bool) {
+	var e insightsEvent
+	if err := json.Unmarshal([]byte(strings.TrimSpace(message)), &e); err != nil {
+		return insightsEvent{}, false
+	}
+	if e.EventType != "performance" || e.RequestID == "" {
+		return insightsEvent{}, false
+	}
+	return e, true
+}
+
+// hasInsightsLayer tells whether one of the layers is the Lambda Insights extension
+func hasInsightsLayer(layers []*lambda.Layer) bool {
+	for _, l := range layers {
+		if strings.Contains(aws.StringValue(l.Arn), ":layer:"+insightsLayerName) {
+			return true
+		}
+	}
+	return false
+}
+
+// insightsFilter returns the filter pattern of the performance event of the request
+func insightsFilter(requestID string) string {
+	return fmt.Sprintf(`{ $.request_id = "%s" }`, requestID)
+}
+
+// readInsights reads the performance event of the invocation from the log group of Lambda
+// Insights into sl.insights. A missing group or event is a notice, it never fails the run.
+func (sl *AWSServerless) readInsights(ctx context.Context, logs logsAPI) error {
+	if sl.requestID == "" {
+		logger.Infof("no Lambda Insights metrics, the request id of the invocation is not known")
+		return nil
+	}
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(insightsLogGroup),
+		FilterPattern: aws.String(insightsFilter(sl.requestID)),
+		StartTime:     aws.Int64(aws.TimeUnixMilli(sl.startTime)),
+	}
+	deadline := time.Now().Add(sl.insightsTimeout)
+	for {
+		var found *insightsEvent
+		err := logs.FilterLogEventsPagesWithContext(ctx, input, func(out *cloudwatchlogs.FilterLogEventsOutput, last bool) bool {
+			for _, e := range out.Events {
+				if ev, ok := parseInsightsEvent(aws.StringValue(e.Message)); ok && ev.RequestID == sl.requestID {
+					found = &ev
+					return false
+				}
+			}
+			return true
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			logger.Infof("no Lambda Insights metrics, %s does not exist. the extension has never run in the region", insightsLogGroup)
+			return nil
+		}
+		if err != nil {
+			logger.Warnf("no Lambda Insights metrics, %s: %s", insightsLogGroup, err)
+			return nil
+		}
+		if found != nil {
+			m := found.insightsMetrics
+			sl.insights = &m
+			logger.Infof("Lambda Insights: cpu %.0fms (user %.0fms, system %.0fms), memory %.0f%% (%.0f of %.0f MB), /tmp %.0f bytes, network rx %.0f tx %.0f bytes",
+				m.CPUTotalTime, m.CPUUserTime, m.CPUSystemTime, m.MemoryUtilization, m.UsedMemoryMax, m.TotalMemory, m.TmpUsed, m.RxBytes, m.TxBytes)
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			logger.Infof("no Lambda Insights metrics of %s in %s after %s, the function may not have the extension", sl.requestID, insightsLogGroup, sl.insightsTimeout)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sl.insightsPoll):
+		}
+	}
+}
+
+// wantsInsights tells whether the run reads the Lambda Insights metrics, by -insights-metrics or
+// by the layers of the function
+func (sl *AWSServerless) wantsInsights(ctx context.Context) bool {
+	if sl.concurrent != nil {
+		logger.Debugf("the Lambda Insights metrics are read for a single request, not for -concurrency or -payload-ndjson")
+		return false
+	}
+	switch sl.insightsMode {
+	case insightsOn:
+		return true
+	case insightsOff:
+		return false
+	}
+	meta, err := sl.metadata.get(ctx, sl.funcName, "")
+	if err != nil {
+		logger.Debugf("can not tell whether %s has the Lambda Insights extension: %s", sl.funcName, err)
+		return false
+	}
+	return hasInsightsLayer(meta.Layers)
+}
+
+// planInsights returns the calls which read the Lambda Insights metrics
+func (sl *AWSServerless) planInsights() ([]plannedCall, error) {
+	note := fmt.Sprintf("every %s up to %s until the performance event of the request is written", insightsPollInterval, insightsTimeout)
+	if sl.insightsMode == insightsAuto {
+		note = fmt.Sprintf("only if the function has the %s layer, %s", insightsLayerName, note)
+	}
+	return []plannedCall{{
+		Service:   "logs",
+		Operation: "FilterLogEvents",
+		Params:    []planParam{{"LogGroupName", insightsLogGroup}, {"FilterPattern", insightsFilter("the request id")}},
+		Note:      note,
+	}}, nil
+}
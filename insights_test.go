@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+func TestParseInsightsEvent(t *testing.T) {
+	for _, tc := range []struct {
+		file      string
+		ok        bool
+		requestID string
+		want      insightsMetrics
+	}{
+		{"cold_start.json", true, "8f5ee3a2-4c1d-4a57-9a3e-0d5c1f1d2b3e", insightsMetrics{
+			CPUTotalTime: 605, CPUUserTime: 562, CPUSystemTime: 43,
+			MemoryUtilization: 41, UsedMemoryMax: 52, TotalMemory: 128,
+			TmpUsed: 13631488, RxBytes: 16384, TxBytes: 8192, TotalNetwork: 24576,
+		}},
+		{"warm.json", true, "c0ffee00-1111-2222-3333-444455556666", insightsMetrics{
+			CPUTotalTime: 11.25, CPUUserTime: 9.5, CPUSystemTime: 1.75,
+			MemoryUtilization: 21.5, UsedMemoryMax: 55, TotalMemory: 256,
+		}},
+		{"shutdown.json", false, "", insightsMetrics{}}, // a platform event, not of an invocation
+		{"not_json.txt", false, "", insightsMetrics{}},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", "insights", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := parseInsightsEvent(string(b))
+		if ok != tc.ok {
+			t.Errorf("%s: got %v", tc.file, ok)
+			continue
+		}
+		if e.RequestID != tc.requestID || e.insightsMetrics != tc.want {
+			t.Errorf("%s: got %s %+v", tc.file, e.RequestID, e.insightsMetrics)
+		}
+	}
+}
+
+func TestHasInsightsLayer(t *testing.T) {
+	layers := []*lambda.Layer{
+		{Arn: aws.String("arn:aws:lambda:us-east-1:123456789012:layer:deps:3")},
+		{Arn: aws.String("arn:aws:lambda:us-east-1:580247275435:layer:LambdaInsightsExtension:38")},
+	}
+	if !hasInsightsLayer(layers) {
+		t.Errorf("the extension layer must be found")
+	}
+	if hasInsightsLayer(layers[:1]) || hasInsightsLayer(nil) {
+		t.Errorf("no extension layer")
+	}
+}
+
+func TestParseArgsInsightsMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, insightsAuto},
+		{[]string{"-insights-metrics"}, insightsOn},
+		{[]string{"-insights-metrics=false"}, insightsOff},
+	} {
+		config, err := parseArgs(append([]string{"-func", "f"}, tc.args...), func(string) string { return "" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.insightsMetrics != tc.want {
+			t.Errorf("%v: got %s", tc.args, config.insightsMetrics)
+		}
+	}
+}
+
+// insightsLogs serves the Lambda Insights log group, whose event appears at the poll of appear
+type insightsLogs struct {
+	windowedLogs
+	polls   int
+	appear  int
+	message string
+	missing bool
+	pattern string
+}
+
+func (l *insightsLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.polls++
+	l.pattern = aws.StringValue(input.FilterPattern)
+	if l.missing {
+		return awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	if l.polls >= l.appear {
+		out.Events = []*cloudwatchlogs.FilteredLogEvent{{Message: aws.String(l.message)}}
+	}
+	fn(out, true)
+	return nil
+}
+
+func TestReadInsights(t *testing.T) {
+	setTestLogger(t)
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "insights", "cold_start.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServerless := func() *AWSServerless {
+		return &AWSServerless{
+			funcName:        "orders-fn",
+			requestID:       "8f5ee3a2-4c1d-4a57-9a3e-0d5c1f1d2b3e",
+			startTime:       time.Now(),
+			insightsPoll:    time.Millisecond,
+			insightsTimeout: 50 * time.Millisecond,
+		}
+	}
+
+	// the event is written a while after the invocation
+	sl := newServerless()
+	logs := &insightsLogs{appear: 3, message: string(b)}
+	if err := sl.readInsights(context.Background(), logs); err != nil {
+		t.Fatal(err)
+	}
+	if sl.insights == nil || sl.insights.CPUTotalTime != 605 || logs.polls != 3 {
+		t.Errorf("got %+v after %d polls", sl.insights, logs.polls)
+	}
+	if want := `{ $.request_id = "8f5ee3a2-4c1d-4a57-9a3e-0d5c1f1d2b3e" }`; logs.pattern != want {
+		t.Errorf("got %s", logs.pattern)
+	}
+
+	// no group, no event or the event of another request is a notice
+	for name, logs := range map[string]*insightsLogs{
+		"no group":      {missing: true},
+		"no event":      {appear: 1 << 20},
+		"other request": {appear: 1, message: `{"event_type":"performance","request_id":"other","cpu_total_time":1}`},
+	} {
+		sl := newServerless()
+		if err := sl.readInsights(context.Background(), logs); err != nil || sl.insights != nil {
+			t.Errorf("%s: got %+v, %v", name, sl.insights, err)
+		}
+		if name == "no group" && logs.polls != 1 {
+			t.Errorf("a missing group is not polled again, got %d polls", logs.polls)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// payloadMarkerRe is the line a function logs to echo the hash of the payload it received, ex:
+//
+//	console.log(`NODELESS_PAYLOAD_SHA256=${crypto.createHash('sha256').update(rawEvent).digest('hex')}`)
+var payloadMarkerRe = regexp.MustCompile(`NODELESS_PAYLOAD_SHA256=([0-9a-fA-F]{64})\b`)
+
+// results of the payload integrity check
+const (
+	integrityMatch    = "match"
+	integrityMismatch = "mismatch"
+	integrityAbsent   = "absent" // the function does not log the marker
+)
+
+// payloadHash returns the SHA-256 of the payload in hex
+func payloadHash(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// payloadIntegrity is a subscriber which compares the hash of the sent payload
+// with the hash the function logged by the marker line
+type payloadIntegrity struct {
+	sent string
+
+	mu       sync.Mutex
+	received string // hash in the first marker line
+}
+
+func newPayloadIntegrity(payload string) *payloadIntegrity {
+	return &payloadIntegrity{sent: payloadHash(payload)}
+}
+
+func (p *payloadIntegrity) handle(ev busEvent) error {
+	le, ok := ev.(logEvent)
+	if !ok {
+		return nil
+	}
+	m := payloadMarkerRe.FindStringSubmatch(le.Message)
+	if len(m) != 2 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.received == "" {
+		p.received = strings.ToLower(m[1])
+	}
+	return nil
+}
+
+// result returns the result of the check and the received hash
+func (p *payloadIntegrity) result() (string, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.received == "":
+		return integrityAbsent, ""
+	case p.received == p.sent:
+		return integrityMatch, p.received
+	}
+	return integrityMismatch, p.received
+}
+
+// check warns on a mismatch. If required, a mismatch or an absent marker is an error.
+func (p *payloadIntegrity) check(required bool) error {
+	result, received := p.result()
+	switch result {
+	case integrityMismatch:
+		if required {
+			return fmt.Errorf("payload integrity: sent sha256:%s but the function received sha256:%s", p.sent, received)
+		}
+		logger.Warnf("payload integrity: sent sha256:%s but the function received sha256:%s", p.sent, received)
+	case integrityAbsent:
+		if required {
+			return fmt.Errorf("payload integrity: the function did not log NODELESS_PAYLOAD_SHA256")
+		}
+	}
+	return nil
+}
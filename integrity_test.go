@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPayloadIntegrity(t *testing.T) {
+	setTestLogger(t)
+	payload := `{"key":"value"}`
+	sum := payloadHash(payload)
+	other := payloadHash("other")
+
+	tests := []struct {
+		name     string
+		lines    []string
+		want     string
+		errIfReq bool
+	}{
+		{"present", []string{"hello", "2021-01-01T00:00:00Z\tINFO\tNODELESS_PAYLOAD_SHA256=" + strings.ToUpper(sum)}, integrityMatch, false},
+		{"absent", []string{"hello", "NODELESS_PAYLOAD_SHA256=short"}, integrityAbsent, true},
+		{"mismatched", []string{"NODELESS_PAYLOAD_SHA256=" + other, "NODELESS_PAYLOAD_SHA256=" + sum}, integrityMismatch, true},
+	}
+	for _, tt := range tests {
+		p := newPayloadIntegrity(payload)
+		for _, line := range tt.lines {
+			p.handle(logEvent{Message: line})
+		}
+		p.handle(runCompleted{})
+		if got, _ := p.result(); got != tt.want {
+			t.Errorf("%s: got %s", tt.name, got)
+		}
+		if err := p.check(false); err != nil {
+			t.Errorf("%s: must not fail unless required, %s", tt.name, err)
+		}
+		if err := p.check(true); (err != nil) != tt.errIfReq {
+			t.Errorf("%s: required, got %v", tt.name, err)
+		}
+	}
+}
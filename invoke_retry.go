@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const (
+	defaultInvokeMaxAttempts = 5
+	defaultInvokeMaxElapsed  = 2 * time.Minute
+	// throttledInvokeBackoff is the first wait before re-invoking a throttled invocation, doubled by each attempt
+	throttledInvokeBackoff    = time.Second
+	maxThrottledInvokeBackoff = 30 * time.Second
+)
+
+// transientInvokeCodes are the error codes of Invoke which a later attempt may not hit, as the
+// concurrency or the capacity is released. Other errors, ex: ResourceNotFoundException, fail at once.
+var transientInvokeCodes = map[string]bool{
+	lambda.ErrCodeTooManyRequestsException:  true,
+	lambda.ErrCodeEC2ThrottledException:     true,
+	lambda.ErrCodeServiceException:          true,
+	lambda.ErrCodeResourceNotReadyException: true,
+	"ThrottlingException":                   true,
+}
+
+// invokeRetryPolicy is how an invocation rejected with a transient error is retried
+type invokeRetryPolicy struct {
+	maxAttempts int           // of Invoke, 1 does not retry
+	maxElapsed  time.Duration // since the first attempt, no retry waits beyond it
+	backoff     func(attempt int) time.Duration
+}
+
+func defaultInvokeRetryPolicy() invokeRetryPolicy {
+	return invokeRetryPolicy{maxAttempts: defaultInvokeMaxAttempts, maxElapsed: defaultInvokeMaxElapsed, backoff: throttledBackoff}
+}
+
+// throttledBackoff returns the exponential wait before the next attempt with equal jitter, so the
+// invocations of several runs throttled at once do not come back at once
+func throttledBackoff(attempt int) time.Duration {
+	wait := throttledInvokeBackoff << uint(attempt-1)
+	if wait > maxThrottledInvokeBackoff || wait <= 0 {
+		wait = maxThrottledInvokeBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// isTransientInvokeError returns true if the Invoke error may go away by itself
+func isTransientInvokeError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && transientInvokeCodes[aerr.Code()]
+}
+
+// do calls invoke until it succeeds, fails with a permanent error, or the attempts or the elapsed time
+// run out. A cancellation of ctx ends the wait at once.
+func (p invokeRetryPolicy) do(ctx context.Context, invoke func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := invoke()
+		if err == nil || !isTransientInvokeError(err) {
+			return err
+		}
+		if attempt >= p.maxAttempts {
+			return fmt.Errorf("still rejected after %d attempts: %w", attempt, err)
+		}
+		wait := p.backoff(attempt)
+		if elapsed := time.Since(start); elapsed+wait > p.maxElapsed {
+			return fmt.Errorf("still rejected after %d attempts in %s: %w", attempt, elapsed.Round(time.Millisecond), err)
+		}
+		logger.Warnf("attempt %d/%d of Invoke is rejected by %s, retry after %s", attempt, p.maxAttempts, err.(awserr.Error).Code(), wait.Round(time.Millisecond))
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// throttledInvoke fails Invoke with errs in order, then succeeds
+type throttledInvoke struct {
+	errs  []error
+	calls int
+}
+
+func (f *throttledInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200), Payload: []byte(`{}`)}, nil
+}
+
+func throttled() error {
+	return awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.", nil)
+}
+
+func TestInvokeRetry(t *testing.T) {
+	setTestLogger(t)
+	var waits []time.Duration
+	policy := invokeRetryPolicy{maxAttempts: 3, maxElapsed: time.Minute, backoff: func(attempt int) time.Duration {
+		waits = append(waits, time.Duration(attempt)*time.Millisecond)
+		return time.Duration(attempt) * time.Millisecond
+	}}
+	sl := &AWSServerless{funcName: "orders-fn", phases: newPhaseTracker(time.Now()), invokeRetry: policy}
+
+	api := &throttledInvoke{errs: []error{throttled(), awserr.New(lambda.ErrCodeEC2ThrottledException, "", nil)}}
+	if _, _, err := sl.invoke(context.Background(), api, lambda.InvocationTypeRequestResponse); err != nil || api.calls != 3 || len(waits) != 2 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+
+	api = &throttledInvoke{errs: []error{throttled(), throttled(), throttled()}}
+	_, _, err := sl.invoke(context.Background(), api, lambda.InvocationTypeRequestResponse)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") || api.calls != 3 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+
+	// a permanent error is not retried
+	api = &throttledInvoke{errs: []error{awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)}}
+	if _, _, err := sl.invoke(context.Background(), api, lambda.InvocationTypeRequestResponse); err == nil || api.calls != 1 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+	api = &throttledInvoke{errs: []error{errors.New("connection reset")}}
+	if _, _, err := sl.invoke(context.Background(), api, lambda.InvocationTypeRequestResponse); err == nil || api.calls != 1 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+}
+
+func TestInvokeRetryLimits(t *testing.T) {
+	setTestLogger(t)
+	// no wait goes beyond the max elapsed time
+	policy := invokeRetryPolicy{maxAttempts: 10, maxElapsed: time.Second, backoff: func(int) time.Duration { return 2 * time.Second }}
+	calls := 0
+	err := policy.do(context.Background(), func() error { calls++; return throttled() })
+	if err == nil || !strings.Contains(err.Error(), "after 1 attempts in") || calls != 1 {
+		t.Errorf("got %v after %d calls", err, calls)
+	}
+
+	// the cancellation ends the wait at once
+	policy = invokeRetryPolicy{maxAttempts: 10, maxElapsed: 2 * time.Hour, backoff: func(int) time.Duration { return time.Hour }}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- policy.do(ctx, throttled) }()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backoff is not aborted by the cancellation")
+	}
+}
+
+func TestThrottledBackoff(t *testing.T) {
+	for attempt, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: maxThrottledInvokeBackoff, 100: maxThrottledInvokeBackoff} {
+		for i := 0; i < 20; i++ {
+			if got := throttledBackoff(attempt); got < base/2 || got > base {
+				t.Errorf("attempt %d: got %s", attempt, got)
+			}
+		}
+	}
+}
+
+// failingInvoke answers a function error to the first failures invocations, then succeeds
+type failingInvoke struct {
+	failures int
+	calls    int
+}
+
+func (f *failingInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return &lambda.InvokeOutput{StatusCode: aws.Int64(200), FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage": "downstream is down"}`)}, nil
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200), Payload: []byte(`{"ok": true}`)}, nil
+}
+
+func TestInvokeWithRetryOnFailure(t *testing.T) {
+	logs := setTestLogger(t)
+	newRun := func() *AWSServerless {
+		return &AWSServerless{
+			funcName:       "orders-fn",
+			phases:         newPhaseTracker(time.Now()),
+			summary:        newSummaryBuilder(),
+			invokeRetry:    invokeRetryPolicy{maxAttempts: 1, maxElapsed: time.Minute},
+			completion:     completionResponse,
+			retryOnFailure: true,
+			maxAttempts:    3,
+			retryDelay:     time.Millisecond,
+		}
+	}
+
+	sl := newRun()
+	api := &failingInvoke{failures: 2}
+	if err := sl.invokeWithRetry(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if api.calls != 3 || len(sl.attempts) != 3 || !sl.attempts[0].Retry || sl.attempts[1].FunctionError != "Unhandled" || sl.attempts[2].Retry {
+		t.Errorf("%d calls, attempts %+v", api.calls, sl.attempts)
+	}
+	if logs.FilterMessageSnippet("failed with Unhandled, retry after 1ms").Len() != 2 || logs.FilterMessageSnippet("attempt 3/3 succeeded").Len() != 1 {
+		t.Errorf("attempts are not logged: %v", logs.All())
+	}
+	// each attempt records its own invocation, after the wait of the retry
+	for i, a := range sl.attempts {
+		if a.Phases == nil || !a.Phases.InvokeAPI.Known {
+			t.Fatalf("attempt %d has no invoke phase: %+v", i+1, a.Phases)
+		}
+	}
+	if first, last := sl.attempts[0].Phases.Total, sl.attempts[2].Phases.Total; last < first+2*time.Millisecond {
+		t.Errorf("the phases of the last attempt are of the first one, total %s and %s", first, last)
+	}
+
+	sl = newRun()
+	api = &failingInvoke{failures: 5}
+	err := sl.invokeWithRetry(context.Background(), api)
+	if !isFunctionError(err) || !strings.Contains(err.Error(), "still fails after 3 attempts") || api.calls != 3 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+	if len(sl.attempts) != 3 || sl.attempts[2].Retry {
+		t.Errorf("attempts %+v", sl.attempts)
+	}
+
+	// an error of the invocation itself is permanent
+	sl = newRun()
+	notFound := &throttledInvoke{errs: []error{awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)}}
+	if err := sl.invokeWithRetry(context.Background(), notFound); err == nil || isFunctionError(err) || notFound.calls != 1 {
+		t.Errorf("got %v after %d calls", err, notFound.calls)
+	}
+
+	// without -retry-on-failure, a function error ends the retry of -retry-if-response
+	sl = newRun()
+	sl.retryOnFailure = false
+	sl.retryIf = mustParseExpr(t, ".retry == true")
+	api = &failingInvoke{failures: 1}
+	if err := sl.invokeWithRetry(context.Background(), api); !isFunctionError(err) || api.calls != 1 {
+		t.Errorf("got %v after %d calls", err, api.calls)
+	}
+}
+
+// numberedInvoke answers the number of the call as the payload of a function error to the first
+// failures invocations, then succeeds with it
+type numberedInvoke struct {
+	failures int
+	calls    int
+}
+
+func (f *numberedInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.calls++
+	payload := []byte(fmt.Sprintf(`{"call": %d}`, f.calls))
+	if f.calls <= f.failures {
+		return &lambda.InvokeOutput{StatusCode: aws.Int64(200), FunctionError: aws.String("Unhandled"), Payload: payload}, nil
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200), Payload: payload}, nil
+}
+
+func TestInvokeWithRetryOutputStdout(t *testing.T) {
+	setTestLogger(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	newRun := func() *AWSServerless {
+		return &AWSServerless{
+			funcName:       "orders-fn",
+			phases:         newPhaseTracker(time.Now()),
+			summary:        newSummaryBuilder(),
+			invokeRetry:    invokeRetryPolicy{maxAttempts: 1, maxElapsed: time.Minute},
+			completion:     completionResponse,
+			output:         outputStdout,
+			retryOnFailure: true,
+			maxAttempts:    3,
+			retryDelay:     time.Millisecond,
+		}
+	}
+	if err := newRun().invokeWithRetry(context.Background(), &numberedInvoke{failures: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// the attempts fail to the end, the error document of the last one is written
+	if err := newRun().invokeWithRetry(context.Background(), &numberedInvoke{failures: 5}); !isFunctionError(err) {
+		t.Fatalf("got %v", err)
+	}
+	w.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"call\": 3}\n{\"call\": 3}\n"; string(got) != want {
+		t.Errorf("only the last attempt must be written once, got %q", got)
+	}
+}
@@ -4,5 +4,13 @@ import "context"
 
 // Invoker is an interface for serverless functions
 type Invoker interface {
-	Invoke(ctx context.Context)
+	Invoke(ctx context.Context) error
+	Capabilities() Capabilities
+}
+
+// consoleInvoker is an Invoker which prints the logs through an emitter, whose rules of -rules-file are
+// reloaded while it runs
+type consoleInvoker interface {
+	Invoker
+	consoleEmitter() *emitter
 }
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	alibabaFCAPIVersion     = "2016-08-15"
+	alibabaSLSAPIVersion    = "0.6.0"
+	alibabaAPITimeout       = 30 * time.Second
+	alibabaInvokeTimeout    = 10 * time.Minute // the longest timeout of a function invoked synchronously
+	alibabaLogPollInterval  = 3 * time.Second
+	alibabaLogWait          = 2 * time.Minute // SLS indexes the logs in seconds
+	alibabaLogLookback      = time.Minute     // clock skew allowed to the timestamps of the logs
+	alibabaLogPageSize      = 100
+	alibabaRequestIDHeader  = "X-Fc-Request-Id"
+	alibabaErrorTypeHeader  = "X-Fc-Error-Type"
+	alibabaAccessKeyIDEnv   = "ALIBABA_CLOUD_ACCESS_KEY_ID"
+	alibabaAccessSecretEnv  = "ALIBABA_CLOUD_ACCESS_KEY_SECRET"
+	alibabaSecurityTokenEnv = "ALIBABA_CLOUD_SECURITY_TOKEN"
+)
+
+var (
+	// the lines Function Compute logs around each invocation, like START and END of Lambda
+	fcStartRequestRe = regexp.MustCompile(`^FC Invoke Start RequestId: (\S+)`)
+	fcEndRequestRe   = regexp.MustCompile(`^FC Invoke End RequestId: (\S+)`)
+)
+
+// alibabaFunctionName is SERVICE/FUNCTION, the Function Compute service and the function in it
+type alibabaFunctionName struct {
+	Service  string
+	Function string
+}
+
+// parseAlibabaFunctionName parses SERVICE/FUNCTION
+func parseAlibabaFunctionName(s string) (alibabaFunctionName, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return alibabaFunctionName{}, fmt.Errorf("function name must be SERVICE/FUNCTION, %s", s)
+	}
+	return alibabaFunctionName{Service: parts[0], Function: parts[1]}, nil
+}
+
+func (n alibabaFunctionName) String() string {
+	return n.Service + "/" + n.Function
+}
+
+// alibabaCredentials is an AccessKey pair, and the token of an STS one
+type alibabaCredentials struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+}
+
+// findAlibabaCredentials reads the credentials from the environment variables the Alibaba Cloud SDKs read
+func findAlibabaCredentials(getenv func(string) string) (alibabaCredentials, error) {
+	creds := alibabaCredentials{
+		AccessKeyID:     getenv(alibabaAccessKeyIDEnv),
+		AccessKeySecret: getenv(alibabaAccessSecretEnv),
+		SecurityToken:   getenv(alibabaSecurityTokenEnv),
+	}
+	if creds.AccessKeyID == "" || creds.AccessKeySecret == "" {
+		return alibabaCredentials{}, fmt.Errorf("%s and %s are required by vendor alibaba", alibabaAccessKeyIDEnv, alibabaAccessSecretEnv)
+	}
+	return creds, nil
+}
+
+// signature returns the base64 HMAC of the string to sign
+func (c alibabaCredentials) signature(h func() hash.Hash, stringToSign string) string {
+	mac := hmac.New(h, []byte(c.AccessKeySecret))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalHeaders returns the headers of the prefixes as sorted "key:value\n" lines
+func canonicalHeaders(header http.Header, prefixes ...string) string {
+	var keys []string
+	for k := range header {
+		lk := strings.ToLower(k)
+		for _, p := range prefixes {
+			if strings.HasPrefix(lk, p) {
+				keys = append(keys, lk)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + ":" + strings.TrimSpace(header.Get(k)) + "\n")
+	}
+	return b.String()
+}
+
+// signFC signs a request to Function Compute
+func (c alibabaCredentials) signFC(req *http.Request) {
+	if c.SecurityToken != "" {
+		req.Header.Set("X-Fc-Security-Token", c.SecurityToken)
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		canonicalHeaders(req.Header, "x-fc-") + req.URL.Path,
+	}, "\n")
+	req.Header.Set("Authorization", "FC "+c.AccessKeyID+":"+c.signature(sha256.New, stringToSign))
+}
+
+// signSLS signs a request to Log Service
+func (c alibabaCredentials) signSLS(req *http.Request) {
+	if c.SecurityToken != "" {
+		req.Header.Set("X-Acs-Security-Token", c.SecurityToken)
+	}
+	req.Header.Set("X-Log-Apiversion", alibabaSLSAPIVersion)
+	req.Header.Set("X-Log-Signaturemethod", "hmac-sha1")
+	req.Header.Set("X-Log-Bodyrawsize", "0")
+
+	resource := req.URL.Path
+	if q := req.URL.Query(); len(q) > 0 {
+		keys := make([]string, 0, len(q))
+		for k := range q {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		params := make([]string, 0, len(keys))
+		for _, k := range keys {
+			params = append(params, k+"="+q.Get(k))
+		}
+		resource += "?" + strings.Join(params, "&")
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		canonicalHeaders(req.Header, "x-log-", "x-acs-") + resource,
+	}, "\n")
+	req.Header.Set("Authorization", "LOG "+c.AccessKeyID+":"+c.signature(sha1.New, stringToSign))
+}
+
+// alibabaLog is a log of the logstore of a function
+type alibabaLog struct {
+	Time    int64 // seconds since the epoch
+	Message string
+}
+
+// parseAlibabaLogs parses the response of GetLogs, a JSON array of logs whose fields are strings
+// except __time__
+func parseAlibabaLogs(body []byte) ([]alibabaLog, error) {
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	ret := make([]alibabaLog, 0, len(raw))
+	for _, r := range raw {
+		var l alibabaLog
+		switch t := r["__time__"].(type) {
+		case float64:
+			l.Time = int64(t)
+		case string:
+			l.Time, _ = strconv.ParseInt(t, 10, 64)
+		}
+		if m, ok := r["message"].(string); ok {
+			l.Message = strings.TrimRight(m, "\n")
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+// AlibabaServerless invokes a function of Alibaba Cloud Function Compute and tails the logstore of
+// its service in Log Service for the request id of the invocation
+type AlibabaServerless struct {
+	name      alibabaFunctionName
+	payload   string
+	accountID string
+	region    string
+
+	creds    alibabaCredentials
+	client   *http.Client
+	fcURL    string
+	slsURL   func(project string) string
+	logPoll  time.Duration
+	logWait  time.Duration
+	project  string
+	logstore string
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	requestID    string
+	errorType    string
+	statusCode   int
+	duration     time.Duration
+	received     int
+	startSeen    bool
+	endSeen      bool
+	logsComplete bool
+}
+
+var _ consoleInvoker = (*AlibabaServerless)(nil)
+
+// NewAlibabaServerless returns new Serverless struct for Alibaba Cloud Function Compute
+func NewAlibabaServerless(config *Config) (*AlibabaServerless, error) {
+	name, err := parseAlibabaFunctionName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.alibabaAccountID == "" || config.alibabaRegion == "" {
+		return nil, fmt.Errorf("vendor alibaba needs -alibaba-cloud-account-id and -alibaba-cloud-region-id")
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Function Compute does not log")
+	}
+	creds, err := findAlibabaCredentials(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	// every query returns the logs since the start again
+	em, err := newEmitter(logger, config.rules, 2*alibabaLogLookback+alibabaInvokeTimeout+alibabaLogWait)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	region := config.alibabaRegion
+	return &AlibabaServerless{
+		name:      name,
+		payload:   config.payload,
+		accountID: config.alibabaAccountID,
+		region:    region,
+		creds:     creds,
+		client:    &http.Client{Timeout: alibabaAPITimeout},
+		fcURL:     fmt.Sprintf("https://%s.%s.fc.aliyuncs.com", config.alibabaAccountID, region),
+		slsURL: func(project string) string {
+			return fmt.Sprintf("https://%s.%s.log.aliyuncs.com", project, region)
+		},
+		logPoll:          alibabaLogPollInterval,
+		logWait:          alibabaLogWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}, nil
+}
+
+// Capabilities returns the options Function Compute supports
+func (sl *AlibabaServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorAlibaba]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *AlibabaServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// Invoke calls the function and tails its logs
+func (sl *AlibabaServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name.String(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	if err := sl.findLogstore(ctx); err != nil {
+		return err
+	}
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	start := time.Now()
+	body, callErr := sl.call(ctx)
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	// the logs of a failed function are what explains the failure
+	if callErr == nil {
+		callErr = sl.checkResponse(body)
+	}
+	if sl.logstore != "" && sl.requestID != "" {
+		if err := sl.tailLogs(ctx, start.Add(-alibabaLogLookback)); err != nil {
+			return err
+		}
+	}
+	if callErr != nil {
+		return callErr
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// do sends the request signed for Function Compute, and returns the response body
+func (sl *AlibabaServerless) do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	sl.creds.signFC(req)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// findLogstore reads the project and the logstore of SLS which the service logs to
+func (sl *AlibabaServerless) findLogstore(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, sl.fcURL+"/"+alibabaFCAPIVersion+"/services/"+url.PathEscape(sl.name.Service), nil)
+	if err != nil {
+		return err
+	}
+	resp, body, err := sl.do(ctx, sl.client, req)
+	if err != nil {
+		return fmt.Errorf("get service %s: %w", sl.name.Service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get service %s: %s: %s", sl.name.Service, resp.Status, truncateMiddle(string(body), 512))
+	}
+	var service struct {
+		LogConfig struct {
+			Project  string `json:"project"`
+			Logstore string `json:"logstore"`
+		} `json:"logConfig"`
+	}
+	if err := json.Unmarshal(body, &service); err != nil {
+		return fmt.Errorf("get service %s: %w", sl.name.Service, err)
+	}
+	sl.project, sl.logstore = service.LogConfig.Project, service.LogConfig.Logstore
+	if sl.logstore == "" {
+		logger.Warnf("service %s has no log config, the logs of %s are not tailed", sl.name.Service, sl.name)
+	}
+	return nil
+}
+
+// call invokes the function synchronously, and returns the response of a successful invocation
+func (sl *AlibabaServerless) call(ctx context.Context) ([]byte, error) {
+	u := fmt.Sprintf("%s/%s/services/%s/functions/%s/invocations", sl.fcURL, alibabaFCAPIVersion, url.PathEscape(sl.name.Service), url.PathEscape(sl.name.Function))
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(sl.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Fc-Invocation-Type", "Sync")
+
+	client := *sl.client
+	client.Timeout = alibabaInvokeTimeout
+
+	start := time.Now()
+	resp, body, err := sl.do(ctx, &client, req)
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.name, err)
+	}
+	sl.statusCode = resp.StatusCode
+	sl.requestID = resp.Header.Get(alibabaRequestIDHeader)
+	sl.errorType = resp.Header.Get(alibabaErrorTypeHeader)
+	logger.Infof("%s responds %s in %s, request %s", sl.name, resp.Status, sl.duration.Round(time.Millisecond), sl.requestID)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("invoke %s: %s, check %s and %s: %s", sl.name, resp.Status, alibabaAccessKeyIDEnv, alibabaAccessSecretEnv, truncateMiddle(string(body), 512))
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("invoke %s: %s, no such function in %s: %s", sl.name, resp.Status, sl.region, truncateMiddle(string(body), 512))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("invoke %s: %s: %s", sl.name, resp.Status, truncateMiddle(string(body), 512))
+	case sl.errorType != "":
+		// an error of the function is 200 with the error type in the header
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", sl.errorType, truncateMiddle(string(body), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *AlibabaServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// getLogs returns the logs of the logstore which match the query, reading all the pages
+func (sl *AlibabaServerless) getLogs(ctx context.Context, query string, from, to time.Time) ([]alibabaLog, error) {
+	var ret []alibabaLog
+	for offset := 0; ; offset += alibabaLogPageSize {
+		q := url.Values{}
+		q.Set("type", "log")
+		q.Set("from", strconv.FormatInt(from.Unix(), 10))
+		q.Set("to", strconv.FormatInt(to.Unix(), 10))
+		q.Set("query", query)
+		q.Set("line", strconv.Itoa(alibabaLogPageSize))
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("reverse", "false")
+		req, err := http.NewRequest(http.MethodGet, sl.slsURL(sl.project)+"/logstores/"+url.PathEscape(sl.logstore)+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		sl.creds.signSLS(req)
+		resp, err := sl.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("get logs of %s: %w", sl.logstore, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("get logs of %s: %w", sl.logstore, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("get logs of %s/%s: %s: %s", sl.project, sl.logstore, resp.Status, truncateMiddle(string(body), 512))
+		}
+		logs, err := parseAlibabaLogs(body)
+		if err != nil {
+			return nil, fmt.Errorf("get logs of %s: %w", sl.logstore, err)
+		}
+		ret = append(ret, logs...)
+		if len(logs) < alibabaLogPageSize {
+			return ret, nil
+		}
+	}
+}
+
+// observe publishes START or END of our request, matched as AWSServerless matches those of Lambda
+func (sl *AlibabaServerless) observe(message string, timestamp int64) {
+	if m := fcStartRequestRe.FindStringSubmatch(message); m != nil && m[1] == sl.requestID && !sl.startSeen {
+		sl.startSeen = true
+		sl.bus.publish(lifecycleEvent{Kind: lifecycleStart, RequestID: sl.requestID, Timestamp: timestamp})
+	}
+	if m := fcEndRequestRe.FindStringSubmatch(message); m != nil && m[1] == sl.requestID && !sl.endSeen {
+		sl.endSeen = true
+		sl.bus.publish(lifecycleEvent{Kind: lifecycleEnd, RequestID: sl.requestID, Timestamp: timestamp})
+		logger.Infof("%s has been finished", sl.requestID)
+	}
+}
+
+// tailLogs prints the logs of the request. Log Service indexes them late, so the logstore is polled
+// until END of the request is seen and a poll finds nothing new, or until logWait passes.
+// A log has no id, so the nth of the same lines in a second is the same log in every poll.
+func (sl *AlibabaServerless) tailLogs(ctx context.Context, since time.Time) error {
+	query := strconv.Quote(sl.requestID)
+	deadline := time.Now().Add(sl.logWait)
+	for {
+		logs, err := sl.getLogs(ctx, query, since, time.Now().Add(alibabaLogLookback))
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]int)
+		fresh := 0
+		for _, l := range logs {
+			key := fmt.Sprintf("%d:%s", l.Time, l.Message)
+			seen[key]++
+			timestamp := l.Time * 1000
+			if !sl.emitter.isNew(fmt.Sprintf("%s#%d", key, seen[key]), timestamp, l.Message) {
+				continue
+			}
+			fresh++
+			sl.received++
+			sl.bus.publish(logEvent{
+				FunctionName: sl.name.String(),
+				RequestID:    sl.requestID,
+				Message:      l.Message,
+				Timestamp:    timestamp,
+			})
+			sl.observe(l.Message, timestamp)
+		}
+		if sl.endSeen && fresh == 0 {
+			sl.logsComplete = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			logger.Warnf("the logs of %s may be incomplete after %s, Log Service indexes them late", sl.name, sl.logWait)
+			return nil
+		}
+		if err := sleepContext(ctx, sl.logPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *AlibabaServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name.String(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the Function Compute invocation
+func (sl *AlibabaServerless) logSummary(v verdict) {
+	summary := schema.AlibabaRunSummary{
+		SchemaVersion:  schema.AlibabaRunSummaryVersion,
+		FunctionName:   sl.name.String(),
+		Region:         sl.region,
+		RequestID:      sl.requestID,
+		StatusCode:     sl.statusCode,
+		ErrorType:      sl.errorType,
+		Duration:       sl.duration,
+		Project:        sl.project,
+		Logstore:       sl.logstore,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
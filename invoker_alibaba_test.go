@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAlibabaFunctionName(t *testing.T) {
+	n, err := parseAlibabaFunctionName("orders/create")
+	if err != nil || n.Service != "orders" || n.Function != "create" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	for _, s := range []string{"orders", "orders/", "/create", "a/b/c"} {
+		if _, err := parseAlibabaFunctionName(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+}
+
+func TestAlibabaSignature(t *testing.T) {
+	creds := alibabaCredentials{AccessKeyID: "ak", AccessKeySecret: "secret", SecurityToken: "sts-token"}
+	date := "Mon, 10 Jun 2024 08:00:00 GMT"
+
+	req, _ := http.NewRequest(http.MethodPost, "https://1234.cn-hangzhou.fc.aliyuncs.com/2016-08-15/services/orders/functions/create/invocations", strings.NewReader("{}"))
+	req.Header.Set("Date", date)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Fc-Invocation-Type", "Sync")
+	creds.signFC(req)
+	if got := req.Header.Get("Authorization"); got != "FC ak:b9IdYHSBb208cOZGLi7pB2vRS+/PjRi+5O6KIPtbXDA=" {
+		t.Errorf("got %s", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, `https://orders.cn-hangzhou.log.aliyuncs.com/logstores/orders-logs?to=1718006500&from=1718006400&query=%221-abc%22`, nil)
+	req.Header.Set("Date", date)
+	creds.signSLS(req)
+	if got := req.Header.Get("Authorization"); got != "LOG ak:8wEOu8qNi18tetyjiQ6QmDzmK6c=" {
+		t.Errorf("the parameters are sorted and not escaped, got %s", got)
+	}
+
+	if _, err := findAlibabaCredentials(func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), alibabaAccessKeyIDEnv) {
+		t.Errorf("got %v", err)
+	}
+}
+
+// fakeAlibaba serves Function Compute and the GetLogs of Log Service, which returns more logs at
+// each query as the indexing lags
+type fakeAlibaba struct {
+	*httptest.Server
+	errorType    string
+	indexedAfter int // queries before END of the request is indexed
+
+	mu      sync.Mutex
+	queries []string
+}
+
+const testFCRequestID = "1-6666a1b2-3c4d5e6f7a8b9c0d1e2f3a4b"
+
+func newFakeAlibaba(t *testing.T) *fakeAlibaba {
+	f := &fakeAlibaba{indexedAfter: 1}
+	// the logs are indexed once, a poll across a second must not see them again with another time
+	now := time.Now().Unix()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2016-08-15/services/orders", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "FC ak:") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"serviceName": "orders", "logConfig": {"project": "orders-project", "logstore": "orders-logs"}}`)
+	})
+	mux.HandleFunc("/2016-08-15/services/orders/functions/create/invocations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Fc-Invocation-Type") != "Sync" || r.Header.Get("Date") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Fc-Request-Id", testFCRequestID)
+		body, _ := ioutil.ReadAll(r.Body)
+		if f.errorType != "" {
+			w.Header().Set("X-Fc-Error-Type", f.errorType)
+			fmt.Fprint(w, `{"errorMessage": "order rejected", "errorType": "Error"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+	})
+	mux.HandleFunc("/logstores/orders-logs", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "LOG ak:") || r.Header.Get("X-Log-Apiversion") != "0.6.0" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query().Get("query")
+		f.mu.Lock()
+		f.queries = append(f.queries, q)
+		n := len(f.queries)
+		f.mu.Unlock()
+
+		logs := []map[string]interface{}{}
+		if q == `"`+testFCRequestID+`"` {
+			logs = append(logs,
+				map[string]interface{}{"__time__": now, "message": "FC Invoke Start RequestId: " + testFCRequestID},
+				map[string]interface{}{"__time__": now, "message": "2024-06-10T08:00:00.000Z " + testFCRequestID + " [error] order rejected\n"},
+				map[string]interface{}{"__time__": now, "message": "2024-06-10T08:00:00.000Z " + testFCRequestID + " [error] order rejected\n"},
+			)
+			if n > f.indexedAfter {
+				logs = append(logs, map[string]interface{}{"__time__": fmt.Sprint(now), "message": "FC Invoke End RequestId: " + testFCRequestID})
+			}
+		}
+		json.NewEncoder(w).Encode(logs)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runAlibaba(t *testing.T, f *fakeAlibaba, config *Config) (*AlibabaServerless, error) {
+	t.Helper()
+	setTestEnv(t, alibabaAccessKeyIDEnv, "ak")
+	setTestEnv(t, alibabaAccessSecretEnv, "secret")
+	setTestEnv(t, alibabaSecurityTokenEnv, "")
+	config.funcName = "orders/create"
+	config.alibabaAccountID, config.alibabaRegion = "1234567890123456", "cn-hangzhou"
+	sl, err := NewAlibabaServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.fcURL = f.URL
+	sl.slsURL = func(project string) string {
+		if project != "orders-project" {
+			t.Errorf("got project %s", project)
+		}
+		return f.URL
+	}
+	sl.logPoll, sl.logWait = 10*time.Millisecond, time.Second
+	return sl, sl.Invoke(context.Background())
+}
+
+func TestAlibabaInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeAlibaba(t)
+	sl, err := runAlibaba(t, f, &Config{payload: `{"id":1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != 200 || sl.requestID != testFCRequestID || sl.logstore != "orders-logs" || !sl.startSeen || !sl.logsComplete {
+		t.Errorf("got %+v", sl)
+	}
+	// each query returns the logs again, they are printed once, but the same two lines are two logs
+	if sl.received != 4 || logs.FilterMessageSnippet("order rejected").Len() != 2 {
+		t.Errorf("got %d events", sl.received)
+	}
+	if len(f.queries) < 3 {
+		t.Errorf("the logstore is polled until END is indexed, got %v", f.queries)
+	}
+}
+
+func TestAlibabaFunctionError(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeAlibaba(t)
+	f.errorType = "UnhandledInvocationError"
+	sl, err := runAlibaba(t, f, &Config{payload: `{"id":1}`})
+	if !isFunctionError(err) || !strings.Contains(err.Error(), "UnhandledInvocationError") {
+		t.Fatalf("got %v", err)
+	}
+	if !sl.logsComplete || sl.received != 4 {
+		t.Errorf("the logs of a failed function are tailed, got %d", sl.received)
+	}
+}
+
+func TestAlibabaCredentialsRequired(t *testing.T) {
+	setTestEnv(t, alibabaAccessKeyIDEnv, "")
+	config := &Config{funcName: "orders/create", alibabaAccountID: "1234567890123456", alibabaRegion: "cn-hangzhou"}
+	if _, err := NewAlibabaServerless(config); err == nil || !strings.Contains(err.Error(), alibabaAccessKeyIDEnv) {
+		t.Errorf("got %v", err)
+	}
+	config.alibabaRegion = ""
+	if _, err := NewAlibabaServerless(config); err == nil || !strings.Contains(err.Error(), "-alibaba-cloud-region-id") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -1,28 +1,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
+	"io"
+	"net/http"
+	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/lambda"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/xray"
+
 	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
 )
 
 const (
-	maxEventsBuffer = 10000
-	maxEventsCache  = 100000
-	watchSleepTime  = 500 // interval in millsec
+	maxRetryBackoff = 30 * time.Second
+
+	// endLogDelay is how long the END of an invocation which ran to the timeout of the function may take to be delivered
+	endLogDelay = 30 * time.Second
+
+	maxAsyncPayloadSize = 256 * 1024      // payload limit of the Event invocation
+	maxSyncPayloadSize  = 6 * 1024 * 1024 // payload limit of the RequestResponse invocation
 )
 
+// logsAPI is the part of CloudWatch Logs API used by the tail
+type logsAPI interface {
+	FilterLogEventsPagesWithContext(aws.Context, *cloudwatchlogs.FilterLogEventsInput, func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, ...request.Option) error
+	DescribeLogStreamsPagesWithContext(aws.Context, *cloudwatchlogs.DescribeLogStreamsInput, func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, ...request.Option) error
+	GetLogEventsWithContext(aws.Context, *cloudwatchlogs.GetLogEventsInput, ...request.Option) (*cloudwatchlogs.GetLogEventsOutput, error)
+}
+
 // AWSServerless is a Serverless struct for AWS
 type AWSServerless struct {
 	funcName string
@@ -30,193 +55,1372 @@ type AWSServerless struct {
 
 	awsOpts      session.Options
 	startTime    time.Time
+	ref          FunctionRef
 	region       string
 	logGroupName string
-	logClient    *cloudwatchlogs.CloudWatchLogs
-	eventCache   *lru.Cache
-	requestID    string
+	logClient    logsAPI
+	// versions whose log streams are tailed, nil for all. see resolveStreamVersions
+	streamVersions []string
+	requestID      string
+	emitter        *emitter
+	bus            *bus
+	summary        *summaryBuilder
+	phases         *phaseTracker
+
+	credsProvider string // name of the credentials provider which won the chain
+
+	retryIf     *expr // re-invoke while the response matches
+	maxAttempts int
+	attempts    []attemptResult
+
+	retryOnFailure bool // re-invoke while the function fails
+	retryDelay     time.Duration
+
+	invocationType string // preference from the config
+	via            string // viaInvoke, viaURL, viaEventBridge or viaSQS
+	functionURL    string // invoked by -via url
+	statusCode     int    // of the response of the Invoke API or the Function URL
+	eventBridge    *eventBridgeTarget
+	eventID        string // of the event put by -via eventbridge
+	sqs            *sqsTarget
+	messageID      string             // of the message sent by -via sqs
+	correlator     *messageCorrelator // ties the invocation to the message of -via sqs
+	delivery       *sqsDelivery       // the phases of the message of -via sqs in its queue
+
+	integrity        *payloadIntegrity
+	requireIntegrity bool // a mismatch or an absent marker is an error
+
+	deadline *deadlineWatcher
+
+	timeline *logTimes // of -timeline, nil unless set
+	json     bool      // the timeline and the response are records instead of text
+
+	invocationState invocationState // of the last tail
+
+	filterStrategies []filterStrategy // strategies which served the tail, in the order of first use
+	lastStrategy     filterStrategy
+
+	githubStatus *githubStatus
+
+	discoverRegion bool
+	state          *localState
+
+	readOnly bool // mutating API calls are rejected
+	dryRun   bool // only the DryRun invocation, nothing is run nor tailed
+	noLogs   bool // only the async invocation, without a call to CloudWatch Logs
+
+	metadata        *metadataCache // GetFunctionConfiguration of the run, set by Invoke
+	noMetadataCache bool
+
+	limits Limits // of -tuning, defaultLimits if zero
+
+	streamReader *streamReader // set when FilterLogEvents is denied
+
+	throttle     *throttleController // shared by the calls to logClient
+	knownStreams []*string           // found by the last discovery, used while discovery yields to event fetching
+
+	baseline *baselineCheck
+
+	clientContext string // base64-encoded
+	correlationID string // of the ClientContext, logged with each log line
+	invokeRetry   invokeRetryPolicy
+	concurrent    *concurrentRun // of -concurrency or -payload-ndjson, nil for a single invocation
+	warmup        *warmupRun     // of -warmup, nil unless warming up
+	output        string         // -output, the file the response is written to
+	runTimeout    time.Duration  // -timeout of the whole run, 0 for no limit
+
+	waitActiveTimeout time.Duration // of -wait-active, 0 unless waiting for the function to be active
+	noPreflight       bool          // -no-preflight skips the check that the function exists
+
+	summarize bool // the run got far enough to log the summary
+
+	pushgateway *pushgateway
+	publisher   *resultPublisher
+	apiCalls    *apiCallCounter
+	shipper     *logShipper // posts the log events to -ship-to, nil if none
+
+	streamPrefixMargin time.Duration    // how long after UTC midnight the streams of the previous date are filtered too
+	clock              func() time.Time // replaced by tests, time.Now if nil
+
+	expect      *sideEffectExpectation
+	sideEffects []sideEffectFinding
+
+	logging     loggingState // set by the preflight
+	invokedType string       // the invocation type of the last invocation
+	responseErr error        // the function error of a sync response, returned after its logs are tailed
+
+	endTimeout time.Duration // how long END is waited for after START, set by the preflight from the timeout of the function, 0 for no limit
+
+	completionStrategy string             // -completion-strategy
+	completion         string             // the strategy which decides the outcome, resolved before invoking
+	metricsClient      metricDataAPI      // set when the metrics decide the outcome
+	metricsBaseline    metricPoint        // the minute of the invocation before invoking
+	invokedAt          time.Time          // when the metrics strategy took the baseline
+	inference          *metricsCompletion // the outcome inferred from the metrics
+
+	setRetention int64    // -set-retention
+	journal      *journal // records -set-retention for the cleanup subcommand
+
+	golden       *responseGolden // -expect-response-file
+	goldenResult string          // "match", "mismatch" or "updated"
+	goldenDiffs  []jsonDiff
+
+	insightsMode    string           // -insights-metrics, "auto", "on" or "off"
+	insightsPoll    time.Duration    // between the reads of the Lambda Insights log group
+	insightsTimeout time.Duration    // how long the performance event is waited for
+	insights        *insightsMetrics // read after the tail, nil if none
+
+	xray *xrayTrace // of -xray, nil unless tracing
+
+	destination *destinationCheck // of -check-destination, nil unless checking
+
+	withLogLevel string             // -with-log-level, "" to leave the level
+	logLevelPoll time.Duration      // between the reads of the status of an update
+	loggingAPI   functionLoggingAPI // set by the log-level step
+	logLevel     *logLevelOverride  // restored when the run is finished, nil if none
 }
 
 // NewAWSServerless returns new Serverless struct for AWS Lambda
 func NewAWSServerless(config *Config) (*AWSServerless, error) {
 
-	logGroupName, region, err := parseAWSFuncName(config.funcName)
+	funcName, ref, err := QualifyFunction(config.funcName, config.qualifier)
+	if err != nil {
+		return nil, fmt.Errorf("ParseFunctionRef: %w", err)
+	}
+
+	if config.withLogLevel != "" && ref.Qualifier != "" {
+		return nil, fmt.Errorf("-with-log-level changes $LATEST, use the unqualified function instead of %s", funcName)
+	}
+
+	awsOpts, err := newAWSSessionOptions(ref.Region, config.network, config.noCredentialCache)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := config.limits.orDefault()
+	em, err := newEmitter(logger, config.rules, limits.EventsWindow)
 	if err != nil {
-		return nil, fmt.Errorf("parseAWSFuncName: %w", err)
+		return nil, err
 	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+	em.showExtension = config.showExtensionLogs
+	em.json = config.json
 
-	awsConfig := aws.NewConfig()
-	if region != "" {
-		awsConfig = awsConfig.WithRegion(region)
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+	deadline := newDeadlineWatcher(config.remainingTimeExpr, config.deadlineMargin)
+	b.subscribe("deadline", deadline, subscribeOptions{})
+	var timeline *logTimes
+	if config.timeline {
+		timeline = &logTimes{}
+		b.subscribe("timeline", timeline, subscribeOptions{})
 	}
-	awsOpts := session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            *awsConfig,
+	var shipper *logShipper
+	if config.shipTo != nil {
+		em.setLineLimit(sinkShip, config.shipMaxLineLength)
+		shipper = newLogShipper(config.shipTo, em)
+		b.subscribe("ship-to", shipper, subscribeOptions{})
 	}
 
-	cache, err := lru.New(maxEventsCache)
+	var attribution map[string]string
+	if !config.noAttribution {
+		attribution = collectAttribution(defaultAttributionEnv())
+		logger.Debugf("attribution: %v", attribution)
+	}
+	clientContext, err := buildClientContext(config.clientContext, attribution)
 	if err != nil {
 		return nil, err
 	}
 
+	startTime := time.Now()
+	var trace *xrayTrace
+	if config.xray {
+		if trace, err = newXRayTrace(startTime); err != nil {
+			return nil, err
+		}
+	}
+	var destination *destinationCheck
+	if config.destinationTimeout > 0 {
+		destination = &destinationCheck{poll: destinationPollInterval, timeout: config.destinationTimeout}
+	}
 	ret := &AWSServerless{
-		funcName:     config.funcName,
+		funcName:     funcName,
 		payload:      config.payload,
-		startTime:    time.Now(),
-		region:       region,
-		logGroupName: logGroupName,
+		startTime:    startTime,
+		ref:          ref,
+		region:       ref.Region,
+		logGroupName: ref.LogGroup(),
 		awsOpts:      awsOpts,
-		eventCache:   cache,
+		emitter:      em,
+		bus:          b,
+		summary:      summary,
+		phases:       newPhaseTracker(startTime),
+		retryIf:      config.retryIf,
+		maxAttempts:  config.maxAttempts,
+
+		retryOnFailure: config.retryOnFailure,
+		retryDelay:     config.retryDelay,
+
+		invocationType: config.invocationType,
+		via:            config.via,
+		eventBridge:    config.eventBridge,
+		sqs:            config.sqs,
+
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		deadline:         deadline,
+		timeline:         timeline,
+		json:             config.json,
+		githubStatus:     config.githubStatus,
+		discoverRegion:   config.discoverRegion,
+		state:            newLocalState(defaultStatePath()),
+		readOnly:         config.readOnly,
+		dryRun:           config.dryRun,
+		noLogs:           config.noLogs,
+		noMetadataCache:  config.noMetadataCache,
+		baseline:         config.baseline,
+		clientContext:    clientContext,
+		correlationID:    correlationID(config.clientContext),
+		invokeRetry:      config.invokeRetry,
+		concurrent:       config.concurrent,
+		warmup:           config.warmup,
+		output:           config.output,
+		runTimeout:       config.runTimeout,
+
+		waitActiveTimeout: config.waitActiveTimeout,
+		noPreflight:       config.noPreflight,
+
+		pushgateway:        config.pushgateway,
+		publisher:          config.publisher,
+		apiCalls:           newAPICallCounter(),
+		shipper:            shipper,
+		streamPrefixMargin: config.streamPrefixMargin,
+		expect:             config.expect,
+		completionStrategy: config.completionStrategy,
+		golden:             config.responseGolden,
+		setRetention:       config.setRetention,
+		journal:            newJournal(defaultJournalPath()),
+		limits:             limits,
+
+		insightsMode:    config.insightsMetrics,
+		insightsPoll:    insightsPollInterval,
+		insightsTimeout: insightsTimeout,
+
+		xray: trace,
+
+		destination: destination,
+
+		withLogLevel: config.withLogLevel,
+		logLevelPoll: logLevelPollInterval,
 	}
 
 	return ret, nil
 }
 
-// parseAWSFuncName parse funcname and get CloudWatch logs group name and region
-// function name could be these format.
-//    * Function name - my-function.
-//    * Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function.
-//    * Partial ARN - 123456789012:function:my-function.
-func parseAWSFuncName(funcName string) (string, string, error) {
-	p := strings.Split(funcName, ":")
-	// func name is Function name
-	if len(p) == 1 {
-		return fmt.Sprintf("/aws/lambda/%s", funcName), "", nil
+var _ consoleInvoker = (*AWSServerless)(nil)
+
+// Capabilities returns the options AWS Lambda supports
+func (sl *AWSServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorAWS]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *AWSServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// Invoke invoke AWS Lambda function
+func (sl *AWSServerless) Invoke(ctx context.Context) (err error) {
+	if sl.shipper != nil {
+		sl.shipper.start()
 	}
-	// func name is Function ARN
-	if p[0] == "arn" && p[1] == "aws" {
-		return fmt.Sprintf("/aws/lambda/%s", p[6]), p[3], nil
+	// the summary is logged before the bus is closed, so that slow subscribers
+	// can not delay it when the process is about to be killed
+	defer func() {
+		if rerr := sl.restoreLogLevel(); rerr != nil && err == nil {
+			err = rerr
+		}
+		if err != nil && sl.runTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = &timeoutError{fmt.Errorf("the run did not finish in -timeout %s, %s: %w", sl.runTimeout, sl.progress(), err)}
+		}
+		if err == nil && sl.summarize && sl.baseline != nil && sl.summary.timedOut() == "" {
+			err = sl.baseline.apply(newBaselineEntry(sl.ref.Name, sl.ref.Qualifier, sl.integrity.sent, sl.summary.allReports()))
+		}
+		if sl.summarize {
+			if rerr := sl.concurrent.writeReport(sl.funcName, sl.summary); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		v := sl.verdict(err)
+		if sl.shipper != nil {
+			// the last batch is posted before the summary, which has the counts
+			sl.shipper.close()
+		}
+		if sl.summarize {
+			sl.logSummary(v)
+			sl.printTimeline()
+		}
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		pushRunMetrics(sl.pushgateway, sl.groupingKey(), sl.runMetrics(v))
+		finishRun(v, sl.githubStatus)
+	}()
+
+	return runSteps(ctx, sl.pipeline())
+}
+
+// progress tells how far a run stopped by -timeout got, ex: "START of r1 was matched but not END, 12 log events were printed"
+func (sl *AWSServerless) progress() string {
+	printed := fmt.Sprintf("%s printed", plural(int(sl.emitter.printedLines()), "log event"))
+	if _, ok := sl.phases.at(transitionInvokeEnd); !ok {
+		return "the function was not invoked, " + printed
 	}
-	// func name is Partial ARN
-	if _, err := strconv.Atoi(p[0]); err == nil && p[1] == "function" {
-		return fmt.Sprintf("/aws/lambda/%s", p[2]), "", nil
+	request := "the request"
+	if sl.requestID != "" {
+		request = sl.requestID
 	}
+	if _, ok := sl.phases.at(transitionStarted); !ok {
+		return fmt.Sprintf("START of %s was not matched, %s", request, printed)
+	}
+	return fmt.Sprintf("START of %s was matched but not END, %s", request, printed)
+}
+
+// pipeline returns the steps of a run in order, which share the session made by the first one
+func (sl *AWSServerless) pipeline() []step {
+	var sess *session.Session
+	var svc *lambda.Lambda
+	var region string // of the session
 
-	return "", "", fmt.Errorf("wrong format function name, %s", funcName)
+	steps := []step{{
+		name: "credentials",
+		plan: sl.planCredentials,
+		run: func(ctx context.Context) error {
+			sl.phases.mark(transitionCredentialsStart, time.Now())
+			var err error
+			sess, err = sl.newSession()
+			if err != nil {
+				return fmt.Errorf("aws session error, %s: %w", sl.funcName, err)
+			}
+			creds, err := sess.Config.Credentials.Get()
+			if err != nil {
+				return fmt.Errorf("aws credentials error, %s: %w", sl.funcName, err)
+			}
+			sl.credsProvider = creds.ProviderName
+			logger.Debugf("aws credentials are provided by %s", creds.ProviderName)
+			sl.phases.mark(transitionCredentialsEnd, time.Now())
+			return nil
+		},
+	}}
+
+	// a region in the ARN is never overridden
+	if sl.discoverRegion && !sl.ref.IsARN {
+		steps = append(steps, step{
+			name: "discover-region",
+			plan: sl.planDiscoverRegion,
+			run: func(ctx context.Context) error {
+				region, err := resolveRegion(ctx, aws.StringValue(sess.Config.Region), sl.ref.Name, lambdaRegions(), sl.state, lambdaClientOf(sess))
+				if err != nil {
+					return err
+				}
+				sess = sess.Copy(aws.NewConfig().WithRegion(region))
+				sl.awsOpts.Config.Region = aws.String(region)
+				sl.region = region
+				sl.ref.Region = region
+				return nil
+			},
+		})
+	}
+
+	if !sl.noPreflight && !sl.dryRun {
+		steps = append(steps, step{
+			name: "check-function",
+			plan: sl.planCheckFunction,
+			run: func(ctx context.Context) error {
+				return checkFunction(ctx, lambda.New(sess), sl.unqualifiedName(), sl.ref.Qualifier, aws.StringValue(sess.Config.Region), sl.regionSource())
+			},
+		})
+	}
+	if sl.waitActiveTimeout > 0 {
+		steps = append(steps, step{
+			name: "wait-active",
+			plan: sl.planWaitActive,
+			run: func(ctx context.Context) error {
+				sl.metadata = newMetadataCache(lambda.New(sess), sl.noMetadataCache)
+				return waitActive(ctx, sl.metadata, sl.funcName, "", sl.waitActiveTimeout, waitActivePoll)
+			},
+		})
+	}
+
+	if sl.dryRun {
+		return append(steps, step{
+			name: "dry-run",
+			plan: sl.planDryRun,
+			run: func(ctx context.Context) error {
+				return sl.invokeDryRun(ctx, lambda.New(sess), aws.StringValue(sess.Config.Region))
+			},
+		})
+	}
+	if sl.noLogs {
+		return append(steps, step{
+			name: "invoke",
+			plan: sl.planNoLogs,
+			run: func(ctx context.Context) error {
+				return sl.invokeNoLogs(ctx, lambda.New(sess))
+			},
+		})
+	}
+	if sl.warmup != nil {
+		return append(steps, step{
+			name: "warmup",
+			plan: sl.planWarmup,
+			run: func(ctx context.Context) error {
+				return sl.warmUp(ctx, lambda.New(sess))
+			},
+		})
+	}
+	steps = append(steps, step{
+		name: "preflight",
+		plan: sl.planPreflight,
+		run: func(ctx context.Context) error {
+			sl.phases.mark(transitionPreflightStart, time.Now())
+			svc = lambda.New(sess)
+			region = aws.StringValue(sess.Config.Region)
+			if sl.waitActiveTimeout == 0 { // otherwise made by wait-active, with the settled configuration
+				sl.metadata = newMetadataCache(svc, sl.noMetadataCache)
+			}
+			sl.logging = sl.checkLogging(ctx, iam.New(sess))
+			if t := sl.functionTimeout(ctx); t > 0 {
+				sl.endTimeout = t + endLogDelay
+			}
+			logs := cloudwatchlogs.New(sess)
+			if sl.logClient == nil { // the tail shares the session of the pipeline
+				sl.logClient = logs
+			}
+			err := sl.checkRetention(ctx, logs, region)
+			sl.streamVersions = sl.resolveStreamVersions(ctx, svc)
+			sl.phases.mark(transitionPreflightEnd, time.Now())
+			return err
+		},
+	})
+	if sl.withLogLevel != "" {
+		steps = append(steps, step{
+			name: "log-level",
+			plan: sl.planLogLevel,
+			run: func(ctx context.Context) error {
+				sl.loggingAPI = newLambdaLogging(svc, sl.metadata)
+				return sl.overrideLogLevel(ctx, region)
+			},
+		})
+	}
+	steps = append(steps, step{
+		name: "invoke",
+		plan: sl.planInvoke,
+		run: func(ctx context.Context) error {
+			invocationType, reason, err := chooseInvocationType(sl.invocationType, sl.payloadSize(), sl.needResponse())
+			if err != nil {
+				return err
+			}
+			if sl.via == viaEventBridge || sl.via == viaSQS {
+				if len(sl.payload) > maxAsyncPayloadSize {
+					return fmt.Errorf("payload is %d bytes, exceeds the limit of %d bytes of an event or a message", len(sl.payload), maxAsyncPayloadSize)
+				}
+				invocationType, reason = lambda.InvocationTypeEvent, "-via "+sl.via
+			}
+			logger.Infof("invocation type is %s: %s", invocationType, reason)
+			if sl.xray != nil {
+				logger.Infof("X-Ray trace id is %s", sl.xray.id)
+			}
+			if sl.concurrent == nil || sl.concurrent.payloads == nil {
+				logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+			}
+
+			sl.completion = resolveCompletion(sl.completionStrategy, sl.logging.Off, invocationType)
+			logger.Infof("the outcome is decided by %s", sl.completion)
+			if sl.completion == completionMetrics {
+				sl.metricsClient = cloudwatch.New(sess)
+				sl.invokedAt = sl.now()
+				sl.metricsBaseline = metricsBaseline(ctx, sl.metricsClient, sl.ref, sl.invokedAt)
+			}
+
+			if sl.retrying() {
+				sl.summarize = true
+				return sl.invokeWithRetry(ctx, svc)
+			}
+			if sl.via == viaEventBridge {
+				if err := sl.putEvent(ctx, eventbridge.New(sess)); err != nil {
+					return err
+				}
+				sl.summarize = true
+				return nil
+			}
+			if sl.via == viaSQS {
+				if err := sl.sendMessage(ctx, sqs.New(sess)); err != nil {
+					return err
+				}
+				sl.summarize = true
+				return nil
+			}
+			if sl.concurrent != nil {
+				if sl.completion != completionLogs {
+					return fmt.Errorf("-concurrency and -payload-ndjson tail the logs of the invocations, logging of %s is off: %s", sl.funcName, sl.logging.Reason)
+				}
+				sl.summarize = true
+				return sl.invokeConcurrently(ctx, svc, invocationType)
+			}
+			if sl.via == viaURL {
+				return sl.invokeViaURL(ctx, sl.metadata, sess.Config.HTTPClient, v4.NewSigner(sess.Config.Credentials), region, os.Stdout)
+			}
+
+			resp, requestID, err := sl.invoke(ctx, svc, invocationType)
+			if err != nil {
+				return err
+			}
+			sl.statusCode = int(aws.Int64Value(resp.StatusCode))
+			if err := checkInvokeStatus(invocationType, sl.statusCode); err != nil {
+				return err
+			}
+			// the tail follows this request only, an async one as well, so that the START of another
+			// request of the function is never taken for ours
+			sl.requestID = requestID
+			if sl.destination != nil {
+				sl.destination.requestID = requestID
+			}
+			// a sync invocation already has the outcome, an async one is finished when END appears in the tail
+			if invocationType == lambda.InvocationTypeRequestResponse {
+				if sl.output != outputStdout {
+					printResponse(os.Stdout, resp.Payload, sl.json)
+				}
+				// the error document of a function error is written as well, the run fails after the tail
+				if err := writeOutput(sl.output, resp.Payload, os.Stdout); err != nil {
+					return err
+				}
+				if resp.FunctionError != nil {
+					// the logs of the failed invocation explain the error, so it is returned after the tail
+					sl.responseErr = &functionError{fmt.Errorf("invoke lambda response error, %v: %s", string(resp.Payload), aws.StringValue(resp.FunctionError))}
+					sl.summarize = true
+					return nil
+				}
+			}
+			sl.summarize = true
+			return sl.checkResponse(resp.Payload)
+		},
+	}, step{
+		name: "tail",
+		plan: sl.planTail,
+		run: func(ctx context.Context) (err error) {
+			if sl.responseErr != nil {
+				defer func() {
+					if err != nil {
+						logger.Warnf("the logs of the failed invocation may be incomplete: %s", err)
+					}
+					err = sl.responseErr
+				}()
+			}
+			switch sl.completion {
+			case completionResponse:
+				logger.Infof("the outcome of %s is the response only, logging is off", sl.funcName)
+				return nil
+			case completionMetrics:
+				return sl.completeByMetrics(ctx)
+			}
+			// each attempt of the retry mode is already tailed
+			if !sl.retrying() {
+				tail := sl.logTailStart
+				if sl.delivery != nil {
+					tail = func(ctx context.Context) error { return sl.tailWatchingQueue(ctx, sqs.New(sess)) }
+				}
+				if err := tail(ctx); err != nil {
+					return err
+				}
+			}
+			if sl.concurrent != nil {
+				if err := sl.concurrent.logRequests(sl.summary); err != nil {
+					return err
+				}
+			}
+			return sl.integrity.check(sl.requireIntegrity)
+		},
+	})
+	if sl.insightsMode != insightsOff {
+		steps = append(steps, step{
+			name: "insights",
+			plan: sl.planInsights,
+			run: func(ctx context.Context) error {
+				if !sl.wantsInsights(ctx) {
+					return nil
+				}
+				return sl.readInsights(ctx, cloudwatchlogs.New(sess))
+			},
+		})
+	}
+	if sl.xray != nil {
+		steps = append(steps, step{
+			name: "xray",
+			plan: sl.planXRay,
+			run: func(ctx context.Context) error {
+				return sl.readXRay(ctx, xray.New(sess))
+			},
+		})
+	}
+	if sl.destination != nil {
+		steps = append(steps, step{
+			name: "destination",
+			plan: sl.planDestination,
+			run: func(ctx context.Context) error {
+				return sl.checkDestination(ctx, lambda.New(sess), sqs.New(sess))
+			},
+		})
+	}
+	if sl.expect != nil {
+		steps = append(steps, step{
+			name: "expect",
+			plan: sl.planExpect,
+			run: func(ctx context.Context) error {
+				checkers, err := sl.expect.checkers(sess)
+				if err != nil {
+					return err
+				}
+				return sl.expectSideEffects(ctx, checkers)
+			},
+		})
+	}
+	if sl.withLogLevel != "" {
+		steps = append(steps, step{name: "restore-log-level", plan: sl.planRestoreLogLevel})
+	}
+	return steps
 }
 
-// Invoke invoke AWS Lambda function
-func (sl *AWSServerless) Invoke(ctx context.Context) error {
-	sess, err := session.NewSessionWithOptions(sl.awsOpts)
+// payloadLimits are the payload limits of the invocation types in bytes
+var payloadLimits = map[string]int{
+	lambda.InvocationTypeEvent:           maxAsyncPayloadSize,
+	lambda.InvocationTypeRequestResponse: maxSyncPayloadSize,
+}
+
+// checkPayloadSize returns an error if the payload exceeds the limit of the invocation type, which Lambda
+// rejects with RequestEntityTooLargeException. The limit is in bytes, so a payload of multibyte UTF-8
+// characters exceeds it with fewer characters.
+func checkPayloadSize(invocationType string, payload []byte) error {
+	limit, ok := payloadLimits[invocationType]
+	if !ok || len(payload) <= limit {
+		return nil
+	}
+	size := fmt.Sprintf("%d bytes", len(payload))
+	if runes := utf8.RuneCount(payload); runes != len(payload) && utf8.Valid(payload) {
+		size += fmt.Sprintf(" (%d characters of UTF-8)", runes)
+	}
+	return fmt.Errorf("payload is %s, exceeds the limit of %d bytes of the %s invocation type", size, limit, invocationType)
+}
+
+// chooseInvocationType returns the Lambda invocation type for the preference and the payload size with the reason.
+// needResponse is the option which needs the response, "" if none.
+func chooseInvocationType(preference string, payloadSize int, needResponse string) (string, string, error) {
+	if payloadSize > maxSyncPayloadSize {
+		return "", "", fmt.Errorf("payload is %d bytes, exceeds the limit of %d bytes of the %s invocation type", payloadSize, maxSyncPayloadSize, lambda.InvocationTypeRequestResponse)
+	}
+	switch preference {
+	case invocationEvent:
+		if payloadSize > maxAsyncPayloadSize {
+			return "", "", fmt.Errorf("payload is %d bytes, exceeds the limit of %d bytes of the %s invocation type, use -invocation-type auto or request-response", payloadSize, maxAsyncPayloadSize, lambda.InvocationTypeEvent)
+		}
+		return lambda.InvocationTypeEvent, "-invocation-type event", nil
+	case invocationRequestResponse:
+		return lambda.InvocationTypeRequestResponse, "-invocation-type request-response", nil
+	}
+	if needResponse != "" {
+		return lambda.InvocationTypeRequestResponse, needResponse + " needs the response", nil
+	}
+	if payloadSize > maxAsyncPayloadSize {
+		return lambda.InvocationTypeRequestResponse, fmt.Sprintf("payload is %d bytes, exceeds the async limit of %d bytes", payloadSize, maxAsyncPayloadSize), nil
+	}
+	return lambda.InvocationTypeEvent, fmt.Sprintf("payload is %d bytes, within the async limit of %d bytes", payloadSize, maxAsyncPayloadSize), nil
+}
+
+// needResponse returns the option which needs the response of a sync invocation, "" if none
+func (sl *AWSServerless) needResponse() string {
+	switch {
+	case sl.via == viaURL:
+		return "-via url"
+	case sl.retryIf != nil:
+		return "-retry-if-response"
+	case sl.retryOnFailure:
+		return "-retry-on-failure"
+	case sl.golden != nil:
+		return "-expect-response-file"
+	case sl.output != "":
+		return "-output"
+	}
+	return ""
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *AWSServerless) checkResponse(payload []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(payload)
+	return err
+}
+
+// checkInvokeStatus checks the status of the Invoke API for the invocation type: 200 of a sync
+// invocation with the response, and 202 of an async one which is only queued
+func checkInvokeStatus(invocationType string, status int) error {
+	want := http.StatusOK
+	if invocationType == lambda.InvocationTypeEvent {
+		want = http.StatusAccepted
+	}
+	if status != want {
+		return fmt.Errorf("invoke returned status %d for the %s invocation, %d is expected", status, invocationType, want)
+	}
+	return nil
+}
+
+// printResponse prints the response of a sync invocation, indented if it is JSON, or as a
+// record in the JSON log format
+func printResponse(w io.Writer, payload []byte, asJSON bool) {
+	if asJSON {
+		logger.Infow("response", zap.String("payload", string(payload)))
+		return
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, payload, "", "  "); err != nil {
+		b.Reset()
+		b.Write(payload)
+	}
+	fmt.Fprintln(w, strings.TrimRight(b.String(), "\n"))
+}
+
+// invoke calls the Invoke API once, retrying a throttled or another transient rejection by
+// sl.invokeRetry, and returns the response with the request id
+func (sl *AWSServerless) invoke(ctx context.Context, svc invokeAPI, invocationType string) (*lambda.InvokeOutput, string, error) {
+	sl.invokedType = invocationType
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	resp, requestID, err := sl.callInvoke(ctx, svc, sl.invokeInput(invocationType))
+	sl.phases.mark(transitionInvokeEnd, time.Now())
 	if err != nil {
-		return fmt.Errorf("aws session error, %s: %w", sl.funcName, err)
+		return nil, "", err
+	}
+	// a sync invocation tells the version which ran it, an alias may route to another one
+	if v := aws.StringValue(resp.ExecutedVersion); v != "" && sl.streamVersions != nil {
+		sl.streamVersions = []string{v}
 	}
-	svc := lambda.New(sess)
+	return resp, requestID, nil
+}
+
+// invokeInput returns the input of the Invoke API
+func (sl *AWSServerless) invokeInput(invocationType string) *lambda.InvokeInput {
 	input := &lambda.InvokeInput{
-		FunctionName:   aws.String(sl.funcName),
+		FunctionName:   aws.String(sl.unqualifiedName()),
 		Payload:        []byte(sl.payload),
 		LogType:        aws.String("Tail"),
-		InvocationType: aws.String("Event"), // always async invocation
+		InvocationType: aws.String(invocationType),
 	}
+	if sl.ref.Qualifier != "" {
+		input.Qualifier = aws.String(sl.ref.Qualifier)
+	}
+	if sl.clientContext != "" {
+		input.ClientContext = aws.String(sl.clientContext)
+	}
+	return input
+}
 
-	resp, err := svc.InvokeWithContext(ctx, input)
-
+// callInvoke calls the Invoke API by sl.invokeRetry, and can be called concurrently. A payload beyond the
+// limit of the invocation type is not sent.
+func (sl *AWSServerless) callInvoke(ctx context.Context, svc invokeAPI, input *lambda.InvokeInput) (*lambda.InvokeOutput, string, error) {
+	if err := checkPayloadSize(aws.StringValue(input.InvocationType), input.Payload); err != nil {
+		return nil, "", fmt.Errorf("lambda invokation, %s: %w", sl.funcName, err)
+	}
+	var requestID string
+	var resp *lambda.InvokeOutput
+	opts := []request.Option{request.WithGetResponseHeader("X-Amzn-Requestid", &requestID)}
+	if sl.xray != nil {
+		opts = append(opts, sl.xray.option())
+	}
+	err := sl.invokeRetry.do(ctx, func() (err error) {
+		resp, err = svc.InvokeWithContext(ctx, input, opts...)
+		return err
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			return fmt.Errorf("aws error, %s: %w", sl.funcName, aerr)
+			return nil, "", fmt.Errorf("aws error, %s: %w", sl.funcName, aerr)
 		}
-		return fmt.Errorf("lambda invokation, %s: %w", sl.funcName, err)
+		return nil, "", fmt.Errorf("lambda invokation, %s: %w", sl.funcName, err)
 	}
+	return resp, requestID, nil
+}
+
+// attemptResult is a result of an invocation in the retry mode
+type attemptResult = schema.Attempt
+
+// retrying returns true in the retry mode of -retry-if-response or -retry-on-failure
+func (sl *AWSServerless) retrying() bool {
+	return sl.retryIf != nil || sl.retryOnFailure
+}
+
+// invokeWithRetry invokes the function synchronously and re-invokes with backoff while the response
+// matches the retry predicate, or with -retry-on-failure while the response is a function error. An error
+// of the invocation itself, as on a function which is not found or a payload which is not JSON, is never retried.
+func (sl *AWSServerless) invokeWithRetry(ctx context.Context, svc invokeAPI) (err error) {
+	// only the response of the last attempt is written to the output, however the attempts end
+	var last *lambda.InvokeOutput
+	defer func() {
+		if last == nil {
+			return
+		}
+		if werr := writeOutput(sl.output, last.Payload, os.Stdout); werr != nil && err == nil {
+			err = werr
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		logger.Infof("=== attempt %d/%d ===", attempt, sl.maxAttempts)
+		sl.startTime = time.Now()
+		// the phases of the summary are of the last attempt
+		sl.phases.restart(transitionInvokeStart)
 
-	if resp.FunctionError != nil {
-		return fmt.Errorf("invoke lambda response error, %v: %s", string(resp.Payload), aws.StringValue(resp.FunctionError))
+		resp, requestID, err := sl.invoke(ctx, svc, lambda.InvocationTypeRequestResponse)
+		if err != nil {
+			return err
+		}
+		sl.requestID = requestID
+		logger.Infof("attempt %d/%d is request %s", attempt, sl.maxAttempts, requestID)
+
+		// the logs of a sync invocation are already written, so tail them until END
+		if sl.completion == completionLogs {
+			if err := sl.logTailStart(ctx); err != nil {
+				return err
+			}
+		}
+		breakdown := sl.phases.breakdown()
+		result := attemptResult{
+			Attempt:   attempt,
+			RequestID: requestID,
+			Report:    sl.summary.report(requestID),
+			Phases:    &breakdown,
+		}
+		last = resp
+
+		if resp.FunctionError != nil {
+			result.FunctionError = aws.StringValue(resp.FunctionError)
+			result.Retry = sl.retryOnFailure && attempt < sl.maxAttempts
+			sl.attempts = append(sl.attempts, result)
+			err := fmt.Errorf("invoke lambda response error, %v: %s", string(resp.Payload), aws.StringValue(resp.FunctionError))
+			if !sl.retryOnFailure {
+				return &functionError{err}
+			}
+			if attempt >= sl.maxAttempts {
+				return &functionError{fmt.Errorf("the function still fails after %d attempts, %w", attempt, err)}
+			}
+			wait := sl.retryWait(attempt)
+			logger.Warnf("attempt %d/%d failed with %s, retry after %s", attempt, sl.maxAttempts, result.FunctionError, wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		retry := false
+		if sl.retryIf != nil {
+			retry, err = sl.retryIf.evalJSON(resp.Payload)
+		}
+		result.Retry = retry
+		sl.attempts = append(sl.attempts, result)
+		if err != nil {
+			return fmt.Errorf("retry-if-response: %w", err)
+		}
+		if !retry {
+			if attempt > 1 {
+				logger.Infof("attempt %d/%d succeeded", attempt, sl.maxAttempts)
+			}
+			return sl.checkResponse(resp.Payload)
+		}
+		if attempt >= sl.maxAttempts {
+			return fmt.Errorf("response still matches %q after %d attempts: %s", sl.retryIf, attempt, string(resp.Payload))
+		}
+
+		wait := sl.retryWait(attempt)
+		logger.Infof("response matches %q, retry after %s", sl.retryIf, wait)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
 	}
+}
 
-	return sl.logTailStart(ctx)
+// retryWait returns the wait before the attempt after the one, -retry-delay or the backoff
+func (sl *AWSServerless) retryWait(attempt int) time.Duration {
+	if sl.retryDelay > 0 {
+		return sl.retryDelay
+	}
+	return retryBackoff(attempt)
 }
 
-func (sl *AWSServerless) logTailStart(ctx context.Context) error {
-	sess, err := session.NewSessionWithOptions(sl.awsOpts)
-	if err != nil {
-		logger.Error("aws session error, %s: %w", sl.funcName, err)
+// sleepContext waits for d, or returns ctx.Err() when ctx is done before that
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	sl.logClient = cloudwatchlogs.New(sess)
+// retryBackoff returns the wait time before the next attempt
+func retryBackoff(attempt int) time.Duration {
+	wait := time.Second << uint(attempt-1)
+	if wait > maxRetryBackoff || wait <= 0 {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
 
-	return sl.logTail(ctx, sl.logGroupName)
+// verdict returns the verdict of the run which ended with err
+func (sl *AWSServerless) verdict(err error) verdict {
+	return formatVerdict(verdictInput{
+		Function:  sl.ref.Name,
+		Qualifier: sl.ref.Qualifier,
+		Report:    sl.summary.report(sl.requestID),
+		Errors:    sl.summary.errors(),
+		Timeout:   sl.summary.timedOut(),
+		Note:      sl.outcomeNote(),
+		Err:       err,
+	})
 }
 
-var startRequestRe = regexp.MustCompile("START RequestId: (.+) Version:")
-var endRequestRe = regexp.MustCompile("END RequestId: (.+)")
+// runMetrics returns the metrics of the run which ended with the verdict
+func (sl *AWSServerless) runMetrics(v verdict) *runMetrics {
+	m := &runMetrics{
+		Outcome:  v.Outcome,
+		Report:   sl.summary.report(sl.requestID),
+		Errors:   sl.summary.errors(),
+		Elapsed:  sl.phases.total(),
+		APICalls: sl.apiCalls.snapshot(),
+	}
+	if sl.throttle != nil {
+		m.ThrottledCalls = sl.throttle.throttled()
+		m.ThrottleWait = sl.throttle.waited()
+	}
+	return m
+}
 
-func (sl *AWSServerless) logTail(ctx context.Context, logGroupName string) error {
-	lastSeenTime := aws.Int64(aws.TimeUnixMilli(sl.startTime))
-	start := make(chan struct{}, 1)
-	done := make(chan struct{}, 1)
-	go func() {
-		apiTicker := time.NewTicker(watchSleepTime * time.Millisecond)
-		for range apiTicker.C {
-			start <- struct{}{}
+// groupingKey returns the grouping key of the metrics of the function in the Pushgateway
+func (sl *AWSServerless) groupingKey() []labelPair {
+	if sl.pushgateway == nil {
+		return nil
+	}
+	return sl.pushgateway.groupingKey(sl.ref.Name, sl.ref.Qualifier)
+}
+
+// logSummary logs the summary record of the Lambda invocation, with its streams, REPORT and phases
+func (sl *AWSServerless) logSummary(v verdict) {
+	sl.phases.mark(transitionRunEnd, time.Now())
+
+	st := sl.emitter.dedupStats()
+	summary := schema.RunSummary{
+		SchemaVersion:        schema.RunSummaryVersion,
+		FunctionName:         sl.funcName,
+		RequestID:            sl.requestID,
+		CredentialsProvider:  sl.credsProvider,
+		ConsoleURL:           sl.ref.ConsoleURL(),
+		FunctionURL:          sl.functionURL,
+		StatusCode:           sl.statusCode,
+		EventID:              sl.eventID,
+		MessageID:            sl.messageID,
+		InvocationState:      sl.invocationState.String(),
+		EventsReceived:       st.received,
+		DuplicatesSuppressed: st.suppressed,
+		CacheEvictions:       st.evictions,
+		PossibleDuplicates:   st.possibleDuplicates,
+		DetectedDuplicates:   st.detectedDuplicates,
+		CompletionStrategy:   sl.completion,
+		MetricsCompletion:    sl.inference,
+		Insights:             sl.insights,
+		SideEffects:          sl.sideEffects,
+		AttemptResults:       sl.attempts,
+		Requests:             sl.concurrent.requestsOf(sl.summary),
+		Warmup:               sl.warmup.summary(),
+		XRay:                 sl.xray.summary(),
+		Destination:          sl.destination.summary(),
+		Shipping:             sl.shipper.summary(),
+		SQS:                  sl.delivery.summary(),
+		Attempts:             len(sl.attempts),
+		ReadOnly:             sl.readOnly,
+		DryRun:               sl.dryRun,
+		NoLogs:               sl.noLogs,
+		Phases:               sl.phases.breakdown(),
+		RunCommon:            runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	if lines, bytes := sl.emitter.extensionStats(); lines > 0 {
+		summary.ExtensionLines, summary.ExtensionBytes = lines, bytes
+		if !sl.emitter.showExtension {
+			logger.Infof("%d extension log lines (%d bytes) are hidden, use -show-extension-logs to print them", lines, bytes)
 		}
-	}()
+	}
+	if streams, start := sl.summary.streams(); len(streams) > 0 {
+		summary.LogStreams = streams
+		summary.GetLogEventsCommands = getLogEventsCommands(sl.region, sl.logGroupName, streams, start)
+	}
+	if report := sl.summary.report(sl.requestID); report != nil {
+		summary.Report, summary.StartType = report, startType(report)
+	}
+	summary.Deadline = sl.deadline.summary()
+	for _, s := range sl.filterStrategies {
+		summary.FilterStrategies = append(summary.FilterStrategies, string(s))
+	}
+	if sl.logging.Off {
+		summary.Logging, summary.LoggingReason = "off", sl.logging.Reason
+	}
+	if sl.throttle != nil {
+		summary.ThrottledCalls = sl.throttle.throttled()
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
 
-	fn := func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
-		for _, event := range res.Events {
-			if _, ok := sl.eventCache.Peek(event.EventId); !ok {
-				sl.eventCache.Add(event.EventId, nil)
+// printTimeline prints the timeline of -timeline
+func (sl *AWSServerless) printTimeline() {
+	if sl.timeline == nil {
+		return
+	}
+	tl, ok := buildTimeline(sl.phases, sl.summary.report(sl.requestID), sl.timeline.snapshot())
+	if !ok {
+		logger.Infof("no timeline, %s was not invoked", sl.funcName)
+		return
+	}
+	tl.RequestID = sl.requestID
+	printTimeline(tl, sl.json)
+}
 
-				logger.Infow(*event.Message, zap.String("function_name", sl.funcName), zap.String("request_id", sl.requestID))
+// newSession returns a new session, guarded in read-only mode
+func (sl *AWSServerless) newSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(sl.awsOpts)
+	if err != nil {
+		return nil, err
+	}
+	if sl.readOnly {
+		enforceReadOnly(sess)
+	}
+	if sl.apiCalls != nil {
+		sl.apiCalls.install(sess)
+	}
+	return sess, nil
+}
 
-				if sl.requestID == "" {
-					start := startRequestRe.FindStringSubmatch(*event.Message)
-					if len(start) == 2 {
-						sl.requestID = start[1]
-					}
-				} else {
-					end := endRequestRe.FindStringSubmatch(*event.Message)
-					if len(end) == 2 {
-						done <- struct{}{}
-						if sl.requestID == end[1] {
-							logger.Infof("%s has been finished", sl.requestID)
-						} else {
-							logger.Infof("%s has already finished but not catched", sl.requestID)
-						}
-					}
-				}
+// logTailStart tails the logs by the client of the session of the pipeline, made by the preflight
+func (sl *AWSServerless) logTailStart(ctx context.Context) error {
+	if sl.logClient == nil {
+		return fmt.Errorf("no CloudWatch Logs client to tail the logs of %s, the preflight did not run", sl.funcName)
+	}
+	return sl.logTail(ctx, sl.logGroupName)
+}
 
+func (sl *AWSServerless) logTail(ctx context.Context, logGroupName string) error {
+	lastSeenTime := aws.Int64(aws.TimeUnixMilli(sl.startTime))
+	single := NewInvocationTracker(sl.requestID)
+	if sl.correlator != nil && sl.requestID == "" {
+		single = NewAdoptingTracker()
+	}
+	var tracker requestTracker = single
+	if sl.concurrent != nil {
+		tracker = sl.concurrent.tracker
+	}
+	sl.limits = sl.limits.orDefault()
+	if sl.throttle == nil {
+		sl.throttle = newThrottleController(time.Now, sl.limits)
+	}
+	defer func() { sl.invocationState = tracker.State() }()
+	var reportDeadline time.Time // set when END is observed
+	var startDeadline time.Time  // of -via eventbridge or sqs, whose invocation may never come
+	var endDeadline time.Time    // set when START is observed, from the timeout of the function
+	var noStart func() error
+	if sl.requestID == "" {
+		switch sl.via {
+		case viaEventBridge:
+			startDeadline, noStart = time.Now().Add(sl.eventBridge.startTimeout), sl.noStartError
+		case viaSQS:
+			// with the queue watched, the wait starts when the message is received
+			noStart = sl.noMatchError
+			if sl.delivery == nil {
+				startDeadline = time.Now().Add(sl.sqs.matchTimeout)
 			}
 		}
-		if lastPage && len(res.Events) > 0 {
-			lastSeenTime = res.Events[len(res.Events)-1].IngestionTime
+	}
+	apiTicker := time.NewTicker(sl.limits.PollInterval)
+	defer apiTicker.Stop()
+
+	handle := func(eventID, stream, message string, timestamp int64) {
+		if !sl.emitter.isNew(eventID, timestamp, message) {
+			return
 		}
-		return true
+		obs := tracker.ObserveLine(stream, message)
+		requestID := tracker.LineRequestID(stream)
+		label := ""
+		if sl.concurrent != nil {
+			label = sl.concurrent.labelOf(requestID)
+		}
+		sl.bus.publish(logEvent{
+			FunctionName:  sl.funcName,
+			RequestID:     requestID,
+			LogStream:     stream,
+			Message:       message,
+			Timestamp:     timestamp,
+			CorrelationID: sl.correlationID,
+			Label:         label,
+			Foreign:       requestID == "",
+		})
+		sl.observe(obs, stream, timestamp)
+		if sl.correlator != nil && single.RequestID() == "" {
+			if start, ok := sl.correlator.match(obs, stream, message, timestamp); ok {
+				single.Adopt(stream, start.requestID)
+				logger.Infof("%s is the invocation of the message %s", start.requestID, sl.messageID)
+				if sl.delivery != nil {
+					sl.delivery.advance(sqsInFlight, time.Now())
+				}
+				sl.observe(observation{Kind: lifecycleStart, RequestID: start.requestID}, stream, start.timestamp)
+			}
+		}
+		sl.requestID = tracker.RequestID()
 	}
 
 	for {
+		switch tracker.decision() {
+		case decisionComplete:
+			return nil
+		case decisionAwaitReport:
+			if reportDeadline.IsZero() {
+				reportDeadline = time.Now().Add(sl.limits.ReportGrace)
+			} else if time.Now().After(reportDeadline) {
+				logger.Debugf("REPORT of %s is not observed in %s", sl.requestID, sl.limits.ReportGrace)
+				return nil
+			}
+		}
+		if startDeadline.IsZero() && noStart != nil && sl.delivery != nil {
+			if at, ok := sl.delivery.inFlightSince(); ok {
+				startDeadline = at.Add(sl.sqs.matchTimeout)
+			}
+		}
+		if !startDeadline.IsZero() && tracker.State() == statePending && time.Now().After(startDeadline) {
+			return noStart()
+		}
+		if sl.endTimeout > 0 && sl.concurrent == nil && tracker.State() == stateStarted {
+			if endDeadline.IsZero() {
+				endDeadline = time.Now().Add(sl.endTimeout)
+			} else if time.Now().After(endDeadline) {
+				single.Timeout()
+				return &timeoutError{fmt.Errorf("END of %s is not observed in %s after its START, longer than the timeout of the function", sl.requestID, sl.endTimeout)}
+			}
+		}
+
 		select {
-		case <-start:
+		case <-apiTicker.C:
+			sl.throttle.prioritizeEvents(sl.requestID != "")
 			streams, err := sl.listLogStreams(ctx, logGroupName, *lastSeenTime)
+			if ctx.Err() != nil {
+				tracker.Abandon()
+				return ctx.Err()
+			}
 			if err != nil {
 				return fmt.Errorf("listLogStreams, %s: %w", logGroupName, err)
 			}
+			streams = filterStreamVersions(streams, sl.streamVersions)
 			if len(streams) == 0 {
 				continue
 			}
-			input := &cloudwatchlogs.FilterLogEventsInput{
-				StartTime:      lastSeenTime,
-				LogStreamNames: streams,
-				LogGroupName:   aws.String(logGroupName),
+			if err := sl.throttle.sleep(ctx, opFetchEvents); err != nil {
+				tracker.Abandon()
+				return err
 			}
 
-			if err := sl.logClient.FilterLogEventsPages(input, fn); err != nil {
-				if awsErr, ok := err.(awserr.Error); ok {
-					if awsErr.Code() == "ThrottlingException" {
-						logger.Info("Rate exceeded for %s. Wait for 500ms then retry.\n", logGroupName)
-						time.Sleep(500 * time.Millisecond)
-						continue
-					}
+			if sl.streamReader != nil {
+				sl.useFilterStrategy(strategyGetLogEvents)
+				var latest int64
+				latest, err = sl.streamReader.poll(ctx, sl.logClient, logGroupName, streams, *lastSeenTime, handle)
+				sl.throttle.observe(opFetchEvents, err)
+				if ctx.Err() != nil {
+					tracker.Abandon()
+					return ctx.Err()
+				}
+				if latest > *lastSeenTime {
+					lastSeenTime = aws.Int64(latest)
+				}
+			} else {
+				var watermark int64
+				watermark, err = sl.filterWindows(ctx, logGroupName, streams, *lastSeenTime, tracker, handle)
+				sl.throttle.observe(opFetchEvents, err)
+				lastSeenTime = aws.Int64(watermark)
+				if ctx.Err() != nil {
+					tracker.Abandon()
+					return ctx.Err()
+				}
+				if isAccessDenied(err) {
+					logger.Warnf("FilterLogEvents is denied, read the %d most recently active log streams by GetLogEvents instead, which is slower: %s", sl.limits.FallbackStreams, err)
+					sl.streamReader = newStreamReader(sl.limits.FallbackStreams)
+					continue
+				}
+			}
+			if err != nil {
+				if isThrottling(err) {
+					logger.Infof("Rate exceeded for %s. Cool down for %s then retry.", logGroupName, sl.throttle.wait(opFetchEvents))
+					continue
+				}
+				if sl.streamReader != nil {
+					return fmt.Errorf("GetLogEvents, %s: %w", logGroupName, err)
 				}
 				return fmt.Errorf("FilterLogEventsPages, %s: %w", logGroupName, err)
 			}
-		case <-done:
-			return nil
 		case <-ctx.Done():
+			tracker.Abandon()
 			return ctx.Err()
 		}
 	}
 }
 
+// now returns the current time of the clock
+func (sl *AWSServerless) now() time.Time {
+	if sl.clock != nil {
+		return sl.clock()
+	}
+	return time.Now()
+}
+
+// filterWindows filters the log events since the watermark, in sub-windows if it is long ago,
+// and returns the advanced watermark
+func (sl *AWSServerless) filterWindows(ctx context.Context, logGroupName string, streams []*string, since int64, tracker requestTracker, handle logEventHandler) (int64, error) {
+	var lastIngestion *int64 // of the last event of a FilterLogEvents call
+	fn := func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+		if ctx.Err() != nil {
+			return false // stop the pagination
+		}
+		for _, event := range res.Events {
+			handle(aws.StringValue(event.EventId), aws.StringValue(event.LogStreamName), aws.StringValue(event.Message), aws.Int64Value(event.Timestamp))
+		}
+		if lastPage && len(res.Events) > 0 {
+			lastIngestion = res.Events[len(res.Events)-1].IngestionTime
+		}
+		return true
+	}
+
+	now := sl.now()
+	windows := splitWindow(since, aws.TimeUnixMilli(now), maxFilterWindow, filterWindowStep)
+	if len(windows) > 1 {
+		logger.Debugf("window since %s is split into %d", msToTime(since).Format(time.RFC3339), len(windows))
+	}
+	prefixes := versionPrefixes(streamDatePrefixes(streams, sl.startTime, now, sl.streamPrefixMargin), sl.streamVersions)
+	for _, w := range windows {
+		inputs, strategy := buildFilterInputs(logGroupName, streams, w.Start, sl.requestID, prefixes)
+		if sl.useFilterStrategy(strategy) {
+			logger.Debugf("%d log streams are updated, filter log events by %s", len(streams), strategy)
+			if strategy == strategyGroup {
+				logger.Debugf("log streams are filtered by %s", formatPrefixes(prefixes))
+			}
+		}
+
+		// the checkpoint of an open window is the earliest of the last ingestions of the prefixes
+		var checkpoint *int64
+		for _, input := range inputs {
+			if w.End > 0 {
+				input.EndTime = aws.Int64(w.End)
+			}
+			lastIngestion = nil
+			if err := sl.logClient.FilterLogEventsPagesWithContext(ctx, input, fn); err != nil {
+				return since, err
+			}
+			if lastIngestion != nil && (checkpoint == nil || *lastIngestion < *checkpoint) {
+				checkpoint = lastIngestion
+			}
+		}
+		// events of a closed window may be ingested after later ones, so its end is the checkpoint
+		if w.End > 0 {
+			since = w.End + 1
+		} else if checkpoint != nil {
+			since = *checkpoint
+		}
+		if tracker.decision() == decisionComplete {
+			break
+		}
+	}
+	return since, nil
+}
+
+// useFilterStrategy records the strategy of a poll cycle, and returns true if it is switched
+func (sl *AWSServerless) useFilterStrategy(s filterStrategy) bool {
+	switched := sl.lastStrategy != s
+	sl.lastStrategy = s
+	for _, used := range sl.filterStrategies {
+		if used == s {
+			return switched
+		}
+	}
+	sl.filterStrategies = append(sl.filterStrategies, s)
+	return switched
+}
+
+// observe publishes the lifecycle of our request found by the tracker
+func (sl *AWSServerless) observe(obs observation, stream string, timestamp int64) {
+	if obs.Kind == "" || obs.Duplicate {
+		return
+	}
+	if obs.Foreign {
+		if obs.Kind == lifecycleEnd {
+			logger.Debugf("%s is not our request, ignored", obs.RequestID)
+		}
+		return
+	}
+	switch obs.Kind {
+	case lifecycleStart:
+		sl.phases.mark(transitionStarted, msToTime(timestamp))
+		sl.bus.publish(lifecycleEvent{Kind: lifecycleStart, RequestID: obs.RequestID, LogStream: stream, Timestamp: timestamp})
+	case lifecycleEnd:
+		sl.bus.publish(lifecycleEvent{Kind: lifecycleEnd, RequestID: obs.RequestID, LogStream: stream, Timestamp: timestamp})
+		sl.phases.mark(transitionEnded, msToTime(timestamp))
+		sl.phases.mark(transitionEndObserved, time.Now())
+		logger.Infof("%s has been finished", obs.RequestID)
+		if sl.delivery != nil {
+			sl.delivery.invoked(time.Now())
+		}
+	case lifecycleReport:
+		sl.bus.publish(reportEvent{Report: *obs.Report, LogStream: stream, Timestamp: timestamp})
+	}
+}
+
+// getLogEventsCommands returns AWS CLI commands which fetch the same log events
+func getLogEventsCommands(region, logGroupName string, streams []string, startTime int64) []string {
+	ret := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		cmd := fmt.Sprintf("aws logs get-log-events --log-group-name %s --log-stream-name %s --start-time %d",
+			shellQuote(logGroupName), shellQuote(stream), startTime)
+		if region != "" {
+			cmd += " --region " + shellQuote(region)
+		}
+		ret = append(ret, cmd)
+	}
+	return ret
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// msToTime converts milliseconds since the epoch used by CloudWatch Logs to time.Time
+func msToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// listLogStreams returns the log streams updated since, or the streams found last time while
+// discovery yields to event fetching in a cool-down. A throttled discovery returns no streams.
 func (sl *AWSServerless) listLogStreams(ctx context.Context, logGroupName string, since int64) ([]*string, error) {
+	if len(sl.knownStreams) > 0 && sl.throttle.skipDiscovery() {
+		return sl.knownStreams, nil
+	}
+	if err := sl.throttle.sleep(ctx, opDiscoverStreams); err != nil {
+		return nil, err
+	}
+
 	streams := make([]*string, 0, 10)
 	fn := func(res *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
 		hasUpdatedStream := false
@@ -241,16 +1445,18 @@ func (sl *AWSServerless) listLogStreams(ctx context.Context, logGroupName string
 		Descending:   aws.Bool(true),
 	}
 
-	if err := sl.logClient.DescribeLogStreamsPagesWithContext(ctx, input, fn); err != nil {
+	err := sl.logClient.DescribeLogStreamsPagesWithContext(ctx, input, fn)
+	sl.throttle.observe(opDiscoverStreams, err)
+	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			if awsErr.Code() == "ResourceNotFoundException" {
 				return streams, nil
-			} else if awsErr.Code() == "ThrottlingException" {
-				time.Sleep(500 * time.Millisecond)
+			} else if isThrottling(err) {
 				return nil, nil
 			}
 		}
 		return nil, fmt.Errorf("DescribeLogStreams, %w", err)
 	}
+	sl.knownStreams = streams
 	return streams, nil
 }
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
 )
 
 func TestAWSGetRequestId(t *testing.T) {
@@ -11,3 +23,665 @@ func TestAWSGetRequestId(t *testing.T) {
 		fmt.Println(ss)
 	}
 }
+
+func TestGetLogEventsCommands(t *testing.T) {
+	streams := []string{"2020/12/01/[$LATEST]0123456789abcdef", "2020/12/01/[42]it's"}
+	cmds := getLogEventsCommands("us-east-1", "/aws/lambda/my-function", streams, 1606780800000)
+	if len(cmds) != 2 {
+		t.Fatalf("got %v", cmds)
+	}
+	for i, cmd := range cmds {
+		args := shellSplit(t, cmd)
+		got := make(map[string]string)
+		for j := 3; j+1 < len(args); j += 2 {
+			got[args[j]] = args[j+1]
+		}
+		if got["--log-group-name"] != "/aws/lambda/my-function" || got["--log-stream-name"] != streams[i] ||
+			got["--start-time"] != "1606780800000" || got["--region"] != "us-east-1" {
+			t.Errorf("%d: %s", i, cmd)
+		}
+	}
+}
+
+// shellSplit splits a command quoted by shellQuote
+func shellSplit(t *testing.T, cmd string) []string {
+	var args []string
+	var cur strings.Builder
+	inQuote, inArg, escaped := false, false, false
+	for _, c := range cmd {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\' && !inQuote:
+			escaped = true
+			inArg = true
+		case c == '\'':
+			inQuote = !inQuote
+			inArg = true
+		case c == ' ' && !inQuote:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		t.Fatalf("unterminated quote: %s", cmd)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+func TestCheckPayloadSize(t *testing.T) {
+	// "あ" is 3 bytes of UTF-8, so the payload is within the limit by characters but not by bytes
+	multibyte := strings.Repeat("あ", maxAsyncPayloadSize/3+1)
+	tests := []struct {
+		invocationType string
+		payload        string
+		want           string
+	}{
+		{lambda.InvocationTypeEvent, strings.Repeat("x", maxAsyncPayloadSize), ""},
+		{lambda.InvocationTypeEvent, strings.Repeat("x", maxAsyncPayloadSize+1), "payload is 262145 bytes, exceeds the limit of 262144 bytes of the Event invocation type"},
+		{lambda.InvocationTypeEvent, multibyte, "payload is 262146 bytes (87382 characters of UTF-8), exceeds the limit of 262144 bytes of the Event invocation type"},
+		{lambda.InvocationTypeRequestResponse, multibyte, ""},
+		{lambda.InvocationTypeRequestResponse, strings.Repeat("x", maxSyncPayloadSize+1), "exceeds the limit of 6291456 bytes of the RequestResponse invocation type"},
+		{lambda.InvocationTypeDryRun, strings.Repeat("x", maxSyncPayloadSize+1), ""},
+	}
+	for _, tt := range tests {
+		err := checkPayloadSize(tt.invocationType, []byte(tt.payload))
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s %d bytes: got %v", tt.invocationType, len(tt.payload), err)
+		}
+	}
+
+	// the payload is not sent
+	sl := &AWSServerless{funcName: "orders-fn", payload: multibyte, invokeRetry: defaultInvokeRetryPolicy()}
+	api := &countingInvoke{}
+	if _, _, err := sl.callInvoke(context.Background(), api, sl.invokeInput(lambda.InvocationTypeEvent)); err == nil || !strings.Contains(err.Error(), "Event invocation type") || api.calls != 0 {
+		t.Errorf("got %v, %d calls", err, api.calls)
+	}
+}
+
+func TestChooseInvocationType(t *testing.T) {
+	tests := []struct {
+		preference   string
+		size         int
+		needResponse string
+		want         string
+		wantErr      bool
+	}{
+		{invocationAuto, 0, "", "Event", false},
+		{invocationAuto, maxAsyncPayloadSize, "", "Event", false},
+		{invocationAuto, maxAsyncPayloadSize + 1, "", "RequestResponse", false},
+		{invocationAuto, maxSyncPayloadSize, "", "RequestResponse", false},
+		{invocationAuto, maxSyncPayloadSize + 1, "", "", true},
+		{invocationAuto, 10, "-retry-if-response", "RequestResponse", false},
+		{invocationAuto, maxAsyncPayloadSize, "-expect-response-file", "RequestResponse", false},
+		{invocationEvent, maxAsyncPayloadSize, "", "Event", false},
+		{invocationEvent, maxAsyncPayloadSize + 1, "", "", true},
+		{invocationRequestResponse, 10, "", "RequestResponse", false},
+		{invocationRequestResponse, maxSyncPayloadSize + 1, "", "", true},
+	}
+	for _, tt := range tests {
+		got, reason, err := chooseInvocationType(tt.preference, tt.size, tt.needResponse)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %d: err %v", tt.preference, tt.size, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %d: got %s", tt.preference, tt.size, got)
+		}
+		if err == nil && reason == "" {
+			t.Errorf("%s %d: reason is empty", tt.preference, tt.size)
+		}
+	}
+}
+
+func TestCheckInvokeStatus(t *testing.T) {
+	for _, tt := range []struct {
+		invocationType string
+		status         int
+		ok             bool
+	}{
+		{"RequestResponse", 200, true},
+		{"Event", 202, true},
+		{"RequestResponse", 202, false},
+		{"Event", 200, false},
+	} {
+		if err := checkInvokeStatus(tt.invocationType, tt.status); (err == nil) != tt.ok {
+			t.Errorf("%s %d: got %v", tt.invocationType, tt.status, err)
+		}
+	}
+}
+
+func TestPrintResponse(t *testing.T) {
+	logs := setTestLogger(t)
+	for in, want := range map[string]string{
+		`{"ok":true,"items":[1]}`: "{\n  \"ok\": true,\n  \"items\": [\n    1\n  ]\n}\n",
+		"plain text":              "plain text\n",
+		"null":                    "null\n",
+	} {
+		var b bytes.Buffer
+		printResponse(&b, []byte(in), false)
+		if b.String() != want {
+			t.Errorf("%s: got %q", in, b.String())
+		}
+	}
+	var b bytes.Buffer
+	printResponse(&b, []byte(`{"ok":true}`), true)
+	if b.Len() != 0 || logs.FilterMessage("response").Len() != 1 {
+		t.Errorf("-json logs the response as a record, got %q", b.String())
+	}
+}
+
+// fakeLogs is embedded by fakes of logsAPI for the calls they do not serve
+type fakeLogs struct{}
+
+func (fakeLogs) GetLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.GetLogEventsInput, opts ...request.Option) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	return &cloudwatchlogs.GetLogEventsOutput{}, nil
+}
+
+// throttledLogs always throttles FilterLogEvents
+type throttledLogs struct {
+	fakeLogs
+	filtered chan struct{}
+}
+
+func (l *throttledLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	select {
+	case l.filtered <- struct{}{}:
+	default:
+	}
+	return awserr.New("ThrottlingException", "Rate exceeded", nil)
+}
+
+func (l *throttledLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	now := aws.Int64(aws.TimeUnixMilli(time.Now()))
+	fn(&cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []*cloudwatchlogs.LogStream{{
+			LogStreamName:       aws.String("stream"),
+			FirstEventTimestamp: now,
+			LastEventTimestamp:  now,
+			LastIngestionTime:   now,
+			UploadSequenceToken: aws.String("token"),
+		}},
+	}, true)
+	return nil
+}
+
+func TestLogTailStartWithoutClient(t *testing.T) {
+	setTestLogger(t)
+	sl := &AWSServerless{funcName: "f", phases: newPhaseTracker(time.Now())}
+	if err := sl.logTailStart(context.Background()); err == nil || !strings.Contains(err.Error(), "the preflight did not run") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLogTailCancelDuringThrottle(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &throttledLogs{filtered: make(chan struct{}, 1)}
+	sl := &AWSServerless{
+		funcName:  "f",
+		startTime: time.Now().Add(-time.Minute),
+		logClient: logs,
+		emitter:   em,
+		bus:       newBus(),
+		summary:   newSummaryBuilder(),
+		phases:    newPhaseTracker(time.Now()),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sl.logTail(ctx, "/aws/lambda/f")
+	}()
+
+	select {
+	case <-logs.filtered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FilterLogEvents is not called")
+	}
+	cancelled := time.Now()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("got %v", err)
+		}
+		if d := time.Since(cancelled); d >= defaultLimits.ThrottleCoolDown/2 {
+			t.Errorf("took %s to return after the cancellation", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("logTail does not return after the cancellation")
+	}
+}
+
+// windowedLogs serves events by the time window of FilterLogEvents, two events a page,
+// and throttles the call starting at throttleAt once after the first page
+type windowedLogs struct {
+	fakeLogs
+	mu         sync.Mutex
+	events     []*cloudwatchlogs.FilteredLogEvent
+	throttleAt int64
+	throttled  bool
+	starts     []int64
+}
+
+func (l *windowedLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.mu.Lock()
+	start := aws.Int64Value(input.StartTime)
+	l.starts = append(l.starts, start)
+	throttle := start == l.throttleAt && !l.throttled
+	l.throttled = l.throttled || throttle
+	l.mu.Unlock()
+
+	var page []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events {
+		ts := aws.Int64Value(e.Timestamp)
+		if ts < start || (input.EndTime != nil && ts > *input.EndTime) {
+			continue
+		}
+		page = append(page, e)
+		if len(page) == 2 {
+			if !fn(&cloudwatchlogs.FilterLogEventsOutput{Events: page}, false) {
+				return nil
+			}
+			page = nil
+			if throttle {
+				return awserr.New("ThrottlingException", "Rate exceeded", nil)
+			}
+		}
+	}
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: page}, true)
+	return nil
+}
+
+func (l *windowedLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	return (&throttledLogs{}).DescribeLogStreamsPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestLogTailSplitWindow(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20 minutes of logs, START at the beginning and END at the end
+	start := time.Now().Add(-20 * time.Minute)
+	startMs := aws.TimeUnixMilli(start)
+	logs := &windowedLogs{throttleAt: startMs + 3*int64(filterWindowStep/time.Millisecond)}
+	var want []string
+	for i := 0; i < 40; i++ {
+		msg := fmt.Sprintf("line %d", i)
+		switch i {
+		case 0:
+			msg = "START RequestId: req Version: $LATEST"
+		case 39:
+			msg = "END RequestId: req"
+		}
+		ts := startMs + int64(i)*30*1000
+		logs.events = append(logs.events, &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(fmt.Sprint(i)),
+			Message:       aws.String(msg),
+			LogStreamName: aws.String("stream"),
+			Timestamp:     aws.Int64(ts),
+			IngestionTime: aws.Int64(aws.TimeUnixMilli(time.Now())),
+		})
+		want = append(want, msg)
+	}
+
+	rec := &recordingSubscriber{}
+	b := newBus()
+	b.subscribe("rec", rec, subscribeOptions{})
+	sl := &AWSServerless{
+		funcName:  "f",
+		requestID: "req",
+		startTime: start,
+		logClient: logs,
+		emitter:   em,
+		bus:       b,
+		summary:   newSummaryBuilder(),
+		phases:    newPhaseTracker(time.Now()),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/f"); err != nil {
+		t.Fatal(err)
+	}
+	b.close(nil)
+
+	var got []string
+	for _, ev := range rec.events {
+		if e, ok := ev.(logEvent); ok {
+			got = append(got, e.Message)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events must be published once in order, got %v", got)
+	}
+
+	// the retry after the throttle resumes at the checkpoint of the throttled window
+	resumed := false
+	for i, s := range logs.starts {
+		if s == logs.throttleAt && i > 0 && logs.starts[i-1] == logs.throttleAt {
+			resumed = true
+		}
+		if i > 0 && s < logs.starts[i-1] && s != logs.throttleAt {
+			t.Errorf("windows must go forward, got %v", logs.starts)
+			break
+		}
+	}
+	if !resumed {
+		t.Errorf("throttled window must be retried from its start, got %v", logs.starts)
+	}
+	if len(logs.starts) < 20 {
+		t.Errorf("20 minutes must be split, got %d calls", len(logs.starts))
+	}
+}
+
+// deniedLogs denies FilterLogEvents and serves GetLogEvents two events a page with forward tokens
+type deniedLogs struct {
+	mu      sync.Mutex
+	streams map[string][]string
+	reads   int
+}
+
+func (l *deniedLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	return awserr.New("AccessDeniedException", "not authorized to perform: logs:FilterLogEvents", nil)
+}
+
+func (l *deniedLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	now := aws.Int64(aws.TimeUnixMilli(time.Now()))
+	var streams []*cloudwatchlogs.LogStream
+	for _, name := range []string{"s1", "s2"} {
+		streams = append(streams, &cloudwatchlogs.LogStream{
+			LogStreamName:       aws.String(name),
+			FirstEventTimestamp: now,
+			LastEventTimestamp:  now,
+			LastIngestionTime:   now,
+			UploadSequenceToken: aws.String("token"),
+		})
+	}
+	fn(&cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: streams}, true)
+	return nil
+}
+
+func (l *deniedLogs) GetLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.GetLogEventsInput, opts ...request.Option) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reads++
+	stream := aws.StringValue(input.LogStreamName)
+	pos := 0
+	if input.NextToken != nil {
+		fmt.Sscanf(strings.TrimPrefix(*input.NextToken, stream+"/"), "%d", &pos)
+	}
+	lines := l.streams[stream]
+	end := pos + 2
+	if end > len(lines) {
+		end = len(lines)
+	}
+	out := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String(fmt.Sprintf("%s/%d", stream, end))}
+	now := aws.TimeUnixMilli(time.Now())
+	for _, line := range lines[pos:end] {
+		out.Events = append(out.Events, &cloudwatchlogs.OutputLogEvent{
+			Message:       aws.String(line),
+			Timestamp:     aws.Int64(now),
+			IngestionTime: aws.Int64(now),
+		})
+	}
+	return out, nil
+}
+
+func TestLogTailGetLogEventsFallback(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": {"START RequestId: req Version: $LATEST", "line 1", "line 1", "line 2", "END RequestId: req", "REPORT RequestId: req\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"},
+		"s2": {"START RequestId: other Version: $LATEST", "other line"},
+	}}
+	rec := &recordingSubscriber{}
+	b := newBus()
+	b.subscribe("rec", rec, subscribeOptions{})
+	sl := &AWSServerless{
+		funcName:  "f",
+		requestID: "req",
+		startTime: time.Now(),
+		logClient: logs,
+		emitter:   em,
+		bus:       b,
+		summary:   newSummaryBuilder(),
+		phases:    newPhaseTracker(time.Now()),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/f"); err != nil {
+		t.Fatal(err)
+	}
+	b.close(nil)
+
+	if sl.invocationState != stateReported {
+		t.Errorf("got %s", sl.invocationState)
+	}
+	var got []string
+	for _, ev := range rec.events {
+		if e, ok := ev.(logEvent); ok && e.LogStream == "s1" {
+			got = append(got, e.Message)
+		}
+	}
+	if len(got) != len(logs.streams["s1"]) || got[2] != "line 1" {
+		t.Errorf("every event of the stream must be published once, got %q", got)
+	}
+	if fmt.Sprint(sl.filterStrategies) != "[log-streams get-log-events]" {
+		t.Errorf("got %v", sl.filterStrategies)
+	}
+}
+
+func TestLogTailSummaryForeignLines(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another request fails and times out in s1 before ours runs there
+	foreign := []string{"START RequestId: other Version: $LATEST", "ERROR other failed", "END RequestId: other", "REPORT RequestId: other\tDuration: 3000.00 ms\tBilled Duration: 3000 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB", "other Task timed out after 3.00 seconds"}
+	ours := []string{"START RequestId: req Version: $LATEST", "ERROR req failed", "END RequestId: req", "REPORT RequestId: req\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"}
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": append(append([]string{"ERROR before any START"}, foreign...), ours...),
+		"s2": {"START RequestId: another Version: $LATEST", "ERROR another failed"},
+	}}
+	sl := &AWSServerless{
+		funcName:  "f",
+		requestID: "req",
+		startTime: time.Now(),
+		logClient: logs,
+		emitter:   em,
+		bus:       newBus(),
+		summary:   newSummaryBuilder(),
+		phases:    newPhaseTracker(time.Now()),
+	}
+	sl.bus.subscribe("summary", sl.summary, subscribeOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/f"); err != nil {
+		t.Fatal(err)
+	}
+	if sl.summary.errors() != 1 || sl.summary.timedOut() != "" {
+		t.Errorf("only the error line of our request must be counted, got %d errors, timeout %q", sl.summary.errors(), sl.summary.timedOut())
+	}
+}
+
+// prefixLogs serves FilterLogEvents by the stream names or the stream name prefix, and the quoted request id
+type prefixLogs struct {
+	fakeLogs
+	events   []*cloudwatchlogs.FilteredLogEvent
+	prefixes []string
+}
+
+func (l *prefixLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.prefixes = append(l.prefixes, aws.StringValue(input.LogStreamNamePrefix))
+	var page []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events {
+		stream := aws.StringValue(e.LogStreamName)
+		if input.LogStreamNamePrefix != nil && !strings.HasPrefix(stream, *input.LogStreamNamePrefix) {
+			continue
+		}
+		if input.LogStreamNames != nil && !containsStream(input.LogStreamNames, stream) {
+			continue
+		}
+		if input.FilterPattern != nil && !strings.Contains(aws.StringValue(e.Message), strings.Trim(*input.FilterPattern, `"`)) {
+			continue
+		}
+		if aws.Int64Value(e.Timestamp) >= aws.Int64Value(input.StartTime) {
+			page = append(page, e)
+		}
+	}
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: page}, true)
+	return nil
+}
+
+func (l *prefixLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	return nil
+}
+
+func containsStream(streams []*string, name string) bool {
+	for _, s := range streams {
+		if aws.StringValue(s) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFilterWindowsAfterMidnight(t *testing.T) {
+	setTestLogger(t)
+	midnight := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	event := func(stream, message string, at time.Time) *cloudwatchlogs.FilteredLogEvent {
+		return &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(stream + message),
+			LogStreamName: aws.String(stream),
+			Message:       aws.String(message),
+			Timestamp:     aws.Int64(aws.TimeUnixMilli(at)),
+			IngestionTime: aws.Int64(aws.TimeUnixMilli(at)),
+		}
+	}
+	// too many streams of today are updated, and our request runs in an environment started yesterday
+	today := streamNames("2020/12/01/", maxFilterStreams+1)
+	older := "2020/11/30/[$LATEST]started-before-midnight"
+
+	tests := []struct {
+		name     string
+		runStart time.Time
+		margin   time.Duration
+		streams  []*string
+		want     bool
+	}{
+		{"within the margin", midnight.Add(10 * time.Second), defaultStreamPrefixMargin, today, true},
+		{"without the margin", midnight.Add(10 * time.Second), 0, today, false},
+		{"older stream is updated", midnight.Add(10 * time.Second), 0, append(today, aws.String(older)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs := &prefixLogs{events: []*cloudwatchlogs.FilteredLogEvent{
+				event(*today[0], "START RequestId: other Version: $LATEST", midnight.Add(15*time.Second)),
+				event(older, "START RequestId: req Version: $LATEST", midnight.Add(20*time.Second)),
+				event(older, "END RequestId: req", midnight.Add(25*time.Second)),
+			}}
+			now := midnight.Add(30 * time.Second)
+			sl := &AWSServerless{
+				funcName:           "f",
+				requestID:          "req",
+				startTime:          tt.runStart,
+				logClient:          logs,
+				emitter:            em,
+				bus:                newBus(),
+				summary:            newSummaryBuilder(),
+				streamPrefixMargin: tt.margin,
+				clock:              func() time.Time { return now },
+			}
+			tracker := NewInvocationTracker("req")
+			var got []string
+			handle := func(eventID, stream, message string, timestamp int64) {
+				got = append(got, message)
+				tracker.Observe(message)
+			}
+			if _, err := sl.filterWindows(context.Background(), "/aws/lambda/f", tt.streams, aws.TimeUnixMilli(tt.runStart), tracker, handle); err != nil {
+				t.Fatal(err)
+			}
+			captured := tracker.State() == stateEnded
+			if captured != tt.want {
+				t.Errorf("got %v by prefixes %q", got, logs.prefixes)
+			}
+		})
+	}
+}
+
+func TestRunTimeoutProgress(t *testing.T) {
+	em, _ := newTestEmitter(t, nil, time.Minute)
+	sl := &AWSServerless{funcName: "f", emitter: em, phases: newPhaseTracker(time.Now())}
+	if got := sl.progress(); got != "the function was not invoked, 0 log events printed" {
+		t.Errorf("got %q", got)
+	}
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+	sl.requestID = "r1"
+	em.emit("INIT_START Runtime Version: go:1")
+	if got := sl.progress(); got != "START of r1 was not matched, 1 log event printed" {
+		t.Errorf("got %q", got)
+	}
+	sl.phases.mark(transitionStarted, time.Now())
+	if got := sl.progress(); got != "START of r1 was matched but not END, 1 log event printed" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLogTailEndTimeout(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": {"START RequestId: req Version: $LATEST", "Task is still running"},
+	}}
+	sl := &AWSServerless{
+		funcName:   "f",
+		requestID:  "req",
+		startTime:  time.Now(),
+		logClient:  logs,
+		emitter:    em,
+		bus:        newBus(),
+		summary:    newSummaryBuilder(),
+		phases:     newPhaseTracker(time.Now()),
+		endTimeout: 100 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = sl.logTail(ctx, "/aws/lambda/f")
+	var te *timeoutError
+	if !errors.As(err, &te) || !strings.Contains(err.Error(), "END of req is not observed in 100ms") {
+		t.Fatalf("got %v", err)
+	}
+	if sl.invocationState != stateTimedOut {
+		t.Errorf("got %s", sl.invocationState)
+	}
+}
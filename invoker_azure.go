@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	azureAppInsightsEndpoint = "https://api.applicationinsights.io"
+	azureAPITimeout          = 30 * time.Second
+	azureInvokeTimeout       = 240 * time.Second // the front end of a function app closes a request at 230s
+	azureLogPollInterval     = 5 * time.Second
+	azureLogWait             = 5 * time.Minute // Application Insights ingests the telemetry in minutes
+	azureLogLookback         = time.Minute     // clock skew allowed to the timestamps of the telemetry
+	azureInvocationIDHeader  = "X-Ms-Invocation-Id"
+)
+
+// azureFunctionName is APP/FUNCTION, the function app and the function in it
+type azureFunctionName struct {
+	App      string
+	Function string
+}
+
+// parseAzureFunctionName parses APP/FUNCTION
+func parseAzureFunctionName(s string) (azureFunctionName, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return azureFunctionName{}, fmt.Errorf("function name must be FUNCTION_APP/FUNCTION, %s", s)
+	}
+	return azureFunctionName{App: parts[0], Function: parts[1]}, nil
+}
+
+func (n azureFunctionName) String() string {
+	return n.App + "/" + n.Function
+}
+
+// url returns the default URL of the HTTP trigger of the function
+func (n azureFunctionName) url() string {
+	return fmt.Sprintf("https://%s.azurewebsites.net/api/%s", n.App, url.PathEscape(n.Function))
+}
+
+// azureTelemetry is a row of the traces, exceptions and requests of Application Insights
+type azureTelemetry struct {
+	Timestamp     time.Time
+	ItemID        string
+	ItemType      string // "trace", "exception" or "request"
+	Message       string
+	SeverityLevel int // of a trace, 0 verbose to 4 critical
+	OuterMessage  string
+	Success       bool // of a request
+	ResultCode    string
+	Duration      float64 // milliseconds of a request
+}
+
+// azureSeverities are the names of the severity levels of a trace which count as errors
+var azureSeverities = map[int]string{2: "WARNING", 3: "ERROR", 4: "CRITICAL"}
+
+// message returns the log line of the row
+func (r *azureTelemetry) message() string {
+	switch r.ItemType {
+	case "exception":
+		return "ERROR " + r.OuterMessage
+	case "request":
+		return fmt.Sprintf("request %s in %.0fms, success %v", r.ResultCode, r.Duration, r.Success)
+	}
+	msg := strings.TrimRight(r.Message, "\n")
+	if s, ok := azureSeverities[r.SeverityLevel]; ok {
+		return s + " " + msg
+	}
+	return msg
+}
+
+// azureQueryResult is the response of the query API of Application Insights
+type azureQueryResult struct {
+	Tables []struct {
+		Columns []struct {
+			Name string `json:"name"`
+		} `json:"columns"`
+		Rows [][]interface{} `json:"rows"`
+	} `json:"tables"`
+}
+
+// telemetry returns the rows of the first table
+func (q *azureQueryResult) telemetry() []azureTelemetry {
+	if len(q.Tables) == 0 {
+		return nil
+	}
+	t := q.Tables[0]
+	var ret []azureTelemetry
+	for _, row := range t.Rows {
+		var r azureTelemetry
+		for i, c := range t.Columns {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			switch v := row[i].(type) {
+			case string:
+				switch c.Name {
+				case "timestamp":
+					r.Timestamp, _ = time.Parse(time.RFC3339Nano, v)
+				case "itemId":
+					r.ItemID = v
+				case "itemType":
+					r.ItemType = v
+				case "message":
+					r.Message = v
+				case "outerMessage":
+					r.OuterMessage = v
+				case "resultCode":
+					r.ResultCode = v
+				}
+			case float64:
+				switch c.Name {
+				case "severityLevel":
+					r.SeverityLevel = int(v)
+				case "duration":
+					r.Duration = v
+				}
+			case bool:
+				if c.Name == "success" {
+					r.Success = v
+				}
+			}
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// AzureServerless invokes an Azure function over its HTTP trigger and tails its telemetry from
+// Application Insights. The request carries a trace of its own, whose id is the operation id of
+// the telemetry.
+type AzureServerless struct {
+	name        azureFunctionName
+	payload     string
+	url         string
+	functionKey string
+	appID       string
+
+	client      *http.Client
+	tokens      *azureTokenCache
+	insightsURL string
+	logPoll     time.Duration
+	logWait     time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	invocationID  string
+	operationID   string
+	statusCode    int
+	duration      time.Duration
+	received      int
+	logsComplete  bool
+	requestFailed bool // the request telemetry reports a failure
+}
+
+var _ consoleInvoker = (*AzureServerless)(nil)
+
+// NewAzureServerless returns new Serverless struct for Azure Functions
+func NewAzureServerless(config *Config) (*AzureServerless, error) {
+	name, err := parseAzureFunctionName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Azure Functions do not log")
+	}
+	// every query returns the telemetry since the start again
+	em, err := newEmitter(logger, config.rules, azureLogLookback+azureInvokeTimeout+azureLogWait)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	sl := &AzureServerless{
+		name:             name,
+		payload:          config.payload,
+		url:              name.url(),
+		functionKey:      config.azureFunctionKey,
+		appID:            config.appInsightsAppID,
+		client:           &http.Client{Timeout: azureAPITimeout},
+		insightsURL:      azureAppInsightsEndpoint,
+		logPoll:          azureLogPollInterval,
+		logWait:          azureLogWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}
+	if sl.appID != "" {
+		creds := findAzureCredentials(os.Getenv, sl.client)
+		logger.Debugf("azure credentials are %s", creds.kind())
+		sl.tokens = newAzureTokenCache(creds)
+	} else {
+		logger.Warnf("no -appinsights-app-id, the logs of %s are not tailed", name)
+	}
+	return sl, nil
+}
+
+// Capabilities returns the options Azure Functions support
+func (sl *AzureServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorAzure]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *AzureServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// Invoke calls the function and tails its telemetry
+func (sl *AzureServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name.String(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	traceID, err := newTraceID()
+	if err != nil {
+		return err
+	}
+	sl.operationID = traceID
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	start := time.Now()
+	body, callErr := sl.call(ctx, traceID)
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	sl.bus.publish(lifecycleEvent{Kind: "END", RequestID: sl.requestID(), Timestamp: unixMilli(time.Now())})
+
+	// the logs of a failed function are what explains the failure
+	if callErr == nil {
+		callErr = sl.checkResponse(body)
+	}
+	if sl.tokens != nil {
+		if err := sl.tailLogs(ctx, start.Add(-azureLogLookback)); err != nil {
+			return err
+		}
+	}
+	if callErr != nil {
+		return callErr
+	}
+	if sl.requestFailed {
+		return &functionError{fmt.Errorf("%s reported a failure", sl.name)}
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// requestID returns the id of the invocation in the events
+func (sl *AzureServerless) requestID() string {
+	if sl.invocationID != "" {
+		return sl.invocationID
+	}
+	return sl.operationID
+}
+
+// call posts the payload to the HTTP trigger, and returns the response of a 2xx status
+func (sl *AzureServerless) call(ctx context.Context, traceID string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, sl.url, strings.NewReader(sl.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sl.functionKey != "" {
+		req.Header.Set("x-functions-key", sl.functionKey)
+	}
+	// W3C trace context, whose trace id becomes the operation id of the telemetry
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", traceID, traceID[:16]))
+
+	client := *sl.client
+	client.Timeout = azureInvokeTimeout
+
+	start := time.Now()
+	sl.bus.publish(lifecycleEvent{Kind: "START", RequestID: traceID, Timestamp: unixMilli(start)})
+	resp, err := client.Do(req.WithContext(ctx))
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.name, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response of %s: %w", sl.name, err)
+	}
+	sl.statusCode = resp.StatusCode
+	sl.invocationID = resp.Header.Get(azureInvocationIDHeader)
+	logger.Infof("%s responds %s in %s, invocation %s", sl.name, resp.Status, sl.duration.Round(time.Millisecond), sl.requestID())
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("invoke %s: %s, check -azure-function-key: %s", sl.name, resp.Status, truncateMiddle(string(body), 512))
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("invoke %s: %s, no such function at %s", sl.name, resp.Status, sl.url)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", resp.Status, truncateMiddle(string(body), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *AzureServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// logQuery returns the query of the telemetry of the invocation since the time
+func (sl *AzureServerless) logQuery(since time.Time) string {
+	match := fmt.Sprintf("operation_Id == %q", sl.operationID)
+	if sl.invocationID != "" {
+		match += fmt.Sprintf(" or tostring(customDimensions.InvocationId) == %q", sl.invocationID)
+	}
+	return fmt.Sprintf(`union traces, exceptions, requests
+| where timestamp >= datetime(%s)
+| where %s
+| project timestamp, itemId, itemType, message, severityLevel, outerMessage, success, resultCode, duration
+| order by timestamp asc`, since.UTC().Format(time.RFC3339Nano), match)
+}
+
+// query runs the query on Application Insights
+func (sl *AzureServerless) query(ctx context.Context, query string) ([]azureTelemetry, error) {
+	token, err := sl.tokens.token(ctx, azureAppInsightsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, sl.insightsURL+"/v1/apps/"+url.PathEscape(sl.appID)+"/query", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("query application insights: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("query application insights: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("query application insights %s: %s: %s", sl.appID, resp.Status, truncateMiddle(string(body), 512))
+	}
+	var out azureQueryResult
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("query application insights: %w", err)
+	}
+	return out.telemetry(), nil
+}
+
+// tailLogs prints the telemetry of the invocation. Application Insights ingests it late, so it is
+// polled until the request telemetry is seen and a poll finds nothing new, or until logWait passes.
+// The rows are deduplicated by the event cache of the emitter.
+func (sl *AzureServerless) tailLogs(ctx context.Context, since time.Time) error {
+	query := sl.logQuery(since)
+	logger.Debugf("log query: %s", query)
+	requestSeen := false
+	deadline := time.Now().Add(sl.logWait)
+	for {
+		rows, err := sl.query(ctx, query)
+		if err != nil {
+			return err
+		}
+		fresh := 0
+		for i := range rows {
+			r := &rows[i]
+			message := r.message()
+			if !sl.emitter.isNew(r.ItemID, unixMilli(r.Timestamp), message) {
+				continue
+			}
+			fresh++
+			if r.ItemType == "request" {
+				requestSeen = true
+				sl.requestFailed = !r.Success
+			}
+			sl.received++
+			sl.bus.publish(logEvent{
+				FunctionName: sl.name.String(),
+				RequestID:    sl.requestID(),
+				Message:      message,
+				Timestamp:    unixMilli(r.Timestamp),
+			})
+		}
+		if requestSeen && fresh == 0 {
+			sl.logsComplete = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			logger.Warnf("the logs of %s may be incomplete after %s, Application Insights ingests them late", sl.name, sl.logWait)
+			return nil
+		}
+		if err := sleepContext(ctx, sl.logPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *AzureServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name.String(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the HTTP-triggered Azure function
+func (sl *AzureServerless) logSummary(v verdict) {
+	summary := schema.AzureRunSummary{
+		SchemaVersion:  schema.AzureRunSummaryVersion,
+		FunctionName:   sl.name.String(),
+		URL:            sl.url,
+		InvocationID:   sl.invocationID,
+		OperationID:    sl.operationID,
+		StatusCode:     sl.statusCode,
+		Duration:       sl.duration,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAzureFunctionName(t *testing.T) {
+	n, err := parseAzureFunctionName("orders-app/HttpOrder")
+	if err != nil || n.App != "orders-app" || n.Function != "HttpOrder" || n.url() != "https://orders-app.azurewebsites.net/api/HttpOrder" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	for _, s := range []string{"orders-app", "orders-app/", "/HttpOrder", "a/b/c"} {
+		if _, err := parseAzureFunctionName(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+}
+
+// fakeAzure serves the HTTP trigger of a function, Entra ID and the query API of Application
+// Insights, which returns more telemetry at each query as the ingestion lags
+type fakeAzure struct {
+	*httptest.Server
+	status        int
+	success       bool // of the request telemetry
+	invocationID  string
+	ingestedAfter int // queries before the request telemetry is ingested
+
+	mu          sync.Mutex
+	operationID string
+	queries     []string
+}
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	f := &fakeAzure{status: http.StatusOK, success: true, invocationID: "4d1c1a0e-0000-4000-8000-000000000001", ingestedAfter: 1}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/HttpOrder", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-functions-key") != "fn-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// 00-<trace id>-<span id>-01
+		parts := strings.Split(r.Header.Get("traceparent"), "-")
+		if len(parts) != 4 || len(parts[1]) != 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.operationID = parts[1]
+		f.mu.Unlock()
+		if f.invocationID != "" {
+			w.Header().Set("x-ms-invocation-id", f.invocationID)
+		}
+		w.WriteHeader(f.status)
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "eyJ.entra", "expires_in": 3599}`)
+	})
+	mux.HandleFunc("/v1/apps/app-id/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer eyJ.entra" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in struct {
+			Query string `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		f.mu.Lock()
+		f.queries = append(f.queries, in.Query)
+		n, op := len(f.queries), f.operationID
+		f.mu.Unlock()
+
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		rows := [][]interface{}{}
+		if strings.Contains(in.Query, fmt.Sprintf("operation_Id == %q", op)) {
+			rows = append(rows,
+				[]interface{}{now, "t-1", "trace", "Executing 'Functions.HttpOrder'", 1.0, nil, nil, nil, nil},
+				[]interface{}{now, "t-2", "trace", "order rejected", 3.0, nil, nil, nil, nil},
+			)
+			if n > f.ingestedAfter {
+				rows = append(rows, []interface{}{now, "r-1", "request", nil, nil, nil, f.success, fmt.Sprint(f.status), 12.5})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tables": []interface{}{map[string]interface{}{
+				"name": "PrimaryResult",
+				"columns": []map[string]string{
+					{"name": "timestamp"}, {"name": "itemId"}, {"name": "itemType"}, {"name": "message"}, {"name": "severityLevel"},
+					{"name": "outerMessage"}, {"name": "success"}, {"name": "resultCode"}, {"name": "duration"},
+				},
+				"rows": rows,
+			}},
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runAzure(t *testing.T, f *fakeAzure, config *Config) (*AzureServerless, error) {
+	t.Helper()
+	setTestEnv(t, "AZURE_TENANT_ID", "tenant")
+	setTestEnv(t, "AZURE_CLIENT_ID", "client")
+	setTestEnv(t, "AZURE_CLIENT_SECRET", "secret")
+	setTestEnv(t, "AZURE_FEDERATED_TOKEN_FILE", "")
+	config.funcName = "orders-app/HttpOrder"
+	if config.azureFunctionKey == "" {
+		config.azureFunctionKey = "fn-key"
+	}
+	sl, err := NewAzureServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.url = f.URL + "/api/HttpOrder"
+	sl.insightsURL = f.URL
+	if sl.tokens != nil {
+		sl.tokens.creds.(*azureClientCredentials).tokenURL = f.URL + "/token"
+	}
+	sl.logPoll, sl.logWait = 10*time.Millisecond, time.Second
+	return sl, sl.Invoke(context.Background())
+}
+
+func TestAzureInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeAzure(t)
+	sl, err := runAzure(t, f, &Config{payload: `{"id":1}`, appInsightsAppID: "app-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != 200 || sl.invocationID != f.invocationID || sl.operationID != f.operationID || !sl.logsComplete {
+		t.Errorf("got %+v", sl)
+	}
+	// each query returns the rows again, they are printed once
+	if sl.received != 3 || logs.FilterMessageSnippet("order rejected").Len() != 1 || sl.summary.errors() != 1 {
+		t.Errorf("got %d events, %d errors", sl.received, sl.summary.errors())
+	}
+	if len(f.queries) < 3 || !strings.Contains(f.queries[0], f.invocationID) {
+		t.Errorf("the telemetry is polled until the request is ingested, got %v", f.queries)
+	}
+}
+
+func TestAzureInvokeFailure(t *testing.T) {
+	setTestLogger(t)
+	var fe *functionError
+
+	f := newFakeAzure(t)
+	f.status, f.success = http.StatusInternalServerError, false
+	sl, err := runAzure(t, f, &Config{payload: `{}`, appInsightsAppID: "app-id"})
+	if !errors.As(err, &fe) || sl.received != 3 {
+		t.Errorf("HTTP 500 is a function error with its logs, got %v, %d events", err, sl.received)
+	}
+
+	// the response is OK, but the host reports a failure
+	f = newFakeAzure(t)
+	f.success = false
+	if _, err := runAzure(t, f, &Config{payload: `{}`, appInsightsAppID: "app-id"}); !errors.As(err, &fe) || !strings.Contains(err.Error(), "reported a failure") {
+		t.Errorf("got %v", err)
+	}
+
+	f = newFakeAzure(t)
+	if _, err := runAzure(t, f, &Config{payload: `{}`, azureFunctionKey: "wrong"}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "-azure-function-key") {
+		t.Errorf("a wrong key is an error of the run, got %v", err)
+	}
+}
+
+func TestAzureInvokeWithoutAppInsights(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeAzure(t)
+	f.invocationID = ""
+	sl, err := runAzure(t, f, &Config{payload: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.queries) != 0 || sl.received != 0 || sl.requestID() != sl.operationID {
+		t.Errorf("got %+v", sl)
+	}
+	if logs.FilterMessageSnippet("are not tailed").Len() != 1 {
+		t.Errorf("no warning")
+	}
+}
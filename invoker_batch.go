@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	batchPollInterval    = 5 * time.Second
+	batchLogGrace        = 10 * time.Second // awslogs may deliver the last lines a while after the job stops
+	batchTerminateWait   = 30 * time.Second // how long the termination of an interrupted run may take
+	batchPayloadEnv      = gcpJobPayloadEnv // the same as a Cloud Run job and an ECS task
+	batchMaxOverrides    = ecsMaxOverrides  // the overrides are passed to the ECS task of the job
+	batchDefaultLogGroup = "/aws/batch/job"
+	batchJobNameSuffix   = "-k8s-nodeless"
+	batchMaxJobName      = 128
+)
+
+// batchAPI is the part of AWS Batch API used to run a job
+type batchAPI interface {
+	SubmitJobWithContext(aws.Context, *batch.SubmitJobInput, ...request.Option) (*batch.SubmitJobOutput, error)
+	DescribeJobsWithContext(aws.Context, *batch.DescribeJobsInput, ...request.Option) (*batch.DescribeJobsOutput, error)
+	TerminateJobWithContext(aws.Context, *batch.TerminateJobInput, ...request.Option) (*batch.TerminateJobOutput, error)
+}
+
+// batchRegion returns the region of the first Batch ARN among the job definition and the job queue,
+// "" if both are names
+func batchRegion(names ...string) string {
+	for _, s := range names {
+		if p := strings.Split(s, ":"); len(p) >= 6 && p[0] == "arn" && p[2] == "batch" {
+			return p[3]
+		}
+	}
+	return ""
+}
+
+// parseBatchParameters parses the payload of -batch-parameters, a JSON object whose values are
+// strings, numbers or booleans
+func parseBatchParameters(payload string) (map[string]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("-batch-parameters needs a JSON object as the payload")
+	}
+	params := make(map[string]string, len(fields))
+	for k, raw := range fields {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			params[k] = v
+		case float64, bool:
+			params[k] = string(raw)
+		default:
+			return nil, fmt.Errorf("-batch-parameters: parameter %s must be a string, a number or a boolean, %s", k, raw)
+		}
+	}
+	return params, nil
+}
+
+var batchJobNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// batchJobName returns the name of a job of the definition, which names it in the console
+func batchJobName(definition string) string {
+	s := definition[strings.LastIndex(definition, "/")+1:]
+	if i := strings.Index(s, ":"); i >= 0 {
+		s = s[:i]
+	}
+	s = batchJobNameRe.ReplaceAllString(s, "_")
+	if max := batchMaxJobName - len(batchJobNameSuffix); len(s) > max {
+		s = s[:max]
+	}
+	return s + batchJobNameSuffix
+}
+
+// batchAttempt is an attempt of a job
+type batchAttempt = schema.BatchAttempt
+
+// BatchJob submits a job of an AWS Batch job definition to a job queue, tails the log stream of
+// each attempt, and waits for the job to succeed or fail. The outcome is the exit code of the
+// container of the last attempt.
+type BatchJob struct {
+	jobDefinition string // NAME, NAME:REVISION or the ARN
+	jobQueue      string
+	payload       string
+	parameters    map[string]string // of -batch-parameters, given instead of NODELESS_PAYLOAD
+
+	api       batchAPI
+	logClient func(region string) logsAPI
+	poll      time.Duration
+	logGrace  time.Duration
+	limits    Limits
+	throttle  *throttleController
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+	cancelExecution  bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	jobID        string
+	jobName      string
+	status       string
+	statusReason string
+	attempts     []batchAttempt // finished ones, from the job
+	exitCode     *int64         // of the last attempt
+	duration     time.Duration
+	interrupted  bool
+	terminated   bool
+
+	mu           sync.Mutex // the tail reads the streams and publishes beside the polls of the job
+	logGroup     string
+	logRegion    string
+	noLogs       bool     // the container does not log by awslogs
+	streams      []string // of the attempts, in the order they are known
+	received     int
+	logsComplete bool
+}
+
+var _ consoleInvoker = (*BatchJob)(nil)
+
+// NewBatchJob returns new Invoker which submits an AWS Batch job
+func NewBatchJob(config *Config) (*BatchJob, error) {
+	if config.jobQueue == "" {
+		return nil, fmt.Errorf("-job-queue is required, a job is submitted to a job queue")
+	}
+	if len(config.payload) > batchMaxOverrides {
+		return nil, fmt.Errorf("payload is %d bytes, exceeds the %d characters of the overrides of a job", len(config.payload), batchMaxOverrides)
+	}
+	var params map[string]string
+	if config.batchParameters {
+		var err error
+		if params, err = parseBatchParameters(config.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	awsOpts, err := newAWSSessionOptions(batchRegion(config.funcName, config.jobQueue), config.network, config.noCredentialCache)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("aws session error: %w", err)
+	}
+
+	limits := config.limits.orDefault()
+	em, err := newEmitter(logger, config.rules, limits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &BatchJob{
+		jobDefinition: config.funcName,
+		jobQueue:      config.jobQueue,
+		payload:       config.payload,
+		parameters:    params,
+		api:           batch.New(sess),
+		logClient: func(region string) logsAPI {
+			if region == "" {
+				return cloudwatchlogs.New(sess)
+			}
+			return cloudwatchlogs.New(sess, aws.NewConfig().WithRegion(region))
+		},
+		poll:             batchPollInterval,
+		logGrace:         batchLogGrace,
+		limits:           limits,
+		throttle:         newThrottleController(time.Now, limits),
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		cancelExecution:  config.cancelExecution,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+	}, nil
+}
+
+// Capabilities returns the options an AWS Batch job supports
+func (j *BatchJob) Capabilities() Capabilities {
+	return vendorCapabilities[VendorAWSBatch]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (j *BatchJob) consoleEmitter() *emitter {
+	return j.emitter
+}
+
+// Invoke submits the job and follows it until it succeeds or fails. When ctx is cancelled, the job
+// keeps running unless -cancel-execution is given.
+func (j *BatchJob) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := j.verdict(err)
+		j.logSummary(v)
+		if berr := j.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if j.pushgateway != nil {
+			pushRunMetrics(j.pushgateway, j.pushgateway.groupingKey(j.definitionName(), ""), &runMetrics{
+				Outcome:        v.Outcome,
+				Errors:         j.summary.errors(),
+				Elapsed:        j.duration,
+				ThrottledCalls: j.throttle.throttled(),
+				ThrottleWait:   j.throttle.waited(),
+			})
+		}
+		finishRun(v, j.githubStatus)
+	}()
+
+	start := time.Now()
+	if err := j.submit(ctx); err != nil {
+		return err
+	}
+	logger.Infof("job %s (%s) is submitted to %s, payload sha256:%s (%d bytes)", j.jobID, j.jobName, j.jobQueue, j.integrity.sent, len(j.payload))
+	j.publish(lifecycleEvent{Kind: lifecycleStart, RequestID: j.jobID, Timestamp: unixMilli(start)})
+
+	// the tail outlives the polls of the job by logGrace at most
+	tailCtx, stopTail := context.WithCancel(context.Background())
+	defer stopTail()
+	stopped := make(chan struct{})
+	var tail sync.WaitGroup
+	tail.Add(1)
+	go func() {
+		defer tail.Done()
+		err := j.tail(tailCtx, start, stopped)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.logsComplete = err == nil && !j.noLogs
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger.Warnf("the logs of job %s are incomplete, %s", j.jobID, err)
+		}
+	}()
+	followErr := j.follow(ctx)
+	j.duration = time.Since(start)
+	close(stopped)
+	if followErr == nil {
+		waitGroup(&tail, j.logGrace)
+	}
+	stopTail()
+	tail.Wait()
+
+	if followErr != nil {
+		if ctx.Err() != nil {
+			return j.interrupt(ctx.Err())
+		}
+		return followErr
+	}
+	j.publish(lifecycleEvent{Kind: lifecycleEnd, RequestID: j.jobID, Timestamp: unixMilli(time.Now())})
+
+	if j.status == batch.JobStatusFailed {
+		if j.exitCode != nil && *j.exitCode != 0 {
+			code := int(*j.exitCode)
+			return &functionError{&exitError{code: code, err: fmt.Errorf("job %s failed, its container exited with %d%s", j.jobID, code, j.failure())}}
+		}
+		return fmt.Errorf("job %s failed%s", j.jobID, j.failure())
+	}
+	return j.integrity.check(j.requireIntegrity)
+}
+
+// definitionName returns the name of the job definition, without the revision
+func (j *BatchJob) definitionName() string {
+	s := j.jobDefinition[strings.LastIndex(j.jobDefinition, "/")+1:]
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// submit submits the job. The payload is given to the container in NODELESS_PAYLOAD, or as the
+// parameters of the job with -batch-parameters.
+func (j *BatchJob) submit(ctx context.Context) error {
+	j.jobName = batchJobName(j.jobDefinition)
+	input := &batch.SubmitJobInput{
+		JobDefinition: aws.String(j.jobDefinition),
+		JobName:       aws.String(j.jobName),
+		JobQueue:      aws.String(j.jobQueue),
+	}
+	switch {
+	case j.parameters != nil:
+		input.Parameters = aws.StringMap(j.parameters)
+	case j.payload != "":
+		input.ContainerOverrides = &batch.ContainerOverrides{
+			Environment: []*batch.KeyValuePair{{Name: aws.String(batchPayloadEnv), Value: aws.String(j.payload)}},
+		}
+	}
+	res, err := j.api.SubmitJobWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("SubmitJob, %s: %w", j.definitionName(), err)
+	}
+	j.jobID = aws.StringValue(res.JobId)
+	j.status = batch.JobStatusSubmitted
+	return nil
+}
+
+// follow polls the job until it succeeds or fails
+func (j *BatchJob) follow(ctx context.Context) error {
+	for {
+		res, err := j.api.DescribeJobsWithContext(ctx, &batch.DescribeJobsInput{Jobs: []*string{aws.String(j.jobID)}})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("DescribeJobs, %s: %w", j.jobID, err)
+		}
+		if len(res.Jobs) == 0 {
+			return fmt.Errorf("DescribeJobs, %s: no such job", j.jobID)
+		}
+		j.observe(res.Jobs[0])
+		if j.status == batch.JobStatusSucceeded || j.status == batch.JobStatusFailed {
+			return nil
+		}
+		if err := sleepContext(ctx, j.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// observe prints a change of the status of the job, and records its attempts and their log streams
+func (j *BatchJob) observe(job *batch.JobDetail) {
+	if status := aws.StringValue(job.Status); status != j.status {
+		j.status = status
+		if reason := aws.StringValue(job.StatusReason); reason != "" {
+			logger.Infof("job %s is %s, %s", j.jobID, status, reason)
+		} else {
+			logger.Infof("job %s is %s", j.jobID, status)
+		}
+	}
+	j.statusReason = aws.StringValue(job.StatusReason)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if c := job.Container; c != nil && j.logGroup == "" && !j.noLogs {
+		j.logGroup = batchDefaultLogGroup
+		if lc := c.LogConfiguration; lc != nil {
+			if aws.StringValue(lc.LogDriver) != batch.LogDriverAwslogs {
+				j.noLogs = true
+				logger.Warnf("the container of job %s logs by %s, its logs are not tailed", j.jobID, aws.StringValue(lc.LogDriver))
+			}
+			if g := aws.StringValue(lc.Options["awslogs-group"]); g != "" {
+				j.logGroup = g
+			}
+			j.logRegion = aws.StringValue(lc.Options["awslogs-region"])
+		}
+	}
+
+	j.attempts = j.attempts[:0]
+	for _, a := range job.Attempts {
+		attempt := batchAttempt{StatusReason: aws.StringValue(a.StatusReason)}
+		if c := a.Container; c != nil {
+			attempt.LogStream = aws.StringValue(c.LogStreamName)
+			attempt.Reason = aws.StringValue(c.Reason)
+			if c.ExitCode != nil {
+				code := int(*c.ExitCode)
+				attempt.ExitCode = &code
+			}
+			j.exitCode = c.ExitCode
+		}
+		j.attempts = append(j.attempts, attempt)
+		j.addStream(attempt.LogStream)
+	}
+	if c := job.Container; c != nil {
+		// the stream of the running attempt, which is not in the attempts until it is finished
+		j.addStream(aws.StringValue(c.LogStreamName))
+		if len(job.Attempts) == 0 && c.ExitCode != nil {
+			j.exitCode = c.ExitCode
+		}
+	}
+}
+
+// addStream adds the log stream of an attempt to the tail. j.mu must be held.
+func (j *BatchJob) addStream(stream string) {
+	if stream == "" {
+		return
+	}
+	for _, s := range j.streams {
+		if s == stream {
+			return
+		}
+	}
+	j.streams = append(j.streams, stream)
+	logger.Infof("attempt %d of job %s logs to %s", len(j.streams), j.jobID, stream)
+}
+
+// failure returns the reasons of the failure of the job to follow its status, if any
+func (j *BatchJob) failure() string {
+	var reasons []string
+	if j.statusReason != "" {
+		reasons = append(reasons, j.statusReason)
+	}
+	if n := len(j.attempts); n > 0 {
+		// the reason of the container is often the reason of the job
+		if r := j.attempts[n-1].Reason; r != "" && !strings.Contains(j.statusReason, r) {
+			reasons = append(reasons, r)
+		}
+		if n > 1 {
+			reasons = append(reasons, fmt.Sprintf("after %d attempts", n))
+		}
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(reasons, ", ")
+}
+
+// tailTarget returns the log group and the streams known so far
+func (j *BatchJob) tailTarget() (string, string, []string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.logGroup, j.logRegion, append([]string(nil), j.streams...), j.noLogs
+}
+
+// tail follows the log streams of the attempts by FilterLogEvents at the interval of the tuning,
+// sharing the cool-downs after a throttling and the dropping of duplicates with the tail of AWS
+// Lambda. A stream is added when its attempt starts. After stopped is closed, it ends at the first
+// poll with no new line.
+func (j *BatchJob) tail(ctx context.Context, start time.Time, stopped <-chan struct{}) error {
+	since := unixMilli(start)
+	ticker := time.NewTicker(j.limits.PollInterval)
+	defer ticker.Stop()
+
+	var logs logsAPI
+	for {
+		final := false
+		select {
+		case <-stopped:
+			final = true
+		default:
+		}
+		group, region, streams, noLogs := j.tailTarget()
+		if noLogs {
+			return nil
+		}
+		fresh := 0
+		var err error
+		if len(streams) > 0 {
+			if logs == nil {
+				logs = j.logClient(region)
+			}
+			if err := j.throttle.sleep(ctx, opFetchEvents); err != nil {
+				return err
+			}
+			err = logs.FilterLogEventsPagesWithContext(ctx, &cloudwatchlogs.FilterLogEventsInput{
+				LogGroupName:   aws.String(group),
+				LogStreamNames: aws.StringSlice(streams),
+				StartTime:      aws.Int64(since),
+			}, func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+				for _, e := range res.Events {
+					ts, msg := aws.Int64Value(e.Timestamp), aws.StringValue(e.Message)
+					if !j.emitter.isNew(aws.StringValue(e.EventId), ts, msg) {
+						continue
+					}
+					fresh++
+					j.publish(logEvent{FunctionName: j.definitionName(), RequestID: j.jobID, LogStream: aws.StringValue(e.LogStreamName), Message: msg, Timestamp: ts})
+				}
+				return ctx.Err() == nil
+			})
+			j.throttle.observe(opFetchEvents, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var awsErr awserr.Error
+		notFound := errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException
+		switch {
+		case isThrottling(err):
+			logger.Infof("Rate exceeded for %s. Cool down for %s then retry.", group, j.throttle.wait(opFetchEvents))
+			continue
+		case notFound:
+			// the stream is created when the container writes its first line
+		case err != nil:
+			return fmt.Errorf("FilterLogEventsPages, %s: %w", group, err)
+		}
+		if final && (fresh == 0 || notFound) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish publishes the event, one at a time since the subscribers are not safe for concurrent use
+func (j *BatchJob) publish(ev busEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := ev.(logEvent); ok {
+		j.received++
+	}
+	j.bus.publish(ev)
+}
+
+// interrupt stops following the job, and terminates it with -cancel-execution
+func (j *BatchJob) interrupt(cause error) error {
+	j.interrupted = true
+	if !j.cancelExecution {
+		logger.Warnf("job %s keeps running in %s", j.jobID, j.jobQueue)
+		return fmt.Errorf("interrupted while following %s: %w", j.jobID, cause)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), batchTerminateWait)
+	defer cancel()
+	_, err := j.api.TerminateJobWithContext(ctx, &batch.TerminateJobInput{
+		JobId:  aws.String(j.jobID),
+		Reason: aws.String("the run of k8s-nodeless is interrupted"),
+	})
+	if err != nil {
+		return fmt.Errorf("interrupted while following %s, and TerminateJob failed: %w", j.jobID, err)
+	}
+	j.terminated = true
+	logger.Warnf("job %s is terminated", j.jobID)
+	return fmt.Errorf("interrupted while following %s: %w", j.jobID, cause)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (j *BatchJob) verdict(err error) verdict {
+	note := ""
+	if j.status == batch.JobStatusSucceeded || j.status == batch.JobStatusFailed {
+		note = fmt.Sprintf("%s in %s, %s, %s", strings.ToLower(j.status), j.duration.Round(time.Second), plural(len(j.attempts), "attempt"), plural(j.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: j.definitionName(),
+		Errors:   j.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the Batch job and its attempts
+func (j *BatchJob) logSummary(v verdict) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	summary := schema.BatchJobSummary{
+		SchemaVersion:      schema.BatchJobSummaryVersion,
+		JobDefinition:      j.jobDefinition,
+		JobQueue:           j.jobQueue,
+		JobID:              j.jobID,
+		JobName:            j.jobName,
+		Status:             j.status,
+		StatusReason:       j.statusReason,
+		Attempts:           j.attempts,
+		Duration:           j.duration,
+		EventsReceived:     j.received,
+		LogsComplete:       j.logsComplete,
+		Interrupted:        j.interrupted,
+		TerminateRequested: j.terminated,
+		RunCommon:          runCommon(v, j.integrity, "", nil),
+	}
+	if j.exitCode != nil {
+		code := int(*j.exitCode)
+		summary.ExitCode = &code
+	}
+	if !j.noLogs {
+		summary.LogGroup = j.logGroup
+		summary.LogStreams = j.streams
+	}
+	if j.parameters != nil {
+		for k := range j.parameters {
+			summary.Parameters = append(summary.Parameters, k)
+		}
+		sort.Strings(summary.Parameters)
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
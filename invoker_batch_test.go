@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const testBatchJobID = "4f2c1b9e-8d3a-4e5f-9a1b-2c3d4e5f6a7b"
+
+// fakeBatch runs a job whose DescribeJobs returns the next of states each poll, and then the last
+type fakeBatch struct {
+	states     []*batch.JobDetail
+	polls      int
+	submit     *batch.SubmitJobInput
+	terminated bool
+}
+
+func (f *fakeBatch) SubmitJobWithContext(ctx aws.Context, input *batch.SubmitJobInput, opts ...request.Option) (*batch.SubmitJobOutput, error) {
+	f.submit = input
+	return &batch.SubmitJobOutput{JobId: aws.String(testBatchJobID), JobName: input.JobName}, nil
+}
+
+func (f *fakeBatch) DescribeJobsWithContext(ctx aws.Context, input *batch.DescribeJobsInput, opts ...request.Option) (*batch.DescribeJobsOutput, error) {
+	i := f.polls
+	if i >= len(f.states) {
+		i = len(f.states) - 1
+	}
+	f.polls++
+	return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{f.states[i]}}, nil
+}
+
+func (f *fakeBatch) TerminateJobWithContext(ctx aws.Context, input *batch.TerminateJobInput, opts ...request.Option) (*batch.TerminateJobOutput, error) {
+	f.terminated = true
+	return &batch.TerminateJobOutput{}, nil
+}
+
+// batchAttemptOf returns a finished attempt which logged to stream, and exited with code unless it is negative
+func batchAttemptOf(stream string, code int64, reason string) *batch.AttemptDetail {
+	c := &batch.AttemptContainerDetail{Reason: aws.String(reason)}
+	if stream != "" {
+		c.LogStreamName = aws.String(stream)
+	}
+	if code >= 0 {
+		c.ExitCode = aws.Int64(code)
+	}
+	return &batch.AttemptDetail{Container: c}
+}
+
+// batchJobState returns the job in the status, whose running attempt logs to stream if any
+func batchJobState(status, stream string, attempts ...*batch.AttemptDetail) *batch.JobDetail {
+	c := &batch.ContainerDetail{}
+	if stream != "" {
+		c.LogStreamName = aws.String(stream)
+	}
+	return &batch.JobDetail{JobId: aws.String(testBatchJobID), Status: aws.String(status), Container: c, Attempts: attempts}
+}
+
+// batchLogs serves the events of the requested log streams
+type batchLogs struct {
+	windowedLogs
+	groups []string
+}
+
+func (l *batchLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.groups = append(l.groups, aws.StringValue(input.LogGroupName))
+	streams := make(map[string]bool)
+	for _, s := range input.LogStreamNames {
+		streams[aws.StringValue(s)] = true
+	}
+	var page []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events {
+		if streams[aws.StringValue(e.LogStreamName)] && aws.Int64Value(e.Timestamp) >= aws.Int64Value(input.StartTime) {
+			page = append(page, e)
+		}
+	}
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: page}, true)
+	return nil
+}
+
+func (l *batchLogs) add(stream string, messages ...string) {
+	now := aws.TimeUnixMilli(time.Now())
+	for _, msg := range messages {
+		l.events = append(l.events, &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(fmt.Sprint(len(l.events))),
+			Message:       aws.String(msg),
+			LogStreamName: aws.String(stream),
+			Timestamp:     aws.Int64(now + 1000 + int64(len(l.events))),
+		})
+	}
+}
+
+func newTestBatchJob(t *testing.T, api batchAPI, logs logsAPI) *BatchJob {
+	t.Helper()
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBus()
+	summary := newSummaryBuilder()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	limits := defaultLimits
+	limits.PollInterval = 5 * time.Millisecond
+	return &BatchJob{
+		jobDefinition: "arn:aws:batch:us-east-1:123456789012:job-definition/nightly-report:3",
+		jobQueue:      "jobs",
+		payload:       `{"day": "2024-06-10"}`,
+		api:           api,
+		logClient:     func(string) logsAPI { return logs },
+		poll:          10 * time.Millisecond,
+		logGrace:      5 * time.Second,
+		limits:        limits,
+		throttle:      newThrottleController(time.Now, limits),
+		emitter:       em,
+		bus:           b,
+		summary:       summary,
+		integrity:     newPayloadIntegrity(`{"day": "2024-06-10"}`),
+	}
+}
+
+func TestBatchJobInvoke(t *testing.T) {
+	setTestLogger(t)
+	stream := "nightly-report/default/0123456789abcdef"
+	api := &fakeBatch{states: []*batch.JobDetail{
+		batchJobState(batch.JobStatusRunnable, ""),
+		batchJobState(batch.JobStatusRunning, stream),
+		batchJobState(batch.JobStatusRunning, stream),
+		batchJobState(batch.JobStatusSucceeded, stream, batchAttemptOf(stream, 0, "")),
+	}}
+	logs := &batchLogs{}
+	logs.add(stream, "loading 2024-06-10", "12 rows", "done")
+	logs.add("other/default/fedcba9876543210", "another job")
+
+	j := newTestBatchJob(t, api, logs)
+	if err := j.Invoke(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	in := api.submit
+	if aws.StringValue(in.JobName) != "nightly-report-k8s-nodeless" || aws.StringValue(in.JobQueue) != "jobs" {
+		t.Errorf("got %+v", in)
+	}
+	env := in.ContainerOverrides.Environment
+	if len(env) != 1 || aws.StringValue(env[0].Name) != "NODELESS_PAYLOAD" || aws.StringValue(env[0].Value) != `{"day": "2024-06-10"}` {
+		t.Errorf("got %+v", env)
+	}
+	if j.received != 3 || !j.logsComplete {
+		t.Errorf("each line of the stream is published once, got %d", j.received)
+	}
+	if logs.groups[0] != batchDefaultLogGroup || j.status != batch.JobStatusSucceeded || len(j.attempts) != 1 {
+		t.Errorf("got %v %s %+v", logs.groups, j.status, j.attempts)
+	}
+}
+
+func TestBatchJobAttempts(t *testing.T) {
+	setTestLogger(t)
+	first, second := "nightly-report/default/aaaa", "nightly-report/default/bbbb"
+	api := &fakeBatch{states: []*batch.JobDetail{
+		batchJobState(batch.JobStatusRunning, first),
+		batchJobState(batch.JobStatusRunnable, "", batchAttemptOf(first, 1, "")),
+		batchJobState(batch.JobStatusRunning, second, batchAttemptOf(first, 1, "")),
+		batchJobState(batch.JobStatusRunning, second, batchAttemptOf(first, 1, "")),
+		batchJobState(batch.JobStatusFailed, second, batchAttemptOf(first, 1, ""), batchAttemptOf(second, 2, "")),
+	}}
+	api.states[4].StatusReason = aws.String("Essential container in task exited")
+	logs := &batchLogs{}
+	logs.add(first, "attempt 1", "connection refused")
+	logs.add(second, "attempt 2", "disk full")
+
+	j := newTestBatchJob(t, api, logs)
+	err := j.Invoke(context.Background())
+	if !isFunctionError(err) || exitCode(err) != 2 {
+		t.Fatalf("the exit code of the last attempt is that of the run, got %v", err)
+	}
+	if want := "job " + testBatchJobID + " failed, its container exited with 2, Essential container in task exited, after 2 attempts"; err.Error() != want {
+		t.Errorf("got %s", err)
+	}
+	if j.received != 4 || len(j.streams) != 2 {
+		t.Errorf("the stream of each attempt is tailed, got %d lines of %v", j.received, j.streams)
+	}
+}
+
+func TestBatchJobFailedToStart(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeBatch{states: []*batch.JobDetail{
+		batchJobState(batch.JobStatusRunnable, ""),
+		batchJobState(batch.JobStatusFailed, "", batchAttemptOf("", -1, "CannotPullContainerError: pull image manifest has been retried 1 time(s)")),
+	}}
+	api.states[1].StatusReason = aws.String("Task failed to start")
+	err := newTestBatchJob(t, api, &batchLogs{}).Invoke(context.Background())
+	if err == nil || isFunctionError(err) || !strings.Contains(err.Error(), "failed, Task failed to start, CannotPullContainerError") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestBatchJobInterrupt(t *testing.T) {
+	setTestLogger(t)
+	for _, cancelExecution := range []bool{false, true} {
+		api := &fakeBatch{states: []*batch.JobDetail{batchJobState(batch.JobStatusRunnable, "")}}
+		j := newTestBatchJob(t, api, &batchLogs{})
+		j.cancelExecution = cancelExecution
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := j.Invoke(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || !j.interrupted {
+			t.Errorf("got %v", err)
+		}
+		if api.terminated != cancelExecution || j.terminated != cancelExecution {
+			t.Errorf("-cancel-execution %v: terminated %v", cancelExecution, api.terminated)
+		}
+	}
+}
+
+func TestParseBatchParameters(t *testing.T) {
+	params, err := parseBatchParameters(`{"day": "2024-06-10", "limit": 100, "dry": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["day"] != "2024-06-10" || params["limit"] != "100" || params["dry"] != "true" {
+		t.Errorf("got %v", params)
+	}
+	for _, payload := range []string{`[1]`, `"day"`, `{"nested": {"a": 1}}`, `{"none": null}`} {
+		if _, err := parseBatchParameters(payload); err == nil {
+			t.Errorf("%s: an error expected", payload)
+		}
+	}
+}
+
+func TestBatchJobName(t *testing.T) {
+	for in, want := range map[string]string{
+		"nightly-report":   "nightly-report-k8s-nodeless",
+		"nightly-report:3": "nightly-report-k8s-nodeless",
+		"arn:aws:batch:us-east-1:123456789012:job-definition/nightly-report:3": "nightly-report-k8s-nodeless",
+	} {
+		if got := batchJobName(in); got != want {
+			t.Errorf("%s: got %s", in, got)
+		}
+	}
+	if got := batchJobName(strings.Repeat("a", 200)); len(got) != batchMaxJobName {
+		t.Errorf("got %d characters", len(got))
+	}
+	if got := batchRegion("nightly-report", "arn:aws:batch:eu-west-1:123456789012:job-queue/jobs"); got != "eu-west-1" {
+		t.Errorf("got %s", got)
+	}
+}
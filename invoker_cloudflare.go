@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	cloudflareAPIURL        = "https://api.cloudflare.com/client/v4"
+	cloudflareAPITimeout    = 30 * time.Second
+	cloudflareInvokeTimeout = 5 * time.Minute  // a Worker runs as long as the client waits
+	cloudflareTailWait      = 30 * time.Second // the trace of a request arrives after it completes
+	cloudflareTailProtocol  = "trace-v1"
+	cloudflareRunHeader     = "X-K8s-Nodeless-Run" // the tail is filtered to the requests of the run by it
+	cloudflareRayHeader     = "Cf-Ray"
+	cloudflareWorkersDev    = ".workers.dev"
+)
+
+// cloudflareTailEvent is a message of a tail session, the trace of a request to the Worker
+type cloudflareTailEvent struct {
+	Outcome        string `json:"outcome"` // "ok", "exception", "exceededCpu", "exceededMemory", "canceled", ...
+	ScriptName     string `json:"scriptName"`
+	EventTimestamp int64  `json:"eventTimestamp"`
+	Exceptions     []struct {
+		Name      string `json:"name"`
+		Message   string `json:"message"`
+		Timestamp int64  `json:"timestamp"`
+	} `json:"exceptions"`
+	Logs []struct {
+		Message   []json.RawMessage `json:"message"` // the arguments of console.log
+		Level     string            `json:"level"`   // "log", "debug", "info", "warn" or "error"
+		Timestamp int64             `json:"timestamp"`
+	} `json:"logs"`
+	Event struct {
+		Request struct {
+			URL     string            `json:"url"`
+			Method  string            `json:"method"`
+			Headers map[string]string `json:"headers"`
+		} `json:"request"`
+	} `json:"event"`
+}
+
+// rayID returns the ray id of the request of the trace
+func (e *cloudflareTailEvent) rayID() string {
+	return e.Event.Request.Headers[strings.ToLower(cloudflareRayHeader)]
+}
+
+// cloudflareRoute is a route of a zone to a Worker
+type cloudflareRoute struct {
+	Pattern string `json:"pattern"` // ex: "example.com/api/*" or "*.example.com/*"
+	Script  string `json:"script"`  // empty on a route which disables Workers
+}
+
+// matchCloudflareRoute returns the script of the most specific route whose pattern matches the
+// host and the path of u, or "" if none does
+func matchCloudflareRoute(routes []cloudflareRoute, u *url.URL) string {
+	target := u.Hostname() + u.EscapedPath()
+	if u.EscapedPath() == "" {
+		target += "/"
+	}
+	best, script := -1, ""
+	for _, r := range routes {
+		pattern := r.Pattern
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			pattern = pattern[i+3:]
+		}
+		re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+		if ok, _ := regexp.MatchString(re, target); ok && len(pattern) > best {
+			best, script = len(pattern), r.Script
+		}
+	}
+	return script
+}
+
+// parseCloudflareWorkerURL parses the URL of -func, a URL without a scheme is https
+func parseCloudflareWorkerURL(s string) (*url.URL, error) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("function must be the workers.dev URL or a URL of a route of the Worker, %s", s)
+	}
+	return u, nil
+}
+
+// CloudflareWorker invokes a Cloudflare Worker by its URL while a tail session of the Worker is open,
+// and prints the console logs and the exceptions of the trace of the request
+type CloudflareWorker struct {
+	url       *url.URL
+	payload   string
+	apiURL    string
+	token     string
+	accountID string
+
+	client   *http.Client
+	tailWait time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	script        string
+	runID         string // of cloudflareRunHeader
+	rayID         string
+	statusCode    int
+	workerOutcome string
+	duration      time.Duration
+	received      int
+	logsComplete  bool
+}
+
+var _ consoleInvoker = (*CloudflareWorker)(nil)
+
+// NewCloudflareWorker returns a new invoker of a Cloudflare Worker
+func NewCloudflareWorker(config *Config) (*CloudflareWorker, error) {
+	u, err := parseCloudflareWorkerURL(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Cloudflare Workers does not log")
+	}
+	if config.cloudflareAPIToken == "" || config.cloudflareAccountID == "" {
+		return nil, fmt.Errorf("vendor cloudflare needs -cloudflare-api-token and -cloudflare-account-id to open a tail of the Worker")
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	em, err := newEmitter(logger, config.rules, cloudflareInvokeTimeout+cloudflareTailWait)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &CloudflareWorker{
+		url:              u,
+		payload:          config.payload,
+		apiURL:           cloudflareAPIURL,
+		token:            config.cloudflareAPIToken,
+		accountID:        config.cloudflareAccountID,
+		client:           &http.Client{Timeout: cloudflareAPITimeout},
+		tailWait:         cloudflareTailWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+		script:           config.cloudflareScript,
+		runID:            hex.EncodeToString(nonce),
+	}, nil
+}
+
+// Capabilities returns the options Cloudflare Workers supports
+func (w *CloudflareWorker) Capabilities() Capabilities {
+	return vendorCapabilities[VendorCloudflare]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (w *CloudflareWorker) consoleEmitter() *emitter {
+	return w.emitter
+}
+
+// name returns the script of the Worker, or its URL before it is known
+func (w *CloudflareWorker) name() string {
+	if w.script != "" {
+		return w.script
+	}
+	return w.url.String()
+}
+
+// Invoke opens a tail of the Worker, requests its URL and prints the trace of the request
+func (w *CloudflareWorker) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := w.verdict(err)
+		w.logSummary(v)
+		if berr := w.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if w.pushgateway != nil {
+			pushRunMetrics(w.pushgateway, w.pushgateway.groupingKey(w.name(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  w.summary.errors(),
+				Elapsed: w.duration,
+			})
+		}
+		finishRun(v, w.githubStatus)
+	}()
+
+	if w.script == "" {
+		if w.script, err = w.findScript(ctx); err != nil {
+			return err
+		}
+	}
+	tail, err := w.openTail(ctx)
+	if err != nil {
+		return err
+	}
+	defer tail.close()
+	logger.Infof("payload sha256:%s (%d bytes)", w.integrity.sent, len(w.payload))
+
+	body, callErr := w.call(ctx)
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	// the trace of a failed request is what explains the failure
+	if err := w.waitTrace(ctx, tail); err != nil {
+		return err
+	}
+	if callErr != nil {
+		return callErr
+	}
+	if w.workerOutcome != "" && w.workerOutcome != "ok" {
+		return &functionError{fmt.Errorf("function error, the outcome of the request %s is %s", w.rayID, w.workerOutcome)}
+	}
+	if err := w.checkResponse(body); err != nil {
+		return err
+	}
+	return w.integrity.check(w.requireIntegrity)
+}
+
+// api calls the Cloudflare API, and decodes the result of its envelope into v
+func (w *CloudflareWorker) api(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, w.apiURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &envelope); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, truncateMiddle(string(respBody), 512))
+	}
+	if !envelope.Success || resp.StatusCode >= 300 {
+		var msgs []string
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%s, check the permissions of -cloudflare-api-token: %s", resp.Status, strings.Join(msgs, ", "))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(msgs, ", "))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, v)
+}
+
+// findScript returns the script of the Worker of the URL, the first label of a workers.dev host
+// or the script of the most specific route of the zone of the host
+func (w *CloudflareWorker) findScript(ctx context.Context) (string, error) {
+	host := w.url.Hostname()
+	if strings.HasSuffix(host, cloudflareWorkersDev) {
+		labels := strings.Split(host, ".")
+		if len(labels) < 4 {
+			return "", fmt.Errorf("%s is not SCRIPT.SUBDOMAIN.workers.dev", host)
+		}
+		return labels[0], nil
+	}
+	zoneID, zoneName := "", ""
+	labels := strings.Split(host, ".")
+	for i := 0; i < len(labels)-1 && zoneID == ""; i++ {
+		name := strings.Join(labels[i:], ".")
+		q := url.Values{}
+		q.Set("name", name)
+		q.Set("account.id", w.accountID)
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := w.api(ctx, http.MethodGet, "/zones?"+q.Encode(), nil, &zones); err != nil {
+			return "", fmt.Errorf("find the zone of %s: %w", host, err)
+		}
+		if len(zones) > 0 {
+			zoneID, zoneName = zones[0].ID, name
+		}
+	}
+	if zoneID == "" {
+		return "", fmt.Errorf("no zone of account %s has %s, give the Worker by -cloudflare-script", w.accountID, host)
+	}
+	var routes []cloudflareRoute
+	if err := w.api(ctx, http.MethodGet, "/zones/"+url.PathEscape(zoneID)+"/workers/routes", nil, &routes); err != nil {
+		return "", fmt.Errorf("routes of zone %s: %w", zoneName, err)
+	}
+	script := matchCloudflareRoute(routes, w.url)
+	if script == "" {
+		return "", fmt.Errorf("no route of zone %s to a Worker matches %s", zoneName, w.url)
+	}
+	logger.Infof("%s is routed to the Worker %s", w.url, script)
+	return script, nil
+}
+
+// cloudflareTail is a tail session of a Worker, whose traces are read into events
+type cloudflareTail struct {
+	w      *CloudflareWorker
+	id     string
+	conn   *wsConn
+	events chan cloudflareTailEvent
+	done   chan struct{} // closed when the tail is closed
+	err    error         // why the reading stopped, set before events is closed
+}
+
+// openTail creates a tail session of the Worker, filtered to the requests of the run
+func (w *CloudflareWorker) openTail(ctx context.Context) (*cloudflareTail, error) {
+	var created struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	path := "/accounts/" + url.PathEscape(w.accountID) + "/workers/scripts/" + url.PathEscape(w.script) + "/tails"
+	if err := w.api(ctx, http.MethodPost, path, struct{}{}, &created); err != nil {
+		return nil, fmt.Errorf("create a tail of %s: %w", w.script, err)
+	}
+	t := &cloudflareTail{w: w, id: created.ID, events: make(chan cloudflareTailEvent, 64), done: make(chan struct{})}
+	conn, err := dialWebSocket(ctx, created.URL, cloudflareTailProtocol, nil)
+	if err != nil {
+		t.delete()
+		return nil, fmt.Errorf("connect the tail of %s: %w", w.script, err)
+	}
+	t.conn = conn
+	filters, err := json.Marshal(map[string]interface{}{
+		"filters": []interface{}{
+			map[string]interface{}{"header": map[string]string{"key": strings.ToLower(cloudflareRunHeader), "query": w.runID}},
+		},
+		"debug": false,
+	})
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	if err := conn.writeText(filters); err != nil {
+		t.close()
+		return nil, fmt.Errorf("filter the tail of %s: %w", w.script, err)
+	}
+	go t.read()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.close()
+		case <-t.done:
+		}
+	}()
+	logger.Infof("tail %s of %s is open", t.id, w.script)
+	return t, nil
+}
+
+// read reads the traces until the session is closed
+func (t *cloudflareTail) read() {
+	defer close(t.events)
+	for {
+		_, message, err := t.conn.readMessage()
+		if err != nil {
+			t.err = err
+			return
+		}
+		var ev cloudflareTailEvent
+		if err := json.Unmarshal(message, &ev); err != nil {
+			logger.Warnf("a message of the tail of %s is not a trace: %s", t.w.script, truncateMiddle(string(message), 256))
+			continue
+		}
+		select {
+		case t.events <- ev:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// close closes the session and deletes the tail, which otherwise lives for hours
+func (t *cloudflareTail) close() {
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	close(t.done)
+	if t.conn != nil {
+		t.conn.close()
+	}
+	t.delete()
+}
+
+// delete deletes the tail, also after ctx is canceled
+func (t *cloudflareTail) delete() {
+	ctx, cancel := context.WithTimeout(context.Background(), cloudflareAPITimeout)
+	defer cancel()
+	path := "/accounts/" + url.PathEscape(t.w.accountID) + "/workers/scripts/" + url.PathEscape(t.w.script) + "/tails/" + url.PathEscape(t.id)
+	if err := t.w.api(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		logger.Warnf("delete the tail %s of %s: %s", t.id, t.w.script, err)
+	}
+}
+
+// call requests the URL of the Worker with the payload, and returns the body of a successful response
+func (w *CloudflareWorker) call(ctx context.Context) ([]byte, error) {
+	method := http.MethodPost
+	if w.payload == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, w.url.String(), strings.NewReader(w.payload))
+	if err != nil {
+		return nil, err
+	}
+	if w.payload != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(cloudflareRunHeader, w.runID)
+	client := *w.client
+	client.Timeout = cloudflareInvokeTimeout
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		w.duration = time.Since(start)
+		return nil, fmt.Errorf("invoke %s: %w", w.name(), err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	w.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", w.name(), err)
+	}
+	w.statusCode = resp.StatusCode
+	w.rayID = resp.Header.Get(cloudflareRayHeader)
+	logger.Infof("%s responds %s in %s, ray %s", w.name(), resp.Status, w.duration.Round(time.Millisecond), w.rayID)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", resp.Status, truncateMiddle(string(body), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// waitTrace prints the trace of the request of the ray id, which arrives after the response, for up to tailWait
+func (w *CloudflareWorker) waitTrace(ctx context.Context, t *cloudflareTail) error {
+	timer := time.NewTimer(w.tailWait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			logger.Warnf("no trace of the request %s arrived at the tail of %s in %s, its logs are not printed", w.rayID, w.script, w.tailWait)
+			return nil
+		case ev, ok := <-t.events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Warnf("the tail of %s closed before the trace of the request %s arrived: %v", w.script, w.rayID, t.err)
+				return nil
+			}
+			// the filter of the header may take effect late, the ray id tells our request
+			if w.rayID != "" && ev.rayID() != w.rayID {
+				continue
+			}
+			w.publishTrace(ev)
+			return nil
+		}
+	}
+}
+
+// publishTrace publishes the console logs and the exceptions of the trace between START and END
+func (w *CloudflareWorker) publishTrace(ev cloudflareTailEvent) {
+	w.workerOutcome = ev.Outcome
+	w.logsComplete = true
+	requestID := w.rayID
+	if requestID == "" {
+		requestID = ev.rayID()
+	}
+	w.bus.publish(lifecycleEvent{Kind: "START", RequestID: requestID, Timestamp: ev.EventTimestamp})
+	type line struct {
+		message   string
+		timestamp int64
+	}
+	var lines []line
+	for _, l := range ev.Logs {
+		lines = append(lines, line{formatCloudflareLog(l.Level, l.Message), l.Timestamp})
+	}
+	for _, e := range ev.Exceptions {
+		lines = append(lines, line{fmt.Sprintf("ERROR Uncaught %s: %s", e.Name, e.Message), e.Timestamp})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].timestamp < lines[j].timestamp })
+	end := ev.EventTimestamp
+	for i, l := range lines {
+		// a trace arrives once, its lines are known by their index
+		if !w.emitter.isNew(fmt.Sprintf("%s/%d", requestID, i), l.timestamp, l.message) {
+			continue
+		}
+		w.received++
+		w.bus.publish(logEvent{
+			FunctionName: w.script,
+			RequestID:    requestID,
+			Message:      l.message,
+			Timestamp:    l.timestamp,
+		})
+		if l.timestamp > end {
+			end = l.timestamp
+		}
+	}
+	w.bus.publish(lifecycleEvent{Kind: "END", RequestID: requestID, Timestamp: end})
+}
+
+// formatCloudflareLog returns the line of a console call: its arguments separated by spaces, strings
+// as they are and the others as JSON, after the level for warn and error
+func formatCloudflareLog(level string, args []json.RawMessage) string {
+	parts := make([]string, 0, len(args))
+	for _, a := range args {
+		var s string
+		if err := json.Unmarshal(a, &s); err == nil {
+			parts = append(parts, s)
+			continue
+		}
+		parts = append(parts, string(a))
+	}
+	message := strings.Join(parts, " ")
+	switch level {
+	case "warn", "error":
+		return strings.ToUpper(level) + " " + message
+	}
+	return message
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (w *CloudflareWorker) checkResponse(body []byte) error {
+	if w.golden == nil {
+		return nil
+	}
+	var err error
+	w.goldenResult, w.goldenDiffs, err = w.golden.check(body)
+	return err
+}
+
+// verdict returns the verdict of the run which ended with err
+func (w *CloudflareWorker) verdict(err error) verdict {
+	note := ""
+	if w.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", w.statusCode, w.duration.Milliseconds(), plural(w.summary.errors(), "error"))
+		if w.workerOutcome != "" && w.workerOutcome != "ok" {
+			note += ", " + w.workerOutcome
+		}
+	}
+	return formatVerdict(verdictInput{
+		Function: w.name(),
+		Errors:   w.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the request to the Worker and its trace
+func (w *CloudflareWorker) logSummary(v verdict) {
+	summary := schema.CloudflareRunSummary{
+		SchemaVersion:  schema.CloudflareRunSummaryVersion,
+		URL:            w.url.String(),
+		Script:         w.script,
+		RayID:          w.rayID,
+		StatusCode:     w.statusCode,
+		WorkerOutcome:  w.workerOutcome,
+		Duration:       w.duration,
+		EventsReceived: w.received,
+		LogsComplete:   w.logsComplete,
+		RunCommon:      runCommon(v, w.integrity, w.goldenResult, w.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
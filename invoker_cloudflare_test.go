@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMatchCloudflareRoute(t *testing.T) {
+	routes := []cloudflareRoute{
+		{Pattern: "example.com/*", Script: "site"},
+		{Pattern: "example.com/api/*", Script: "api"},
+		{Pattern: "*.example.com/*", Script: "wildcard"},
+		{Pattern: "example.com/static/*", Script: ""},
+	}
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"https://example.com/", "site"},
+		{"https://example.com", "site"},
+		{"https://example.com/api/orders?id=1", "api"},
+		{"https://shop.example.com/cart", "wildcard"},
+		{"https://example.com/static/a.png", ""},
+		{"https://example.org/", ""},
+	} {
+		u, _ := url.Parse(tc.url)
+		if got := matchCloudflareRoute(routes, u); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+// acceptTestWebSocket upgrades the request to the server side of a WebSocket
+func acceptTestWebSocket(t *testing.T, w http.ResponseWriter, r *http.Request) *wsConn {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: websocket.Subprotocols(r)}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return newWSConn(conn)
+}
+
+func TestWebSocket(t *testing.T) {
+	large := strings.Repeat("x", 70000)
+	pong := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := acceptTestWebSocket(t, w, r)
+		if c == nil {
+			return
+		}
+		defer c.conn.Close()
+		if got := c.conn.Subprotocol(); got != "trace-v1" {
+			t.Errorf("got the subprotocol %q", got)
+		}
+		_, hello, err := c.readMessage()
+		if err != nil || string(hello) != "hello" {
+			t.Errorf("got %q %v", hello, err)
+		}
+		c.conn.SetPongHandler(func(data string) error {
+			pong <- data
+			return nil
+		})
+		c.conn.WriteControl(websocket.PingMessage, []byte("p"), time.Now().Add(time.Second))
+		c.writeText([]byte(strings.Repeat("y", 300)))
+		c.writeText([]byte(large))
+		// the pong is read before the answer of the close
+		if _, _, err := c.conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("the client must close normally, got %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := dialWebSocket(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), "trace-v1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeText([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{strings.Repeat("y", 300), large} {
+		if _, got, err := c.readMessage(); err != nil || string(got) != want {
+			t.Fatalf("got %d bytes, %v", len(got), err)
+		}
+	}
+	c.close()
+	select {
+	case got := <-pong:
+		if got != "p" {
+			t.Errorf("pong %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the ping is not answered")
+	}
+
+	// a close of the server is io.EOF
+	closing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := acceptTestWebSocket(t, w, r); c != nil {
+			c.close()
+		}
+	}))
+	defer closing.Close()
+	c, err = dialWebSocket(context.Background(), closing.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.readMessage(); err != io.EOF {
+		t.Errorf("a close is io.EOF, got %v", err)
+	}
+
+	srv404 := httptest.NewServer(http.NotFoundHandler())
+	defer srv404.Close()
+	if _, err := dialWebSocket(context.Background(), srv404.URL, "", nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v", err)
+	}
+}
+
+const testRayID = "7d1a2b3c4d5e6f70-NRT"
+
+// fakeCloudflare serves the API of the tails and the routes, the tail sessions and a Worker whose
+// trace is sent to the open session after it responds, after the trace of another request
+type fakeCloudflare struct {
+	*httptest.Server
+	trace   string // of our request
+	status  int
+	noTrace bool // the trace of our request is not sent
+
+	mu      sync.Mutex
+	tail    *wsConn
+	filters string
+	runID   string
+	deleted []string
+	ready   chan struct{} // closed when the session is filtered
+	closed  chan struct{}
+}
+
+func newFakeCloudflare(t *testing.T) *fakeCloudflare {
+	f := &fakeCloudflare{status: http.StatusOK, ready: make(chan struct{}), closed: make(chan struct{})}
+	f.trace = `{"outcome": "ok", "scriptName": "hello", "eventTimestamp": 1718000000000,
+		"logs": [{"message": ["loading order", 1], "level": "log", "timestamp": 1718000000010},
+			{"message": ["slow lookup"], "level": "warn", "timestamp": 1718000000020}],
+		"exceptions": [],
+		"event": {"request": {"url": "https://hello.acme.workers.dev/", "method": "POST", "headers": {"cf-ray": "` + testRayID + `"}}}}`
+	envelope := func(w http.ResponseWriter, result string) {
+		fmt.Fprintf(w, `{"success": true, "errors": [], "result": %s}`, result)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client/v4/accounts/acct/workers/scripts/hello/tails", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"success": false, "errors": [{"code": 10000, "message": "Authentication error"}]}`)
+			return
+		}
+		envelope(w, fmt.Sprintf(`{"id": "tail-1", "url": "ws://%s/tail/tail-1", "expires_at": "2024-06-10T14:00:00Z"}`, r.Host))
+	})
+	mux.HandleFunc("/client/v4/accounts/acct/workers/scripts/hello/tails/tail-1", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.Method)
+		f.mu.Unlock()
+		envelope(w, "null")
+	})
+	mux.HandleFunc("/client/v4/zones", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") == "example.com" && r.URL.Query().Get("account.id") == "acct" {
+			envelope(w, `[{"id": "zone-1", "name": "example.com"}]`)
+			return
+		}
+		envelope(w, `[]`)
+	})
+	mux.HandleFunc("/client/v4/zones/zone-1/workers/routes", func(w http.ResponseWriter, r *http.Request) {
+		envelope(w, `[{"id": "r1", "pattern": "example.com/*", "script": "site"}, {"id": "r2", "pattern": "api.example.com/orders*", "script": "hello"}]`)
+	})
+	mux.HandleFunc("/tail/tail-1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Sec-WebSocket-Protocol") != "trace-v1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c := acceptTestWebSocket(t, w, r)
+		if c == nil {
+			return
+		}
+		_, filters, err := c.readMessage()
+		if err != nil {
+			t.Error(err)
+		}
+		f.mu.Lock()
+		f.tail, f.filters = c, string(filters)
+		f.mu.Unlock()
+		close(f.ready)
+		go func() {
+			defer close(f.closed)
+			defer c.conn.Close()
+			for {
+				if _, _, err := c.readMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	})
+	mux.HandleFunc("/worker", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-f.ready:
+		case <-time.After(time.Second):
+		}
+		f.mu.Lock()
+		f.runID = r.Header.Get(cloudflareRunHeader)
+		tail := f.tail
+		f.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Cf-Ray", testRayID)
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+		if tail == nil || f.noTrace {
+			return
+		}
+		go func() {
+			other := strings.Replace(f.trace, testRayID, "0000000000000000-SJC", -1)
+			tail.writeText([]byte(strings.Replace(other, "loading order", "another request", -1)))
+			tail.writeText([]byte(f.trace))
+		}()
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestCloudflareWorker(t *testing.T, f *fakeCloudflare, config *Config) *CloudflareWorker {
+	t.Helper()
+	if config.funcName == "" {
+		config.funcName = f.URL + "/worker"
+	}
+	if config.cloudflareAPIToken == "" {
+		config.cloudflareAPIToken = "token"
+	}
+	config.cloudflareAccountID = "acct"
+	w, err := NewCloudflareWorker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.apiURL = f.URL + "/client/v4"
+	w.tailWait = 2 * time.Second
+	return w
+}
+
+func TestCloudflareInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeCloudflare(t)
+	w := newTestCloudflareWorker(t, f, &Config{payload: `{"id": 1}`, cloudflareScript: "hello"})
+	if err := w.Invoke(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-f.closed
+	var filters struct {
+		Filters []struct {
+			Header struct{ Key, Query string } `json:"header"`
+		} `json:"filters"`
+	}
+	if err := json.Unmarshal([]byte(f.filters), &filters); err != nil || len(filters.Filters) != 1 || filters.Filters[0].Header.Query != f.runID || f.runID == "" {
+		t.Errorf("the tail must be filtered to the run %q, got %s", f.runID, f.filters)
+	}
+	if w.rayID != testRayID || w.workerOutcome != "ok" || w.received != 2 || !w.logsComplete {
+		t.Errorf("got %+v", w)
+	}
+	if logs.FilterMessage("loading order 1").Len() != 1 || logs.FilterMessage("WARN slow lookup").Len() != 1 || logs.FilterMessageSnippet("another request").Len() != 0 {
+		t.Errorf("only the trace of the ray id is printed, got %v", logs.All())
+	}
+	if strings.Join(f.deleted, ",") != http.MethodDelete {
+		t.Errorf("the tail must be deleted, got %v", f.deleted)
+	}
+}
+
+func TestCloudflareInvokeFailure(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeCloudflare(t)
+	f.status = http.StatusInternalServerError
+	f.trace = strings.Replace(f.trace, `"outcome": "ok"`, `"outcome": "exception"`, 1)
+	f.trace = strings.Replace(f.trace, `"exceptions": []`, `"exceptions": [{"name": "TypeError", "message": "x is undefined", "timestamp": 1718000000030}]`, 1)
+	w := newTestCloudflareWorker(t, f, &Config{payload: `{"id": 1}`, cloudflareScript: "hello"})
+	err := w.Invoke(context.Background())
+	var fe *functionError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "500") {
+		t.Errorf("a 500 is a function error, got %v", err)
+	}
+	if w.workerOutcome != "exception" || w.summary.errors() != 1 || logs.FilterMessage("ERROR Uncaught TypeError: x is undefined").Len() != 1 {
+		t.Errorf("the exception of a failed request is printed, got %+v", w)
+	}
+
+	logs = setTestLogger(t)
+	f = newFakeCloudflare(t)
+	f.noTrace = true
+	w = newTestCloudflareWorker(t, f, &Config{cloudflareScript: "hello"})
+	w.tailWait = 50 * time.Millisecond
+	if err := w.Invoke(context.Background()); err != nil || w.logsComplete {
+		t.Errorf("a missing trace is not an error, got %v", err)
+	}
+	if logs.FilterMessageSnippet("no trace of the request").Len() != 1 {
+		t.Errorf("a missing trace must be warned")
+	}
+
+	f = newFakeCloudflare(t)
+	w = newTestCloudflareWorker(t, f, &Config{cloudflareScript: "hello", cloudflareAPIToken: "wrong"})
+	if err := w.Invoke(context.Background()); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "-cloudflare-api-token") {
+		t.Errorf("a wrong token is an error of the run, got %v", err)
+	}
+
+	if _, err := NewCloudflareWorker(&Config{funcName: "hello.acme.workers.dev"}); err == nil {
+		t.Errorf("the token and the account id are required")
+	}
+}
+
+func TestCloudflareFindScript(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeCloudflare(t)
+	for _, tc := range []struct {
+		url, want, err string
+	}{
+		{"hello.acme.workers.dev", "hello", ""},
+		{"https://api.example.com/orders/1", "hello", ""},
+		{"https://example.com/", "site", ""},
+		{"https://api.example.com/users", "", "no route of zone example.com"},
+		{"https://example.org/", "", "no zone of account acct"},
+	} {
+		w := newTestCloudflareWorker(t, f, &Config{funcName: tc.url})
+		got, err := w.findScript(context.Background())
+		if got != tc.want || (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: got %q %v", tc.url, got, err)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	ecsPollInterval   = 2 * time.Second
+	ecsLogGrace       = 10 * time.Second // awslogs may deliver the last lines a while after the task stops
+	ecsStopWait       = 30 * time.Second // how long the stop of an interrupted run may take
+	ecsPayloadEnv     = gcpJobPayloadEnv // the same as a Cloud Run job
+	ecsMaxOverrides   = 8192             // the max characters of the overrides of RunTask
+	ecsStartedBy      = "k8s-nodeless"
+	ecsDefaultCluster = "default"
+	ecsStopped        = "STOPPED"
+)
+
+// ecsAPI is the part of ECS API used to run a task
+type ecsAPI interface {
+	DescribeTaskDefinitionWithContext(aws.Context, *ecs.DescribeTaskDefinitionInput, ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error)
+	RunTaskWithContext(aws.Context, *ecs.RunTaskInput, ...request.Option) (*ecs.RunTaskOutput, error)
+	DescribeTasksWithContext(aws.Context, *ecs.DescribeTasksInput, ...request.Option) (*ecs.DescribeTasksOutput, error)
+	StopTaskWithContext(aws.Context, *ecs.StopTaskInput, ...request.Option) (*ecs.StopTaskOutput, error)
+}
+
+// parseIDList parses a comma separated list of ids, ex: "subnet-1, subnet-2"
+func parseIDList(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// taskDefinitionRegion returns the region of a task definition ARN, "" for a family
+func taskDefinitionRegion(s string) string {
+	p := strings.Split(s, ":")
+	if len(p) >= 6 && p[0] == "arn" && p[2] == "ecs" && strings.HasPrefix(p[5], "task-definition/") {
+		return p[3]
+	}
+	return ""
+}
+
+// ECSTask runs a task definition once as an ECS task on Fargate, tails the awslogs log stream of
+// its container, and waits for the task to stop. The outcome is the exit code of the container.
+type ECSTask struct {
+	taskDefinition string // FAMILY, FAMILY:REVISION or the ARN
+	payload        string
+
+	cluster        string
+	subnets        []string
+	securityGroups []string
+	publicIP       bool
+	container      string // whose logs are tailed and whose exit code is the outcome
+
+	api       ecsAPI
+	logClient func(region string) logsAPI
+	poll      time.Duration
+	logGrace  time.Duration
+	limits    Limits
+	throttle  *throttleController
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+	cancelExecution  bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	taskDefinitionARN string
+	logGroup          string // "" if the container does not log by awslogs
+	logRegion         string
+	streamPrefix      string
+
+	taskARN         string
+	lastStatus      string
+	stopCode        string
+	stoppedReason   string
+	containerReason string
+	exitCode        *int64
+	duration        time.Duration
+	logsComplete    bool
+	interrupted     bool
+	stopRequested   bool
+
+	mu       sync.Mutex // the tail publishes beside the polls of the task
+	received int
+}
+
+var _ consoleInvoker = (*ECSTask)(nil)
+
+// NewECSTask returns new Invoker which runs an ECS task on Fargate
+func NewECSTask(config *Config) (*ECSTask, error) {
+	if len(config.ecsSubnets) == 0 {
+		return nil, fmt.Errorf("-ecs-subnets is required, a Fargate task runs in the subnets of a VPC")
+	}
+	if len(config.payload) > ecsMaxOverrides {
+		return nil, fmt.Errorf("payload is %d bytes, exceeds the %d characters of the overrides of RunTask", len(config.payload), ecsMaxOverrides)
+	}
+
+	awsOpts, err := newAWSSessionOptions(taskDefinitionRegion(config.funcName), config.network, config.noCredentialCache)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("aws session error: %w", err)
+	}
+
+	limits := config.limits.orDefault()
+	em, err := newEmitter(logger, config.rules, limits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &ECSTask{
+		taskDefinition: config.funcName,
+		payload:        config.payload,
+		cluster:        config.ecsCluster,
+		subnets:        config.ecsSubnets,
+		securityGroups: config.ecsSecurityGroups,
+		publicIP:       config.ecsAssignPublicIP,
+		container:      config.ecsContainer,
+		api:            ecs.New(sess),
+		logClient: func(region string) logsAPI {
+			if region == "" {
+				return cloudwatchlogs.New(sess)
+			}
+			return cloudwatchlogs.New(sess, aws.NewConfig().WithRegion(region))
+		},
+		poll:             ecsPollInterval,
+		logGrace:         ecsLogGrace,
+		limits:           limits,
+		throttle:         newThrottleController(time.Now, limits),
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		cancelExecution:  config.cancelExecution,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+	}, nil
+}
+
+// Capabilities returns the options an ECS task supports
+func (t *ECSTask) Capabilities() Capabilities {
+	return vendorCapabilities[VendorECS]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (t *ECSTask) consoleEmitter() *emitter {
+	return t.emitter
+}
+
+// Invoke runs the task and follows it until it stops. When ctx is cancelled, the task keeps
+// running unless -cancel-execution is given.
+func (t *ECSTask) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := t.verdict(err)
+		t.logSummary(v)
+		if berr := t.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if t.pushgateway != nil {
+			pushRunMetrics(t.pushgateway, t.pushgateway.groupingKey(t.family(), ""), &runMetrics{
+				Outcome:        v.Outcome,
+				Errors:         t.summary.errors(),
+				Elapsed:        t.duration,
+				ThrottledCalls: t.throttle.throttled(),
+				ThrottleWait:   t.throttle.waited(),
+			})
+		}
+		finishRun(v, t.githubStatus)
+	}()
+
+	if err := t.resolve(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := t.run(ctx); err != nil {
+		return err
+	}
+	logger.Infof("task %s of %s is started in %s, payload sha256:%s (%d bytes)", t.taskID(), t.family(), t.cluster, t.integrity.sent, len(t.payload))
+	t.publish(lifecycleEvent{Kind: lifecycleStart, RequestID: t.taskID(), Timestamp: unixMilli(start)})
+
+	// the tail outlives the polls of the task by logGrace at most
+	tailCtx, stopTail := context.WithCancel(context.Background())
+	defer stopTail()
+	stopped := make(chan struct{})
+	var tail sync.WaitGroup
+	if t.logGroup != "" {
+		tail.Add(1)
+		go func() {
+			defer tail.Done()
+			err := t.tail(tailCtx, t.logClient(t.logRegion), start, stopped)
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.logsComplete = err == nil
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logger.Warnf("the logs of task %s are incomplete, %s", t.taskID(), err)
+			}
+		}()
+	}
+	followErr := t.follow(ctx)
+	t.duration = time.Since(start)
+	close(stopped)
+	if followErr == nil {
+		waitGroup(&tail, t.logGrace)
+	}
+	stopTail()
+	tail.Wait()
+
+	if followErr != nil {
+		if ctx.Err() != nil {
+			return t.interrupt(ctx.Err())
+		}
+		return followErr
+	}
+	t.publish(lifecycleEvent{Kind: lifecycleEnd, RequestID: t.taskID(), Timestamp: unixMilli(time.Now())})
+
+	if t.stopCode == ecs.TaskStopCodeTaskFailedToStart {
+		return fmt.Errorf("task %s failed to start%s", t.taskID(), t.failure())
+	}
+	if t.exitCode == nil {
+		return fmt.Errorf("task %s stopped before container %s exited%s", t.taskID(), t.container, t.failure())
+	}
+	if code := int(*t.exitCode); code != 0 {
+		return &functionError{&exitError{code: code, err: fmt.Errorf("container %s of task %s exited with %d%s", t.container, t.taskID(), code, t.failure())}}
+	}
+	return t.integrity.check(t.requireIntegrity)
+}
+
+// family returns the family of the task definition, without the revision
+func (t *ECSTask) family() string {
+	s := t.taskDefinition[strings.LastIndex(t.taskDefinition, "/")+1:]
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// taskID returns the last part of the ARN of the task
+func (t *ECSTask) taskID() string {
+	return t.taskARN[strings.LastIndex(t.taskARN, "/")+1:]
+}
+
+// resolve reads the task definition, and picks the container: the one of -ecs-container, or the
+// first essential one. Its awslogs options locate the log stream of the task.
+func (t *ECSTask) resolve(ctx context.Context) error {
+	res, err := t.api.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(t.taskDefinition)})
+	if err != nil {
+		return fmt.Errorf("DescribeTaskDefinition, %s: %w", t.taskDefinition, err)
+	}
+	td := res.TaskDefinition
+	t.taskDefinitionARN = aws.StringValue(td.TaskDefinitionArn)
+
+	var def *ecs.ContainerDefinition
+	for _, c := range td.ContainerDefinitions {
+		if t.container == "" && aws.BoolValue(c.Essential) || t.container != "" && aws.StringValue(c.Name) == t.container {
+			def = c
+			break
+		}
+	}
+	if def == nil {
+		if t.container != "" {
+			return fmt.Errorf("task definition %s has no container %s", t.taskDefinitionARN, t.container)
+		}
+		return fmt.Errorf("task definition %s has no essential container", t.taskDefinitionARN)
+	}
+	t.container = aws.StringValue(def.Name)
+
+	lc := def.LogConfiguration
+	if lc == nil || aws.StringValue(lc.LogDriver) != ecs.LogDriverAwslogs {
+		logger.Warnf("container %s does not log by awslogs, its logs are not tailed", t.container)
+		return nil
+	}
+	t.streamPrefix = aws.StringValue(lc.Options["awslogs-stream-prefix"])
+	if t.streamPrefix == "" {
+		logger.Warnf("container %s has no awslogs-stream-prefix, the log stream of the task is not known and its logs are not tailed", t.container)
+		return nil
+	}
+	t.logGroup = aws.StringValue(lc.Options["awslogs-group"])
+	t.logRegion = aws.StringValue(lc.Options["awslogs-region"])
+	return nil
+}
+
+// logStream returns the log stream of the container of the task, PREFIX/CONTAINER/TASK_ID
+func (t *ECSTask) logStream() string {
+	return fmt.Sprintf("%s/%s/%s", t.streamPrefix, t.container, t.taskID())
+}
+
+// run runs the task. The payload is given to the container in NODELESS_PAYLOAD.
+func (t *ECSTask) run(ctx context.Context) error {
+	vpc := &ecs.AwsVpcConfiguration{
+		Subnets:        aws.StringSlice(t.subnets),
+		AssignPublicIp: aws.String(ecs.AssignPublicIpDisabled),
+	}
+	if len(t.securityGroups) > 0 {
+		vpc.SecurityGroups = aws.StringSlice(t.securityGroups)
+	}
+	if t.publicIP {
+		vpc.AssignPublicIp = aws.String(ecs.AssignPublicIpEnabled)
+	}
+	input := &ecs.RunTaskInput{
+		Cluster:              aws.String(t.cluster),
+		TaskDefinition:       aws.String(t.taskDefinitionARN),
+		LaunchType:           aws.String(ecs.LaunchTypeFargate),
+		Count:                aws.Int64(1),
+		StartedBy:            aws.String(ecsStartedBy),
+		NetworkConfiguration: &ecs.NetworkConfiguration{AwsvpcConfiguration: vpc},
+	}
+	if t.payload != "" {
+		input.Overrides = &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{{
+			Name:        aws.String(t.container),
+			Environment: []*ecs.KeyValuePair{{Name: aws.String(ecsPayloadEnv), Value: aws.String(t.payload)}},
+		}}}
+	}
+	res, err := t.api.RunTaskWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("RunTask, %s: %w", t.family(), err)
+	}
+	if len(res.Failures) > 0 {
+		return fmt.Errorf("RunTask, %s: %s", t.family(), ecsFailures(res.Failures))
+	}
+	if len(res.Tasks) == 0 {
+		return fmt.Errorf("RunTask, %s: no task is started", t.family())
+	}
+	t.taskARN = aws.StringValue(res.Tasks[0].TaskArn)
+	t.lastStatus = aws.StringValue(res.Tasks[0].LastStatus)
+	return nil
+}
+
+// ecsFailures returns the failures of an ECS call as a message
+func ecsFailures(failures []*ecs.Failure) string {
+	msgs := make([]string, 0, len(failures))
+	for _, f := range failures {
+		msg := aws.StringValue(f.Reason)
+		if d := aws.StringValue(f.Detail); d != "" {
+			msg += " (" + d + ")"
+		}
+		if arn := aws.StringValue(f.Arn); arn != "" {
+			msg += " " + arn
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// follow polls the task until it stops. A task which fails to start, as on a CannotPullContainerError,
+// ends the follow as soon as ECS decides to stop it, instead of after its deprovisioning.
+func (t *ECSTask) follow(ctx context.Context) error {
+	for {
+		res, err := t.api.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(t.cluster),
+			Tasks:   []*string{aws.String(t.taskARN)},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("DescribeTasks, %s: %w", t.taskID(), err)
+		}
+		if len(res.Tasks) == 0 {
+			return fmt.Errorf("DescribeTasks, %s: %s", t.taskID(), ecsFailures(res.Failures))
+		}
+		t.observe(res.Tasks[0])
+		if t.lastStatus == ecsStopped || t.stopCode == ecs.TaskStopCodeTaskFailedToStart {
+			return nil
+		}
+		if err := sleepContext(ctx, t.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// observe prints a change of the status of the task and records it
+func (t *ECSTask) observe(task *ecs.Task) {
+	if status := aws.StringValue(task.LastStatus); status != t.lastStatus {
+		t.lastStatus = status
+		logger.Infof("task %s is %s", t.taskID(), status)
+	}
+	if code := aws.StringValue(task.StopCode); code != "" && t.stopCode == "" {
+		t.stopCode, t.stoppedReason = code, aws.StringValue(task.StoppedReason)
+		logger.Infof("task %s is stopping, %s: %s", t.taskID(), t.stopCode, t.stoppedReason)
+	}
+	for _, c := range task.Containers {
+		if aws.StringValue(c.Name) != t.container {
+			continue
+		}
+		t.containerReason = aws.StringValue(c.Reason)
+		if c.ExitCode != nil {
+			t.exitCode = c.ExitCode
+		}
+	}
+}
+
+// failure returns the reasons of the stop of the task to follow its status, if any. The exit of
+// the container is not a reason when its exit code is known.
+func (t *ECSTask) failure() string {
+	var reasons []string
+	if t.stopCode != "" && !(t.stopCode == ecs.TaskStopCodeEssentialContainerExited && t.exitCode != nil) {
+		reasons = append(reasons, t.stopCode+": "+t.stoppedReason)
+	}
+	// the reason of the container is often the reason of the task
+	if t.containerReason != "" && !strings.Contains(t.stoppedReason, t.containerReason) {
+		reasons = append(reasons, t.containerReason)
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(reasons, ", ")
+}
+
+// tail follows the log stream of the container by FilterLogEvents at the interval of the tuning,
+// sharing the cool-downs after a throttling and the dropping of duplicates with the tail of AWS
+// Lambda. After stopped is closed, it ends at the first poll with no new line.
+func (t *ECSTask) tail(ctx context.Context, logs logsAPI, start time.Time, stopped <-chan struct{}) error {
+	stream := t.logStream()
+	since := unixMilli(start)
+	ticker := time.NewTicker(t.limits.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		final := false
+		select {
+		case <-stopped:
+			final = true
+		default:
+		}
+		if err := t.throttle.sleep(ctx, opFetchEvents); err != nil {
+			return err
+		}
+		fresh := 0
+		err := logs.FilterLogEventsPagesWithContext(ctx, &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName:   aws.String(t.logGroup),
+			LogStreamNames: []*string{aws.String(stream)},
+			StartTime:      aws.Int64(since),
+		}, func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			for _, e := range res.Events {
+				ts, msg := aws.Int64Value(e.Timestamp), aws.StringValue(e.Message)
+				if !t.emitter.isNew(aws.StringValue(e.EventId), ts, msg) {
+					continue
+				}
+				fresh++
+				if ts > since {
+					since = ts
+				}
+				t.publish(logEvent{FunctionName: t.family(), RequestID: t.taskID(), LogStream: stream, Message: msg, Timestamp: ts})
+			}
+			return ctx.Err() == nil
+		})
+		t.throttle.observe(opFetchEvents, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var awsErr awserr.Error
+		notFound := errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException
+		switch {
+		case isThrottling(err):
+			logger.Infof("Rate exceeded for %s. Cool down for %s then retry.", t.logGroup, t.throttle.wait(opFetchEvents))
+			continue
+		case notFound:
+			// the stream is created when the container writes its first line
+		case err != nil:
+			return fmt.Errorf("FilterLogEventsPages, %s: %w", t.logGroup, err)
+		}
+		if final && (fresh == 0 || notFound) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish publishes the event, one at a time since the subscribers are not safe for concurrent use
+func (t *ECSTask) publish(ev busEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := ev.(logEvent); ok {
+		t.received++
+	}
+	t.bus.publish(ev)
+}
+
+// interrupt stops following the task, and stops it with -cancel-execution
+func (t *ECSTask) interrupt(cause error) error {
+	t.interrupted = true
+	id := t.taskID()
+	if !t.cancelExecution {
+		logger.Warnf("task %s keeps running, %s", id, t.taskARN)
+		return fmt.Errorf("interrupted while following %s: %w", id, cause)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ecsStopWait)
+	defer cancel()
+	_, err := t.api.StopTaskWithContext(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(t.cluster),
+		Task:    aws.String(t.taskARN),
+		Reason:  aws.String("the run of k8s-nodeless is interrupted"),
+	})
+	if err != nil {
+		return fmt.Errorf("interrupted while following %s, and StopTask failed: %w", id, err)
+	}
+	t.stopRequested = true
+	logger.Warnf("task %s is stopped", id)
+	return fmt.Errorf("interrupted while following %s: %w", id, cause)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (t *ECSTask) verdict(err error) verdict {
+	note := ""
+	if t.exitCode != nil {
+		note = fmt.Sprintf("exited with %d in %s, %s", *t.exitCode, t.duration.Round(time.Second), plural(t.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: t.family(),
+		Errors:   t.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the task and the exit of its container
+func (t *ECSTask) logSummary(v verdict) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	summary := schema.ECSTaskSummary{
+		SchemaVersion:   schema.ECSTaskSummaryVersion,
+		TaskDefinition:  t.taskDefinitionARN,
+		Cluster:         t.cluster,
+		TaskARN:         t.taskARN,
+		Container:       t.container,
+		LastStatus:      t.lastStatus,
+		StopCode:        t.stopCode,
+		StoppedReason:   t.stoppedReason,
+		ContainerReason: t.containerReason,
+		Duration:        t.duration,
+		LogGroup:        t.logGroup,
+		EventsReceived:  t.received,
+		LogsComplete:    t.logsComplete,
+		Interrupted:     t.interrupted,
+		StopRequested:   t.stopRequested,
+		RunCommon:       runCommon(v, t.integrity, "", nil),
+	}
+	if t.exitCode != nil {
+		code := int(*t.exitCode)
+		summary.ExitCode = &code
+	}
+	if t.logGroup != "" && t.taskARN != "" {
+		summary.LogStream = t.logStream()
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const testTaskARN = "arn:aws:ecs:us-east-1:123456789012:task/jobs/0123456789abcdef0123456789abcdef"
+
+// fakeECS runs a task whose DescribeTasks returns the next of states each poll, and then the last
+type fakeECS struct {
+	states   []*ecs.Task
+	polls    int
+	failures []*ecs.Failure
+	run      *ecs.RunTaskInput
+	stopped  bool
+}
+
+func (f *fakeECS) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &ecs.TaskDefinition{
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/report:7"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{{
+			Name:      aws.String("log-router"),
+			Essential: aws.Bool(false),
+		}, {
+			Name:      aws.String("app"),
+			Essential: aws.Bool(true),
+			LogConfiguration: &ecs.LogConfiguration{
+				LogDriver: aws.String("awslogs"),
+				Options: map[string]*string{
+					"awslogs-group":         aws.String("/ecs/report"),
+					"awslogs-region":        aws.String("us-east-1"),
+					"awslogs-stream-prefix": aws.String("ecs"),
+				},
+			},
+		}},
+	}}, nil
+}
+
+func (f *fakeECS) RunTaskWithContext(ctx aws.Context, input *ecs.RunTaskInput, opts ...request.Option) (*ecs.RunTaskOutput, error) {
+	f.run = input
+	if len(f.failures) > 0 {
+		return &ecs.RunTaskOutput{Failures: f.failures}, nil
+	}
+	return &ecs.RunTaskOutput{Tasks: []*ecs.Task{{TaskArn: aws.String(testTaskARN), LastStatus: aws.String("PROVISIONING")}}}, nil
+}
+
+func (f *fakeECS) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	i := f.polls
+	if i >= len(f.states) {
+		i = len(f.states) - 1
+	}
+	f.polls++
+	return &ecs.DescribeTasksOutput{Tasks: []*ecs.Task{f.states[i]}}, nil
+}
+
+func (f *fakeECS) StopTaskWithContext(ctx aws.Context, input *ecs.StopTaskInput, opts ...request.Option) (*ecs.StopTaskOutput, error) {
+	f.stopped = true
+	return &ecs.StopTaskOutput{}, nil
+}
+
+// ecsTaskState returns a task in the status, whose app container exited with code unless it is negative
+func ecsTaskState(status string, code int64) *ecs.Task {
+	c := &ecs.Container{Name: aws.String("app"), LastStatus: aws.String(status)}
+	task := &ecs.Task{TaskArn: aws.String(testTaskARN), LastStatus: aws.String(status), Containers: []*ecs.Container{c}}
+	if code >= 0 {
+		c.ExitCode = aws.Int64(code)
+		task.StopCode = aws.String(ecs.TaskStopCodeEssentialContainerExited)
+		task.StoppedReason = aws.String("Essential container in task exited")
+	}
+	return task
+}
+
+// streamLogs serves the events of a log stream, which does not exist at the first poll
+type streamLogs struct {
+	windowedLogs
+	polls   int
+	streams []string
+}
+
+func (l *streamLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.polls++
+	l.streams = aws.StringValueSlice(input.LogStreamNames)
+	if l.polls == 1 {
+		return awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log stream does not exist.", nil)
+	}
+	var page []*cloudwatchlogs.FilteredLogEvent
+	for _, e := range l.events {
+		if aws.Int64Value(e.Timestamp) >= aws.Int64Value(input.StartTime) {
+			page = append(page, e)
+		}
+	}
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: page}, true)
+	return nil
+}
+
+func newTestECSTask(t *testing.T, api ecsAPI, logs logsAPI) *ECSTask {
+	t.Helper()
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBus()
+	summary := newSummaryBuilder()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	limits := defaultLimits
+	limits.PollInterval = 5 * time.Millisecond
+	return &ECSTask{
+		taskDefinition: "report",
+		payload:        `{"day": "2024-06-10"}`,
+		cluster:        "jobs",
+		subnets:        []string{"subnet-1", "subnet-2"},
+		api:            api,
+		logClient:      func(string) logsAPI { return logs },
+		poll:           10 * time.Millisecond,
+		logGrace:       5 * time.Second,
+		limits:         limits,
+		throttle:       newThrottleController(time.Now, limits),
+		emitter:        em,
+		bus:            b,
+		summary:        summary,
+		integrity:      newPayloadIntegrity(`{"day": "2024-06-10"}`),
+	}
+}
+
+func TestECSTaskInvoke(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeECS{states: []*ecs.Task{
+		ecsTaskState("PENDING", -1),
+		ecsTaskState("RUNNING", -1),
+		ecsTaskState("RUNNING", -1),
+		ecsTaskState("STOPPED", 0),
+	}}
+	logs := &streamLogs{}
+	now := aws.TimeUnixMilli(time.Now())
+	for i, msg := range []string{"loading 2024-06-10", "12 rows", "done"} {
+		logs.events = append(logs.events, &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(fmt.Sprint(i)),
+			Message:       aws.String(msg),
+			LogStreamName: aws.String("ecs/app/0123456789abcdef0123456789abcdef"),
+			Timestamp:     aws.Int64(now + 1000 + int64(i)),
+		})
+	}
+
+	task := newTestECSTask(t, api, logs)
+	if err := task.Invoke(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	run := api.run
+	if aws.StringValue(run.LaunchType) != "FARGATE" || aws.StringValue(run.TaskDefinition) != "arn:aws:ecs:us-east-1:123456789012:task-definition/report:7" {
+		t.Errorf("got %+v", run)
+	}
+	if vpc := run.NetworkConfiguration.AwsvpcConfiguration; len(vpc.Subnets) != 2 || aws.StringValue(vpc.AssignPublicIp) != "DISABLED" {
+		t.Errorf("got %+v", vpc)
+	}
+	o := run.Overrides.ContainerOverrides[0]
+	if aws.StringValue(o.Name) != "app" || aws.StringValue(o.Environment[0].Name) != "NODELESS_PAYLOAD" || aws.StringValue(o.Environment[0].Value) != `{"day": "2024-06-10"}` {
+		t.Errorf("the payload is given to the essential container, got %+v", o)
+	}
+	if len(logs.streams) != 1 || logs.streams[0] != "ecs/app/0123456789abcdef0123456789abcdef" {
+		t.Errorf("got %v", logs.streams)
+	}
+	if task.received != 3 || !task.logsComplete {
+		t.Errorf("each line is published once, got %d", task.received)
+	}
+	if task.exitCode == nil || *task.exitCode != 0 || task.lastStatus != "STOPPED" {
+		t.Errorf("got %v %s", task.exitCode, task.lastStatus)
+	}
+}
+
+func TestECSTaskExitCode(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeECS{states: []*ecs.Task{ecsTaskState("STOPPED", 3)}}
+	err := newTestECSTask(t, api, &streamLogs{}).Invoke(context.Background())
+	if !isFunctionError(err) || exitCode(err) != 3 {
+		t.Fatalf("the exit code of the container is that of the run, got %v", err)
+	}
+	if want := "container app of task 0123456789abcdef0123456789abcdef exited with 3"; err.Error() != want {
+		t.Errorf("got %s", err)
+	}
+	if exitCode(fmt.Errorf("Invoke error, %w", err)) != 3 || exitCode(errors.New("other")) != exitRunError {
+		t.Errorf("the exit code is carried through the wrapping")
+	}
+}
+
+func TestECSTaskFailedToStart(t *testing.T) {
+	setTestLogger(t)
+	pending := ecsTaskState("PENDING", -1)
+	pending.DesiredStatus = aws.String("STOPPED")
+	pending.StopCode = aws.String(ecs.TaskStopCodeTaskFailedToStart)
+	pending.StoppedReason = aws.String("CannotPullContainerError: pull image manifest has been retried 1 time(s): 123456789012.dkr.ecr.us-east-1.amazonaws.com/report:v9: not found")
+	pending.Containers[0].Reason = aws.String("CannotPullContainerError: pull image manifest has been retried 1 time(s)")
+	api := &fakeECS{states: []*ecs.Task{ecsTaskState("PROVISIONING", -1), pending}}
+
+	err := newTestECSTask(t, api, &streamLogs{}).Invoke(context.Background())
+	if err == nil || isFunctionError(err) || !strings.Contains(err.Error(), "failed to start, TaskFailedToStart: CannotPullContainerError") {
+		t.Fatalf("got %v", err)
+	}
+	if api.polls != 2 {
+		t.Errorf("the failure is known before the task is deprovisioned, got %d polls", api.polls)
+	}
+	if strings.Count(err.Error(), "CannotPullContainerError") != 1 {
+		t.Errorf("the reason of the container repeats that of the task, got %s", err)
+	}
+
+	api = &fakeECS{failures: []*ecs.Failure{{Reason: aws.String("MISSING"), Arn: aws.String("arn:aws:ecs:us-east-1:123456789012:container-instance/x")}}}
+	if err := newTestECSTask(t, api, &streamLogs{}).Invoke(context.Background()); err == nil || !strings.Contains(err.Error(), "MISSING") {
+		t.Errorf("a failure of RunTask is an error, got %v", err)
+	}
+}
+
+func TestECSTaskInterrupt(t *testing.T) {
+	setTestLogger(t)
+	for _, cancelExecution := range []bool{false, true} {
+		api := &fakeECS{states: []*ecs.Task{ecsTaskState("RUNNING", -1)}}
+		task := newTestECSTask(t, api, &streamLogs{})
+		task.cancelExecution = cancelExecution
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := task.Invoke(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || !task.interrupted {
+			t.Errorf("got %v", err)
+		}
+		if api.stopped != cancelExecution || task.stopRequested != cancelExecution {
+			t.Errorf("-cancel-execution %v: stopped %v", cancelExecution, api.stopped)
+		}
+	}
+}
+
+func TestParseIDList(t *testing.T) {
+	if got := parseIDList(" subnet-1,subnet-2, ,"); len(got) != 2 || got[1] != "subnet-2" {
+		t.Errorf("got %q", got)
+	}
+	if got := taskDefinitionRegion("arn:aws:ecs:eu-west-1:123456789012:task-definition/report:7"); got != "eu-west-1" {
+		t.Errorf("got %s", got)
+	}
+	if got := taskDefinitionRegion("report:7"); got != "" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	gcpFunctionsEndpoint = "https://cloudfunctions.googleapis.com"
+	gcpLoggingEndpoint   = "https://logging.googleapis.com"
+	gcpAPITimeout        = 30 * time.Second
+	gcpLogPollInterval   = 2 * time.Second  // Cloud Logging allows 60 reads a minute per project
+	gcpLogWait           = 90 * time.Second // how long the logs are awaited after the response
+	gcpLogLookback       = time.Minute      // clock skew allowed to the timestamps of the logs
+	gcpInvokeGrace       = 30 * time.Second // waited beyond the timeout of the function
+)
+
+// generations of Cloud Functions, as the environment of the v2 API
+const (
+	gcpGen1 = "GEN_1"
+	gcpGen2 = "GEN_2" // runs as a Cloud Run service, and logs under its revision
+)
+
+// gcpExecutionFinished starts the last log line of an execution of a 1st gen function, ex:
+// "Function execution took 12 ms, finished with status code: 200"
+const gcpExecutionFinished = "Function execution took"
+
+// gcpFunctionName is the resource name of a Cloud Function, projects/P/locations/L/functions/F
+type gcpFunctionName struct {
+	Project  string
+	Location string
+	Function string
+}
+
+// parseGCPFunctionName parses the resource name of a Cloud Function
+func parseGCPFunctionName(s string) (gcpFunctionName, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "functions" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return gcpFunctionName{}, fmt.Errorf("function name must be projects/PROJECT/locations/LOCATION/functions/NAME, %s", s)
+	}
+	return gcpFunctionName{Project: parts[1], Location: parts[3], Function: parts[5]}, nil
+}
+
+func (n gcpFunctionName) String() string {
+	return fmt.Sprintf("projects/%s/locations/%s/functions/%s", n.Project, n.Location, n.Function)
+}
+
+// gcpFunction is the part of a Cloud Functions v2 function used to invoke it
+type gcpFunction struct {
+	Name          string `json:"name"`
+	State         string `json:"state"`       // ex: "ACTIVE"
+	Environment   string `json:"environment"` // "GEN_1" or "GEN_2"
+	URL           string `json:"url"`
+	ServiceConfig struct {
+		URI            string `json:"uri"`
+		TimeoutSeconds int    `json:"timeoutSeconds"`
+		Service        string `json:"service"`  // projects/P/locations/L/services/S of a 2nd gen function
+		Revision       string `json:"revision"` // the latest revision of the service
+
+		AllTrafficOnLatestRevision bool `json:"allTrafficOnLatestRevision"`
+	} `json:"serviceConfig"`
+}
+
+// generation returns gcpGen1 or gcpGen2. A function without the environment is of the 2nd gen
+// if it has a Cloud Run service.
+func (f *gcpFunction) generation() string {
+	if f.Environment == gcpGen2 || f.Environment == "" && f.ServiceConfig.Service != "" {
+		return gcpGen2
+	}
+	return gcpGen1
+}
+
+// serviceName returns the name of the Cloud Run service of a 2nd gen function, which is that
+// of the function unless the API tells otherwise
+func (f *gcpFunction) serviceName(n gcpFunctionName) string {
+	if i := strings.LastIndex(f.ServiceConfig.Service, "/"); i >= 0 && i < len(f.ServiceConfig.Service)-1 {
+		return f.ServiceConfig.Service[i+1:]
+	}
+	return strings.ToLower(n.Function)
+}
+
+// uri returns the HTTPS endpoint of the function
+func (f *gcpFunction) uri() string {
+	if f.URL != "" {
+		return f.URL
+	}
+	return f.ServiceConfig.URI
+}
+
+// gcpLogEntry is the part of a Cloud Logging entry shown as a log line
+type gcpLogEntry struct {
+	InsertID    string                 `json:"insertId"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Severity    string                 `json:"severity"`
+	TextPayload string                 `json:"textPayload"`
+	JSONPayload map[string]interface{} `json:"jsonPayload"`
+	HTTPRequest *struct {
+		Status  int    `json:"status"`
+		Latency string `json:"latency"`
+	} `json:"httpRequest"` // only on the request log
+	Labels map[string]string `json:"labels"`
+}
+
+// message returns the log line of the entry. The severities from WARNING up prefix the line,
+// so that an error is counted as the error lines of Lambda are.
+func (e *gcpLogEntry) message() string {
+	msg := e.TextPayload
+	if msg == "" && e.JSONPayload != nil {
+		if m, ok := e.JSONPayload["message"].(string); ok {
+			msg = m
+		} else if buf, err := json.Marshal(e.JSONPayload); err == nil {
+			msg = string(buf)
+		}
+	}
+	if msg == "" && e.HTTPRequest != nil {
+		msg = fmt.Sprintf("HTTP %d %s", e.HTTPRequest.Status, e.HTTPRequest.Latency)
+	}
+	switch e.Severity {
+	case "WARNING", "ERROR", "CRITICAL", "ALERT", "EMERGENCY":
+		return e.Severity + " " + strings.TrimRight(msg, "\n")
+	}
+	return strings.TrimRight(msg, "\n")
+}
+
+// gcpAPI calls the Google APIs with an access token of the Application Default Credentials
+type gcpAPI struct {
+	tokens *gcpTokenCache
+	client *http.Client
+}
+
+// call sends in as JSON to a Google API, and decodes the response of a 200 status into out
+func (api *gcpAPI) call(ctx context.Context, method, url string, in, out interface{}) error {
+	token, err := api.tokens.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, truncateMiddle(string(buf), 512))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// listLogs returns the log entries of the filter in the project, in the order of the timestamps
+func (api *gcpAPI) listLogs(ctx context.Context, loggingURL, project, filter string) ([]gcpLogEntry, error) {
+	var ret []gcpLogEntry
+	in := map[string]interface{}{
+		"resourceNames": []string{"projects/" + project},
+		"filter":        filter,
+		"orderBy":       "timestamp asc",
+		"pageSize":      1000,
+	}
+	for {
+		var out struct {
+			Entries       []gcpLogEntry `json:"entries"`
+			NextPageToken string        `json:"nextPageToken"`
+		}
+		if err := api.call(ctx, http.MethodPost, loggingURL+"/v2/entries:list", in, &out); err != nil {
+			return nil, err
+		}
+		ret = append(ret, out.Entries...)
+		if out.NextPageToken == "" {
+			return ret, nil
+		}
+		in["pageToken"] = out.NextPageToken
+	}
+}
+
+// GCPServerless invokes a Cloud Function over HTTPS and tails its logs from Cloud Logging.
+// The invocation carries a trace of its own, by which its logs are found.
+type GCPServerless struct {
+	name    gcpFunctionName
+	payload string
+
+	api          *gcpAPI
+	functionsURL string
+	loggingURL   string
+	logPoll      time.Duration
+	logWait      time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+	deadline  *deadlineWatcher
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	generation   string // gcpGen1 or gcpGen2
+	service      string // the Cloud Run service of a 2nd gen function
+	revision     string // the revision which serves every request of a 2nd gen function, "" if not known
+	uri          string
+	trace        string // projects/P/traces/T
+	executionID  string // Function-Execution-Id of the response, or the label of a log entry of the trace
+	statusCode   int
+	duration     time.Duration
+	received     int
+	logsComplete bool
+}
+
+var _ consoleInvoker = (*GCPServerless)(nil)
+
+// NewGCPServerless returns new Serverless struct for Google Cloud Functions.
+// It authenticates by Application Default Credentials.
+func NewGCPServerless(config *Config) (*GCPServerless, error) {
+	name, err := parseGCPFunctionName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Cloud Functions do not log")
+	}
+	if config.cancelExecution {
+		return nil, fmt.Errorf("-cancel-execution applies to Cloud Run jobs, projects/PROJECT/locations/LOCATION/jobs/NAME")
+	}
+	client := &http.Client{Timeout: gcpAPITimeout}
+	creds, err := findGCPCredentials(os.Getenv, client)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("gcp credentials are %s", creds.kind())
+
+	em, err := newEmitter(logger, config.rules, defaultLimits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+	deadline := newDeadlineWatcher(config.remainingTimeExpr, config.deadlineMargin)
+	b.subscribe("deadline", deadline, subscribeOptions{})
+
+	return &GCPServerless{
+		name:             name,
+		payload:          config.payload,
+		api:              &gcpAPI{tokens: newGCPTokenCache(creds), client: client},
+		functionsURL:     gcpFunctionsEndpoint,
+		loggingURL:       gcpLoggingEndpoint,
+		logPoll:          gcpLogPollInterval,
+		logWait:          gcpLogWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		deadline:         deadline,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}, nil
+}
+
+// Capabilities returns the options Cloud Functions support
+func (sl *GCPServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorGCP]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *GCPServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// newTraceID returns a random trace id of Cloud Trace, 32 hex characters
+func newTraceID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Invoke calls the function and tails its logs
+func (sl *GCPServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name.Function, ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	fn, err := sl.getFunction(ctx)
+	if err != nil {
+		return err
+	}
+	if fn.State != "" && fn.State != "ACTIVE" {
+		return fmt.Errorf("%s is %s, not ACTIVE", sl.name, fn.State)
+	}
+	sl.generation = fn.generation()
+	if sl.generation == gcpGen2 {
+		sl.service = fn.serviceName(sl.name)
+		if fn.ServiceConfig.AllTrafficOnLatestRevision {
+			sl.revision = fn.ServiceConfig.Revision
+		}
+		logger.Debugf("%s is a 2nd gen function, which logs under the Cloud Run service %s", sl.name.Function, sl.service)
+	}
+	sl.uri = fn.uri()
+	if sl.uri == "" {
+		return fmt.Errorf("%s has no URL, only HTTP functions can be invoked", sl.name)
+	}
+	traceID, err := newTraceID()
+	if err != nil {
+		return err
+	}
+	sl.trace = fmt.Sprintf("projects/%s/traces/%s", sl.name.Project, traceID)
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	start := time.Now()
+	body, callErr := sl.call(ctx, fn, traceID)
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	sl.bus.publish(lifecycleEvent{Kind: "END", RequestID: sl.trace, Timestamp: unixMilli(time.Now())})
+
+	// the logs of a failed function are what explains the failure
+	if callErr == nil {
+		callErr = sl.checkResponse(body)
+	}
+	if err := sl.tailLogs(ctx, start.Add(-gcpLogLookback)); err != nil {
+		return err
+	}
+	if callErr != nil {
+		return callErr
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// getFunction gets the function by the Cloud Functions v2 API, which serves both generations
+func (sl *GCPServerless) getFunction(ctx context.Context) (*gcpFunction, error) {
+	var fn gcpFunction
+	if err := sl.api.call(ctx, http.MethodGet, sl.functionsURL+"/v2/"+sl.name.String(), nil, &fn); err != nil {
+		return nil, fmt.Errorf("get function, %s: %w", sl.name, err)
+	}
+	return &fn, nil
+}
+
+// call posts the payload to the function with an ID token, and returns the response of a 2xx status
+func (sl *GCPServerless) call(ctx context.Context, fn *gcpFunction, traceID string) ([]byte, error) {
+	token, err := sl.api.tokens.idToken(ctx, sl.uri)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, sl.uri, strings.NewReader(sl.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cloud-Trace-Context", traceID+"/1;o=1")
+
+	// the function may run longer than an API call
+	client := *sl.api.client
+	client.Timeout = time.Duration(fn.ServiceConfig.TimeoutSeconds)*time.Second + gcpInvokeGrace
+	if fn.ServiceConfig.TimeoutSeconds == 0 {
+		client.Timeout = 0
+	}
+
+	start := time.Now()
+	sl.bus.publish(lifecycleEvent{Kind: "START", RequestID: sl.trace, Timestamp: unixMilli(start)})
+	resp, err := client.Do(req.WithContext(ctx))
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.name, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response of %s: %w", sl.name, err)
+	}
+	sl.statusCode = resp.StatusCode
+	sl.executionID = resp.Header.Get("Function-Execution-Id")
+	logger.Infof("%s responds %s in %s, trace %s", sl.name.Function, resp.Status, sl.duration.Round(time.Millisecond), sl.trace)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("invoke %s: %s, the credentials need roles/cloudfunctions.invoker or roles/run.invoker: %s", sl.name, resp.Status, truncateMiddle(string(body), 512))
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusGatewayTimeout:
+		return nil, &functionError{fmt.Errorf("timeout after %ds, %s", fn.ServiceConfig.TimeoutSeconds, resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", resp.Status, truncateMiddle(string(body), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *GCPServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// resourceFilter returns the Cloud Logging filter of the monitored resource the function logs under:
+// the function itself for the 1st gen, and the revisions of its Cloud Run service for the 2nd gen
+func (sl *GCPServerless) resourceFilter() string {
+	if sl.generation != gcpGen2 {
+		return fmt.Sprintf(`resource.type="cloud_function" AND resource.labels.function_name=%q AND resource.labels.region=%q`, sl.name.Function, sl.name.Location)
+	}
+	f := fmt.Sprintf(`resource.type="cloud_run_revision" AND resource.labels.service_name=%q AND resource.labels.location=%q`, sl.service, sl.name.Location)
+	if sl.revision != "" {
+		f += fmt.Sprintf(" AND resource.labels.revision_name=%q", sl.revision)
+	}
+	return f
+}
+
+// logFilter returns the Cloud Logging filter of the logs of the invocation since the time. The
+// lines without the trace are found by the execution id once it is known.
+func (sl *GCPServerless) logFilter(since time.Time) string {
+	match := fmt.Sprintf("trace=%q", sl.trace)
+	if sl.executionID != "" {
+		match = fmt.Sprintf("(%s OR labels.execution_id=%q)", match, sl.executionID)
+	}
+	return fmt.Sprintf("%s AND %s AND timestamp>=%q", sl.resourceFilter(), match, since.UTC().Format(time.RFC3339Nano))
+}
+
+// ended returns true if the entry is the last one of the invocation: the request log of Cloud Run
+// for a 2nd gen function, or the line telling the execution finished for a 1st gen one, which has
+// no request log
+func (sl *GCPServerless) ended(e *gcpLogEntry) bool {
+	if sl.generation == gcpGen2 {
+		return e.HTTPRequest != nil
+	}
+	return sl.executionID != "" && e.Labels["execution_id"] == sl.executionID && strings.HasPrefix(e.TextPayload, gcpExecutionFinished)
+}
+
+// tailLogs prints the logs of the invocation. Cloud Logging ingests them late, so they are polled
+// until the end of the invocation is seen and a poll finds nothing new, or until logWait passes.
+// The filter is rebuilt for each poll, as the execution id may be found in the entries of the trace.
+func (sl *GCPServerless) tailLogs(ctx context.Context, since time.Time) error {
+	seen := make(map[string]bool)
+	endSeen := false
+	deadline := time.Now().Add(sl.logWait)
+	for {
+		filter := sl.logFilter(since)
+		logger.Debugf("log filter: %s", filter)
+		entries, err := sl.api.listLogs(ctx, sl.loggingURL, sl.name.Project, filter)
+		if err != nil {
+			return fmt.Errorf("list log entries, %s: %w", sl.name, err)
+		}
+		fresh := 0
+		for i := range entries {
+			e := &entries[i]
+			if seen[e.InsertID] {
+				continue
+			}
+			seen[e.InsertID] = true
+			fresh++
+			if id := e.Labels["execution_id"]; id != "" && sl.executionID == "" {
+				sl.executionID = id
+			}
+			if sl.ended(e) {
+				endSeen = true
+			}
+			sl.received++
+			sl.bus.publish(logEvent{
+				FunctionName: sl.name.Function,
+				RequestID:    sl.trace,
+				Message:      e.message(),
+				Timestamp:    unixMilli(e.Timestamp),
+			})
+		}
+		if endSeen && fresh == 0 {
+			sl.logsComplete = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			logger.Warnf("the logs of %s may be incomplete after %s, Cloud Logging ingests them late", sl.name.Function, sl.logWait)
+			return nil
+		}
+		if err := sleepContext(ctx, sl.logPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *GCPServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name.Function,
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the Cloud Functions invocation
+func (sl *GCPServerless) logSummary(v verdict) {
+	summary := schema.GCPRunSummary{
+		SchemaVersion:  schema.GCPRunSummaryVersion,
+		FunctionName:   sl.name.String(),
+		Generation:     sl.generation,
+		Trace:          sl.trace,
+		ExecutionID:    sl.executionID,
+		URL:            sl.uri,
+		StatusCode:     sl.statusCode,
+		Duration:       sl.duration,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		Deadline:       sl.deadline.summary(),
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
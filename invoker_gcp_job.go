@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	gcpRunEndpoint     = "https://run.googleapis.com"
+	gcpJobLogSettle    = 10 * time.Second // logs are awaited at least this long after the completion
+	gcpJobCancelWait   = 30 * time.Second // how long the cancel of an interrupted run may take
+	gcpJobPayloadEnv   = "NODELESS_PAYLOAD"
+	gcpConditionFailed = "CONDITION_FAILED"
+)
+
+// gcpJobName is the resource name of a Cloud Run job, projects/P/locations/L/jobs/J
+type gcpJobName struct {
+	Project  string
+	Location string
+	Job      string
+}
+
+// isGCPJobName returns true if the name is of a Cloud Run job rather than of a function
+func isGCPJobName(s string) bool {
+	parts := strings.Split(s, "/")
+	return len(parts) == 6 && parts[4] == "jobs"
+}
+
+// parseGCPJobName parses the resource name of a Cloud Run job
+func parseGCPJobName(s string) (gcpJobName, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "jobs" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return gcpJobName{}, fmt.Errorf("job name must be projects/PROJECT/locations/LOCATION/jobs/NAME, %s", s)
+	}
+	return gcpJobName{Project: parts[1], Location: parts[3], Job: parts[5]}, nil
+}
+
+func (n gcpJobName) String() string {
+	return fmt.Sprintf("projects/%s/locations/%s/jobs/%s", n.Project, n.Location, n.Job)
+}
+
+// gcpExecution is the part of a Cloud Run job execution used to follow it
+type gcpExecution struct {
+	Name           string `json:"name"` // projects/P/locations/L/jobs/J/executions/E
+	CompletionTime string `json:"completionTime"`
+	TaskCount      int    `json:"taskCount"`
+	RunningCount   int    `json:"runningCount"`
+	SucceededCount int    `json:"succeededCount"`
+	FailedCount    int    `json:"failedCount"`
+	CancelledCount int    `json:"cancelledCount"`
+	LogURI         string `json:"logUri"`
+	Conditions     []struct {
+		Type    string `json:"type"`
+		State   string `json:"state"`
+		Message string `json:"message"`
+	} `json:"conditions"`
+}
+
+// done returns true if the execution reached a terminal state
+func (e *gcpExecution) done() bool {
+	return e.CompletionTime != ""
+}
+
+// shortName returns the last part of the name, which the logs carry
+func (e *gcpExecution) shortName() string {
+	return e.Name[strings.LastIndex(e.Name, "/")+1:]
+}
+
+// failure returns why a completed execution failed, or "" if it succeeded
+func (e *gcpExecution) failure() string {
+	for _, c := range e.Conditions {
+		if c.Type == "Completed" && c.State == gcpConditionFailed {
+			if c.Message != "" {
+				return c.Message
+			}
+			break
+		}
+	}
+	switch {
+	case e.FailedCount > 0:
+		return fmt.Sprintf("%d of %d tasks failed", e.FailedCount, e.TaskCount)
+	case e.CancelledCount > 0:
+		return fmt.Sprintf("%d of %d tasks were cancelled", e.CancelledCount, e.TaskCount)
+	}
+	return ""
+}
+
+// GCPJob runs a Cloud Run job and streams the logs of the execution from Cloud Logging
+// until the execution completes.
+type GCPJob struct {
+	name    gcpJobName
+	payload string
+
+	api        *gcpAPI
+	runURL     string
+	loggingURL string
+	poll       time.Duration
+	logWait    time.Duration
+	logSettle  time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+	cancelExecution  bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	execution       *gcpExecution
+	duration        time.Duration
+	received        int
+	logsComplete    bool
+	interrupted     bool
+	cancelRequested bool
+}
+
+var _ consoleInvoker = (*GCPJob)(nil)
+
+// NewGCPJob returns new Invoker which runs a Cloud Run job.
+// It authenticates by Application Default Credentials.
+func NewGCPJob(config *Config) (*GCPJob, error) {
+	name, err := parseGCPJobName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Cloud Run jobs do not log")
+	}
+	if config.responseGolden != nil {
+		return nil, fmt.Errorf("-expect-response-file needs a response, which Cloud Run jobs do not return")
+	}
+	client := &http.Client{Timeout: gcpAPITimeout}
+	creds, err := findGCPCredentials(os.Getenv, client)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("gcp credentials are %s", creds.kind())
+
+	em, err := newEmitter(logger, config.rules, defaultLimits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &GCPJob{
+		name:             name,
+		payload:          config.payload,
+		api:              &gcpAPI{tokens: newGCPTokenCache(creds), client: client},
+		runURL:           gcpRunEndpoint,
+		loggingURL:       gcpLoggingEndpoint,
+		poll:             gcpLogPollInterval,
+		logWait:          gcpLogWait,
+		logSettle:        gcpJobLogSettle,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		cancelExecution:  config.cancelExecution,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+	}, nil
+}
+
+// Capabilities returns the options Cloud Run jobs support
+func (j *GCPJob) Capabilities() Capabilities {
+	return vendorCapabilities[VendorGCP]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (j *GCPJob) consoleEmitter() *emitter {
+	return j.emitter
+}
+
+// Invoke runs the job and streams the logs of the execution until it completes. When ctx is
+// cancelled, the logs stop and the execution keeps running unless -cancel-execution is given.
+func (j *GCPJob) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := j.verdict(err)
+		j.logSummary(v)
+		if berr := j.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if j.pushgateway != nil {
+			pushRunMetrics(j.pushgateway, j.pushgateway.groupingKey(j.name.Job, ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  j.summary.errors(),
+				Elapsed: j.duration,
+			})
+		}
+		finishRun(v, j.githubStatus)
+	}()
+
+	start := time.Now()
+	exec, err := j.run(ctx)
+	if err != nil {
+		return err
+	}
+	j.execution = exec
+	logger.Infof("execution %s of %s is started, payload sha256:%s (%d bytes)", exec.shortName(), j.name.Job, j.integrity.sent, len(j.payload))
+	j.bus.publish(lifecycleEvent{Kind: "START", RequestID: exec.shortName(), Timestamp: unixMilli(start)})
+
+	if err := j.follow(ctx, start); err != nil {
+		if ctx.Err() != nil {
+			j.duration = time.Since(start)
+			return j.interrupt(ctx.Err())
+		}
+		return err
+	}
+	j.bus.publish(lifecycleEvent{Kind: "END", RequestID: j.execution.shortName(), Timestamp: unixMilli(time.Now())})
+
+	if msg := j.execution.failure(); msg != "" {
+		return &functionError{fmt.Errorf("execution %s failed, %s", j.execution.shortName(), msg)}
+	}
+	return j.integrity.check(j.requireIntegrity)
+}
+
+// run starts an execution of the job. The payload is given to the containers in NODELESS_PAYLOAD.
+func (j *GCPJob) run(ctx context.Context) (*gcpExecution, error) {
+	in := map[string]interface{}{}
+	if j.payload != "" {
+		in["overrides"] = map[string]interface{}{
+			"containerOverrides": []interface{}{
+				map[string]interface{}{"env": []interface{}{map[string]string{"name": gcpJobPayloadEnv, "value": j.payload}}},
+			},
+		}
+	}
+	var op struct {
+		Name     string       `json:"name"`
+		Metadata gcpExecution `json:"metadata"`
+	}
+	if err := j.api.call(ctx, http.MethodPost, j.runURL+"/v2/"+j.name.String()+":run", in, &op); err != nil {
+		return nil, fmt.Errorf("run job, %s: %w", j.name, err)
+	}
+	if op.Metadata.Name == "" {
+		return nil, fmt.Errorf("run job, %s: the operation %s has no execution", j.name, op.Name)
+	}
+	return &op.Metadata, nil
+}
+
+// getExecution gets the current state of the execution
+func (j *GCPJob) getExecution(ctx context.Context) (*gcpExecution, error) {
+	var exec gcpExecution
+	if err := j.api.call(ctx, http.MethodGet, j.runURL+"/v2/"+j.execution.Name, nil, &exec); err != nil {
+		return nil, fmt.Errorf("get execution, %s: %w", j.execution.shortName(), err)
+	}
+	return &exec, nil
+}
+
+// logFilter returns the Cloud Logging filter of the logs of the execution since the time
+func (j *GCPJob) logFilter(since time.Time) string {
+	return fmt.Sprintf(`resource.type="cloud_run_job" AND resource.labels.job_name=%q AND labels."run.googleapis.com/execution_name"=%q AND timestamp>=%q`,
+		j.name.Job, j.execution.shortName(), since.UTC().Format(time.RFC3339Nano))
+}
+
+// follow polls the execution and its logs until it completes and no more logs arrive. Cloud Logging
+// ingests the logs late, so they are awaited for logSettle after the completion, or up to logWait.
+func (j *GCPJob) follow(ctx context.Context, start time.Time) error {
+	since := start.Add(-gcpLogLookback)
+	seen := make(map[string]bool)
+	var completed time.Time
+	for {
+		if completed.IsZero() {
+			exec, err := j.getExecution(ctx)
+			if err != nil {
+				return err
+			}
+			j.execution = exec
+			if exec.done() {
+				completed = time.Now()
+				j.duration = completed.Sub(start)
+				logger.Debugf("execution %s is completed, %d succeeded, %d failed, %d cancelled", exec.shortName(), exec.SucceededCount, exec.FailedCount, exec.CancelledCount)
+			}
+		}
+
+		entries, err := j.api.listLogs(ctx, j.loggingURL, j.name.Project, j.logFilter(since))
+		if err != nil {
+			return fmt.Errorf("list log entries, %s: %w", j.name, err)
+		}
+		fresh := 0
+		for i := range entries {
+			e := &entries[i]
+			if seen[e.InsertID] {
+				continue
+			}
+			seen[e.InsertID] = true
+			fresh++
+			// later polls start at the last timestamp, entries at the same time are deduplicated
+			if e.Timestamp.After(since) {
+				since = e.Timestamp
+			}
+			j.received++
+			j.bus.publish(logEvent{
+				FunctionName: j.name.Job,
+				RequestID:    j.execution.shortName(),
+				Message:      e.message(),
+				Timestamp:    unixMilli(e.Timestamp),
+			})
+		}
+
+		if !completed.IsZero() {
+			waited := time.Since(completed)
+			if fresh == 0 && waited >= j.logSettle {
+				j.logsComplete = true
+				return nil
+			}
+			if waited >= j.logWait {
+				logger.Warnf("the logs of %s may be incomplete after %s, Cloud Logging ingests them late", j.execution.shortName(), j.logWait)
+				return nil
+			}
+		}
+		if err := sleepContext(ctx, j.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// interrupt stops following the execution, and cancels it with -cancel-execution
+func (j *GCPJob) interrupt(cause error) error {
+	j.interrupted = true
+	name := j.execution.shortName()
+	if !j.cancelExecution {
+		logger.Warnf("execution %s keeps running, its logs are at %s", name, j.execution.LogURI)
+		return fmt.Errorf("interrupted while following %s: %w", name, cause)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gcpJobCancelWait)
+	defer cancel()
+	if err := j.api.call(ctx, http.MethodPost, j.runURL+"/v2/"+j.execution.Name+":cancel", map[string]interface{}{}, nil); err != nil {
+		return fmt.Errorf("interrupted while following %s, and cancel failed: %w", name, err)
+	}
+	j.cancelRequested = true
+	logger.Warnf("execution %s is cancelled", name)
+	return fmt.Errorf("interrupted while following %s: %w", name, cause)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (j *GCPJob) verdict(err error) verdict {
+	note := ""
+	if e := j.execution; e != nil && e.done() {
+		note = fmt.Sprintf("%d/%d tasks succeeded in %s, %s", e.SucceededCount, e.TaskCount, j.duration.Round(time.Second), plural(j.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: j.name.Job,
+		Errors:   j.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the execution of the Cloud Run job
+func (j *GCPJob) logSummary(v verdict) {
+	summary := schema.GCPJobSummary{
+		SchemaVersion:   schema.GCPJobSummaryVersion,
+		JobName:         j.name.String(),
+		Duration:        j.duration,
+		EventsReceived:  j.received,
+		LogsComplete:    j.logsComplete,
+		Interrupted:     j.interrupted,
+		CancelRequested: j.cancelRequested,
+		RunCommon:       runCommon(v, j.integrity, "", nil),
+	}
+	if e := j.execution; e != nil {
+		summary.Execution = e.shortName()
+		summary.TaskCount, summary.SucceededCount, summary.FailedCount, summary.CancelledCount = e.TaskCount, e.SucceededCount, e.FailedCount, e.CancelledCount
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
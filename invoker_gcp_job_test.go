@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testJobExecution = "projects/my-proj/locations/us-central1/jobs/batch/executions/batch-x7k2p"
+
+func TestParseGCPJobName(t *testing.T) {
+	n, err := parseGCPJobName("projects/my-proj/locations/us-central1/jobs/batch")
+	if err != nil || n.Project != "my-proj" || n.Location != "us-central1" || n.Job != "batch" || n.String() != "projects/my-proj/locations/us-central1/jobs/batch" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	if !isGCPJobName("projects/my-proj/locations/us-central1/jobs/batch") || isGCPJobName("projects/my-proj/locations/us-central1/functions/hello") {
+		t.Errorf("isGCPJobName")
+	}
+	if _, err := parseGCPJobName("projects/my-proj/locations//jobs/batch"); err == nil {
+		t.Errorf("an empty location must be an error")
+	}
+}
+
+// fakeRunJob serves the metadata server, the Cloud Run API and Cloud Logging for a job
+// whose execution completes after polls
+type fakeRunJob struct {
+	*httptest.Server
+	polls     int // the execution completes at this poll
+	failed    bool
+	overrides string
+
+	mu        sync.Mutex
+	gets      int
+	cancelled bool
+}
+
+func newFakeRunJob(t *testing.T) *fakeRunJob {
+	f := &fakeRunJob{polls: 2}
+	execution := func() map[string]interface{} {
+		e := map[string]interface{}{"name": testJobExecution, "taskCount": 2, "logUri": "https://console.cloud.google.com/logs"}
+		if f.gets < f.polls {
+			e["runningCount"] = 2
+			return e
+		}
+		e["completionTime"] = time.Now().UTC().Format(time.RFC3339Nano)
+		if f.failed {
+			e["succeededCount"], e["failedCount"] = 1, 1
+			e["conditions"] = []map[string]string{{"type": "Completed", "state": "CONDITION_FAILED", "message": "Task batch-x7k2p-task1 failed with exit code 2"}}
+		} else {
+			e["succeededCount"] = 2
+			e["conditions"] = []map[string]string{{"type": "Completed", "state": "CONDITION_SUCCEEDED"}}
+		}
+		return e
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "ya29.test", "expires_in": 3600}`)
+	})
+	mux.HandleFunc("/v2/projects/my-proj/locations/us-central1/jobs/batch:run", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Overrides json.RawMessage `json:"overrides"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		f.mu.Lock()
+		f.overrides = string(in.Overrides)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "projects/my-proj/locations/us-central1/operations/op-1", "metadata": map[string]interface{}{"name": testJobExecution}})
+	})
+	mux.HandleFunc("/v2/"+testJobExecution, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.gets++
+		json.NewEncoder(w).Encode(execution())
+	})
+	mux.HandleFunc("/v2/"+testJobExecution+":cancel", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.cancelled = true
+		f.mu.Unlock()
+		fmt.Fprint(w, `{}`)
+	})
+	mux.HandleFunc("/v2/entries:list", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Filter string `json:"filter"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		var out struct {
+			Entries []gcpLogEntry `json:"entries"`
+		}
+		if strings.Contains(in.Filter, `labels."run.googleapis.com/execution_name"="batch-x7k2p"`) {
+			f.mu.Lock()
+			gets := f.gets
+			f.mu.Unlock()
+			// one more line each poll while the execution runs
+			for i := 1; i <= gets && i <= f.polls; i++ {
+				out.Entries = append(out.Entries, gcpLogEntry{InsertID: fmt.Sprint(i), Timestamp: time.Now(), TextPayload: fmt.Sprintf("processed batch %d", i)})
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runGCPJob(t *testing.T, ctx context.Context, f *fakeRunJob, config *Config) (*GCPJob, error) {
+	t.Helper()
+	setTestEnv(t, "HOME", t.TempDir())
+	setTestEnv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setTestEnv(t, "CLOUDSDK_CONFIG", "")
+	setTestEnv(t, "GCE_METADATA_HOST", strings.TrimPrefix(f.URL, "http://"))
+	config.funcName = "projects/my-proj/locations/us-central1/jobs/batch"
+	j, err := NewGCPJob(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.runURL, j.loggingURL = f.URL, f.URL
+	j.poll, j.logSettle, j.logWait = 10*time.Millisecond, 30*time.Millisecond, time.Second
+	return j, j.Invoke(ctx)
+}
+
+func TestGCPJobInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeRunJob(t)
+	j, err := runGCPJob(t, context.Background(), f, &Config{payload: `{"date":"2026-10-16"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.logsComplete || j.received != 2 || j.execution.SucceededCount != 2 {
+		t.Errorf("got %+v", j)
+	}
+	for _, msg := range []string{"processed batch 1", "processed batch 2", "2/2 tasks succeeded"} {
+		if logs.FilterMessageSnippet(msg).Len() != 1 {
+			t.Errorf("%q is not logged", msg)
+		}
+	}
+	if !strings.Contains(f.overrides, `"name":"NODELESS_PAYLOAD"`) || !strings.Contains(f.overrides, `2026-10-16`) {
+		t.Errorf("the payload must be given in NODELESS_PAYLOAD, got %s", f.overrides)
+	}
+}
+
+func TestGCPJobInvokeFailed(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeRunJob(t)
+	f.failed = true
+	j, err := runGCPJob(t, context.Background(), f, &Config{})
+	var fe *functionError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "exit code 2") {
+		t.Errorf("a failed execution must be a function error, got %v", err)
+	}
+	if j.received != 2 || f.overrides != "" {
+		t.Errorf("got %+v, overrides %s", j, f.overrides)
+	}
+}
+
+func TestGCPJobInvokeInterrupted(t *testing.T) {
+	for _, cancelExecution := range []bool{false, true} {
+		logs := setTestLogger(t)
+		f := newFakeRunJob(t)
+		f.polls = 1000
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		j, err := runGCPJob(t, ctx, f, &Config{cancelExecution: cancelExecution})
+		cancel()
+		var fe *functionError
+		if err == nil || errors.As(err, &fe) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("an interrupted run is an error of the run, got %v", err)
+		}
+		if !j.interrupted || f.cancelled != cancelExecution || j.cancelRequested != cancelExecution {
+			t.Errorf("-cancel-execution=%v: cancelled %v", cancelExecution, f.cancelled)
+		}
+		if !cancelExecution && logs.FilterMessageSnippet("keeps running").Len() != 1 {
+			t.Errorf("no warning of the running execution")
+		}
+	}
+}
+
+func TestGCPJobRejectsResponseFile(t *testing.T) {
+	_, err := NewGCPJob(&Config{funcName: "projects/p/locations/l/jobs/j", responseGolden: &responseGolden{path: "golden.json"}})
+	if err == nil {
+		t.Errorf("-expect-response-file must be an error")
+	}
+}
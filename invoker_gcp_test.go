@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseGCPFunctionName(t *testing.T) {
+	n, err := parseGCPFunctionName("projects/my-proj/locations/asia-northeast1/functions/hello")
+	if err != nil || n.Project != "my-proj" || n.Location != "asia-northeast1" || n.Function != "hello" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	if n.String() != "projects/my-proj/locations/asia-northeast1/functions/hello" {
+		t.Errorf("got %s", n)
+	}
+	for _, s := range []string{"hello", "projects/my-proj/functions/hello", "projects//locations/l/functions/f", "projects/p/locations/l/functions/"} {
+		if _, err := parseGCPFunctionName(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+}
+
+func TestGCPLogEntryMessage(t *testing.T) {
+	cases := []struct {
+		entry gcpLogEntry
+		want  string
+	}{
+		{gcpLogEntry{TextPayload: "hello\n"}, "hello"},
+		{gcpLogEntry{Severity: "ERROR", TextPayload: "boom"}, "ERROR boom"},
+		{gcpLogEntry{JSONPayload: map[string]interface{}{"message": "structured"}}, "structured"},
+		{gcpLogEntry{JSONPayload: map[string]interface{}{"n": 1}}, `{"n":1}`},
+	}
+	for _, c := range cases {
+		if got := c.entry.message(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+// fakeGCP serves the metadata server, the Cloud Functions API, the function and Cloud Logging
+type fakeGCP struct {
+	*httptest.Server
+	status      int    // of the function
+	state       string // of the function
+	environment string // of the function
+	executionID string // of the response, "" for none
+	entries     func(filter, trace string) []gcpLogEntry
+
+	mu      sync.Mutex
+	trace   string
+	filters []string
+}
+
+func newFakeGCP(t *testing.T) *fakeGCP {
+	f := &fakeGCP{status: http.StatusOK, state: "ACTIVE", environment: gcpGen2}
+	f.entries = func(filter, trace string) []gcpLogEntry {
+		now := time.Now()
+		return []gcpLogEntry{
+			{InsertID: "1", Timestamp: now, TextPayload: "hello from the function"},
+			{InsertID: "2", Timestamp: now, Severity: "ERROR", TextPayload: "something failed"},
+			{InsertID: "3", Timestamp: now, HTTPRequest: &struct {
+				Status  int    `json:"status"`
+				Latency string `json:"latency"`
+			}{Status: 200, Latency: "0.1s"}},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "ya29.test", "expires_in": 3600}`)
+	})
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/identity", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testJWT(time.Now().Add(time.Hour)))
+	})
+	mux.HandleFunc("/v2/projects/my-proj/locations/us-central1/functions/hello", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"name": "projects/my-proj/locations/us-central1/functions/hello", "state": %q, "environment": %q, "serviceConfig": {"uri": "%s/fn", "timeoutSeconds": 60}}`, f.state, f.environment, f.URL)
+	})
+	mux.HandleFunc("/fn", func(w http.ResponseWriter, r *http.Request) {
+		trace := r.Header.Get("X-Cloud-Trace-Context")
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || len(trace) < 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.trace = "projects/my-proj/traces/" + trace[:32]
+		f.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if f.executionID != "" {
+			w.Header().Set("Function-Execution-Id", f.executionID)
+		}
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+	})
+	mux.HandleFunc("/v2/entries:list", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Filter string `json:"filter"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		f.mu.Lock()
+		f.filters = append(f.filters, in.Filter)
+		trace := f.trace
+		f.mu.Unlock()
+		var out struct {
+			Entries []gcpLogEntry `json:"entries"`
+		}
+		if strings.Contains(in.Filter, fmt.Sprintf("trace=%q", trace)) {
+			out.Entries = f.entries(in.Filter, trace)
+		}
+		json.NewEncoder(w).Encode(out)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runGCP(t *testing.T, f *fakeGCP, config *Config) (*GCPServerless, error) {
+	t.Helper()
+	setTestEnv(t, "HOME", t.TempDir())
+	setTestEnv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setTestEnv(t, "CLOUDSDK_CONFIG", "")
+	setTestEnv(t, "GCE_METADATA_HOST", strings.TrimPrefix(f.URL, "http://"))
+	if config.funcName == "" {
+		config.funcName = "projects/my-proj/locations/us-central1/functions/hello"
+	}
+	sl, err := NewGCPServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.functionsURL, sl.loggingURL = f.URL, f.URL
+	sl.logPoll, sl.logWait = 10*time.Millisecond, time.Second
+	return sl, sl.Invoke(context.Background())
+}
+
+func TestGCPInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeGCP(t)
+	sl, err := runGCP(t, f, &Config{payload: `{"key":"value"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != 200 || sl.received != 3 || !sl.logsComplete || !strings.HasPrefix(sl.trace, "projects/my-proj/traces/") {
+		t.Errorf("got %+v", sl)
+	}
+	if sl.summary.errors() != 1 {
+		t.Errorf("the ERROR entry must be counted, got %d", sl.summary.errors())
+	}
+	for _, msg := range []string{"hello from the function", "ERROR something failed"} {
+		if logs.FilterMessageSnippet(msg).Len() != 1 {
+			t.Errorf("%q is not logged", msg)
+		}
+	}
+	if logs.FilterField(zap.String("payload", `{"echo": {"key":"value"}}`)).Len() != 1 {
+		t.Errorf("the response is not logged")
+	}
+	if len(f.filters) < 2 || !strings.Contains(f.filters[0], "timestamp>=") {
+		t.Errorf("the logs are polled until nothing new comes, got %v", f.filters)
+	}
+	if !strings.HasPrefix(f.filters[0], `resource.type="cloud_run_revision" AND resource.labels.service_name="hello"`) || sl.generation != gcpGen2 {
+		t.Errorf("a 2nd gen function logs under its Cloud Run service, got %s", f.filters[0])
+	}
+}
+
+func TestGCPInvokeGen1(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeGCP(t)
+	f.environment = gcpGen1
+	// a line of the execution without the trace is found by the execution id in the labels of a traced one
+	f.entries = func(filter, trace string) []gcpLogEntry {
+		now := time.Now()
+		exec := map[string]string{"execution_id": "exec-1"}
+		ret := []gcpLogEntry{
+			{InsertID: "1", Timestamp: now, TextPayload: "Function execution started", Labels: exec},
+		}
+		if strings.Contains(filter, `labels.execution_id="exec-1"`) {
+			ret = append(ret,
+				gcpLogEntry{InsertID: "2", Timestamp: now, TextPayload: "untraced line", Labels: exec},
+				gcpLogEntry{InsertID: "3", Timestamp: now, TextPayload: "Function execution took 12 ms, finished with status code: 200", Labels: exec},
+			)
+		}
+		return ret
+	}
+	sl, err := runGCP(t, f, &Config{payload: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.generation != gcpGen1 || sl.executionID != "exec-1" || sl.received != 3 || !sl.logsComplete {
+		t.Errorf("got %+v", sl)
+	}
+	if !strings.HasPrefix(f.filters[0], `resource.type="cloud_function" AND resource.labels.function_name="hello" AND resource.labels.region="us-central1"`) {
+		t.Errorf("got %s", f.filters[0])
+	}
+}
+
+func TestGCPLogFilter(t *testing.T) {
+	since := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	name := gcpFunctionName{Project: "my-proj", Location: "us-central1", Function: "Hello"}
+	var fn gcpFunction
+	if err := json.Unmarshal([]byte(`{"environment": "GEN_2", "serviceConfig": {"service": "projects/my-proj/locations/us-central1/services/hello-svc", "revision": "hello-svc-00003-abc", "allTrafficOnLatestRevision": true}}`), &fn); err != nil {
+		t.Fatal(err)
+	}
+	sl := &GCPServerless{name: name, trace: "projects/my-proj/traces/t1", generation: fn.generation(), service: fn.serviceName(name), revision: fn.ServiceConfig.Revision}
+	want := `resource.type="cloud_run_revision" AND resource.labels.service_name="hello-svc" AND resource.labels.location="us-central1" AND resource.labels.revision_name="hello-svc-00003-abc" AND trace="projects/my-proj/traces/t1" AND timestamp>="2026-10-16T12:00:00Z"`
+	if got := sl.logFilter(since); got != want {
+		t.Errorf("got %s", got)
+	}
+
+	sl = &GCPServerless{name: name, trace: "projects/my-proj/traces/t1", generation: (&gcpFunction{}).generation(), executionID: "exec-1"}
+	want = `resource.type="cloud_function" AND resource.labels.function_name="Hello" AND resource.labels.region="us-central1" AND (trace="projects/my-proj/traces/t1" OR labels.execution_id="exec-1") AND timestamp>="2026-10-16T12:00:00Z"`
+	if got := sl.logFilter(since); got != want {
+		t.Errorf("got %s", got)
+	}
+	if (&gcpFunction{}).serviceName(name) != "hello" {
+		t.Error("the service of a 2nd gen function is named after the function")
+	}
+
+	// the end of an invocation
+	done := gcpLogEntry{TextPayload: "Function execution took 5 ms, finished with status: 'ok'", Labels: map[string]string{"execution_id": "exec-1"}}
+	if !sl.ended(&done) || sl.ended(&gcpLogEntry{TextPayload: done.TextPayload, Labels: map[string]string{"execution_id": "exec-2"}}) {
+		t.Error("a 1st gen execution ends by its own finished line")
+	}
+	sl.generation = gcpGen2
+	if sl.ended(&done) || !sl.ended(&gcpLogEntry{HTTPRequest: &struct {
+		Status  int    `json:"status"`
+		Latency string `json:"latency"`
+	}{Status: 200}}) {
+		t.Error("a 2nd gen invocation ends by the request log")
+	}
+}
+
+func TestGCPInvokeFunctionError(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeGCP(t)
+	f.status = http.StatusInternalServerError
+	sl, err := runGCP(t, f, &Config{payload: `{}`})
+	var fe *functionError
+	if !errors.As(err, &fe) {
+		t.Errorf("HTTP 500 must be a function error, got %v", err)
+	}
+	if sl.received != 3 {
+		t.Errorf("the logs of a failed invocation are tailed, got %d", sl.received)
+	}
+
+	f = newFakeGCP(t)
+	f.status = http.StatusForbidden
+	if _, err := runGCP(t, f, &Config{payload: `{}`}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "invoker") {
+		t.Errorf("HTTP 403 is an error of the run, got %v", err)
+	}
+
+	f = newFakeGCP(t)
+	f.state = "DEPLOYING"
+	if _, err := runGCP(t, f, &Config{payload: `{}`}); err == nil || !strings.Contains(err.Error(), "DEPLOYING") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestGCPInvokeLogsIncomplete(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeGCP(t)
+	f.entries = func(string, string) []gcpLogEntry {
+		return []gcpLogEntry{{InsertID: "1", Timestamp: time.Now(), TextPayload: "no request log yet"}}
+	}
+	sl, err := runGCP(t, f, &Config{payload: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.logsComplete || sl.received != 1 {
+		t.Errorf("got %+v", sl)
+	}
+	if logs.FilterMessageSnippet("may be incomplete").Len() != 1 {
+		t.Errorf("no warning")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	knativeInvokeTimeout   = 10 * time.Minute // the max timeoutSeconds of a revision by default
+	knativePodPollInterval = time.Second
+	knativeLogGrace        = 2 * time.Second // lines logged right after the response are still read
+	knativeServiceLabel    = "serving.knative.dev/service"
+	knativeQueueProxy      = "queue-proxy" // the sidecar of Knative, whose logs are not the function's
+)
+
+// knativeServiceName is NAMESPACE/SERVICE
+type knativeServiceName struct {
+	Namespace string
+	Service   string
+}
+
+func (n knativeServiceName) String() string {
+	return n.Namespace + "/" + n.Service
+}
+
+// parseKnativeServiceName parses NAMESPACE/SERVICE, or SERVICE in the namespace
+func parseKnativeServiceName(s, namespace string) (knativeServiceName, error) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return knativeServiceName{Namespace: namespace, Service: parts[0]}, nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return knativeServiceName{Namespace: parts[0], Service: parts[1]}, nil
+	}
+	return knativeServiceName{}, fmt.Errorf("function name must be NAMESPACE/SERVICE, SERVICE or a URL, %s", s)
+}
+
+// isRawURL returns true if the function name is a URL to post to as is
+func isRawURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// knativeServiceOfURL returns the service of a cluster-local URL, SERVICE.NAMESPACE.svc[.cluster.local]
+func knativeServiceOfURL(s string) (knativeServiceName, bool) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return knativeServiceName{}, false
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 3 || labels[2] != "svc" || labels[0] == "" || labels[1] == "" {
+		return knativeServiceName{}, false
+	}
+	return knativeServiceName{Namespace: labels[1], Service: labels[0]}, true
+}
+
+// knativeService is the part of a Knative Service used to invoke it
+type knativeService struct {
+	Status struct {
+		URL     string `json:"url"` // external, unless the service is cluster-local
+		Address struct {
+			URL string `json:"url"` // cluster-local
+		} `json:"address"`
+		LatestReadyRevisionName string `json:"latestReadyRevisionName"`
+		Conditions              []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// KnativeServerless invokes a Knative Service by HTTP and streams the logs of its pods from the
+// Kubernetes API while the request runs. It runs in the cluster with a service account which can
+// get Knative Services and list pods and their logs.
+type KnativeServerless struct {
+	name     knativeServiceName // zero for a URL which is not of a service
+	payload  string
+	url      string // resolved from the service unless given
+	external bool
+
+	kube     *kubeAPI // nil when not in a cluster
+	client   *http.Client
+	podPoll  time.Duration
+	logGrace time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	requestID  string
+	revision   string
+	statusCode int
+	duration   time.Duration
+
+	mu       sync.Mutex // the streams of the pods publish concurrently
+	pods     []string
+	received int
+}
+
+var _ consoleInvoker = (*KnativeServerless)(nil)
+
+// NewKnativeServerless returns new Serverless struct for Knative Serving
+func NewKnativeServerless(config *Config) (*KnativeServerless, error) {
+	kube, err := newInClusterKubeAPI(os.Getenv)
+	if err != nil {
+		if !isRawURL(config.funcName) {
+			return nil, fmt.Errorf("a Knative Service is resolved in the cluster, give its URL outside: %w", err)
+		}
+	}
+	return newKnativeServerless(config, kube)
+}
+
+func newKnativeServerless(config *Config, kube *kubeAPI) (*KnativeServerless, error) {
+	sl := &KnativeServerless{
+		payload:  config.payload,
+		external: config.knativeExternal,
+		kube:     kube,
+		client:   &http.Client{Timeout: knativeInvokeTimeout},
+		podPoll:  knativePodPollInterval,
+		logGrace: knativeLogGrace,
+
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}
+	if isRawURL(config.funcName) {
+		sl.url = config.funcName
+		name, ok := knativeServiceOfURL(sl.url)
+		switch {
+		case !ok:
+			logger.Warnf("%s is not the cluster-local URL of a Knative Service, its logs are not tailed", sl.url)
+		case kube == nil:
+			logger.Warnf("not in a Kubernetes cluster, the logs of %s are not tailed", sl.url)
+		default:
+			sl.name = name
+		}
+	} else {
+		var err error
+		if sl.name, err = parseKnativeServiceName(config.funcName, kube.namespace); err != nil {
+			return nil, err
+		}
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which Knative does not log")
+	}
+
+	em, err := newEmitter(logger, config.rules, defaultLimits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	sl.emitter = em
+	sl.summary = newSummaryBuilder()
+	sl.integrity = newPayloadIntegrity(config.payload)
+	sl.bus = newBus()
+	sl.bus.subscribe("console", em, subscribeOptions{})
+	sl.bus.subscribe("summary", sl.summary, subscribeOptions{})
+	sl.bus.subscribe("payload-integrity", sl.integrity, subscribeOptions{})
+	return sl, nil
+}
+
+// Capabilities returns the options Knative Serving supports
+func (sl *KnativeServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorKnative]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *KnativeServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// target returns the name of the function in the verdict and the metrics
+func (sl *KnativeServerless) target() string {
+	if sl.name.Service != "" {
+		return sl.name.String()
+	}
+	return sl.url
+}
+
+// Invoke calls the service and streams the logs of its pods until the response
+func (sl *KnativeServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.target(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	if sl.url == "" {
+		if err := sl.resolve(ctx); err != nil {
+			return err
+		}
+	}
+	traceID, err := newTraceID()
+	if err != nil {
+		return err
+	}
+	sl.requestID = traceID
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	// the pods are followed from the request on, so that a pod of a cold start is not missed
+	start := time.Now()
+	tailCtx, stopTail := context.WithCancel(ctx)
+	defer stopTail()
+	tailErr := make(chan error, 1)
+	if sl.name.Service != "" && sl.kube != nil {
+		go func() { tailErr <- sl.tail(tailCtx, start) }()
+	} else {
+		tailErr <- nil
+	}
+
+	body, callErr := sl.call(ctx, traceID)
+	if ctx.Err() == nil {
+		sleepContext(ctx, sl.logGrace)
+	}
+	stopTail()
+	// the streams are done before the bus is closed
+	tailed := <-tailErr
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	if tailed != nil {
+		if callErr == nil {
+			return tailed
+		}
+		logger.Warnf("the logs of %s are incomplete, %s", sl.name, tailed)
+	}
+	sl.publish(lifecycleEvent{Kind: "END", RequestID: traceID, Timestamp: unixMilli(time.Now())})
+	if callErr != nil {
+		return callErr
+	}
+	if err := sl.checkResponse(body); err != nil {
+		return err
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// resolve finds the URL and the latest revision of the service
+func (sl *KnativeServerless) resolve(ctx context.Context) error {
+	var svc knativeService
+	path := "/apis/serving.knative.dev/v1/namespaces/" + url.PathEscape(sl.name.Namespace) + "/services/" + url.PathEscape(sl.name.Service)
+	if err := sl.kube.get(ctx, path, nil, &svc); err != nil {
+		var ke *kubeError
+		if errors.As(err, &ke) && ke.code == http.StatusNotFound {
+			return fmt.Errorf("no Knative Service %s: %w", sl.name, err)
+		}
+		return fmt.Errorf("get Knative Service %s: %w", sl.name, err)
+	}
+	for _, c := range svc.Status.Conditions {
+		if c.Type == "Ready" && c.Status != "True" {
+			// the traffic still goes to the last ready revision
+			logger.Warnf("%s is not ready, %s: %s", sl.name, c.Reason, c.Message)
+		}
+	}
+	sl.revision = svc.Status.LatestReadyRevisionName
+	sl.url = svc.Status.Address.URL
+	if sl.external {
+		sl.url = svc.Status.URL
+	}
+	if sl.url == "" {
+		return fmt.Errorf("%s has no URL yet, it has never been ready", sl.name)
+	}
+	logger.Infof("%s is %s, revision %s", sl.name, sl.url, sl.revision)
+	return nil
+}
+
+// call posts the payload to the service, and returns the response of a 2xx status
+func (sl *KnativeServerless) call(ctx context.Context, traceID string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, sl.url, strings.NewReader(sl.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", traceID, traceID[:16]))
+
+	start := time.Now()
+	sl.publish(lifecycleEvent{Kind: "START", RequestID: traceID, Timestamp: unixMilli(start)})
+	resp, err := sl.client.Do(req.WithContext(ctx))
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.target(), err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response of %s: %w", sl.target(), err)
+	}
+	sl.statusCode = resp.StatusCode
+	logger.Infof("%s responds %s in %s", sl.target(), resp.Status, sl.duration.Round(time.Millisecond))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", resp.Status, truncateMiddle(string(body), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *KnativeServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// tail streams the logs of the pods of the service since the time until ctx is done. The pods are
+// listed every podPoll, so that the pods which a cold start or a scale out creates are followed
+// once they run. The containers of a pod are streamed, except the queue-proxy sidecar.
+func (sl *KnativeServerless) tail(ctx context.Context, since time.Time) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	selector := knativeServiceLabel + "=" + sl.name.Service
+	seen := make(map[string]bool)
+	for {
+		pods, err := sl.kube.listPods(ctx, sl.name.Namespace, selector)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, p := range pods {
+			// the log of a pending pod is not readable yet
+			if seen[p.Metadata.Name] || p.Status.Phase == "Pending" {
+				continue
+			}
+			seen[p.Metadata.Name] = true
+			sl.mu.Lock()
+			sl.pods = append(sl.pods, p.Metadata.Name)
+			sl.mu.Unlock()
+			for _, c := range p.Spec.Containers {
+				if c.Name == knativeQueueProxy {
+					continue
+				}
+				wg.Add(1)
+				go func(pod, container string) {
+					defer wg.Done()
+					err := sl.kube.streamLogs(ctx, sl.name.Namespace, pod, container, since, func(line kubeLogLine) {
+						// sinceTime has a precision of seconds
+						if line.Timestamp.Before(since) {
+							return
+						}
+						sl.mu.Lock()
+						sl.received++
+						sl.mu.Unlock()
+						sl.publish(logEvent{
+							FunctionName: sl.target(),
+							RequestID:    sl.requestID,
+							Message:      line.Message,
+							Timestamp:    unixMilli(line.Timestamp),
+						})
+					})
+					if err != nil {
+						// a pod scaled in while streaming does not fail the run
+						logger.Warnf("%s", err)
+					}
+				}(p.Metadata.Name, c.Name)
+			}
+		}
+		if err := sleepContext(ctx, sl.podPoll); err != nil {
+			return nil
+		}
+	}
+}
+
+// publish publishes the event, one at a time since the subscribers are not safe for concurrent use
+func (sl *KnativeServerless) publish(ev busEvent) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.bus.publish(ev)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *KnativeServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.target(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the request to the Knative Service
+func (sl *KnativeServerless) logSummary(v verdict) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	summary := schema.KnativeRunSummary{
+		SchemaVersion:  schema.KnativeRunSummaryVersion,
+		URL:            sl.url,
+		Revision:       sl.revision,
+		StatusCode:     sl.statusCode,
+		Duration:       sl.duration,
+		Pods:           sl.pods,
+		EventsReceived: sl.received,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	if sl.name.Service != "" {
+		summary.Service = sl.name.String()
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
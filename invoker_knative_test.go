@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseKnativeServiceName(t *testing.T) {
+	if n, err := parseKnativeServiceName("fn/orders", "default"); err != nil || n.String() != "fn/orders" {
+		t.Errorf("got %v, %v", n, err)
+	}
+	if n, err := parseKnativeServiceName("orders", "default"); err != nil || n.String() != "default/orders" {
+		t.Errorf("got %v, %v", n, err)
+	}
+	for _, s := range []string{"", "fn/", "/orders", "a/b/c"} {
+		if _, err := parseKnativeServiceName(s, "default"); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+	for s, want := range map[string]string{
+		"http://orders.fn.svc.cluster.local":      "fn/orders",
+		"http://orders.fn.svc:8080/path":          "fn/orders",
+		"https://orders.fn.example.com":           "",
+		"http://orders-fn.apps.internal/function": "",
+	} {
+		n, ok := knativeServiceOfURL(s)
+		if (ok && n.String() != want) || (!ok && want != "") {
+			t.Errorf("%s: got %v, %v", s, n, ok)
+		}
+	}
+}
+
+// fakeKnative serves a Knative Service and the Kubernetes API of its cluster. The pod of the
+// service is pending for the first lists, as in a cold start, and its logs follow until the
+// client goes away.
+type fakeKnative struct {
+	*httptest.Server
+	status       int
+	delay        time.Duration // of the response
+	hang         bool          // the response never comes
+	pendingLists int
+
+	mu         sync.Mutex
+	lists      int
+	containers []string // whose logs are streamed
+	paths      []string // of the requests to the service
+}
+
+func newFakeKnative(t *testing.T) *fakeKnative {
+	f := &fakeKnative{status: http.StatusOK, delay: 100 * time.Millisecond, pendingLists: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/serving.knative.dev/v1/namespaces/fn/services/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/orders") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "message": "services.serving.knative.dev \"missing\" not found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status": {"url": "%[1]s/external", "address": {"url": "%[1]s/local"}, "latestReadyRevisionName": "orders-00002",
+			"conditions": [{"type": "Ready", "status": "True"}]}}`, f.URL)
+	})
+	mux.HandleFunc("/api/v1/namespaces/fn/pods", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "serving.knative.dev/service=orders" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.lists++
+		phase := "Running"
+		if f.lists <= f.pendingLists {
+			phase = "Pending"
+		}
+		f.mu.Unlock()
+		fmt.Fprintf(w, `{"items": [{"metadata": {"name": "orders-00002-deployment-7f9c"},
+			"spec": {"containers": [{"name": "user-container"}, {"name": "queue-proxy"}]}, "status": {"phase": %q}}]}`, phase)
+	})
+	mux.HandleFunc("/api/v1/namespaces/fn/pods/orders-00002-deployment-7f9c/log", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.containers = append(f.containers, r.URL.Query().Get("container"))
+		f.mu.Unlock()
+		now := time.Now().UTC()
+		// sinceTime is in seconds, so an older line may come
+		fmt.Fprintf(w, "%s an older request\n", now.Add(-2*time.Second).Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "%s handling order\n", now.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "%s ERROR order rejected\n", now.Format(time.RFC3339Nano))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	service := func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.paths = append(f.paths, r.URL.Path)
+		f.mu.Unlock()
+		// the server sees the client going away once the body is read
+		body, _ := ioutil.ReadAll(r.Body)
+		if f.hang {
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(f.delay)
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+	}
+	mux.HandleFunc("/local", service)
+	mux.HandleFunc("/external", service)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runKnative(t *testing.T, ctx context.Context, f *fakeKnative, config *Config) (*KnativeServerless, error) {
+	t.Helper()
+	sl, err := newKnativeServerless(config, &kubeAPI{baseURL: f.URL, namespace: "fn", client: f.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.podPoll, sl.logGrace = 10*time.Millisecond, 50*time.Millisecond
+	return sl, sl.Invoke(ctx)
+}
+
+func TestKnativeInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeKnative(t)
+	sl, err := runKnative(t, context.Background(), f, &Config{funcName: "orders", payload: `{"id":1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != 200 || sl.revision != "orders-00002" || sl.url != f.URL+"/local" || len(sl.pods) != 1 {
+		t.Errorf("got %+v", sl)
+	}
+	// the pod is followed once it runs, without the queue-proxy
+	if strings.Join(f.containers, ",") != "user-container" {
+		t.Errorf("got %v", f.containers)
+	}
+	if sl.received != 2 || logs.FilterMessageSnippet("an older request").Len() != 0 || sl.summary.errors() != 1 {
+		t.Errorf("got %d events, %d errors", sl.received, sl.summary.errors())
+	}
+
+	f = newFakeKnative(t)
+	if sl, err := runKnative(t, context.Background(), f, &Config{funcName: "fn/orders", payload: `{}`, knativeExternal: true}); err != nil || sl.url != f.URL+"/external" {
+		t.Errorf("got %v, %v", sl.url, err)
+	}
+}
+
+func TestKnativeInvokeFailure(t *testing.T) {
+	setTestLogger(t)
+	var fe *functionError
+
+	f := newFakeKnative(t)
+	f.status = http.StatusInternalServerError
+	sl, err := runKnative(t, context.Background(), f, &Config{funcName: "orders", payload: `{}`})
+	if !errors.As(err, &fe) || sl.received != 2 {
+		t.Errorf("HTTP 500 is a function error with its logs, got %v, %d events", err, sl.received)
+	}
+
+	f = newFakeKnative(t)
+	if _, err := runKnative(t, context.Background(), f, &Config{funcName: "missing", payload: `{}`}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "no Knative Service fn/missing") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestKnativeInvokeCancel(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeKnative(t)
+	f.hang = true
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	start := time.Now()
+	sl, err := runKnative(t, ctx, f, &Config{funcName: "orders", payload: `{}`})
+	if !errors.Is(err, context.Canceled) || time.Since(start) > 5*time.Second {
+		t.Errorf("got %v after %s", err, time.Since(start))
+	}
+	// the logs are streamed until the cancellation
+	if sl.received != 2 {
+		t.Errorf("got %d events", sl.received)
+	}
+}
+
+func TestKnativeInvokeURL(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeKnative(t)
+	sl, err := runKnative(t, context.Background(), f, &Config{funcName: f.URL + "/local", payload: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.revision != "" || sl.received != 0 || f.lists != 0 || len(f.paths) != 1 || logs.FilterMessageSnippet("are not tailed").Len() != 1 {
+		t.Errorf("got %+v", sl)
+	}
+}
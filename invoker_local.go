@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultLocalTimeout = 30 * time.Second
+	maxLocalLineSize    = 1024 * 1024
+	rieRetryInterval    = 100 * time.Millisecond
+	localStopGrace      = 2 * time.Second
+)
+
+// envItems is a repeatable flag of KEY=VALUE environment variables
+type envItems []string
+
+func (e *envItems) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envItems) Set(v string) error {
+	if i := strings.IndexByte(v, '='); i <= 0 {
+		return fmt.Errorf("KEY=VALUE required, %s", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+func (e *envItems) reset() {
+	*e = nil
+}
+
+// LocalServerless runs a local program as the function. The payload is given on stdin,
+// or by the Lambda Runtime Interface Emulator HTTP contract if rieURL is set.
+// stdout and stderr of the program are the logs.
+type LocalServerless struct {
+	program string
+	payload string
+	env     []string
+	timeout time.Duration
+	rieURL  string
+
+	requestID string
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	pubMu     sync.Mutex // keeps lines of stdout and stderr whole
+
+	integrity        *payloadIntegrity
+	requireIntegrity bool
+	deadline         *deadlineWatcher
+
+	exitCode int
+	duration time.Duration
+
+	githubStatus *githubStatus
+
+	baseline *baselineCheck
+
+	pushgateway *pushgateway
+}
+
+var _ consoleInvoker = (*LocalServerless)(nil)
+
+// NewLocalServerless returns new Serverless struct for a local program
+func NewLocalServerless(config *Config) (*LocalServerless, error) {
+	if _, err := os.Stat(config.funcName); err != nil {
+		return nil, fmt.Errorf("local function: %w", err)
+	}
+
+	em, err := newEmitter(logger, config.rules, defaultLimits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	requestID, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+	deadline := newDeadlineWatcher(config.remainingTimeExpr, config.deadlineMargin)
+	b.subscribe("deadline", deadline, subscribeOptions{})
+
+	return &LocalServerless{
+		program:          config.funcName,
+		payload:          config.payload,
+		env:              config.withEnv,
+		timeout:          config.localTimeout,
+		rieURL:           config.localRIE,
+		requestID:        requestID,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		deadline:         deadline,
+		exitCode:         -1,
+		githubStatus:     config.githubStatus,
+		baseline:         config.baseline,
+		pushgateway:      config.pushgateway,
+	}, nil
+}
+
+// Capabilities returns the options a local program supports
+func (sl *LocalServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorLocal]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *LocalServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// newRequestID returns a random UUID
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Invoke runs the local program
+func (sl *LocalServerless) Invoke(ctx context.Context) (err error) {
+	// the summary is logged before the bus is closed, so that slow subscribers
+	// can not delay it when the process is about to be killed
+	defer func() {
+		if err == nil && sl.baseline != nil {
+			err = sl.baseline.apply(newBaselineEntry(filepath.Base(sl.program), "", sl.integrity.sent, sl.summary.allReports()))
+		}
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(filepath.Base(sl.program), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Report:  sl.summary.report(sl.requestID),
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	runCtx, cancel := context.WithTimeout(ctx, sl.timeout)
+	defer cancel()
+
+	start := time.Now()
+	sl.publishLine(fmt.Sprintf("START RequestId: %s Version: $LATEST", sl.requestID))
+	sl.bus.publish(lifecycleEvent{Kind: "START", RequestID: sl.requestID, Timestamp: unixMilli(start)})
+
+	if sl.rieURL != "" {
+		err = sl.runRIE(runCtx)
+	} else {
+		err = sl.runStdin(runCtx)
+	}
+	sl.duration = time.Since(start)
+	if runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = &functionError{fmt.Errorf("task timed out after %s", sl.timeout)}
+	}
+
+	end := time.Now()
+	sl.publishLine(fmt.Sprintf("END RequestId: %s", sl.requestID))
+	sl.bus.publish(lifecycleEvent{Kind: "END", RequestID: sl.requestID, Timestamp: unixMilli(end)})
+	report := reportMetrics{
+		RequestID:      sl.requestID,
+		Duration:       float64(sl.duration) / float64(time.Millisecond),
+		BilledDuration: float64(sl.duration.Round(time.Millisecond) / time.Millisecond),
+	}
+	sl.bus.publish(reportEvent{Report: report, Timestamp: unixMilli(end)})
+	logger.Infof("%s has been finished", sl.requestID)
+
+	if err != nil {
+		return err
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// unixMilli converts time.Time to milliseconds since the epoch as CloudWatch Logs does
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (sl *LocalServerless) command(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, sl.program)
+	cmd.Env = append(os.Environ(),
+		"AWS_LAMBDA_FUNCTION_NAME="+filepath.Base(sl.program),
+		"NODELESS_REQUEST_ID="+sl.requestID,
+	)
+	cmd.Env = append(cmd.Env, sl.env...)
+	return cmd
+}
+
+// runStdin runs the program with the payload on stdin. A non-zero exit is a function error.
+func (sl *LocalServerless) runStdin(ctx context.Context) error {
+	cmd := sl.command(ctx)
+	cmd.Stdin = strings.NewReader(sl.payload)
+	wait, err := sl.start(cmd)
+	if err != nil {
+		return err
+	}
+	err = wait()
+	sl.exitCode = cmd.ProcessState.ExitCode()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("local function error, %s: Unhandled: %w", sl.program, err)
+	}
+	return nil
+}
+
+// runRIE runs the program, which serves the Runtime Interface Emulator, and posts the payload to it
+func (sl *LocalServerless) runRIE(ctx context.Context) error {
+	cmd := sl.command(ctx)
+	wait, err := sl.start(cmd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cmd.Process.Signal(os.Interrupt)
+		t := time.AfterFunc(localStopGrace, func() { cmd.Process.Kill() })
+		wait()
+		t.Stop()
+		sl.exitCode = cmd.ProcessState.ExitCode()
+	}()
+
+	var resp *http.Response
+	for {
+		req, err := http.NewRequest(http.MethodPost, sl.rieURL, strings.NewReader(sl.payload))
+		if err != nil {
+			return err
+		}
+		resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the emulator is not listening yet
+		if err := sleepContext(ctx, rieRetryInterval); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response of %s: %w", sl.rieURL, err)
+	}
+	if fe := rieFunctionError(resp, body); fe != "" {
+		return &functionError{fmt.Errorf("local function error, %s: %s", string(body), fe)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("local function, %s: %s", resp.Status, string(body))
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return nil
+}
+
+// rieFunctionError returns the function error of the emulator response, or "" if succeeded
+func rieFunctionError(resp *http.Response, body []byte) string {
+	if e := resp.Header.Get("X-Amz-Function-Error"); e != "" {
+		return e
+	}
+	var payload struct {
+		ErrorType    string `json:"errorType"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.ErrorType != "" && payload.ErrorMessage != "" {
+		return "Unhandled"
+	}
+	return ""
+}
+
+// start starts the command and returns the function which waits for the command and its output
+func (sl *LocalServerless) start(cmd *exec.Cmd) (func() error, error) {
+	var readers []*os.File
+	closeAll := func(files []*os.File) {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	var writers []*os.File
+	for i := 0; i < 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll(readers)
+			closeAll(writers)
+			return nil, err
+		}
+		readers = append(readers, r)
+		writers = append(writers, w)
+	}
+	cmd.Stdout, cmd.Stderr = writers[0], writers[1]
+	err := cmd.Start()
+	closeAll(writers) // the child has its own copies
+	if err != nil {
+		closeAll(readers)
+		return nil, fmt.Errorf("start local function, %s: %w", sl.program, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			sl.readLines(r)
+		}(r)
+	}
+	return func() error {
+		err := cmd.Wait()
+		// a child process of the program may still hold the pipes, so do not wait for EOF forever
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(localStopGrace):
+			closeAll(readers)
+			<-done
+		}
+		closeAll(readers)
+		return err
+	}, nil
+}
+
+// readLines publishes each line of the output as a log event
+func (sl *LocalServerless) readLines(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLocalLineSize)
+	for scanner.Scan() {
+		sl.publishLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		logger.Warnf("read output of %s: %s", sl.program, err)
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+func (sl *LocalServerless) publishLine(line string) {
+	sl.pubMu.Lock()
+	defer sl.pubMu.Unlock()
+	sl.bus.publish(logEvent{
+		FunctionName: sl.program,
+		RequestID:    sl.requestID,
+		Message:      strings.TrimRight(line, "\r"),
+		Timestamp:    unixMilli(time.Now()),
+	})
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *LocalServerless) verdict(err error) verdict {
+	return formatVerdict(verdictInput{
+		Function: filepath.Base(sl.program),
+		Report:   sl.summary.report(sl.requestID),
+		Errors:   sl.summary.errors(),
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the local process
+func (sl *LocalServerless) logSummary(v verdict) {
+	summary := schema.LocalRunSummary{
+		SchemaVersion: schema.LocalRunSummaryVersion,
+		FunctionName:  sl.program,
+		RequestID:     sl.requestID,
+		ExitCode:      sl.exitCode,
+		Duration:      sl.duration,
+		Report:        sl.summary.report(sl.requestID),
+		Deadline:      sl.deadline.summary(),
+		RunCommon:     runCommon(v, sl.integrity, "", nil),
+	}
+	summary.ExtensionLines, summary.ExtensionBytes = sl.emitter.extensionStats()
+	logger.Infow("summary", recordFields(summary)...)
+}
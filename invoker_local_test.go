@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func writeScript(t *testing.T, dir, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, "handler.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runLocal(t *testing.T, config *Config) (*LocalServerless, *observer.ObservedLogs, error) {
+	t.Helper()
+	logs := setTestLogger(t)
+	if config.localTimeout == 0 {
+		config.localTimeout = 5 * time.Second
+	}
+	sl, err := NewLocalServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sl.Invoke(context.Background())
+	return sl, logs, err
+}
+
+func TestLocalInvoke(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := `{"key":"value"}`
+	program := writeScript(t, dir, `read payload
+echo "got $payload"
+echo "greeting=$GREETING" >&2
+echo "NODELESS_PAYLOAD_SHA256=$(printf %s "$payload" | sha256sum | cut -d' ' -f1)"
+`)
+	sl, logs, err := runLocal(t, &Config{funcName: program, payload: payload, withEnv: []string{"GREETING=hello"}, requirePayloadIntegrity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{`got {"key":"value"}`, "greeting=hello", "START RequestId: " + sl.requestID, "END RequestId: " + sl.requestID} {
+		if logs.FilterMessageSnippet(msg).Len() != 1 {
+			t.Errorf("%q is not logged", msg)
+		}
+	}
+	if sl.exitCode != 0 {
+		t.Errorf("exit code %d", sl.exitCode)
+	}
+	if sl.summary.report(sl.requestID) == nil {
+		t.Errorf("no report")
+	}
+}
+
+func TestLocalInvokeFunctionError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sl, _, err := runLocal(t, &Config{funcName: writeScript(t, dir, "exit 3\n")})
+	if err == nil || !strings.Contains(err.Error(), "Unhandled") {
+		t.Errorf("non-zero exit must be a function error, got %v", err)
+	}
+	if sl.exitCode != 3 {
+		t.Errorf("exit code %d", sl.exitCode)
+	}
+
+	_, _, err = runLocal(t, &Config{funcName: writeScript(t, dir, "sleep 10 &\nwait\n"), localTimeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLocalInvokeRIE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		received = string(buf)
+		if received == "fail" {
+			w.Write([]byte(`{"errorType":"Error","errorMessage":"boom"}`))
+			return
+		}
+		w.Write([]byte(`"ok"`))
+	}))
+	defer ts.Close()
+
+	program := writeScript(t, dir, "echo emulator started\nexec sleep 10\n")
+	_, logs, err := runLocal(t, &Config{funcName: program, payload: "hello", localRIE: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "hello" {
+		t.Errorf("got %s", received)
+	}
+	if logs.FilterMessage("response").Len() != 1 {
+		t.Errorf("response is not logged")
+	}
+
+	_, _, err = runLocal(t, &Config{funcName: program, payload: "fail", localRIE: ts.URL})
+	if err == nil || !strings.Contains(err.Error(), "Unhandled") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLocalInvokeRunTimeout(t *testing.T) {
+	setTestLogger(t)
+	program := writeScript(t, t.TempDir(), "exec sleep 10\n")
+	started := time.Now()
+	err := invokeOnce(context.Background(), &Config{vendor: VendorLocal, funcName: program, localTimeout: 5 * time.Second, runTimeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "-timeout 100ms") || exitCode(err) != exitTimeout {
+		t.Errorf("got %v", err)
+	}
+	if d := time.Since(started); d > 3*time.Second {
+		t.Errorf("took %s to stop by -timeout", d)
+	}
+}
+
+func TestLocalInvokeRulesFileEdited(t *testing.T) {
+	logs := setTestLogger(t)
+	old := rulesCheckInterval
+	rulesCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rulesCheckInterval = old })
+
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(rulesPath, []byte("grep-v drop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "marker")
+	program := writeScript(t, dir, `echo "keep first"
+echo "drop first"
+while [ ! -f `+marker+` ]; do sleep 0.01; done
+echo "keep second"
+echo "drop second"
+`)
+	done := make(chan error, 1)
+	go func() {
+		done <- invokeOnce(context.Background(), &Config{vendor: VendorLocal, funcName: program, localTimeout: 5 * time.Second, rulesFile: rulesPath})
+	}()
+	waitFor(t, func() bool { return logs.FilterMessage("keep first").Len() == 1 })
+	if err := ioutil.WriteFile(rulesPath, []byte("grep-v keep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return logs.FilterMessageSnippet("rules are reloaded").Len() == 1 })
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for msg, want := range map[string]int{"keep first": 1, "drop first": 0, "keep second": 0, "drop second": 1} {
+		if got := logs.FilterMessage(msg).Len(); got != want {
+			t.Errorf("%q is logged %d times, want %d", msg, got, want)
+		}
+	}
+}
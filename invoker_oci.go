@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	ociFunctionsAPIVersion = "20181201"
+	ociLoggingAPIVersion   = "20200531"
+	ociSearchAPIVersion    = "20190909"
+	ociAPITimeout          = 30 * time.Second
+	ociInvokeTimeout       = 6 * time.Minute // longer than the longest timeout of a function, 300s
+	ociLogPollInterval     = 5 * time.Second
+	ociLogWait             = 3 * time.Minute  // the Logging service ingests the logs in a minute or so
+	ociLogQuiet            = 15 * time.Second // without a new line after the response, the logs are complete
+	ociLogLookback         = time.Minute      // clock skew allowed to the timestamps of the logs
+	ociSearchPageSize      = 1000
+	ociRequestIDHeader     = "Opc-Request-Id"
+	ociNextPageHeader      = "Opc-Next-Page"
+	ociFunctionIDPrefix    = "ocid1.fnfunc."
+)
+
+// ociFunction is the function of GetFunction
+type ociFunction struct {
+	ID             string `json:"id"`
+	DisplayName    string `json:"displayName"`
+	ApplicationID  string `json:"applicationId"`
+	CompartmentID  string `json:"compartmentId"`
+	InvokeEndpoint string `json:"invokeEndpoint"`
+}
+
+// ociSearchResult is a log of the response of SearchLogs
+type ociSearchResult struct {
+	Data struct {
+		Datetime   int64 `json:"datetime"` // milliseconds since the epoch
+		LogContent struct {
+			ID   string `json:"id"`
+			Data struct {
+				Message string `json:"message"`
+			} `json:"data"`
+		} `json:"logContent"`
+	} `json:"data"`
+}
+
+// OCIServerless invokes an OCI Function by its OCID and reads the logs of the invocation from the
+// function logs of its application in the Logging service
+type OCIServerless struct {
+	functionID string
+	payload    string
+	auth       string // ociAuthAPIKey or ociAuthInstancePrincipal
+
+	signer    *ociSigner
+	region    string
+	instance  *ociInstancePrincipal
+	client    *http.Client
+	endpoint  func(service, region string) string
+	logPoll   time.Duration
+	logWait   time.Duration
+	logQuiet  time.Duration
+	function  ociFunction
+	logID     string
+	logSearch string // COMPARTMENT/LOG_GROUP/LOG of the search query
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	requestID    string
+	errorCode    string
+	statusCode   int
+	duration     time.Duration
+	received     int
+	logsComplete bool
+}
+
+var _ consoleInvoker = (*OCIServerless)(nil)
+
+// NewOCIServerless returns new Serverless struct for OCI Functions
+func NewOCIServerless(config *Config) (*OCIServerless, error) {
+	if !strings.HasPrefix(config.funcName, ociFunctionIDPrefix) {
+		return nil, fmt.Errorf("function must be the OCID of an OCI function, %s..., %s", ociFunctionIDPrefix, config.funcName)
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which OCI Functions does not log")
+	}
+	client := &http.Client{Timeout: ociAPITimeout}
+	sl := &OCIServerless{
+		functionID: config.funcName,
+		payload:    config.payload,
+		auth:       config.ociAuth,
+		client:     client,
+		endpoint: func(service, region string) string {
+			return fmt.Sprintf("https://%s.%s.oci.oraclecloud.com", service, region)
+		},
+		logPoll:          ociLogPollInterval,
+		logWait:          ociLogWait,
+		logQuiet:         ociLogQuiet,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}
+	switch config.ociAuth {
+	case ociAuthAPIKey:
+		signer, region, err := ociProfileSigner(config.ociConfigFile, config.ociProfile, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		sl.signer, sl.region = signer, region
+	case ociAuthInstancePrincipal:
+		// the token is got by Invoke, which has the context
+		sl.instance = &ociInstancePrincipal{
+			client:      client,
+			metadataURL: ociMetadataURL,
+			authURL: func(region string) string {
+				return fmt.Sprintf("https://auth.%s.oraclecloud.com", region)
+			},
+		}
+	default:
+		return nil, fmt.Errorf("oci-auth must be %q or %q, %s", ociAuthAPIKey, ociAuthInstancePrincipal, config.ociAuth)
+	}
+
+	// every search returns the logs since the start again
+	var err error
+	sl.emitter, err = newEmitter(logger, config.rules, 2*ociLogLookback+ociInvokeTimeout+ociLogWait)
+	if err != nil {
+		return nil, err
+	}
+	sl.emitter.setLineLimit(sinkConsole, config.maxLineLength)
+
+	sl.summary = newSummaryBuilder()
+	sl.integrity = newPayloadIntegrity(config.payload)
+	sl.bus = newBus()
+	sl.bus.subscribe("console", sl.emitter, subscribeOptions{})
+	sl.bus.subscribe("summary", sl.summary, subscribeOptions{})
+	sl.bus.subscribe("payload-integrity", sl.integrity, subscribeOptions{})
+	return sl, nil
+}
+
+// Capabilities returns the options OCI Functions supports
+func (sl *OCIServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorOCI]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *OCIServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// name returns the display name of the function, or its OCID before it is read
+func (sl *OCIServerless) name() string {
+	if sl.function.DisplayName != "" {
+		return sl.function.DisplayName
+	}
+	return sl.functionID
+}
+
+// Invoke calls the function and tails its logs
+func (sl *OCIServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	if sl.instance != nil {
+		if sl.signer, sl.region, err = sl.instance.signer(ctx); err != nil {
+			return err
+		}
+	}
+	if err := sl.getFunction(ctx); err != nil {
+		return err
+	}
+	if err := sl.findLog(ctx); err != nil {
+		return err
+	}
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	start := time.Now()
+	body, callErr := sl.call(ctx)
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	// the logs of a failed function are what explains the failure
+	if callErr == nil {
+		callErr = sl.checkResponse(body)
+	}
+	if sl.logID != "" && sl.requestID != "" {
+		if err := sl.tailLogs(ctx, start.Add(-ociLogLookback)); err != nil {
+			return err
+		}
+	}
+	if callErr != nil {
+		return callErr
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// do sends the signed request, and returns the response body
+func (sl *OCIServerless) do(ctx context.Context, client *http.Client, method, u string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := sl.signer.sign(req, body); err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// getJSON reads a resource of an OCI API, and returns the token of its next page if any
+func (sl *OCIServerless) getJSON(ctx context.Context, what, u string, v interface{}) (string, error) {
+	resp, body, err := sl.do(ctx, sl.client, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", what, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound {
+		// OCI answers 404 also to a resource the key is not authorized to read
+		return "", fmt.Errorf("%s: %s, the resource does not exist or the policies of the %s do not allow to read it: %s", what, resp.Status, sl.auth, truncateMiddle(string(body), 512))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s: %s", what, resp.Status, truncateMiddle(string(body), 512))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", fmt.Errorf("%s: %w", what, err)
+	}
+	return resp.Header.Get(ociNextPageHeader), nil
+}
+
+// getFunction reads the invoke endpoint and the application of the function
+func (sl *OCIServerless) getFunction(ctx context.Context) error {
+	u := fmt.Sprintf("%s/%s/functions/%s", sl.endpoint("functions", sl.region), ociFunctionsAPIVersion, url.PathEscape(sl.functionID))
+	if _, err := sl.getJSON(ctx, "get function "+sl.functionID, u, &sl.function); err != nil {
+		return err
+	}
+	if sl.function.InvokeEndpoint == "" {
+		return fmt.Errorf("get function %s: no invoke endpoint", sl.functionID)
+	}
+	return nil
+}
+
+// findLog finds the function log of the application in the log groups of the compartment of the
+// function, which the application is configured to write to
+func (sl *OCIServerless) findLog(ctx context.Context) error {
+	base := sl.endpoint("logging", sl.region) + "/" + ociLoggingAPIVersion
+	page := ""
+	for {
+		q := url.Values{}
+		q.Set("compartmentId", sl.function.CompartmentID)
+		if page != "" {
+			q.Set("page", page)
+		}
+		var groups []struct {
+			ID string `json:"id"`
+		}
+		next, err := sl.getJSON(ctx, "list log groups", base+"/logGroups?"+q.Encode(), &groups)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			q := url.Values{}
+			q.Set("sourceService", "functions")
+			q.Set("sourceResource", sl.function.ApplicationID)
+			var logs []struct {
+				ID string `json:"id"`
+			}
+			if _, err := sl.getJSON(ctx, "list logs of "+g.ID, base+"/logGroups/"+url.PathEscape(g.ID)+"/logs?"+q.Encode(), &logs); err != nil {
+				return err
+			}
+			if len(logs) > 0 {
+				sl.logID = logs[0].ID
+				sl.logSearch = sl.function.CompartmentID + "/" + g.ID + "/" + logs[0].ID
+				return nil
+			}
+		}
+		if next == "" {
+			break
+		}
+		page = next
+	}
+	logger.Warnf("application of %s has no function log in compartment %s, the logs are not tailed", sl.name(), sl.function.CompartmentID)
+	return nil
+}
+
+// call invokes the function synchronously, and returns the response of a successful invocation
+func (sl *OCIServerless) call(ctx context.Context) ([]byte, error) {
+	u := fmt.Sprintf("%s/%s/functions/%s/actions/invoke", strings.TrimSuffix(sl.function.InvokeEndpoint, "/"), ociFunctionsAPIVersion, url.PathEscape(sl.functionID))
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Fn-Invoke-Type", "sync")
+
+	client := *sl.client
+	client.Timeout = ociInvokeTimeout
+
+	start := time.Now()
+	resp, body, err := sl.do(ctx, &client, http.MethodPost, u, []byte(sl.payload), header)
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.name(), err)
+	}
+	sl.statusCode = resp.StatusCode
+	sl.requestID = resp.Header.Get(ociRequestIDHeader)
+	logger.Infof("%s responds %s in %s, request %s", sl.name(), resp.Status, sl.duration.Round(time.Millisecond), sl.requestID)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &apiErr)
+		// a function which fails or times out is 502 or 504 with a code of FunctionInvoke...
+		if resp.StatusCode >= 500 && strings.HasPrefix(apiErr.Code, "FunctionInvoke") {
+			sl.errorCode = apiErr.Code
+			return nil, &functionError{fmt.Errorf("function error, %s: %s", apiErr.Code, apiErr.Message)}
+		}
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return nil, fmt.Errorf("invoke %s: %s, the policies of the %s must allow FN_INVOCATION of the function: %s", sl.name(), resp.Status, sl.auth, truncateMiddle(string(body), 512))
+		}
+		return nil, fmt.Errorf("invoke %s: %s: %s", sl.name(), resp.Status, truncateMiddle(string(body), 512))
+	}
+	logger.Infow("response", zap.String("payload", string(body)))
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *OCIServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// searchLogs returns the logs of the request in the function log, reading all the pages
+func (sl *OCIServerless) searchLogs(ctx context.Context, from, to time.Time) ([]ociSearchResult, error) {
+	query := fmt.Sprintf(`search "%s" | where data.opcRequestId = '%s' | sort by datetime asc`, sl.logSearch, sl.requestID)
+	body, err := json.Marshal(map[string]interface{}{
+		"timeStart":         from.UTC().Format(time.RFC3339Nano),
+		"timeEnd":           to.UTC().Format(time.RFC3339Nano),
+		"searchQuery":       query,
+		"isReturnFieldInfo": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ret []ociSearchResult
+	page := ""
+	for {
+		q := url.Values{}
+		q.Set("limit", fmt.Sprint(ociSearchPageSize))
+		if page != "" {
+			q.Set("page", page)
+		}
+		u := sl.endpoint("logging", sl.region) + "/" + ociSearchAPIVersion + "/search?" + q.Encode()
+		resp, respBody, err := sl.do(ctx, sl.client, http.MethodPost, u, body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("search logs of %s: %w", sl.logID, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("search logs of %s: %s: %s", sl.logID, resp.Status, truncateMiddle(string(respBody), 512))
+		}
+		var results struct {
+			Results []ociSearchResult `json:"results"`
+		}
+		if err := json.Unmarshal(respBody, &results); err != nil {
+			return nil, fmt.Errorf("search logs of %s: %w", sl.logID, err)
+		}
+		ret = append(ret, results.Results...)
+		if page = resp.Header.Get(ociNextPageHeader); page == "" {
+			return ret, nil
+		}
+	}
+}
+
+// tailLogs prints the logs of the request. A function logs no START or END, and the Logging
+// service ingests the logs late, so the log is searched until some lines are printed and none is
+// new for logQuiet, or until logWait passes.
+func (sl *OCIServerless) tailLogs(ctx context.Context, since time.Time) error {
+	deadline := time.Now().Add(sl.logWait)
+	lastFresh := time.Now()
+	for {
+		logs, err := sl.searchLogs(ctx, since, time.Now().Add(ociLogLookback))
+		if err != nil {
+			return err
+		}
+		for _, l := range logs {
+			msg := strings.TrimRight(l.Data.LogContent.Data.Message, "\n")
+			if !sl.emitter.isNew(l.Data.LogContent.ID, l.Data.Datetime, msg) {
+				continue
+			}
+			lastFresh = time.Now()
+			sl.received++
+			sl.bus.publish(logEvent{
+				FunctionName: sl.name(),
+				RequestID:    sl.requestID,
+				Message:      msg,
+				Timestamp:    l.Data.Datetime,
+			})
+		}
+		if sl.received > 0 && time.Since(lastFresh) >= sl.logQuiet {
+			sl.logsComplete = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if sl.received == 0 {
+				logger.Warnf("no log of %s in %s, the function may log nothing", sl.name(), sl.logWait)
+			} else {
+				logger.Warnf("the logs of %s may be incomplete after %s, the Logging service ingests them late", sl.name(), sl.logWait)
+			}
+			return nil
+		}
+		if err := sleepContext(ctx, sl.logPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *OCIServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the OCI function invocation
+func (sl *OCIServerless) logSummary(v verdict) {
+	summary := schema.OCIRunSummary{
+		SchemaVersion:  schema.OCIRunSummaryVersion,
+		FunctionID:     sl.functionID,
+		FunctionName:   sl.function.DisplayName,
+		Region:         sl.region,
+		Auth:           sl.auth,
+		RequestID:      sl.requestID,
+		StatusCode:     sl.statusCode,
+		ErrorCode:      sl.errorCode,
+		Duration:       sl.duration,
+		LogID:          sl.logID,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	openfaasDefaultGateway = "http://gateway.openfaas:8080" // from a pod of the cluster
+	openfaasDefaultUser    = "admin"
+	openfaasInvokeTimeout  = 10 * time.Minute
+	openfaasLogGrace       = 2 * time.Second  // lines logged right after the response are still read
+	openfaasAsyncQuiet     = 10 * time.Second // an async invocation is over when its logs are quiet this long
+	openfaasAsyncWait      = 5 * time.Minute
+	openfaasCallIDHeader   = "X-Call-Id"
+)
+
+// openfaasFunctionName is NAME or NAME.NAMESPACE, as the gateway takes it
+type openfaasFunctionName struct {
+	Name      string
+	Namespace string // "" for the default namespace of the gateway
+}
+
+// parseOpenFaaSFunctionName parses NAME or NAME.NAMESPACE
+func parseOpenFaaSFunctionName(s string) (openfaasFunctionName, error) {
+	parts := strings.Split(s, ".")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return openfaasFunctionName{Name: parts[0]}, nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return openfaasFunctionName{Name: parts[0], Namespace: parts[1]}, nil
+	}
+	return openfaasFunctionName{}, fmt.Errorf("function name must be NAME or NAME.NAMESPACE, %s", s)
+}
+
+func (n openfaasFunctionName) String() string {
+	if n.Namespace == "" {
+		return n.Name
+	}
+	return n.Name + "." + n.Namespace
+}
+
+// openfaasLogMessage is a line of the NDJSON stream of /system/logs
+type openfaasLogMessage struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Instance  string    `json:"instance"` // the replica
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+}
+
+// OpenFaaSServerless invokes a function through the OpenFaaS gateway, synchronously or by its
+// async endpoint, and follows the logs of the function from the gateway while it runs
+type OpenFaaSServerless struct {
+	name     openfaasFunctionName
+	payload  string
+	gateway  string
+	user     string
+	password string
+	async    bool
+
+	client     *http.Client
+	logGrace   time.Duration
+	asyncQuiet time.Duration
+	asyncWait  time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	callID       string
+	statusCode   int
+	duration     time.Duration
+	logsComplete bool
+
+	mu       sync.Mutex // the log stream publishes concurrently
+	received int
+	lastLine time.Time // when the last line is received
+}
+
+var _ consoleInvoker = (*OpenFaaSServerless)(nil)
+
+// NewOpenFaaSServerless returns new Serverless struct for OpenFaaS
+func NewOpenFaaSServerless(config *Config) (*OpenFaaSServerless, error) {
+	name, err := parseOpenFaaSFunctionName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which OpenFaaS does not log")
+	}
+	gateway := strings.TrimSuffix(config.openfaasURL, "/")
+	if !isRawURL(gateway) {
+		return nil, fmt.Errorf("openfaas-url must be an http(s) URL, %s", config.openfaasURL)
+	}
+	em, err := newEmitter(logger, config.rules, defaultLimits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &OpenFaaSServerless{
+		name:     name,
+		payload:  config.payload,
+		gateway:  gateway,
+		user:     config.openfaasUser,
+		password: config.openfaasPassword,
+		// auto is sync, there is no size limit of the async endpoint to choose by
+		async:            config.invocationType == invocationEvent,
+		client:           &http.Client{},
+		logGrace:         openfaasLogGrace,
+		asyncQuiet:       openfaasAsyncQuiet,
+		asyncWait:        openfaasAsyncWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}, nil
+}
+
+// Capabilities returns the options OpenFaaS supports
+func (sl *OpenFaaSServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorOpenFaaS]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *OpenFaaSServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// Invoke calls the function and follows its logs until the response, or until the logs of an
+// async invocation are quiet
+func (sl *OpenFaaSServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name.String(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	callID, err := newTraceID()
+	if err != nil {
+		return err
+	}
+	sl.callID = callID
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+
+	// the logs are followed from the request on, so that a replica of a cold start is not missed
+	start := time.Now()
+	tailCtx, stopTail := context.WithCancel(ctx)
+	defer stopTail()
+	tailErr, tailDone := make(chan error, 1), make(chan struct{})
+	go func() {
+		tailErr <- sl.tail(tailCtx, start)
+		close(tailDone)
+	}()
+
+	body, callErr := sl.call(ctx)
+	if callErr == nil && sl.async {
+		sl.waitQuiet(ctx, tailDone)
+	} else if ctx.Err() == nil {
+		sleepContext(ctx, sl.logGrace)
+		sl.logsComplete = true
+	}
+	stopTail()
+	// the stream is done before the bus is closed
+	tailed := <-tailErr
+	var fe *functionError
+	if callErr != nil && !errors.As(callErr, &fe) {
+		return callErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if tailed != nil {
+		if callErr == nil {
+			return tailed
+		}
+		logger.Warnf("the logs of %s are incomplete, %s", sl.name, tailed)
+	}
+	sl.publish(lifecycleEvent{Kind: "END", RequestID: sl.callID, Timestamp: unixMilli(time.Now())})
+	if callErr != nil {
+		return callErr
+	}
+	if !sl.async {
+		if err := sl.checkResponse(body); err != nil {
+			return err
+		}
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// call posts the payload to the function, or to its async endpoint which queues it. It returns
+// the response of a 2xx status.
+func (sl *OpenFaaSServerless) call(ctx context.Context) ([]byte, error) {
+	path := "/function/"
+	if sl.async {
+		path = "/async-function/"
+	}
+	req, err := http.NewRequest(http.MethodPost, sl.gateway+path+url.PathEscape(sl.name.String()), strings.NewReader(sl.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(openfaasCallIDHeader, sl.callID)
+	if sl.password != "" {
+		req.SetBasicAuth(sl.user, sl.password)
+	}
+	client := *sl.client
+	client.Timeout = openfaasInvokeTimeout
+
+	start := time.Now()
+	sl.publish(lifecycleEvent{Kind: "START", RequestID: sl.callID, Timestamp: unixMilli(start)})
+	resp, err := client.Do(req.WithContext(ctx))
+	sl.duration = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", sl.name, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response of %s: %w", sl.name, err)
+	}
+	sl.statusCode = resp.StatusCode
+	if id := resp.Header.Get(openfaasCallIDHeader); id != "" {
+		sl.mu.Lock()
+		sl.callID = id
+		sl.mu.Unlock()
+	}
+	logger.Infof("%s responds %s in %s, call %s", sl.name, resp.Status, sl.duration.Round(time.Millisecond), sl.callID)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, fmt.Errorf("invoke %s: %s, check -openfaas-user and -openfaas-password", sl.name, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("invoke %s: %s, no such function at %s: %s", sl.name, resp.Status, sl.gateway, truncateMiddle(string(body), 512))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, &functionError{fmt.Errorf("function error, %s: %s", resp.Status, truncateMiddle(string(body), 512))}
+	}
+	if !sl.async {
+		logger.Infow("response", zap.String("payload", string(body)))
+	}
+	return body, nil
+}
+
+// checkResponse compares the response with the golden file of -expect-response-file
+func (sl *OpenFaaSServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// tail follows the logs of the function since the time until ctx is done
+func (sl *OpenFaaSServerless) tail(ctx context.Context, since time.Time) error {
+	q := url.Values{
+		"name":   {sl.name.Name},
+		"follow": {"true"},
+		// the gateway takes seconds
+		"since": {since.UTC().Format(time.RFC3339)},
+	}
+	if sl.name.Namespace != "" {
+		q.Set("namespace", sl.name.Namespace)
+	}
+	req, err := http.NewRequest(http.MethodGet, sl.gateway+"/system/logs?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if sl.password != "" {
+		req.SetBasicAuth(sl.user, sl.password)
+	}
+	resp, err := sl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("logs of %s: %w", sl.name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("logs of %s: %s: %s", sl.name, resp.Status, truncateMiddle(string(body), 512))
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var m openfaasLogMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			logger.Debugf("not a log message, %s", sc.Text())
+			continue
+		}
+		if m.Timestamp.Before(since) {
+			continue
+		}
+		sl.mu.Lock()
+		sl.received++
+		sl.lastLine = time.Now()
+		callID := sl.callID
+		sl.mu.Unlock()
+		sl.publish(logEvent{
+			FunctionName: sl.name.String(),
+			RequestID:    callID,
+			LogStream:    m.Instance,
+			Message:      strings.TrimRight(m.Text, "\n"),
+			Timestamp:    unixMilli(m.Timestamp),
+		})
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("logs of %s: %w", sl.name, err)
+	}
+	return nil
+}
+
+// waitQuiet waits until the logs of an async invocation have a line and then are quiet for
+// asyncQuiet, since the gateway does not tell when a queued invocation ends. It gives up after
+// asyncWait, when the stream ends, or when ctx is done.
+func (sl *OpenFaaSServerless) waitQuiet(ctx context.Context, tailDone <-chan struct{}) {
+	poll := sl.asyncQuiet / 10
+	deadline := time.Now().Add(sl.asyncWait)
+	for {
+		sl.mu.Lock()
+		quiet := sl.received > 0 && time.Since(sl.lastLine) >= sl.asyncQuiet
+		sl.mu.Unlock()
+		if quiet {
+			sl.logsComplete = true
+			return
+		}
+		if time.Now().After(deadline) {
+			logger.Warnf("the logs of %s may be incomplete after %s, an async invocation is not known to end", sl.name, sl.asyncWait)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tailDone:
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// publish publishes the event, one at a time since the subscribers are not safe for concurrent use
+func (sl *OpenFaaSServerless) publish(ev busEvent) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.bus.publish(ev)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *OpenFaaSServerless) verdict(err error) verdict {
+	note := ""
+	if sl.statusCode != 0 {
+		note = fmt.Sprintf("HTTP %d in %dms, %s", sl.statusCode, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name.String(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the invocation through the OpenFaaS gateway
+func (sl *OpenFaaSServerless) logSummary(v verdict) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	summary := schema.OpenFaaSRunSummary{
+		SchemaVersion:  schema.OpenFaaSRunSummaryVersion,
+		FunctionName:   sl.name.String(),
+		Gateway:        sl.gateway,
+		CallID:         sl.callID,
+		Async:          sl.async,
+		StatusCode:     sl.statusCode,
+		Duration:       sl.duration,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
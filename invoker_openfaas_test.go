@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOpenFaaSFunctionName(t *testing.T) {
+	if n, err := parseOpenFaaSFunctionName("figlet"); err != nil || n.String() != "figlet" || n.Namespace != "" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	if n, err := parseOpenFaaSFunctionName("figlet.staging-fn"); err != nil || n.Name != "figlet" || n.Namespace != "staging-fn" {
+		t.Errorf("got %+v, %v", n, err)
+	}
+	for _, s := range []string{"", "figlet.", ".staging-fn", "a.b.c"} {
+		if _, err := parseOpenFaaSFunctionName(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+}
+
+// fakeOpenFaaS serves the gateway, whose log stream sends the lines of the function and stays
+// open until the client goes away
+type fakeOpenFaaS struct {
+	*httptest.Server
+	status int
+	lines  []string // logged by the function, the first one before the run
+
+	mu      sync.Mutex
+	paths   []string
+	callID  string
+	logsQry string
+}
+
+func newFakeOpenFaaS(t *testing.T) *fakeOpenFaaS {
+	f := &fakeOpenFaaS{status: http.StatusOK, lines: []string{"an older request", "handling order", "ERROR order rejected"}}
+	auth := func(w http.ResponseWriter, r *http.Request) bool {
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	invoke := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.paths = append(f.paths, r.URL.Path)
+		f.callID = r.Header.Get("X-Call-Id")
+		f.mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "error finding function missing.openfaas-fn")
+			return
+		}
+		w.Header().Set("X-Call-Id", r.Header.Get("X-Call-Id"))
+		if strings.HasPrefix(r.URL.Path, "/async-function/") {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"echo": %s}`, body)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/function/", func(w http.ResponseWriter, r *http.Request) {
+		if auth(w, r) {
+			invoke(w, r)
+		}
+	})
+	mux.HandleFunc("/async-function/", func(w http.ResponseWriter, r *http.Request) {
+		if auth(w, r) {
+			invoke(w, r)
+		}
+	})
+	mux.HandleFunc("/system/logs", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(w, r) {
+			return
+		}
+		f.mu.Lock()
+		f.logsQry = r.URL.RawQuery
+		lines := f.lines
+		f.mu.Unlock()
+		enc := json.NewEncoder(w)
+		now := time.Now().UTC()
+		for i, text := range lines {
+			ts := now
+			if i == 0 {
+				// the gateway takes the since in seconds
+				ts = now.Add(-2 * time.Second)
+			}
+			enc.Encode(openfaasLogMessage{Name: "figlet", Namespace: "openfaas-fn", Instance: "figlet-6d8b-x2", Timestamp: ts, Text: text + "\n"})
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runOpenFaaS(t *testing.T, ctx context.Context, f *fakeOpenFaaS, config *Config) (*OpenFaaSServerless, error) {
+	t.Helper()
+	if config.funcName == "" {
+		config.funcName = "figlet"
+	}
+	config.openfaasURL, config.openfaasUser = f.URL+"/", "admin"
+	if config.openfaasPassword == "" {
+		config.openfaasPassword = "secret"
+	}
+	sl, err := NewOpenFaaSServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.logGrace, sl.asyncQuiet, sl.asyncWait = 50*time.Millisecond, 100*time.Millisecond, 5*time.Second
+	return sl, sl.Invoke(ctx)
+}
+
+func TestOpenFaaSInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeOpenFaaS(t)
+	sl, err := runOpenFaaS(t, context.Background(), f, &Config{payload: `{"id":1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != 200 || sl.callID != f.callID || sl.async || !sl.logsComplete || f.paths[0] != "/function/figlet" {
+		t.Errorf("got %+v", sl)
+	}
+	if sl.received != 2 || logs.FilterMessageSnippet("an older request").Len() != 0 || sl.summary.errors() != 1 {
+		t.Errorf("got %d events, %d errors", sl.received, sl.summary.errors())
+	}
+	if !strings.Contains(f.logsQry, "follow=true") || !strings.Contains(f.logsQry, "name=figlet") {
+		t.Errorf("got %s", f.logsQry)
+	}
+
+	// the namespace is given to the logs too
+	f = newFakeOpenFaaS(t)
+	if _, err := runOpenFaaS(t, context.Background(), f, &Config{funcName: "figlet.staging-fn", payload: `{}`}); err != nil || f.paths[0] != "/function/figlet.staging-fn" || !strings.Contains(f.logsQry, "namespace=staging-fn") {
+		t.Errorf("got %v, %v, %s", err, f.paths, f.logsQry)
+	}
+}
+
+func TestOpenFaaSInvokeAsync(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeOpenFaaS(t)
+	sl, err := runOpenFaaS(t, context.Background(), f, &Config{payload: `{}`, invocationType: invocationEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.statusCode != http.StatusAccepted || !sl.async || !sl.logsComplete || sl.received != 2 || f.paths[0] != "/async-function/figlet" {
+		t.Errorf("got %+v", sl)
+	}
+}
+
+func TestOpenFaaSInvokeFailure(t *testing.T) {
+	setTestLogger(t)
+	var fe *functionError
+
+	f := newFakeOpenFaaS(t)
+	f.status = http.StatusInternalServerError
+	sl, err := runOpenFaaS(t, context.Background(), f, &Config{payload: `{}`})
+	if !errors.As(err, &fe) || sl.received != 2 {
+		t.Errorf("HTTP 500 is a function error with its logs, got %v, %d events", err, sl.received)
+	}
+
+	f = newFakeOpenFaaS(t)
+	if _, err := runOpenFaaS(t, context.Background(), f, &Config{payload: `{}`, openfaasPassword: "wrong"}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "-openfaas-password") {
+		t.Errorf("got %v", err)
+	}
+	f = newFakeOpenFaaS(t)
+	if _, err := runOpenFaaS(t, context.Background(), f, &Config{funcName: "missing", payload: `{}`}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "no such function") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestOpenFaaSInvokeCancel(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeOpenFaaS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	// an async invocation whose logs never get quiet
+	f.lines = nil
+	sl, err := runOpenFaaS(t, ctx, f, &Config{payload: `{}`, invocationType: invocationEvent})
+	if !errors.Is(err, context.Canceled) || sl.logsComplete {
+		t.Errorf("got %v, %+v", err, sl)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	openwhiskAPITimeout       = 30 * time.Second
+	openwhiskPollInterval     = time.Second
+	openwhiskActivationWait   = 10 * time.Minute // longer than the longest timeout of an action
+	openwhiskDefaultNamespace = "_"              // the namespace of the auth key
+)
+
+// openwhiskLogRe is a line of the logs of an activation, "TIMESTAMP stdout: MESSAGE"
+var openwhiskLogRe = regexp.MustCompile(`^(\S+)\s+(stdout|stderr): ?(.*)$`)
+
+// openwhiskActionName is [/NAMESPACE/][PACKAGE/]NAME, as the wsk CLI takes it
+type openwhiskActionName struct {
+	Namespace string
+	Action    string // NAME or PACKAGE/NAME
+}
+
+// parseOpenWhiskActionName parses [/NAMESPACE/][PACKAGE/]NAME
+func parseOpenWhiskActionName(s string) (openwhiskActionName, error) {
+	n := openwhiskActionName{Namespace: openwhiskDefaultNamespace, Action: s}
+	if strings.HasPrefix(s, "/") {
+		parts := strings.SplitN(s[1:], "/", 2)
+		if len(parts) != 2 {
+			return openwhiskActionName{}, fmt.Errorf("action name must be [/NAMESPACE/][PACKAGE/]NAME, %s", s)
+		}
+		n.Namespace, n.Action = parts[0], parts[1]
+	}
+	parts := strings.Split(n.Action, "/")
+	if n.Namespace == "" || len(parts) > 2 {
+		return openwhiskActionName{}, fmt.Errorf("action name must be [/NAMESPACE/][PACKAGE/]NAME, %s", s)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return openwhiskActionName{}, fmt.Errorf("action name must be [/NAMESPACE/][PACKAGE/]NAME, %s", s)
+		}
+	}
+	return n, nil
+}
+
+func (n openwhiskActionName) String() string {
+	if n.Namespace == openwhiskDefaultNamespace {
+		return n.Action
+	}
+	return "/" + n.Namespace + "/" + n.Action
+}
+
+// openwhiskAPIURL returns the base URL of the API of the API host, which is a host as wsk takes it or a URL
+func openwhiskAPIURL(apihost string) (string, error) {
+	apihost = strings.TrimSuffix(apihost, "/")
+	if apihost == "" {
+		return "", fmt.Errorf("vendor openwhisk needs -openwhisk-apihost")
+	}
+	if !strings.HasPrefix(apihost, "http://") && !strings.HasPrefix(apihost, "https://") {
+		apihost = "https://" + apihost
+	}
+	u, err := url.Parse(apihost)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("openwhisk-apihost must be a host or an http(s) URL, %s", apihost)
+	}
+	return apihost + "/api/v1", nil
+}
+
+// openwhiskResult is the response of /activations/ID/result
+type openwhiskResult struct {
+	Result  json.RawMessage `json:"result"`
+	Status  string          `json:"status"` // "success", "application error", "action developer error" or "whisk internal error"
+	Success bool            `json:"success"`
+}
+
+// OpenWhiskServerless invokes an action of Apache OpenWhisk or IBM Cloud Functions without
+// blocking, and polls the logs and the result of the activation until it completes
+type OpenWhiskServerless struct {
+	name    openwhiskActionName
+	payload string
+	apiURL  string
+	user    string // of the auth key, UUID:KEY
+	key     string
+
+	client         *http.Client
+	poll           time.Duration
+	activationWait time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	activationID string
+	status       string
+	success      bool
+	duration     time.Duration // from the invocation to the result
+	received     int
+	logsComplete bool
+}
+
+var _ consoleInvoker = (*OpenWhiskServerless)(nil)
+
+// NewOpenWhiskServerless returns new Serverless struct for Apache OpenWhisk
+func NewOpenWhiskServerless(config *Config) (*OpenWhiskServerless, error) {
+	name, err := parseOpenWhiskActionName(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	if config.baseline != nil {
+		return nil, fmt.Errorf("-baseline compares the REPORT metrics, which OpenWhisk does not log")
+	}
+	apiURL, err := openwhiskAPIURL(config.openwhiskAPIHost)
+	if err != nil {
+		return nil, err
+	}
+	auth := strings.SplitN(config.openwhiskAuth, ":", 2)
+	if len(auth) != 2 || auth[0] == "" || auth[1] == "" {
+		return nil, fmt.Errorf("vendor openwhisk needs -openwhisk-auth, the auth key UUID:KEY")
+	}
+	em, err := newEmitter(logger, config.rules, openwhiskActivationWait)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &OpenWhiskServerless{
+		name:             name,
+		payload:          config.payload,
+		apiURL:           apiURL,
+		user:             auth[0],
+		key:              auth[1],
+		client:           &http.Client{Timeout: openwhiskAPITimeout},
+		poll:             openwhiskPollInterval,
+		activationWait:   openwhiskActivationWait,
+		emitter:          em,
+		bus:              b,
+		summary:          summary,
+		integrity:        integrity,
+		requireIntegrity: config.requirePayloadIntegrity,
+		githubStatus:     config.githubStatus,
+		pushgateway:      config.pushgateway,
+		golden:           config.responseGolden,
+	}, nil
+}
+
+// Capabilities returns the options OpenWhisk supports
+func (sl *OpenWhiskServerless) Capabilities() Capabilities {
+	return vendorCapabilities[VendorOpenWhisk]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (sl *OpenWhiskServerless) consoleEmitter() *emitter {
+	return sl.emitter
+}
+
+// Invoke invokes the action and follows its activation until it completes
+func (sl *OpenWhiskServerless) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := sl.verdict(err)
+		sl.logSummary(v)
+		if berr := sl.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if sl.pushgateway != nil {
+			pushRunMetrics(sl.pushgateway, sl.pushgateway.groupingKey(sl.name.String(), ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  sl.summary.errors(),
+				Elapsed: sl.duration,
+			})
+		}
+		finishRun(v, sl.githubStatus)
+	}()
+
+	logger.Infof("payload sha256:%s (%d bytes)", sl.integrity.sent, len(sl.payload))
+	start := time.Now()
+	if err := sl.call(ctx); err != nil {
+		return err
+	}
+	result, err := sl.follow(ctx)
+	sl.duration = time.Since(start)
+	if err != nil {
+		return err
+	}
+	sl.bus.publish(lifecycleEvent{Kind: "END", RequestID: sl.activationID, Timestamp: unixMilli(time.Now())})
+	logger.Infof("activation %s is %s in %s", sl.activationID, sl.status, sl.duration.Round(time.Millisecond))
+
+	if !sl.success {
+		return &functionError{fmt.Errorf("activation %s of %s failed, %s: %s", sl.activationID, sl.name, sl.status, truncateMiddle(string(result), 512))}
+	}
+	logger.Infow("response", zap.String("payload", string(result)))
+	if err := sl.checkResponse(result); err != nil {
+		return err
+	}
+	return sl.integrity.check(sl.requireIntegrity)
+}
+
+// do sends a request authorized by the auth key, and returns the status and the body of the response
+func (sl *OpenWhiskServerless) do(ctx context.Context, method, path string, body string) (int, []byte, error) {
+	req, err := http.NewRequest(method, sl.apiURL+path, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(sl.user, sl.key)
+	resp, err := sl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, buf, nil
+}
+
+// namespacePath returns the path of the namespace of the action
+func (sl *OpenWhiskServerless) namespacePath() string {
+	return "/namespaces/" + url.PathEscape(sl.name.Namespace)
+}
+
+// call invokes the action without blocking and remembers the activation id
+func (sl *OpenWhiskServerless) call(ctx context.Context) error {
+	parts := strings.Split(sl.name.Action, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	path := sl.namespacePath() + "/actions/" + strings.Join(parts, "/") + "?blocking=false"
+	payload := sl.payload
+	if strings.TrimSpace(payload) == "" {
+		payload = "{}"
+	}
+	start := time.Now()
+	status, body, err := sl.do(ctx, http.MethodPost, path, payload)
+	if err != nil {
+		return fmt.Errorf("invoke %s: %w", sl.name, err)
+	}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fmt.Errorf("invoke %s: %d %s, check -openwhisk-auth: %s", sl.name, status, http.StatusText(status), truncateMiddle(string(body), 512))
+	case status == http.StatusNotFound:
+		return fmt.Errorf("invoke %s: %d %s, no such action at %s: %s", sl.name, status, http.StatusText(status), sl.apiURL, truncateMiddle(string(body), 512))
+	case status < 200 || status >= 300:
+		return fmt.Errorf("invoke %s: %d %s: %s", sl.name, status, http.StatusText(status), truncateMiddle(string(body), 512))
+	}
+	var out struct {
+		ActivationID string `json:"activationId"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil || out.ActivationID == "" {
+		return fmt.Errorf("invoke %s: no activation id in the response: %s", sl.name, truncateMiddle(string(body), 512))
+	}
+	sl.activationID = out.ActivationID
+	logger.Infof("%s is invoked, activation %s", sl.name, sl.activationID)
+	sl.bus.publish(lifecycleEvent{Kind: "START", RequestID: sl.activationID, Timestamp: unixMilli(start)})
+	return nil
+}
+
+// follow polls the result and the logs of the activation until it completes, and returns the result
+func (sl *OpenWhiskServerless) follow(ctx context.Context) (json.RawMessage, error) {
+	deadline := time.Now().Add(sl.activationWait)
+	for {
+		result, done, err := sl.result(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// the logs are read after the result, so that those of a completed activation are all there
+		if err := sl.logs(ctx); err != nil {
+			return nil, err
+		}
+		if done {
+			sl.logsComplete = true
+			return result, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, &timeoutError{fmt.Errorf("activation %s of %s did not complete in %s", sl.activationID, sl.name, sl.activationWait)}
+		}
+		if err := sleepContext(ctx, sl.poll); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// result returns the result of the activation, or false while it runs
+func (sl *OpenWhiskServerless) result(ctx context.Context) (json.RawMessage, bool, error) {
+	status, body, err := sl.do(ctx, http.MethodGet, sl.namespacePath()+"/activations/"+url.PathEscape(sl.activationID)+"/result", "")
+	if err != nil {
+		return nil, false, fmt.Errorf("result of activation %s: %w", sl.activationID, err)
+	}
+	switch {
+	case status == http.StatusNotFound:
+		// the activation record is written when it completes
+		return nil, false, nil
+	case status != http.StatusOK:
+		return nil, false, fmt.Errorf("result of activation %s: %d %s: %s", sl.activationID, status, http.StatusText(status), truncateMiddle(string(body), 512))
+	}
+	var out openwhiskResult
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, false, fmt.Errorf("result of activation %s: %w", sl.activationID, err)
+	}
+	sl.status, sl.success = out.Status, out.Success
+	return out.Result, true, nil
+}
+
+// logs publishes the lines of the logs of the activation not published yet
+func (sl *OpenWhiskServerless) logs(ctx context.Context) error {
+	status, body, err := sl.do(ctx, http.MethodGet, sl.namespacePath()+"/activations/"+url.PathEscape(sl.activationID)+"/logs", "")
+	if err != nil {
+		return fmt.Errorf("logs of activation %s: %w", sl.activationID, err)
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return nil
+	case status != http.StatusOK:
+		return fmt.Errorf("logs of activation %s: %d %s: %s", sl.activationID, status, http.StatusText(status), truncateMiddle(string(body), 512))
+	}
+	var out struct {
+		Logs []string `json:"logs"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return fmt.Errorf("logs of activation %s: %w", sl.activationID, err)
+	}
+	for i, line := range out.Logs {
+		timestamp, message := parseOpenWhiskLogLine(line)
+		// the logs of an activation only grow, so a line is known by its index
+		if !sl.emitter.isNew(fmt.Sprintf("%s/%d", sl.activationID, i), timestamp, message) {
+			continue
+		}
+		sl.received++
+		sl.bus.publish(logEvent{
+			FunctionName: sl.name.String(),
+			RequestID:    sl.activationID,
+			Message:      message,
+			Timestamp:    timestamp,
+		})
+	}
+	return nil
+}
+
+// parseOpenWhiskLogLine returns the timestamp and the message of a line of the logs of an
+// activation. stderr is kept as the prefix of the message, a line of another format is the message.
+func parseOpenWhiskLogLine(line string) (int64, string) {
+	m := openwhiskLogRe.FindStringSubmatch(line)
+	if m == nil {
+		return unixMilli(time.Now()), line
+	}
+	t, err := time.Parse(time.RFC3339Nano, m[1])
+	if err != nil {
+		return unixMilli(time.Now()), line
+	}
+	if m[2] == "stderr" {
+		return unixMilli(t), "stderr: " + m[3]
+	}
+	return unixMilli(t), m[3]
+}
+
+// checkResponse compares the result with the golden file of -expect-response-file
+func (sl *OpenWhiskServerless) checkResponse(body []byte) error {
+	if sl.golden == nil {
+		return nil
+	}
+	var err error
+	sl.goldenResult, sl.goldenDiffs, err = sl.golden.check(body)
+	return err
+}
+
+// verdict returns the verdict of the run which ended with err
+func (sl *OpenWhiskServerless) verdict(err error) verdict {
+	note := ""
+	if sl.status != "" {
+		note = fmt.Sprintf("%s in %dms, %s", sl.status, sl.duration.Milliseconds(), plural(sl.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: sl.name.String(),
+		Errors:   sl.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the activation
+func (sl *OpenWhiskServerless) logSummary(v verdict) {
+	summary := schema.OpenWhiskRunSummary{
+		SchemaVersion:  schema.OpenWhiskRunSummaryVersion,
+		Action:         sl.name.String(),
+		APIURL:         sl.apiURL,
+		ActivationID:   sl.activationID,
+		Status:         sl.status,
+		Success:        sl.success,
+		Duration:       sl.duration,
+		EventsReceived: sl.received,
+		LogsComplete:   sl.logsComplete,
+		RunCommon:      runCommon(v, sl.integrity, sl.goldenResult, sl.goldenDiffs),
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOpenWhiskActionName(t *testing.T) {
+	for in, want := range map[string]openwhiskActionName{
+		"hello":                {Namespace: "_", Action: "hello"},
+		"utils/hello":          {Namespace: "_", Action: "utils/hello"},
+		"/guest/hello":         {Namespace: "guest", Action: "hello"},
+		"/guest/utils/hello":   {Namespace: "guest", Action: "utils/hello"},
+		"/whisk.system/utils/": {},
+	} {
+		got, err := parseOpenWhiskActionName(in)
+		if want.Action == "" {
+			if err == nil {
+				t.Errorf("%s must be an error", in)
+			}
+			continue
+		}
+		if err != nil || got != want || got.String() != in {
+			t.Errorf("%s: got %+v, %v", in, got, err)
+		}
+	}
+	for _, s := range []string{"", "/guest", "//hello", "a/b/c", "/guest/a/b/c"} {
+		if _, err := parseOpenWhiskActionName(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+	if u, err := openwhiskAPIURL("us-south.functions.cloud.ibm.com"); err != nil || u != "https://us-south.functions.cloud.ibm.com/api/v1" {
+		t.Errorf("got %s, %v", u, err)
+	}
+	if u, err := openwhiskAPIURL("http://172.17.0.1:3233/"); err != nil || u != "http://172.17.0.1:3233/api/v1" {
+		t.Errorf("got %s, %v", u, err)
+	}
+}
+
+func TestParseOpenWhiskLogLine(t *testing.T) {
+	ts, msg := parseOpenWhiskLogLine("2024-06-10T08:00:00.123456789Z stdout: order 1 accepted")
+	if ts != time.Date(2024, 6, 10, 8, 0, 0, 123000000, time.UTC).UnixNano()/1e6 || msg != "order 1 accepted" {
+		t.Errorf("got %d %q", ts, msg)
+	}
+	if _, msg := parseOpenWhiskLogLine("2024-06-10T08:00:00.1Z  stderr: ERROR order rejected"); msg != "stderr: ERROR order rejected" {
+		t.Errorf("got %q", msg)
+	}
+	if _, msg := parseOpenWhiskLogLine("The action did not initialize or run as expected."); msg != "The action did not initialize or run as expected." {
+		t.Errorf("got %q", msg)
+	}
+}
+
+// fakeOpenWhisk serves an action whose activation completes after some polls of its result.
+// Its logs grow with the polls and are complete once the result is there.
+type fakeOpenWhisk struct {
+	*httptest.Server
+	doneAfter int // polls of the result before the activation completes
+	result    string
+
+	mu      sync.Mutex
+	payload string
+	polls   int
+}
+
+const testActivationID = "2c6fa4f1b7bd4a2fafa4f1b7bdaa2f39"
+
+func newFakeOpenWhisk(t *testing.T) *fakeOpenWhisk {
+	f := &fakeOpenWhisk{doneAfter: 2, result: `{"result": {"ok": true}, "status": "success", "success": true, "size": 11}`}
+	lines := []string{
+		"2024-06-10T08:00:00.100Z stdout: loading order 1",
+		"2024-06-10T08:00:00.200Z stderr: WARN slow lookup",
+		"2024-06-10T08:00:00.300Z stdout: done",
+	}
+	auth := func(w http.ResponseWriter, r *http.Request) bool {
+		if user, key, ok := r.BasicAuth(); !ok || user != "uuid" || key != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "The supplied authentication is invalid", "code": "x"}`)
+			return false
+		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/_/actions/utils/hello", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Query().Get("blocking") != "false" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.payload = string(body)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"activationId": %q}`, testActivationID)
+	})
+	mux.HandleFunc("/api/v1/namespaces/_/activations/"+testActivationID+"/result", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(w, r) {
+			return
+		}
+		f.mu.Lock()
+		f.polls++
+		done := f.polls > f.doneAfter
+		f.mu.Unlock()
+		if !done {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "The requested resource does not exist."}`)
+			return
+		}
+		fmt.Fprint(w, f.result)
+	})
+	mux.HandleFunc("/api/v1/namespaces/_/activations/"+testActivationID+"/logs", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(w, r) {
+			return
+		}
+		f.mu.Lock()
+		n := f.polls
+		if n > f.doneAfter {
+			n = len(lines)
+		}
+		f.mu.Unlock()
+		if n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if n > len(lines) {
+			n = len(lines)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"logs": lines[:n]})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runOpenWhisk(t *testing.T, f *fakeOpenWhisk, config *Config) (*OpenWhiskServerless, error) {
+	t.Helper()
+	config.funcName = "utils/hello"
+	config.openwhiskAPIHost = f.URL
+	if config.openwhiskAuth == "" {
+		config.openwhiskAuth = "uuid:key"
+	}
+	sl, err := NewOpenWhiskServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.poll = 5 * time.Millisecond
+	return sl, sl.Invoke(context.Background())
+}
+
+func TestOpenWhiskInvoke(t *testing.T) {
+	logs := setTestLogger(t)
+	f := newFakeOpenWhisk(t)
+	sl, err := runOpenWhisk(t, f, &Config{payload: `{"id": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.payload != `{"id": 1}` || sl.activationID != testActivationID || sl.status != "success" || !sl.logsComplete {
+		t.Errorf("got %+v", sl)
+	}
+	// the logs are read at each poll, each line is printed once
+	if sl.received != 3 || logs.FilterMessageSnippet("slow lookup").Len() != 1 {
+		t.Errorf("got %d lines", sl.received)
+	}
+	if logs.FilterMessage("response").Len() != 1 {
+		t.Errorf("the result is the response")
+	}
+}
+
+func TestOpenWhiskInvokeFailure(t *testing.T) {
+	setTestLogger(t)
+	f := newFakeOpenWhisk(t)
+	f.result = `{"result": {"error": "order rejected"}, "status": "application error", "success": false}`
+	sl, err := runOpenWhisk(t, f, &Config{payload: `{"id": 1}`})
+	var fe *functionError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "application error") || !strings.Contains(err.Error(), "order rejected") {
+		t.Errorf("success false is a function error, got %v", err)
+	}
+	if sl.received != 3 {
+		t.Errorf("the logs of a failed activation are printed, got %d", sl.received)
+	}
+
+	f = newFakeOpenWhisk(t)
+	if _, err := runOpenWhisk(t, f, &Config{payload: `{}`, openwhiskAuth: "uuid:wrong"}); err == nil || errors.As(err, &fe) || !strings.Contains(err.Error(), "-openwhisk-auth") {
+		t.Errorf("a wrong key is an error of the run, got %v", err)
+	}
+
+	f = newFakeOpenWhisk(t)
+	f.doneAfter = 1 << 20
+	config := &Config{funcName: "utils/hello", openwhiskAPIHost: f.URL, openwhiskAuth: "uuid:key"}
+	sl, err = NewOpenWhiskServerless(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.poll, sl.activationWait = 5*time.Millisecond, 30*time.Millisecond
+	if err := sl.Invoke(context.Background()); err == nil || !strings.Contains(err.Error(), "did not complete") {
+		t.Errorf("got %v", err)
+	}
+
+	if _, err := NewOpenWhiskServerless(&Config{funcName: "hello", openwhiskAPIHost: f.URL, openwhiskAuth: "nokey"}); err == nil {
+		t.Errorf("an auth key without : must be an error")
+	}
+}
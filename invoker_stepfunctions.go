@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	sfnPollInterval = time.Second
+	sfnLogGrace     = 10 * time.Second // the tails of the Lambda tasks may still await END and REPORT after the execution ends
+	sfnStopWait     = 30 * time.Second // how long the stop of an interrupted run may take
+	sfnHistoryPage  = 1000             // the max events of a GetExecutionHistory page
+	sfnRunning      = "RUNNING"
+)
+
+// stateMachineARN is arn:PARTITION:states:REGION:ACCOUNT:stateMachine:NAME
+type stateMachineARN struct {
+	ARN    string
+	Region string
+	Name   string
+}
+
+// isStateMachineARN returns true if the name is of a state machine rather than of a function
+func isStateMachineARN(s string) bool {
+	p := strings.Split(s, ":")
+	return len(p) == 7 && p[0] == "arn" && p[2] == "states" && p[5] == "stateMachine"
+}
+
+// parseStateMachineARN parses the ARN of a state machine
+func parseStateMachineARN(s string) (stateMachineARN, error) {
+	p := strings.Split(s, ":")
+	if !isStateMachineARN(s) || !strings.HasPrefix(p[1], "aws") || p[3] == "" || !accountIDRe.MatchString(p[4]) || p[6] == "" {
+		return stateMachineARN{}, fmt.Errorf("state machine must be arn:aws:states:REGION:ACCOUNT:stateMachine:NAME, %s", s)
+	}
+	return stateMachineARN{ARN: s, Region: p[3], Name: p[6]}, nil
+}
+
+// sfnAPI is the part of Step Functions API used to run an execution
+type sfnAPI interface {
+	StartExecutionWithContext(aws.Context, *sfn.StartExecutionInput, ...request.Option) (*sfn.StartExecutionOutput, error)
+	GetExecutionHistoryWithContext(aws.Context, *sfn.GetExecutionHistoryInput, ...request.Option) (*sfn.GetExecutionHistoryOutput, error)
+	StopExecutionWithContext(aws.Context, *sfn.StopExecutionInput, ...request.Option) (*sfn.StopExecutionOutput, error)
+}
+
+// sfnTask is a Lambda task of the execution whose logs are tailed
+type sfnTask struct {
+	schema.StepFunctionsTask
+	ref       FunctionRef
+	region    string
+	scheduled time.Time
+}
+
+// StepFunctions starts an execution of a Step Functions state machine, prints its state transitions
+// from the execution history, and tails the logs of the Lambda functions its task states invoke
+// until the execution ends.
+type StepFunctions struct {
+	machine stateMachineARN
+	payload string
+
+	api       sfnAPI
+	logClient func(region string) logsAPI
+	poll      time.Duration
+	logGrace  time.Duration
+	limits    Limits
+
+	streamPrefixMargin time.Duration
+
+	emitter   *emitter
+	bus       *bus
+	summary   *summaryBuilder
+	integrity *payloadIntegrity
+
+	requireIntegrity bool
+	cancelExecution  bool
+
+	githubStatus *githubStatus
+	pushgateway  *pushgateway
+
+	golden       *responseGolden
+	goldenResult string
+	goldenDiffs  []jsonDiff
+
+	executionARN  string
+	status        string
+	errorName     string
+	cause         string
+	output        string
+	duration      time.Duration
+	interrupted   bool
+	stopRequested bool
+
+	states  []schema.StepFunctionsState
+	entered map[string]int     // index in states of the running state of each name
+	stateOf map[int64]string   // the state each history event belongs to
+	taskOf  map[int64]*sfnTask // the Lambda task each history event belongs to
+	tasks   []*sfnTask
+
+	mu       sync.Mutex // the tails of the Lambda tasks publish concurrently
+	received int
+}
+
+var _ consoleInvoker = (*StepFunctions)(nil)
+
+// NewStepFunctions returns new Invoker which runs a Step Functions state machine
+func NewStepFunctions(config *Config) (*StepFunctions, error) {
+	machine, err := parseStateMachineARN(config.funcName)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []struct {
+		given bool
+		flag  string
+		why   string
+	}{
+		{config.retryIf != nil, "retry-if-response", "an execution has no response to retry on"},
+		{config.retryOnFailure, "retry-on-failure", "an execution has no response to retry on"},
+		{config.invocationType == invocationRequestResponse, "invocation-type request-response", "an execution is always asynchronous"},
+		{config.baseline != nil, "baseline", "an execution has no REPORT of its own"},
+		{config.timeline, "timeline", "the phases are of a single invocation"},
+		{config.readOnly, "read-only", "StartExecution is a mutating call"},
+		{len(config.clientContext) > 0, "client-context", "an execution has no ClientContext"},
+		{config.expect != nil, "expect-sqs-message and -expect-dynamodb-item", "an execution is followed until it ends"},
+		{config.completionStrategy == completionMetrics, "completion-strategy metrics", "the end of an execution is in its history"},
+		{config.setRetention > 0, "set-retention", "the log groups of the tasks are not known before they run"},
+		{config.insightsMetrics == insightsOn, "insights-metrics", "the metrics are of a single invocation"},
+	} {
+		if c.given {
+			return nil, fmt.Errorf("-%s can not be used with a state machine, %s", c.flag, c.why)
+		}
+	}
+
+	awsOpts, err := newAWSSessionOptions(machine.Region, config.network, config.noCredentialCache)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("aws session error: %w", err)
+	}
+
+	limits := config.limits.orDefault()
+	em, err := newEmitter(logger, config.rules, limits.EventsWindow)
+	if err != nil {
+		return nil, err
+	}
+	em.setLineLimit(sinkConsole, config.maxLineLength)
+
+	summary := newSummaryBuilder()
+	integrity := newPayloadIntegrity(config.payload)
+	b := newBus()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	b.subscribe("payload-integrity", integrity, subscribeOptions{})
+
+	return &StepFunctions{
+		machine: machine,
+		payload: config.payload,
+		api:     sfn.New(sess),
+		logClient: func(region string) logsAPI {
+			return cloudwatchlogs.New(sess, aws.NewConfig().WithRegion(region))
+		},
+		poll:               sfnPollInterval,
+		logGrace:           sfnLogGrace,
+		limits:             limits,
+		streamPrefixMargin: config.streamPrefixMargin,
+		emitter:            em,
+		bus:                b,
+		summary:            summary,
+		integrity:          integrity,
+		requireIntegrity:   config.requirePayloadIntegrity,
+		cancelExecution:    config.cancelExecution,
+		githubStatus:       config.githubStatus,
+		pushgateway:        config.pushgateway,
+		golden:             config.responseGolden,
+	}, nil
+}
+
+// Capabilities returns the options a state machine supports, which are those of AWS Lambda
+func (s *StepFunctions) Capabilities() Capabilities {
+	return vendorCapabilities[VendorAWS]
+}
+
+// consoleEmitter returns the emitter which prints the logs
+func (s *StepFunctions) consoleEmitter() *emitter {
+	return s.emitter
+}
+
+// Invoke starts an execution and follows it until it ends. When ctx is cancelled, the execution
+// keeps running unless -cancel-execution is given.
+func (s *StepFunctions) Invoke(ctx context.Context) (err error) {
+	defer func() {
+		v := s.verdict(err)
+		s.logSummary(v)
+		if berr := s.bus.close(err); berr != nil && err == nil {
+			err = berr
+		}
+		if s.pushgateway != nil {
+			pushRunMetrics(s.pushgateway, s.pushgateway.groupingKey(s.machine.Name, ""), &runMetrics{
+				Outcome: v.Outcome,
+				Errors:  s.summary.errors(),
+				Elapsed: s.duration,
+			})
+		}
+		finishRun(v, s.githubStatus)
+	}()
+
+	input := &sfn.StartExecutionInput{StateMachineArn: aws.String(s.machine.ARN)}
+	if s.payload != "" {
+		input.Input = aws.String(s.payload)
+	}
+	start := time.Now()
+	res, err := s.api.StartExecutionWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("StartExecution, %s: %w", s.machine.Name, err)
+	}
+	s.executionARN = aws.StringValue(res.ExecutionArn)
+	s.status = sfnRunning
+	logger.Infof("execution %s of %s is started, payload sha256:%s (%d bytes)", s.executionName(), s.machine.Name, s.integrity.sent, len(s.payload))
+	s.publish(lifecycleEvent{Kind: "START", RequestID: s.executionName(), Timestamp: unixMilli(start)})
+
+	// the tails outlive the history polls by logGrace at most, and are done before the bus is closed
+	tailCtx, stopTails := context.WithCancel(context.Background())
+	defer stopTails()
+	var tails sync.WaitGroup
+	followErr := s.follow(ctx, func(t *sfnTask) {
+		tails.Add(1)
+		go func() {
+			defer tails.Done()
+			s.tail(tailCtx, t)
+		}()
+	})
+	s.duration = time.Since(start)
+	if followErr == nil {
+		waitGroup(&tails, s.logGrace)
+	}
+	stopTails()
+	tails.Wait()
+
+	if followErr != nil {
+		if ctx.Err() != nil {
+			return s.interrupt(ctx.Err())
+		}
+		return followErr
+	}
+	s.publish(lifecycleEvent{Kind: "END", RequestID: s.executionName(), Timestamp: unixMilli(time.Now())})
+
+	if s.status != "SUCCEEDED" {
+		return &functionError{fmt.Errorf("execution %s is %s%s", s.executionName(), s.status, s.failure())}
+	}
+	logger.Infow("output", zap.String("payload", s.output))
+	if s.golden != nil {
+		if s.goldenResult, s.goldenDiffs, err = s.golden.check([]byte(s.output)); err != nil {
+			return err
+		}
+	}
+	return s.integrity.check(s.requireIntegrity)
+}
+
+// failure returns the error and the cause of the execution to follow its status, if any
+func (s *StepFunctions) failure() string {
+	switch {
+	case s.errorName != "" && s.cause != "":
+		return fmt.Sprintf(", %s: %s", s.errorName, s.cause)
+	case s.errorName != "" || s.cause != "":
+		return ", " + s.errorName + s.cause
+	}
+	return ""
+}
+
+// waitGroup waits for wg up to the timeout, and returns false if it timed out
+func waitGroup(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// executionName returns the last part of the ARN of the execution
+func (s *StepFunctions) executionName() string {
+	return s.executionARN[strings.LastIndex(s.executionARN, ":")+1:]
+}
+
+// follow polls the history of the execution until it ends, and calls startTail for each Lambda
+// task scheduled. A history read to the end has no token to go on with, so each poll reads it
+// from the start and skips the events already seen.
+func (s *StepFunctions) follow(ctx context.Context, startTail func(*sfnTask)) error {
+	var last int64
+	for {
+		var token *string
+		for {
+			res, err := s.api.GetExecutionHistoryWithContext(ctx, &sfn.GetExecutionHistoryInput{
+				ExecutionArn: aws.String(s.executionARN),
+				MaxResults:   aws.Int64(sfnHistoryPage),
+				NextToken:    token,
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("GetExecutionHistory, %s: %w", s.executionName(), err)
+			}
+			for _, e := range res.Events {
+				if id := aws.Int64Value(e.Id); id > last {
+					last = id
+					if t := s.observe(e); t != nil {
+						startTail(t)
+					}
+				}
+			}
+			if token = res.NextToken; token == nil {
+				break
+			}
+		}
+		if s.status != sfnRunning {
+			return nil
+		}
+		if err := sleepContext(ctx, s.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// observe prints a history event and records it, and returns the Lambda task it schedules if any
+func (s *StepFunctions) observe(e *sfn.HistoryEvent) *sfnTask {
+	if s.stateOf == nil {
+		s.entered = make(map[string]int)
+		s.stateOf = make(map[int64]string)
+		s.taskOf = make(map[int64]*sfnTask)
+	}
+	id, prev := aws.Int64Value(e.Id), aws.Int64Value(e.PreviousEventId)
+	at := aws.TimeValue(e.Timestamp)
+	state := s.stateOf[prev]
+	task := s.taskOf[prev]
+	var scheduled *sfnTask
+
+	switch {
+	case e.StateEnteredEventDetails != nil:
+		state = aws.StringValue(e.StateEnteredEventDetails.Name)
+		s.entered[state] = len(s.states)
+		s.states = append(s.states, schema.StepFunctionsState{Name: state, Entered: at, Status: "running"})
+		logger.Infof("state %s entered", state)
+	case e.StateExitedEventDetails != nil:
+		state = aws.StringValue(e.StateExitedEventDetails.Name)
+		if i, ok := s.entered[state]; ok {
+			st := &s.states[i]
+			st.Duration = at.Sub(st.Entered)
+			if st.Status == "running" {
+				st.Status = "succeeded"
+			}
+			logger.Infof("state %s exited in %s", state, st.Duration.Round(time.Millisecond))
+		}
+	case e.TaskScheduledEventDetails != nil && aws.StringValue(e.TaskScheduledEventDetails.ResourceType) == "lambda":
+		d := e.TaskScheduledEventDetails
+		var params struct {
+			FunctionName string `json:"FunctionName"`
+		}
+		if err := json.Unmarshal([]byte(aws.StringValue(d.Parameters)), &params); err != nil || params.FunctionName == "" {
+			logger.Warnf("the function of state %s is unknown, its logs are not tailed", state)
+			break
+		}
+		task = s.newTask(state, params.FunctionName, aws.StringValue(d.Region), at)
+		scheduled = task
+	case e.LambdaFunctionScheduledEventDetails != nil:
+		task = s.newTask(state, aws.StringValue(e.LambdaFunctionScheduledEventDetails.Resource), "", at)
+		scheduled = task
+	case e.TaskSucceededEventDetails != nil, e.LambdaFunctionSucceededEventDetails != nil:
+		if task != nil {
+			task.Status = "succeeded"
+		}
+	case e.ExecutionSucceededEventDetails != nil:
+		s.status, s.output = "SUCCEEDED", aws.StringValue(e.ExecutionSucceededEventDetails.Output)
+		logger.Infof("execution %s succeeded", s.executionName())
+	default:
+		errName, cause, kind, ok := historyFailure(e)
+		if !ok {
+			break
+		}
+		if kind != "" {
+			s.status, s.errorName, s.cause = kind, errName, cause
+			logger.Warnf("execution %s is %s%s", s.executionName(), kind, s.failure())
+			break
+		}
+		if task != nil {
+			task.Status = "failed"
+		}
+		if i, ok := s.entered[state]; ok {
+			s.states[i].Status = "failed"
+		}
+		logger.Warnf("state %s failed, %s: %s", state, errName, cause)
+	}
+	s.stateOf[id] = state
+	if task != nil {
+		s.taskOf[id] = task
+	}
+	return scheduled
+}
+
+// newTask records a Lambda task of the state, whose function is a name or an ARN. It returns nil
+// if the function is not a Lambda function reference.
+func (s *StepFunctions) newTask(state, function, region string, scheduled time.Time) *sfnTask {
+	ref, err := ParseFunctionRef(function)
+	if err != nil {
+		logger.Warnf("the function of state %s is not tailed: %s", state, err)
+		return nil
+	}
+	if ref.Region != "" {
+		region = ref.Region
+	}
+	if region == "" {
+		region = s.machine.Region
+	}
+	t := &sfnTask{
+		StepFunctionsTask: schema.StepFunctionsTask{State: state, FunctionName: ref.Name, Status: "scheduled"},
+		ref:               ref,
+		region:            region,
+		scheduled:         scheduled,
+	}
+	s.tasks = append(s.tasks, t)
+	// a task scheduled again is a retry of a failure
+	if i, ok := s.entered[state]; ok {
+		s.states[i].Status = "running"
+	}
+	logger.Infof("state %s invokes %s", state, ref.Name)
+	return t
+}
+
+// historyFailure returns the error and the cause of a failure event. kind is the status of the
+// execution if the event ends it, "" if it is a failure of a state.
+func historyFailure(e *sfn.HistoryEvent) (errName, cause, kind string, ok bool) {
+	switch {
+	case e.ExecutionFailedEventDetails != nil:
+		return aws.StringValue(e.ExecutionFailedEventDetails.Error), aws.StringValue(e.ExecutionFailedEventDetails.Cause), "FAILED", true
+	case e.ExecutionTimedOutEventDetails != nil:
+		return aws.StringValue(e.ExecutionTimedOutEventDetails.Error), aws.StringValue(e.ExecutionTimedOutEventDetails.Cause), "TIMED_OUT", true
+	case e.ExecutionAbortedEventDetails != nil:
+		return aws.StringValue(e.ExecutionAbortedEventDetails.Error), aws.StringValue(e.ExecutionAbortedEventDetails.Cause), "ABORTED", true
+	case e.TaskFailedEventDetails != nil:
+		return aws.StringValue(e.TaskFailedEventDetails.Error), aws.StringValue(e.TaskFailedEventDetails.Cause), "", true
+	case e.TaskTimedOutEventDetails != nil:
+		return aws.StringValue(e.TaskTimedOutEventDetails.Error), aws.StringValue(e.TaskTimedOutEventDetails.Cause), "", true
+	case e.TaskStartFailedEventDetails != nil:
+		return aws.StringValue(e.TaskStartFailedEventDetails.Error), aws.StringValue(e.TaskStartFailedEventDetails.Cause), "", true
+	case e.TaskSubmitFailedEventDetails != nil:
+		return aws.StringValue(e.TaskSubmitFailedEventDetails.Error), aws.StringValue(e.TaskSubmitFailedEventDetails.Cause), "", true
+	case e.LambdaFunctionFailedEventDetails != nil:
+		return aws.StringValue(e.LambdaFunctionFailedEventDetails.Error), aws.StringValue(e.LambdaFunctionFailedEventDetails.Cause), "", true
+	case e.LambdaFunctionTimedOutEventDetails != nil:
+		return aws.StringValue(e.LambdaFunctionTimedOutEventDetails.Error), aws.StringValue(e.LambdaFunctionTimedOutEventDetails.Cause), "", true
+	case e.LambdaFunctionStartFailedEventDetails != nil:
+		return aws.StringValue(e.LambdaFunctionStartFailedEventDetails.Error), aws.StringValue(e.LambdaFunctionStartFailedEventDetails.Cause), "", true
+	case e.LambdaFunctionScheduleFailedEventDetails != nil:
+		return aws.StringValue(e.LambdaFunctionScheduleFailedEventDetails.Error), aws.StringValue(e.LambdaFunctionScheduleFailedEventDetails.Cause), "", true
+	case e.ActivityFailedEventDetails != nil:
+		return aws.StringValue(e.ActivityFailedEventDetails.Error), aws.StringValue(e.ActivityFailedEventDetails.Cause), "", true
+	case e.ActivityTimedOutEventDetails != nil:
+		return aws.StringValue(e.ActivityTimedOutEventDetails.Error), aws.StringValue(e.ActivityTimedOutEventDetails.Cause), "", true
+	}
+	return "", "", "", false
+}
+
+// tail tails the log group of the function of the task by the tail of AWS Lambda, which follows
+// the first START after the task is scheduled. Tasks of the same function running at once, as in
+// a Map state, may be told apart wrongly.
+func (s *StepFunctions) tail(ctx context.Context, t *sfnTask) {
+	b := newBus()
+	b.subscribe("step-functions", taskEvents{s}, subscribeOptions{})
+	tl := &AWSServerless{
+		funcName:           t.ref.Name,
+		ref:                t.ref,
+		region:             t.region,
+		logGroupName:       t.ref.LogGroup(),
+		startTime:          t.scheduled,
+		logClient:          s.logClient(t.region),
+		emitter:            s.emitter,
+		bus:                b,
+		summary:            newSummaryBuilder(),
+		phases:             newPhaseTracker(t.scheduled),
+		limits:             s.limits,
+		streamPrefixMargin: s.streamPrefixMargin,
+	}
+	err := tl.logTail(ctx, tl.logGroupName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.RequestID, t.InvocationState = tl.requestID, tl.invocationState.String()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Warnf("the logs of %s of state %s are incomplete, %s", t.FunctionName, t.State, err)
+	}
+}
+
+// taskEvents forwards the events of the tail of a task to the bus of the execution
+type taskEvents struct {
+	s *StepFunctions
+}
+
+func (f taskEvents) handle(ev busEvent) error {
+	if _, ok := ev.(runCompleted); ok {
+		return nil
+	}
+	f.s.publish(ev)
+	return nil
+}
+
+// publish publishes the event, one at a time since the subscribers are not safe for concurrent use
+func (s *StepFunctions) publish(ev busEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := ev.(logEvent); ok {
+		s.received++
+	}
+	s.bus.publish(ev)
+}
+
+// interrupt stops following the execution, and stops it with -cancel-execution
+func (s *StepFunctions) interrupt(cause error) error {
+	s.interrupted = true
+	name := s.executionName()
+	if !s.cancelExecution {
+		logger.Warnf("execution %s keeps running, %s", name, s.executionARN)
+		return fmt.Errorf("interrupted while following %s: %w", name, cause)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sfnStopWait)
+	defer cancel()
+	_, err := s.api.StopExecutionWithContext(ctx, &sfn.StopExecutionInput{
+		ExecutionArn: aws.String(s.executionARN),
+		Error:        aws.String("Interrupted"),
+		Cause:        aws.String("the run of k8s-nodeless is interrupted"),
+	})
+	if err != nil {
+		return fmt.Errorf("interrupted while following %s, and StopExecution failed: %w", name, err)
+	}
+	s.stopRequested = true
+	logger.Warnf("execution %s is stopped", name)
+	return fmt.Errorf("interrupted while following %s: %w", name, cause)
+}
+
+// verdict returns the verdict of the run which ended with err
+func (s *StepFunctions) verdict(err error) verdict {
+	note := ""
+	if s.status != "" && s.status != sfnRunning {
+		note = fmt.Sprintf("%s in %s, %s, %s", s.status, s.duration.Round(time.Second), plural(len(s.states), "state"), plural(s.summary.errors(), "error"))
+	}
+	return formatVerdict(verdictInput{
+		Function: s.machine.Name,
+		Errors:   s.summary.errors(),
+		Note:     note,
+		Err:      err,
+	})
+}
+
+// logSummary logs the summary record of the execution and its states
+func (s *StepFunctions) logSummary(v verdict) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := schema.StepFunctionsSummary{
+		SchemaVersion:  schema.StepFunctionsSummaryVersion,
+		StateMachine:   s.machine.ARN,
+		ExecutionARN:   s.executionARN,
+		Status:         s.status,
+		Error:          s.errorName,
+		Cause:          s.cause,
+		Duration:       s.duration,
+		States:         s.states,
+		EventsReceived: s.received,
+		Interrupted:    s.interrupted,
+		StopRequested:  s.stopRequested,
+		RunCommon:      runCommon(v, s.integrity, s.goldenResult, s.goldenDiffs),
+	}
+	if summary.States == nil {
+		summary.States = []schema.StepFunctionsState{}
+	}
+	for _, t := range s.tasks {
+		summary.LambdaTasks = append(summary.LambdaTasks, t.StepFunctionsTask)
+	}
+	logger.Infow("summary", recordFields(summary)...)
+}
+
+// writePlan writes the plan of an execution of the state machine
+func (s *StepFunctions) writePlan(w io.Writer) error {
+	header := fmt.Sprintf("plan of %s in %s, nothing is called", s.machine.ARN, s.machine.Region)
+	steps := []step{{
+		name: "start-execution",
+		plan: s.planStart,
+	}, {
+		name: "follow",
+		plan: s.planFollow,
+	}, {
+		name: "tail-tasks",
+		plan: s.planTailTasks,
+	}, finishStep(s.githubStatus)}
+	if s.pushgateway != nil {
+		steps = append(steps, pushStep(s.pushgateway, s.pushgateway.groupingKey(s.machine.Name, "")))
+	}
+	return writePlan(w, header, steps)
+}
+
+func (s *StepFunctions) planStart() ([]plannedCall, error) {
+	params := []planParam{{"StateMachineArn", s.machine.ARN}}
+	if s.payload != "" {
+		params = append(params, planParam{"Input", fmt.Sprintf("%d bytes, sha256:%s", len(s.payload), s.integrity.sent)})
+	}
+	return []plannedCall{{Service: "states", Operation: "StartExecution", Params: params}}, nil
+}
+
+func (s *StepFunctions) planFollow() ([]plannedCall, error) {
+	ret := []plannedCall{{
+		Service:   "states",
+		Operation: "GetExecutionHistory",
+		Params:    []planParam{{"ExecutionArn", "the started execution"}, {"MaxResults", fmt.Sprint(sfnHistoryPage)}},
+		Note:      fmt.Sprintf("every %s from the start of the history until the execution ends", s.poll),
+	}}
+	if s.cancelExecution {
+		ret = append(ret, plannedCall{
+			Service:   "states",
+			Operation: "StopExecution",
+			Params:    []planParam{{"ExecutionArn", "the started execution"}},
+			Note:      "only if the run is interrupted, by -cancel-execution",
+		})
+	}
+	return ret, nil
+}
+
+func (s *StepFunctions) planTailTasks() ([]plannedCall, error) {
+	group := planParam{"LogGroupName", "the log group of the function of each Lambda task, in its region"}
+	return []plannedCall{{
+		Service:   "logs",
+		Operation: "DescribeLogStreams",
+		Params:    []planParam{group, {"OrderBy", "LastEventTime"}, {"Descending", "true"}},
+		Note:      fmt.Sprintf("every %s from when the task is scheduled until its END and REPORT, up to %s after the execution ends", s.limits.PollInterval, s.logGrace),
+	}, {
+		Service:   "logs",
+		Operation: "FilterLogEvents",
+		Params:    []planParam{group, {"LogStreamNames", "the updated streams"}},
+		Note:      "after each discovery",
+	}}, nil
+}
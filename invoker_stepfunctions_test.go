@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+func TestParseStateMachineARN(t *testing.T) {
+	m, err := parseStateMachineARN("arn:aws:states:us-east-1:123456789012:stateMachine:orders")
+	if err != nil || m.Region != "us-east-1" || m.Name != "orders" {
+		t.Errorf("got %+v, %v", m, err)
+	}
+	for _, s := range []string{
+		"arn:aws:states:us-east-1:123456789012:execution:orders:run",
+		"arn:aws:states::123456789012:stateMachine:orders",
+		"arn:aws:states:us-east-1:1234:stateMachine:orders",
+		"arn:aws:lambda:us-east-1:123456789012:function:orders",
+		"orders",
+	} {
+		if _, err := parseStateMachineARN(s); err == nil {
+			t.Errorf("%s must be an error", s)
+		}
+	}
+	if isStateMachineARN("arn:aws:lambda:us-east-1:123456789012:function:orders") {
+		t.Errorf("a function is not a state machine")
+	}
+}
+
+// fakeSFN serves a history which grows by a batch of events each poll, two events a page
+type fakeSFN struct {
+	mu      sync.Mutex
+	batches [][]*sfn.HistoryEvent
+	polls   int
+	input   string
+	stopped bool
+}
+
+func (f *fakeSFN) StartExecutionWithContext(ctx aws.Context, input *sfn.StartExecutionInput, opts ...request.Option) (*sfn.StartExecutionOutput, error) {
+	f.input = aws.StringValue(input.Input)
+	return &sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:aws:states:us-east-1:123456789012:execution:orders:run-1")}, nil
+}
+
+func (f *fakeSFN) GetExecutionHistoryWithContext(ctx aws.Context, input *sfn.GetExecutionHistoryInput, opts ...request.Option) (*sfn.GetExecutionHistoryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []*sfn.HistoryEvent
+	for i := 0; i <= f.polls && i < len(f.batches); i++ {
+		events = append(events, f.batches[i]...)
+	}
+	from, _ := strconv.Atoi(aws.StringValue(input.NextToken))
+	to := from + 2
+	if to >= len(events) {
+		f.polls++
+		return &sfn.GetExecutionHistoryOutput{Events: events[from:]}, nil
+	}
+	return &sfn.GetExecutionHistoryOutput{Events: events[from:to], NextToken: aws.String(strconv.Itoa(to))}, nil
+}
+
+func (f *fakeSFN) StopExecutionWithContext(ctx aws.Context, input *sfn.StopExecutionInput, opts ...request.Option) (*sfn.StopExecutionOutput, error) {
+	f.stopped = true
+	return &sfn.StopExecutionOutput{}, nil
+}
+
+// historyEvent returns the event id following prev at the time, whose details fill sets
+func historyEvent(id, prev int64, at time.Time, fill func(e *sfn.HistoryEvent)) *sfn.HistoryEvent {
+	e := &sfn.HistoryEvent{Id: aws.Int64(id), PreviousEventId: aws.Int64(prev), Timestamp: aws.Time(at)}
+	fill(e)
+	return e
+}
+
+func newTestStepFunctions(t *testing.T, api sfnAPI, logs logsAPI) *StepFunctions {
+	t.Helper()
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBus()
+	summary := newSummaryBuilder()
+	b.subscribe("console", em, subscribeOptions{})
+	b.subscribe("summary", summary, subscribeOptions{})
+	machine, _ := parseStateMachineARN("arn:aws:states:us-east-1:123456789012:stateMachine:orders")
+	return &StepFunctions{
+		machine:   machine,
+		payload:   `{"id": 1}`,
+		api:       api,
+		logClient: func(string) logsAPI { return logs },
+		poll:      10 * time.Millisecond,
+		logGrace:  5 * time.Second,
+		emitter:   em,
+		bus:       b,
+		summary:   summary,
+		integrity: newPayloadIntegrity(`{"id": 1}`),
+	}
+}
+
+func TestStepFunctionsInvoke(t *testing.T) {
+	observed := setTestLogger(t)
+	start := time.Now().Add(-time.Minute)
+	api := &fakeSFN{batches: [][]*sfn.HistoryEvent{{
+		historyEvent(1, 0, start, func(e *sfn.HistoryEvent) { e.ExecutionStartedEventDetails = &sfn.ExecutionStartedEventDetails{} }),
+		historyEvent(2, 1, start, func(e *sfn.HistoryEvent) {
+			e.StateEnteredEventDetails = &sfn.StateEnteredEventDetails{Name: aws.String("Validate")}
+		}),
+		historyEvent(3, 2, start.Add(time.Second), func(e *sfn.HistoryEvent) {
+			e.StateExitedEventDetails = &sfn.StateExitedEventDetails{Name: aws.String("Validate")}
+		}),
+	}, {
+		historyEvent(4, 3, start.Add(time.Second), func(e *sfn.HistoryEvent) {
+			e.StateEnteredEventDetails = &sfn.StateEnteredEventDetails{Name: aws.String("Process")}
+		}),
+		historyEvent(5, 4, start.Add(time.Second), func(e *sfn.HistoryEvent) {
+			e.TaskScheduledEventDetails = &sfn.TaskScheduledEventDetails{
+				ResourceType: aws.String("lambda"),
+				Resource:     aws.String("invoke"),
+				Region:       aws.String("us-east-1"),
+				Parameters:   aws.String(`{"FunctionName":"arn:aws:lambda:us-east-1:123456789012:function:worker:$LATEST","Payload":{"id":1}}`),
+			}
+		}),
+		historyEvent(6, 5, start.Add(2*time.Second), func(e *sfn.HistoryEvent) {
+			e.TaskSucceededEventDetails = &sfn.TaskSucceededEventDetails{Output: aws.String(`{"Payload":{"ok":true}}`)}
+		}),
+	}, {
+		historyEvent(7, 6, start.Add(3*time.Second), func(e *sfn.HistoryEvent) {
+			e.StateExitedEventDetails = &sfn.StateExitedEventDetails{Name: aws.String("Process")}
+		}),
+		historyEvent(8, 7, start.Add(3*time.Second), func(e *sfn.HistoryEvent) {
+			e.ExecutionSucceededEventDetails = &sfn.ExecutionSucceededEventDetails{Output: aws.String(`{"ok":true}`)}
+		}),
+	}}}
+
+	startMs := aws.TimeUnixMilli(start)
+	logs := &windowedLogs{}
+	for i, msg := range []string{
+		"START RequestId: req-1 Version: $LATEST",
+		"processing 1",
+		"END RequestId: req-1",
+		"REPORT RequestId: req-1\tDuration: 812.00 ms\tBilled Duration: 813 ms\tMemory Size: 128 MB\tMax Memory Used: 64 MB",
+	} {
+		logs.events = append(logs.events, &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(fmt.Sprint(i)),
+			Message:       aws.String(msg),
+			LogStreamName: aws.String("stream"),
+			Timestamp:     aws.Int64(startMs + 1500 + int64(i)),
+			IngestionTime: aws.Int64(aws.TimeUnixMilli(time.Now())),
+		})
+	}
+
+	s := newTestStepFunctions(t, api, logs)
+	if err := s.Invoke(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if api.input != `{"id": 1}` {
+		t.Errorf("the payload is the input, got %s", api.input)
+	}
+	if s.status != "SUCCEEDED" || s.output != `{"ok":true}` {
+		t.Errorf("got %s %s", s.status, s.output)
+	}
+	if len(s.states) != 2 || s.states[0].Name != "Validate" || s.states[0].Duration != time.Second || s.states[1].Status != "succeeded" {
+		t.Errorf("got %+v", s.states)
+	}
+	if len(s.tasks) != 1 {
+		t.Fatalf("got %d tasks", len(s.tasks))
+	}
+	task := s.tasks[0].StepFunctionsTask
+	if task.State != "Process" || task.FunctionName != "worker" || task.RequestID != "req-1" || task.InvocationState != "Reported" || task.Status != "succeeded" {
+		t.Errorf("got %+v", task)
+	}
+	if s.received != 4 {
+		t.Errorf("the lines of the task are published, got %d", s.received)
+	}
+	if n := observed.FilterMessage("output").Len(); n != 1 {
+		t.Errorf("the output must be logged once, got %d", n)
+	}
+}
+
+func TestStepFunctionsRetriedState(t *testing.T) {
+	setTestLogger(t)
+	s := newTestStepFunctions(t, &fakeSFN{}, &windowedLogs{})
+	at := time.Now()
+	scheduled := func(e *sfn.HistoryEvent) {
+		e.LambdaFunctionScheduledEventDetails = &sfn.LambdaFunctionScheduledEventDetails{Resource: aws.String("arn:aws:lambda:us-west-2:123456789012:function:worker")}
+	}
+	failed := func(e *sfn.HistoryEvent) {
+		e.LambdaFunctionFailedEventDetails = &sfn.LambdaFunctionFailedEventDetails{Error: aws.String("Lambda.Unknown")}
+	}
+	var tails []*sfnTask
+	for _, e := range []*sfn.HistoryEvent{
+		historyEvent(1, 0, at, func(e *sfn.HistoryEvent) {
+			e.StateEnteredEventDetails = &sfn.StateEnteredEventDetails{Name: aws.String("Process")}
+		}),
+		historyEvent(2, 1, at, scheduled),
+		historyEvent(3, 2, at, failed),
+		historyEvent(4, 3, at, scheduled),
+		historyEvent(5, 4, at, func(e *sfn.HistoryEvent) {
+			e.LambdaFunctionSucceededEventDetails = &sfn.LambdaFunctionSucceededEventDetails{}
+		}),
+		historyEvent(6, 5, at, func(e *sfn.HistoryEvent) {
+			e.StateExitedEventDetails = &sfn.StateExitedEventDetails{Name: aws.String("Process")}
+		}),
+	} {
+		if task := s.observe(e); task != nil {
+			tails = append(tails, task)
+		}
+	}
+	if len(tails) != 2 || tails[0].Status != "failed" || tails[1].Status != "succeeded" || tails[0].region != "us-west-2" {
+		t.Errorf("each attempt is a task, got %+v", tails)
+	}
+	if s.states[0].Status != "succeeded" {
+		t.Errorf("a state retried to success succeeds, got %s", s.states[0].Status)
+	}
+}
+
+func TestStepFunctionsFailed(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeSFN{batches: [][]*sfn.HistoryEvent{{
+		historyEvent(1, 0, time.Now(), func(e *sfn.HistoryEvent) {
+			e.ExecutionFailedEventDetails = &sfn.ExecutionFailedEventDetails{Error: aws.String("States.TaskFailed"), Cause: aws.String("boom")}
+		}),
+	}}}
+	s := newTestStepFunctions(t, api, &windowedLogs{})
+	err := s.Invoke(context.Background())
+	var fe *functionError
+	if !errors.As(err, &fe) || s.status != "FAILED" {
+		t.Fatalf("a failed execution is a function error, got %v", err)
+	}
+	if want := "execution run-1 is FAILED, States.TaskFailed: boom"; err.Error() != want {
+		t.Errorf("got %s", err)
+	}
+}
+
+func TestStepFunctionsInterrupt(t *testing.T) {
+	setTestLogger(t)
+	for _, cancelExecution := range []bool{false, true} {
+		api := &fakeSFN{}
+		s := newTestStepFunctions(t, api, &windowedLogs{})
+		s.cancelExecution = cancelExecution
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := s.Invoke(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || !s.interrupted {
+			t.Errorf("got %v", err)
+		}
+		if api.stopped != cancelExecution || s.stopRequested != cancelExecution {
+			t.Errorf("-cancel-execution %v: stopped %v", cancelExecution, api.stopped)
+		}
+	}
+}
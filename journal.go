@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// journalVersion is the version of the journal file format
+const journalVersion = schema.JournalVersion
+
+const (
+	journalStaleLock = time.Minute           // a lock older than this is left by a process which died
+	journalLockPoll  = 10 * time.Millisecond // how often a waiting process checks the lock
+)
+
+// journalEntry is a mutation of cloud state made by this tool. Its kind is the key of the reversers.
+type journalEntry = schema.JournalEntry
+
+type journalFile = schema.JournalFile
+
+// journal records mutations in a local file so that they can be reverted by the cleanup command
+// even if the process is killed. Concurrent invocations of this tool share the file, whose
+// read-modify-write is serialized by a lock file next to it.
+type journal struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+// defaultJournalPath returns the default path of the journal file
+func defaultJournalPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".k8s-nodeless", "journal.json")
+}
+
+func (j *journal) load() (*journalFile, error) {
+	buf, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return &journalFile{Version: journalVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f journalFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, fmt.Errorf("journal %s: %w", j.path, err)
+	}
+	if f.Version != journalVersion {
+		return nil, fmt.Errorf("journal %s: unsupported version %d", j.path, f.Version)
+	}
+	return &f, nil
+}
+
+// save writes the journal. The file is renamed into place, so that a reader never sees a partial one.
+func (j *journal) save(f *journalFile) error {
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".*.tmp") // 0600
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// lock takes the lock of the journal, which only one process holds, waiting for another process
+// which holds it until ctx is done. A lock older than journalStaleLock is taken over.
+func (j *journal) lock(ctx context.Context) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return nil, err
+	}
+	path := j.path + ".lock"
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			held, err := f.Stat()
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { removeLock(path, held) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > journalStaleLock {
+			takeOverLock(path, info)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("journal: %s is held by another process: %w", path, ctx.Err())
+		case <-time.After(journalLockPoll):
+		}
+	}
+}
+
+// takeOverLock removes the stale lock of path, which was stale as stat. Another waiter may have
+// taken it over and locked again since, so the lock is renamed aside first, and a lock which is not
+// the stale one is put back.
+func takeOverLock(path string, stale os.FileInfo) {
+	aside := fmt.Sprintf("%s.%d-%d.stale", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		return // taken over by another waiter, or released
+	}
+	// the inode of a removed lock may be reused by the next one, whose time differs
+	if info, err := os.Stat(aside); err == nil && !(os.SameFile(info, stale) && info.ModTime().Equal(stale.ModTime())) {
+		os.Link(aside, path) // fails only if yet another waiter locked in between
+		os.Remove(aside)
+		return
+	}
+	logger.Warnf("journal: %s is left since %s, it is taken over", path, stale.ModTime())
+	os.Remove(aside)
+}
+
+// removeLock releases the lock of path which is held, unless it was taken over as stale
+func removeLock(path string, held os.FileInfo) {
+	if info, err := os.Stat(path); err == nil && os.SameFile(info, held) && info.ModTime().Equal(held.ModTime()) {
+		os.Remove(path)
+	}
+}
+
+// record adds the mutation to the journal. It must be called before the mutating API call.
+func (j *journal) record(ctx context.Context, e journalEntry) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	unlock, err := j.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	f, err := j.load()
+	if err != nil {
+		return "", err
+	}
+	if e.ID == "" {
+		e.ID = fmt.Sprintf("%s-%d", e.Kind, time.Now().UnixNano())
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	f.Entries = append(f.Entries, e)
+	return e.ID, j.save(f)
+}
+
+// markReverted removes the entry, which is reverted, with any other entry marked reverted by an
+// older version, so that the journal keeps only what is left to revert
+func (j *journal) markReverted(ctx context.Context, id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	unlock, err := j.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := j.load()
+	if err != nil {
+		return err
+	}
+	entries := f.Entries[:0]
+	for _, e := range f.Entries {
+		if e.ID != id && !e.Reverted {
+			entries = append(entries, e)
+		}
+	}
+	f.Entries = entries
+	return j.save(f)
+}
+
+// outstanding returns entries which are not reverted yet
+func (j *journal) outstanding() ([]journalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	var ret []journalEntry
+	for _, e := range f.Entries {
+		if !e.Reverted {
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
+
+// reverser reverts a kind of mutation. Both methods must be idempotent.
+type reverser interface {
+	// changed reports whether the resource is still in the mutated state
+	changed(ctx context.Context, e journalEntry) (bool, error)
+	// revert restores the previous state
+	revert(ctx context.Context, e journalEntry) error
+}
+
+// cleanupJournal reverts outstanding entries. An entry which fails to revert is kept
+// in the journal to be retried, and the first error is returned after all entries are tried.
+func cleanupJournal(ctx context.Context, j *journal, reversers map[string]reverser, confirm func(journalEntry) bool) error {
+	entries, err := j.outstanding()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	fail := func(e journalEntry, err error) {
+		logger.Warnf("cleanup %s %s failed: %s", e.Kind, e.Resource, err)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("cleanup %s %s: %w", e.Kind, e.Resource, err)
+		}
+	}
+
+	for _, e := range entries {
+		r, ok := reversers[e.Kind]
+		if !ok {
+			fail(e, fmt.Errorf("unknown mutation type"))
+			continue
+		}
+		changed, err := r.changed(ctx, e)
+		if err != nil {
+			fail(e, err)
+			continue
+		}
+		if changed {
+			if !confirm(e) {
+				logger.Infof("cleanup %s %s is skipped", e.Kind, e.Resource)
+				continue
+			}
+			if err := r.revert(ctx, e); err != nil {
+				fail(e, err)
+				continue
+			}
+			logger.Infof("%s %s is reverted", e.Kind, e.Resource)
+		} else {
+			logger.Infof("%s %s is already in the previous state", e.Kind, e.Resource)
+		}
+		if err := j.markReverted(ctx, e.ID); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
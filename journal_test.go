@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type fakeReverser struct {
+	changedErr map[string]error
+	revertErr  map[string]error
+	reverted   []string
+}
+
+func (f *fakeReverser) changed(ctx context.Context, e journalEntry) (bool, error) {
+	if err := f.changedErr[e.Resource]; err != nil {
+		return false, err
+	}
+	return e.Resource != "already-reverted", nil
+}
+
+func (f *fakeReverser) revert(ctx context.Context, e journalEntry) error {
+	if err := f.revertErr[e.Resource]; err != nil {
+		return err
+	}
+	f.reverted = append(f.reverted, e.Resource)
+	return nil
+}
+
+func newTestJournal(t *testing.T) (*journal, func()) {
+	t.Helper()
+	logger = zap.NewNop().Sugar()
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newJournal(filepath.Join(dir, "sub", "journal.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestCleanupJournalPartialFailure(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	for _, res := range []string{"ok", "fail", "already-reverted", "check-fail"} {
+		if _, err := j.record(context.Background(), journalEntry{Kind: "test", Resource: res}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := j.record(context.Background(), journalEntry{Kind: "unknown", Resource: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeReverser{
+		changedErr: map[string]error{"check-fail": errors.New("throttled")},
+		revertErr:  map[string]error{"fail": errors.New("access denied")},
+	}
+	reversers := map[string]reverser{"test": fake}
+	yes := func(journalEntry) bool { return true }
+
+	if err := cleanupJournal(context.Background(), j, reversers, yes); err == nil {
+		t.Error("error expected")
+	}
+	if len(fake.reverted) != 1 || fake.reverted[0] != "ok" {
+		t.Errorf("reverted: %v", fake.reverted)
+	}
+	left, err := j.outstanding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 3 {
+		t.Errorf("outstanding: %+v", left)
+	}
+
+	// retry after the failures are resolved
+	fake.changedErr = nil
+	fake.revertErr = nil
+	delete(reversers, "unknown")
+	reversers["unknown"] = fake
+	if err := cleanupJournal(context.Background(), j, reversers, yes); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.reverted) != 4 {
+		t.Errorf("reverted: %v", fake.reverted)
+	}
+	if left, _ := j.outstanding(); len(left) != 0 {
+		t.Errorf("outstanding: %+v", left)
+	}
+	// the reverted entries are pruned, the journal does not grow
+	if f, err := j.load(); err != nil || len(f.Entries) != 0 {
+		t.Errorf("got %+v %v", f, err)
+	}
+}
+
+func TestCleanupJournalDeclined(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	if _, err := j.record(context.Background(), journalEntry{Kind: "test", Resource: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeReverser{}
+	no := func(journalEntry) bool { return false }
+	if err := cleanupJournal(context.Background(), j, map[string]reverser{"test": fake}, no); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.reverted) != 0 {
+		t.Errorf("reverted: %v", fake.reverted)
+	}
+	if left, _ := j.outstanding(); len(left) != 1 {
+		t.Errorf("declined entry should be kept: %+v", left)
+	}
+}
+
+func TestJournalVersion(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	os.MkdirAll(filepath.Dir(j.path), 0700)
+	if err := ioutil.WriteFile(j.path, []byte(`{"version": 99, "entries": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.outstanding(); err == nil {
+		t.Error("unsupported version should be rejected")
+	}
+}
+
+func TestJournalConcurrentWriters(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	// two invocations of the tool, each with its own journal of the same file
+	const writes = 20
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			writer := newJournal(j.path)
+			for i := 0; i < writes; i++ {
+				if _, err := writer.record(context.Background(), journalEntry{Kind: "env", Resource: fmt.Sprintf("writer-%d-%d", w, i)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	entries, err := j.outstanding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2*writes {
+		t.Errorf("%d entries, want %d", len(entries), 2*writes)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(j.path)); len(files) != 1 {
+		t.Errorf("a temp or lock file is left, got %d files", len(files))
+	}
+}
+
+func TestJournalStaleLock(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	os.MkdirAll(filepath.Dir(j.path), 0700)
+	lock := j.path + ".lock"
+	if err := ioutil.WriteFile(lock, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * journalStaleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.record(context.Background(), journalEntry{Kind: "env", Resource: "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("the lock is left, %v", err)
+	}
+}
+
+func TestJournalLockWait(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	unlock, err := j.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := newJournal(j.path).record(ctx, journalEntry{Kind: "env", Resource: "f"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a held lock must be waited for until ctx is done, got %v", err)
+	}
+	unlock()
+	if _, err := j.record(context.Background(), journalEntry{Kind: "env", Resource: "f"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalStaleLockTakenOverOnce(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	os.MkdirAll(filepath.Dir(j.path), 0700)
+	lock := j.path + ".lock"
+	if err := ioutil.WriteFile(lock, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * journalStaleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// two waiters see the stale lock, the first one takes it over and locks
+	stale, err := os.Stat(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := j.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := os.Stat(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second one must not take over the fresh lock
+	takeOverLock(lock, stale)
+	if info, err := os.Stat(lock); err != nil || !os.SameFile(info, held) {
+		t.Fatalf("the fresh lock is taken over, %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(j.path)); len(files) != 1 {
+		t.Errorf("the renamed lock is left, got %d files", len(files))
+	}
+	unlock()
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("the lock is left, %v", err)
+	}
+}
+
+func TestJournalPrunesReverted(t *testing.T) {
+	j, done := newTestJournal(t)
+	defer done()
+
+	// an entry marked reverted by an older version is pruned too
+	os.MkdirAll(filepath.Dir(j.path), 0700)
+	if err := ioutil.WriteFile(j.path, []byte(`{"version": 1, "entries": [{"id": "old", "kind": "env", "reverted": true}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 2)
+	for i := range ids {
+		id, err := j.record(context.Background(), journalEntry{Kind: "env", Resource: fmt.Sprintf("f%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	if err := j.markReverted(context.Background(), ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	f, err := j.load()
+	if err != nil || len(f.Entries) != 1 || f.Entries[0].ID != ids[1] {
+		t.Errorf("got %+v %v", f, err)
+	}
+}
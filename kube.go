@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeAPITimeout        = 30 * time.Second
+)
+
+// kubeAPI calls the Kubernetes API of the cluster the pod runs in, with the token of its service account
+type kubeAPI struct {
+	baseURL   string // ex: https://10.0.0.1:443
+	tokenFile string // read every time, since a bound token is rotated by kubelet
+	namespace string // of the pod
+	client    *http.Client
+}
+
+// newInClusterKubeAPI returns the API of the cluster from the environment of a pod
+func newInClusterKubeAPI(getenv func(string) string) (*kubeAPI, error) {
+	host, port := getenv("KUBERNETES_SERVICE_HOST"), getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not in a Kubernetes cluster, KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("service account: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("service account: no certificate in ca.crt")
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(kubeServiceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("service account: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &kubeAPI{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(kubeServiceAccountDir, "token"),
+		namespace: strings.TrimSpace(string(namespace)),
+		// no timeout of the client, a log stream lasts as long as the run
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// do sends the request and returns the response of a 200 status
+func (k *kubeAPI) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := k.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("service account: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &status) == nil && status.Message != "" {
+			return nil, &kubeError{code: resp.StatusCode, message: status.Message}
+		}
+		return nil, &kubeError{code: resp.StatusCode, message: truncateMiddle(string(body), 512)}
+	}
+	return resp, nil
+}
+
+// get decodes the object at the path into out
+func (k *kubeAPI) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, kubeAPITimeout)
+	defer cancel()
+	resp, err := k.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// kubeError is an error status of the Kubernetes API
+type kubeError struct {
+	code    int
+	message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes api %d: %s", e.code, e.message)
+}
+
+// kubePod is the part of a pod used to stream its logs
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// listPods returns the pods of the label selector
+func (k *kubeAPI) listPods(ctx context.Context, namespace, selector string) ([]kubePod, error) {
+	var list struct {
+		Items []kubePod `json:"items"`
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	if err := k.get(ctx, path, url.Values{"labelSelector": {selector}}, &list); err != nil {
+		return nil, fmt.Errorf("list pods of %s: %w", selector, err)
+	}
+	return list.Items, nil
+}
+
+// kubeLogLine is a line of the log of a container
+type kubeLogLine struct {
+	Timestamp time.Time
+	Message   string
+}
+
+// streamLogs follows the log of the container since the time, and calls fn for each line until
+// the log ends or ctx is done
+func (k *kubeAPI) streamLogs(ctx context.Context, namespace, pod, container string, since time.Time, fn func(kubeLogLine)) error {
+	query := url.Values{
+		"container":  {container},
+		"follow":     {"true"},
+		"timestamps": {"true"},
+		"sinceTime":  {since.UTC().Format(time.RFC3339)},
+	}
+	resp, err := k.do(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(pod)+"/log", query)
+	if err != nil {
+		return fmt.Errorf("logs of %s/%s: %w", pod, container, err)
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		fn(parseKubeLogLine(sc.Text()))
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("logs of %s/%s: %w", pod, container, err)
+	}
+	return nil
+}
+
+// parseKubeLogLine splits the timestamp which timestamps=true prefixes to a line
+func parseKubeLogLine(s string) kubeLogLine {
+	if i := strings.IndexByte(s, ' '); i > 0 {
+		if ts, err := time.Parse(time.RFC3339Nano, s[:i]); err == nil {
+			return kubeLogLine{Timestamp: ts, Message: s[i+1:]}
+		}
+	}
+	return kubeLogLine{Timestamp: time.Now(), Message: s}
+}
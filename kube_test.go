@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKubeLogLine(t *testing.T) {
+	l := parseKubeLogLine("2026-10-16T01:02:03.123456789Z order 1 accepted")
+	if l.Message != "order 1 accepted" || l.Timestamp.Nanosecond() != 123456789 {
+		t.Errorf("got %+v", l)
+	}
+	if l := parseKubeLogLine("no timestamp"); l.Message != "no timestamp" {
+		t.Errorf("got %+v", l)
+	}
+}
+
+func TestKubeAPI(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("sa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/fn/pods":
+			if r.URL.Query().Get("labelSelector") != "app=a" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"kind": "Status", "message": "pods is forbidden: User \"system:serviceaccount:ci:runner\" cannot list resource \"pods\""}`)
+				return
+			}
+			fmt.Fprint(w, `{"items": [{"metadata": {"name": "a-1"}, "spec": {"containers": [{"name": "user-container"}]}, "status": {"phase": "Running"}}]}`)
+		case "/api/v1/namespaces/fn/pods/a-1/log":
+			q := r.URL.Query()
+			if q.Get("follow") != "true" || q.Get("container") != "user-container" || q.Get("sinceTime") != "2026-10-16T01:02:03Z" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "2026-10-16T01:02:03.5Z one\n2026-10-16T01:02:04Z two\n")
+		}
+	}))
+	defer ts.Close()
+
+	k := &kubeAPI{baseURL: ts.URL, tokenFile: tokenFile, namespace: "fn", client: ts.Client()}
+	pods, err := k.listPods(context.Background(), "fn", "app=a")
+	if err != nil || len(pods) != 1 || pods[0].Metadata.Name != "a-1" || pods[0].Spec.Containers[0].Name != "user-container" {
+		t.Errorf("got %+v, %v", pods, err)
+	}
+	if _, err := k.listPods(context.Background(), "fn", "app=b"); err == nil || !strings.Contains(err.Error(), "403: pods is forbidden") {
+		t.Errorf("got %v", err)
+	}
+
+	var lines []string
+	since := time.Date(2026, 10, 16, 1, 2, 3, 400000000, time.UTC)
+	err = k.streamLogs(context.Background(), "fn", "a-1", "user-container", since, func(l kubeLogLine) { lines = append(lines, l.Message) })
+	if err != nil || strings.Join(lines, ",") != "one,two" {
+		t.Errorf("got %v, %v", lines, err)
+	}
+}
+
+func TestNewInClusterKubeAPI(t *testing.T) {
+	if _, err := newInClusterKubeAPI(func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), "not in a Kubernetes cluster") {
+		t.Errorf("got %v", err)
+	}
+}
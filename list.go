@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	maxMetricQueries       = 500 // limit of GetMetricData queries per call
+	defaultMaxMetricsFuncs = 1000
+)
+
+// functionInfo is a row of the list subcommand
+type functionInfo = schema.FunctionInfo
+
+// runList runs the list subcommand
+func runList(args []string) error {
+	var region string
+	var withErrors bool
+	var since time.Duration
+	var maxFuncs int
+	var jsonOutput bool
+	var prefix string
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.StringVar(&region, "region", "", "AWS region")
+	fs.BoolVar(&withErrors, "with-errors", false, "join Errors and Invocations metrics and sort by errors")
+	fs.DurationVar(&since, "since", 24*time.Hour, "metrics window for -with-errors")
+	fs.IntVar(&maxFuncs, "max-functions", defaultMaxMetricsFuncs, "max number of functions to fetch metrics for")
+	fs.BoolVar(&jsonOutput, "json", false, "output JSON")
+	fs.StringVar(&prefix, "prefix", "", "list only the functions whose names start with the prefix")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{})
+	defer logger.Sync()
+
+	awsOpts, err := newAWSSessionOptions(region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	ctx := context.Background()
+
+	funcs, err := listFunctions(ctx, lambda.New(sess))
+	if err != nil {
+		return err
+	}
+	funcs = filterByPrefix(funcs, prefix)
+
+	if withErrors {
+		targets := funcs
+		if len(targets) > maxFuncs {
+			logger.Warnf("%d functions found, metrics are fetched only for the first %d", len(targets), maxFuncs)
+			targets = targets[:maxFuncs]
+		}
+		end := time.Now()
+		metrics, err := fetchFunctionMetrics(ctx, cloudwatch.New(sess), targets, end.Add(-since), end)
+		if err != nil {
+			return err
+		}
+		joinFunctionMetrics(targets, metrics)
+		sortByErrors(funcs)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(funcs)
+	}
+	printFunctionTable(funcs, withErrors)
+	return nil
+}
+
+// listFunctions returns all functions in the region
+func listFunctions(ctx context.Context, svc *lambda.Lambda) ([]functionInfo, error) {
+	var ret []functionInfo
+	fn := func(res *lambda.ListFunctionsOutput, lastPage bool) bool {
+		for _, f := range res.Functions {
+			ret = append(ret, functionInfo{
+				Name:         aws.StringValue(f.FunctionName),
+				Runtime:      aws.StringValue(f.Runtime),
+				MemorySize:   aws.Int64Value(f.MemorySize),
+				Timeout:      aws.Int64Value(f.Timeout),
+				LastModified: aws.StringValue(f.LastModified),
+			})
+		}
+		return true
+	}
+	if err := svc.ListFunctionsPagesWithContext(ctx, &lambda.ListFunctionsInput{}, fn); err != nil {
+		return nil, fmt.Errorf("ListFunctions: %w", err)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// filterByPrefix returns the functions whose names start with prefix, all of them if prefix is empty
+func filterByPrefix(funcs []functionInfo, prefix string) []functionInfo {
+	if prefix == "" {
+		return funcs
+	}
+	var ret []functionInfo
+	for _, f := range funcs {
+		if strings.HasPrefix(f.Name, prefix) {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// metricQueryID returns the GetMetricData query id of the metric of i-th function
+func metricQueryID(metricName string, i int) string {
+	if metricName == "Errors" {
+		return fmt.Sprintf("e%d", i)
+	}
+	return fmt.Sprintf("i%d", i)
+}
+
+// buildMetricQueries returns Errors and Invocations queries chunked by the API limit
+func buildMetricQueries(funcs []functionInfo, period int64) [][]*cloudwatch.MetricDataQuery {
+	var chunks [][]*cloudwatch.MetricDataQuery
+	var current []*cloudwatch.MetricDataQuery
+	for i, f := range funcs {
+		if len(current)+2 > maxMetricQueries {
+			chunks = append(chunks, current)
+			current = nil
+		}
+		for _, name := range []string{"Errors", "Invocations"} {
+			current = append(current, &cloudwatch.MetricDataQuery{
+				Id: aws.String(metricQueryID(name, i)),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String("AWS/Lambda"),
+						MetricName: aws.String(name),
+						Dimensions: []*cloudwatch.Dimension{
+							{Name: aws.String("FunctionName"), Value: aws.String(f.Name)},
+						},
+					},
+					Period: aws.Int64(period),
+					Stat:   aws.String("Sum"),
+				},
+			})
+		}
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// fetchFunctionMetrics returns the sum of each metric keyed by the query id
+func fetchFunctionMetrics(ctx context.Context, svc *cloudwatch.CloudWatch, funcs []functionInfo, start, end time.Time) (map[string]float64, error) {
+	// one datapoint for the whole window, period must be a multiple of 60
+	period := int64(end.Sub(start).Seconds())
+	period = (period/60 + 1) * 60
+
+	ret := make(map[string]float64)
+	for _, queries := range buildMetricQueries(funcs, period) {
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(start),
+			EndTime:           aws.Time(end),
+			MetricDataQueries: queries,
+		}
+		fn := func(res *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+			for _, r := range res.MetricDataResults {
+				for _, v := range r.Values {
+					ret[aws.StringValue(r.Id)] += aws.Float64Value(v)
+				}
+			}
+			return true
+		}
+		if err := svc.GetMetricDataPagesWithContext(ctx, input, fn); err != nil {
+			return nil, fmt.Errorf("GetMetricData: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+// joinFunctionMetrics sets metrics to the functions
+func joinFunctionMetrics(funcs []functionInfo, metrics map[string]float64) {
+	for i := range funcs {
+		errs := metrics[metricQueryID("Errors", i)]
+		invocations := metrics[metricQueryID("Invocations", i)]
+		funcs[i].Errors = aws.Float64(errs)
+		funcs[i].Invocations = aws.Float64(invocations)
+		if invocations > 0 {
+			funcs[i].ErrorRate = aws.Float64(errs / invocations)
+		}
+	}
+}
+
+// sortByErrors sorts functions by errors desc, then by name
+func sortByErrors(funcs []functionInfo) {
+	sort.SliceStable(funcs, func(i, j int) bool {
+		ei, ej := aws.Float64Value(funcs[i].Errors), aws.Float64Value(funcs[j].Errors)
+		if ei != ej {
+			return ei > ej
+		}
+		return funcs[i].Name < funcs[j].Name
+	})
+}
+
+func printFunctionTable(funcs []functionInfo, withErrors bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if withErrors {
+		fmt.Fprintln(w, "\tNAME\tRUNTIME\tMEMORY\tTIMEOUT\tLAST MODIFIED\tINVOCATIONS\tERRORS\tERROR RATE")
+	} else {
+		fmt.Fprintln(w, "NAME\tRUNTIME\tMEMORY\tTIMEOUT\tLAST MODIFIED")
+	}
+	for _, f := range funcs {
+		row := fmt.Sprintf("%s\t%s\t%d\t%d\t%s", f.Name, f.Runtime, f.MemorySize, f.Timeout, f.LastModified)
+		if !withErrors {
+			fmt.Fprintln(w, row)
+			continue
+		}
+		mark := ""
+		if aws.Float64Value(f.Errors) > 0 {
+			mark = "!"
+		}
+		rate := "-"
+		if f.ErrorRate != nil {
+			rate = fmt.Sprintf("%.1f%%", *f.ErrorRate*100)
+		}
+		metrics := "-\t-"
+		if f.Invocations != nil {
+			metrics = fmt.Sprintf("%.0f\t%.0f", *f.Invocations, aws.Float64Value(f.Errors))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mark, row, metrics, rate)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestFilterByPrefix(t *testing.T) {
+	funcs := []functionInfo{{Name: "orders-api"}, {Name: "orders-worker"}, {Name: "payments"}}
+	if got := filterByPrefix(funcs, ""); len(got) != 3 {
+		t.Errorf("no prefix: %v", got)
+	}
+	got := filterByPrefix(funcs, "orders-")
+	if len(got) != 2 || got[0].Name != "orders-api" || got[1].Name != "orders-worker" {
+		t.Errorf("orders-: %v", got)
+	}
+	if got := filterByPrefix(funcs, "Orders"); len(got) != 0 {
+		t.Errorf("Orders: %v", got)
+	}
+}
+
+func TestBuildMetricQueries(t *testing.T) {
+	funcs := make([]functionInfo, 600)
+	for i := range funcs {
+		funcs[i].Name = fmt.Sprintf("fn-%d", i)
+	}
+	chunks := buildMetricQueries(funcs, 86460)
+	if len(chunks) != 3 {
+		t.Fatalf("chunks: %d", len(chunks))
+	}
+	total := 0
+	for _, c := range chunks {
+		if len(c) > maxMetricQueries {
+			t.Errorf("chunk exceeds the limit: %d", len(c))
+		}
+		total += len(c)
+	}
+	if total != 1200 {
+		t.Errorf("total: %d", total)
+	}
+	last := chunks[2][len(chunks[2])-1]
+	if aws.StringValue(last.Id) != "i599" || aws.StringValue(last.MetricStat.Metric.Dimensions[0].Value) != "fn-599" {
+		t.Errorf("last: %s", aws.StringValue(last.Id))
+	}
+}
+
+func TestJoinAndSortFunctionMetrics(t *testing.T) {
+	funcs := []functionInfo{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	metrics := map[string]float64{
+		"i0": 10,
+		"e1": 1, "i1": 4,
+		"e2": 5, "i2": 5,
+	}
+	joinFunctionMetrics(funcs, metrics)
+	sortByErrors(funcs)
+
+	want := []string{"c", "b", "a", "d"}
+	for i, name := range want {
+		if funcs[i].Name != name {
+			t.Errorf("%d: got %s, want %s", i, funcs[i].Name, name)
+		}
+	}
+	if r := aws.Float64Value(funcs[1].ErrorRate); r != 0.25 {
+		t.Errorf("error rate: %v", r)
+	}
+	if funcs[3].ErrorRate != nil {
+		t.Errorf("no invocations should have no error rate")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+const logLevelNone = "NONE"
+
+// loggingConfig is LoggingConfig of a function. The SDK we use predates it, so it is decoded from
+// the response of GetFunctionConfiguration.
+type loggingConfig struct {
+	LogFormat           string
+	ApplicationLogLevel string
+	SystemLogLevel      string
+	LogGroup            string
+}
+
+// withLoggingConfig is a request option which decodes LoggingConfig into dst before the SDK
+// unmarshals the response without it
+func withLoggingConfig(dst **loggingConfig) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Unmarshal.PushFront(func(r *request.Request) { decodeLoggingConfig(r, dst) })
+	}
+}
+
+func decodeLoggingConfig(r *request.Request, dst **loggingConfig) {
+	if r.HTTPResponse == nil || r.HTTPResponse.Body == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	r.HTTPResponse.Body.Close()
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return // the SDK fails to unmarshal it too
+	}
+	var v struct{ LoggingConfig *loggingConfig }
+	if err := json.Unmarshal(body, &v); err == nil {
+		*dst = v.LoggingConfig
+	}
+}
+
+// iamAPI is the part of IAM API used to tell whether the execution role can write logs
+type iamAPI interface {
+	ListAttachedRolePoliciesWithContext(aws.Context, *iam.ListAttachedRolePoliciesInput, ...request.Option) (*iam.ListAttachedRolePoliciesOutput, error)
+	ListRolePoliciesWithContext(aws.Context, *iam.ListRolePoliciesInput, ...request.Option) (*iam.ListRolePoliciesOutput, error)
+}
+
+// logsManagedPolicies are the AWS managed policies which allow logs:CreateLogStream and logs:PutLogEvents
+var logsManagedPolicies = map[string]bool{
+	"AWSLambdaBasicExecutionRole":     true,
+	"AWSLambdaVPCAccessExecutionRole": true,
+	"AWSLambdaKinesisExecutionRole":   true,
+	"AWSLambdaDynamoDBExecutionRole":  true,
+	"AWSLambdaSQSQueueExecutionRole":  true,
+	"AWSLambdaMSKExecutionRole":       true,
+	"AWSLambdaExecute":                true,
+	"CloudWatchLogsFullAccess":        true,
+	"PowerUserAccess":                 true,
+	"AdministratorAccess":             true,
+}
+
+// roleWritesLogs guesses whether the role can write logs from the names of its policies. An inline
+// or a customer managed policy may allow it, so the role is only reported unable when every policy
+// is an AWS managed one which does not allow it. The reason is set when it is unable.
+func roleWritesLogs(ctx context.Context, api iamAPI, roleARN string) (bool, string, error) {
+	name := roleARN[strings.LastIndexByte(roleARN, '/')+1:]
+	if name == "" {
+		return true, "", fmt.Errorf("no role name in %q", roleARN)
+	}
+	inline, err := api.ListRolePoliciesWithContext(ctx, &iam.ListRolePoliciesInput{RoleName: aws.String(name), MaxItems: aws.Int64(1)})
+	if err != nil {
+		return true, "", fmt.Errorf("ListRolePolicies, %s: %w", name, err)
+	}
+	if len(inline.PolicyNames) > 0 {
+		return true, "", nil
+	}
+
+	input := &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(name)}
+	for {
+		out, err := api.ListAttachedRolePoliciesWithContext(ctx, input)
+		if err != nil {
+			return true, "", fmt.Errorf("ListAttachedRolePolicies, %s: %w", name, err)
+		}
+		for _, p := range out.AttachedPolicies {
+			if logsManagedPolicies[aws.StringValue(p.PolicyName)] || !strings.Contains(aws.StringValue(p.PolicyArn), ":iam::aws:policy/") {
+				return true, "", nil
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			break
+		}
+		input.Marker = out.Marker
+	}
+	return false, fmt.Sprintf("the execution role %s has no policy which allows logs:PutLogEvents, such as AWSLambdaBasicExecutionRole", name), nil
+}
+
+// loggingState tells whether the function writes the logs the tail needs
+type loggingState struct {
+	Off    bool
+	Reason string
+}
+
+// loggingOf tells whether the function writes the START, END and REPORT lines of an invocation,
+// from its LoggingConfig and the policies of its execution role. Whatever can not be told is
+// assumed to log, as before.
+func loggingOf(ctx context.Context, meta *functionMetadata, roles iamAPI) loggingState {
+	name := aws.StringValue(meta.FunctionName)
+	if lc := meta.Logging; lc != nil {
+		if strings.EqualFold(lc.SystemLogLevel, logLevelNone) {
+			return loggingState{Off: true, Reason: "its LoggingConfig discards the platform logs, SystemLogLevel is NONE"}
+		}
+		if strings.EqualFold(lc.ApplicationLogLevel, logLevelNone) {
+			logger.Warnf("the application logs of %s are discarded by its LoggingConfig, only the platform logs are tailed", name)
+		}
+	}
+	writes, reason, err := roleWritesLogs(ctx, roles, aws.StringValue(meta.Role))
+	if err != nil {
+		logger.Debugf("can not tell whether %s writes logs: %s", name, err)
+		return loggingState{}
+	}
+	if !writes {
+		return loggingState{Off: true, Reason: reason}
+	}
+	return loggingState{}
+}
+
+// checkLogging tells up front when the function does not log, since the tail would wait for
+// logs which never come
+func (sl *AWSServerless) checkLogging(ctx context.Context, roles iamAPI) loggingState {
+	meta, err := sl.metadata.get(ctx, sl.funcName, "")
+	if err != nil {
+		logger.Debugf("can not tell whether %s writes logs: %s", sl.funcName, err)
+		return loggingState{}
+	}
+	state := loggingOf(ctx, meta, roles)
+	if state.Off {
+		logger.Warnf("logging of %s is off: %s", sl.funcName, state.Reason)
+	}
+	return state
+}
+
+func (sl *AWSServerless) planPreflight() ([]plannedCall, error) {
+	calls := []plannedCall{{
+		Service:   "lambda",
+		Operation: "GetFunctionConfiguration",
+		Params:    []planParam{{"FunctionName", sl.funcName}},
+		Note:      "LoggingConfig and the execution role, to tell whether the function writes logs, and the timeout, which bounds the wait for END",
+	}, {
+		Service:   "iam",
+		Operation: "ListRolePolicies",
+		Params:    []planParam{{"RoleName", "the execution role"}},
+	}, {
+		Service:   "iam",
+		Operation: "ListAttachedRolePolicies",
+		Params:    []planParam{{"RoleName", "the execution role"}},
+		Note:      "only if the role has no inline policy",
+	}}
+	calls = append(calls, planRetention(sl.logGroupName, sl.setRetention)...)
+	return append(calls, sl.planStreamVersions()...), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+func TestDecodeLoggingConfig(t *testing.T) {
+	body := `{"FunctionName": "orders-fn", "LoggingConfig": {"LogFormat": "JSON", "ApplicationLogLevel": "INFO", "SystemLogLevel": "NONE", "LogGroup": "/aws/lambda/orders-fn"}}`
+	r := &request.Request{HTTPResponse: &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}}
+	var lc *loggingConfig
+	decodeLoggingConfig(r, &lc)
+	if lc == nil || lc.SystemLogLevel != "NONE" || lc.LogFormat != "JSON" {
+		t.Errorf("got %+v", lc)
+	}
+	// the SDK still unmarshals the whole body
+	rest, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil || string(rest) != body {
+		t.Errorf("got %s, %v", rest, err)
+	}
+
+	lc = nil
+	decodeLoggingConfig(&request.Request{HTTPResponse: &http.Response{Body: ioutil.NopCloser(strings.NewReader(`{"FunctionName": "f"}`))}}, &lc)
+	if lc != nil {
+		t.Errorf("a function without LoggingConfig, got %+v", lc)
+	}
+}
+
+// fakeIAM serves the policies of a role
+type fakeIAM struct {
+	inline   []string
+	attached [][]string // pages of policy ARNs
+	err      error
+}
+
+func (f *fakeIAM) ListRolePoliciesWithContext(ctx aws.Context, input *iam.ListRolePoliciesInput, opts ...request.Option) (*iam.ListRolePoliciesOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &iam.ListRolePoliciesOutput{PolicyNames: aws.StringSlice(f.inline)}, nil
+}
+
+func (f *fakeIAM) ListAttachedRolePoliciesWithContext(ctx aws.Context, input *iam.ListAttachedRolePoliciesInput, opts ...request.Option) (*iam.ListAttachedRolePoliciesOutput, error) {
+	page := 0
+	if input.Marker != nil {
+		fmt.Sscan(aws.StringValue(input.Marker), &page)
+	}
+	out := &iam.ListAttachedRolePoliciesOutput{}
+	if page < len(f.attached) {
+		for _, arn := range f.attached[page] {
+			out.AttachedPolicies = append(out.AttachedPolicies, &iam.AttachedPolicy{PolicyArn: aws.String(arn), PolicyName: aws.String(arn[strings.LastIndexByte(arn, '/')+1:])})
+		}
+	}
+	if page+1 < len(f.attached) {
+		out.IsTruncated = aws.Bool(true)
+		out.Marker = aws.String(fmt.Sprint(page + 1))
+	}
+	return out, nil
+}
+
+func TestRoleWritesLogs(t *testing.T) {
+	role := "arn:aws:iam::123456789012:role/service-role/orders-fn-role"
+	tests := []struct {
+		name   string
+		api    *fakeIAM
+		writes bool
+	}{
+		{"basic execution", &fakeIAM{attached: [][]string{{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"}, {"arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"}}}, true},
+		{"inline policy", &fakeIAM{inline: []string{"logs"}}, true},
+		{"customer managed", &fakeIAM{attached: [][]string{{"arn:aws:iam::123456789012:policy/orders-logs"}}}, true},
+		{"aws managed only", &fakeIAM{attached: [][]string{{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"}, {"arn:aws:iam::aws:policy/AmazonSQSFullAccess"}}}, false},
+		{"no policy", &fakeIAM{}, false},
+	}
+	for _, tt := range tests {
+		writes, reason, err := roleWritesLogs(context.Background(), tt.api, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if writes != tt.writes {
+			t.Errorf("%s: got %v", tt.name, writes)
+		}
+		if !writes && !strings.Contains(reason, "orders-fn-role") {
+			t.Errorf("%s: reason must name the role, %s", tt.name, reason)
+		}
+	}
+
+	denied := awserr.New("AccessDenied", "not authorized to perform: iam:ListRolePolicies", nil)
+	if writes, _, err := roleWritesLogs(context.Background(), &fakeIAM{err: denied}, role); err == nil || !writes {
+		t.Errorf("a denied call can not tell, got %v %v", writes, err)
+	}
+}
+
+func TestLoggingOf(t *testing.T) {
+	setTestLogger(t)
+	meta := func(lc *loggingConfig) *functionMetadata {
+		return &functionMetadata{
+			FunctionConfiguration: &lambda.FunctionConfiguration{FunctionName: aws.String("orders-fn"), Role: aws.String("arn:aws:iam::123456789012:role/orders-fn-role")},
+			Logging:               lc,
+		}
+	}
+	basic := &fakeIAM{attached: [][]string{{"arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"}}}
+
+	if s := loggingOf(context.Background(), meta(nil), basic); s.Off {
+		t.Errorf("got %+v", s)
+	}
+	if s := loggingOf(context.Background(), meta(&loggingConfig{SystemLogLevel: "NONE"}), basic); !s.Off || !strings.Contains(s.Reason, "SystemLogLevel") {
+		t.Errorf("got %+v", s)
+	}
+	// START, END and REPORT are still written
+	if s := loggingOf(context.Background(), meta(&loggingConfig{ApplicationLogLevel: "NONE", SystemLogLevel: "INFO"}), basic); s.Off {
+		t.Errorf("got %+v", s)
+	}
+	if s := loggingOf(context.Background(), meta(nil), &fakeIAM{}); !s.Off {
+		t.Errorf("got %+v", s)
+	}
+	if s := loggingOf(context.Background(), meta(nil), &fakeIAM{err: awserr.New("AccessDenied", "", nil)}); s.Off {
+		t.Errorf("what can not be told is assumed to log, got %+v", s)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// kindFunctionLogLevel is the journal kind of -with-log-level
+const kindFunctionLogLevel = "function-log-level"
+
+const (
+	logFormatJSON          = "JSON"
+	defaultLogLevel        = "INFO" // the application log level of the JSON format when none is set
+	logLevelPollInterval   = time.Second
+	logLevelWaitTimeout    = 2 * time.Minute
+	logLevelRestoreTimeout = time.Minute // the restore runs after the run is interrupted too
+)
+
+// validLogLevels are the application log levels Lambda accepts
+var validLogLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// parseLogLevel parses -with-log-level, one of validLogLevels in any case. An empty string is not set.
+func parseLogLevel(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, l := range validLogLevels {
+		if strings.EqualFold(s, l) {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("with-log-level must be one of %s, %s", strings.Join(validLogLevels, ", "), s)
+}
+
+// functionLoggingAPI reads and changes LoggingConfig of a function, which the SDK we use does not know
+type functionLoggingAPI interface {
+	loggingConfig(ctx context.Context, function string) (*functionMetadata, error)
+	updateLoggingConfig(ctx context.Context, function, revision string, lc loggingConfig) error
+}
+
+// lambdaConfigurationAPI is the part of the Lambda API used to change LoggingConfig
+type lambdaConfigurationAPI interface {
+	functionConfigurationAPI
+	UpdateFunctionConfigurationWithContext(ctx aws.Context, input *lambda.UpdateFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error)
+}
+
+type lambdaLogging struct {
+	api      lambdaConfigurationAPI
+	metadata *metadataCache // refreshed by every read, the configuration is polled until an update settles
+}
+
+func newLambdaLogging(api lambdaConfigurationAPI, metadata *metadataCache) lambdaLogging {
+	if metadata == nil {
+		metadata = newMetadataCache(api, false)
+	}
+	return lambdaLogging{api: api, metadata: metadata}
+}
+
+func (l lambdaLogging) loggingConfig(ctx context.Context, function string) (*functionMetadata, error) {
+	return l.metadata.refresh(ctx, function, "")
+}
+
+func (l lambdaLogging) updateLoggingConfig(ctx context.Context, function, revision string, lc loggingConfig) error {
+	input := &lambda.UpdateFunctionConfigurationInput{FunctionName: aws.String(function)}
+	if revision != "" {
+		input.RevisionId = aws.String(revision) // fails if the function was changed since it was read
+	}
+	_, err := l.api.UpdateFunctionConfigurationWithContext(ctx, input, withLoggingConfigUpdate(lc))
+	l.metadata.invalidate(function, "")
+	if err != nil {
+		return fmt.Errorf("UpdateFunctionConfiguration, %s: %w", function, err)
+	}
+	return nil
+}
+
+// withLoggingConfigUpdate is a request option which adds LoggingConfig to the body the SDK built without it
+func withLoggingConfigUpdate(lc loggingConfig) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			body := []byte("{}")
+			if b := r.GetBody(); b != nil {
+				if _, err := b.Seek(0, io.SeekStart); err != nil {
+					r.Error = err
+					return
+				}
+				var err error
+				if body, err = ioutil.ReadAll(b); err != nil {
+					r.Error = err
+					return
+				}
+			}
+			buf, err := addLoggingConfig(body, lc)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			r.SetBufferBody(buf)
+		})
+	}
+}
+
+// addLoggingConfig returns the JSON body with LoggingConfig. The empty fields are left as they are.
+func addLoggingConfig(body []byte, lc loggingConfig) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, fmt.Errorf("body of UpdateFunctionConfiguration: %w", err)
+		}
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	buf, err := json.Marshal(struct {
+		LogFormat           string `json:",omitempty"`
+		ApplicationLogLevel string `json:",omitempty"`
+		SystemLogLevel      string `json:",omitempty"`
+		LogGroup            string `json:",omitempty"`
+	}{lc.LogFormat, lc.ApplicationLogLevel, lc.SystemLogLevel, lc.LogGroup})
+	if err != nil {
+		return nil, err
+	}
+	fields["LoggingConfig"] = buf
+	return json.Marshal(fields)
+}
+
+// waitFunctionUpdated waits until no update of the function is in progress, and returns its configuration
+func waitFunctionUpdated(ctx context.Context, api functionLoggingAPI, function string, poll time.Duration) (*functionMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, logLevelWaitTimeout)
+	defer cancel()
+	for {
+		meta, err := api.loggingConfig(ctx, function)
+		if err != nil {
+			return nil, err
+		}
+		switch aws.StringValue(meta.LastUpdateStatus) {
+		case lambda.LastUpdateStatusFailed:
+			return nil, fmt.Errorf("the last update of %s failed: %s", function, aws.StringValue(meta.LastUpdateStatusReason))
+		case lambda.LastUpdateStatusInProgress:
+		default:
+			return meta, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("an update of %s is still in progress: %w", function, ctx.Err())
+		case <-time.After(poll):
+		}
+	}
+}
+
+// logLevelPrevious is the state a log level mutation restores
+type logLevelPrevious struct {
+	ApplicationLogLevel string `json:"application_log_level"`
+}
+
+// logLevelOverride is the application log level of a function changed for a run
+type logLevelOverride struct {
+	function  string
+	previous  string
+	config    loggingConfig // LoggingConfig while it is overridden
+	journalID string
+}
+
+// overrideLogLevel sets the application log level of the function for a run. The mutation is recorded
+// in the journal before it is made, so that the cleanup subcommand can revert it. The override is
+// returned whenever it may have been made, with an error too, and must be restored.
+func overrideLogLevel(ctx context.Context, api functionLoggingAPI, j *journal, region, function, level string, poll time.Duration) (*logLevelOverride, error) {
+	cur, err := waitFunctionUpdated(ctx, api, function, poll)
+	if err != nil {
+		return nil, err
+	}
+	lc := cur.Logging
+	if lc == nil || !strings.EqualFold(lc.LogFormat, logFormatJSON) {
+		format := "Text"
+		if lc != nil && lc.LogFormat != "" {
+			format = lc.LogFormat
+		}
+		return nil, fmt.Errorf("-with-log-level needs the JSON log format, %s logs in the %s format. set LogFormat of its LoggingConfig to JSON", function, format)
+	}
+	previous := lc.ApplicationLogLevel
+	if previous == "" {
+		previous = defaultLogLevel
+	}
+	if strings.EqualFold(previous, level) {
+		logger.Infof("the application log level of %s is already %s", function, level)
+		return nil, nil
+	}
+
+	buf, err := json.Marshal(logLevelPrevious{ApplicationLogLevel: previous})
+	if err != nil {
+		return nil, err
+	}
+	id, err := j.record(ctx, journalEntry{Kind: kindFunctionLogLevel, Resource: function, Region: region, Previous: buf})
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	o := &logLevelOverride{function: function, previous: previous, config: *lc, journalID: id}
+	o.config.ApplicationLogLevel = level
+	if err := api.updateLoggingConfig(ctx, function, aws.StringValue(cur.RevisionId), o.config); err != nil {
+		if ctx.Err() != nil {
+			return o, err // the update may have been made before the interruption
+		}
+		// nothing is changed to revert
+		if err := j.markReverted(ctx, id); err != nil {
+			logger.Warnf("journal: %s", err)
+		}
+		return nil, err
+	}
+	logger.Infof("the application log level of %s is %s for the run, it is restored to %s after the run", function, level, previous)
+	if _, err := waitFunctionUpdated(ctx, api, function, poll); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// restore sets the application log level back, after the update of the override is finished
+func (o *logLevelOverride) restore(ctx context.Context, api functionLoggingAPI, j *journal, poll time.Duration) error {
+	if _, err := waitFunctionUpdated(ctx, api, o.function, poll); err != nil {
+		return err
+	}
+	lc := o.config
+	lc.ApplicationLogLevel = o.previous
+	if err := api.updateLoggingConfig(ctx, o.function, "", lc); err != nil {
+		return err
+	}
+	if err := j.markReverted(ctx, o.journalID); err != nil {
+		logger.Warnf("journal: %s", err)
+	}
+	logger.Infof("the application log level of %s is restored to %s", o.function, o.previous)
+	return nil
+}
+
+// overrideLogLevel sets the application log level of -with-log-level for the run
+func (sl *AWSServerless) overrideLogLevel(ctx context.Context, region string) error {
+	o, err := overrideLogLevel(ctx, sl.loggingAPI, sl.journal, region, sl.funcName, sl.withLogLevel, sl.logLevelPoll)
+	sl.logLevel = o
+	if o != nil {
+		sl.metadata.invalidate(sl.funcName, "")
+	}
+	return err
+}
+
+// restoreLogLevel restores the application log level of -with-log-level. It runs when the run is
+// finished or interrupted, so it does not use the context of the run.
+func (sl *AWSServerless) restoreLogLevel() error {
+	if sl.logLevel == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logLevelRestoreTimeout)
+	defer cancel()
+	if err := sl.logLevel.restore(ctx, sl.loggingAPI, sl.journal, sl.logLevelPoll); err != nil {
+		logger.Errorf("the application log level of %s is left %s, the cleanup subcommand restores it: %s", sl.funcName, sl.logLevel.config.ApplicationLogLevel, err)
+		return fmt.Errorf("restore the log level of %s: %w", sl.funcName, err)
+	}
+	sl.logLevel = nil
+	return nil
+}
+
+// planLogLevel returns the calls of -with-log-level before the invocation
+func (sl *AWSServerless) planLogLevel() ([]plannedCall, error) {
+	return []plannedCall{{
+		Service:   "lambda",
+		Operation: "UpdateFunctionConfiguration",
+		Params:    []planParam{{"FunctionName", sl.funcName}, {"LoggingConfig.ApplicationLogLevel", sl.withLogLevel}},
+		Note:      "only if the level differs, recorded in the journal for the cleanup subcommand. the function must use the JSON log format",
+	}, {
+		Service:   "lambda",
+		Operation: "GetFunctionConfiguration",
+		Params:    []planParam{{"FunctionName", sl.funcName}},
+		Note:      fmt.Sprintf("every %s up to %s until LastUpdateStatus is not InProgress, before and after the update", logLevelPollInterval, logLevelWaitTimeout),
+	}}, nil
+}
+
+// planRestoreLogLevel returns the calls which restore the log level after the run
+func (sl *AWSServerless) planRestoreLogLevel() ([]plannedCall, error) {
+	return []plannedCall{{
+		Service:   "lambda",
+		Operation: "UpdateFunctionConfiguration",
+		Params:    []planParam{{"FunctionName", sl.funcName}, {"LoggingConfig.ApplicationLogLevel", "the previous level"}},
+		Note:      "after the run, even when it fails or is interrupted",
+	}}, nil
+}
+
+// logLevelReverser restores the application log level of a function set by -with-log-level
+type logLevelReverser struct {
+	client func(region string) functionLoggingAPI
+	poll   time.Duration
+}
+
+func newLogLevelReverser(sess *session.Session) *logLevelReverser {
+	return &logLevelReverser{
+		client: func(region string) functionLoggingAPI {
+			if region == "" {
+				return newLambdaLogging(lambda.New(sess), nil)
+			}
+			return newLambdaLogging(lambda.New(sess, aws.NewConfig().WithRegion(region)), nil)
+		},
+		poll: logLevelPollInterval,
+	}
+}
+
+func (r *logLevelReverser) previous(e journalEntry) (logLevelPrevious, error) {
+	var prev logLevelPrevious
+	if err := json.Unmarshal(e.Previous, &prev); err != nil {
+		return prev, fmt.Errorf("previous log level: %w", err)
+	}
+	if prev.ApplicationLogLevel == "" {
+		return prev, errors.New("no previous log level")
+	}
+	return prev, nil
+}
+
+func (r *logLevelReverser) changed(ctx context.Context, e journalEntry) (bool, error) {
+	prev, err := r.previous(e)
+	if err != nil {
+		return false, err
+	}
+	meta, err := r.client(e.Region).loggingConfig(ctx, e.Resource)
+	if err != nil {
+		return false, err
+	}
+	// a function switched back to the text format has no application log level to restore
+	return meta.Logging != nil && strings.EqualFold(meta.Logging.LogFormat, logFormatJSON) && !strings.EqualFold(meta.Logging.ApplicationLogLevel, prev.ApplicationLogLevel), nil
+}
+
+func (r *logLevelReverser) revert(ctx context.Context, e journalEntry) error {
+	prev, err := r.previous(e)
+	if err != nil {
+		return err
+	}
+	api := r.client(e.Region)
+	meta, err := waitFunctionUpdated(ctx, api, e.Resource, r.poll)
+	if err != nil {
+		return err
+	}
+	if meta.Logging == nil {
+		return fmt.Errorf("%s has no LoggingConfig", e.Resource)
+	}
+	lc := *meta.Logging
+	lc.ApplicationLogLevel = prev.ApplicationLogLevel
+	return api.updateLoggingConfig(ctx, e.Resource, aws.StringValue(meta.RevisionId), lc)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	if l, err := parseLogLevel("debug"); err != nil || l != "DEBUG" {
+		t.Errorf("got %s, %v", l, err)
+	}
+	if l, err := parseLogLevel(""); err != nil || l != "" {
+		t.Errorf("got %s, %v", l, err)
+	}
+	if _, err := parseLogLevel("VERBOSE"); err == nil {
+		t.Errorf("an error expected")
+	}
+}
+
+func TestAddLoggingConfig(t *testing.T) {
+	buf, err := addLoggingConfig([]byte(`{"Timeout":30}`), loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "DEBUG"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"LoggingConfig":{"LogFormat":"JSON","ApplicationLogLevel":"DEBUG"},"Timeout":30}`; string(buf) != want {
+		t.Errorf("the other fields are kept and the empty ones are left out, got %s", buf)
+	}
+	if buf, err := addLoggingConfig(nil, loggingConfig{ApplicationLogLevel: "INFO"}); err != nil || string(buf) != `{"LoggingConfig":{"ApplicationLogLevel":"INFO"}}` {
+		t.Errorf("got %s, %v", buf, err)
+	}
+}
+
+// fakeFunctionLogging is a function whose updates stay in progress for inProgress reads
+type fakeFunctionLogging struct {
+	mu         sync.Mutex
+	lc         *loggingConfig
+	inProgress int
+	pending    int
+	updates    []string // the application log levels of the updates
+	updateErr  error
+	onUpdate   func()
+}
+
+func (f *fakeFunctionLogging) loggingConfig(ctx context.Context, function string) (*functionMetadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := lambda.LastUpdateStatusSuccessful
+	if f.pending > 0 {
+		f.pending--
+		status = lambda.LastUpdateStatusInProgress
+	}
+	meta := &functionMetadata{FunctionConfiguration: &lambda.FunctionConfiguration{
+		FunctionName:     aws.String(function),
+		LastUpdateStatus: aws.String(status),
+		RevisionId:       aws.String("r1"),
+	}}
+	if f.lc != nil {
+		lc := *f.lc
+		meta.Logging = &lc
+	}
+	return meta, nil
+}
+
+func (f *fakeFunctionLogging) updateLoggingConfig(ctx context.Context, function, revision string, lc loggingConfig) error {
+	f.mu.Lock()
+	if f.updateErr != nil {
+		f.mu.Unlock()
+		return f.updateErr
+	}
+	if f.pending > 0 {
+		f.mu.Unlock()
+		return awserr.New(lambda.ErrCodeResourceConflictException, "An update is in progress", nil)
+	}
+	f.lc = &lc
+	f.updates = append(f.updates, lc.ApplicationLogLevel)
+	f.pending = f.inProgress
+	hook := f.onUpdate
+	f.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	return nil
+}
+
+func (f *fakeFunctionLogging) level() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lc.ApplicationLogLevel
+}
+
+func newLogLevelServerless(t *testing.T, api functionLoggingAPI) *AWSServerless {
+	t.Helper()
+	return &AWSServerless{
+		funcName:     "orders-fn",
+		withLogLevel: "DEBUG",
+		logLevelPoll: time.Millisecond,
+		loggingAPI:   api,
+		journal:      newJournal(filepath.Join(t.TempDir(), "journal.json")),
+		metadata:     newMetadataCache(nil, false),
+	}
+}
+
+func TestOverrideLogLevel(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "WARN", SystemLogLevel: "INFO"}, inProgress: 2}
+	sl := newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(context.Background(), "us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	if api.level() != "DEBUG" || api.pending != 0 || api.lc.SystemLogLevel != "INFO" {
+		t.Errorf("the invocation waits for the update, got %+v, %d pending", api.lc, api.pending)
+	}
+	entries, err := sl.journal.outstanding()
+	if err != nil || len(entries) != 1 || entries[0].Kind != kindFunctionLogLevel || entries[0].Resource != "orders-fn" {
+		t.Fatalf("got %+v, %v", entries, err)
+	}
+	var prev logLevelPrevious
+	if err := json.Unmarshal(entries[0].Previous, &prev); err != nil || prev.ApplicationLogLevel != "WARN" {
+		t.Errorf("got %+v, %v", prev, err)
+	}
+
+	if err := sl.restoreLogLevel(); err != nil {
+		t.Fatal(err)
+	}
+	if api.level() != "WARN" || len(api.updates) != 2 {
+		t.Errorf("got %v", api.updates)
+	}
+	if entries, _ := sl.journal.outstanding(); len(entries) != 0 {
+		t.Errorf("the restore is marked in the journal, got %+v", entries)
+	}
+
+	// the same level is not set, and there is nothing to restore
+	api = &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "DEBUG"}}
+	sl = newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(context.Background(), "us-east-1"); err != nil || sl.logLevel != nil || len(api.updates) != 0 {
+		t.Errorf("got %v, %v", api.updates, err)
+	}
+}
+
+func TestOverrideLogLevelTextFormat(t *testing.T) {
+	setTestLogger(t)
+	for _, lc := range []*loggingConfig{nil, {LogFormat: "Text"}} {
+		api := &fakeFunctionLogging{lc: lc}
+		sl := newLogLevelServerless(t, api)
+		err := sl.overrideLogLevel(context.Background(), "us-east-1")
+		if err == nil || !strings.Contains(err.Error(), "needs the JSON log format, orders-fn logs in the Text format") {
+			t.Errorf("got %v", err)
+		}
+		if entries, _ := sl.journal.outstanding(); len(entries) != 0 || len(api.updates) != 0 || sl.logLevel != nil {
+			t.Errorf("nothing is changed, got %+v", entries)
+		}
+	}
+
+	// a rejected update leaves nothing to revert
+	api := &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON"}, updateErr: errors.New("AccessDeniedException")}
+	sl := newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(context.Background(), "us-east-1"); err == nil || sl.logLevel != nil {
+		t.Errorf("got %v", err)
+	}
+	if entries, _ := sl.journal.outstanding(); len(entries) != 0 {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestRestoreLogLevelOnInterrupt(t *testing.T) {
+	setTestLogger(t)
+	// interrupted while the update is in progress, the restore waits for it
+	api := &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "INFO"}, inProgress: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	api.onUpdate = cancel
+	sl := newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(ctx, "us-east-1"); !errors.Is(err, context.Canceled) || sl.logLevel == nil {
+		t.Fatalf("got %v", err)
+	}
+	api.onUpdate = nil
+	if err := sl.restoreLogLevel(); err != nil {
+		t.Fatal(err)
+	}
+	if api.level() != "INFO" || len(api.updates) != 2 {
+		t.Errorf("got %v", api.updates)
+	}
+	if entries, _ := sl.journal.outstanding(); len(entries) != 0 {
+		t.Errorf("got %+v", entries)
+	}
+
+	// the update call itself is interrupted, it may have been made
+	api = &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "INFO"}}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	api.updateErr = ctx.Err()
+	sl = newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(ctx, "us-east-1"); err == nil || sl.logLevel == nil {
+		t.Fatalf("the override must be restored, got %v", err)
+	}
+	api.updateErr = nil
+	if err := sl.restoreLogLevel(); err != nil || len(api.updates) != 1 || api.level() != "INFO" {
+		t.Errorf("got %v, %v", api.updates, err)
+	}
+
+	// a failed restore is an error, and is left in the journal for the cleanup subcommand
+	api = &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "INFO"}}
+	sl = newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(context.Background(), "us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	api.updateErr = errors.New("ThrottlingException")
+	if err := sl.restoreLogLevel(); err == nil || !strings.Contains(err.Error(), "restore the log level of orders-fn") {
+		t.Errorf("got %v", err)
+	}
+	if entries, _ := sl.journal.outstanding(); len(entries) != 1 {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestLogLevelReverser(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeFunctionLogging{lc: &loggingConfig{LogFormat: "JSON", ApplicationLogLevel: "ERROR", LogGroup: "/custom/orders"}}
+	sl := newLogLevelServerless(t, api)
+	if err := sl.overrideLogLevel(context.Background(), "us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	sl.logLevel = nil // the process was killed before the restore
+
+	r := &logLevelReverser{client: func(string) functionLoggingAPI { return api }, poll: time.Millisecond}
+	yes := func(journalEntry) bool { return true }
+	if err := cleanupJournal(context.Background(), sl.journal, map[string]reverser{kindFunctionLogLevel: r}, yes); err != nil {
+		t.Fatal(err)
+	}
+	if api.level() != "ERROR" || api.lc.LogGroup != "/custom/orders" {
+		t.Errorf("got %+v", api.lc)
+	}
+	if entries, _ := sl.journal.outstanding(); len(entries) != 0 {
+		t.Errorf("got %+v", entries)
+	}
+}
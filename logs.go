@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// anchorMark is put before the lines of the anchor request
+const anchorMark = "▶ "
+
+// logStreamer prints the log events of every request of a log group from a point in time
+type logStreamer struct {
+	logs         logsAPI
+	emitter      *emitter
+	logGroupName string
+	anchor       *anchor // nil if no request is marked
+	follow       bool
+	poll         time.Duration
+	idle         time.Duration                       // stops following when no event is printed for it, 0 for no limit
+	versionOf    func(stream, message string) string // the version of the request of a line, nil if not tagged
+
+	current   map[string]string // log stream to its current request
+	lastSeen  int64
+	lastEvent time.Time // when an event was printed last, or the start
+}
+
+// streamLogs prints the events since s.lastSeen, and keeps polling if s.follow
+func (s *logStreamer) streamLogs(ctx context.Context) error {
+	if s.lastEvent.IsZero() {
+		s.lastEvent = time.Now()
+	}
+	for {
+		if err := s.pollOnce(ctx); err != nil {
+			return err
+		}
+		if !s.follow {
+			return nil
+		}
+		if s.idle > 0 && time.Since(s.lastEvent) >= s.idle {
+			logger.Infof("no new log event in %s", s.idle)
+			return nil
+		}
+		if err := sleepContext(ctx, s.poll); err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *logStreamer) pollOnce(ctx context.Context) error {
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(s.logGroupName),
+		StartTime:    aws.Int64(s.lastSeen),
+	}
+	lastSeen := s.lastSeen
+	fn := func(res *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+		for _, event := range res.Events {
+			message := aws.StringValue(event.Message)
+			stream := aws.StringValue(event.LogStreamName)
+			timestamp := aws.Int64Value(event.Timestamp)
+			if !s.emitter.isNew(aws.StringValue(event.EventId), timestamp, message) {
+				continue
+			}
+			if kind, id, _ := parseLifecycle(message); kind == lifecycleStart {
+				s.current[stream] = id
+			}
+			requestID := s.current[stream]
+			if s.anchor != nil && requestID == s.anchor.RequestID {
+				message = anchorMark + message
+			}
+			record := schema.LogLine{RequestID: requestID}
+			if s.versionOf != nil {
+				record.Version = s.versionOf(stream, message)
+			}
+			s.emitter.emit(message, recordFields(record)...)
+			s.lastEvent = time.Now()
+			if timestamp > lastSeen {
+				lastSeen = timestamp
+			}
+		}
+		return true
+	}
+	err := s.logs.FilterLogEventsPagesWithContext(ctx, input, fn)
+	s.lastSeen = lastSeen
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "ThrottlingException" {
+		logger.Infof("Rate exceeded for %s. Retry at the next poll.", s.logGroupName)
+		return nil
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("FilterLogEventsPages, %s: %w", s.logGroupName, err)
+	}
+	return nil
+}
+
+// runLogs runs the logs subcommand, which prints the logs of every request from a request onwards
+func runLogs(args []string) error {
+	var funcName string
+	var sinceRequest string
+	var lookback time.Duration
+	var follow bool
+	var retention string
+	var json bool
+
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.StringVar(&funcName, "func", "", "function name")
+	fs.StringVar(&sinceRequest, "since-request", "", "print the logs from the START of this request onwards")
+	fs.DurationVar(&lookback, "lookback", defaultAnchorLookback, "how far back the request of -since-request is searched")
+	fs.BoolVar(&follow, "follow", false, "keep printing new logs until interrupted")
+	fs.StringVar(&retention, "set-retention", "", "set the retention of the log group to the days, recorded in the journal for the cleanup subcommand")
+	fs.BoolVar(&json, "json", false, "enable JSON log format")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{json: json})
+	defer logger.Sync()
+
+	if funcName == "" || sinceRequest == "" {
+		return &configError{fmt.Errorf("-func and -since-request are required")}
+	}
+	ref, err := ParseFunctionRef(funcName)
+	if err != nil {
+		return &configError{err}
+	}
+	days, err := parseRetentionDays(retention)
+	if err != nil {
+		return &configError{err}
+	}
+	awsOpts, err := newAWSSessionOptions(ref.Region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := cancelOnSignal(ctx, cancel)
+	defer stop()
+
+	logs := cloudwatchlogs.New(sess)
+	cur, ok := checkRetention(ctx, logs, ref.LogGroup(), lookback)
+	if days > 0 {
+		if !ok {
+			return fmt.Errorf("-set-retention: the retention of %s is unknown, it is not set", ref.LogGroup())
+		}
+		if err := setRetention(ctx, logs, newJournal(defaultJournalPath()), aws.StringValue(sess.Config.Region), ref.LogGroup(), cur, days); err != nil {
+			return err
+		}
+	}
+	a, err := resolveAnchor(ctx, logs, ref.LogGroup(), sinceRequest, time.Now(), lookback, anchorSearchStep)
+	if err != nil {
+		return err
+	}
+	logger.Infof("request %s started at %s in %s", a.RequestID, msToTime(a.Timestamp).UTC().Format(time.RFC3339Nano), a.LogStream)
+
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		return err
+	}
+	s := &logStreamer{
+		logs:         logs,
+		emitter:      em,
+		logGroupName: ref.LogGroup(),
+		anchor:       a,
+		follow:       follow,
+		poll:         defaultLimits.PollInterval,
+		current:      map[string]string{a.LogStream: a.RequestID},
+		lastSeen:     a.Timestamp,
+	}
+	return s.streamLogs(ctx)
+}
@@ -2,33 +2,249 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"go.uber.org/zap"
 )
 
 var logger *zap.SugaredLogger
 
+// subcommands are run by the first argument. Each subcommand parses its own flags and sets up the logger.
+var subcommands = map[string]func(args []string) error{
+	"canary-watch": runCanaryWatch,
+	"cleanup":      runCleanup,
+	"describe":     runDescribe,
+	"fleet-logs":   runFleetLogs,
+	"list":         runList,
+	"logs":         runLogs,
+	"schema":       runSchema,
+	"tail":         runTail,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					return
+				}
+				// the flags are parsed before the logger is set up
+				if logger == nil {
+					fmt.Fprintf(os.Stderr, "%s error, %s\n", os.Args[1], err)
+				} else {
+					logger.Errorf("%s error, %s\n", os.Args[1], err)
+					logger.Sync()
+				}
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+	}
+
 	config, err := parseConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		fmt.Printf("parseConfig error: %s\n", err)
-		os.Exit(-1)
+		os.Exit(exitConfigError)
+	}
+	if config.showConfig {
+		config.printEffectiveConfig()
+		return
 	}
 
 	logger = NewLogger(config)
+	if config.publisher != nil {
+		logger = config.publisher.capture.wrap(logger)
+	}
 	defer logger.Sync()
 
+	config.logEffectiveConfig(logger)
+
+	if config.plan {
+		if err := printPlan(os.Stdout, config); err != nil {
+			logger.Errorf("plan error, %s\n", err)
+			logger.Sync()
+			os.Exit(exitConfigError)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	sl, err := NewAWSServerless(config)
-	if err != nil {
-		logger.Fatalf("NewAWSServerless, %s\n", err)
+	if config.every > 0 {
+		stopping, stop := finishOnSignal(ctx, cancel)
+		defer stop()
+		if err := runRepeat(ctx, stopping, config, invokeAndPublish); err != nil {
+			logger.Errorf("%s\n", err)
+			logger.Sync()
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	stop := cancelOnSignal(ctx, cancel)
+	defer stop()
+
+	if config.watch {
+		if err := runWatch(ctx, config, invokeAndPublish); err != nil {
+			logger.Errorf("watch error, %s\n", err)
+			logger.Sync()
+			os.Exit(exitCode(err))
+		}
+		return
 	}
 
+	if err := invokeAndPublish(ctx, config); err != nil {
+		logger.Errorf("%s\n", err)
+		logger.Sync()
+		os.Exit(exitCode(err))
+	}
+}
+
+// cancelOnSignal cancels ctx on SIGINT or SIGTERM, so that a run stops with its summary. A second
+// signal kills the process as usual. The returned func stops the watching.
+func cancelOnSignal(ctx context.Context, cancel context.CancelFunc) func() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			signal.Stop(sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return func() { signal.Stop(sig) }
+}
+
+// newInvoker returns the Invoker of the vendor
+func newInvoker(config *Config) (Invoker, error) {
+	switch config.vendor {
+	case VendorAWS:
+		if isStateMachineARN(config.funcName) {
+			s, err := NewStepFunctions(config)
+			if err != nil {
+				return nil, fmt.Errorf("NewStepFunctions, %w", err)
+			}
+			return s, nil
+		}
+		sl, err := NewAWSServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewAWSServerless, %w", err)
+		}
+		return sl, nil
+	case VendorGCP:
+		if isGCPJobName(config.funcName) {
+			j, err := NewGCPJob(config)
+			if err != nil {
+				return nil, fmt.Errorf("NewGCPJob, %w", err)
+			}
+			return j, nil
+		}
+		sl, err := NewGCPServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewGCPServerless, %w", err)
+		}
+		return sl, nil
+	case VendorAzure:
+		sl, err := NewAzureServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewAzureServerless, %w", err)
+		}
+		return sl, nil
+	case VendorKnative:
+		sl, err := NewKnativeServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewKnativeServerless, %w", err)
+		}
+		return sl, nil
+	case VendorOpenFaaS:
+		sl, err := NewOpenFaaSServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewOpenFaaSServerless, %w", err)
+		}
+		return sl, nil
+	case VendorOpenWhisk:
+		sl, err := NewOpenWhiskServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewOpenWhiskServerless, %w", err)
+		}
+		return sl, nil
+	case VendorAlibaba:
+		sl, err := NewAlibabaServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewAlibabaServerless, %w", err)
+		}
+		return sl, nil
+	case VendorOCI:
+		sl, err := NewOCIServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewOCIServerless, %w", err)
+		}
+		return sl, nil
+	case VendorCloudflare:
+		w, err := NewCloudflareWorker(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewCloudflareWorker, %w", err)
+		}
+		return w, nil
+	case VendorECS:
+		t, err := NewECSTask(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewECSTask, %w", err)
+		}
+		return t, nil
+	case VendorAWSBatch:
+		j, err := NewBatchJob(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewBatchJob, %w", err)
+		}
+		return j, nil
+	case VendorLocal:
+		sl, err := NewLocalServerless(config)
+		if err != nil {
+			return nil, fmt.Errorf("NewLocalServerless, %w", err)
+		}
+		return sl, nil
+	}
+	return nil, fmt.Errorf("vendor %s is not supported yet", config.vendor)
+}
+
+// invokeOnce invokes the function with the config and tails its logs
+func invokeOnce(ctx context.Context, config *Config) error {
+	if config.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.runTimeout)
+		defer cancel()
+	}
+	rules, rulesStat, err := openRules(config.rulesFile)
+	if err != nil {
+		return &configError{err}
+	}
+	config.rules = rules
+	sl, err := newInvoker(config)
+	if err != nil {
+		return &configError{err}
+	}
+	if ci, ok := sl.(consoleInvoker); ok && rulesStat != nil {
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		go watchRules(watchCtx, config.rulesFile, rulesStat, rulesCheckInterval, ci.consoleEmitter())
+	}
 	if err := sl.Invoke(ctx); err != nil {
-		logger.Fatalf("Invoke error, %s\n", err)
+		var te *timeoutError
+		if config.runTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.As(err, &te) {
+			err = &timeoutError{fmt.Errorf("the run did not finish in -timeout %s: %w", config.runTimeout, err)}
+		}
+		return fmt.Errorf("Invoke error, %w", err)
 	}
+	return nil
 }
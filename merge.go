@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// mergePayloads deep-merges override onto base. Both must be JSON objects. The numbers are kept
+// as written, so that an id or an epoch beyond 2^53 does not lose its precision.
+func mergePayloads(base, override string) (string, error) {
+	b, err := decodeJSON([]byte(base))
+	if _, ok := b.(map[string]interface{}); err != nil || !ok {
+		return "", fmt.Errorf("payload_file is not a JSON object")
+	}
+	o, err := decodeJSON([]byte(override))
+	if _, ok := o.(map[string]interface{}); err != nil || !ok {
+		return "", fmt.Errorf("payload is not a JSON object")
+	}
+	buf, err := json.Marshal(deepMerge(b, o))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// deepMerge merges override onto base. Objects are merged recursively,
+// and anything else including arrays and null replaces the value of base.
+func deepMerge(base, override interface{}) interface{} {
+	bm, ok := base.(map[string]interface{})
+	if !ok {
+		return override
+	}
+	om, ok := override.(map[string]interface{})
+	if !ok {
+		return override
+	}
+	ret := make(map[string]interface{}, len(bm)+len(om))
+	for k, v := range bm {
+		ret[k] = v
+	}
+	for k, v := range om {
+		if bv, ok := ret[k]; ok {
+			ret[k] = deepMerge(bv, v)
+		} else {
+			ret[k] = v
+		}
+	}
+	return ret
+}
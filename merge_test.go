@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMergePayloads(t *testing.T) {
+	tests := []struct {
+		base, override, want string
+	}{
+		{`{"a":1,"b":2}`, `{"b":3,"c":4}`, `{"a":1,"b":3,"c":4}`},
+		{`{"o":{"x":1,"y":{"z":1}}}`, `{"o":{"y":{"w":2}}}`, `{"o":{"x":1,"y":{"w":2,"z":1}}}`},
+		{`{"list":[1,2,3]}`, `{"list":[4]}`, `{"list":[4]}`},
+		{`{"o":{"x":1}}`, `{"o":"scalar"}`, `{"o":"scalar"}`},
+		{`{"o":"scalar"}`, `{"o":{"x":1}}`, `{"o":{"x":1}}`},
+		{`{"o":{"x":1}}`, `{"o":null}`, `{"o":null}`},
+		{`{"o":null}`, `{"o":{"x":1}}`, `{"o":{"x":1}}`},
+		{`{}`, `{"overrides":{"dryRun":true}}`, `{"overrides":{"dryRun":true}}`},
+		{`{"id":9007199254740993,"o":{"ts":1700000000123456789}}`, `{"o":{"n":1.50}}`, `{"id":9007199254740993,"o":{"n":1.50,"ts":1700000000123456789}}`},
+	}
+	for _, tt := range tests {
+		got, err := mergePayloads(tt.base, tt.override)
+		if err != nil {
+			t.Errorf("%s + %s: %s", tt.base, tt.override, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s + %s: got %s", tt.base, tt.override, got)
+		}
+	}
+
+	for _, tt := range [][2]string{
+		{`[1]`, `{"a":1}`},
+		{`{"a":1}`, `"str"`},
+		{`null`, `{"a":1}`},
+		{`{"a":1}`, `not json`},
+	} {
+		if _, err := mergePayloads(tt[0], tt[1]); err == nil {
+			t.Errorf("%s + %s: must be an error", tt[0], tt[1])
+		}
+	}
+}
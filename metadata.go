@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// functionConfigurationAPI is the part of the Lambda API the metadata cache uses
+type functionConfigurationAPI interface {
+	GetFunctionConfigurationWithContext(ctx aws.Context, input *lambda.GetFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error)
+	GetFunctionUrlConfigWithContext(ctx aws.Context, input *lambda.GetFunctionUrlConfigInput, opts ...request.Option) (*lambda.GetFunctionUrlConfigOutput, error)
+}
+
+// functionMetadata is the configuration of a function with the fields the SDK does not know
+type functionMetadata struct {
+	*lambda.FunctionConfiguration
+	Logging *loggingConfig // nil if the function has no LoggingConfig
+}
+
+// metadataCache caches GetFunctionConfiguration for a run, and GetFunctionUrlConfig which is read through it.
+// Concurrent lookups of the same function share one API call, and errors are not cached. Every mutation
+// of a function must invalidate it.
+type metadataCache struct {
+	api      functionConfigurationAPI
+	disabled bool // -no-metadata-cache
+
+	mu      sync.Mutex
+	entries map[string]*metadataEntry
+}
+
+type metadataEntry struct {
+	done  chan struct{} // closed when value and err are set
+	value interface{}
+	err   error
+}
+
+func newMetadataCache(api functionConfigurationAPI, disabled bool) *metadataCache {
+	return &metadataCache{
+		api:      api,
+		disabled: disabled,
+		entries:  make(map[string]*metadataEntry),
+	}
+}
+
+func metadataKey(function, qualifier string) string {
+	return function + "@" + qualifier
+}
+
+// functionURLKey is the key of the Function URL, which a function name can not collide with
+func functionURLKey(function, qualifier string) string {
+	return "url " + metadataKey(function, qualifier)
+}
+
+// get returns the configuration of the function. qualifier can be empty.
+func (c *metadataCache) get(ctx context.Context, function, qualifier string) (*functionMetadata, error) {
+	v, err := c.load(ctx, metadataKey(function, qualifier), func() (interface{}, error) {
+		return c.fetch(ctx, function, qualifier)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*functionMetadata), nil
+}
+
+// refresh fetches the configuration of the function again, for a caller which waits for it to change
+func (c *metadataCache) refresh(ctx context.Context, function, qualifier string) (*functionMetadata, error) {
+	c.invalidate(function, qualifier)
+	return c.get(ctx, function, qualifier)
+}
+
+// functionURL returns the Function URL of the function. qualifier can be empty.
+func (c *metadataCache) functionURL(ctx context.Context, function, qualifier string) (*functionURLConfig, error) {
+	v, err := c.load(ctx, functionURLKey(function, qualifier), func() (interface{}, error) {
+		return c.fetchFunctionURL(ctx, function, qualifier)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*functionURLConfig), nil
+}
+
+// load returns the value of the key, calling fetch if it is not cached or the cache is disabled
+func (c *metadataCache) load(ctx context.Context, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if c.disabled {
+		return fetch()
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &metadataEntry{done: make(chan struct{})}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-e.done:
+			return e.value, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	e.value, e.err = fetch()
+	close(e.done)
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	return e.value, e.err
+}
+
+// invalidate forgets the function, after the tool changed it
+func (c *metadataCache) invalidate(function, qualifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, metadataKey(function, qualifier))
+	delete(c.entries, functionURLKey(function, qualifier))
+}
+
+func (c *metadataCache) fetch(ctx context.Context, function, qualifier string) (*functionMetadata, error) {
+	input := &lambda.GetFunctionConfigurationInput{FunctionName: aws.String(function)}
+	if qualifier != "" {
+		input.Qualifier = aws.String(qualifier)
+	}
+	var logging *loggingConfig
+	conf, err := c.api.GetFunctionConfigurationWithContext(ctx, input, withLoggingConfig(&logging))
+	if err != nil {
+		return nil, fmt.Errorf("GetFunctionConfiguration, %s: %w", function, err)
+	}
+	return &functionMetadata{FunctionConfiguration: conf, Logging: logging}, nil
+}
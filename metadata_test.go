@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// countingConfigurations counts GetFunctionConfiguration calls per function, and fails while fail is set
+type countingConfigurations struct {
+	mu    sync.Mutex
+	calls map[string]int
+	fail  int32
+}
+
+func (c *countingConfigurations) GetFunctionConfigurationWithContext(ctx aws.Context, input *lambda.GetFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	key := metadataKey(aws.StringValue(input.FunctionName), aws.StringValue(input.Qualifier))
+	c.mu.Lock()
+	c.calls[key]++
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond) // let concurrent lookups pile up
+	if atomic.LoadInt32(&c.fail) != 0 {
+		return nil, errors.New("throttled")
+	}
+	return &lambda.FunctionConfiguration{FunctionName: input.FunctionName, Version: input.Qualifier}, nil
+}
+
+// GetFunctionUrlConfigWithContext answers a Function URL for the function "a" only
+func (c *countingConfigurations) GetFunctionUrlConfigWithContext(ctx aws.Context, input *lambda.GetFunctionUrlConfigInput, opts ...request.Option) (*lambda.GetFunctionUrlConfigOutput, error) {
+	function := aws.StringValue(input.FunctionName)
+	c.mu.Lock()
+	c.calls[functionURLKey(function, aws.StringValue(input.Qualifier))]++
+	c.mu.Unlock()
+	if function != "a" {
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "The resource you requested does not exist.", nil)
+	}
+	return &lambda.GetFunctionUrlConfigOutput{FunctionUrl: aws.String("https://a.lambda-url.us-east-1.on.aws/"), AuthType: aws.String(functionURLAuthIAM)}, nil
+}
+
+// noFunctionURL answers GetFunctionUrlConfig of a function without a Function URL
+type noFunctionURL struct{}
+
+func (noFunctionURL) GetFunctionUrlConfigWithContext(ctx aws.Context, input *lambda.GetFunctionUrlConfigInput, opts ...request.Option) (*lambda.GetFunctionUrlConfigOutput, error) {
+	return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "The resource you requested does not exist.", nil)
+}
+
+func (c *countingConfigurations) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[key]
+}
+
+func TestMetadataCacheConcurrent(t *testing.T) {
+	api := &countingConfigurations{calls: make(map[string]int)}
+	cache := newMetadataCache(api, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, fn := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(fn string) {
+				defer wg.Done()
+				conf, err := cache.get(context.Background(), fn, "live")
+				if err != nil || aws.StringValue(conf.FunctionName) != fn {
+					t.Errorf("got %v %v", conf, err)
+				}
+			}(fn)
+		}
+	}
+	wg.Wait()
+	for _, fn := range []string{"a", "b"} {
+		if n := api.count(metadataKey(fn, "live")); n != 1 {
+			t.Errorf("%s: %d calls, want 1", fn, n)
+		}
+	}
+
+	if _, err := cache.get(context.Background(), "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.count(metadataKey("a", "")); n != 1 {
+		t.Errorf("a qualifier is a different key, got %d calls", n)
+	}
+
+	cache.invalidate("a", "live")
+	if _, err := cache.get(context.Background(), "a", "live"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.count(metadataKey("a", "live")); n != 2 {
+		t.Errorf("invalidated function must be fetched again, got %d calls", n)
+	}
+	if _, err := cache.refresh(context.Background(), "a", "live"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.count(metadataKey("a", "live")); n != 3 {
+		t.Errorf("refresh must fetch the function again, got %d calls", n)
+	}
+}
+
+func TestMetadataCacheErrors(t *testing.T) {
+	api := &countingConfigurations{calls: make(map[string]int), fail: 1}
+	cache := newMetadataCache(api, false)
+	if _, err := cache.get(context.Background(), "a", ""); err == nil {
+		t.Fatal("error must be returned")
+	}
+	atomic.StoreInt32(&api.fail, 0)
+	if _, err := cache.get(context.Background(), "a", ""); err != nil {
+		t.Errorf("error must not be cached, got %v", err)
+	}
+
+	disabled := newMetadataCache(api, true)
+	for i := 0; i < 3; i++ {
+		disabled.get(context.Background(), "b", "")
+	}
+	if n := api.count(metadataKey("b", "")); n != 3 {
+		t.Errorf("disabled cache must call every time, got %d calls", n)
+	}
+}
+
+func TestMetadataCacheFunctionURL(t *testing.T) {
+	api := &countingConfigurations{calls: make(map[string]int)}
+	cache := newMetadataCache(api, false)
+	for i := 0; i < 2; i++ {
+		conf, err := cache.functionURL(context.Background(), "a", "live")
+		if err != nil || conf.FunctionUrl != "https://a.lambda-url.us-east-1.on.aws/" || conf.AuthType != functionURLAuthIAM {
+			t.Fatalf("got %+v %v", conf, err)
+		}
+	}
+	if n := api.count(functionURLKey("a", "live")); n != 1 {
+		t.Errorf("the Function URL must be cached, got %d calls", n)
+	}
+	if n := api.count(metadataKey("a", "live")); n != 0 {
+		t.Errorf("GetFunctionConfiguration must not be called, got %d calls", n)
+	}
+	cache.invalidate("a", "live")
+	if _, err := cache.functionURL(context.Background(), "a", "live"); err != nil || api.count(functionURLKey("a", "live")) != 2 {
+		t.Errorf("an invalidated Function URL must be fetched again, got %v", err)
+	}
+
+	if _, err := cache.functionURL(context.Background(), "b", ""); err == nil || !strings.Contains(err.Error(), "b has no Function URL") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// names of the metrics of a run, the same wherever they are exported
+const (
+	metricRunOutcome          = "nodeless_run_outcome"
+	metricRunElapsed          = "nodeless_run_elapsed_seconds"
+	metricInvocationStart     = "nodeless_invocation_start"
+	metricInvocationDuration  = "nodeless_invocation_duration_seconds"
+	metricInvocationBilled    = "nodeless_invocation_billed_duration_seconds"
+	metricInvocationInit      = "nodeless_invocation_init_duration_seconds"
+	metricInvocationRestore   = "nodeless_invocation_restore_duration_seconds"
+	metricInvocationMaxMemory = "nodeless_invocation_max_memory_used_bytes"
+	metricInvocationErrors    = "nodeless_invocation_error_lines"
+	metricAPICalls            = "nodeless_aws_api_calls"
+	metricThrottledCalls      = "nodeless_logs_throttled_calls"
+	metricThrottleWait        = "nodeless_logs_throttle_wait_seconds"
+)
+
+// labelPair is a label of a metric or of a grouping key
+type labelPair struct {
+	Name  string
+	Value string
+}
+
+// labelValueEscaper escapes a label value of the text format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// runMetrics is the result of a run as metrics
+type runMetrics struct {
+	Outcome        verdictOutcome
+	Report         *reportMetrics // nil if REPORT is not observed
+	Errors         int
+	Elapsed        time.Duration
+	APICalls       map[string]int // AWS operation to the number of calls, nil for a local function
+	ThrottledCalls int
+	ThrottleWait   time.Duration
+}
+
+// writeText writes the metrics in the Prometheus text format, in a fixed order
+func (m *runMetrics) writeText(w io.Writer) error {
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	sample := func(name string, labels []labelPair, v float64) {
+		b.WriteString(name)
+		if len(labels) > 0 {
+			parts := make([]string, len(labels))
+			for i, l := range labels {
+				parts[i] = fmt.Sprintf(`%s="%s"`, l.Name, labelValueEscaper.Replace(l.Value))
+			}
+			b.WriteString("{" + strings.Join(parts, ",") + "}")
+		}
+		fmt.Fprintf(&b, " %g\n", v)
+	}
+	boolValue := func(ok bool) float64 {
+		if ok {
+			return 1
+		}
+		return 0
+	}
+
+	gauge(metricRunOutcome, "1 for the outcome of the run, 0 for the others")
+	for _, o := range []verdictOutcome{outcomeSuccess, outcomeFailure, outcomeError} {
+		sample(metricRunOutcome, []labelPair{{"outcome", string(o)}}, boolValue(m.Outcome == o))
+	}
+	gauge(metricRunElapsed, "wall time of the run")
+	sample(metricRunElapsed, nil, m.Elapsed.Seconds())
+	gauge(metricInvocationErrors, "error log lines of the invocation")
+	sample(metricInvocationErrors, nil, float64(m.Errors))
+
+	if r := m.Report; r != nil {
+		gauge(metricInvocationStart, "1 for how the execution environment was started")
+		for _, s := range []string{startCold, startWarm, startSnapStartRestore} {
+			sample(metricInvocationStart, []labelPair{{"type", s}}, boolValue(startType(r) == s))
+		}
+		gauge(metricInvocationDuration, "duration of the invocation from REPORT")
+		sample(metricInvocationDuration, nil, r.Duration/1000)
+		gauge(metricInvocationBilled, "billed duration of the invocation from REPORT")
+		sample(metricInvocationBilled, nil, r.BilledDuration/1000)
+		if r.ColdStart {
+			gauge(metricInvocationInit, "init duration of a cold start from REPORT")
+			sample(metricInvocationInit, nil, r.InitDuration/1000)
+		}
+		if r.RestoreDuration > 0 {
+			gauge(metricInvocationRestore, "restore duration of a SnapStart restore")
+			sample(metricInvocationRestore, nil, r.RestoreDuration/1000)
+		}
+		if r.MaxMemoryUsed > 0 {
+			gauge(metricInvocationMaxMemory, "max memory used by the invocation from REPORT")
+			sample(metricInvocationMaxMemory, nil, r.MaxMemoryUsed*1024*1024)
+		}
+	}
+
+	if m.APICalls != nil {
+		ops := make([]string, 0, len(m.APICalls))
+		for op := range m.APICalls {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		gauge(metricAPICalls, "AWS API calls of the run by operation")
+		for _, op := range ops {
+			sample(metricAPICalls, []labelPair{{"operation", op}}, float64(m.APICalls[op]))
+		}
+		gauge(metricThrottledCalls, "CloudWatch Logs calls throttled in the run")
+		sample(metricThrottledCalls, nil, float64(m.ThrottledCalls))
+		gauge(metricThrottleWait, "time the tail waited for throttling to cool down")
+		sample(metricThrottleWait, nil, m.ThrottleWait.Seconds())
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// apiCallCounter counts the AWS API calls of a run by operation
+type apiCallCounter struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newAPICallCounter() *apiCallCounter {
+	return &apiCallCounter{calls: make(map[string]int)}
+}
+
+// install counts the calls of every client made from the session, once a call is complete with its retries
+func (c *apiCallCounter) install(sess *session.Session) {
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "k8s-nodeless.APICallCounter", Fn: c.count})
+}
+
+func (c *apiCallCounter) count(r *request.Request) {
+	if r.Operation == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[r.Operation.Name]++
+}
+
+// snapshot returns a copy of the counts
+func (c *apiCallCounter) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[string]int, len(c.calls))
+	for k, v := range c.calls {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestRunMetricsWriteText(t *testing.T) {
+	m := &runMetrics{
+		Outcome:        outcomeFailure,
+		Report:         &reportMetrics{Duration: 1200, BilledDuration: 1300, MaxMemoryUsed: 64, InitDuration: 250, ColdStart: true},
+		Errors:         2,
+		Elapsed:        3500 * time.Millisecond,
+		APICalls:       map[string]int{"Invoke": 1, "DescribeLogStreams": 4},
+		ThrottledCalls: 1,
+		ThrottleWait:   500 * time.Millisecond,
+	}
+	var buf bytes.Buffer
+	if err := m.writeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP nodeless_run_outcome 1 for the outcome of the run, 0 for the others
+# TYPE nodeless_run_outcome gauge
+nodeless_run_outcome{outcome="success"} 0
+nodeless_run_outcome{outcome="failure"} 1
+nodeless_run_outcome{outcome="error"} 0
+# HELP nodeless_run_elapsed_seconds wall time of the run
+# TYPE nodeless_run_elapsed_seconds gauge
+nodeless_run_elapsed_seconds 3.5
+# HELP nodeless_invocation_error_lines error log lines of the invocation
+# TYPE nodeless_invocation_error_lines gauge
+nodeless_invocation_error_lines 2
+# HELP nodeless_invocation_start 1 for how the execution environment was started
+# TYPE nodeless_invocation_start gauge
+nodeless_invocation_start{type="cold"} 1
+nodeless_invocation_start{type="warm"} 0
+nodeless_invocation_start{type="snapstart-restore"} 0
+# HELP nodeless_invocation_duration_seconds duration of the invocation from REPORT
+# TYPE nodeless_invocation_duration_seconds gauge
+nodeless_invocation_duration_seconds 1.2
+# HELP nodeless_invocation_billed_duration_seconds billed duration of the invocation from REPORT
+# TYPE nodeless_invocation_billed_duration_seconds gauge
+nodeless_invocation_billed_duration_seconds 1.3
+# HELP nodeless_invocation_init_duration_seconds init duration of a cold start from REPORT
+# TYPE nodeless_invocation_init_duration_seconds gauge
+nodeless_invocation_init_duration_seconds 0.25
+# HELP nodeless_invocation_max_memory_used_bytes max memory used by the invocation from REPORT
+# TYPE nodeless_invocation_max_memory_used_bytes gauge
+nodeless_invocation_max_memory_used_bytes 6.7108864e+07
+# HELP nodeless_aws_api_calls AWS API calls of the run by operation
+# TYPE nodeless_aws_api_calls gauge
+nodeless_aws_api_calls{operation="DescribeLogStreams"} 4
+nodeless_aws_api_calls{operation="Invoke"} 1
+# HELP nodeless_logs_throttled_calls CloudWatch Logs calls throttled in the run
+# TYPE nodeless_logs_throttled_calls gauge
+nodeless_logs_throttled_calls 1
+# HELP nodeless_logs_throttle_wait_seconds time the tail waited for throttling to cool down
+# TYPE nodeless_logs_throttle_wait_seconds gauge
+nodeless_logs_throttle_wait_seconds 0.5
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s", buf.String())
+	}
+
+	// a local function without REPORT
+	buf.Reset()
+	(&runMetrics{Outcome: outcomeError}).writeText(&buf)
+	if bytes.Contains(buf.Bytes(), []byte("nodeless_invocation_duration_seconds")) || bytes.Contains(buf.Bytes(), []byte("nodeless_aws_api_calls")) {
+		t.Errorf("got\n%s", buf.String())
+	}
+}
+
+func TestAPICallCounter(t *testing.T) {
+	c := newAPICallCounter()
+	for _, name := range []string{"Invoke", "FilterLogEvents", "FilterLogEvents"} {
+		c.count(&request.Request{Operation: &request.Operation{Name: name}})
+	}
+	c.count(&request.Request{})
+	got := c.snapshot()
+	if len(got) != 2 || got["Invoke"] != 1 || got["FilterLogEvents"] != 2 {
+		t.Errorf("got %v", got)
+	}
+	got["Invoke"] = 10
+	if c.snapshot()["Invoke"] != 1 {
+		t.Errorf("the snapshot must be a copy")
+	}
+}
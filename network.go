@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// dialTimeout is the timeout to connect to each address of a host
+const dialTimeout = 5 * time.Second
+
+// networkOptions are how the AWS endpoints are reached
+type networkOptions struct {
+	dualStack  bool // use the dual-stack endpoints, which have IPv6 addresses
+	preferIPv6 bool // try the IPv6 addresses of a host first
+}
+
+// addNetworkFlags defines the flags of networkOptions, shared by the subcommands
+func addNetworkFlags(fs *flag.FlagSet) *networkOptions {
+	opts := &networkOptions{}
+	fs.BoolVar(&opts.dualStack, "dualstack", false, "use the dual-stack endpoints of Lambda, CloudWatch Logs and STS, which are reachable by IPv6")
+	fs.BoolVar(&opts.preferIPv6, "prefer-ipv6", false, "connect to the IPv6 addresses of an endpoint first")
+	return opts
+}
+
+// dualStackServices are the services whose dual-stack endpoints -dualstack uses
+var dualStackServices = map[string]bool{
+	endpoints.LambdaServiceID: true,
+	endpoints.LogsServiceID:   true,
+	endpoints.StsServiceID:    true,
+}
+
+// dualStackURL returns the dual-stack endpoint of the service, ex: https://lambda.us-east-1.api.aws
+func dualStackURL(service, region string) string {
+	suffix := "api.aws"
+	if strings.HasPrefix(region, "cn-") {
+		suffix = "api.amazonwebservices.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", service, region, suffix)
+}
+
+// dualStackResolver resolves dualStackServices to their dual-stack endpoints and others by base.
+// The SDK version we use resolves dual-stack endpoints only for S3.
+func dualStackResolver(base endpoints.Resolver) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if !dualStackServices[service] || region == "" || region == "aws-global" {
+			return base.EndpointFor(service, region, opts...)
+		}
+		partition := "aws"
+		if strings.HasPrefix(region, "cn-") {
+			partition = "aws-cn"
+		} else if strings.HasPrefix(region, "us-gov-") {
+			partition = "aws-us-gov"
+		}
+		return endpoints.ResolvedEndpoint{
+			URL:                dualStackURL(service, region),
+			PartitionID:        partition,
+			SigningRegion:      region,
+			SigningName:        service,
+			SigningNameDerived: true,
+			SigningMethod:      "v4",
+		}, nil
+	})
+}
+
+// ipResolver is the part of net.Resolver the dialer uses
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dialAttempt is a failed connection to an address of a host
+type dialAttempt struct {
+	ip  net.IP
+	err error
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// dialError is a failure to connect to every address of a host. It tells which addresses were tried,
+// as a host unreachable by one of IPv4 and IPv6 otherwise only fails with a slow timeout.
+type dialError struct {
+	address   string
+	attempts  []dialAttempt
+	dualStack bool
+}
+
+func (e *dialError) Error() string {
+	if len(e.attempts) == 0 {
+		return fmt.Sprintf("dial %s: no address", e.address)
+	}
+	tried := make([]string, len(e.attempts))
+	onlyIPv4 := true
+	for i, a := range e.attempts {
+		tried[i] = fmt.Sprintf("%s (%s): %s", a.ip, ipFamily(a.ip), a.err)
+		if a.ip.To4() == nil {
+			onlyIPv4 = false
+		}
+	}
+	msg := fmt.Sprintf("dial %s, tried %s", e.address, strings.Join(tried, "; "))
+	if onlyIPv4 && !e.dualStack {
+		msg += "; the endpoint has only IPv4 addresses, use -dualstack if the network is IPv6-only"
+	}
+	return msg
+}
+
+// Unwrap returns the error of the last attempt
+func (e *dialError) Unwrap() error {
+	if len(e.attempts) == 0 {
+		return nil
+	}
+	return e.attempts[len(e.attempts)-1].err
+}
+
+// diagnosticDialer connects to the addresses of a host one by one and returns a dialError
+// with every attempt when none of them is reachable
+type diagnosticDialer struct {
+	dialer     *net.Dialer
+	resolver   ipResolver
+	preferIPv6 bool
+	dualStack  bool
+}
+
+func newDiagnosticDialer(opts networkOptions) *diagnosticDialer {
+	return &diagnosticDialer{
+		dialer:     &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second},
+		resolver:   net.DefaultResolver,
+		preferIPv6: opts.preferIPv6,
+		dualStack:  opts.dualStack,
+	}
+}
+
+// DialContext is the DialContext of http.Transport
+func (d *diagnosticDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	ips = orderAddrs(ips, d.preferIPv6)
+
+	dialErr := &dialError{address: address, dualStack: d.dualStack}
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr.attempts = append(dialErr.attempts, dialAttempt{ip: ip, err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, dialErr
+}
+
+// orderAddrs returns the IPv6 addresses first if preferIPv6, keeping the order of the resolver otherwise
+func orderAddrs(ips []net.IP, preferIPv6 bool) []net.IP {
+	if !preferIPv6 {
+		return ips
+	}
+	ret := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			ret = append(ret, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// newHTTPClient returns the HTTP client of every AWS client of this tool with -dualstack or -prefer-ipv6,
+// or nil for the default client of the SDK, whose dialer races IPv4 and IPv6 (Happy Eyeballs) instead of
+// trying the addresses one by one
+func newHTTPClient(opts networkOptions) *http.Client {
+	if !opts.dualStack && !opts.preferIPv6 {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDiagnosticDialer(opts).DialContext
+	return &http.Client{Transport: transport}
+}
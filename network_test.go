@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// staticResolver resolves every host to the same addresses
+type staticResolver []string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ret := make([]net.IPAddr, len(r))
+	for i, s := range r {
+		ret[i] = net.IPAddr{IP: net.ParseIP(s)}
+	}
+	return ret, nil
+}
+
+// loopbackListeners listens on the same port of 127.0.0.1 and ::1, skipping the test if IPv6 is not available
+func loopbackListeners(t *testing.T) (string, net.Listener, net.Listener) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		v4, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := strconv.Itoa(v4.Addr().(*net.TCPAddr).Port)
+		v6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+		if err != nil {
+			v4.Close()
+			l, err := net.Listen("tcp6", "[::1]:0")
+			if err != nil {
+				t.Skipf("IPv6 loopback is not available: %s", err)
+			}
+			l.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			v4.Close()
+			v6.Close()
+		})
+		for _, l := range []net.Listener{v4, v6} {
+			go func(l net.Listener) {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}(l)
+		}
+		return port, v4, v6
+	}
+	t.Skip("no port is free on both 127.0.0.1 and ::1")
+	return "", nil, nil
+}
+
+func TestDiagnosticDialerPreferIPv6(t *testing.T) {
+	port, _, _ := loopbackListeners(t)
+	tests := []struct {
+		preferIPv6 bool
+		want       string
+	}{
+		{false, "127.0.0.1"},
+		{true, "::1"},
+	}
+	for _, tt := range tests {
+		d := newDiagnosticDialer(networkOptions{preferIPv6: tt.preferIPv6})
+		d.resolver = staticResolver{"127.0.0.1", "::1"}
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("lambda.example", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		conn.Close()
+		if got != tt.want {
+			t.Errorf("prefer-ipv6 %v: connected to %s, want %s", tt.preferIPv6, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnosticDialerFallback(t *testing.T) {
+	port, v4, _ := loopbackListeners(t)
+	v4.Close()
+	d := newDiagnosticDialer(networkOptions{})
+	d.resolver = staticResolver{"127.0.0.1", "::1"}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("lambda.example", port))
+	if err != nil {
+		t.Fatalf("the IPv6 address must be tried after the IPv4 one, %s", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "::1" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestDiagnosticDialerError(t *testing.T) {
+	port, v4, v6 := loopbackListeners(t)
+	v4.Close()
+	v6.Close()
+
+	d := newDiagnosticDialer(networkOptions{})
+	d.resolver = staticResolver{"127.0.0.1", "::1"}
+	_, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("lambda.example", port))
+	var dialErr *dialError
+	if !errors.As(err, &dialErr) {
+		t.Fatalf("got %v", err)
+	}
+	if len(dialErr.attempts) != 2 {
+		t.Errorf("every address must be tried, got %d", len(dialErr.attempts))
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "127.0.0.1 (ipv4)") || !strings.Contains(msg, "::1 (ipv6)") || !strings.Contains(msg, "lambda.example:"+port) {
+		t.Errorf("got %s", msg)
+	}
+	if strings.Contains(msg, "-dualstack") {
+		t.Errorf("no hint when an IPv6 address is tried, got %s", msg)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("the error of the attempt must be unwrapped, got %T", errors.Unwrap(err))
+	}
+
+	d.resolver = staticResolver{"127.0.0.1"}
+	_, err = d.DialContext(context.Background(), "tcp", net.JoinHostPort("lambda.example", port))
+	if err == nil || !strings.Contains(err.Error(), "use -dualstack") {
+		t.Errorf("only IPv4 addresses must hint -dualstack, got %v", err)
+	}
+	d.dualStack = true
+	_, err = d.DialContext(context.Background(), "tcp", net.JoinHostPort("lambda.example", port))
+	if err == nil || strings.Contains(err.Error(), "use -dualstack") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")}
+	join := func(ips []net.IP) string {
+		s := make([]string, len(ips))
+		for i, ip := range ips {
+			s[i] = ip.String()
+		}
+		return strings.Join(s, ",")
+	}
+	if got := join(orderAddrs(ips, false)); got != "10.0.0.1,2001:db8::1,10.0.0.2,2001:db8::2" {
+		t.Errorf("got %s", got)
+	}
+	if got := join(orderAddrs(ips, true)); got != "2001:db8::1,2001:db8::2,10.0.0.1,10.0.0.2" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestDualStackResolver(t *testing.T) {
+	base := endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		return endpoints.ResolvedEndpoint{URL: "https://base/" + service}, nil
+	})
+	r := dualStackResolver(base)
+	tests := []struct {
+		service, region string
+		url, partition  string
+	}{
+		{"lambda", "us-east-1", "https://lambda.us-east-1.api.aws", "aws"},
+		{"logs", "ap-northeast-1", "https://logs.ap-northeast-1.api.aws", "aws"},
+		{"sts", "us-gov-west-1", "https://sts.us-gov-west-1.api.aws", "aws-us-gov"},
+		{"lambda", "cn-north-1", "https://lambda.cn-north-1.api.amazonwebservices.com.cn", "aws-cn"},
+		{"codedeploy", "us-east-1", "https://base/codedeploy", ""},
+		{"sts", "aws-global", "https://base/sts", ""},
+	}
+	for _, tt := range tests {
+		got, err := r.EndpointFor(tt.service, tt.region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.URL != tt.url || got.PartitionID != tt.partition {
+			t.Errorf("%s %s: got %+v", tt.service, tt.region, got)
+		}
+		if tt.partition != "" && (got.SigningRegion != tt.region || got.SigningName != tt.service) {
+			t.Errorf("%s %s: must be signed for the region and the service, got %+v", tt.service, tt.region, got)
+		}
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	if c := newHTTPClient(networkOptions{}); c != nil {
+		t.Errorf("the default client of the SDK must be kept without the flags, got %v", c)
+	}
+	for _, opts := range []networkOptions{{dualStack: true}, {preferIPv6: true}} {
+		if c := newHTTPClient(opts); c == nil {
+			t.Errorf("%+v: the diagnostic dialer must be installed", opts)
+		}
+	}
+	opts, err := newAWSSessionOptions("us-east-1", networkOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Config.HTTPClient != nil {
+		t.Errorf("got %v", opts.Config.HTTPClient)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// invokeNoLogs invokes the function asynchronously and ends with the status code and the request id of the
+// response, without any call to CloudWatch Logs, for credentials which may invoke the function but not read
+// its logs. The outcome of the function is not known.
+func (sl *AWSServerless) invokeNoLogs(ctx context.Context, api invokeAPI) error {
+	sl.summarize = true
+	resp, requestID, err := sl.invoke(ctx, api, lambda.InvocationTypeEvent)
+	if err != nil {
+		return err
+	}
+	sl.statusCode = int(aws.Int64Value(resp.StatusCode))
+	if err := checkInvokeStatus(lambda.InvocationTypeEvent, sl.statusCode); err != nil {
+		return err
+	}
+	sl.requestID = requestID
+	logger.Infof("invoked %s asynchronously: status %d, request id %s; no log is tailed by -no-logs", sl.qualifiedName(), sl.statusCode, requestID)
+	return nil
+}
+
+// planNoLogs describes the invocation of -no-logs in a plan
+func (sl *AWSServerless) planNoLogs() ([]plannedCall, error) {
+	params := []planParam{
+		{"FunctionName", sl.unqualifiedName()},
+		{"InvocationType", lambda.InvocationTypeEvent},
+		{"Payload", fmt.Sprintf("%d bytes, sha256:%s", len(sl.payload), sl.integrity.sent)},
+	}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	if sl.clientContext != "" {
+		params = append(params, planParam{"ClientContext", fmt.Sprintf("%d bytes base64-encoded", len(sl.clientContext))})
+	}
+	note := "the run ends with the status code and the request id, no log is tailed"
+	if p := sl.invokeRetry; p.maxAttempts > 1 {
+		note += fmt.Sprintf("; retried on TooManyRequestsException and other transient errors, up to %d attempts within %s", p.maxAttempts, p.maxElapsed)
+	}
+	return []plannedCall{{Service: "lambda", Operation: "Invoke", Params: params, Note: note}}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+func TestInvokeNoLogs(t *testing.T) {
+	logs := setTestLogger(t)
+	ref, err := ParseFunctionRef("orders-fn:live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := &AWSServerless{funcName: "orders-fn:live", ref: ref, payload: `{"id": 1}`, noLogs: true, phases: newPhaseTracker(time.Now())}
+	api := &countingInvoke{}
+	if err := sl.invokeNoLogs(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if api.calls != 1 || sl.invokedType != lambda.InvocationTypeEvent || sl.statusCode != 202 || sl.requestID != "r1" || !sl.summarize {
+		t.Errorf("got %d calls, %s %d %s", api.calls, sl.invokedType, sl.statusCode, sl.requestID)
+	}
+	if logs.FilterMessageSnippet("invoked orders-fn:live asynchronously: status 202, request id r1").Len() != 1 {
+		t.Errorf("the status and the request id are not printed: %v", logs.All())
+	}
+	if note := sl.outcomeNote(); !strings.Contains(note, "status 202") {
+		t.Errorf("got %s", note)
+	}
+}
+
+func TestParseArgsNoLogs(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-no-logs"}, noenv)
+	if err != nil || !config.noLogs {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-no-logs", "-invocation-type", "event"}, noenv); err != nil {
+		t.Errorf("got %v", err)
+	}
+	for _, extra := range [][]string{
+		{"-invocation-type", "request-response"},
+		{"-via", "url"},
+		{"-concurrency", "2"},
+		{"-warmup", "2"},
+		{"-retry-on-failure"},
+		{"-xray"},
+		{"-timeline"},
+		{"-completion-strategy", "logs"},
+	} {
+		args := append([]string{"-func", "f", "-no-logs"}, extra...)
+		if _, err := parseArgs(args, noenv); err == nil || !strings.Contains(err.Error(), "-no-logs") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
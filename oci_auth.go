@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ociAuthAPIKey            = "api_key"
+	ociAuthInstancePrincipal = "instance_principal"
+	ociDefaultProfile        = "DEFAULT"
+	ociDefaultConfigFile     = "~/.oci/config"
+	ociMetadataURL           = "http://169.254.169.254/opc/v2"
+	ociTenancyOUPrefix       = "opc-tenant:" // of the OU of the certificate of an instance
+)
+
+// ociSigner signs the requests to the OCI APIs by the HTTP Signatures the OCI SDKs send
+type ociSigner struct {
+	keyID string // TENANCY/USER/FINGERPRINT of an API key, or ST$TOKEN of a security token
+	key   *rsa.PrivateKey
+}
+
+// sign signs the request whose body is body, adding the date and for a body its length and hash
+func (s *ociSigner) sign(req *http.Request, body []byte) error {
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	headers := []string{"date", "(request-target)", "host"}
+	if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+		sum := sha256.Sum256(body)
+		req.Header.Set("X-Content-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		headers = append(headers, "content-length", "content-type", "x-content-sha256")
+	}
+	digest := sha256.Sum256([]byte(ociSigningString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return fmt.Errorf("sign %s: %w", req.URL.Host, err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature version="1",keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		s.keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// ociSigningString returns the "name: value" lines of the headers which are signed
+func ociSigningString(req *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, h+": "+strings.ToLower(req.Method)+" "+req.URL.RequestURI())
+		case "host":
+			lines = append(lines, h+": "+req.URL.Host)
+		default:
+			lines = append(lines, h+": "+req.Header.Get(h))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseOCIPrivateKey parses a PEM RSA key in PKCS#1 or PKCS#8, encrypted with the passphrase if it is
+func parseOCIPrivateKey(data []byte, passphrase string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key")
+	}
+	der := block.Bytes
+	// the OCI CLI encrypts a key with the legacy encryption of PEM
+	if x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("the key is encrypted, pass_phrase is needed")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("decrypt the key: %w", err)
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// ociHomePath expands a leading ~ of a path of the OCI config
+func ociHomePath(path string, getenv func(string) string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, _ := homeDir(getenv); home != "" {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// ociProfileSigner returns the signer and the region of a profile of the OCI config file, which
+// takes the keys it does not have from DEFAULT as the OCI CLI does. A profile of
+// "oci session authenticate" signs with its security token.
+func ociProfileSigner(configFile, profile string, getenv func(string) string) (*ociSigner, string, error) {
+	path := ociHomePath(configFile, getenv)
+	keys, err := readProfileSection(path, ociDefaultProfile)
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", path, err)
+	}
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	if profile != ociDefaultProfile {
+		section, err := readProfileSection(path, profile)
+		if err != nil {
+			return nil, "", fmt.Errorf("read %s: %w", path, err)
+		}
+		if section == nil {
+			return nil, "", fmt.Errorf("no profile %s in %s", profile, path)
+		}
+		for k, v := range section {
+			keys[k] = v
+		}
+	} else if len(keys) == 0 {
+		return nil, "", fmt.Errorf("no profile %s in %s, run oci setup config or give -oci-auth %s", profile, path, ociAuthInstancePrincipal)
+	}
+
+	var missing []string
+	for _, k := range []string{"key_file", "tenancy", "region"} {
+		if keys[k] == "" {
+			missing = append(missing, k)
+		}
+	}
+	tokenFile := keys["security_token_file"]
+	if tokenFile == "" {
+		for _, k := range []string{"user", "fingerprint"} {
+			if keys[k] == "" {
+				missing = append(missing, k)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, "", fmt.Errorf("profile %s of %s has no %s", profile, path, strings.Join(missing, ", "))
+	}
+
+	keyFile := ociHomePath(keys["key_file"], getenv)
+	pemKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("read key_file of profile %s: %w", profile, err)
+	}
+	key, err := parseOCIPrivateKey(pemKey, keys["pass_phrase"])
+	if err != nil {
+		return nil, "", fmt.Errorf("key_file %s: %w", keyFile, err)
+	}
+	signer := &ociSigner{keyID: keys["tenancy"] + "/" + keys["user"] + "/" + keys["fingerprint"], key: key}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(ociHomePath(tokenFile, getenv))
+		if err != nil {
+			return nil, "", fmt.Errorf("read security_token_file of profile %s: %w", profile, err)
+		}
+		signer.keyID = "ST$" + strings.TrimSpace(string(token))
+	}
+	return signer, keys["region"], nil
+}
+
+// ociInstancePrincipal gets a security token of the instance, a node of OKE, with the certificate
+// of the instance metadata, as the OCI SDKs do. The token lasts 20 minutes, longer than a run.
+type ociInstancePrincipal struct {
+	client      *http.Client
+	metadataURL string
+	authURL     func(region string) string
+}
+
+// metadata returns a value of the instance metadata service v2
+func (p *ociInstancePrincipal) metadata(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.metadataURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer Oracle")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata %s, is this an OCI instance?: %w", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata %s: %s", path, resp.Status)
+	}
+	return body, nil
+}
+
+// signer returns the signer of the security token and the region of the instance
+func (p *ociInstancePrincipal) signer(ctx context.Context) (*ociSigner, string, error) {
+	region, err := p.metadata(ctx, "/instance/canonicalRegionName")
+	if err != nil {
+		return nil, "", err
+	}
+	var pems [3][]byte
+	for i, name := range []string{"cert.pem", "key.pem", "intermediate.pem"} {
+		if pems[i], err = p.metadata(ctx, "/identity/"+name); err != nil {
+			return nil, "", err
+		}
+	}
+	block, _ := pem.Decode(pems[0])
+	if block == nil {
+		return nil, "", fmt.Errorf("instance metadata cert.pem: no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("instance metadata cert.pem: %w", err)
+	}
+	tenancy := ""
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if strings.HasPrefix(ou, ociTenancyOUPrefix) {
+			tenancy = strings.TrimPrefix(ou, ociTenancyOUPrefix)
+		}
+	}
+	if tenancy == "" {
+		return nil, "", fmt.Errorf("instance metadata cert.pem: no tenancy in the subject %s", cert.Subject)
+	}
+	certKey, err := parseOCIPrivateKey(pems[1], "")
+	if err != nil {
+		return nil, "", fmt.Errorf("instance metadata key.pem: %w", err)
+	}
+
+	sessionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, "", err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&sessionKey.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	var intermediates []string
+	for rest := pems[2]; ; {
+		var b *pem.Block
+		if b, rest = pem.Decode(rest); b == nil {
+			break
+		}
+		intermediates = append(intermediates, base64.StdEncoding.EncodeToString(b.Bytes))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"certificate":              base64.StdEncoding.EncodeToString(cert.Raw),
+		"publicKey":                base64.StdEncoding.EncodeToString(publicKey),
+		"intermediateCertificates": intermediates,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	reg := strings.TrimSpace(string(region))
+	req, err := http.NewRequest(http.MethodPost, p.authURL(reg)+"/v1/x509", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	fingerprint := sha1.Sum(cert.Raw)
+	certSigner := &ociSigner{keyID: tenancy + "/fed-x509/" + strings.Replace(fmt.Sprintf("% x", fingerprint), " ", ":", -1), key: certKey}
+	if err := certSigner.sign(req, body); err != nil {
+		return nil, "", err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", fmt.Errorf("get a security token of the instance: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("get a security token of the instance: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("get a security token of the instance: %s: %s", resp.Status, truncateMiddle(string(respBody), 512))
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(respBody, &token); err != nil || token.Token == "" {
+		return nil, "", fmt.Errorf("get a security token of the instance: no token in %s", truncateMiddle(string(respBody), 512))
+	}
+	return &ociSigner{keyID: "ST$" + token.Token, key: sessionKey}, reg, nil
+}
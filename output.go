@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// recordWriter writes each log record by a single Write call under a lock, so that records
+// of concurrent sinks are never interleaved. If syncEach is set, the record is synced at once
+// so that what was logged survives an abrupt kill.
+type recordWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	syncEach bool
+}
+
+func newRecordWriter(w io.Writer, syncEach bool) *recordWriter {
+	return &recordWriter{w: w, syncEach: syncEach}
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if r.syncEach {
+		if err := r.sync(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *recordWriter) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sync()
+}
+
+// sync syncs the underlying writer. Pipes and terminals can not be synced, which is not an error.
+func (r *recordWriter) sync() error {
+	s, ok := r.w.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	if err := s.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingSyncer struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (c *countingSyncer) Sync() error {
+	c.syncs++
+	return nil
+}
+
+func TestRecordWriterSyncEach(t *testing.T) {
+	var buf countingSyncer
+	w := newRecordWriter(&buf, true)
+	w.Write([]byte("a\n"))
+	w.Write([]byte("b\n"))
+	if buf.syncs != 2 || buf.String() != "a\nb\n" {
+		t.Errorf("got %d syncs, %q", buf.syncs, buf.String())
+	}
+}
+
+// tortureChildEnv makes the test binary run as a child which invokes a function of the fake OpenFaaS
+// gateway at the URL with -json, and tails its logs
+const tortureChildEnv = "NODELESS_TORTURE_GATEWAY"
+
+func runTortureChild(gatewayURL string) {
+	config := &Config{funcName: "figlet", json: true, payload: `{"id":1}`, openfaasURL: gatewayURL, openfaasUser: "admin", openfaasPassword: "secret"}
+	logger = NewLogger(config)
+	sl, err := NewOpenFaaSServerless(config)
+	if err != nil {
+		panic(err)
+	}
+	sl.logGrace = 50 * time.Millisecond
+	sl.Invoke(context.Background())
+	// as the command exits, without the output of the test framework
+	os.Exit(0)
+}
+
+func TestJSONOutputSurvivesKill(t *testing.T) {
+	if url := os.Getenv(tortureChildEnv); url != "" {
+		runTortureChild(url)
+		return
+	}
+	if testing.Short() {
+		t.Skip("torture test")
+	}
+
+	f := newFakeOpenFaaS(t)
+	var lines []string
+	for i := 0; i < 3000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d %s", i, strings.Repeat("x", i%2000)))
+	}
+	f.mu.Lock()
+	f.lines = lines
+	f.mu.Unlock()
+	completed := 0
+	for round := 0; round < 10; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestJSONOutputSurvivesKill$")
+		cmd.Env = append(os.Environ(), tortureChildEnv+"="+f.URL+"/")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan []byte)
+		go func() {
+			buf, _ := ioutil.ReadAll(stdout)
+			done <- buf
+		}()
+		// from the invocation to the summary of the run
+		time.Sleep(time.Duration(5+rand.Intn(400)) * time.Millisecond)
+		cmd.Process.Kill()
+		out := <-done
+		cmd.Wait()
+
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			t.Errorf("round %d: the output ends with a partial line", round)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		lines, summary := 0, false
+		for scanner.Scan() {
+			var rec map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("round %d: line %d is not JSON, %s: %q", round, lines, err, scanner.Text())
+			}
+			summary = summary || rec["msg"] == "summary"
+			lines++
+		}
+		// a run which finished before the kill has its summary
+		if cmd.ProcessState.Success() {
+			completed++
+			if !summary {
+				t.Errorf("round %d: the run finished without the summary", round)
+			}
+		}
+	}
+	t.Logf("%d of 10 runs finished before the kill", completed)
+}
+
+// slowSubscriber takes a while to finish the run, as a webhook or an exporter
+type slowSubscriber struct {
+	finished time.Time
+}
+
+func (s *slowSubscriber) handle(ev busEvent) error {
+	if _, ok := ev.(runCompleted); ok {
+		time.Sleep(100 * time.Millisecond)
+		s.finished = time.Now()
+	}
+	return nil
+}
+
+func TestSummaryBeforeSlowTeardown(t *testing.T) {
+	logs := setTestLogger(t)
+	program := writeScript(t, t.TempDir(), "echo hello\n")
+	sl, err := NewLocalServerless(&Config{funcName: program, localTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowSubscriber{}
+	sl.bus.subscribe("webhook", slow, subscribeOptions{buffer: 8, required: true})
+	if err := sl.Invoke(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	summary := logs.FilterMessage("summary").All()
+	if len(summary) != 1 || slow.finished.IsZero() {
+		t.Fatalf("got %d summaries, the subscriber finished at %s", len(summary), slow.finished)
+	}
+	if !summary[0].Time.Before(slow.finished) {
+		t.Errorf("the summary waits for the slow subscriber")
+	}
+}
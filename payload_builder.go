@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// payloadItems is a repeatable flag of key=value payload items
+type payloadItems []string
+
+func (p *payloadItems) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *payloadItems) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// buildPayload builds a JSON object from httpie style items.
+//
+//	key=value      string value
+//	key:=3         raw JSON value
+//	a.b.c=value    nested object
+//	a.0=value      array element
+//	a\.b=value     literal dot in the key
+func buildPayload(items []string) (string, error) {
+	root := make(map[string]interface{})
+	for _, item := range items {
+		path, value, err := parsePayloadItem(item)
+		if err != nil {
+			return "", err
+		}
+		if _, err := setPayloadPath(root, path, value, item); err != nil {
+			return "", err
+		}
+	}
+	buf, err := json.Marshal(root)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// parsePayloadItem splits an item into the key path and the value
+func parsePayloadItem(item string) ([]string, interface{}, error) {
+	var path []string
+	var seg strings.Builder
+	for i := 0; i < len(item); i++ {
+		c := item[i]
+		switch {
+		case c == '\\' && i+1 < len(item):
+			i++
+			seg.WriteByte(item[i])
+		case c == '.':
+			if seg.Len() == 0 {
+				return nil, nil, fmt.Errorf("empty key segment, %s", item)
+			}
+			path = append(path, seg.String())
+			seg.Reset()
+		case c == ':' && i+1 < len(item) && item[i+1] == '=':
+			if seg.Len() == 0 {
+				return nil, nil, fmt.Errorf("empty key segment, %s", item)
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(item[i+2:]), &v); err != nil {
+				return nil, nil, fmt.Errorf("invalid JSON value, %s: %w", item, err)
+			}
+			return append(path, seg.String()), v, nil
+		case c == '=':
+			if seg.Len() == 0 {
+				return nil, nil, fmt.Errorf("empty key segment, %s", item)
+			}
+			return append(path, seg.String()), item[i+1:], nil
+		default:
+			seg.WriteByte(c)
+		}
+	}
+	return nil, nil, fmt.Errorf("key=value or key:=json required, %s", item)
+}
+
+// maxPayloadArrayIndex bounds an array index of an item, as the array is filled with null up to it
+const maxPayloadArrayIndex = 1023
+
+// setPayloadPath sets the value at the path under the container and returns the container,
+// which is newly created if the container is nil.
+func setPayloadPath(container interface{}, path []string, value interface{}, item string) (interface{}, error) {
+	seg := path[0]
+	index, numErr := strconv.Atoi(seg)
+	if container == nil {
+		if numErr == nil && index >= 0 {
+			container = []interface{}{}
+		} else {
+			container = make(map[string]interface{})
+		}
+	}
+
+	var current interface{}
+	switch c := container.(type) {
+	case map[string]interface{}:
+		current = c[seg]
+	case []interface{}:
+		if numErr != nil || index < 0 {
+			return nil, fmt.Errorf("%s: %q is not an array index", item, seg)
+		}
+		if index > maxPayloadArrayIndex {
+			return nil, fmt.Errorf("%s: array index %d is beyond the limit, %d", item, index, maxPayloadArrayIndex)
+		}
+		if index < len(c) {
+			current = c[index]
+		}
+	default:
+		return nil, fmt.Errorf("%s: conflicts with a non object value", item)
+	}
+
+	var err error
+	if len(path) == 1 {
+		if current != nil {
+			return nil, fmt.Errorf("%s: %q is already set", item, seg)
+		}
+		current = value
+	} else {
+		switch current.(type) {
+		case nil, map[string]interface{}, []interface{}:
+		default:
+			return nil, fmt.Errorf("%s: %q is already set as a non object value", item, seg)
+		}
+		current, err = setPayloadPath(current, path[1:], value, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[seg] = current
+	case []interface{}:
+		for len(c) <= index {
+			c = append(c, nil)
+		}
+		c[index] = current
+		container = c
+	}
+	return container, nil
+}
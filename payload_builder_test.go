@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildPayload(t *testing.T) {
+	tests := []struct {
+		items []string
+		want  string
+	}{
+		{[]string{"key=value"}, `{"key":"value"}`},
+		{[]string{"key="}, `{"key":""}`},
+		{[]string{"key=a=b"}, `{"key":"a=b"}`},
+		{[]string{"count:=3"}, `{"count":3}`},
+		{[]string{"flag:=true", "none:=null"}, `{"flag":true,"none":null}`},
+		{[]string{"obj:={\"a\":[1,2]}"}, `{"obj":{"a":[1,2]}}`},
+		{[]string{"nested.flag:=true", "nested.name=x"}, `{"nested":{"flag":true,"name":"x"}}`},
+		{[]string{"a.b.c=d"}, `{"a":{"b":{"c":"d"}}}`},
+		{[]string{"list.0=a", "list.1=b"}, `{"list":["a","b"]}`},
+		{[]string{"list.1=b"}, `{"list":[null,"b"]}`},
+		{[]string{"list.0.name=a", "list.0.id:=1"}, `{"list":[{"id":1,"name":"a"}]}`},
+		{[]string{"list.0.0:=1"}, `{"list":[[1]]}`},
+		{[]string{"list.1023:=1"}, `{"list":[` + strings.Repeat("null,", 1023) + `1]}`},
+		{[]string{`a\.b=c`}, `{"a.b":"c"}`},
+		{[]string{`a\=b=c`}, `{"a=b":"c"}`},
+		{[]string{`a\:=b`}, `{"a:":"b"}`},
+		{[]string{"0=a"}, `{"0":"a"}`},
+		{[]string{"obj:={}", "obj.a=b"}, `{"obj":{"a":"b"}}`},
+		{[]string{"time=2020-12-01T00:00:00Z"}, `{"time":"2020-12-01T00:00:00Z"}`},
+	}
+	for _, tt := range tests {
+		got, err := buildPayload(tt.items)
+		if err != nil {
+			t.Errorf("%v: %s", tt.items, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestBuildPayloadError(t *testing.T) {
+	tests := [][]string{
+		{"novalue"},
+		{"=value"},
+		{":=1"},
+		{"a..b=c"},
+		{".a=b"},
+		{"count:=three"},
+		{"a=1", "a=2"},
+		{"a=1", "a.b=2"},
+		{"a.b=2", "a=1"},
+		{"list.0=a", "list.name=b"},
+		{"list.0=a", "list.0=b"},
+		{"a:=1", "a.0=b"},
+		{"list.100000000=x"},
+	}
+	for _, items := range tests {
+		if got, err := buildPayload(items); err == nil {
+			t.Errorf("%v: error expected, got %s", items, got)
+		}
+	}
+}
+
+func TestParseArgsPayloadItems(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-p", "a=b", "-p", "n:=1"}, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.payload != `{"a":"b","n":1}` {
+		t.Errorf("got %s", config.payload)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-p", "a=b", "-payload", "{}"}, noEnv); err == nil {
+		t.Error("-p and -payload should be exclusive")
+	}
+}
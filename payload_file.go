@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// latestPayloadPrefix picks the most recently modified *.json of the directory as -payload_file
+const latestPayloadPrefix = "@latest:"
+
+const (
+	// stdinPayloadFile is the -payload_file which reads the payload from stdin until EOF
+	stdinPayloadFile = "-"
+	// maxStdinPayloadSize is beyond the payload limit of every vendor, so that a pipe which never ends
+	// fails instead of filling the memory
+	maxStdinPayloadSize = 32 * 1024 * 1024
+)
+
+// stdinFile is stdin of the process
+type stdinFile interface {
+	io.Reader
+	Stat() (os.FileInfo, error)
+}
+
+// payloadStdin is read by -payload_file -, replaced by tests
+var payloadStdin stdinFile = os.Stdin
+
+// readStdinPayload reads the payload from stdin until EOF. A terminal is an error rather than a wait
+// for the user to type the payload.
+func readStdinPayload(in stdinFile) (string, error) {
+	if fi, err := in.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("-payload_file - reads the payload from stdin, which is a terminal; pipe the payload, ex: cat event.json | k8s-nodeless -func my-fn -payload_file -")
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(in, maxStdinPayloadSize+1))
+	if err != nil {
+		return "", fmt.Errorf("read payload from stdin: %w", err)
+	}
+	if len(buf) > maxStdinPayloadSize {
+		return "", fmt.Errorf("payload from stdin exceeds %d bytes", maxStdinPayloadSize)
+	}
+	return string(buf), nil
+}
+
+// homeDir returns the home directory in the environment
+func homeDir(getenv func(string) string) (string, string) {
+	if runtime.GOOS == "windows" {
+		return getenv("USERPROFILE"), "USERPROFILE"
+	}
+	return getenv("HOME"), "HOME"
+}
+
+// expandPath expands a leading ~ to the home directory and $VAR or ${VAR} to the environment
+// variable. An unset variable is an error rather than an empty string, which would make another path.
+func expandPath(path string, getenv func(string) string) (string, error) {
+	var unset []string
+	expanded := os.Expand(path, func(name string) string {
+		v := getenv(name)
+		if v == "" {
+			unset = append(unset, "$"+name)
+		}
+		return v
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("payload file %s: %s is not set", path, strings.Join(unset, ", "))
+	}
+
+	sep := "/"
+	if runtime.GOOS == "windows" && strings.HasPrefix(expanded, `~\`) {
+		sep = `\`
+	}
+	if expanded == "~" || strings.HasPrefix(expanded, "~"+sep) {
+		home, env := homeDir(getenv)
+		if home == "" {
+			return "", fmt.Errorf("payload file %s: ~ can not be expanded, %s is not set", path, env)
+		}
+		expanded = filepath.Join(home, expanded[1:])
+	}
+	return expanded, nil
+}
+
+// resolvePayloadFile returns the path of -payload_file, which is expanded, the newest *.json
+// of the directory of @latest:DIR, or - for stdin
+func resolvePayloadFile(spec string, getenv func(string) string) (string, error) {
+	if spec == stdinPayloadFile {
+		return spec, nil
+	}
+	if strings.HasPrefix(spec, latestPayloadPrefix) {
+		dir, err := expandPath(strings.TrimPrefix(spec, latestPayloadPrefix), getenv)
+		if err != nil {
+			return "", err
+		}
+		return latestJSON(dir)
+	}
+	path, err := expandPath(spec, getenv)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPayloadFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// latestJSON returns the most recently modified *.json file of the directory. Of files modified at
+// the same time, the last by name is picked so that the choice is stable.
+func latestJSON(dir string) (string, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", payloadPathError(dir, err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("payload file %s%s: %s is not a directory", latestPayloadPrefix, dir, dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", payloadPathError(dir, err)
+	}
+	var files []os.FileInfo
+	for _, e := range entries {
+		if e.Mode().IsRegular() && strings.EqualFold(filepath.Ext(e.Name()), ".json") {
+			files = append(files, e)
+		}
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("payload file %s%s: no *.json in %s", latestPayloadPrefix, dir, dir)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().After(files[j].ModTime())
+		}
+		return files[i].Name() > files[j].Name()
+	})
+	return filepath.Join(dir, files[0].Name()), nil
+}
+
+// checkPayloadFile returns an error which tells why the path can not be read as a payload file
+func checkPayloadFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return payloadPathError(path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("payload file %s is a directory, %s%s picks its most recently modified *.json", path, latestPayloadPrefix, path)
+	}
+	return nil
+}
+
+// payloadPathError describes the error of the stat or the read of the path
+func payloadPathError(path string, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		if parent := nearestExistingParent(path); parent != "" {
+			return fmt.Errorf("payload file %s does not exist, nearest existing parent is %s", path, parent)
+		}
+		return fmt.Errorf("payload file %s does not exist", path)
+	case os.IsPermission(err):
+		return fmt.Errorf("payload file %s: %w", path, os.ErrPermission)
+	}
+	return fmt.Errorf("read payload file, %s: %w", path, err)
+}
+
+// nearestExistingParent returns the deepest directory above the path which exists, or ""
+func nearestExistingParent(path string) string {
+	p := filepath.Clean(path)
+	for {
+		parent := filepath.Dir(p)
+		if parent == p {
+			return ""
+		}
+		if fi, err := os.Stat(parent); err == nil && fi.IsDir() {
+			return parent
+		}
+		p = parent
+	}
+}
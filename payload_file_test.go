@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHomeEnv returns the environment of a home directory of this platform
+func testHomeEnv(home string, env map[string]string) func(string) string {
+	name := "HOME"
+	if runtime.GOOS == "windows" {
+		name = "USERPROFILE"
+	}
+	return func(k string) string {
+		if k == name {
+			return home
+		}
+		return env[k]
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home := filepath.Join("home", "ci")
+	getenv := testHomeEnv(home, map[string]string{"FIXTURES": filepath.Join("srv", "fixtures")})
+	cases := map[string]string{
+		"~":                      home,
+		"~/fixtures/event.json":  filepath.Join(home, "fixtures", "event.json"),
+		"$FIXTURES/event.json":   filepath.Join("srv", "fixtures") + "/event.json",
+		"${FIXTURES}/event.json": filepath.Join("srv", "fixtures") + "/event.json",
+		"event.json":             "event.json",
+		"~other/event.json":      "~other/event.json",
+		"fixtures/~/event.json":  "fixtures/~/event.json",
+		"$UNSET/event.json":      "", // an error
+	}
+	if runtime.GOOS == "windows" {
+		cases[`~\fixtures\event.json`] = filepath.Join(home, "fixtures", "event.json")
+	}
+	for in, want := range cases {
+		got, err := expandPath(in, getenv)
+		if want == "" {
+			if err == nil || !strings.Contains(err.Error(), "$UNSET is not set") {
+				t.Errorf("%s: an unset variable must be an error, got %q, %v", in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := expandPath("~/event.json", func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), "can not be expanded") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestResolvePayloadFile(t *testing.T) {
+	dir := t.TempDir()
+	fixtures := filepath.Join(dir, "fixtures")
+	if err := os.Mkdir(fixtures, 0755); err != nil {
+		t.Fatal(err)
+	}
+	event := filepath.Join(fixtures, "event.json")
+	if err := ioutil.WriteFile(event, []byte(`{"id": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	getenv := testHomeEnv(dir, map[string]string{"FIXTURES": fixtures})
+
+	for _, spec := range []string{"~/fixtures/event.json", "$FIXTURES/event.json", event} {
+		if got, err := resolvePayloadFile(spec, getenv); err != nil || filepath.Clean(got) != event {
+			t.Errorf("%s: got %s, %v", spec, got, err)
+		}
+	}
+
+	_, err := resolvePayloadFile("~/fixtures/missing/event.json", getenv)
+	if err == nil || err.Error() != "payload file "+filepath.Join(fixtures, "missing", "event.json")+" does not exist, nearest existing parent is "+fixtures {
+		t.Errorf("got %v", err)
+	}
+	_, err = resolvePayloadFile("$FIXTURES", getenv)
+	if err == nil || !strings.Contains(err.Error(), fixtures+" is a directory, @latest:"+fixtures) {
+		t.Errorf("got %v", err)
+	}
+
+	// the read error of a file which can not be read, as root may read anything
+	err = payloadPathError(event, &os.PathError{Op: "open", Path: event, Err: os.ErrPermission})
+	if !errors.Is(err, os.ErrPermission) || err.Error() != "payload file "+event+": permission denied" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLatestPayloadFile(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Add(-time.Hour)
+	for i, name := range []string{"a.json", "c.JSON", "b.json", "z.txt", "sub.json"} {
+		path := filepath.Join(dir, name)
+		if name == "sub.json" {
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := ioutil.WriteFile(path, []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getenv := testHomeEnv(dir, nil)
+
+	// z.txt and the directory sub.json are newer, but not JSON files
+	got, err := resolvePayloadFile("@latest:"+dir, getenv)
+	if err != nil || got != filepath.Join(dir, "b.json") {
+		t.Errorf("got %s, %v", got, err)
+	}
+	if got, err := resolvePayloadFile("@latest:~", getenv); err != nil || got != filepath.Join(dir, "b.json") {
+		t.Errorf("the directory is expanded, got %s, %v", got, err)
+	}
+
+	// of the same mtime, the last by name
+	same := base.Add(10 * time.Minute)
+	for _, name := range []string{"a.json", "b.json"} {
+		os.Chtimes(filepath.Join(dir, name), same, same)
+	}
+	if got, _ := latestJSON(dir); got != filepath.Join(dir, "b.json") {
+		t.Errorf("got %s", got)
+	}
+
+	empty := filepath.Join(dir, "sub.json")
+	if _, err := resolvePayloadFile("@latest:"+empty, getenv); err == nil || !strings.Contains(err.Error(), "no *.json in") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := resolvePayloadFile("@latest:"+filepath.Join(dir, "a.json"), getenv); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := resolvePayloadFile("@latest:"+filepath.Join(dir, "missing"), getenv); err == nil || !strings.Contains(err.Error(), "does not exist, nearest existing parent is "+dir) {
+		t.Errorf("got %v", err)
+	}
+
+	config, err := parseArgs([]string{"-func", "f", "-payload_file", "@latest:" + dir}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-payload_file @latest:" + dir + " (" + filepath.Join(dir, "b.json") + ")"; config.payloadSource != want || config.payload != `{}` {
+		t.Errorf("got %s", config.payloadSource)
+	}
+}
+
+// fakeStdin is stdin of the mode, ex: os.ModeNamedPipe when piped or os.ModeCharDevice for a terminal
+type fakeStdin struct {
+	*strings.Reader
+	mode os.FileMode
+}
+
+func (f fakeStdin) Stat() (os.FileInfo, error) {
+	return fakeStdinInfo{f.mode}, nil
+}
+
+type fakeStdinInfo struct{ mode os.FileMode }
+
+func (i fakeStdinInfo) Name() string       { return "stdin" }
+func (i fakeStdinInfo) Size() int64        { return 0 }
+func (i fakeStdinInfo) Mode() os.FileMode  { return i.mode }
+func (i fakeStdinInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeStdinInfo) IsDir() bool        { return false }
+func (i fakeStdinInfo) Sys() interface{}   { return nil }
+
+func TestReadStdinPayload(t *testing.T) {
+	got, err := readStdinPayload(fakeStdin{strings.NewReader(`{"id": 1}`), os.ModeNamedPipe})
+	if err != nil || got != `{"id": 1}` {
+		t.Errorf("got %q %v", got, err)
+	}
+	if _, err := readStdinPayload(fakeStdin{strings.NewReader(""), os.ModeDevice | os.ModeCharDevice}); err == nil || !strings.Contains(err.Error(), "which is a terminal") {
+		t.Errorf("got %v", err)
+	}
+	big := strings.Repeat("x", maxStdinPayloadSize+1)
+	if _, err := readStdinPayload(fakeStdin{strings.NewReader(big), os.ModeNamedPipe}); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("got %v", err)
+	}
+}
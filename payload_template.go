@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateVars is a repeatable flag of key=value variables of -payload-template
+type templateVars map[string]string
+
+func (v templateVars) String() string {
+	var items []string
+	for k, val := range v {
+		items = append(items, k+"="+val)
+	}
+	sort.Strings(items)
+	return strings.Join(items, " ")
+}
+
+func (v templateVars) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("key=value required, %s", s)
+	}
+	v[s[:i]] = s[i+1:]
+	return nil
+}
+
+// payloadTemplate renders the payload as a text/template by -payload-template. A template can use
+// {{ env "NAME" }}, {{ var "key" }} or {{ .key }} of -var, and {{ now }}, the time of the rendering in UTC.
+type payloadTemplate struct {
+	vars   templateVars
+	getenv func(string) string
+	now    func() time.Time
+}
+
+// templateErrorRe splits an error of text/template into the line and the rest
+var templateErrorRe = regexp.MustCompile(`(?s)^template: payload:(\d+)(?::\d+)?: (.*)$`)
+
+// render returns the rendered text of the payload from the source, or the text as is if t is nil.
+// An unset environment variable or variable is an error rather than an empty string.
+func (t *payloadTemplate) render(source, text string) (string, error) {
+	if t == nil {
+		return text, nil
+	}
+	funcs := template.FuncMap{
+		"env": func(name string) (string, error) {
+			v := t.getenv(name)
+			if v == "" {
+				return "", fmt.Errorf("$%s is not set", name)
+			}
+			return v, nil
+		},
+		"var": func(key string) (string, error) {
+			v, ok := t.vars[key]
+			if !ok {
+				return "", fmt.Errorf("%s is not set by -var", key)
+			}
+			return v, nil
+		},
+		"now": func() time.Time { return t.now().UTC() },
+	}
+	tmpl, err := template.New("payload").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", templateError(source, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]string(t.vars)); err != nil {
+		return "", templateError(source, err)
+	}
+	return buf.String(), nil
+}
+
+// templateError tells the line of the template where rendering failed
+func templateError(source string, err error) error {
+	m := templateErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("payload template %s: %w", source, err)
+	}
+	return fmt.Errorf("payload template %s, line %s: %s", source, m[1], m[2])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPayloadTemplate(t *testing.T) {
+	tmpl := &payloadTemplate{
+		vars:   templateVars{"build_id": "b-42"},
+		getenv: func(name string) string { return map[string]string{"STAGE": "dev"}[name] },
+		now:    func() time.Time { return time.Date(2026, 10, 16, 9, 30, 0, 0, time.FixedZone("JST", 9*60*60)) },
+	}
+	got, err := tmpl.render("event.json", `{"stage": "{{ env "STAGE" }}", "build": "{{ var "build_id" }}", "again": "{{ .build_id }}", "at": "{{ now.Format "2006-01-02T15:04:05Z07:00" }}", "ts": {{ now.Unix }}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"stage": "dev", "build": "b-42", "again": "b-42", "at": "2026-10-16T00:30:00Z", "ts": 1792110600}`; got != want {
+		t.Errorf("got %s", got)
+	}
+
+	for text, want := range map[string]string{
+		"{\n  \"stage\": \"{{ env \"REGION\" }}\"\n}":  "payload template event.json, line 2: ",
+		"{\n\n  \"build\": \"{{ .commit }}\"\n}":       "line 3: ",
+		"{\n  \"id\": {{ if }}\n}":                     "line 2: ",
+		`{"build": "{{ var "commit" }}"}`:              "commit is not set by -var",
+		`{"stage": "{{ env "REGION" }}"}`:              "$REGION is not set",
+		"{\n  \"id\": 1,\n  \"x\": \"{{ unknown }}\"}": "line 3: function \"unknown\" not defined",
+	} {
+		if _, err := tmpl.render("event.json", text); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v", text, err)
+		}
+	}
+
+	var nilTemplate *payloadTemplate
+	if got, err := nilTemplate.render("-payload", "{{ as is }}"); err != nil || got != "{{ as is }}" {
+		t.Errorf("got %s %v", got, err)
+	}
+}
+
+func TestTemplateVars(t *testing.T) {
+	v := templateVars{}
+	for _, s := range []string{"build_id=b-42", "query=a=b", "empty="} {
+		if err := v.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v["build_id"] != "b-42" || v["query"] != "a=b" || v["empty"] != "" {
+		t.Errorf("got %v", v)
+	}
+	if err := v.Set("=b"); err == nil {
+		t.Errorf("an empty key must be an error")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// transition is a point of time in a run
+type transition int
+
+// transitions in the order they happen
+const (
+	transitionRunStart transition = iota
+	transitionCredentialsStart
+	transitionCredentialsEnd
+	transitionPreflightStart
+	transitionPreflightEnd
+	transitionInvokeStart
+	transitionInvokeEnd
+	transitionStarted     // timestamp of the START line
+	transitionEnded       // timestamp of the END line
+	transitionEndObserved // the END line is received by this tool
+	transitionRunEnd
+)
+
+// phase is a span between two transitions which the wall time is attributed to
+type phase struct {
+	name     string
+	from, to transition
+	field    func(*schema.Phases) *schema.PhaseDuration // of the summary
+}
+
+// phases of a run. A phase is unknown unless both transitions are observed.
+var phases = []phase{
+	{"credentials", transitionCredentialsStart, transitionCredentialsEnd, func(p *schema.Phases) *schema.PhaseDuration { return &p.Credentials }},
+	{"preflight", transitionPreflightStart, transitionPreflightEnd, func(p *schema.Phases) *schema.PhaseDuration { return &p.Preflight }},
+	{"invoke_api", transitionInvokeStart, transitionInvokeEnd, func(p *schema.Phases) *schema.PhaseDuration { return &p.InvokeAPI }},
+	{"queue_wait", transitionInvokeEnd, transitionStarted, func(p *schema.Phases) *schema.PhaseDuration { return &p.QueueWait }},
+	{"execution", transitionStarted, transitionEnded, func(p *schema.Phases) *schema.PhaseDuration { return &p.Execution }},
+	{"ingestion_lag", transitionEnded, transitionEndObserved, func(p *schema.Phases) *schema.PhaseDuration { return &p.IngestionLag }},
+	{"teardown", transitionEndObserved, transitionRunEnd, func(p *schema.Phases) *schema.PhaseDuration { return &p.Teardown }},
+}
+
+// phaseTracker records transitions of a run. Each transition is recorded only once,
+// and a transition earlier than the latest recorded one is ignored.
+type phaseTracker struct {
+	mu     sync.Mutex
+	marks  map[transition]time.Time
+	latest transition
+}
+
+func newPhaseTracker(start time.Time) *phaseTracker {
+	return &phaseTracker{
+		marks: map[transition]time.Time{transitionRunStart: start},
+	}
+}
+
+// mark records the transition at t. It returns false if the transition is ignored.
+func (p *phaseTracker) mark(tr transition, t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.marks[tr]; ok || tr < p.latest {
+		return false
+	}
+	p.marks[tr] = t
+	p.latest = tr
+	return true
+}
+
+// restart forgets the transitions from tr on, so that they are recorded again by the next attempt
+func (p *phaseTracker) restart(tr transition) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latest = transitionRunStart
+	for t := range p.marks {
+		if t >= tr {
+			delete(p.marks, t)
+		} else if t > p.latest {
+			p.latest = t
+		}
+	}
+}
+
+// duration returns the duration of the phase, or false if it can not be measured.
+// A negative duration caused by a clock skew between the function and this tool is rounded to zero.
+func (p *phaseTracker) duration(ph phase) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	from, ok := p.marks[ph.from]
+	if !ok {
+		return 0, false
+	}
+	to, ok := p.marks[ph.to]
+	if !ok {
+		return 0, false
+	}
+	if d := to.Sub(from); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// at returns the time of the transition, or false if it is not recorded
+func (p *phaseTracker) at(tr transition) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.marks[tr]
+	return t, ok
+}
+
+// total returns the wall time from the start to the latest transition
+func (p *phaseTracker) total() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.marks[p.latest].Sub(p.marks[transitionRunStart])
+}
+
+// breakdown returns the breakdown for the summary
+func (p *phaseTracker) breakdown() schema.Phases {
+	ret := schema.Phases{Total: p.total()}
+	for _, ph := range phases {
+		d, ok := p.duration(ph)
+		*ph.field(&ret) = schema.PhaseDuration{Duration: d, Known: ok}
+	}
+	return ret
+}
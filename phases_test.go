@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPhaseTracker(t *testing.T) {
+	base := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+
+	p := newPhaseTracker(base)
+	p.mark(transitionCredentialsStart, at(0))
+	p.mark(transitionCredentialsEnd, at(100))
+	p.mark(transitionInvokeStart, at(100))
+	p.mark(transitionInvokeEnd, at(300))
+	p.mark(transitionStarted, at(1300))
+	if p.mark(transitionStarted, at(5000)) {
+		t.Error("second START should be ignored")
+	}
+	p.mark(transitionEnded, at(1500))
+	p.mark(transitionEndObserved, at(4500))
+	if p.mark(transitionInvokeEnd, at(4600)) {
+		t.Error("going back should be ignored")
+	}
+	p.mark(transitionRunEnd, at(4600))
+
+	want := map[string]time.Duration{
+		"credentials":   100 * time.Millisecond,
+		"invoke_api":    200 * time.Millisecond,
+		"queue_wait":    time.Second,
+		"execution":     200 * time.Millisecond,
+		"ingestion_lag": 3 * time.Second,
+		"teardown":      100 * time.Millisecond,
+	}
+	for _, ph := range phases {
+		d, ok := p.duration(ph)
+		w, known := want[ph.name]
+		if ok != known || d != w {
+			t.Errorf("%s: got %v %v, want %v %v", ph.name, d, ok, w, known)
+		}
+	}
+	if p.total() != 4600*time.Millisecond {
+		t.Errorf("total: %v", p.total())
+	}
+
+	// the summary names the phases
+	buf, err := json.Marshal(p.breakdown())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, ph := range phases {
+		if w, known := want[ph.name]; known && got[ph.name] != float64(w) || !known && got[ph.name] != "unknown" {
+			t.Errorf("%s: got %v", ph.name, got[ph.name])
+		}
+	}
+}
+
+func TestPhaseTrackerNoStart(t *testing.T) {
+	base := time.Now()
+	p := newPhaseTracker(base)
+	p.mark(transitionInvokeEnd, base)
+	p.mark(transitionRunEnd, base.Add(time.Second))
+
+	for _, name := range []string{"queue_wait", "execution", "ingestion_lag", "teardown"} {
+		if _, ok := p.duration(phaseByName(name)); ok {
+			t.Errorf("%s should be unknown", name)
+		}
+	}
+}
+
+func TestPhaseTrackerClockSkew(t *testing.T) {
+	base := time.Now()
+	p := newPhaseTracker(base)
+	p.mark(transitionInvokeEnd, base)
+	p.mark(transitionStarted, base.Add(-50*time.Millisecond))
+	if d, ok := p.duration(phaseByName("queue_wait")); !ok || d != 0 {
+		t.Errorf("got %v %v", d, ok)
+	}
+}
+
+func phaseByName(name string) phase {
+	for _, ph := range phases {
+		if ph.name == name {
+			return ph
+		}
+	}
+	panic(name)
+}
+
+func TestPhaseTrackerRestart(t *testing.T) {
+	base := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+
+	p := newPhaseTracker(base)
+	p.mark(transitionCredentialsStart, at(0))
+	p.mark(transitionCredentialsEnd, at(100))
+	p.mark(transitionInvokeStart, at(100))
+	p.mark(transitionInvokeEnd, at(300))
+	p.mark(transitionStarted, at(400))
+	p.mark(transitionEnded, at(500))
+
+	// the retry of the attempt
+	p.restart(transitionInvokeStart)
+	if !p.mark(transitionInvokeStart, at(2000)) || !p.mark(transitionInvokeEnd, at(2050)) || !p.mark(transitionStarted, at(2100)) {
+		t.Fatal("the transitions of the next attempt are ignored")
+	}
+	if d, ok := p.duration(phases[2]); !ok || d != 50*time.Millisecond {
+		t.Errorf("invoke_api: got %v %v", d, ok)
+	}
+	if _, ok := p.duration(phases[4]); ok {
+		t.Error("execution of the first attempt is kept")
+	}
+	if d, ok := p.duration(phases[0]); !ok || d != 100*time.Millisecond {
+		t.Errorf("credentials before the attempts: got %v %v", d, ok)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// planParam is a key parameter of a planned call
+type planParam struct {
+	Key   string
+	Value string
+}
+
+// plannedCall is an API call which a step would make
+type plannedCall struct {
+	Service   string
+	Operation string
+	Params    []planParam // in the order they are printed
+	Note      string      // when or how often the call is made
+}
+
+// mutates returns true if the call changes state, by the same table as the read-only guard
+func (c plannedCall) mutates() bool {
+	return !readOnlyAllowed(c.Operation)
+}
+
+// step is a stage of a run. plan describes the calls which run would make, without making them,
+// so that -plan prints what a run does from the same steps the run executes.
+type step struct {
+	name string
+	plan func() ([]plannedCall, error)
+	run  func(ctx context.Context) error // nil for a step which is run by the deferred finish of a run
+}
+
+// runSteps runs the steps in order and stops at the first error
+func runSteps(ctx context.Context, steps []step) error {
+	for _, s := range steps {
+		if s.run == nil {
+			continue
+		}
+		if err := s.run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePlan writes the numbered steps with their calls, and the mutating calls at the end
+func writePlan(w io.Writer, header string, steps []step) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", header)
+	var mutations []string
+	for i, s := range steps {
+		calls, err := s.plan()
+		if err != nil {
+			return fmt.Errorf("plan of %s: %w", s.name, err)
+		}
+		fmt.Fprintf(&b, "\n%d. %s\n", i+1, s.name)
+		if len(calls) == 0 {
+			b.WriteString("   no API call\n")
+		}
+		for _, c := range calls {
+			name := c.Service + ":" + c.Operation
+			if c.mutates() {
+				mutations = append(mutations, name)
+				name += " (mutates)"
+			}
+			fmt.Fprintf(&b, "   %s\n", name)
+			for _, p := range c.Params {
+				fmt.Fprintf(&b, "       %s: %s\n", p.Key, p.Value)
+			}
+			if c.Note != "" {
+				fmt.Fprintf(&b, "       -- %s\n", c.Note)
+			}
+		}
+	}
+	if len(mutations) == 0 {
+		b.WriteString("\nmutating calls: none\n")
+	} else {
+		fmt.Fprintf(&b, "\nmutating calls: %s\n", strings.Join(mutations, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// planner is an Invoker which can print its plan
+type planner interface {
+	writePlan(w io.Writer) error
+}
+
+// printPlan prints the calls a run with the config would make, and makes none of them
+func printPlan(w io.Writer, config *Config) error {
+	inv, err := newInvoker(config)
+	if err != nil {
+		return err
+	}
+	p, ok := inv.(planner)
+	if !ok {
+		return fmt.Errorf("-plan is not supported by %s", config.vendor)
+	}
+	return p.writePlan(w)
+}
+
+// writePlan writes the plan of a run of the function
+func (sl *AWSServerless) writePlan(w io.Writer) error {
+	region, err := sl.configuredRegion()
+	if err != nil {
+		return err
+	}
+	if region == "" {
+		region = "the default region"
+	}
+	header := fmt.Sprintf("plan of %s in %s, nothing is called", sl.funcName, region)
+	if sl.readOnly {
+		header += "\nread-only: mutating AWS calls are rejected"
+	}
+	steps := sl.pipeline()
+	if sl.shipper != nil {
+		steps = append(steps, shipStep(sl.shipper.target))
+	}
+	steps = append(steps, finishStep(sl.githubStatus))
+	if sl.pushgateway != nil {
+		steps = append(steps, pushStep(sl.pushgateway, sl.groupingKey()))
+	}
+	if sl.publisher != nil {
+		steps = append(steps, publishStep(sl.publisher))
+	}
+	return writePlan(w, header, steps)
+}
+
+// configuredRegion returns the region of the function or of the AWS config, without calling AWS
+func (sl *AWSServerless) configuredRegion() (string, error) {
+	if sl.region != "" {
+		return sl.region, nil
+	}
+	sess, err := session.NewSessionWithOptions(sl.awsOpts)
+	if err != nil {
+		return "", fmt.Errorf("aws session error, %s: %w", sl.funcName, err)
+	}
+	return aws.StringValue(sess.Config.Region), nil
+}
+
+func (sl *AWSServerless) planCredentials() ([]plannedCall, error) {
+	providers, err := credentialProviders(sl.awsOpts, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	note := "only if the profile assumes a role and no unexpired credentials are cached, otherwise the credentials are read from the environment, the container or the instance metadata"
+	if providers != nil {
+		note = "only if the profile assumes a role, otherwise the credentials are read from the environment or the container endpoint"
+	}
+	return []plannedCall{{Service: "sts", Operation: "AssumeRole", Note: note}}, nil
+}
+
+func (sl *AWSServerless) planDiscoverRegion() ([]plannedCall, error) {
+	configured, err := sl.configuredRegion()
+	if err != nil {
+		return nil, err
+	}
+	var ret []plannedCall
+	if configured != "" {
+		ret = append(ret, plannedCall{
+			Service:   "lambda",
+			Operation: "GetFunction",
+			Params:    []planParam{{"FunctionName", sl.ref.Name}, {"Region", configured}},
+		})
+	}
+	return append(ret, plannedCall{
+		Service:   "lambda",
+		Operation: "GetFunction",
+		Params:    []planParam{{"FunctionName", sl.ref.Name}, {"Region", "the remembered region, then each region of the aws partition"}},
+		Note:      "only if the function is not found in the configured region",
+	}), nil
+}
+
+func (sl *AWSServerless) planInvoke() ([]plannedCall, error) {
+	invocationType, reason, err := chooseInvocationType(sl.invocationType, sl.payloadSize(), sl.needResponse())
+	if err != nil {
+		return nil, err
+	}
+	payload := planParam{"Payload", fmt.Sprintf("%d bytes, sha256:%s", len(sl.payload), sl.integrity.sent)}
+	if c := sl.concurrent; c != nil && c.payloads != nil {
+		payload.Value = fmt.Sprintf("each line of %s, up to %d bytes", c.payloadFile, sl.payloadSize())
+	}
+	params := []planParam{
+		{"FunctionName", sl.unqualifiedName()},
+		{"InvocationType", invocationType},
+		payload,
+		{"LogType", "Tail"},
+	}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	if sl.clientContext != "" {
+		params = append(params, planParam{"ClientContext", fmt.Sprintf("%d bytes base64-encoded", len(sl.clientContext))})
+	}
+	note := reason
+	switch {
+	case sl.retryIf != nil:
+		note = fmt.Sprintf("repeated while the response matches %q, up to %d attempts", sl.retryIf, sl.maxAttempts)
+	case sl.retryOnFailure:
+		note = fmt.Sprintf("repeated while the response is a function error, up to %d attempts", sl.maxAttempts)
+	}
+	if p := sl.invokeRetry; p.maxAttempts > 1 {
+		note += fmt.Sprintf("; retried on TooManyRequestsException and other transient errors, up to %d attempts within %s", p.maxAttempts, p.maxElapsed)
+	}
+	var ret []plannedCall
+	if sl.completionStrategy == completionMetrics || (sl.completionStrategy == completionAuto && !sl.retrying() && sl.via != viaURL) {
+		baseline := plannedCall{
+			Service:   "cloudwatch",
+			Operation: "GetMetricData",
+			Params:    []planParam{{"Namespace", "AWS/Lambda"}, {"MetricName", "Invocations, Errors, Duration"}, {"Period", fmt.Sprint(metricsPeriod)}},
+			Note:      "the baseline of the minute before invoking",
+		}
+		if sl.completionStrategy == completionAuto {
+			baseline.Note = "only if logging of the function is off and the invocation is async, " + baseline.Note
+		}
+		ret = append(ret, baseline)
+	}
+	if sl.via == viaEventBridge {
+		return append(ret, plannedCall{
+			Service:   "events",
+			Operation: "PutEvents",
+			Params: []planParam{
+				{"EventBusName", sl.eventBridge.bus},
+				{"Source", sl.eventBridge.source},
+				{"DetailType", sl.eventBridge.detailType},
+				{"Detail", payload.Value},
+			},
+			Note: fmt.Sprintf("a rule of the bus invokes the function, whose first START within %s is taken as the invocation", sl.eventBridge.startTimeout),
+		}), nil
+	}
+	if sl.via == viaSQS {
+		queue := planParam{"QueueUrl", sl.sqs.queueURL}
+		send := []planParam{queue, {"MessageBody", payload.Value}, {"MessageAttributes", sqsCorrelationAttribute + ": a random UUID"}}
+		if strings.HasSuffix(sl.sqs.queueURL, ".fifo") {
+			send = append(send, planParam{"MessageGroupId", sqsMessageGroupID}, planParam{"MessageDeduplicationId", "a random UUID"})
+		}
+		return append(ret,
+			plannedCall{Service: "sqs", Operation: "GetQueueAttributes", Params: []planParam{queue, {"AttributeNames", sqs.QueueAttributeNameRedrivePolicy}}, Note: "the DLQ of the redrive policy"},
+			plannedCall{Service: "sqs", Operation: "GetQueueUrl", Params: []planParam{{"QueueName", "the name in deadLetterTargetArn"}}, Note: "only if the queue has a redrive policy"},
+			plannedCall{Service: "sqs", Operation: "SendMessage", Params: send,
+				Note: fmt.Sprintf("the event source mapping of the queue receives the message%s and invokes the function, whose invocation logging the message id within %s after is taken as ours", enqueuedWithin(sl.sqs.enqueuedTimeout), sl.sqs.matchTimeout)},
+		), nil
+	}
+	if sl.via == viaURL {
+		lookup := []planParam{{"FunctionName", sl.unqualifiedName()}}
+		if sl.ref.Qualifier != "" {
+			lookup = append(lookup, planParam{"Qualifier", sl.ref.Qualifier})
+		}
+		return append(ret,
+			plannedCall{Service: "lambda", Operation: "GetFunctionUrlConfig", Params: lookup, Note: "the Function URL and its auth type"},
+			plannedCall{Service: "lambda", Operation: "InvokeFunctionUrl", Params: []planParam{payload}, Note: "a POST to the Function URL, signed with SigV4 when its auth type is AWS_IAM"},
+		), nil
+	}
+	if c := sl.concurrent; c != nil && c.payloads != nil {
+		note = fmt.Sprintf("once by each of %d lines, %d at once, each request is tailed up to %s; %s", c.n, c.workers, c.timeout, note)
+		if c.failFast {
+			note += "; no more invocation after one fails"
+		}
+	} else if c != nil {
+		note = fmt.Sprintf("%d times at once, each request is tailed up to %s; %s", c.n, c.timeout, note)
+	}
+	return append(ret, plannedCall{Service: "lambda", Operation: "Invoke", Params: params, Note: note}), nil
+}
+
+func (sl *AWSServerless) planTail() ([]plannedCall, error) {
+	metrics := plannedCall{
+		Service:   "cloudwatch",
+		Operation: "GetMetricData",
+		Params:    []planParam{{"Namespace", "AWS/Lambda"}, {"MetricName", "Invocations, Errors, Duration"}, {"Period", fmt.Sprint(metricsPeriod)}},
+		Note:      fmt.Sprintf("every %s up to %s until a datapoint is attributed to the invocation", metricsPollInterval, metricsInferTimeout),
+	}
+	if sl.completionStrategy == completionMetrics {
+		return []plannedCall{metrics}, nil
+	}
+
+	when := "every"
+	if sl.retrying() {
+		when = "after each attempt, every"
+	}
+	group := planParam{"LogGroupName", sl.logGroupName}
+	streams := "the updated streams"
+	if sl.tailsByVersion() {
+		streams = fmt.Sprintf("the updated streams of the versions of %s", sl.ref.Qualifier)
+	}
+	ret := []plannedCall{{
+		Service:   "logs",
+		Operation: "DescribeLogStreams",
+		Params:    []planParam{group, {"OrderBy", "LastEventTime"}, {"Descending", "true"}},
+		Note:      fmt.Sprintf("%s %s until END and REPORT of the request", when, sl.limits.orDefault().PollInterval),
+	}, {
+		Service:   "logs",
+		Operation: "FilterLogEvents",
+		Params:    []planParam{group, {"LogStreamNames", fmt.Sprintf("%s, or the streams of today and earlier dates by prefixes if more than %d", streams, maxFilterStreams)}},
+		Note:      "after each discovery, for each date prefix",
+	}, {
+		Service:   "logs",
+		Operation: "GetLogEvents",
+		Params:    []planParam{group, {"LogStreamName", fmt.Sprintf("each of the %d most recently active streams", sl.limits.orDefault().FallbackStreams)}},
+		Note:      "only if FilterLogEvents is denied",
+	}}
+	if sl.via == viaSQS {
+		interval := sl.limits.orDefault().PollInterval
+		until := "until the message is consumed"
+		if sl.sqs.consumedTimeout > 0 {
+			until += fmt.Sprintf(", up to %s after the invocation", sl.sqs.consumedTimeout)
+		}
+		dlq := planParam{"QueueUrl", "the DLQ of " + sl.sqs.queueURL}
+		ret = append(ret, plannedCall{
+			Service:   "sqs",
+			Operation: "GetQueueAttributes",
+			Params:    []planParam{{"QueueUrl", sl.sqs.queueURL}, {"AttributeNames", "ApproximateNumberOfMessages, ApproximateNumberOfMessagesNotVisible"}},
+			Note:      fmt.Sprintf("every %s while tailing %s, the phase of the message by the depth of the queue", interval, until),
+		}, plannedCall{
+			Service:   "sqs",
+			Operation: "ReceiveMessage",
+			Params:    []planParam{dlq, {"MaxNumberOfMessages", fmt.Sprint(sqsMaxMessages)}, {"VisibilityTimeout", fmt.Sprint(sqsPeekVisibility)}, {"MessageAttributeNames", sqsCorrelationAttribute}},
+			Note:      fmt.Sprintf("only if the queue has a DLQ, every %s while tailing until the message is redriven there, each received message is visible again when its visibility timeout expires", interval),
+		})
+	}
+	if sl.completionStrategy == completionAuto && !sl.retrying() {
+		metrics.Note = "instead of the calls above when logging of the function is off and the invocation is async, " + metrics.Note
+		ret = append(ret, metrics)
+	}
+	return ret, nil
+}
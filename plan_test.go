@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+func TestPlanGolden(t *testing.T) {
+	setTestLogger(t)
+	getenv := func(k string) string {
+		if k == githubTokenEnv {
+			return "token"
+		}
+		return ""
+	}
+	arn := "arn:aws:lambda:us-east-1:123456789012:function:orders-fn:live"
+	tests := []struct {
+		name   string
+		args   []string
+		region string // of the AWS config
+	}{
+		{"event", []string{"-func", arn, "-payload", `{"id": 1}`, "-no-attribution"}, ""},
+		{"retry_read_only", []string{"-func", arn, "-payload", `{"id": 1}`, "-retry-if-response", ".retry == true", "-max-attempts", "5",
+			"-read-only", "-client-context", `{"custom": {"k": "v"}}`, "-no-attribution"}, ""},
+		{"retry_on_failure", []string{"-func", arn, "-payload", `{"id": 1}`, "-retry-on-failure", "-max-attempts", "5", "-retry-delay", "30s", "-no-attribution"}, ""},
+		{"discover_region_github", []string{"-func", "orders-fn", "-discover-region", "-invocation-type", "request-response",
+			"-github-status", "shirou/k8s-nodeless@0123abc", "-no-attribution"}, "ap-northeast-1"},
+		{"expect_side_effects", []string{"-func", arn, "-no-attribution", "-consume", "-expect-filter", `.status == "shipped"`,
+			"-expect-sqs-message", "https://sqs.us-east-1.amazonaws.com/123456789012/shipments",
+			"-expect-dynamodb-item", `orders:{"id": "o-1"}`}, ""},
+		{"completion_metrics", []string{"-func", arn, "-payload", `{"id": 1}`, "-completion-strategy", "metrics", "-no-attribution"}, ""},
+		{"set_retention", []string{"-func", arn, "-payload", `{"id": 1}`, "-set-retention", "14", "-no-attribution"}, ""},
+		{"via_url", []string{"-func", arn, "-payload", `{"id": 1}`, "-via", "url", "-no-attribution"}, ""},
+		{"via_eventbridge", []string{"-func", arn, "-payload", `{"id": 1}`, "-via", "eventbridge", "-eventbridge-bus", "orders",
+			"-eventbridge-source", "orders.api", "-eventbridge-detail-type", "OrderPlaced", "-no-attribution"}, ""},
+		{"dry_run", []string{"-func", arn, "-payload", `{"id": 1}`, "-dry-run", "-no-attribution"}, ""},
+		{"no_logs", []string{"-func", arn, "-payload", `{"id": 1}`, "-no-logs", "-no-attribution"}, ""},
+		{"via_sqs", []string{"-func", arn, "-payload", `{"id": 1}`, "-via", "sqs", "-queue", "https://sqs.us-east-1.amazonaws.com/123456789012/orders.fifo", "-no-attribution"}, ""},
+		{"concurrency", []string{"-func", arn, "-payload", `{"id": 1}`, "-concurrency", "10", "-invocation-type", "request-response", "-no-attribution"}, ""},
+		{"payload_ndjson", []string{"-func", arn, "-payload-ndjson", "testdata/batch/orders.ndjson", "-batch-workers", "2", "-fail-fast", "-no-attribution"}, ""},
+		{"warmup", []string{"-func", arn, "-warmup", "20", "-no-attribution"}, ""},
+		{"wait_active", []string{"-func", arn, "-payload", `{"id": 1}`, "-wait-active", "-no-attribution"}, ""},
+		{"xray", []string{"-func", arn, "-payload", `{"id": 1}`, "-xray", "-no-attribution"}, ""},
+		{"check_destination", []string{"-func", arn, "-payload", `{"id": 1}`, "-invocation-type", "event", "-check-destination", "-no-attribution"}, ""},
+		{"with_log_level", []string{"-func", "orders-fn", "-payload", `{"id": 1}`, "-with-log-level", "debug", "-no-attribution"}, "us-east-1"},
+		{"ship_to", []string{"-func", arn, "-payload", `{"id": 1}`, "-ship-to", "https://collector.example.com/ingest", "-no-attribution"}, ""},
+		{"state_machine", []string{"-func", "arn:aws:states:us-east-1:123456789012:stateMachine:orders", "-payload", `{"id": 1}`, "-cancel-execution", "-no-attribution"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a plan must not call AWS even if it could
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer server.Close()
+
+			config, err := parseArgs(append(tt.args, "-plan"), getenv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inv, err := newInvoker(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sl, ok := inv.(*AWSServerless); ok {
+				sl.awsOpts.Config.Endpoint = aws.String(server.URL)
+				if tt.region != "" {
+					sl.awsOpts.Config.Region = aws.String(tt.region)
+				}
+			}
+			var buf bytes.Buffer
+			if err := inv.(planner).writePlan(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if calls > 0 {
+				t.Errorf("%d calls are made", calls)
+			}
+
+			golden := filepath.Join("testdata", "plan", tt.name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestPlanError(t *testing.T) {
+	setTestLogger(t)
+	config, err := parseArgs([]string{"-func", "arn:aws:lambda:us-east-1:123456789012:function:f", "-payload", strings.Repeat("x", maxSyncPayloadSize+1), "-no-attribution", "-plan"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printPlan(&buf, config); err == nil || !strings.Contains(err.Error(), "plan of invoke") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRunSteps(t *testing.T) {
+	var ran []string
+	s := func(name string, err error) step {
+		return step{name: name, run: func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	failed := errors.New("failed")
+	err := runSteps(context.Background(), []step{s("a", nil), {name: "deferred"}, s("b", failed), s("c", nil)})
+	if err != failed || strings.Join(ran, ",") != "a,b" {
+		t.Errorf("got %v %v", ran, err)
+	}
+}
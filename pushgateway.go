@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	pushgatewayMaxAttempts = 3
+	pushgatewayTimeout     = 30 * time.Second // of a push with its retries
+	pushgatewayContentType = "text/plain; version=0.0.4"
+)
+
+// pushgateway pushes the metrics of a run to a Prometheus Pushgateway, for batch jobs which are gone before a scrape
+type pushgateway struct {
+	url             string // base URL, ex: http://pushgateway:9091
+	instance        string // the CI repository or the host
+	deleteOnSuccess bool   // a successful run deletes the group instead of pushing
+	client          *http.Client
+	backoff         func(attempt int) time.Duration
+}
+
+// newPushgateway returns the pusher to the base URL. The instance is taken from the environment.
+func newPushgateway(rawURL string, deleteOnSuccess bool, getenv func(string) string, hostname func() (string, error)) (*pushgateway, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("pushgateway-url must be an http or https URL, %s", rawURL)
+	}
+	instance := ciInstance(getenv)
+	if instance == "" {
+		if instance, err = hostname(); err != nil {
+			return nil, fmt.Errorf("pushgateway instance: %w", err)
+		}
+	}
+	return &pushgateway{
+		url:             strings.TrimSuffix(rawURL, "/"),
+		instance:        instance,
+		deleteOnSuccess: deleteOnSuccess,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		backoff:         retryBackoff,
+	}, nil
+}
+
+// groupingKey returns the labels which identify the metrics of the function in the Pushgateway.
+// The job is the function, so that a later run of the same function replaces them.
+func (p *pushgateway) groupingKey(function, qualifier string) []labelPair {
+	key := []labelPair{{"job", function}, {"instance", p.instance}}
+	if qualifier != "" {
+		key = append(key, labelPair{"qualifier", qualifier})
+	}
+	return key
+}
+
+// groupingPath returns the URL path of the grouping key. A value which is empty or has a slash
+// is base64url-encoded, as the Pushgateway requires.
+func groupingPath(key []labelPair) string {
+	var b strings.Builder
+	b.WriteString("/metrics")
+	for _, l := range key {
+		if l.Value == "" || strings.Contains(l.Value, "/") {
+			v := base64.URLEncoding.EncodeToString([]byte(l.Value))
+			if v == "" {
+				v = "="
+			}
+			fmt.Fprintf(&b, "/%s@base64/%s", l.Name, v)
+			continue
+		}
+		fmt.Fprintf(&b, "/%s/%s", l.Name, url.PathEscape(l.Value))
+	}
+	return b.String()
+}
+
+// pushgatewayPermanentError is an error which is not retried
+type pushgatewayPermanentError struct {
+	msg string
+}
+
+func (e *pushgatewayPermanentError) Error() string { return e.msg }
+
+// push replaces the metrics of the group with m, or deletes the group when the run succeeded and
+// deleteOnSuccess is set. Server errors are retried.
+func (p *pushgateway) push(ctx context.Context, key []labelPair, m *runMetrics) error {
+	method := http.MethodPut
+	var body []byte
+	if p.deleteOnSuccess && m.Outcome == outcomeSuccess {
+		method = http.MethodDelete
+	} else {
+		var buf bytes.Buffer
+		if err := m.writeText(&buf); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	u := p.url + groupingPath(key)
+
+	for attempt := 1; ; attempt++ {
+		err := p.pushOnce(ctx, method, u, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*pushgatewayPermanentError); ok || attempt >= pushgatewayMaxAttempts {
+			return err
+		}
+		if err := sleepContext(ctx, p.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pushgateway) pushOnce(ctx context.Context, method, u string, body []byte) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return &pushgatewayPermanentError{err.Error()}
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", pushgatewayContentType)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushgateway: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("pushgateway: %s %s: %s", method, u, resp.Status)
+	}
+	return &pushgatewayPermanentError{fmt.Sprintf("pushgateway: %s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(msg)))}
+}
+
+// pushRunMetrics pushes the metrics of the run. A failure is only a warning, never the outcome of the run.
+func pushRunMetrics(p *pushgateway, key []labelPair, m *runMetrics) {
+	if p == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pushgatewayTimeout)
+	defer cancel()
+	if err := p.push(ctx, key, m); err != nil {
+		logger.Warnf("%s", err)
+		return
+	}
+	logger.Debugf("metrics of %s are pushed to %s", key[0].Value, p.url)
+}
+
+// pushStep describes pushRunMetrics in a plan
+func pushStep(p *pushgateway, key []labelPair) step {
+	return step{
+		name: "push-metrics",
+		plan: func() ([]plannedCall, error) {
+			note := "the metrics of the run"
+			if p.deleteOnSuccess {
+				note = "the metrics of a failed run, or DeleteMetrics of the group when the run succeeds"
+			}
+			return []plannedCall{{
+				Service:   "pushgateway",
+				Operation: "PushMetrics",
+				Params:    []planParam{{"URL", p.url + groupingPath(key)}},
+				Note:      note,
+			}}, nil
+		},
+	}
+}
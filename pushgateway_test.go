@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupingPath(t *testing.T) {
+	tests := []struct {
+		key  []labelPair
+		want string
+	}{
+		{[]labelPair{{"job", "orders-fn"}, {"instance", "build-01"}}, "/metrics/job/orders-fn/instance/build-01"},
+		{[]labelPair{{"job", "orders-fn"}, {"instance", "shirou/k8s-nodeless"}}, "/metrics/job/orders-fn/instance@base64/c2hpcm91L2s4cy1ub2RlbGVzcw=="},
+		{[]labelPair{{"job", "orders-fn"}, {"instance", ""}}, "/metrics/job/orders-fn/instance@base64/="},
+		{[]labelPair{{"job", "a b"}, {"qualifier", "$LATEST"}}, "/metrics/job/a%20b/qualifier/$LATEST"},
+	}
+	for _, tt := range tests {
+		if got := groupingPath(tt.key); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNewPushgateway(t *testing.T) {
+	hostname := func() (string, error) { return "build-01", nil }
+	noenv := func(string) string { return "" }
+	p, err := newPushgateway("http://pushgateway:9091/", false, noenv, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.url != "http://pushgateway:9091" || p.instance != "build-01" {
+		t.Errorf("got %+v", p)
+	}
+	key := p.groupingKey("orders-fn", "live")
+	if len(key) != 3 || key[0] != (labelPair{"job", "orders-fn"}) || key[2] != (labelPair{"qualifier", "live"}) {
+		t.Errorf("got %v", key)
+	}
+
+	env := map[string]string{"CIRCLE_PROJECT_USERNAME": "o", "CIRCLE_PROJECT_REPONAME": "r"}
+	p, err = newPushgateway("https://pushgateway", false, func(k string) string { return env[k] }, hostname)
+	if err != nil || p.instance != "o/r" {
+		t.Errorf("got %+v, %v", p, err)
+	}
+
+	for _, u := range []string{"pushgateway:9091", "ftp://pushgateway", "http://"} {
+		if _, err := newPushgateway(u, false, noenv, hostname); err == nil {
+			t.Errorf("%s must be an error", u)
+		}
+	}
+	if _, err := newPushgateway("http://pushgateway", false, noenv, func() (string, error) { return "", errors.New("no hostname") }); err == nil {
+		t.Errorf("no instance must be an error")
+	}
+}
+
+// fakePushgateway records the requests, and answers with the statuses in order, then 200
+type fakePushgateway struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []string // method and path
+	bodies   []string
+	types    []string
+}
+
+func (f *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath())
+	f.bodies = append(f.bodies, string(body))
+	f.types = append(f.types, r.Header.Get("Content-Type"))
+	if len(f.statuses) > 0 {
+		w.WriteHeader(f.statuses[0])
+		f.statuses = f.statuses[1:]
+	}
+}
+
+func testPushgateway(t *testing.T, fake *fakePushgateway, deleteOnSuccess bool) *pushgateway {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	p, err := newPushgateway(server.URL, deleteOnSuccess, func(k string) string {
+		if k == "GITHUB_REPOSITORY" {
+			return "shirou/k8s-nodeless"
+		}
+		return ""
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.backoff = func(int) time.Duration { return time.Millisecond }
+	return p
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	fake := &fakePushgateway{statuses: []int{http.StatusServiceUnavailable}}
+	p := testPushgateway(t, fake, false)
+	m := &runMetrics{Outcome: outcomeSuccess, APICalls: map[string]int{"Invoke": 1}}
+	if err := p.push(context.Background(), p.groupingKey("orders-fn", ""), m); err != nil {
+		t.Fatal(err)
+	}
+	want := "PUT /metrics/job/orders-fn/instance@base64/c2hpcm91L2s4cy1ub2RlbGVzcw=="
+	if len(fake.requests) != 2 || fake.requests[1] != want {
+		t.Fatalf("a server error must be retried, got %v", fake.requests)
+	}
+	if fake.types[1] != pushgatewayContentType || !strings.Contains(fake.bodies[1], `nodeless_aws_api_calls{operation="Invoke"} 1`) {
+		t.Errorf("got %s\n%s", fake.types[1], fake.bodies[1])
+	}
+
+	// a client error is not retried
+	fake = &fakePushgateway{statuses: []int{http.StatusBadRequest}}
+	p = testPushgateway(t, fake, false)
+	if err := p.push(context.Background(), p.groupingKey("orders-fn", ""), m); err == nil || len(fake.requests) != 1 {
+		t.Errorf("got %v, %v", err, fake.requests)
+	}
+
+	// retries are limited
+	fake = &fakePushgateway{statuses: []int{500, 500, 500, 500}}
+	p = testPushgateway(t, fake, false)
+	if err := p.push(context.Background(), p.groupingKey("orders-fn", ""), m); err == nil || len(fake.requests) != pushgatewayMaxAttempts {
+		t.Errorf("got %v, %v", err, fake.requests)
+	}
+}
+
+func TestPushgatewayDeleteOnSuccess(t *testing.T) {
+	fake := &fakePushgateway{}
+	p := testPushgateway(t, fake, true)
+	key := p.groupingKey("orders-fn", "live")
+	if err := p.push(context.Background(), key, &runMetrics{Outcome: outcomeFailure}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(context.Background(), key, &runMetrics{Outcome: outcomeSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 2 || !strings.HasPrefix(fake.requests[0], "PUT ") || !strings.HasPrefix(fake.requests[1], "DELETE ") || fake.bodies[1] != "" {
+		t.Errorf("a failure must be pushed and a success delete the group, got %v", fake.requests)
+	}
+}
+
+func TestPushRunMetricsWarns(t *testing.T) {
+	logs := setTestLogger(t)
+	fake := &fakePushgateway{statuses: []int{http.StatusBadRequest}}
+	p := testPushgateway(t, fake, false)
+	pushRunMetrics(p, p.groupingKey("orders-fn", ""), &runMetrics{Outcome: outcomeSuccess})
+	if logs.FilterMessageSnippet("400 Bad Request").Len() != 1 {
+		t.Errorf("a push failure must be warned, got %v", logs.All())
+	}
+	pushRunMetrics(nil, nil, &runMetrics{})
+}
+
+func TestParseArgsPushgateway(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-pushgateway-url", "http://pushgateway:9091", "-pushgateway-delete-on-success"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.pushgateway == nil || !config.pushgateway.deleteOnSuccess {
+		t.Errorf("got %+v", config.pushgateway)
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-pushgateway-delete-on-success"}, noenv); err == nil {
+		t.Errorf("-pushgateway-delete-on-success without -pushgateway-url must be an error")
+	}
+	if _, err := parseArgs([]string{"-func", "f", "-pushgateway-url", "pushgateway:9091"}, noenv); err == nil {
+		t.Errorf("a URL without a scheme must be an error")
+	}
+}
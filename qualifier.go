@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// latestVersion is the qualifier of the unpublished version of a function
+const latestVersion = "$LATEST"
+
+// resolveStreamVersions returns the versions of the qualified function, whose log streams are tailed.
+// Lambda names a stream "YYYY/MM/DD/[VERSION]...", so the streams of other versions are skipped. An alias
+// is resolved to its version and the version it routes traffic to, if any. It returns nil, all streams,
+// unless tailsByVersion, or when the alias can not be resolved.
+func (sl *AWSServerless) resolveStreamVersions(ctx context.Context, api aliasAPI) []string {
+	q := sl.ref.Qualifier
+	switch {
+	case !sl.tailsByVersion():
+		return nil
+	case q == latestVersion || isVersion(q):
+		return []string{q}
+	}
+	old, routed, err := aliasVersions(ctx, api, sl.unqualifiedName(), q)
+	if err != nil {
+		logger.Warnf("the log streams of every version are tailed, the alias %s is not resolved: %s", q, err)
+		return nil
+	}
+	versions := []string{old}
+	if routed != "" {
+		versions = append(versions, routed)
+	}
+	logger.Infof("the alias %s is version %s, the log streams of the other versions are skipped", q, strings.Join(versions, " and "))
+	return versions
+}
+
+// tailsByVersion returns true if the log streams are filtered by the version of the qualifier. An event
+// or a message invokes whatever its rule or event source mapping targets.
+func (sl *AWSServerless) tailsByVersion() bool {
+	return sl.ref.Qualifier != "" && sl.via != viaEventBridge && sl.via != viaSQS
+}
+
+// filterStreamVersions returns the log streams of versions, or all of them when versions is nil
+func filterStreamVersions(streams []*string, versions []string) []*string {
+	if versions == nil {
+		return streams
+	}
+	want := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		want[v] = true
+	}
+	var ret []*string
+	for _, s := range streams {
+		if v, ok := streamVersion(aws.StringValue(s)); !ok || want[v] {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// streamVersion returns the version in the name of a log stream of Lambda, "YYYY/MM/DD/[VERSION]ID"
+func streamVersion(name string) (string, bool) {
+	if len(name) < len(streamDateLayout) || !strings.HasPrefix(name[len(streamDateLayout):], "[") {
+		return "", false
+	}
+	rest := name[len(streamDateLayout)+1:]
+	i := strings.Index(rest, "]")
+	if i < 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// versionPrefixes narrows the date prefixes of the log streams to versions, as long as the prefixes
+// do not exceed maxStreamPrefixes
+func versionPrefixes(prefixes, versions []string) []string {
+	if versions == nil || len(prefixes)*len(versions) > maxStreamPrefixes {
+		return prefixes
+	}
+	ret := make([]string, 0, len(prefixes)*len(versions))
+	for _, p := range prefixes {
+		for _, v := range versions {
+			ret = append(ret, p+"["+v+"]")
+		}
+	}
+	return ret
+}
+
+func (sl *AWSServerless) planStreamVersions() []plannedCall {
+	q := sl.ref.Qualifier
+	if !sl.tailsByVersion() || q == latestVersion || isVersion(q) {
+		return nil
+	}
+	return []plannedCall{{
+		Service:   "lambda",
+		Operation: "GetAlias",
+		Params:    []planParam{{"FunctionName", sl.unqualifiedName()}, {"Name", q}},
+		Note:      "the versions of the alias, whose log streams are tailed",
+	}}
+}
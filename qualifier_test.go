@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// fakeAlias answers GetAlias with the versions of an alias, or err
+type fakeAlias struct {
+	version string
+	routed  string
+	err     error
+}
+
+func (f fakeAlias) GetAliasWithContext(ctx aws.Context, input *lambda.GetAliasInput, opts ...request.Option) (*lambda.AliasConfiguration, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &lambda.AliasConfiguration{FunctionVersion: aws.String(f.version)}
+	if f.routed != "" {
+		out.RoutingConfig = &lambda.AliasRoutingConfiguration{AdditionalVersionWeights: map[string]*float64{f.routed: aws.Float64(0.1)}}
+	}
+	return out, nil
+}
+
+func TestResolveStreamVersions(t *testing.T) {
+	setTestLogger(t)
+	tests := []struct {
+		funcName string
+		via      string
+		api      fakeAlias
+		want     []string
+	}{
+		{"orders-fn", viaInvoke, fakeAlias{}, nil},
+		{"orders-fn:$LATEST", viaInvoke, fakeAlias{}, []string{"$LATEST"}},
+		{"orders-fn:42", viaInvoke, fakeAlias{}, []string{"42"}},
+		{"orders-fn:live", viaInvoke, fakeAlias{version: "41"}, []string{"41"}},
+		{"orders-fn:live", viaURL, fakeAlias{version: "41", routed: "42"}, []string{"41", "42"}},
+		{"orders-fn:live", viaInvoke, fakeAlias{err: errors.New("AccessDenied")}, nil},
+		{"orders-fn:live", viaSQS, fakeAlias{version: "41"}, nil},
+	}
+	for _, tt := range tests {
+		ref, err := ParseFunctionRef(tt.funcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sl := &AWSServerless{funcName: tt.funcName, ref: ref, via: tt.via}
+		if got := sl.resolveStreamVersions(context.Background(), tt.api); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s via %s: got %v", tt.funcName, tt.via, got)
+		}
+	}
+}
+
+func TestFilterStreamVersions(t *testing.T) {
+	streams := aws.StringSlice([]string{
+		"2024/05/01/[$LATEST]0a1b",
+		"2024/05/01/[41]2c3d",
+		"2024/05/01/[42]4e5f",
+		"custom-stream",
+	})
+	got := aws.StringValueSlice(filterStreamVersions(streams, []string{"42"}))
+	if want := []string{"2024/05/01/[42]4e5f", "custom-stream"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+	if got := filterStreamVersions(streams, nil); len(got) != len(streams) {
+		t.Errorf("got %v", aws.StringValueSlice(got))
+	}
+}
+
+func TestVersionPrefixes(t *testing.T) {
+	got := versionPrefixes([]string{"2024/05/02/", "2024/05/01/"}, []string{"$LATEST"})
+	if want := []string{"2024/05/02/[$LATEST]", "2024/05/01/[$LATEST]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+	// too many prefixes, filtered by the dates
+	prefixes := []string{"2024/05/02/", "2024/05/01/"}
+	if got := versionPrefixes(prefixes, []string{"41", "42"}); !reflect.DeepEqual(got, prefixes) {
+		t.Errorf("got %v", got)
+	}
+}
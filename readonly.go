@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// readOnlyRule allows or rejects the operations matching the pattern in read-only mode.
+// A pattern is an operation name, optionally ending with * to match a prefix.
+type readOnlyRule struct {
+	pattern string
+	allowed bool
+	reason  string
+}
+
+// readOnlyRules is the table of operations in read-only mode. The first matching rule wins,
+// and an operation which matches none is rejected.
+var readOnlyRules = []readOnlyRule{
+	{"Invoke", true, "the invocation is the purpose of a run"},
+	{"InvokeFunctionUrl", true, "the invocation through the Function URL of -via url"},
+	{"PutEvents", true, "the event of -via eventbridge is the invocation"},
+	{"SendMessage", true, "the message of -via sqs is the invocation"},
+	{"AssumeRole*", true, "obtains credentials, nothing is changed"},
+	{"GetCallerIdentity", true, "reads the identity of the credentials"},
+	{"Get*", true, "reads"},
+	{"List*", true, "reads"},
+	{"Describe*", true, "reads"},
+	{"Filter*", true, "reads"},
+	{"BatchGet*", true, "reads"},
+	{"Update*", false, "mutates"},
+	{"Put*", false, "mutates"},
+	{"Delete*", false, "mutates"},
+	{"Create*", false, "mutates"},
+}
+
+// readOnlyError is returned for an operation rejected in read-only mode, before the request is sent
+type readOnlyError struct {
+	Service   string
+	Operation string
+}
+
+func (e *readOnlyError) Error() string {
+	return fmt.Sprintf("read-only mode: %s %s is rejected as a mutating operation", e.Service, e.Operation)
+}
+
+// readOnlyAllowed returns true if the operation is allowed in read-only mode
+func readOnlyAllowed(operation string) bool {
+	for _, r := range readOnlyRules {
+		if p := strings.TrimSuffix(r.pattern, "*"); p != r.pattern {
+			if strings.HasPrefix(operation, p) {
+				return r.allowed
+			}
+		} else if operation == r.pattern {
+			return r.allowed
+		}
+	}
+	return false
+}
+
+// readOnlyGuard fails the request of a mutating operation
+func readOnlyGuard(r *request.Request) {
+	if r.Operation == nil || readOnlyAllowed(r.Operation.Name) {
+		return
+	}
+	r.Error = &readOnlyError{Service: r.ClientInfo.ServiceName, Operation: r.Operation.Name}
+}
+
+// enforceReadOnly installs the guard to the session, so that every client made from it is guarded
+func enforceReadOnly(sess *session.Session) {
+	sess.Handlers.Validate.PushFrontNamed(request.NamedHandler{Name: "k8s-nodeless.ReadOnlyGuard", Fn: readOnlyGuard})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestReadOnlyAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"Invoke":                      true,
+		"InvokeAsync":                 false,
+		"AssumeRoleWithWebIdentity":   true,
+		"GetFunction":                 true,
+		"ListFunctions":               true,
+		"DescribeLogStreams":          true,
+		"FilterLogEvents":             true,
+		"BatchGetTraces":              true,
+		"UpdateFunctionConfiguration": false,
+		"PutFunctionConcurrency":      false,
+		"PutSubscriptionFilter":       false,
+		"DeleteSubscriptionFilter":    false,
+		"CreateLogGroup":              false,
+		"TagResource":                 false,
+		"PutObject":                   false,
+	}
+	for op, want := range tests {
+		if got := readOnlyAllowed(op); got != want {
+			t.Errorf("%s: got %v, want %v", op, got, want)
+		}
+	}
+}
+
+func TestReadOnlyRulesShadowing(t *testing.T) {
+	// a rule after a prefix rule which matches it would never be used
+	for i, r := range readOnlyRules {
+		for _, prev := range readOnlyRules[:i] {
+			p := prev.pattern
+			if p[len(p)-1] == '*' && len(r.pattern) >= len(p)-1 && r.pattern[:len(p)-1] == p[:len(p)-1] {
+				t.Errorf("%s is shadowed by %s", r.pattern, prev.pattern)
+			}
+		}
+	}
+}
+
+func TestReadOnlyGuard(t *testing.T) {
+	r := &request.Request{
+		ClientInfo: metadata.ClientInfo{ServiceName: "lambda"},
+		Operation:  &request.Operation{Name: "PutFunctionConcurrency"},
+	}
+	readOnlyGuard(r)
+	var roErr *readOnlyError
+	if !errors.As(r.Error, &roErr) || roErr.Service != "lambda" || roErr.Operation != "PutFunctionConcurrency" {
+		t.Errorf("got %v", r.Error)
+	}
+
+	r = &request.Request{Operation: &request.Operation{Name: "Invoke"}}
+	readOnlyGuard(r)
+	if r.Error != nil {
+		t.Errorf("Invoke must be allowed, got %v", r.Error)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+
+	"go.uber.org/zap"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// recordFields returns the fields of a record of the schema package as zap fields in their order,
+// leaving out the empty omitempty ones as encoding/json does, so that a record of the JSON log format
+// is what the schema describes
+func recordFields(record interface{}) []interface{} {
+	v := reflect.ValueOf(record)
+	var ret []interface{}
+	for _, f := range schema.Fields(v.Type()) {
+		fv := v.FieldByIndex(f.Index)
+		if f.OmitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		ret = append(ret, zap.Any(f.Name, fv.Interface()))
+	}
+	return ret
+}
+
+// isEmptyValue is what encoding/json omits with omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// runCommon returns the part of a "summary" record which does not depend on the vendor, from the
+// verdict, the integrity check of the payload and the comparison with the golden file. goldenResult
+// is empty unless the response is compared.
+func runCommon(v verdict, integrity *payloadIntegrity, goldenResult string, goldenDiffs []jsonDiff) schema.RunCommon {
+	result, received := integrity.result()
+	c := schema.RunCommon{
+		PayloadSHA256:    integrity.sent,
+		PayloadIntegrity: result,
+		ResponseGolden:   goldenResult,
+		ResponseDiffs:    goldenDiffs,
+		Verdict:          v.Line,
+		Outcome:          string(v.Outcome),
+	}
+	if result == integrityMismatch {
+		c.ReceivedPayloadSHA256 = received
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+func TestRecordFields(t *testing.T) {
+	fields := recordFields(schema.LocalRunSummary{
+		SchemaVersion: schema.LocalRunSummaryVersion,
+		FunctionName:  "handler",
+		Duration:      time.Second,
+		Report:        &reportMetrics{RequestID: "r1"},
+		RunCommon:     schema.RunCommon{Verdict: "✅"},
+	})
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.(zapcore.Field).Key)
+	}
+	want := []string{"schema_version", "function_name", "request_id", "exit_code", "duration", "report", "payload_sha256", "payload_integrity", "verdict", "outcome"}
+	if len(names) != len(want) {
+		t.Fatalf("got %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got %v", names)
+		}
+	}
+	if f := fields[4].(zapcore.Field); !f.Equals(zap.Duration("duration", time.Second)) {
+		t.Errorf("a duration is still a duration, got %+v", f)
+	}
+
+	// the phases are in place of the embedded struct
+	fields = recordFields(schema.RunSummary{Phases: schema.Phases{Total: time.Second}})
+	if f := fields[len(fields)-5].(zapcore.Field); f.Key != "teardown" {
+		t.Errorf("got %+v", f)
+	}
+}
+
+func TestRunCommon(t *testing.T) {
+	v := verdict{Outcome: outcomeFailure, Line: "❌ orders-fn"}
+	integrity := newPayloadIntegrity(`{"id": 1}`)
+	c := runCommon(v, integrity, "", nil)
+	if c.PayloadSHA256 != integrity.sent || c.PayloadIntegrity != integrityAbsent || c.ReceivedPayloadSHA256 != "" {
+		t.Errorf("got %+v", c)
+	}
+	if c.Verdict != v.Line || c.Outcome != "failure" || c.ResponseGolden != "" {
+		t.Errorf("got %+v", c)
+	}
+
+	integrity.handle(logEvent{Message: "NODELESS_PAYLOAD_SHA256=" + strings.Repeat("0", 64)})
+	diffs := []jsonDiff{{Path: "/id"}}
+	c = runCommon(v, integrity, "mismatch", diffs)
+	if c.PayloadIntegrity != integrityMismatch || c.ReceivedPayloadSHA256 != strings.Repeat("0", 64) {
+		t.Errorf("the received hash is not kept on a mismatch: %+v", c)
+	}
+	if c.ResponseGolden != "mismatch" || len(c.ResponseDiffs) != 1 {
+		t.Errorf("got %+v", c)
+	}
+}
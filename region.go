@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const (
+	discoverRegionTimeout     = 3 * time.Second // per region
+	discoverRegionConcurrency = 8
+)
+
+// errFunctionNotFound is returned when the function does not exist in the region
+var errFunctionNotFound = errors.New("function not found")
+
+// errRegionNotEnabled is returned when the region is an opt-in region which is not enabled for the account
+var errRegionNotEnabled = errors.New("region not enabled")
+
+// functionGetter is the part of the Lambda API the region discovery uses
+type functionGetter interface {
+	GetFunctionWithContext(ctx aws.Context, input *lambda.GetFunctionInput, opts ...request.Option) (*lambda.GetFunctionOutput, error)
+}
+
+// lambdaRegions returns the regions of Lambda known to the SDK
+func lambdaRegions() []string {
+	var regions []string
+	if svc, ok := endpoints.AwsPartition().Services()[endpoints.LambdaServiceID]; ok {
+		for id := range svc.Regions() {
+			regions = append(regions, id)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// lookupFunction returns nil if the function exists in the region of the client
+func lookupFunction(ctx context.Context, svc functionGetter, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, discoverRegionTimeout)
+	defer cancel()
+	_, err := svc.GetFunctionWithContext(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(name)})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case lambda.ErrCodeResourceNotFoundException:
+			return errFunctionNotFound
+		// the credentials are unknown to an opt-in region which is not enabled
+		case "UnrecognizedClientException", "InvalidClientTokenId":
+			return errRegionNotEnabled
+		}
+	}
+	return err
+}
+
+// discoverRegions returns the regions which have the function. A region which fails is logged and skipped.
+func discoverRegions(ctx context.Context, regions []string, name string, client func(region string) functionGetter) []string {
+	var mu sync.Mutex
+	var found []string
+	sem := make(chan struct{}, discoverRegionConcurrency)
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(region string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := lookupFunction(ctx, client(region), name)
+			switch {
+			case err == nil:
+				mu.Lock()
+				found = append(found, region)
+				mu.Unlock()
+			case errors.Is(err, errFunctionNotFound):
+			case errors.Is(err, errRegionNotEnabled):
+				logger.Debugf("discover region: %s is not enabled", region)
+			default:
+				logger.Warnf("discover region: %s: %s", region, err)
+			}
+		}(region)
+	}
+	wg.Wait()
+	sort.Strings(found)
+	return found
+}
+
+// resolveRegion returns the region of the function. The configured region is used if it has the function,
+// then the region remembered in the state, then the only one of regions which has the function.
+func resolveRegion(ctx context.Context, configured, name string, regions []string, state *localState, client func(region string) functionGetter) (string, error) {
+	if configured != "" {
+		err := lookupFunction(ctx, client(configured), name)
+		if err == nil {
+			return configured, nil
+		}
+		if !errors.Is(err, errFunctionNotFound) {
+			return "", fmt.Errorf("GetFunction, %s in %s: %w", name, configured, err)
+		}
+		logger.Infof("%s is not found in %s, discovering the region", name, configured)
+	}
+
+	f, err := state.load()
+	if err != nil {
+		logger.Warnf("discover region: %s", err)
+	} else if cached := f.Regions[name]; cached != "" && cached != configured {
+		if err := lookupFunction(ctx, client(cached), name); err == nil {
+			logger.Infof("%s is in %s, remembered in %s", name, cached, state.path)
+			return cached, nil
+		}
+	}
+
+	found := discoverRegions(ctx, regions, name, client)
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%s is not found in any region", name)
+	case 1:
+	default:
+		return "", fmt.Errorf("%s is found in %d regions, %s. specify the region by AWS_REGION or an ARN", name, len(found), strings.Join(found, ", "))
+	}
+	logger.Infof("%s is discovered in %s", name, found[0])
+	if err := state.update(func(f *stateFile) {
+		if f.Regions == nil {
+			f.Regions = make(map[string]string)
+		}
+		f.Regions[name] = found[0]
+	}); err != nil {
+		logger.Warnf("discover region: %s", err)
+	}
+	return found[0], nil
+}
+
+// lambdaClientOf returns the function which creates a Lambda client of a region from the session
+func lambdaClientOf(sess *session.Session) func(region string) functionGetter {
+	return func(region string) functionGetter {
+		return lambda.New(sess, aws.NewConfig().WithRegion(region))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// fakeRegions answers GetFunction by the region: "found", "not-enabled" or anything else for not found
+type fakeRegions struct {
+	mu      sync.Mutex
+	regions map[string]string
+	calls   []string
+}
+
+type fakeRegionClient struct {
+	f      *fakeRegions
+	region string
+}
+
+func (c fakeRegionClient) GetFunctionWithContext(ctx aws.Context, input *lambda.GetFunctionInput, opts ...request.Option) (*lambda.GetFunctionOutput, error) {
+	c.f.mu.Lock()
+	c.f.calls = append(c.f.calls, c.region)
+	c.f.mu.Unlock()
+	switch c.f.regions[c.region] {
+	case "found":
+		return &lambda.GetFunctionOutput{}, nil
+	case "not-enabled":
+		return nil, awserr.New("UnrecognizedClientException", "The security token included in the request is invalid", nil)
+	}
+	return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)
+}
+
+func (f *fakeRegions) client(region string) functionGetter {
+	return fakeRegionClient{f: f, region: region}
+}
+
+func TestResolveRegion(t *testing.T) {
+	setTestLogger(t)
+	all := []string{"ap-east-1", "ap-northeast-1", "eu-west-1", "us-east-1", "us-west-2"}
+
+	tests := []struct {
+		name       string
+		configured string
+		regions    map[string]string
+		want       string
+		err        string
+	}{
+		{"configured", "us-east-1", map[string]string{"us-east-1": "found", "eu-west-1": "found"}, "us-east-1", ""},
+		{"not in configured", "us-east-1", map[string]string{"ap-east-1": "not-enabled", "eu-west-1": "found"}, "eu-west-1", ""},
+		{"no region", "", map[string]string{"us-west-2": "found"}, "us-west-2", ""},
+		{"ambiguous", "", map[string]string{"us-west-2": "found", "ap-northeast-1": "found"}, "", "ap-northeast-1, us-west-2"},
+		{"nowhere", "", map[string]string{"ap-east-1": "not-enabled"}, "", "not found in any region"},
+	}
+	for _, tt := range tests {
+		state := newLocalState(filepath.Join(t.TempDir(), "state.json"))
+		f := &fakeRegions{regions: tt.regions}
+		got, err := resolveRegion(context.Background(), tt.configured, "fn", all, state, f.client)
+		if got != tt.want || (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %q %v, want %q %q", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestResolveRegionCache(t *testing.T) {
+	setTestLogger(t)
+	all := []string{"eu-west-1", "us-east-1", "us-west-2"}
+	state := newLocalState(filepath.Join(t.TempDir(), "state.json"))
+
+	f := &fakeRegions{regions: map[string]string{"eu-west-1": "found"}}
+	if _, err := resolveRegion(context.Background(), "", "fn", all, state, f.client); err != nil {
+		t.Fatal(err)
+	}
+	st, err := state.load()
+	if err != nil || st.Regions["fn"] != "eu-west-1" {
+		t.Fatalf("discovered region must be saved, got %v %v", st, err)
+	}
+
+	f = &fakeRegions{regions: map[string]string{"eu-west-1": "found"}}
+	got, err := resolveRegion(context.Background(), "us-east-1", "fn", all, state, f.client)
+	if err != nil || got != "eu-west-1" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if strings.Join(f.calls, ",") != "us-east-1,eu-west-1" {
+		t.Errorf("remembered region must be tried without fanning out, called %v", f.calls)
+	}
+
+	// the function is moved
+	f = &fakeRegions{regions: map[string]string{"us-west-2": "found"}}
+	got, err = resolveRegion(context.Background(), "", "fn", all, state, f.client)
+	if err != nil || got != "us-west-2" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if st, _ := state.load(); st.Regions["fn"] != "us-west-2" {
+		t.Errorf("state must be updated, got %v", st.Regions)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runRepeat invokes the function every interval of -every, up to -count times unless it is 0, and logs the
+// outcome of each run in a line. A run which takes longer than the interval delays the next one instead of
+// overlapping it. Each run has its own invoker, so nothing of a run is carried to the next. stopping ends
+// the repetition after the run in flight; a cancel of ctx stops that run too. The error is of the last
+// failed run, so that the exit code tells how it failed.
+func runRepeat(ctx context.Context, stopping <-chan struct{}, config *Config, invoke func(context.Context, *Config) error) error {
+	ticker := time.NewTicker(config.every)
+	defer ticker.Stop()
+
+	var failed, runs int
+	var last error
+	for config.count == 0 || runs < config.count {
+		if runs > 0 {
+			select {
+			case <-ctx.Done():
+				return repeatError(runs, failed, last)
+			case <-stopping:
+				logger.Infof("stopped after %s", plural(runs, "run"))
+				return repeatError(runs, failed, last)
+			case <-ticker.C:
+			}
+		}
+		runs++
+		logger.Infof("=== run %d ===", runs)
+		started := time.Now()
+		c := *config
+		err := invoke(ctx, &c)
+		logger.Info(repeatLine(runs, started, time.Since(started), err))
+		if err != nil {
+			failed++
+			last = err
+		}
+		if ctx.Err() != nil {
+			return repeatError(runs, failed, last)
+		}
+		// before the select below, which may pick a tick of the slow run
+		select {
+		case <-stopping:
+			logger.Infof("stopped after %s", plural(runs, "run"))
+			return repeatError(runs, failed, last)
+		default:
+		}
+	}
+	return repeatError(runs, failed, last)
+}
+
+// repeatLine is the outcome of a run of -every in a line, ex:
+//
+//	run 3 at 2024-05-01T12:05:00Z: success in 1.2s
+//	run 4 at 2024-05-01T12:10:00Z: failure (exit 1) in 812ms: Invoke error, ...
+func repeatLine(run int, started time.Time, d time.Duration, err error) string {
+	line := fmt.Sprintf("run %d at %s: ", run, started.UTC().Format(time.RFC3339))
+	code := exitCode(err)
+	switch code {
+	case exitSuccess:
+		line += string(outcomeSuccess)
+	case exitFunctionError:
+		line += fmt.Sprintf("%s (exit %d)", outcomeFailure, code)
+	case exitTimeout:
+		line += fmt.Sprintf("timeout (exit %d)", code)
+	default:
+		line += fmt.Sprintf("%s (exit %d)", outcomeError, code)
+	}
+	line += " in " + formatSpan(d)
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	return line
+}
+
+// repeatError returns the error of the repetition, nil if every run succeeded
+func repeatError(runs, failed int, last error) error {
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %s failed, the last: %w", failed, plural(runs, "run"), last)
+}
+
+// finishOnSignal closes the returned channel on SIGINT or SIGTERM, so that -every finishes the run in
+// flight with its tail before it exits. A second signal cancels ctx as cancelOnSignal does, and a third
+// kills the process as usual. The returned func stops the watching.
+func finishOnSignal(ctx context.Context, cancel context.CancelFunc) (<-chan struct{}, func()) {
+	stopping := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			logger.Infof("finishing the run in flight, interrupt again to stop it")
+			close(stopping)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-sig:
+			signal.Stop(sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return stopping, func() { signal.Stop(sig) }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRepeat(t *testing.T) {
+	logs := setTestLogger(t)
+	config := &Config{every: 10 * time.Millisecond, count: 3, payload: `{"id": 1}`}
+	var runs []time.Time
+	invoke := func(ctx context.Context, c *Config) error {
+		if c == config {
+			t.Error("each run must have its own config")
+		}
+		runs = append(runs, time.Now())
+		if len(runs) == 2 {
+			return &functionError{errors.New("out of stock")}
+		}
+		return nil
+	}
+	err := runRepeat(context.Background(), nil, config, invoke)
+	if len(runs) != 3 {
+		t.Fatalf("%d runs, want 3", len(runs))
+	}
+	if exitCode(err) != exitFunctionError || !strings.Contains(err.Error(), "1 of 3 runs failed") {
+		t.Errorf("runRepeat() error = %v", err)
+	}
+	if d := runs[2].Sub(runs[1]); d < 5*time.Millisecond {
+		t.Errorf("runs are %s apart, want the interval", d)
+	}
+	if logs.FilterMessageSnippet(": success in").Len() != 2 || logs.FilterMessageSnippet("run 2 at").FilterMessageSnippet("failure (exit 1)").Len() != 1 {
+		t.Errorf("no outcome line of each run: %v", logs.All())
+	}
+}
+
+func TestRunRepeatStopping(t *testing.T) {
+	setTestLogger(t)
+	config := &Config{every: time.Millisecond}
+	stopping := make(chan struct{})
+	runs := 0
+	invoke := func(ctx context.Context, c *Config) error {
+		runs++
+		// an interrupt while the run is in flight does not stop it
+		close(stopping)
+		select {
+		case <-ctx.Done():
+			t.Error("the run in flight is cancelled")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return nil
+	}
+	if err := runRepeat(context.Background(), stopping, config, invoke); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("%d runs after the interrupt, want 1", runs)
+	}
+}
+
+func TestRunRepeatCancel(t *testing.T) {
+	setTestLogger(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	invoke := func(ctx context.Context, c *Config) error {
+		runs++
+		cancel()
+		return &timeoutError{ctx.Err()}
+	}
+	err := runRepeat(ctx, nil, &Config{every: time.Millisecond}, invoke)
+	if runs != 1 || exitCode(err) != exitTimeout {
+		t.Errorf("%d runs, error = %v", runs, err)
+	}
+}
+
+func TestRepeatLine(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 5, 0, 0, time.UTC)
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "run 3 at 2024-05-01T12:05:00Z: success in 1.2s"},
+		{&functionError{errors.New("boom")}, "run 3 at 2024-05-01T12:05:00Z: failure (exit 1) in 1.2s: boom"},
+		{&timeoutError{errors.New("no END")}, "run 3 at 2024-05-01T12:05:00Z: timeout (exit 4) in 1.2s: no END"},
+		{errors.New("throttled"), "run 3 at 2024-05-01T12:05:00Z: error (exit 2) in 1.2s: throttled"},
+	}
+	for _, tt := range tests {
+		if got := repeatLine(3, started, 1200*time.Millisecond, tt.err); got != tt.want {
+			t.Errorf("repeatLine(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
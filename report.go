@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+var reportRequestRe = regexp.MustCompile(`^REPORT RequestId: (\S+)`)
+var reportFieldRe = regexp.MustCompile(`(Init Duration|Billed Restore Duration|Restore Duration|Billed Duration|Duration|Memory Size|Max Memory Used): ([0-9.]+) (ms|MB)`)
+
+// restoreReportRe matches the RESTORE_REPORT line of a SnapStart function restored from a snapshot
+var restoreReportRe = regexp.MustCompile(`^RESTORE_REPORT Restore Duration: ([0-9.]+) ms`)
+
+// start types of an invocation
+const (
+	startCold             = "cold"
+	startWarm             = "warm"
+	startSnapStartRestore = "snapstart-restore" // a SnapStart environment restored from a snapshot instead of init
+)
+
+// reportMetrics is the metrics of an invocation from the REPORT line
+type reportMetrics = schema.Report
+
+// startType returns how the execution environment of the invocation was started
+func startType(r *reportMetrics) string {
+	switch {
+	case r.RestoreDuration > 0:
+		return startSnapStartRestore
+	case r.ColdStart:
+		return startCold
+	}
+	return startWarm
+}
+
+// parseReport parses a REPORT line, ex:
+//
+//	REPORT RequestId: 2e3c63b7-... Duration: 1.85 ms Billed Duration: 2 ms Memory Size: 128 MB Max Memory Used: 64 MB Init Duration: 140.25 ms
+//	REPORT RequestId: 2e3c63b7-... Duration: 6.17 ms Billed Duration: 275 ms Memory Size: 512 MB Max Memory Used: 127 MB Restore Duration: 368.28 ms Billed Restore Duration: 268 ms
+func parseReport(line string) (reportMetrics, bool) {
+	m := reportRequestRe.FindStringSubmatch(line)
+	if len(m) != 2 {
+		return reportMetrics{}, false
+	}
+	ret := reportMetrics{RequestID: m[1]}
+	for _, f := range reportFieldRe.FindAllStringSubmatch(line, -1) {
+		v, err := strconv.ParseFloat(f[2], 64)
+		if err != nil {
+			continue
+		}
+		switch f[1] {
+		case "Duration":
+			ret.Duration = v
+		case "Billed Duration":
+			ret.BilledDuration = v
+		case "Memory Size":
+			ret.MemorySize = v
+		case "Max Memory Used":
+			ret.MaxMemoryUsed = v
+		case "Init Duration":
+			ret.InitDuration = v
+			ret.ColdStart = true
+		case "Restore Duration":
+			ret.RestoreDuration = v
+		case "Billed Restore Duration":
+			ret.BilledRestoreDuration = v
+		}
+	}
+	return ret, true
+}
+
+// parseRestoreReport returns the restore duration of a RESTORE_REPORT line in the text or JSON format.
+// Unlike REPORT, it has no request id, and is logged before START of the first request of the environment.
+func parseRestoreReport(message string) (float64, bool) {
+	if strings.HasPrefix(message, `{"time":`) {
+		var rec platformRecord
+		if json.Unmarshal([]byte(message), &rec) != nil || rec.Type != "platform.restoreReport" {
+			return 0, false
+		}
+		return rec.Record.Metrics.DurationMs, true
+	}
+	m := restoreReportRe.FindStringSubmatch(message)
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	return v, err == nil
+}
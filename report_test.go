@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestParseReport(t *testing.T) {
+	m, ok := parseReport("REPORT RequestId: 2e3c63b7-0681-4e60-9767-b025b0714db1\tDuration: 1.85 ms\tBilled Duration: 2 ms\tMemory Size: 128 MB\tMax Memory Used: 64 MB\tInit Duration: 140.25 ms\t\n")
+	if !ok {
+		t.Fatal("REPORT expected")
+	}
+	want := reportMetrics{
+		RequestID:      "2e3c63b7-0681-4e60-9767-b025b0714db1",
+		Duration:       1.85,
+		BilledDuration: 2,
+		MemorySize:     128,
+		MaxMemoryUsed:  64,
+		InitDuration:   140.25,
+		ColdStart:      true,
+	}
+	if m != want {
+		t.Errorf("got %+v", m)
+	}
+
+	m, ok = parseReport("REPORT RequestId: abc\tDuration: 10.00 ms\tBilled Duration: 10 ms\tMemory Size: 128 MB\tMax Memory Used: 70 MB\t")
+	if !ok || m.ColdStart || m.Duration != 10 {
+		t.Errorf("got %+v", m)
+	}
+
+	if _, ok := parseReport("END RequestId: abc"); ok {
+		t.Error("not a REPORT")
+	}
+}
+
+func TestParseReportSnapStart(t *testing.T) {
+	m, ok := parseReport("REPORT RequestId: abc\tDuration: 6.17 ms\tBilled Duration: 275 ms\tMemory Size: 512 MB\tMax Memory Used: 127 MB\tRestore Duration: 368.28 ms\tBilled Restore Duration: 268 ms\t")
+	if !ok {
+		t.Fatal("REPORT expected")
+	}
+	if m.Duration != 6.17 || m.BilledDuration != 275 || m.RestoreDuration != 368.28 || m.BilledRestoreDuration != 268 || m.ColdStart {
+		t.Errorf("got %+v", m)
+	}
+	if startType(&m) != startSnapStartRestore {
+		t.Errorf("got %s", startType(&m))
+	}
+
+	for _, tt := range []struct {
+		m    reportMetrics
+		want string
+	}{
+		{reportMetrics{}, startWarm},
+		{reportMetrics{InitDuration: 140, ColdStart: true}, startCold},
+	} {
+		if got := startType(&tt.m); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestParseRestoreReport(t *testing.T) {
+	tests := []struct {
+		message string
+		want    float64
+		ok      bool
+	}{
+		{"RESTORE_REPORT Restore Duration: 571.67 ms\n", 571.67, true},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.restoreReport","record":{"status":"success","metrics":{"durationMs":571.67}}}`, 571.67, true},
+		{`{"time":"2023-11-20T10:00:00.000Z","type":"platform.report","record":{"requestId":"abc","metrics":{"durationMs":1.5}}}`, 0, false},
+		{"RESTORE_START Runtime Version: java:11.v15", 0, false},
+		{"REPORT RequestId: abc\tDuration: 1.00 ms", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRestoreReport(tt.message)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v %v", tt.message, got, ok)
+		}
+	}
+}
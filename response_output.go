@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// outputStdout is the -output which writes the response to stdout
+const outputStdout = "-"
+
+// writeOutput writes the response payload of a sync invocation as is to -output, or to stdout for -,
+// ending with a newline there so that the next log line starts on its own line. A file is replaced at
+// once by renaming a temp file in its directory, so that the next step of a pipeline never reads a
+// partial response.
+func writeOutput(path string, payload []byte, stdout io.Writer) error {
+	switch path {
+	case "":
+		return nil
+	case outputStdout:
+		if !bytes.HasSuffix(payload, []byte("\n")) {
+			payload = append(payload[:len(payload):len(payload)], '\n')
+		}
+		_, err := stdout.Write(payload)
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write output, %s: %w", path, err)
+	}
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write output, %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write output, %s: %w", path, err)
+	}
+	// TempFile creates it 0600, an output is as readable as a file written by the shell
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write output, %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write output, %s: %w", path, err)
+	}
+	logger.Infof("the response is written to %s (%d bytes)", path, len(payload))
+	return nil
+}
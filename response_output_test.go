@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteOutput(t *testing.T) {
+	setTestLogger(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "response.json")
+	if err := ioutil.WriteFile(path, []byte(`{"old": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"errorMessage": "boom", "errorType": "Error"}`)
+	if err := writeOutput(path, payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("got %s %v", got, err)
+	}
+	if fi, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && fi.Mode().Perm() != 0644 {
+		t.Errorf("got %v %v", fi.Mode(), err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the temp file is left, got %d entries", len(entries))
+	}
+
+	var stdout bytes.Buffer
+	if err := writeOutput(outputStdout, payload, &stdout); err != nil || stdout.String() != string(payload)+"\n" {
+		t.Errorf("got %s %v", stdout.String(), err)
+	}
+	if err := writeOutput("", payload, &stdout); err != nil || stdout.Len() != len(payload)+1 {
+		t.Errorf("no -output must write nothing, got %v", err)
+	}
+	if err := writeOutput(filepath.Join(dir, "missing", "response.json"), payload, nil); err == nil {
+		t.Errorf("a missing directory must be an error")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	ssmStandardValueLimit = 4096 // bytes of the value of a standard parameter
+	ssmAdvancedValueLimit = 8192 // of an advanced parameter
+	resultPublishTimeout  = 30 * time.Second
+	resultErrorLimit      = 1024 // bytes of the error of a run in a result
+)
+
+// ssmAPI is the part of the SSM API -publish-result uses
+type ssmAPI interface {
+	PutParameterWithContext(aws.Context, *ssm.PutParameterInput, ...request.Option) (*ssm.PutParameterOutput, error)
+}
+
+// s3API is the part of the S3 API -publish-result uses
+type s3API interface {
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+}
+
+// resultDestination is an SSM parameter, ssm:/NAME, or an S3 object, s3://BUCKET/KEY
+type resultDestination struct {
+	parameter string
+	bucket    string
+	key       string
+}
+
+// parseResultDestination parses ssm:/NAME or s3://BUCKET/KEY. The key of an S3 prefix, which
+// -publish-spill takes, may be empty.
+func parseResultDestination(s string, prefix bool) (resultDestination, error) {
+	switch {
+	case strings.HasPrefix(s, "ssm:") && !prefix:
+		name := strings.TrimPrefix(s, "ssm:")
+		if name == "" || strings.Contains(name, "//") {
+			return resultDestination{}, fmt.Errorf("the parameter of %s must be a name or a path, ssm:/path/to/param", s)
+		}
+		return resultDestination{parameter: name}, nil
+	case strings.HasPrefix(s, "s3://"):
+		parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+		d := resultDestination{bucket: parts[0]}
+		if len(parts) == 2 {
+			d.key = parts[1]
+		}
+		if d.bucket == "" || (d.key == "" && !prefix) || strings.HasSuffix(d.key, "/") && !prefix {
+			return resultDestination{}, fmt.Errorf("%s must be s3://BUCKET/KEY", s)
+		}
+		return d, nil
+	}
+	if prefix {
+		return resultDestination{}, fmt.Errorf("%s must be s3://BUCKET/PREFIX", s)
+	}
+	return resultDestination{}, fmt.Errorf("%s must be ssm:/path/to/param or s3://BUCKET/KEY", s)
+}
+
+func (d resultDestination) String() string {
+	if d.parameter != "" {
+		return "ssm:" + d.parameter
+	}
+	return "s3://" + d.bucket + "/" + d.key
+}
+
+// summaryCapture is a zap core which keeps the fields of the last "summary" record, so that the
+// result of a run carries the summary whichever vendor logged it
+type summaryCapture struct {
+	mu     sync.Mutex
+	fields map[string]interface{}
+}
+
+// summaryCaptureWith is the capture of a logger with fields
+type summaryCaptureWith struct {
+	*summaryCapture
+	context []zapcore.Field
+}
+
+func (c summaryCaptureWith) With(fields []zapcore.Field) zapcore.Core {
+	return summaryCaptureWith{c.summaryCapture, append(append([]zapcore.Field{}, c.context...), fields...)}
+}
+
+func (c summaryCaptureWith) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if e.Message == "summary" {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c summaryCaptureWith) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	return c.summaryCapture.Write(e, append(append([]zapcore.Field{}, c.context...), fields...))
+}
+
+func (c *summaryCapture) Enabled(zapcore.Level) bool { return true }
+func (c *summaryCapture) Sync() error                { return nil }
+
+func (c *summaryCapture) With(fields []zapcore.Field) zapcore.Core {
+	return summaryCaptureWith{c, fields}
+}
+
+func (c *summaryCapture) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fields = nil
+}
+
+// wrap returns the logger which also writes to the capture
+func (c *summaryCapture) wrap(l *zap.SugaredLogger) *zap.SugaredLogger {
+	return l.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, c)
+	})).Sugar()
+}
+
+func (c *summaryCapture) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if e.Message == "summary" {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *summaryCapture) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fields = enc.Fields
+	return nil
+}
+
+// summary returns the last summary as JSON, and its verdict and outcome
+func (c *summaryCapture) summary() (json.RawMessage, string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fields == nil {
+		return nil, "", ""
+	}
+	buf, err := json.Marshal(c.fields)
+	if err != nil {
+		return nil, "", ""
+	}
+	v, _ := c.fields["verdict"].(string)
+	o, _ := c.fields["outcome"].(string)
+	return buf, v, o
+}
+
+// resultPublisher writes the result of a run to an SSM parameter or an S3 object at its end, also
+// when it fails, for the later stages of a pipeline to branch on without parsing the logs
+type resultPublisher struct {
+	dest      resultDestination
+	spill     resultDestination // the prefix of a result too large for a parameter, none if bucket is empty
+	overwrite bool
+	secure    bool // an SSM SecureString of the default key
+	required  bool // a failure to publish fails the run
+
+	network      networkOptions
+	noCredsCache bool
+	ssm          ssmAPI
+	s3           s3API
+	capture      *summaryCapture
+}
+
+// newResultPublisher returns the publisher of the flags of -publish-result
+func newResultPublisher(dest, spill string, overwrite, secure, required bool) (*resultPublisher, error) {
+	d, err := parseResultDestination(dest, false)
+	if err != nil {
+		return nil, fmt.Errorf("-publish-result: %w", err)
+	}
+	p := &resultPublisher{dest: d, overwrite: overwrite, secure: secure, required: required, capture: &summaryCapture{}}
+	if spill != "" {
+		if p.spill, err = parseResultDestination(spill, true); err != nil {
+			return nil, fmt.Errorf("-publish-spill: %w", err)
+		}
+	}
+	if secure && d.parameter == "" {
+		return nil, fmt.Errorf("-publish-secure-string needs an ssm: -publish-result")
+	}
+	return p, nil
+}
+
+// clients makes the AWS clients of the default region unless they are set
+func (p *resultPublisher) clients() error {
+	if p.ssm != nil && p.s3 != nil {
+		return nil
+	}
+	opts, err := newAWSSessionOptions("", p.network, p.noCredsCache)
+	if err != nil {
+		return err
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	if p.ssm == nil {
+		p.ssm = ssm.New(sess)
+	}
+	if p.s3 == nil {
+		p.s3 = s3.New(sess)
+	}
+	return nil
+}
+
+// newRunResult returns the result of the run of the config which ended with err. The outcome is
+// that of the summary when the run got that far.
+func (p *resultPublisher) newRunResult(config *Config, started time.Time, err error) schema.RunResult {
+	r := schema.RunResult{
+		SchemaVersion: schema.RunResultVersion,
+		Function:      config.funcName,
+		Vendor:        string(config.vendor),
+		Outcome:       string(outcomeSuccess),
+		StartedAt:     started.UTC(),
+		FinishedAt:    time.Now().UTC(),
+	}
+	var outcome string
+	r.Summary, r.Verdict, outcome = p.capture.summary()
+	if err != nil {
+		r.Outcome, r.ExitCode = string(outcomeError), exitCode(err)
+		if isFunctionError(err) {
+			r.Outcome = string(outcomeFailure)
+		}
+		r.Error = truncateMiddle(err.Error(), resultErrorLimit)
+	}
+	if outcome != "" {
+		r.Outcome = outcome
+	}
+	return r
+}
+
+// publish writes the result. A result larger than an advanced parameter is written to the spill
+// prefix, and the parameter gets the result without the summary and where the whole one is.
+func (p *resultPublisher) publish(ctx context.Context, r schema.RunResult) error {
+	if err := p.clients(); err != nil {
+		return err
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if p.dest.parameter == "" {
+		return p.putObject(ctx, p.dest, body)
+	}
+	if len(body) > ssmAdvancedValueLimit {
+		if p.spill.bucket == "" {
+			return fmt.Errorf("the result of %d bytes is larger than %d bytes of an SSM parameter, give -publish-spill s3://BUCKET/PREFIX", len(body), ssmAdvancedValueLimit)
+		}
+		spilled := resultDestination{bucket: p.spill.bucket, key: path.Join(p.spill.key, strings.TrimPrefix(p.dest.parameter, "/")+".json")}
+		if err := p.putObject(ctx, spilled, body); err != nil {
+			return err
+		}
+		r.Summary, r.ResultS3 = nil, spilled.String()
+		if body, err = json.Marshal(r); err != nil {
+			return err
+		}
+	}
+	return p.putParameter(ctx, body)
+}
+
+// putParameter writes the parameter. It is Intelligent-Tiering, a standard parameter up to 4KB and
+// an advanced one above, which can not be made standard again.
+func (p *resultPublisher) putParameter(ctx context.Context, body []byte) error {
+	typ := ssm.ParameterTypeString
+	if p.secure {
+		typ = ssm.ParameterTypeSecureString
+	}
+	if len(body) > ssmStandardValueLimit {
+		logger.Infof("the result of %d bytes is larger than %d bytes, %s is an advanced parameter", len(body), ssmStandardValueLimit, p.dest)
+	}
+	out, err := p.ssm.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(p.dest.parameter),
+		Value:     aws.String(string(body)),
+		Type:      aws.String(typ),
+		Tier:      aws.String(ssm.ParameterTierIntelligentTiering),
+		Overwrite: aws.Bool(p.overwrite),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == ssm.ErrCodeParameterAlreadyExists {
+		return fmt.Errorf("PutParameter %s: it exists, and -publish-overwrite=false", p.dest.parameter)
+	}
+	if err != nil {
+		return fmt.Errorf("PutParameter %s: %w", p.dest.parameter, err)
+	}
+	logger.Infof("the result is published to %s, version %d", p.dest, aws.Int64Value(out.Version))
+	return nil
+}
+
+// putObject writes the object. Without overwrite, an existing object is an error, checked before
+// the write since S3 has no conditional put.
+func (p *resultPublisher) putObject(ctx context.Context, d resultDestination, body []byte) error {
+	if !p.overwrite {
+		_, err := p.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(d.bucket), Key: aws.String(d.key)})
+		var awsErr awserr.Error
+		switch {
+		case err == nil:
+			return fmt.Errorf("PutObject %s: it exists, and -publish-overwrite=false", d)
+		case !errors.As(err, &awsErr) || awsErr.Code() != "NotFound":
+			return fmt.Errorf("HeadObject %s: %w", d, err)
+		}
+	}
+	_, err := p.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(d.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject %s: %w", d, err)
+	}
+	logger.Infof("the result is published to %s", d)
+	return nil
+}
+
+// invokeAndPublish invokes the function once, and publishes the result by -publish-result whatever
+// the outcome. A failure to publish fails only a run which succeeded, and only with -publish-required.
+func invokeAndPublish(ctx context.Context, config *Config) error {
+	p := config.publisher
+	if p == nil {
+		return invokeOnce(ctx, config)
+	}
+	p.capture.reset()
+	started := time.Now()
+	err := invokeOnce(ctx, config)
+
+	// the run may have been interrupted, the result is published all the same
+	pctx, cancel := context.WithTimeout(context.Background(), resultPublishTimeout)
+	defer cancel()
+	perr := p.publish(pctx, p.newRunResult(config, started, err))
+	switch {
+	case perr == nil:
+	case p.required && err == nil:
+		return fmt.Errorf("-publish-result: %w", perr)
+	case p.required:
+		logger.Errorf("-publish-result: %s", perr)
+	default:
+		logger.Warnf("-publish-result: %s", perr)
+	}
+	return err
+}
+
+// publishStep describes the publishing of the result in a plan
+func publishStep(p *resultPublisher) step {
+	return step{
+		name: "publish-result",
+		plan: func() ([]plannedCall, error) {
+			if p.dest.parameter == "" {
+				return []plannedCall{{
+					Service:   "s3",
+					Operation: "PutObject",
+					Params:    []planParam{{"Bucket", p.dest.bucket}, {"Key", p.dest.key}},
+					Note:      "the result of the run, also when it fails",
+				}}, nil
+			}
+			note := "the result of the run, also when it fails"
+			if p.spill.bucket != "" {
+				note += ". PutObject to " + p.spill.String() + " first when it is larger than 8KB"
+			}
+			return []plannedCall{{
+				Service:   "ssm",
+				Operation: "PutParameter",
+				Params:    []planParam{{"Name", p.dest.parameter}},
+				Note:      note,
+			}}, nil
+		},
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// fakeSSM keeps the parameters, with the limits of the value of each tier
+type fakeSSM struct {
+	params map[string]*ssm.PutParameterInput
+	err    error
+}
+
+func (f *fakeSSM) PutParameterWithContext(ctx aws.Context, input *ssm.PutParameterInput, opts ...request.Option) (*ssm.PutParameterOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	name, n := aws.StringValue(input.Name), len(aws.StringValue(input.Value))
+	limit := ssmStandardValueLimit
+	if tier := aws.StringValue(input.Tier); tier == ssm.ParameterTierAdvanced || tier == ssm.ParameterTierIntelligentTiering {
+		limit = ssmAdvancedValueLimit
+	}
+	if n > limit {
+		return nil, awserr.New("ValidationException", fmt.Sprintf("value of %d bytes is too large", n), nil)
+	}
+	if _, ok := f.params[name]; ok && !aws.BoolValue(input.Overwrite) {
+		return nil, awserr.New(ssm.ErrCodeParameterAlreadyExists, "The parameter already exists.", nil)
+	}
+	f.params[name] = input
+	return &ssm.PutParameterOutput{Version: aws.Int64(1)}, nil
+}
+
+// fakeS3 keeps the objects by s3://BUCKET/KEY
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects["s3://"+aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = string(buf)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if _, ok := f.objects["s3://"+aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]; !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func newTestPublisher(t *testing.T, dest, spill string, overwrite, secure, required bool) (*resultPublisher, *fakeSSM, *fakeS3) {
+	t.Helper()
+	p, err := newResultPublisher(dest, spill, overwrite, secure, required)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, f3 := &fakeSSM{params: make(map[string]*ssm.PutParameterInput)}, &fakeS3{objects: make(map[string]string)}
+	p.ssm, p.s3 = fs, f3
+	return p, fs, f3
+}
+
+func TestParseResultDestination(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		prefix bool
+		want   string
+		err    bool
+	}{
+		{in: "ssm:/ci/orders/result", want: "ssm:/ci/orders/result"},
+		{in: "ssm:result", want: "ssm:result"},
+		{in: "s3://bucket/ci/result.json", want: "s3://bucket/ci/result.json"},
+		{in: "s3://bucket/ci/", prefix: true, want: "s3://bucket/ci/"},
+		{in: "s3://bucket", prefix: true, want: "s3://bucket/"},
+		{in: "ssm:", err: true},
+		{in: "s3://bucket", err: true},
+		{in: "s3://bucket/dir/", err: true},
+		{in: "s3:///key", err: true},
+		{in: "ssm:/p", prefix: true, err: true},
+		{in: "/ci/result", err: true},
+	} {
+		d, err := parseResultDestination(c.in, c.prefix)
+		if (err != nil) != c.err || err == nil && d.String() != c.want {
+			t.Errorf("%s: got %v %v", c.in, d, err)
+		}
+	}
+	if _, err := newResultPublisher("s3://bucket/key", "", true, true, false); err == nil {
+		t.Error("a SecureString must need an ssm: destination")
+	}
+}
+
+func TestPublishResult(t *testing.T) {
+	setTestLogger(t)
+	ctx := context.Background()
+	r := schema.RunResult{SchemaVersion: schema.RunResultVersion, Function: "orders", Outcome: "success", Summary: json.RawMessage(`{"verdict":"PASS"}`)}
+
+	p, fs, _ := newTestPublisher(t, "ssm:/ci/orders", "", true, true, false)
+	if err := p.publish(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	put := fs.params["/ci/orders"]
+	if aws.StringValue(put.Type) != ssm.ParameterTypeSecureString || aws.StringValue(put.Tier) != ssm.ParameterTierIntelligentTiering {
+		t.Errorf("got %v", put)
+	}
+	var got schema.RunResult
+	if err := json.Unmarshal([]byte(aws.StringValue(put.Value)), &got); err != nil || string(got.Summary) != `{"verdict":"PASS"}` {
+		t.Errorf("got %s %v", aws.StringValue(put.Value), err)
+	}
+
+	// an advanced parameter up to 8KB, the spill prefix above
+	r.Summary = json.RawMessage(`{"pad":"` + strings.Repeat("x", 5000) + `"}`)
+	if err := p.publish(ctx, r); err != nil {
+		t.Errorf("a result of 5KB must fit an advanced parameter, got %v", err)
+	}
+	r.Summary = json.RawMessage(`{"pad":"` + strings.Repeat("x", 9000) + `"}`)
+	if err := p.publish(ctx, r); err == nil || !strings.Contains(err.Error(), "-publish-spill") {
+		t.Errorf("got %v", err)
+	}
+	p, fs, f3 := newTestPublisher(t, "ssm:/ci/orders", "s3://artifacts/results", true, false, false)
+	if err := p.publish(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	spilled := f3.objects["s3://artifacts/results/ci/orders.json"]
+	if len(spilled) < 9000 {
+		t.Errorf("the whole result must be spilled, got %d bytes in %v", len(spilled), f3.objects)
+	}
+	got = schema.RunResult{}
+	if err := json.Unmarshal([]byte(aws.StringValue(fs.params["/ci/orders"].Value)), &got); err != nil || got.Summary != nil || got.ResultS3 != "s3://artifacts/results/ci/orders.json" || got.Function != "orders" {
+		t.Errorf("got %+v %v", got, err)
+	}
+}
+
+func TestPublishResultOverwrite(t *testing.T) {
+	setTestLogger(t)
+	ctx := context.Background()
+	r := schema.RunResult{Function: "orders"}
+
+	p, _, _ := newTestPublisher(t, "ssm:/ci/orders", "", false, false, false)
+	if err := p.publish(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.publish(ctx, r); err == nil || !strings.Contains(err.Error(), "-publish-overwrite=false") {
+		t.Errorf("got %v", err)
+	}
+
+	p, _, f3 := newTestPublisher(t, "s3://artifacts/orders.json", "", false, false, false)
+	if err := p.publish(ctx, r); err != nil || f3.objects["s3://artifacts/orders.json"] == "" {
+		t.Fatalf("got %v %v", err, f3.objects)
+	}
+	if err := p.publish(ctx, r); err == nil || !strings.Contains(err.Error(), "-publish-overwrite=false") {
+		t.Errorf("got %v", err)
+	}
+	p.overwrite = true
+	if err := p.publish(ctx, r); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestInvokeAndPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := setTestLogger(t)
+
+	p, fs, _ := newTestPublisher(t, "ssm:/ci/orders", "", true, false, false)
+	logger = p.capture.wrap(logger)
+	config := &Config{vendor: VendorLocal, funcName: writeScript(t, dir, "exit 3\n"), localTimeout: 5 * time.Second, publisher: p}
+	err = invokeAndPublish(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "Unhandled") {
+		t.Fatalf("the error of the run must be kept, got %v", err)
+	}
+	var got schema.RunResult
+	if err := json.Unmarshal([]byte(aws.StringValue(fs.params["/ci/orders"].Value)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Outcome == "success" || got.ExitCode != exitCode(err) || got.Vendor != "local" || !strings.Contains(got.Error, "Unhandled") || got.Verdict == "" {
+		t.Errorf("got %+v", got)
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal(got.Summary, &summary); err != nil || summary["verdict"] != got.Verdict || summary["outcome"] != got.Outcome {
+		t.Errorf("the summary of the run must be in the result, got %s %v", got.Summary, err)
+	}
+
+	// a failure to publish is a warning unless -publish-required, and never hides the error of the run
+	fs.err = errors.New("AccessDeniedException")
+	if err := invokeAndPublish(context.Background(), config); err == nil || !strings.Contains(err.Error(), "Unhandled") {
+		t.Errorf("got %v", err)
+	}
+	if logs.FilterMessageSnippet("AccessDeniedException").Len() != 1 {
+		t.Errorf("the failure to publish must be logged: %v", logs.All())
+	}
+	p.required = true
+	config.funcName = writeScript(t, dir, "echo ok\n")
+	if err := invokeAndPublish(context.Background(), config); err == nil || !strings.Contains(err.Error(), "AccessDeniedException") {
+		t.Errorf("-publish-required must fail a run which succeeded, got %v", err)
+	}
+}
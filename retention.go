@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// kindLogGroupRetention is the journal kind of -set-retention
+const kindLogGroupRetention = "log-group-retention"
+
+// validRetentionDays are the retention periods CloudWatch Logs accepts
+var validRetentionDays = []int64{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// retentionAPI is the part of CloudWatch Logs API used to check and set the retention of a log group
+type retentionAPI interface {
+	DescribeLogGroupsPagesWithContext(aws.Context, *cloudwatchlogs.DescribeLogGroupsInput, func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool, ...request.Option) error
+	PutRetentionPolicyWithContext(aws.Context, *cloudwatchlogs.PutRetentionPolicyInput, ...request.Option) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
+	DeleteRetentionPolicyWithContext(aws.Context, *cloudwatchlogs.DeleteRetentionPolicyInput, ...request.Option) (*cloudwatchlogs.DeleteRetentionPolicyOutput, error)
+}
+
+// parseRetentionDays parses -set-retention, one of validRetentionDays. An empty string is 0, not set.
+func parseRetentionDays(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	days, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		for _, d := range validRetentionDays {
+			if d == days {
+				return days, nil
+			}
+		}
+	}
+	valid := make([]string, len(validRetentionDays))
+	for i, d := range validRetentionDays {
+		valid[i] = strconv.FormatInt(d, 10)
+	}
+	return 0, fmt.Errorf("set-retention must be one of %s days, %s", strings.Join(valid, ", "), s)
+}
+
+// logGroupRetention is the retention of a log group
+type logGroupRetention struct {
+	Days        int64 // 0 when the logs never expire
+	StoredBytes int64
+}
+
+// describeRetention returns the retention of the log group. It returns false if there is no such group,
+// as a function which has never run has none.
+func describeRetention(ctx context.Context, api retentionAPI, group string) (logGroupRetention, bool, error) {
+	var ret logGroupRetention
+	found := false
+	err := api.DescribeLogGroupsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogGroupsInput{LogGroupNamePrefix: aws.String(group)},
+		func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+			for _, g := range page.LogGroups {
+				if aws.StringValue(g.LogGroupName) == group {
+					ret = logGroupRetention{Days: aws.Int64Value(g.RetentionInDays), StoredBytes: aws.Int64Value(g.StoredBytes)}
+					found = true
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return ret, false, fmt.Errorf("DescribeLogGroups, %s: %w", group, err)
+	}
+	return ret, found, nil
+}
+
+// retentionWarning returns why the retention of the group deserves a warning, or "" if it does not.
+// window is how far back a historical command looks, 0 for a run.
+func retentionWarning(group string, r logGroupRetention, window time.Duration) string {
+	if r.Days == 0 {
+		return fmt.Sprintf("the logs of %s never expire and %d bytes are stored, use -set-retention DAYS to expire them", group, r.StoredBytes)
+	}
+	if retention := time.Duration(r.Days) * 24 * time.Hour; window > retention {
+		return fmt.Sprintf("the retention of %s is %d days, shorter than %s looked back, the older logs are expired", group, r.Days, window)
+	}
+	return ""
+}
+
+// checkRetention warns about the retention of the log group, and returns it. Whatever can not be
+// told is not warned about.
+func checkRetention(ctx context.Context, api retentionAPI, group string, window time.Duration) (logGroupRetention, bool) {
+	r, found, err := describeRetention(ctx, api, group)
+	if err != nil {
+		logger.Debugf("can not tell the retention of %s: %s", group, err)
+		return r, false
+	}
+	if !found {
+		logger.Debugf("no log group %s yet", group)
+		return r, false
+	}
+	if w := retentionWarning(group, r, window); w != "" {
+		logger.Warnf("%s", w)
+	}
+	return r, true
+}
+
+// retentionPrevious is the state a retention mutation restores
+type retentionPrevious struct {
+	Days *int64 `json:"retention_in_days"` // nil when the logs never expired
+}
+
+// setRetention sets the retention of the log group from cur to days. The mutation is recorded in the
+// journal before it is made, so that the cleanup subcommand can revert it.
+func setRetention(ctx context.Context, api retentionAPI, j *journal, region, group string, cur logGroupRetention, days int64) error {
+	if cur.Days == days {
+		logger.Infof("the retention of %s is already %d days", group, days)
+		return nil
+	}
+	var prev retentionPrevious
+	if cur.Days > 0 {
+		prev.Days = aws.Int64(cur.Days)
+	}
+	buf, err := json.Marshal(prev)
+	if err != nil {
+		return err
+	}
+	id, err := j.record(ctx, journalEntry{Kind: kindLogGroupRetention, Resource: group, Region: region, Previous: buf})
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	if _, err := api.PutRetentionPolicyWithContext(ctx, &cloudwatchlogs.PutRetentionPolicyInput{
+		LogGroupName:    aws.String(group),
+		RetentionInDays: aws.Int64(days),
+	}); err != nil {
+		// nothing is changed to revert
+		if err := j.markReverted(ctx, id); err != nil {
+			logger.Warnf("journal: %s", err)
+		}
+		return fmt.Errorf("PutRetentionPolicy, %s: %w", group, err)
+	}
+	logger.Infof("the retention of %s is set to %d days, the cleanup subcommand reverts it", group, days)
+	return nil
+}
+
+// retentionReverser restores the retention of a log group set by -set-retention
+type retentionReverser struct {
+	client func(region string) retentionAPI
+}
+
+func newRetentionReverser(sess *session.Session) *retentionReverser {
+	return &retentionReverser{client: func(region string) retentionAPI {
+		if region == "" {
+			return cloudwatchlogs.New(sess)
+		}
+		return cloudwatchlogs.New(sess, aws.NewConfig().WithRegion(region))
+	}}
+}
+
+func (r *retentionReverser) previous(e journalEntry) (retentionPrevious, error) {
+	var prev retentionPrevious
+	if err := json.Unmarshal(e.Previous, &prev); err != nil {
+		return prev, fmt.Errorf("previous retention: %w", err)
+	}
+	return prev, nil
+}
+
+func (r *retentionReverser) changed(ctx context.Context, e journalEntry) (bool, error) {
+	prev, err := r.previous(e)
+	if err != nil {
+		return false, err
+	}
+	cur, found, err := describeRetention(ctx, r.client(e.Region), e.Resource)
+	if err != nil || !found {
+		return false, err
+	}
+	return cur.Days != aws.Int64Value(prev.Days), nil
+}
+
+func (r *retentionReverser) revert(ctx context.Context, e journalEntry) error {
+	prev, err := r.previous(e)
+	if err != nil {
+		return err
+	}
+	api := r.client(e.Region)
+	if prev.Days == nil {
+		if _, err := api.DeleteRetentionPolicyWithContext(ctx, &cloudwatchlogs.DeleteRetentionPolicyInput{LogGroupName: aws.String(e.Resource)}); err != nil {
+			return fmt.Errorf("DeleteRetentionPolicy: %w", err)
+		}
+		return nil
+	}
+	if _, err := api.PutRetentionPolicyWithContext(ctx, &cloudwatchlogs.PutRetentionPolicyInput{LogGroupName: aws.String(e.Resource), RetentionInDays: prev.Days}); err != nil {
+		return fmt.Errorf("PutRetentionPolicy: %w", err)
+	}
+	return nil
+}
+
+// checkRetention warns about the retention of the log group of the function, and sets it by -set-retention
+func (sl *AWSServerless) checkRetention(ctx context.Context, api retentionAPI, region string) error {
+	cur, ok := checkRetention(ctx, api, sl.logGroupName, 0)
+	if sl.setRetention == 0 {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("-set-retention: the retention of %s is unknown, it is not set", sl.logGroupName)
+	}
+	return setRetention(ctx, api, sl.journal, region, sl.logGroupName, cur, sl.setRetention)
+}
+
+// planRetention returns the calls of the retention check, and of -set-retention if days is set
+func planRetention(group string, days int64) []plannedCall {
+	calls := []plannedCall{{
+		Service:   "logs",
+		Operation: "DescribeLogGroups",
+		Params:    []planParam{{"LogGroupNamePrefix", group}},
+		Note:      "the retention and the stored bytes of the log group",
+	}}
+	if days > 0 {
+		calls = append(calls, plannedCall{
+			Service:   "logs",
+			Operation: "PutRetentionPolicy",
+			Params:    []planParam{{"LogGroupName", group}, {"RetentionInDays", strconv.FormatInt(days, 10)}},
+			Note:      "only if the retention differs, recorded in the journal for the cleanup subcommand",
+		})
+	}
+	return calls
+}
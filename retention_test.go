@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// fakeRetention serves log groups by name, in pages of one group
+type fakeRetention struct {
+	groups  map[string]*cloudwatchlogs.LogGroup
+	puts    []int64
+	deletes int
+	putErr  error
+}
+
+func newFakeRetention(group string, days, stored int64) *fakeRetention {
+	g := &cloudwatchlogs.LogGroup{LogGroupName: aws.String(group), StoredBytes: aws.Int64(stored)}
+	if days > 0 {
+		g.RetentionInDays = aws.Int64(days)
+	}
+	return &fakeRetention{groups: map[string]*cloudwatchlogs.LogGroup{
+		group + "-other": {LogGroupName: aws.String(group + "-other"), RetentionInDays: aws.Int64(1)},
+		group:            g,
+	}}
+}
+
+func (f *fakeRetention) DescribeLogGroupsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput, fn func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool, opts ...request.Option) error {
+	prefix := aws.StringValue(input.LogGroupNamePrefix)
+	for _, name := range []string{prefix + "-other", prefix} {
+		if g, ok := f.groups[name]; ok {
+			if !fn(&cloudwatchlogs.DescribeLogGroupsOutput{LogGroups: []*cloudwatchlogs.LogGroup{g}}, false) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeRetention) PutRetentionPolicyWithContext(ctx aws.Context, input *cloudwatchlogs.PutRetentionPolicyInput, opts ...request.Option) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	f.puts = append(f.puts, aws.Int64Value(input.RetentionInDays))
+	f.groups[aws.StringValue(input.LogGroupName)].RetentionInDays = input.RetentionInDays
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+func (f *fakeRetention) DeleteRetentionPolicyWithContext(ctx aws.Context, input *cloudwatchlogs.DeleteRetentionPolicyInput, opts ...request.Option) (*cloudwatchlogs.DeleteRetentionPolicyOutput, error) {
+	f.deletes++
+	f.groups[aws.StringValue(input.LogGroupName)].RetentionInDays = nil
+	return &cloudwatchlogs.DeleteRetentionPolicyOutput{}, nil
+}
+
+func TestCheckRetention(t *testing.T) {
+	setTestLogger(t)
+	group := "/aws/lambda/orders-fn"
+
+	r, ok := checkRetention(context.Background(), newFakeRetention(group, 0, 4096), group, 0)
+	if !ok || r.Days != 0 || r.StoredBytes != 4096 {
+		t.Errorf("got %+v %v", r, ok)
+	}
+	if w := retentionWarning(group, r, 0); !strings.Contains(w, "never expire") || !strings.Contains(w, "-set-retention") {
+		t.Errorf("got %q", w)
+	}
+
+	r, ok = checkRetention(context.Background(), newFakeRetention(group, 1, 0), group, time.Hour)
+	if !ok || r.Days != 1 {
+		t.Errorf("the group of the exact name, got %+v", r)
+	}
+	if w := retentionWarning(group, r, time.Hour); w != "" {
+		t.Errorf("got %q", w)
+	}
+	if w := retentionWarning(group, r, 48*time.Hour); !strings.Contains(w, "shorter than 48h0m0s") {
+		t.Errorf("got %q", w)
+	}
+
+	if _, ok := checkRetention(context.Background(), &fakeRetention{}, group, 0); ok {
+		t.Errorf("no log group yet")
+	}
+}
+
+func TestSetRetention(t *testing.T) {
+	setTestLogger(t)
+	group := "/aws/lambda/orders-fn"
+	j := newJournal(filepath.Join(t.TempDir(), "journal.json"))
+
+	api := newFakeRetention(group, 0, 0)
+	if err := setRetention(context.Background(), api, j, "us-east-1", group, logGroupRetention{}, 14); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.puts) != 1 || api.puts[0] != 14 {
+		t.Errorf("got %v", api.puts)
+	}
+	entries, err := j.outstanding()
+	if err != nil || len(entries) != 1 || entries[0].Kind != kindLogGroupRetention || entries[0].Resource != group {
+		t.Fatalf("got %+v, %v", entries, err)
+	}
+	if prev, err := (&retentionReverser{}).previous(entries[0]); err != nil || prev.Days != nil {
+		t.Errorf("the logs never expired, got %+v, %v", prev, err)
+	}
+
+	// the same retention is not set again
+	if err := setRetention(context.Background(), api, j, "us-east-1", group, logGroupRetention{Days: 14}, 14); err != nil || len(api.puts) != 1 {
+		t.Errorf("got %v, %v", api.puts, err)
+	}
+
+	// a failed call leaves nothing to revert
+	failing := newFakeRetention(group, 7, 0)
+	failing.putErr = fmt.Errorf("AccessDeniedException")
+	if err := setRetention(context.Background(), failing, j, "us-east-1", group, logGroupRetention{Days: 7}, 30); err == nil {
+		t.Errorf("an error expected")
+	}
+	if entries, _ := j.outstanding(); len(entries) != 1 {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestRetentionReverser(t *testing.T) {
+	setTestLogger(t)
+	group := "/aws/lambda/orders-fn"
+	j := newJournal(filepath.Join(t.TempDir(), "journal.json"))
+	never := newFakeRetention(group, 0, 0)
+	week := newFakeRetention(group+"-week", 7, 0)
+	if err := setRetention(context.Background(), never, j, "us-east-1", group, logGroupRetention{}, 14); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRetention(context.Background(), week, j, "eu-west-1", group+"-week", logGroupRetention{Days: 7}, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]retentionAPI{"us-east-1": never, "eu-west-1": week}
+	r := &retentionReverser{client: func(region string) retentionAPI { return clients[region] }}
+	yes := func(journalEntry) bool { return true }
+	if err := cleanupJournal(context.Background(), j, map[string]reverser{kindLogGroupRetention: r}, yes); err != nil {
+		t.Fatal(err)
+	}
+	if never.deletes != 1 || never.groups[group].RetentionInDays != nil {
+		t.Errorf("the logs never expire again, got %+v", never.groups[group])
+	}
+	if got := aws.Int64Value(week.groups[group+"-week"].RetentionInDays); got != 7 {
+		t.Errorf("got %d", got)
+	}
+	if entries, _ := j.outstanding(); len(entries) != 0 {
+		t.Errorf("got %+v", entries)
+	}
+
+	// a retention already restored by hand is only marked
+	if err := setRetention(context.Background(), week, j, "eu-west-1", group+"-week", logGroupRetention{Days: 7}, 30); err != nil {
+		t.Fatal(err)
+	}
+	week.groups[group+"-week"].RetentionInDays = aws.Int64(7)
+	puts := len(week.puts)
+	if err := cleanupJournal(context.Background(), j, map[string]reverser{kindLogGroupRetention: r}, yes); err != nil || len(week.puts) != puts {
+		t.Errorf("got %v, %v", week.puts, err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redactedText = "[REDACTED]"
+
+// rulesCheckInterval is how often the rules file is checked for a change
+var rulesCheckInterval = 2 * time.Second
+
+// ruleSet is a compiled set of filter and redaction rules.
+// It is never modified after it is built, so it can be shared between goroutines.
+type ruleSet struct {
+	grep   []*regexp.Regexp // if any, a line must match one of them
+	grepV  []*regexp.Regexp // a line matching one of them is dropped
+	redact []*regexp.Regexp // matched parts are replaced by redactedText
+
+	extension []lineRule // additional patterns of extension lines
+}
+
+// parseRules parses a rules file. Each line is one of
+//
+//	grep <regexp>
+//	grep-v <regexp>
+//	redact <regexp>
+//	extension <regexp>
+//
+// Empty lines and lines starting with # are ignored.
+func parseRules(r io.Reader) (*ruleSet, error) {
+	rs := &ruleSet{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := strings.SplitN(line, " ", 2)
+		if len(p) != 2 || strings.TrimSpace(p[1]) == "" {
+			return nil, fmt.Errorf("line %d: pattern required, %s", lineNo, line)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(p[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch p[0] {
+		case "grep":
+			rs.grep = append(rs.grep, re)
+		case "grep-v":
+			rs.grepV = append(rs.grepV, re)
+		case "redact":
+			rs.redact = append(rs.redact, re)
+		case "extension":
+			rs.extension = append(rs.extension, lineRule{name: "rules-file", class: lineExtension, pattern: re})
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule, %s", lineNo, p[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// loadRules reads and parses a rules file
+func loadRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs, err := parseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rs, nil
+}
+
+// openRules stats and loads the rules file of -rules-file once for a run, nil for none. The stat is
+// taken before the read, so that the watcher which starts from it reloads an edit made after the read.
+func openRules(path string) (*ruleSet, os.FileInfo, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rules file: %w", err)
+	}
+	rs, err := loadRules(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loadRules: %w", err)
+	}
+	return rs, st, nil
+}
+
+// extensionRules returns additional patterns of extension lines
+func (rs *ruleSet) extensionRules() []lineRule {
+	if rs == nil {
+		return nil
+	}
+	return rs.extension
+}
+
+// apply returns the message after redaction, or false if the message should be dropped
+func (rs *ruleSet) apply(message string) (string, bool) {
+	if rs == nil {
+		return message, true
+	}
+	if len(rs.grep) > 0 {
+		matched := false
+		for _, re := range rs.grep {
+			if re.MatchString(message) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	for _, re := range rs.grepV {
+		if re.MatchString(message) {
+			return "", false
+		}
+	}
+	for _, re := range rs.redact {
+		message = re.ReplaceAllString(message, redactedText)
+	}
+	return message, true
+}
+
+// watchRules checks the rules file periodically and swaps the rules of the emitter when the file
+// differs from loaded, the stat of the rules the emitter has. An invalid file is rejected and the
+// previous rules are kept.
+func watchRules(ctx context.Context, path string, loaded os.FileInfo, interval time.Duration, e *emitter) {
+	lastMod, lastSize := loaded.ModTime(), loaded.Size()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st, err := os.Stat(path)
+		if err != nil {
+			e.logger.Warnf("rules file, %s: %s", path, err)
+			continue
+		}
+		if st.ModTime().Equal(lastMod) && st.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = st.ModTime(), st.Size()
+
+		rs, err := loadRules(path)
+		if err != nil {
+			e.logger.Warnf("rules file is rejected, previous rules are still active: %s", err)
+			continue
+		}
+		e.setRules(rs)
+		e.logger.Infof("rules are reloaded from %s", path)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rs, err := parseRules(strings.NewReader(`
+# comment
+grep ERROR|WARN
+grep-v healthcheck
+redact token=[a-z0-9]+
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		out  string
+		keep bool
+	}{
+		{"INFO started", "", false},
+		{"ERROR healthcheck failed", "", false},
+		{"ERROR token=abc123 rejected", "ERROR " + redactedText + " rejected", true},
+		{"WARN slow", "WARN slow", true},
+	}
+	for _, tt := range tests {
+		out, keep := rs.apply(tt.in)
+		if keep != tt.keep || out != tt.out {
+			t.Errorf("%q: got %q %v, want %q %v", tt.in, out, keep, tt.out, tt.keep)
+		}
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, in := range []string{"grep (", "grep", "unknown foo"} {
+		if _, err := parseRules(strings.NewReader(in)); err == nil {
+			t.Errorf("%q should be rejected", in)
+		}
+	}
+}
+
+func TestEmitterSwapRules(t *testing.T) {
+	e, logs := newTestEmitter(t, nil, defaultLimits.EventsWindow)
+
+	dropAll, err := parseRules(strings.NewReader("grep-v ."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				e.emit("line")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		e.setRules(dropAll)
+		e.setRules(nil)
+	}
+	wg.Wait()
+
+	e.setRules(dropAll)
+	before := logs.Len()
+	e.emit("line")
+	if logs.Len() != before {
+		t.Errorf("line should be dropped after swap")
+	}
+}
+
+func TestWatchRulesRejectInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(path, []byte("grep-v drop"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, st, err := openRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, logs := newTestEmitter(t, rs, defaultLimits.EventsWindow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchRules(ctx, path, st, 10*time.Millisecond, e)
+
+	if err := ioutil.WriteFile(path, []byte("grep-v (broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return logs.FilterMessageSnippet("rejected").Len() > 0 })
+	e.emit("drop me")
+	if logs.FilterMessage("drop me").Len() != 0 {
+		t.Errorf("previous rules should be kept")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("grep-v other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return logs.FilterMessageSnippet("reloaded").Len() > 0 })
+	e.emit("drop me")
+	if logs.FilterMessage("drop me").Len() != 1 {
+		t.Errorf("new rules should be active")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,113 @@
+package schema
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// versions of the outputs of the subcommands and of the local files, the files carry theirs
+const (
+	FunctionListVersion = 1
+	BaselineVersion     = 1
+	JournalVersion      = 1
+	StateVersion        = 1
+	BatchReportVersion  = 1
+)
+
+// FunctionDescriptionVersion is the version of the output of the describe subcommand
+const FunctionDescriptionVersion = 1
+
+// FunctionInfo is a function in the output of the list subcommand
+type FunctionInfo struct {
+	Name         string   `json:"name"`
+	Runtime      string   `json:"runtime"`
+	MemorySize   int64    `json:"memory_size"`
+	Timeout      int64    `json:"timeout"`
+	LastModified string   `json:"last_modified"`
+	Invocations  *float64 `json:"invocations,omitempty"` // only with -errors
+	Errors       *float64 `json:"errors,omitempty"`
+	ErrorRate    *float64 `json:"error_rate,omitempty"`
+}
+
+// FunctionDescription is the output of the describe subcommand. The values of the environment variables
+// are left out, as they may be secrets.
+type FunctionDescription struct {
+	Name                string   `json:"name"`
+	ARN                 string   `json:"arn"`
+	Version             string   `json:"version"`
+	Runtime             string   `json:"runtime,omitempty"` // empty for a container image
+	Handler             string   `json:"handler,omitempty"`
+	PackageType         string   `json:"package_type,omitempty"`
+	MemorySize          int64    `json:"memory_size"`
+	Timeout             int64    `json:"timeout"`
+	EnvironmentKeys     []string `json:"environment_keys"`
+	ReservedConcurrency *int64   `json:"reserved_concurrency,omitempty"` // nil if it is not reserved or not known
+	DeadLetterTarget    string   `json:"dead_letter_target,omitempty"`
+	LogGroup            string   `json:"log_group"`
+	LogFormat           string   `json:"log_format,omitempty"`
+	State               string   `json:"state,omitempty"`
+	LastModified        string   `json:"last_modified"`
+}
+
+// Percentiles of a metric over the samples of a run
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+}
+
+// BaselineEntry is the summary metrics of a run which later runs are compared against
+type BaselineEntry struct {
+	Function       string      `json:"function"`
+	Qualifier      string      `json:"qualifier,omitempty"`
+	PayloadSHA256  string      `json:"payload_sha256"`
+	Samples        int         `json:"samples"`
+	Duration       Percentiles `json:"duration_ms"`
+	BilledDuration Percentiles `json:"billed_duration_ms"`
+	MaxMemoryUsed  Percentiles `json:"max_memory_used_mb"`
+	ColdStarts     int         `json:"cold_starts"`
+	// SnapStart restores are neither cold nor warm, and their durations are compared among restores
+	Restores        int          `json:"restores,omitempty"`
+	RestoreDuration *Percentiles `json:"restore_duration_ms,omitempty"`
+	SavedAt         time.Time    `json:"saved_at"`
+}
+
+// BaselineFile holds the baselines of several functions and payloads, keyed by
+// "function[:qualifier]@sha256:payload"
+type BaselineFile struct {
+	Version   int                       `json:"version"` // BaselineVersion
+	Baselines map[string]*BaselineEntry `json:"baselines"`
+}
+
+// JournalEntry is a mutation of cloud state made by k8s-nodeless
+type JournalEntry struct {
+	ID       string          `json:"id"`
+	Kind     string          `json:"kind"`     // mutation type, which tells how it is reverted
+	Resource string          `json:"resource"` // ex: function ARN
+	Region   string          `json:"region,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"` // state to restore
+	Time     time.Time       `json:"time"`
+	Reverted bool            `json:"reverted"`
+}
+
+// JournalFile is the journal of the mutations
+type JournalFile struct {
+	Version int            `json:"version"` // JournalVersion
+	Entries []JournalEntry `json:"entries"`
+}
+
+// StateFile is what is remembered across runs to save API calls
+type StateFile struct {
+	Version int               `json:"version"`           // StateVersion
+	Regions map[string]string `json:"regions,omitempty"` // function name to the region found by -discover-region
+}
+
+// BatchReport is the result of each line of -payload-ndjson, written by -batch-report
+type BatchReport struct {
+	Version      int                 `json:"version"` // BatchReportVersion
+	FunctionName string              `json:"function_name"`
+	PayloadFile  string              `json:"payload_file"`
+	Succeeded    int                 `json:"succeeded"`
+	Failed       int                 `json:"failed"`
+	Skipped      int                 `json:"skipped"`
+	Items        []ConcurrentRequest `json:"items"`
+}
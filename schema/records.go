@@ -0,0 +1,623 @@
+package schema
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// versions of the records of the JSON log format
+const (
+	RunSummaryVersion           = 1
+	LocalRunSummaryVersion      = 1
+	GCPRunSummaryVersion        = 1
+	GCPJobSummaryVersion        = 1
+	AzureRunSummaryVersion      = 1
+	KnativeRunSummaryVersion    = 1
+	OpenFaaSRunSummaryVersion   = 1
+	StepFunctionsSummaryVersion = 1
+	ECSTaskSummaryVersion       = 1
+	BatchJobSummaryVersion      = 1
+	AlibabaRunSummaryVersion    = 1
+	OpenWhiskRunSummaryVersion  = 1
+	OCIRunSummaryVersion        = 1
+	CloudflareRunSummaryVersion = 1
+	LogLineVersion              = 1
+	TimelineVersion             = 1
+	CanaryVersion               = 1
+	FleetSummaryVersion         = 1
+	RunResultVersion            = 1
+)
+
+// RunCommon is the part of a "summary" record which every vendor has: the integrity check of the
+// payload, the comparison of the response with the golden file and the verdict of the run
+type RunCommon struct {
+	PayloadSHA256         string `json:"payload_sha256"`
+	PayloadIntegrity      string `json:"payload_integrity"`
+	ReceivedPayloadSHA256 string `json:"received_payload_sha256,omitempty"` // only on a mismatch
+
+	ResponseGolden string         `json:"response_golden,omitempty"` // "match", "mismatch" or "updated", only with -expect-response-file
+	ResponseDiffs  []ResponseDiff `json:"response_diffs,omitempty"`
+
+	Verdict string `json:"verdict"`
+	Outcome string `json:"outcome"` // "success", "failure" or "unknown"
+}
+
+// RunSummary is the "summary" record of a run, logged once at the end
+type RunSummary struct {
+	SchemaVersion        int    `json:"schema_version"` // RunSummaryVersion
+	FunctionName         string `json:"function_name"`
+	RequestID            string `json:"request_id"`
+	CredentialsProvider  string `json:"credentials_provider"`
+	ConsoleURL           string `json:"console_url"`
+	FunctionURL          string `json:"function_url,omitempty"` // invoked by -via url
+	StatusCode           int    `json:"status_code,omitempty"`  // of the response of the Function URL
+	EventID              string `json:"event_id,omitempty"`     // of the event put by -via eventbridge
+	MessageID            string `json:"message_id,omitempty"`   // of the message sent by -via sqs
+	InvocationState      string `json:"invocation_state"`       // of the last tail, ex: "Reported"
+	EventsReceived       int    `json:"events_received"`
+	DuplicatesSuppressed int    `json:"duplicates_suppressed"`
+	CacheEvictions       int    `json:"cache_evictions"` // event ids forgotten past -events-window
+	PossibleDuplicates   int    `json:"possible_duplicates"`
+	DetectedDuplicates   int    `json:"detected_duplicates"`
+
+	ExtensionLines       int64    `json:"extension_lines,omitempty"`
+	ExtensionBytes       int64    `json:"extension_bytes,omitempty"`
+	LogStreams           []string `json:"log_streams,omitempty"`
+	GetLogEventsCommands []string `json:"get_log_events_commands,omitempty"`
+	Report               *Report  `json:"report,omitempty"`
+	StartType            string   `json:"start_type,omitempty"` // "cold", "warm" or "snapstart-restore"
+
+	Deadline *Deadline `json:"deadline,omitempty"`
+
+	FilterStrategies   []string            `json:"filter_strategies,omitempty"`
+	CompletionStrategy string              `json:"completion_strategy"`
+	Logging            string              `json:"logging,omitempty"` // "off" when the function does not log
+	LoggingReason      string              `json:"logging_reason,omitempty"`
+	MetricsCompletion  *MetricsCompletion  `json:"metrics_completion,omitempty"`
+	Insights           *InsightsMetrics    `json:"insights,omitempty"` // only with the Lambda Insights extension
+	SideEffects        []SideEffect        `json:"side_effects,omitempty"`
+	Attempts           int                 `json:"attempts,omitempty"`
+	AttemptResults     []Attempt           `json:"attempt_results,omitempty"`
+	Requests           []ConcurrentRequest `json:"requests,omitempty"` // of -concurrency or -payload-ndjson
+	Warmup             *Warmup             `json:"warmup,omitempty"`
+	XRay               *XRayTrace          `json:"xray,omitempty"`        // only with -xray
+	Destination        *Destination        `json:"destination,omitempty"` // only with -check-destination
+	Shipping           *Shipping           `json:"shipping,omitempty"`    // only with -ship-to
+	SQS                *SQSDelivery        `json:"sqs,omitempty"`         // only with -via sqs
+	ReadOnly           bool                `json:"read_only,omitempty"`
+	DryRun             bool                `json:"dry_run,omitempty"` // only validated by the DryRun invocation type
+	NoLogs             bool                `json:"no_logs,omitempty"` // only invoked asynchronously by -no-logs, nothing is tailed
+	ThrottledCalls     int                 `json:"throttled_calls,omitempty"`
+
+	Phases
+
+	RunCommon
+}
+
+// LocalRunSummary is the "summary" record of a run of a local function
+type LocalRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // LocalRunSummaryVersion
+	FunctionName   string        `json:"function_name"`
+	RequestID      string        `json:"request_id"`
+	ExitCode       int           `json:"exit_code"`
+	Duration       time.Duration `json:"duration"`
+	ExtensionLines int64         `json:"extension_lines,omitempty"`
+	ExtensionBytes int64         `json:"extension_bytes,omitempty"`
+	Report         *Report       `json:"report,omitempty"`
+
+	Deadline *Deadline `json:"deadline,omitempty"`
+
+	RunCommon
+}
+
+// GCPRunSummary is the "summary" record of a run of a Google Cloud function
+type GCPRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"`       // GCPRunSummaryVersion
+	FunctionName   string        `json:"function_name"`        // projects/P/locations/L/functions/F
+	Generation     string        `json:"generation,omitempty"` // "GEN_1" or "GEN_2"
+	Trace          string        `json:"trace"`                // the trace the invocation is sent with, which its logs carry
+	ExecutionID    string        `json:"execution_id,omitempty"`
+	URL            string        `json:"url"`
+	StatusCode     int           `json:"status_code"`
+	Duration       time.Duration `json:"duration"` // of the HTTP request
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // the end of the invocation is seen and no more logs arrive
+
+	Deadline *Deadline `json:"deadline,omitempty"`
+
+	RunCommon
+}
+
+// GCPJobSummary is the "summary" record of a run of a Cloud Run job
+type GCPJobSummary struct {
+	SchemaVersion   int           `json:"schema_version"` // GCPJobSummaryVersion
+	JobName         string        `json:"job_name"`       // projects/P/locations/L/jobs/J
+	Execution       string        `json:"execution"`      // the name of the execution, whose logs carry it
+	TaskCount       int           `json:"task_count"`
+	SucceededCount  int           `json:"succeeded_count"`
+	FailedCount     int           `json:"failed_count"`
+	CancelledCount  int           `json:"cancelled_count"`
+	Duration        time.Duration `json:"duration"` // from the run to the completion of the execution
+	EventsReceived  int           `json:"events_received"`
+	LogsComplete    bool          `json:"logs_complete"`              // no more logs arrive after the completion
+	Interrupted     bool          `json:"interrupted,omitempty"`      // the run stopped before the execution completed
+	CancelRequested bool          `json:"cancel_requested,omitempty"` // the execution is cancelled by -cancel-execution
+
+	RunCommon
+}
+
+// AzureRunSummary is the "summary" record of a run of an Azure function
+type AzureRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // AzureRunSummaryVersion
+	FunctionName   string        `json:"function_name"`  // APP/FUNCTION
+	URL            string        `json:"url"`
+	InvocationID   string        `json:"invocation_id,omitempty"` // from the response headers
+	OperationID    string        `json:"operation_id"`            // the trace id the request is sent with
+	StatusCode     int           `json:"status_code"`
+	Duration       time.Duration `json:"duration"` // of the HTTP request
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // the request telemetry is seen and no more logs arrive
+
+	RunCommon
+}
+
+// AlibabaRunSummary is the "summary" record of a run of an Alibaba Cloud Function Compute function
+type AlibabaRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // AlibabaRunSummaryVersion
+	FunctionName   string        `json:"function_name"`  // SERVICE/FUNCTION
+	Region         string        `json:"region"`
+	RequestID      string        `json:"request_id,omitempty"` // from the response headers
+	StatusCode     int           `json:"status_code"`
+	ErrorType      string        `json:"error_type,omitempty"` // of a function error
+	Duration       time.Duration `json:"duration"`             // of the HTTP request
+	Project        string        `json:"project,omitempty"`    // of Log Service, which the service logs to
+	Logstore       string        `json:"logstore,omitempty"`
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // END of the request is seen and no more logs arrive
+
+	RunCommon
+}
+
+// OpenWhiskRunSummary is the "summary" record of a run of an OpenWhisk action
+type OpenWhiskRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // OpenWhiskRunSummaryVersion
+	Action         string        `json:"action"`         // [/NAMESPACE/][PACKAGE/]NAME
+	APIURL         string        `json:"api_url"`
+	ActivationID   string        `json:"activation_id,omitempty"`
+	Status         string        `json:"status,omitempty"` // of the activation, ex: "success" or "application error"
+	Success        bool          `json:"success"`
+	Duration       time.Duration `json:"duration"` // from the invocation to the result
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // the logs are read after the activation completes
+
+	RunCommon
+}
+
+// OCIRunSummary is the "summary" record of a run of an OCI function
+type OCIRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // OCIRunSummaryVersion
+	FunctionID     string        `json:"function_id"`    // OCID
+	FunctionName   string        `json:"function_name,omitempty"`
+	Region         string        `json:"region,omitempty"`
+	Auth           string        `json:"auth"`                 // "api_key" or "instance_principal"
+	RequestID      string        `json:"request_id,omitempty"` // opc-request-id of the invocation
+	StatusCode     int           `json:"status_code"`
+	ErrorCode      string        `json:"error_code,omitempty"` // of a function error, ex: "FunctionInvokeExecutionFailed"
+	Duration       time.Duration `json:"duration"`             // of the HTTP request
+	LogID          string        `json:"log_id,omitempty"`     // of the function log of the application
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // no new line arrives for a while after the response
+
+	RunCommon
+}
+
+// CloudflareRunSummary is the "summary" record of a run of a Cloudflare Worker
+type CloudflareRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // CloudflareRunSummaryVersion
+	URL            string        `json:"url"`
+	Script         string        `json:"script,omitempty"`
+	RayID          string        `json:"ray_id,omitempty"` // of the request
+	StatusCode     int           `json:"status_code"`
+	WorkerOutcome  string        `json:"worker_outcome,omitempty"` // of the trace, ex: "ok" or "exception"
+	Duration       time.Duration `json:"duration"`                 // of the HTTP request
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // the trace of the request arrived
+
+	RunCommon
+}
+
+// KnativeRunSummary is the "summary" record of a run of a Knative Service
+type KnativeRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // KnativeRunSummaryVersion
+	Service        string        `json:"service"`        // NAMESPACE/SERVICE, empty for a raw URL
+	URL            string        `json:"url"`
+	Revision       string        `json:"revision,omitempty"` // the latest ready revision when the service is resolved
+	StatusCode     int           `json:"status_code"`
+	Duration       time.Duration `json:"duration"`       // of the HTTP request
+	Pods           []string      `json:"pods,omitempty"` // whose logs are streamed
+	EventsReceived int           `json:"events_received"`
+
+	RunCommon
+}
+
+// OpenFaaSRunSummary is the "summary" record of a run of an OpenFaaS function
+type OpenFaaSRunSummary struct {
+	SchemaVersion  int           `json:"schema_version"` // OpenFaaSRunSummaryVersion
+	FunctionName   string        `json:"function_name"`  // NAME or NAME.NAMESPACE
+	Gateway        string        `json:"gateway"`
+	CallID         string        `json:"call_id"` // X-Call-Id of the gateway
+	Async          bool          `json:"async"`   // queued by the async endpoint
+	StatusCode     int           `json:"status_code"`
+	Duration       time.Duration `json:"duration"` // of the HTTP request
+	EventsReceived int           `json:"events_received"`
+	LogsComplete   bool          `json:"logs_complete"` // the logs are followed after the response, or until an async invocation is quiet
+
+	RunCommon
+}
+
+// StepFunctionsSummary is the "summary" record of an execution of a Step Functions state machine
+type StepFunctionsSummary struct {
+	SchemaVersion  int                  `json:"schema_version"` // StepFunctionsSummaryVersion
+	StateMachine   string               `json:"state_machine"`  // ARN
+	ExecutionARN   string               `json:"execution_arn"`
+	Status         string               `json:"status"` // "SUCCEEDED", "FAILED", "TIMED_OUT" or "ABORTED", "RUNNING" if interrupted
+	Error          string               `json:"error,omitempty"`
+	Cause          string               `json:"cause,omitempty"`
+	Duration       time.Duration        `json:"duration"`
+	States         []StepFunctionsState `json:"states"`                 // in the order they are entered
+	LambdaTasks    []StepFunctionsTask  `json:"lambda_tasks,omitempty"` // whose logs are tailed
+	EventsReceived int                  `json:"events_received"`
+	Interrupted    bool                 `json:"interrupted,omitempty"`    // the run stopped before the execution ended
+	StopRequested  bool                 `json:"stop_requested,omitempty"` // the execution is stopped by -cancel-execution
+
+	RunCommon
+}
+
+// StepFunctionsState is a state entered by an execution
+type StepFunctionsState struct {
+	Name     string        `json:"name"`
+	Entered  time.Time     `json:"entered"`
+	Duration time.Duration `json:"duration"` // until it is exited, 0 if it is not
+	Status   string        `json:"status"`   // "running", "succeeded" or "failed"
+}
+
+// StepFunctionsTask is an invocation of a Lambda function by a task state
+type StepFunctionsTask struct {
+	State           string `json:"state"`
+	FunctionName    string `json:"function_name"`
+	RequestID       string `json:"request_id,omitempty"`       // of the first START after the task is scheduled
+	InvocationState string `json:"invocation_state,omitempty"` // of the tail, ex: "Reported"
+	Status          string `json:"status"`                     // "scheduled", "succeeded" or "failed"
+}
+
+// ECSTaskSummary is the "summary" record of a run of an ECS task on Fargate
+type ECSTaskSummary struct {
+	SchemaVersion   int           `json:"schema_version"`  // ECSTaskSummaryVersion
+	TaskDefinition  string        `json:"task_definition"` // the ARN of the revision run
+	Cluster         string        `json:"cluster"`
+	TaskARN         string        `json:"task_arn"`
+	Container       string        `json:"container"`   // whose logs are tailed and whose exit code is the outcome
+	LastStatus      string        `json:"last_status"` // ex: "STOPPED"
+	StopCode        string        `json:"stop_code,omitempty"`
+	StoppedReason   string        `json:"stopped_reason,omitempty"`
+	ContainerReason string        `json:"container_reason,omitempty"` // ex: "CannotPullContainerError: ..."
+	ExitCode        *int          `json:"exit_code,omitempty"`        // absent if the container did not exit
+	Duration        time.Duration `json:"duration"`                   // from RunTask to the stop of the task
+	LogGroup        string        `json:"log_group,omitempty"`        // absent if the container does not log by awslogs
+	LogStream       string        `json:"log_stream,omitempty"`
+	EventsReceived  int           `json:"events_received"`
+	LogsComplete    bool          `json:"logs_complete"`            // no more logs arrive after the stop
+	Interrupted     bool          `json:"interrupted,omitempty"`    // the run stopped before the task stopped
+	StopRequested   bool          `json:"stop_requested,omitempty"` // the task is stopped by -cancel-execution
+
+	RunCommon
+}
+
+// BatchJobSummary is the "summary" record of a run of an AWS Batch job
+type BatchJobSummary struct {
+	SchemaVersion      int            `json:"schema_version"` // BatchJobSummaryVersion
+	JobDefinition      string         `json:"job_definition"`
+	JobQueue           string         `json:"job_queue"`
+	JobID              string         `json:"job_id"`
+	JobName            string         `json:"job_name"`
+	Status             string         `json:"status"` // ex: "SUCCEEDED"
+	StatusReason       string         `json:"status_reason,omitempty"`
+	ExitCode           *int           `json:"exit_code,omitempty"` // of the last attempt, absent if its container did not exit
+	Attempts           []BatchAttempt `json:"attempts,omitempty"`
+	Parameters         []string       `json:"parameters,omitempty"` // the names of the parameters of -batch-parameters
+	Duration           time.Duration  `json:"duration"`             // from SubmitJob to the end of the job
+	LogGroup           string         `json:"log_group,omitempty"`  // absent if the container does not log by awslogs
+	LogStreams         []string       `json:"log_streams,omitempty"`
+	EventsReceived     int            `json:"events_received"`
+	LogsComplete       bool           `json:"logs_complete"`                 // no more logs arrive after the end
+	Interrupted        bool           `json:"interrupted,omitempty"`         // the run stopped before the job ended
+	TerminateRequested bool           `json:"terminate_requested,omitempty"` // the job is terminated by -cancel-execution
+
+	RunCommon
+}
+
+// BatchAttempt is a finished attempt of an AWS Batch job
+type BatchAttempt struct {
+	LogStream    string `json:"log_stream,omitempty"`
+	ExitCode     *int   `json:"exit_code,omitempty"`
+	Reason       string `json:"reason,omitempty"`        // of the container, ex: "CannotPullContainerError: ..."
+	StatusReason string `json:"status_reason,omitempty"` // of the attempt
+}
+
+// Timeline is the "timeline" record of -timeline, the phases and the log bursts of a run on
+// an axis from the invocation to the completion
+type Timeline struct {
+	SchemaVersion int             `json:"schema_version"` // TimelineVersion
+	RequestID     string          `json:"request_id"`
+	Span          time.Duration   `json:"span"` // of the axis
+	Bars          []TimelineBar   `json:"bars"` // of the phases which are observed
+	LogBursts     []TimelineBurst `json:"log_bursts"`
+}
+
+// TimelineBar is a phase on the timeline
+type TimelineBar struct {
+	Name     string        `json:"name"`  // queue_wait, init, restore, execution or ingestion_lag
+	Start    time.Duration `json:"start"` // from the invocation
+	Duration time.Duration `json:"duration"`
+}
+
+// TimelineBurst is log lines close to each other on the timeline
+type TimelineBurst struct {
+	Start    time.Duration `json:"start"` // from the invocation
+	Duration time.Duration `json:"duration"`
+	Lines    int           `json:"lines"`
+}
+
+// Report is the metrics of an invocation from the REPORT line
+type Report struct {
+	RequestID      string  `json:"request_id"`
+	Duration       float64 `json:"duration_ms"`
+	BilledDuration float64 `json:"billed_duration_ms"`
+	MemorySize     float64 `json:"memory_size_mb"`
+	MaxMemoryUsed  float64 `json:"max_memory_used_mb"`
+	InitDuration   float64 `json:"init_duration_ms,omitempty"` // only on a cold start
+	ColdStart      bool    `json:"cold_start"`
+
+	RestoreDuration       float64 `json:"restore_duration_ms,omitempty"` // only on a SnapStart restore
+	BilledRestoreDuration float64 `json:"billed_restore_duration_ms,omitempty"`
+}
+
+// InsightsMetrics are the enhanced metrics of an invocation written by the Lambda Insights
+// extension, by the names of its performance event
+type InsightsMetrics struct {
+	CPUTotalTime      float64 `json:"cpu_total_time"` // milliseconds of user and system time
+	CPUUserTime       float64 `json:"cpu_user_time"`
+	CPUSystemTime     float64 `json:"cpu_system_time"`
+	MemoryUtilization float64 `json:"memory_utilization"` // percent of total_memory
+	UsedMemoryMax     float64 `json:"used_memory_max"`    // MB
+	TotalMemory       float64 `json:"total_memory"`       // MB
+	TmpUsed           float64 `json:"tmp_used"`           // bytes of /tmp
+	RxBytes           float64 `json:"rx_bytes"`
+	TxBytes           float64 `json:"tx_bytes"`
+	TotalNetwork      float64 `json:"total_network"` // bytes received and sent
+}
+
+// Deadline is the time left to the deadline of the function observed in its logs
+type Deadline struct {
+	RemainingMs int64 `json:"remaining_at_last_log_ms"`
+	BudgetMs    int64 `json:"budget_ms"` // elapsed time at the log + remaining
+	AtRisk      bool  `json:"at_risk"`   // remaining is within the margin of the budget
+}
+
+// MetricsCompletion is the outcome of an invocation inferred from the metrics of the function
+type MetricsCompletion struct {
+	Minute      time.Time `json:"minute"`      // of the datapoint attributed to the request
+	Invocations float64   `json:"invocations"` // since the invocation in the minute, 1 when only ours
+	Errors      float64   `json:"errors"`
+	DurationMin float64   `json:"duration_min_ms"`
+	DurationMax float64   `json:"duration_max_ms"`
+	Ambiguous   bool      `json:"ambiguous"` // other invocations are counted with ours
+	Polls       int       `json:"polls"`
+	Caveats     []string  `json:"caveats,omitempty"`
+}
+
+// SideEffect is what is found by polling for a side effect of the invocation
+type SideEffect struct {
+	Kind     string      `json:"kind"` // "sqs-message" or "dynamodb-item"
+	Resource string      `json:"resource"`
+	Filter   string      `json:"filter,omitempty"`
+	Matched  bool        `json:"matched"`
+	Attempts int         `json:"attempts"`
+	Seen     int         `json:"seen"`            // messages or items seen, matching or not
+	Found    interface{} `json:"found,omitempty"` // the matching one, or the last item seen
+}
+
+// ResponseDiff is a difference of the response from the golden file of -expect-response-file
+type ResponseDiff struct {
+	Path     string      `json:"path"` // JSON pointer, "" for the whole response
+	Kind     string      `json:"kind"` // "changed", "missing" or "unexpected"
+	Expected interface{} `json:"expected,omitempty"`
+	Actual   interface{} `json:"actual,omitempty"`
+}
+
+// ConcurrentRequest is one of the invocations of -concurrency or -payload-ndjson
+type ConcurrentRequest struct {
+	Label     string  `json:"label"`                // ordinal of the invocation, ex: "#03", which the log lines are tagged with
+	Line      int     `json:"line,omitempty"`       // of the payload in -payload-ndjson
+	RequestID string  `json:"request_id,omitempty"` // none when the invocation is not made
+	Status    string  `json:"status"`               // "succeeded", "failed" or "skipped" by -fail-fast
+	Error     string  `json:"error,omitempty"`
+	State     string  `json:"state,omitempty"` // the invocation state of the request
+	Report    *Report `json:"report,omitempty"`
+}
+
+// Warmup is the result of -warmup, invocations made at once only to start execution environments
+type Warmup struct {
+	Invocations     int     `json:"invocations"`
+	ColdStarts      int     `json:"cold_starts"`
+	Warm            int     `json:"warm"`
+	Unknown         int     `json:"unknown,omitempty"` // no REPORT in the tail of the log in the response
+	Failed          int     `json:"failed,omitempty"`  // not invoked, ex: still throttled after the retries
+	InitDurationP50 float64 `json:"init_duration_p50_ms,omitempty"`
+	InitDurationP95 float64 `json:"init_duration_p95_ms,omitempty"`
+}
+
+// XRayTrace is the trace of an invocation by -xray, its segments and subsegments depth first in the order they started
+type XRayTrace struct {
+	TraceID  string        `json:"trace_id"`
+	Complete bool          `json:"complete"` // false when segments were still missing or in progress at the end of the wait
+	Segments []XRaySegment `json:"segments"`
+}
+
+// XRaySegment is a segment or a subsegment of a trace
+type XRaySegment struct {
+	Name      string        `json:"name"`
+	Origin    string        `json:"origin,omitempty"`    // of a segment, ex: "AWS::Lambda::Function"
+	Operation string        `json:"operation,omitempty"` // of a call to an AWS service, ex: "GetItem"
+	Depth     int           `json:"depth"`               // 0 for a segment which has no parent in the trace
+	Start     time.Duration `json:"start"`               // from the start of the trace
+	Duration  time.Duration `json:"duration"`
+	Error     bool          `json:"error,omitempty"` // an error, a fault or a throttle
+}
+
+// Destination is the record of an async invocation in its destination by -check-destination
+type Destination struct {
+	OnSuccess       string      `json:"on_success,omitempty"` // ARN of the destination, "" if none
+	OnFailure       string      `json:"on_failure,omitempty"`
+	Found           bool        `json:"found"`
+	Target          string      `json:"target,omitempty"`    // ARN of the destination the record is in
+	Condition       string      `json:"condition,omitempty"` // "Success", "RetriesExhausted" or "EventAgeExceeded"
+	InvokeCount     int         `json:"invoke_count,omitempty"`
+	Retries         int         `json:"retries"`
+	StatusCode      int         `json:"status_code,omitempty"`
+	FunctionError   string      `json:"function_error,omitempty"`
+	ResponsePayload interface{} `json:"response_payload,omitempty"`
+}
+
+// SQSDelivery is how far the message of -via sqs got through its queue
+type SQSDelivery struct {
+	Phase           string        `json:"phase"`                       // the last one reached: "enqueued", "in-flight", "consumed" or "redriven"
+	QueueWait       time.Duration `json:"queue_wait,omitempty"`        // from SendMessage to in-flight
+	InFlight        time.Duration `json:"in_flight,omitempty"`         // from in-flight to consumed or redriven
+	Visible         int64         `json:"visible_messages"`            // ApproximateNumberOfMessages of the queue at the last poll
+	NotVisible      int64         `json:"not_visible_messages"`        // ApproximateNumberOfMessagesNotVisible at the last poll
+	Polls           int           `json:"polls"`                       // of the attributes of the queue
+	ReceiveCount    int           `json:"receive_count,omitempty"`     // ApproximateReceiveCount of the message in the DLQ
+	DeadLetterQueue string        `json:"dead_letter_queue,omitempty"` // the URL of the DLQ watched for the message
+}
+
+// Shipping is what -ship-to posted to the collector
+type Shipping struct {
+	Shipped int `json:"shipped"` // events accepted by the collector
+	Dropped int `json:"dropped"` // events over the memory cap, refused by the collector, or not posted by the end of the run
+	Batches int `json:"batches"`
+}
+
+// Attempt is an invocation of -retry-if-response or -retry-on-failure
+type Attempt struct {
+	Attempt       int     `json:"attempt"`
+	RequestID     string  `json:"request_id"`
+	Retry         bool    `json:"retry"`                    // the response matched -retry-if-response, or failed with -retry-on-failure
+	FunctionError string  `json:"function_error,omitempty"` // of the response, ex: "Unhandled"
+	Report        *Report `json:"report,omitempty"`
+	Phases        *Phases `json:"phases,omitempty"` // of the attempt, from the start of the run
+}
+
+// Phases is the breakdown of the wall time of a run
+type Phases struct {
+	Total        time.Duration `json:"total"`
+	Credentials  PhaseDuration `json:"credentials"`
+	Preflight    PhaseDuration `json:"preflight"`
+	InvokeAPI    PhaseDuration `json:"invoke_api"`
+	QueueWait    PhaseDuration `json:"queue_wait"`
+	Execution    PhaseDuration `json:"execution"`
+	IngestionLag PhaseDuration `json:"ingestion_lag"`
+	Teardown     PhaseDuration `json:"teardown"`
+}
+
+// PhaseDuration is the duration of a phase in nanoseconds, or "unknown" unless both ends are observed
+type PhaseDuration struct {
+	Duration time.Duration
+	Known    bool
+}
+
+// MarshalJSON implements json.Marshaler
+func (d PhaseDuration) MarshalJSON() ([]byte, error) {
+	if !d.Known {
+		return []byte(`"unknown"`), nil
+	}
+	return json.Marshal(int64(d.Duration))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *PhaseDuration) UnmarshalJSON(b []byte) error {
+	if string(b) == `"unknown"` {
+		*d = PhaseDuration{}
+		return nil
+	}
+	var ns int64
+	if err := json.Unmarshal(b, &ns); err != nil {
+		return err
+	}
+	*d = PhaseDuration{Duration: time.Duration(ns), Known: true}
+	return nil
+}
+
+func (PhaseDuration) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "integer", "description": "nanoseconds"},
+			map[string]interface{}{"const": "unknown"},
+		},
+	}
+}
+
+// LogLine is a log line of the function. The message is the line after the rules.
+type LogLine struct {
+	FunctionName  string `json:"function_name,omitempty"`  // of a run
+	RequestID     string `json:"request_id,omitempty"`     // of a run and the logs subcommand
+	Version       string `json:"version,omitempty"`        // of the canary-watch subcommand
+	CorrelationID string `json:"correlation_id,omitempty"` // in custom of the ClientContext of a run
+	Label         string `json:"label,omitempty"`          // of the invocation when a run invokes several times
+}
+
+// Canary is the "canary" record of the error counts of the versions, logged every poll
+type Canary struct {
+	SchemaVersion int            `json:"schema_version"` // CanaryVersion
+	Versions      []VersionStats `json:"versions"`
+	NewVersion    string         `json:"new_version"`
+}
+
+// VersionStats is the error count of a version
+type VersionStats struct {
+	Version     string `json:"version"`
+	Invocations int    `json:"invocations"`
+	Errors      int    `json:"errors"`
+}
+
+// FleetSummary is the "summary" record of the fleet-logs subcommand, logged when it is interrupted
+type FleetSummary struct {
+	SchemaVersion int             `json:"schema_version"` // FleetSummaryVersion
+	Prefix        string          `json:"prefix"`
+	Since         time.Duration   `json:"since"`
+	Functions     []FleetFunction `json:"functions"`
+}
+
+// FleetFunction is what the tail of a function of the fleet observed
+type FleetFunction struct {
+	FunctionName string `json:"function_name"`
+	LogGroup     string `json:"log_group"`
+	Events       int    `json:"events"`
+	Errors       int    `json:"errors"`
+	Error        string `json:"error,omitempty"` // why the tail stopped or saw nothing
+}
+
+// RunResult is the result of a run which -publish-result writes to an SSM parameter or an S3 object
+type RunResult struct {
+	SchemaVersion int             `json:"schema_version"` // RunResultVersion
+	Function      string          `json:"function"`
+	Vendor        string          `json:"vendor"`
+	Outcome       string          `json:"outcome"` // "success", "failure" of the function or "error"
+	ExitCode      int             `json:"exit_code"`
+	Verdict       string          `json:"verdict,omitempty"` // of the summary
+	Error         string          `json:"error,omitempty"`
+	StartedAt     time.Time       `json:"started_at"`
+	FinishedAt    time.Time       `json:"finished_at"`
+	Summary       json.RawMessage `json:"summary,omitempty"`   // the "summary" record of the vendor
+	ResultS3      string          `json:"result_s3,omitempty"` // where the whole result is when it is too large for a parameter
+}
@@ -0,0 +1,206 @@
+// Package schema holds the versioned structs of every JSON output of k8s-nodeless: the records of
+// the JSON log format, the output of the list subcommand and the local files. k8s-nodeless marshals
+// them only through these structs, so that consumers can depend on them.
+//
+// A field may be added to a version. Removing a field or changing its type needs a new version,
+// which the compatibility test enforces against the frozen shapes under testdata/compat.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Artifact is a JSON output described by a schema
+type Artifact struct {
+	Name        string
+	Version     int
+	Description string
+	Value       interface{} // a zero value of the type of the output
+
+	// Record is set when the output is a record of the JSON log format, whose fields follow
+	// the time, the level and the message. Message is the message of every record, if fixed.
+	Record  bool
+	Message string
+}
+
+// Artifacts are all the JSON outputs in the order they are dumped
+var Artifacts = []Artifact{
+	{Name: "run-summary", Version: RunSummaryVersion, Description: "the summary of a run", Value: RunSummary{}, Record: true, Message: "summary"},
+	{Name: "local-run-summary", Version: LocalRunSummaryVersion, Description: "the summary of a run of a local function", Value: LocalRunSummary{}, Record: true, Message: "summary"},
+	{Name: "gcp-run-summary", Version: GCPRunSummaryVersion, Description: "the summary of a run of a Google Cloud function", Value: GCPRunSummary{}, Record: true, Message: "summary"},
+	{Name: "gcp-job-summary", Version: GCPJobSummaryVersion, Description: "the summary of a run of a Cloud Run job", Value: GCPJobSummary{}, Record: true, Message: "summary"},
+	{Name: "azure-run-summary", Version: AzureRunSummaryVersion, Description: "the summary of a run of an Azure function", Value: AzureRunSummary{}, Record: true, Message: "summary"},
+	{Name: "alibaba-run-summary", Version: AlibabaRunSummaryVersion, Description: "the summary of a run of an Alibaba Cloud Function Compute function", Value: AlibabaRunSummary{}, Record: true, Message: "summary"},
+	{Name: "knative-run-summary", Version: KnativeRunSummaryVersion, Description: "the summary of a run of a Knative Service", Value: KnativeRunSummary{}, Record: true, Message: "summary"},
+	{Name: "openfaas-run-summary", Version: OpenFaaSRunSummaryVersion, Description: "the summary of a run of an OpenFaaS function", Value: OpenFaaSRunSummary{}, Record: true, Message: "summary"},
+	{Name: "openwhisk-run-summary", Version: OpenWhiskRunSummaryVersion, Description: "the summary of a run of an OpenWhisk action", Value: OpenWhiskRunSummary{}, Record: true, Message: "summary"},
+	{Name: "oci-run-summary", Version: OCIRunSummaryVersion, Description: "the summary of a run of an OCI function", Value: OCIRunSummary{}, Record: true, Message: "summary"},
+	{Name: "cloudflare-run-summary", Version: CloudflareRunSummaryVersion, Description: "the summary of a run of a Cloudflare Worker", Value: CloudflareRunSummary{}, Record: true, Message: "summary"},
+	{Name: "stepfunctions-summary", Version: StepFunctionsSummaryVersion, Description: "the summary of an execution of a Step Functions state machine", Value: StepFunctionsSummary{}, Record: true, Message: "summary"},
+	{Name: "ecs-task-summary", Version: ECSTaskSummaryVersion, Description: "the summary of a run of an ECS task on Fargate", Value: ECSTaskSummary{}, Record: true, Message: "summary"},
+	{Name: "batch-job-summary", Version: BatchJobSummaryVersion, Description: "the summary of a run of an AWS Batch job", Value: BatchJobSummary{}, Record: true, Message: "summary"},
+	{Name: "timeline", Version: TimelineVersion, Description: "the phases and the log bursts of a run by -timeline", Value: Timeline{}, Record: true, Message: "timeline"},
+	{Name: "log-line", Version: LogLineVersion, Description: "a log line of the function, the message is the line", Value: LogLine{}, Record: true},
+	{Name: "canary", Version: CanaryVersion, Description: "the error counts of the versions by the canary-watch subcommand", Value: Canary{}, Record: true, Message: "canary"},
+	{Name: "fleet-summary", Version: FleetSummaryVersion, Description: "the events and the errors of each function by the fleet-logs subcommand", Value: FleetSummary{}, Record: true, Message: "summary"},
+	{Name: "run-result", Version: RunResultVersion, Description: "the result of a run written by -publish-result", Value: RunResult{}},
+	{Name: "function-list", Version: FunctionListVersion, Description: "the output of the list subcommand with -json", Value: []FunctionInfo{}},
+	{Name: "function-description", Version: FunctionDescriptionVersion, Description: "the output of the describe subcommand with -json", Value: FunctionDescription{}},
+	{Name: "baseline-file", Version: BaselineVersion, Description: "the baseline file of -baseline and -save-baseline", Value: BaselineFile{}},
+	{Name: "journal-file", Version: JournalVersion, Description: "the journal of the mutations reverted by the cleanup subcommand", Value: JournalFile{}},
+	{Name: "state-file", Version: StateVersion, Description: "the state remembered across runs", Value: StateFile{}},
+	{Name: "batch-report", Version: BatchReportVersion, Description: "the result of each line of -payload-ndjson written by -batch-report", Value: BatchReport{}},
+}
+
+// Lookup returns the artifact of the name
+func Lookup(name string) (Artifact, bool) {
+	for _, a := range Artifacts {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Artifact{}, false
+}
+
+// FileName returns the name of the schema file of the artifact
+func (a Artifact) FileName() string {
+	return a.Name + ".schema.json"
+}
+
+// JSONSchema returns the JSON Schema of the artifact, indented and terminated by a newline
+func (a Artifact) JSONSchema() ([]byte, error) {
+	s := typeSchema(reflect.TypeOf(a.Value))
+	if a.Record {
+		msg := map[string]interface{}{"type": "string"}
+		if a.Message != "" {
+			msg = map[string]interface{}{"const": a.Message}
+		}
+		props := s["properties"].(map[string]interface{})
+		props["time"] = map[string]interface{}{"type": "string", "description": "ISO 8601"}
+		props["level"] = map[string]interface{}{"type": "string"}
+		props["msg"] = msg
+		required, _ := s["required"].([]string)
+		required = append(required, "level", "msg", "time")
+		sort.Strings(required)
+		s["required"] = required
+	}
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["$id"] = fmt.Sprintf("https://github.com/shirou/k8s-nodeless/schema/%s.v%d.schema.json", a.Name, a.Version)
+	s["title"] = fmt.Sprintf("%s v%d", a.Name, a.Version)
+	s["description"] = a.Description
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("schema of %s: %w", a.Name, err)
+	}
+	return append(buf, '\n'), nil
+}
+
+// schemaer is a type which describes its own JSON Schema, as its MarshalJSON does not follow its fields
+type schemaer interface {
+	jsonSchema() map[string]interface{}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	schemaerType   = reflect.TypeOf((*schemaer)(nil)).Elem()
+)
+
+// typeSchema returns the JSON Schema of the values of t as encoding/json marshals them
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return typeSchema(t.Elem())
+	}
+	if t.Implements(schemaerType) {
+		return reflect.Zero(t).Interface().(schemaer).jsonSchema()
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for _, f := range Fields(t) {
+			props[f.Name] = typeSchema(f.Type)
+			if !f.OmitEmpty {
+				required = append(required, f.Name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			sort.Strings(required)
+			s["required"] = required
+		}
+		return s
+	}
+	panic(fmt.Sprintf("schema: unsupported type %s", t))
+}
+
+// Field is a JSON field of a struct
+type Field struct {
+	Name      string
+	OmitEmpty bool
+	Type      reflect.Type
+	Index     []int // for reflect.Value.FieldByIndex
+}
+
+// Fields returns the JSON fields of the struct type in their order, with the fields of an
+// untagged embedded struct in place as encoding/json does
+func Fields(t reflect.Type) []Field {
+	var ret []Field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" || (sf.PkgPath != "" && !sf.Anonymous) {
+			continue
+		}
+		if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range Fields(sf.Type) {
+				f.Index = append([]int{i}, f.Index...)
+				ret = append(ret, f)
+			}
+			continue
+		}
+		name, opts := tag, ""
+		if j := strings.IndexByte(tag, ','); j >= 0 {
+			name, opts = tag[:j], tag[j+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		ret = append(ret, Field{
+			Name:      name,
+			OmitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			Type:      sf.Type,
+			Index:     []int{i},
+		})
+	}
+	return ret
+}
@@ -0,0 +1,234 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the schema files and freeze the shapes of new versions")
+
+// shape flattens the fields of t into their paths and types, ex: "report.duration_ms": "number"
+func shape(t reflect.Type, path string, out map[string]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	typ, _ := typeSchema(t)["type"].(string)
+	switch {
+	case t.Implements(schemaerType):
+		typ = t.Name()
+	case t == timeType || t == durationType:
+		typ = t.String()
+	case t == rawMessageType || t.Kind() == reflect.Interface:
+		typ = "any"
+	case t.Kind() == reflect.Struct:
+		for _, f := range Fields(t) {
+			p := f.Name
+			if path != "" {
+				p = path + "." + f.Name
+			}
+			shape(f.Type, p, out)
+			if f.OmitEmpty {
+				out[p] += ",omitempty"
+			}
+		}
+		if path == "" {
+			return
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		shape(t.Elem(), path+"[]", out)
+	case t.Kind() == reflect.Map:
+		shape(t.Elem(), path+"{}", out)
+	}
+	if path != "" {
+		out[path] = typ
+	}
+}
+
+func shapeOf(a Artifact) map[string]string {
+	out := make(map[string]string)
+	shape(reflect.TypeOf(a.Value), "", out)
+	return out
+}
+
+// TestCompatibility fails when a field of the current version of an artifact is removed, its type
+// is changed or it becomes optional. Such a change needs a new version, whose shape is frozen by -update.
+func TestCompatibility(t *testing.T) {
+	for _, a := range Artifacts {
+		path := filepath.Join("testdata", "compat", fmt.Sprintf("%s.v%d.json", a.Name, a.Version))
+		cur := shapeOf(a)
+		buf, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && *update {
+			buf, err = json.MarshalIndent(cur, "", "  ")
+			if err == nil {
+				err = ioutil.WriteFile(path, append(buf, '\n'), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s v%d is not frozen, run go test ./schema -update: %s", a.Name, a.Version, err)
+			continue
+		}
+		var frozen map[string]string
+		if err := json.Unmarshal(buf, &frozen); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		for _, c := range breakingChanges(frozen, cur) {
+			t.Errorf("%s v%d: %s, bump the version", a.Name, a.Version, c)
+		}
+	}
+}
+
+// breakingChanges returns the fields of the frozen shape which are removed, changed or made optional
+func breakingChanges(frozen, cur map[string]string) []string {
+	var paths []string
+	for p := range frozen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var ret []string
+	for _, p := range paths {
+		want, got := frozen[p], cur[p]
+		switch {
+		case got == "":
+			ret = append(ret, fmt.Sprintf("%s is removed", p))
+		case strings.TrimSuffix(got, ",omitempty") != strings.TrimSuffix(want, ",omitempty"):
+			ret = append(ret, fmt.Sprintf("the type of %s is changed from %q to %q", p, want, got))
+		case got != want && strings.HasSuffix(got, ",omitempty"):
+			ret = append(ret, fmt.Sprintf("%s is made optional", p))
+		}
+	}
+	return ret
+}
+
+func TestCompatibilityDetectsChanges(t *testing.T) {
+	type v1 struct {
+		Name   string    `json:"name"`
+		Count  int       `json:"count"`
+		Report *Report   `json:"report,omitempty"`
+		At     time.Time `json:"at"`
+	}
+	type removed struct {
+		Name string    `json:"name"`
+		At   time.Time `json:"at"`
+	}
+	type retyped struct {
+		Name  string    `json:"name"`
+		Count float64   `json:"count"`
+		At    time.Time `json:"at"`
+	}
+	type added struct {
+		v1
+		Extra []string `json:"extra,omitempty"`
+	}
+	type optional struct {
+		Name   string    `json:"name,omitempty"`
+		Count  int       `json:"count"`
+		Report *Report   `json:"report,omitempty"`
+		At     time.Time `json:"at"`
+	}
+	frozen := shapeOf(Artifact{Value: v1{}})
+	if frozen["report.duration_ms"] != "number" || frozen["report"] != "object,omitempty" || frozen["at"] != "time.Time" {
+		t.Fatalf("got %v", frozen)
+	}
+	tests := []struct {
+		value interface{}
+		want  []string
+	}{
+		{removed{}, []string{"count is removed", "report is removed"}},
+		{retyped{}, []string{`the type of count is changed from "integer" to "number"`, "report is removed"}},
+		{optional{}, []string{"name is made optional"}},
+		{added{}, nil},
+	}
+	for _, tt := range tests {
+		got := breakingChanges(frozen, shapeOf(Artifact{Value: tt.value}))
+		// the fields of a removed object are removed too
+		var top []string
+		for _, c := range got {
+			if !strings.HasPrefix(c, "report.") {
+				top = append(top, c)
+			}
+		}
+		if !reflect.DeepEqual(top, tt.want) {
+			t.Errorf("%T: got %q", tt.value, got)
+		}
+	}
+}
+
+// TestSchemaFiles fails when a schema file under schema/ is not regenerated
+func TestSchemaFiles(t *testing.T) {
+	for _, a := range Artifacts {
+		want, err := a.JSONSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *update {
+			if err := ioutil.WriteFile(a.FileName(), want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := ioutil.ReadFile(a.FileName())
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date, run go test ./schema -update", a.FileName())
+		}
+	}
+}
+
+// TestFields checks that the fields are what encoding/json marshals
+func TestFields(t *testing.T) {
+	for _, a := range Artifacts {
+		typ := reflect.TypeOf(a.Value)
+		if typ.Kind() != reflect.Struct {
+			continue
+		}
+		buf, err := json.Marshal(a.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			t.Fatal(err)
+		}
+		var required []string
+		for _, f := range Fields(typ) {
+			if !f.OmitEmpty {
+				required = append(required, f.Name)
+			}
+		}
+		if len(required) != len(m) {
+			t.Errorf("%s: got %v, marshaled %s", a.Name, required, buf)
+		}
+		for _, name := range required {
+			if _, ok := m[name]; !ok {
+				t.Errorf("%s: %s is not marshaled", a.Name, name)
+			}
+		}
+	}
+}
+
+func TestPhaseDuration(t *testing.T) {
+	buf, err := json.Marshal(Phases{Total: time.Second, Execution: PhaseDuration{Duration: 5, Known: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte(`"execution":5`)) || !bytes.Contains(buf, []byte(`"teardown":"unknown"`)) {
+		t.Errorf("got %s", buf)
+	}
+	var p Phases
+	if err := json.Unmarshal(buf, &p); err != nil || p.Execution != (PhaseDuration{Duration: 5, Known: true}) || p.Teardown.Known {
+		t.Errorf("got %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// runSchema runs the schema subcommand. "schema dump" prints the JSON Schemas of the JSON outputs.
+func runSchema(args []string) error {
+	logger = NewLogger(&Config{})
+	defer logger.Sync()
+
+	if len(args) == 0 || args[0] != "dump" {
+		return &configError{fmt.Errorf("usage: schema dump [-dir DIR] [NAME...]")}
+	}
+	var dir string
+	fs := flag.NewFlagSet("schema dump", flag.ContinueOnError)
+	fs.StringVar(&dir, "dir", "", "write NAME.schema.json files to the directory instead of printing them")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	artifacts, err := selectArtifacts(fs.Args())
+	if err != nil {
+		return &configError{err}
+	}
+	if dir == "" {
+		return dumpSchemas(os.Stdout, artifacts)
+	}
+	for _, a := range artifacts {
+		buf, err := a.JSONSchema()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, a.FileName()), buf, 0644); err != nil {
+			return fmt.Errorf("write schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// selectArtifacts returns the artifacts of the names, or all of them if none is given
+func selectArtifacts(names []string) ([]schema.Artifact, error) {
+	if len(names) == 0 {
+		return schema.Artifacts, nil
+	}
+	var ret []schema.Artifact
+	for _, name := range names {
+		a, ok := schema.Lookup(name)
+		if !ok {
+			known := make([]string, len(schema.Artifacts))
+			for i, a := range schema.Artifacts {
+				known[i] = a.Name
+			}
+			return nil, fmt.Errorf("unknown schema %q, one of %s", name, strings.Join(known, ", "))
+		}
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+// dumpSchemas writes the JSON Schemas of the artifacts one after another
+func dumpSchemas(w io.Writer, artifacts []schema.Artifact) error {
+	for _, a := range artifacts {
+		buf, err := a.JSONSchema()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
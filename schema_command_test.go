@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpSchemas(t *testing.T) {
+	artifacts, err := selectArtifacts([]string{"run-summary", "state-file"})
+	if err != nil || len(artifacts) != 2 {
+		t.Fatalf("got %v, %v", artifacts, err)
+	}
+	var buf bytes.Buffer
+	if err := dumpSchemas(&buf, artifacts); err != nil {
+		t.Fatal(err)
+	}
+	// the dump is the committed schema files
+	dec := json.NewDecoder(&buf)
+	for _, a := range artifacts {
+		var got, want map[string]interface{}
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join("schema", a.FileName()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &want); err != nil {
+			t.Fatal(err)
+		}
+		if got["$id"] != want["$id"] || got["title"] != want["title"] {
+			t.Errorf("got %v", got["$id"])
+		}
+	}
+
+	if _, err := selectArtifacts([]string{"summary"}); err == nil || !strings.Contains(err.Error(), "run-summary") {
+		t.Errorf("got %v", err)
+	}
+	if all, _ := selectArtifacts(nil); len(all) < 8 {
+		t.Errorf("got %d", len(all))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "time"
+
+// seenSet remembers the ids of the events of the last window of event time, in two generations.
+// The current generation takes the new ids, and when an event is window past its start, the
+// previous one is dropped and the current one becomes the previous. An id is therefore
+// remembered at least while the newest timestamp is within window of its own timestamp, which is
+// the overlap of the polls that re-read it, and the memory is bounded by the event rate in two
+// windows instead of a count that a noisy run overflows.
+type seenSet struct {
+	window int64 // milliseconds
+
+	current      map[string]struct{}
+	previous     map[string]struct{}
+	started      bool
+	currentStart int64 // timestamp which started the current generation
+	currentMax   int64 // the newest timestamp in the current generation
+	previousMax  int64 // the newest timestamp in the previous generation
+
+	forgotten    int   // ids dropped with a generation
+	forgottenMax int64 // the newest timestamp of the dropped ids
+}
+
+func newSeenSet(window time.Duration) *seenSet {
+	return &seenSet{
+		window:   window.Milliseconds(),
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// add remembers the id and returns false if it has been remembered already
+func (s *seenSet) add(id string, timestamp int64) bool {
+	if _, ok := s.current[id]; ok {
+		return false
+	}
+	if _, ok := s.previous[id]; ok {
+		return false
+	}
+	if !s.started {
+		s.started, s.currentStart = true, timestamp
+	} else if timestamp-s.currentStart >= s.window {
+		s.rotate(timestamp)
+	}
+	s.current[id] = struct{}{}
+	if timestamp > s.currentMax {
+		s.currentMax = timestamp
+	}
+	return true
+}
+
+// rotate drops the previous generation and starts a new one at the timestamp
+func (s *seenSet) rotate(timestamp int64) {
+	if len(s.previous) > 0 {
+		s.forgotten += len(s.previous)
+		if s.previousMax > s.forgottenMax {
+			s.forgottenMax = s.previousMax
+		}
+	}
+	s.previous, s.previousMax = s.current, s.currentMax
+	s.current, s.currentMax = make(map[string]struct{}), 0
+	s.currentStart = timestamp
+}
+
+// maybeForgotten returns true if an event of the timestamp may have been remembered and dropped
+func (s *seenSet) maybeForgotten(timestamp int64) bool {
+	return s.forgotten > 0 && timestamp <= s.forgottenMax
+}
+
+// len returns the number of the remembered ids
+func (s *seenSet) len() int {
+	return len(s.current) + len(s.previous)
+}
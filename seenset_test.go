@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"testing/quick"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// seenStream returns the timestamps of a stream whose events come gaps milliseconds apart
+func seenStream(gaps []uint8) []int64 {
+	ts := make([]int64, len(gaps))
+	now := int64(1600000000000)
+	for i, g := range gaps {
+		now += int64(g % 50)
+		ts[i] = now
+	}
+	return ts
+}
+
+func TestSeenSetNoFalseNegatives(t *testing.T) {
+	const window = 100 // milliseconds
+	// each event is added, then an earlier one is re-read as an overlapping poll does. an event
+	// within the window of the newest must always be suppressed
+	f := func(gaps []uint8, replays []uint16) bool {
+		s := newSeenSet(window * time.Millisecond)
+		ts := seenStream(gaps)
+		for i := range ts {
+			if !s.add(fmt.Sprint(i), ts[i]) {
+				t.Logf("event %d is new", i)
+				return false
+			}
+			if len(replays) == 0 {
+				continue
+			}
+			j := int(replays[i%len(replays)]) % (i + 1)
+			if s.add(fmt.Sprint(j), ts[j]) && ts[j]+window >= ts[i] {
+				t.Logf("event %d at %d was forgotten at %d", j, ts[j], ts[i])
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSeenSetBounded(t *testing.T) {
+	const window = 100 // milliseconds
+	// the remembered ids never exceed the events of two windows, however long the stream is
+	f := func(gaps []uint8) bool {
+		s := newSeenSet(window * time.Millisecond)
+		ts := seenStream(gaps)
+		maxInWindow, first := 0, 0
+		for i := range ts {
+			for ts[i]-ts[first] >= window {
+				first++
+			}
+			if n := i - first + 1; n > maxInWindow {
+				maxInWindow = n
+			}
+			s.add(fmt.Sprint(i), ts[i])
+			if s.len() > 2*maxInWindow {
+				t.Logf("%d ids remembered after %d events, at most %d in a window", s.len(), i+1, maxInWindow)
+				return false
+			}
+		}
+		return s.len()+s.forgotten == len(ts)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+	if !newSeenSet(time.Second).add("a", 0) || newSeenSet(time.Second).maybeForgotten(0) {
+		t.Error("an empty set remembers nothing")
+	}
+}
+
+const benchmarkEvents = 1000000
+
+// benchmarkDedup feeds a synthetic stream of 1M events, 1000 a second of event time, each
+// re-read once by the next poll, and reports the time of an event and the memory retained
+func benchmarkDedup(b *testing.B, newSet func() func(id string, timestamp int64) bool) {
+	ids := make([]string, benchmarkEvents)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("3651924765431798462810293847561029384756102938%08d", i)
+	}
+	var before, after runtime.MemStats
+	var retained uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		isNew := newSet()
+		for i, id := range ids {
+			isNew(id, int64(i))
+			if i >= 500 {
+				isNew(ids[i-500], int64(i-500))
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > before.HeapAlloc {
+			retained = after.HeapAlloc - before.HeapAlloc
+		}
+		runtime.KeepAlive(isNew)
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*benchmarkEvents*2), "ns/event")
+	b.ReportMetric(float64(retained), "retained-B")
+}
+
+func BenchmarkDedupSeenSet(b *testing.B) {
+	benchmarkDedup(b, func() func(string, int64) bool {
+		s := newSeenSet(defaultLimits.EventsWindow)
+		return s.add
+	})
+}
+
+// BenchmarkDedupLRU is the LRU of the ids the emitter used before, sized as -events-cache was
+func BenchmarkDedupLRU(b *testing.B) {
+	benchmarkDedup(b, func() func(string, int64) bool {
+		c, err := lru.New(100000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return func(id string, _ int64) bool {
+			found, _ := c.ContainsOrAdd(id, nil)
+			return !found
+		}
+	})
+}
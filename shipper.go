@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	shipAuthorizationEnv = "SHIP_TO_AUTHORIZATION" // the value of the Authorization header, ex: "Bearer xxx"
+	shipBatchEvents      = 500
+	shipBatchBytes       = 1 << 20
+	shipFlushInterval    = 2 * time.Second
+	shipMaxBuffered      = 8 << 20 // events over it are dropped while the collector is unreachable
+	shipCloseTimeout     = 10 * time.Second
+	shipContentType      = "application/x-ndjson"
+)
+
+// shipTarget is the collector of -ship-to
+type shipTarget struct {
+	url           string
+	authorization string // from SHIP_TO_AUTHORIZATION, "" to send none
+}
+
+// parseShipTarget parses the URL of -ship-to
+func parseShipTarget(rawURL, authorization string) (*shipTarget, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ship-to must be an http or https URL, %s", rawURL)
+	}
+	return &shipTarget{url: rawURL, authorization: authorization}, nil
+}
+
+// shippedEvent is a line of the NDJSON body posted to the collector
+type shippedEvent struct {
+	Timestamp     int64  `json:"timestamp"` // milliseconds since the epoch
+	FunctionName  string `json:"function_name,omitempty"`
+	RequestID     string `json:"request_id,omitempty"`
+	LogStream     string `json:"log_stream,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Message       string `json:"message"`
+}
+
+// shipPermanentError is a response of the collector which is not retried
+type shipPermanentError struct {
+	msg string
+}
+
+func (e *shipPermanentError) Error() string { return e.msg }
+
+// logShipper posts the log events to the collector of -ship-to in batches. It is a subscriber of the bus
+// which only appends to its buffer, so that a slow or unreachable collector never blocks the console;
+// the batches are posted by its own goroutine.
+type logShipper struct {
+	target       *shipTarget
+	emitter      *emitter // the rules of the console apply to the shipped lines too
+	client       *http.Client
+	backoff      func(attempt int) time.Duration
+	batchEvents  int
+	batchBytes   int
+	interval     time.Duration
+	maxBuffered  int
+	closeTimeout time.Duration
+
+	mu          sync.Mutex
+	pending     [][]byte // encoded lines, not yet taken into a batch
+	pendingSize int      // bytes of pending
+	posting     int      // bytes of the batch being posted
+	closed      bool
+	shipped     int
+	dropped     int
+	batches     int
+	warned      bool
+
+	full   chan struct{} // a batch is full
+	stop   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// newLogShipper returns the shipper of the events to the target. start must be called before events are published.
+func newLogShipper(target *shipTarget, em *emitter) *logShipper {
+	return &logShipper{
+		target:       target,
+		emitter:      em,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		backoff:      retryBackoff,
+		batchEvents:  shipBatchEvents,
+		batchBytes:   shipBatchBytes,
+		interval:     shipFlushInterval,
+		maxBuffered:  shipMaxBuffered,
+		closeTimeout: shipCloseTimeout,
+		full:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// handle buffers log events. An event over the memory cap is dropped.
+func (s *logShipper) handle(ev busEvent) error {
+	le, ok := ev.(logEvent)
+	if !ok {
+		return nil
+	}
+	message, ok := le.Message, true
+	if s.emitter != nil {
+		message, ok = s.emitter.shown(le.Message)
+	}
+	if !ok {
+		return nil
+	}
+	if s.emitter != nil {
+		message = s.emitter.render(sinkShip, message)
+	}
+	line, err := json.Marshal(shippedEvent{
+		Timestamp:     le.Timestamp,
+		FunctionName:  le.FunctionName,
+		RequestID:     le.RequestID,
+		LogStream:     le.LogStream,
+		CorrelationID: le.CorrelationID,
+		Message:       message,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.pendingSize+s.posting+len(line) > s.maxBuffered {
+		s.dropped++
+		return nil
+	}
+	s.pending = append(s.pending, line)
+	s.pendingSize += len(line)
+	if len(s.pending) >= s.batchEvents || s.pendingSize >= s.batchBytes {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// start starts posting the batches
+func (s *logShipper) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx)
+}
+
+func (s *logShipper) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.full:
+			s.flush(ctx, false)
+		case <-ticker.C:
+			s.flush(ctx, true)
+		case <-s.stop:
+			s.flush(ctx, true)
+			return
+		}
+	}
+}
+
+// flush posts the full batches, and with all the last one which is not full too
+func (s *logShipper) flush(ctx context.Context, all bool) {
+	for {
+		batch := s.take(all)
+		if len(batch) == 0 {
+			return
+		}
+		err := s.post(ctx, batch)
+		s.mu.Lock()
+		s.posting = 0
+		if err == nil {
+			s.shipped += len(batch)
+			s.batches++
+		} else {
+			s.dropped += len(batch)
+		}
+		warn := err != nil && !s.warned
+		if warn {
+			s.warned = true
+		}
+		s.mu.Unlock()
+		if warn {
+			logger.Warnf("%s; %d events are dropped", err, len(batch))
+		}
+	}
+}
+
+// take removes a batch of up to batchEvents lines and batchBytes from the pending lines.
+// It is empty unless the batch is full or all is set.
+func (s *logShipper) take(all bool) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, size := 0, 0
+	for n < len(s.pending) && n < s.batchEvents && (n == 0 || size+len(s.pending[n]) <= s.batchBytes) {
+		size += len(s.pending[n])
+		n++
+	}
+	full := n == s.batchEvents || n < len(s.pending) || size >= s.batchBytes
+	if n == 0 || (!all && !full) {
+		return nil
+	}
+	batch := s.pending[:n:n]
+	s.pending = s.pending[n:]
+	s.pendingSize -= size
+	s.posting = size
+	return batch
+}
+
+// post sends the batch as gzipped NDJSON. Server errors and connection errors are retried until ctx is done.
+func (s *logShipper) post(ctx context.Context, batch [][]byte) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	for _, line := range batch {
+		if _, err := zw.Write(line); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.postOnce(ctx, body.Bytes())
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*shipPermanentError); ok {
+			return err
+		}
+		if serr := sleepContext(ctx, s.backoff(attempt)); serr != nil {
+			return err
+		}
+	}
+}
+
+func (s *logShipper) postOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.target.url, bytes.NewReader(body))
+	if err != nil {
+		return &shipPermanentError{err.Error()}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", shipContentType)
+	req.Header.Set("Content-Encoding", "gzip")
+	if s.target.authorization != "" {
+		req.Header.Set("Authorization", s.target.authorization)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ship-to: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("ship-to: POST %s: %s", s.target.url, resp.Status)
+	}
+	return &shipPermanentError{fmt.Sprintf("ship-to: POST %s: %s: %s", s.target.url, resp.Status, strings.TrimSpace(string(msg)))}
+}
+
+// close posts the last batch, waiting for the collector up to closeTimeout, and stops buffering.
+// The events which are still not posted are dropped.
+func (s *logShipper) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	timer := time.AfterFunc(s.closeTimeout, s.cancel)
+	close(s.stop)
+	<-s.done
+	timer.Stop()
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped += len(s.pending)
+	s.pending, s.pendingSize = nil, 0
+	logger.Debugf("shipped %s to %s in %d batches, %d dropped", plural(s.shipped, "event"), s.target.url, s.batches, s.dropped)
+}
+
+// summary returns the counts of the events for the summary, nil without -ship-to
+func (s *logShipper) summary() *schema.Shipping {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &schema.Shipping{Shipped: s.shipped, Dropped: s.dropped, Batches: s.batches}
+}
+
+// shipStep describes the shipping of -ship-to in a plan
+func shipStep(target *shipTarget) step {
+	return step{
+		name: "ship-events",
+		plan: func() ([]plannedCall, error) {
+			return []plannedCall{{
+				Service:   "ship-to",
+				Operation: "POST",
+				Params:    []planParam{{"URL", target.url}},
+				Note:      fmt.Sprintf("the log events as gzipped NDJSON, in batches of up to %d events every %s while the run goes on", shipBatchEvents, shipFlushInterval),
+			}}, nil
+		},
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+	"go.uber.org/zap"
+)
+
+// fakeCollector records the batches posted to it. status returns the status of the nth request, from 1.
+type fakeCollector struct {
+	mu       sync.Mutex
+	requests int
+	batches  [][]shippedEvent
+	headers  http.Header
+	status   func(n int) int
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.requests++
+	n := c.requests
+	c.headers = r.Header.Clone()
+	c.mu.Unlock()
+	if c.status != nil {
+		if status := c.status(n); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var batch []shippedEvent
+	sc := bufio.NewScanner(zr)
+	for sc.Scan() {
+		var e shippedEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batch = append(batch, e)
+	}
+	c.mu.Lock()
+	c.batches = append(c.batches, batch)
+	c.mu.Unlock()
+}
+
+func (c *fakeCollector) sizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sizes []int
+	for _, b := range c.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func newTestShipper(t *testing.T, c *fakeCollector) *logShipper {
+	t.Helper()
+	ts := httptest.NewServer(c)
+	t.Cleanup(ts.Close)
+	s := newLogShipper(&shipTarget{url: ts.URL, authorization: "Bearer secret"}, nil)
+	s.backoff = func(int) time.Duration { return time.Millisecond }
+	s.interval = time.Hour
+	return s
+}
+
+func publishLines(s *logShipper, n int) {
+	for i := 0; i < n; i++ {
+		s.handle(logEvent{FunctionName: "orders-fn", RequestID: "r1", LogStream: "s1", Message: fmt.Sprintf("line %d", i), Timestamp: int64(i)})
+	}
+}
+
+func TestLogShipperBatches(t *testing.T) {
+	setTestLogger(t)
+	c := &fakeCollector{}
+	s := newTestShipper(t, c)
+	s.batchEvents = 3
+	s.start()
+	publishLines(s, 7)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.sizes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.sizes(); fmt.Sprint(got) != "[3 3]" {
+		t.Fatalf("the full batches are not posted before the end: %v", got)
+	}
+	s.close()
+	if got := c.sizes(); fmt.Sprint(got) != "[3 3 1]" {
+		t.Errorf("got batches of %v", got)
+	}
+	if got := s.summary(); *got != (schema.Shipping{Shipped: 7, Batches: 3}) {
+		t.Errorf("got %+v", got)
+	}
+	if e := c.batches[2][0]; e.Message != "line 6" || e.RequestID != "r1" || e.LogStream != "s1" || e.Timestamp != 6 {
+		t.Errorf("got %+v", e)
+	}
+	h := c.headers
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Content-Type") != shipContentType || h.Get("Authorization") != "Bearer secret" {
+		t.Errorf("got headers %v", h)
+	}
+}
+
+func TestLogShipperBatchBytes(t *testing.T) {
+	setTestLogger(t)
+	c := &fakeCollector{}
+	s := newTestShipper(t, c)
+	line, _ := json.Marshal(shippedEvent{FunctionName: "orders-fn", RequestID: "r1", LogStream: "s1", Message: "line 0"})
+	s.batchBytes = 2*(len(line)+1) + 1 // two lines fit, not three
+	s.start()
+	publishLines(s, 5)
+	s.close()
+	if got := c.sizes(); fmt.Sprint(got) != "[2 2 1]" {
+		t.Errorf("got batches of %v", got)
+	}
+}
+
+func TestLogShipperFlushInterval(t *testing.T) {
+	setTestLogger(t)
+	c := &fakeCollector{}
+	s := newTestShipper(t, c)
+	s.interval = 10 * time.Millisecond
+	s.start()
+	defer s.close()
+	publishLines(s, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.sizes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.sizes(); fmt.Sprint(got) != "[2]" {
+		t.Errorf("a batch which is not full is not posted on the interval: %v", got)
+	}
+}
+
+func TestLogShipperLineLimit(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(zap.NewNop().Sugar(), nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	em.setLineLimit(sinkConsole, 10)
+	em.setLineLimit(sinkShip, 40)
+	c := &fakeCollector{}
+	s := newTestShipper(t, c)
+	s.emitter = em
+	s.start()
+	long := strings.Repeat("x", 100)
+	s.handle(logEvent{FunctionName: "orders-fn", RequestID: "r1", Message: long})
+	s.handle(logEvent{FunctionName: "orders-fn", RequestID: "r1", Message: "short line"})
+	s.close()
+	if len(c.batches) != 1 || len(c.batches[0]) != 2 {
+		t.Fatalf("got batches of %v", c.sizes())
+	}
+	if got := c.batches[0][0].Message; got != truncateMiddle(long, 40) || len(got) > 40 {
+		t.Errorf("a long line is not capped by the limit of the sink: %q", got)
+	}
+	if got := c.batches[0][1].Message; got != "short line" {
+		t.Errorf("a line is capped by the limit of the console: %q", got)
+	}
+}
+
+func TestLogShipperRetry(t *testing.T) {
+	setTestLogger(t)
+	c := &fakeCollector{status: func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	s := newTestShipper(t, c)
+	s.start()
+	publishLines(s, 4)
+	s.close()
+	if c.requests != 3 || fmt.Sprint(c.sizes()) != "[4]" {
+		t.Errorf("got %d requests, batches of %v", c.requests, c.sizes())
+	}
+	if got := s.summary(); *got != (schema.Shipping{Shipped: 4, Batches: 1}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestLogShipperPermanentError(t *testing.T) {
+	logs := setTestLogger(t)
+	c := &fakeCollector{status: func(n int) int {
+		if n == 1 {
+			return http.StatusUnauthorized
+		}
+		return http.StatusOK
+	}}
+	s := newTestShipper(t, c)
+	s.batchEvents = 2
+	s.start()
+	publishLines(s, 3)
+	s.close()
+	if c.requests != 2 || fmt.Sprint(c.sizes()) != "[1]" {
+		t.Errorf("a refused batch is retried: %d requests, batches of %v", c.requests, c.sizes())
+	}
+	if got := s.summary(); *got != (schema.Shipping{Shipped: 1, Dropped: 2, Batches: 1}) {
+		t.Errorf("got %+v", got)
+	}
+	if logs.FilterMessageSnippet("401 Unauthorized").Len() != 1 {
+		t.Errorf("the refusal is not warned: %v", logs.All())
+	}
+}
+
+func TestLogShipperOverflow(t *testing.T) {
+	setTestLogger(t)
+	release := make(chan struct{})
+	c := &fakeCollector{status: func(n int) int {
+		if n == 1 {
+			<-release
+		}
+		return http.StatusOK
+	}}
+	s := newTestShipper(t, c)
+	line, _ := json.Marshal(shippedEvent{FunctionName: "orders-fn", RequestID: "r1", LogStream: "s1", Message: "line 0"})
+	s.batchEvents = 2
+	s.maxBuffered = 4 * (len(line) + 1) // the batch being posted and two more lines
+	s.start()
+	publishLines(s, 2)
+	posting := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.posting > 0
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !posting() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	publishLines(s, 5) // the collector hangs on the first batch
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("publishing is blocked by the collector for %s", elapsed)
+	}
+	close(release)
+	s.close()
+	if got := s.summary(); *got != (schema.Shipping{Shipped: 4, Dropped: 3, Batches: 2}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestLogShipperCloseTimeout(t *testing.T) {
+	setTestLogger(t)
+	c := &fakeCollector{status: func(int) int { return http.StatusBadGateway }}
+	s := newTestShipper(t, c)
+	s.closeTimeout = 50 * time.Millisecond
+	s.start()
+	publishLines(s, 3)
+	start := time.Now()
+	s.close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("close waited %s", elapsed)
+	}
+	if got := s.summary(); *got != (schema.Shipping{Dropped: 3}) {
+		t.Errorf("got %+v", got)
+	}
+	publishLines(s, 1)
+	if got := s.summary(); got.Dropped != 4 {
+		t.Errorf("an event after close is not dropped: %+v", got)
+	}
+}
+
+func TestParseShipTarget(t *testing.T) {
+	for _, u := range []string{"collector:9000", "ftp://collector/ingest", "https://"} {
+		if _, err := parseShipTarget(u, ""); err == nil {
+			t.Errorf("%s: no error", u)
+		}
+	}
+	config, err := parseArgs([]string{"-func", "f", "-ship-to", "https://collector.example.com/ingest"}, func(name string) string {
+		if name == shipAuthorizationEnv {
+			return "Bearer secret"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.shipTo == nil || config.shipTo.url != "https://collector.example.com/ingest" || config.shipTo.authorization != "Bearer secret" {
+		t.Errorf("got %+v", config.shipTo)
+	}
+}
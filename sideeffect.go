@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultExpectTimeout = 30 * time.Second
+	expectMaxAttempts    = 10
+	expectMaxBackoff     = 8 * time.Second
+
+	sqsMaxMessages     = 10 // max of a ReceiveMessage
+	sqsWaitTimeSeconds = 1  // long polling of a ReceiveMessage
+	sqsPeekVisibility  = 2  // seconds a received message is hidden from the consumers of the queue
+	sqsDeleteTimeout   = 5 * time.Second
+)
+
+// sqsAPI is the part of SQS API used to find a message
+type sqsAPI interface {
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+}
+
+// dynamodbAPI is the part of DynamoDB API used to find an item
+type dynamodbAPI interface {
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+}
+
+// sideEffectExpectation is the side effects a run expects after the invocation, from the flags
+type sideEffectExpectation struct {
+	queueURL string                 // -expect-sqs-message
+	table    string                 // -expect-dynamodb-item
+	key      map[string]interface{} // of the item
+	filter   *expr                  // nil matches anything
+	consume  bool                   // delete the matching message instead of returning it
+	timeout  time.Duration
+}
+
+// parseSideEffectFlags returns the expectation of the flags, or nil if no side effect is expected
+func parseSideEffectFlags(queueURL, item, filter string, consume bool, timeout time.Duration) (*sideEffectExpectation, error) {
+	if queueURL == "" && item == "" {
+		if filter != "" || consume {
+			return nil, fmt.Errorf("-expect-filter and -consume need -expect-sqs-message or -expect-dynamodb-item")
+		}
+		return nil, nil
+	}
+	if consume && queueURL == "" {
+		return nil, fmt.Errorf("-consume needs -expect-sqs-message")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("expect-timeout must be positive")
+	}
+	ret := &sideEffectExpectation{queueURL: queueURL, consume: consume, timeout: timeout}
+	if item != "" {
+		table, key, err := parseDynamoDBItemFlag(item)
+		if err != nil {
+			return nil, err
+		}
+		ret.table, ret.key = table, key
+	}
+	if filter != "" {
+		e, err := parseExpr(filter)
+		if err != nil {
+			return nil, fmt.Errorf("expect-filter: %w", err)
+		}
+		ret.filter = e
+	}
+	return ret, nil
+}
+
+// parseDynamoDBItemFlag parses table:key-json, ex: orders:{"id": "o-1"}
+func parseDynamoDBItemFlag(s string) (string, map[string]interface{}, error) {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return "", nil, fmt.Errorf("expect-dynamodb-item must be table:key-json, %s", s)
+	}
+	var key map[string]interface{}
+	if err := json.Unmarshal([]byte(s[i+1:]), &key); err != nil || len(key) == 0 || len(key) > 2 {
+		return "", nil, fmt.Errorf("the key of expect-dynamodb-item must be a JSON object of the partition key and the sort key, %s", s[i+1:])
+	}
+	return s[:i], key, nil
+}
+
+// sideEffectFinding is the result of a side effect check, in the summary
+type sideEffectFinding = schema.SideEffect
+
+// sideEffectChecker looks for a side effect of the invocation
+type sideEffectChecker interface {
+	kind() string
+	resource() string
+	// poll looks for the side effect once, and returns the matching document or nil,
+	// with the documents seen. last is the last document seen, or nil.
+	poll(ctx context.Context) (found interface{}, seen int, last interface{}, err error)
+}
+
+// checkers returns the checkers of the expectation with the clients of the session
+func (e *sideEffectExpectation) checkers(sess *session.Session) ([]sideEffectChecker, error) {
+	var ret []sideEffectChecker
+	if e.queueURL != "" {
+		ret = append(ret, &sqsChecker{api: sqs.New(sess), queueURL: e.queueURL, filter: e.filter, consume: e.consume})
+	}
+	if e.table != "" {
+		c, err := newDynamoDBChecker(dynamodb.New(sess), e.table, e.key, e.filter)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// expectBackoff returns the wait before the next poll
+func expectBackoff(attempt int) time.Duration {
+	wait := 500 * time.Millisecond << uint(attempt-1)
+	if wait > expectMaxBackoff || wait <= 0 {
+		wait = expectMaxBackoff
+	}
+	return wait
+}
+
+// expectSideEffect polls the checker with backoff until the side effect is found, the attempts are
+// exhausted or the timeout expires. An error of the API ends the check.
+func expectSideEffect(ctx context.Context, c sideEffectChecker, filter *expr, timeout time.Duration, backoff func(int) time.Duration) (sideEffectFinding, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ret := sideEffectFinding{Kind: c.kind(), Resource: c.resource()}
+	if filter != nil {
+		ret.Filter = filter.String()
+	}
+	for attempt := 1; attempt <= expectMaxAttempts; attempt++ {
+		ret.Attempts = attempt
+		found, seen, last, err := c.poll(ctx)
+		ret.Seen += seen
+		if last != nil {
+			ret.Found = last
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break // the timeout in a long poll
+			}
+			return ret, fmt.Errorf("%s %s: %w", ret.Kind, ret.Resource, err)
+		}
+		if found != nil {
+			ret.Matched = true
+			ret.Found = found
+			return ret, nil
+		}
+		if attempt < expectMaxAttempts && sleepContext(ctx, backoff(attempt)) != nil {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// sqsChecker finds a message in a queue. A received message is peeked: it is hidden for sqsPeekVisibility
+// and visible again when it expires, without a call which would hand it back to the consumers earlier
+// and make the poll receive it again at once. The matching message is deleted with consume.
+type sqsChecker struct {
+	api      sqsAPI
+	queueURL string
+	filter   *expr
+	consume  bool
+}
+
+func (c *sqsChecker) kind() string     { return "sqs-message" }
+func (c *sqsChecker) resource() string { return c.queueURL }
+
+func (c *sqsChecker) poll(ctx context.Context) (interface{}, int, interface{}, error) {
+	out, err := c.api.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(c.queueURL),
+		MaxNumberOfMessages:   aws.Int64(sqsMaxMessages),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeSeconds),
+		VisibilityTimeout:     aws.Int64(sqsPeekVisibility),
+		MessageAttributeNames: []*string{aws.String("All")},
+	})
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("ReceiveMessage: %w", err)
+	}
+	var found, last interface{}
+	for _, m := range out.Messages {
+		doc := sqsMessageDocument(m)
+		last = doc
+		matched := found == nil
+		if matched && c.filter != nil {
+			if matched, err = c.filter.evalBool(doc["body"]); err != nil {
+				logger.Debugf("message %s: %s", aws.StringValue(m.MessageId), err)
+			}
+		}
+		if matched {
+			found = doc
+		}
+		if matched && c.consume {
+			if err := c.delete(m); err != nil {
+				return found, len(out.Messages), last, err
+			}
+		}
+	}
+	return found, len(out.Messages), last, nil
+}
+
+// delete deletes the message consumed by -consume
+func (c *sqsChecker) delete(m *sqs.Message) error {
+	// not cancelled with the poll, so that a matching message is not left for the consumers after the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), sqsDeleteTimeout)
+	defer cancel()
+	_, err := c.api.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(c.queueURL), ReceiptHandle: m.ReceiptHandle})
+	if err != nil {
+		return fmt.Errorf("DeleteMessage: %w", err)
+	}
+	return nil
+}
+
+// sqsMessageDocument returns the message for the summary. The body is decoded if it is JSON,
+// and the filter is evaluated against it.
+func sqsMessageDocument(m *sqs.Message) map[string]interface{} {
+	var body interface{}
+	if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &body); err != nil {
+		body = aws.StringValue(m.Body)
+	}
+	return map[string]interface{}{"message_id": aws.StringValue(m.MessageId), "body": body}
+}
+
+// dynamoDBChecker finds an item by its key
+type dynamoDBChecker struct {
+	api    dynamodbAPI
+	table  string
+	key    map[string]*dynamodb.AttributeValue
+	filter *expr
+}
+
+func newDynamoDBChecker(api dynamodbAPI, table string, key map[string]interface{}, filter *expr) (*dynamoDBChecker, error) {
+	av, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		return nil, fmt.Errorf("expect-dynamodb-item key: %w", err)
+	}
+	return &dynamoDBChecker{api: api, table: table, key: av, filter: filter}, nil
+}
+
+func (c *dynamoDBChecker) kind() string     { return "dynamodb-item" }
+func (c *dynamoDBChecker) resource() string { return c.table }
+
+func (c *dynamoDBChecker) poll(ctx context.Context) (interface{}, int, interface{}, error) {
+	out, err := c.api.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            c.key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if len(out.Item) == 0 {
+		return nil, 0, nil, nil
+	}
+	var item map[string]interface{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &item); err != nil {
+		return nil, 1, nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if c.filter != nil {
+		matched, err := c.filter.evalBool(item)
+		if err != nil {
+			logger.Debugf("item of %s: %s", c.table, err)
+		}
+		if !matched {
+			return nil, 1, item, nil
+		}
+	}
+	return item, 1, item, nil
+}
+
+// expectSideEffects polls each checker in turn. A side effect which is not found fails the run
+// as the function did not do it.
+func (sl *AWSServerless) expectSideEffects(ctx context.Context, checkers []sideEffectChecker) error {
+	for _, c := range checkers {
+		f, err := expectSideEffect(ctx, c, sl.expect.filter, sl.expect.timeout, expectBackoff)
+		sl.sideEffects = append(sl.sideEffects, f)
+		if err != nil {
+			return err
+		}
+		if !f.Matched {
+			what := "no " + f.Kind
+			if f.Filter != "" {
+				what += fmt.Sprintf(" matches %q", f.Filter)
+			}
+			return &functionError{fmt.Errorf("%s in %s after %d attempts, %d seen", what, f.Resource, f.Attempts, f.Seen)}
+		}
+		logger.Infof("%s is found in %s after %d attempts", f.Kind, f.Resource, f.Attempts)
+	}
+	return nil
+}
+
+func (sl *AWSServerless) planExpect() ([]plannedCall, error) {
+	e := sl.expect
+	note := fmt.Sprintf("up to %d times in %s until a match", expectMaxAttempts, e.timeout)
+	if e.filter != nil {
+		note = fmt.Sprintf("up to %d times in %s until a match of %q", expectMaxAttempts, e.timeout, e.filter)
+	}
+	var ret []plannedCall
+	if e.queueURL != "" {
+		queue := planParam{"QueueUrl", e.queueURL}
+		ret = append(ret, plannedCall{
+			Service:   "sqs",
+			Operation: "ReceiveMessage",
+			Params:    []planParam{queue, {"MaxNumberOfMessages", fmt.Sprint(sqsMaxMessages)}, {"VisibilityTimeout", fmt.Sprint(sqsPeekVisibility)}},
+			Note:      note + ", each received message is visible again when its visibility timeout expires",
+		})
+		if e.consume {
+			ret = append(ret, plannedCall{
+				Service:   "sqs",
+				Operation: "DeleteMessage",
+				Params:    []planParam{queue},
+				Note:      "for the matching message, -consume",
+			})
+		}
+	}
+	if e.table != "" {
+		key, err := json.Marshal(e.key)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, plannedCall{
+			Service:   "dynamodb",
+			Operation: "GetItem",
+			Params:    []planParam{{"TableName", e.table}, {"Key", string(key)}, {"ConsistentRead", "true"}},
+			Note:      note,
+		})
+	}
+	return ret, nil
+}
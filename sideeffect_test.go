@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeSQS serves a batch of messages to each ReceiveMessage, and records the visibility timeouts and deletions
+type fakeSQS struct {
+	batches    [][]*sqs.Message
+	receives   int
+	visibility []int64 // VisibilityTimeout of each ReceiveMessage
+	deleted    []string
+	err        error
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.receives++
+	f.visibility = append(f.visibility, aws.Int64Value(input.VisibilityTimeout))
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.batches) == 0 {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func sqsMessage(id, body string) *sqs.Message {
+	return &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String("rh-" + id), Body: aws.String(body)}
+}
+
+func noBackoff(int) time.Duration { return 0 }
+
+func mustParseExpr(t *testing.T, src string) *expr {
+	t.Helper()
+	e, err := parseExpr(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSQSChecker(t *testing.T) {
+	setTestLogger(t)
+	filter := mustParseExpr(t, `.status == "shipped"`)
+	batches := func() [][]*sqs.Message {
+		return [][]*sqs.Message{
+			{},
+			{sqsMessage("m1", `{"status": "pending"}`), sqsMessage("m2", "not json"), sqsMessage("m3", `{"status": "shipped"}`)},
+		}
+	}
+
+	for _, consume := range []bool{false, true} {
+		api := &fakeSQS{batches: batches()}
+		c := &sqsChecker{api: api, queueURL: "https://sqs/out", filter: filter, consume: consume}
+		f, err := expectSideEffect(context.Background(), c, filter, time.Minute, noBackoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Matched || f.Attempts != 2 || f.Seen != 3 || f.Filter != `.status == "shipped"` {
+			t.Errorf("consume %v: got %+v", consume, f)
+		}
+		if doc := f.Found.(map[string]interface{}); doc["message_id"] != "m3" {
+			t.Errorf("got %v", doc)
+		}
+		if consume {
+			if len(api.deleted) != 1 || api.deleted[0] != "rh-m3" {
+				t.Errorf("the matching message must be deleted, got %v", api.deleted)
+			}
+		} else if len(api.deleted) != 0 {
+			t.Errorf("nothing is deleted without -consume, got %v", api.deleted)
+		}
+		// the messages are peeked, and visible again to the consumers when the short timeout expires
+		if fmt.Sprint(api.visibility) != fmt.Sprint([]int64{sqsPeekVisibility, sqsPeekVisibility}) {
+			t.Errorf("consume %v: visibility timeouts %v", consume, api.visibility)
+		}
+	}
+}
+
+func TestSQSCheckerNotFound(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeSQS{batches: [][]*sqs.Message{{sqsMessage("m1", `{"status": "pending"}`)}}}
+	filter := mustParseExpr(t, `.status == "shipped"`)
+	c := &sqsChecker{api: api, queueURL: "https://sqs/out", filter: filter}
+	f, err := expectSideEffect(context.Background(), c, filter, time.Minute, noBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Matched || f.Attempts != expectMaxAttempts || api.receives != expectMaxAttempts || f.Seen != 1 {
+		t.Errorf("got %+v", f)
+	}
+	// the last message seen helps to tell why it does not match
+	if doc := f.Found.(map[string]interface{}); doc["message_id"] != "m1" {
+		t.Errorf("got %v", doc)
+	}
+}
+
+func TestExpectSideEffectTimeout(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeSQS{}
+	c := &sqsChecker{api: api, queueURL: "https://sqs/out"}
+	start := time.Now()
+	f, err := expectSideEffect(context.Background(), c, nil, 50*time.Millisecond, func(int) time.Duration { return time.Hour })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Matched || f.Attempts != 1 || time.Since(start) > 10*time.Second {
+		t.Errorf("got %+v in %s", f, time.Since(start))
+	}
+}
+
+func TestExpectSideEffects(t *testing.T) {
+	setTestLogger(t)
+	sl := &AWSServerless{expect: &sideEffectExpectation{timeout: time.Minute}}
+
+	err := sl.expectSideEffects(context.Background(), []sideEffectChecker{&sqsChecker{api: &fakeSQS{}, queueURL: "https://sqs/out"}})
+	if !isFunctionError(err) {
+		t.Errorf("a missing side effect is a failure of the function, got %v", err)
+	}
+	if len(sl.sideEffects) != 1 || sl.sideEffects[0].Matched {
+		t.Errorf("got %+v", sl.sideEffects)
+	}
+
+	sl.sideEffects = nil
+	denied := awserr.New("AccessDenied", "not authorized to perform: sqs:receivemessage", nil)
+	err = sl.expectSideEffects(context.Background(), []sideEffectChecker{&sqsChecker{api: &fakeSQS{err: denied}, queueURL: "https://sqs/out"}})
+	if err == nil || isFunctionError(err) || !errors.Is(err, denied) {
+		t.Errorf("an API error is an error of the run, got %v", err)
+	}
+	if len(sl.sideEffects) != 1 || sl.sideEffects[0].Attempts != 1 {
+		t.Errorf("got %+v", sl.sideEffects)
+	}
+}
+
+// fakeDynamoDB serves the items in order to each GetItem, nil for an absent item
+type fakeDynamoDB struct {
+	items []map[string]interface{}
+	keys  []map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if !aws.BoolValue(input.ConsistentRead) {
+		return nil, fmt.Errorf("an item written just now needs a consistent read")
+	}
+	f.keys = append(f.keys, input.Key)
+	if len(f.items) == 0 {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	item := f.items[0]
+	if len(f.items) > 1 {
+		f.items = f.items[1:]
+	}
+	if item == nil {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	av, err := newDynamoDBChecker(nil, "", item, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: av.key}, nil
+}
+
+func TestDynamoDBChecker(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeDynamoDB{items: []map[string]interface{}{
+		nil,
+		{"id": "o-1", "status": "pending"},
+		{"id": "o-1", "status": "shipped", "total": 12.5},
+	}}
+	filter := mustParseExpr(t, `.status == "shipped"`)
+	c, err := newDynamoDBChecker(api, "orders", map[string]interface{}{"id": "o-1"}, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := expectSideEffect(context.Background(), c, filter, time.Minute, noBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Matched || f.Attempts != 3 || f.Seen != 2 || f.Kind != "dynamodb-item" || f.Resource != "orders" {
+		t.Errorf("got %+v", f)
+	}
+	if item := f.Found.(map[string]interface{}); item["total"] != 12.5 {
+		t.Errorf("got %v", item)
+	}
+	if len(api.keys) != 3 || aws.StringValue(api.keys[0]["id"].S) != "o-1" {
+		t.Errorf("got %v", api.keys)
+	}
+
+	// any item matches without a filter
+	c, _ = newDynamoDBChecker(&fakeDynamoDB{items: []map[string]interface{}{{"id": "o-1"}}}, "orders", map[string]interface{}{"id": "o-1"}, nil)
+	if f, err := expectSideEffect(context.Background(), c, nil, time.Minute, noBackoff); err != nil || !f.Matched || f.Attempts != 1 {
+		t.Errorf("got %+v, %v", f, err)
+	}
+}
+
+func TestParseSideEffectFlags(t *testing.T) {
+	tests := []struct {
+		queueURL, item, filter string
+		consume                bool
+		timeout                time.Duration
+		ok                     bool
+	}{
+		{"", "", "", false, time.Second, true},
+		{"https://sqs/out", "", ".ok", true, time.Second, true},
+		{"", `orders:{"id": "o-1", "sk": 1}`, ".ok", false, time.Second, true},
+		{"", "", ".ok", false, time.Second, false},
+		{"", "", "", true, time.Second, false},
+		{"", `orders:{"id": "o-1"}`, "", true, time.Second, false},
+		{"https://sqs/out", "", ".ok ==", false, time.Second, false},
+		{"https://sqs/out", "", "", false, 0, false},
+		{"", `orders`, "", false, time.Second, false},
+		{"", `:{"id": "o-1"}`, "", false, time.Second, false},
+		{"", `orders:"o-1"`, "", false, time.Second, false},
+		{"", `orders:{}`, "", false, time.Second, false},
+	}
+	for _, tt := range tests {
+		_, err := parseSideEffectFlags(tt.queueURL, tt.item, tt.filter, tt.consume, tt.timeout)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v", tt, err)
+		}
+	}
+
+	e, err := parseSideEffectFlags("", `orders:{"id": "o-1"}`, "", false, time.Second)
+	if err != nil || e.table != "orders" || e.key["id"] != "o-1" {
+		t.Errorf("got %+v, %v", e, err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	defaultSQSEnqueuedTimeout = 5 * time.Minute
+	sqsCorrelationAttribute   = "nodeless-correlation-id" // the message attribute which finds the message in the DLQ
+)
+
+// phases of a message sent to an SQS source queue
+const (
+	sqsEnqueued = "enqueued"  // sent, not received by the event source mapping yet
+	sqsInFlight = "in-flight" // received by the event source mapping, which invokes the function with it
+	sqsConsumed = "consumed"  // deleted from the queue by the event source mapping
+	sqsRedriven = "redriven"  // moved to the DLQ after too many receives
+)
+
+// sqsDelivery follows a message through its source queue. The queue is not peeked, which would count as a
+// receive of the messages toward the maxReceiveCount of the redrive policy, and its approximate depth counts
+// every message of the queue, lagging behind. So the depth only confirms what the logs tell of our message:
+// it is in flight when its invocation is found in the logs, or when the queue shows no visible message but
+// some in flight; it is consumed only after its invocation has ended in the logs, once a poll of the depth
+// after the END tells that a message in flight was deleted, no message being in flight any more or fewer
+// than before the END.
+type sqsDelivery struct {
+	mu            sync.Mutex
+	correlationID string // of the message attribute which finds the message in the DLQ
+	phase         string
+	sentAt        time.Time
+	inFlightAt    time.Time
+	invokedAt     time.Time // END of the invocation of the message in the logs
+	endedAt       time.Time // when the message was consumed or redriven
+	visible       int64
+	notVisible    int64
+	sawVisible    bool  // a poll counted a visible message
+	inFlightAtEnd int64 // notVisible at the last poll before the END, -1 until a poll is taken
+	polls         int
+	receiveCount  int
+	dlqURL        string
+	consumed      chan struct{} // closed when the message is consumed
+}
+
+func newSQSDelivery(correlationID, dlqURL string, sentAt time.Time) *sqsDelivery {
+	return &sqsDelivery{correlationID: correlationID, phase: sqsEnqueued, sentAt: sentAt, dlqURL: dlqURL, consumed: make(chan struct{})}
+}
+
+// advance moves the message forward to the phase. A phase which is behind is ignored.
+func (d *sqsDelivery) advance(phase string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.advanceLocked(phase, now)
+}
+
+func (d *sqsDelivery) advanceLocked(phase string, now time.Time) {
+	// a message redriven to the DLQ disappears from the queue too, as if it was consumed
+	if d.phase == sqsRedriven || d.phase == phase || (d.phase == sqsConsumed && phase != sqsRedriven) {
+		return
+	}
+	if d.phase == sqsEnqueued {
+		d.inFlightAt = now
+		logger.Infof("the message is in flight after %s in the queue", now.Sub(d.sentAt).Round(time.Millisecond))
+	}
+	d.phase = phase
+	switch phase {
+	case sqsConsumed:
+		d.endedAt = now
+		close(d.consumed)
+		logger.Infof("the message is consumed after %s in flight", now.Sub(d.inFlightAt).Round(time.Millisecond))
+	case sqsRedriven:
+		d.endedAt = now
+	}
+}
+
+// invoked tells that the invocation of the message has ended in the logs. The message is consumed when the
+// depth agrees at a later poll.
+func (d *sqsDelivery) invoked(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.invokedAt.IsZero() {
+		return
+	}
+	d.advanceLocked(sqsInFlight, now)
+	d.invokedAt = now
+	d.inFlightAtEnd = d.notVisible
+	if d.polls == 0 {
+		d.inFlightAtEnd = -1
+	}
+}
+
+// observeDepth takes the approximate numbers of the messages of the queue
+func (d *sqsDelivery) observeDepth(visible, notVisible int64, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.visible, d.notVisible = visible, notVisible
+	d.polls++
+	logger.Debugf("the queue has %d visible and %d in-flight messages, the message is %s", visible, notVisible, d.phase)
+	if visible > 0 {
+		d.sawVisible = true
+	} else if d.phase == sqsEnqueued && (notVisible > 0 || d.sawVisible) {
+		// an empty queue right after SendMessage may not count the message yet
+		d.advanceLocked(sqsInFlight, now)
+	}
+	if d.invokedAt.IsZero() {
+		return
+	}
+	if notVisible == 0 || notVisible < d.inFlightAtEnd {
+		d.advanceLocked(sqsConsumed, now)
+	} else if d.inFlightAtEnd < 0 {
+		// no poll before the END, the first one after is the one to compare with
+		d.inFlightAtEnd = notVisible
+	}
+}
+
+// inFlightSince returns when the message went in flight, false while it is enqueued
+func (d *sqsDelivery) inFlightSince() (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inFlightAt, !d.inFlightAt.IsZero()
+}
+
+// enqueuedFor returns how long the message has been waiting in the queue, 0 when it is not any more
+func (d *sqsDelivery) enqueuedFor(now time.Time) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.phase != sqsEnqueued {
+		return 0
+	}
+	return now.Sub(d.sentAt)
+}
+
+// summary returns the record of the delivery, nil for no message
+func (d *sqsDelivery) summary() *schema.SQSDelivery {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := &schema.SQSDelivery{
+		Phase:           d.phase,
+		Visible:         d.visible,
+		NotVisible:      d.notVisible,
+		Polls:           d.polls,
+		ReceiveCount:    d.receiveCount,
+		DeadLetterQueue: d.dlqURL,
+	}
+	if !d.inFlightAt.IsZero() {
+		s.QueueWait = d.inFlightAt.Sub(d.sentAt)
+	}
+	if !d.endedAt.IsZero() {
+		s.InFlight = d.endedAt.Sub(d.inFlightAt)
+	}
+	return s
+}
+
+// tailWatchingQueue tails the logs while the queue and its DLQ are watched for the message. The message
+// waiting longer than -sqs-enqueued-timeout, or landing in the DLQ, fails the run at once. After the tail,
+// the message is waited to be consumed up to -sqs-consumed-timeout.
+func (sl *AWSServerless) tailWatchingQueue(ctx context.Context, api sqsQueueAPI) error {
+	ctx, cancel := context.WithCancel(ctx)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	interval := sl.limits.orDefault().PollInterval
+	go func() {
+		defer close(done)
+		if err := sl.watchQueue(ctx, api, interval); err != nil {
+			failed <- err
+			cancel()
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	err := sl.logTailStart(ctx)
+	select {
+	case werr := <-failed:
+		return werr
+	default:
+	}
+	if err != nil || sl.sqs.consumedTimeout == 0 {
+		return err
+	}
+
+	timer := time.NewTimer(sl.sqs.consumedTimeout)
+	defer timer.Stop()
+	select {
+	case <-sl.delivery.consumed:
+		return nil
+	case werr := <-failed:
+		return werr
+	case <-timer.C:
+		d := sl.delivery.summary()
+		return &timeoutError{fmt.Errorf("the message %s is not consumed in -sqs-consumed-timeout %s after the invocation: no poll of %s shows fewer messages in flight than before its END, %d are visible and %d in flight",
+			sl.messageID, sl.sqs.consumedTimeout, sl.sqs.queueURL, d.Visible, d.NotVisible)}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchQueue polls the depth of the queue and receives the messages of the DLQ every interval until ctx is
+// done. It returns a timeout error when the message waits in the queue longer than -sqs-enqueued-timeout,
+// and a function error with the body when the message is redriven to the DLQ.
+func (sl *AWSServerless) watchQueue(ctx context.Context, api sqsQueueAPI, interval time.Duration) error {
+	d := sl.delivery
+	depth, dlq := true, sl.sqs.dlqURL != ""
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if depth {
+			out, err := api.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl: aws.String(sl.sqs.queueURL),
+				AttributeNames: aws.StringSlice([]string{
+					sqs.QueueAttributeNameApproximateNumberOfMessages,
+					sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+				}),
+			})
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				// the message is taken as in flight, so that -sqs-match-timeout bounds the wait
+				logger.Warnf("the depth of %s is not watched any more, GetQueueAttributes: %s", sl.sqs.queueURL, err)
+				depth = false
+				d.advance(sqsInFlight, time.Now())
+			} else {
+				d.observeDepth(attributeInt(out.Attributes, sqs.QueueAttributeNameApproximateNumberOfMessages),
+					attributeInt(out.Attributes, sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible), time.Now())
+			}
+		}
+		if wait := d.enqueuedFor(time.Now()); sl.sqs.enqueuedTimeout > 0 && wait > sl.sqs.enqueuedTimeout {
+			s := d.summary()
+			reason := fmt.Sprintf("the event source mapping of %s may be disabled, or throttled by its maximum concurrency", sl.funcName)
+			if s.Visible == 0 && s.NotVisible == 0 {
+				reason = fmt.Sprintf("the queue reads empty, so the message may have been received by an invocation of %s which does not log the message id", sl.funcName)
+			}
+			return &timeoutError{fmt.Errorf("the message %s is not received from %s in -sqs-enqueued-timeout %s, %d messages are visible and %d in flight: %s",
+				sl.messageID, sl.sqs.queueURL, sl.sqs.enqueuedTimeout, s.Visible, s.NotVisible, reason)}
+		}
+		if dlq {
+			err := sl.receiveDLQ(ctx, api)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if _, ok := err.(*functionError); ok {
+				return err
+			}
+			if err != nil {
+				logger.Warnf("the DLQ %s is not watched any more, ReceiveMessage: %s", sl.sqs.dlqURL, err)
+				dlq = false
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// receiveDLQ receives the messages of the DLQ, and returns a function error with the body when our message
+// is there, found by its correlation attribute. The received messages are peeked like sqsChecker does.
+func (sl *AWSServerless) receiveDLQ(ctx context.Context, api sqsAPI) error {
+	out, err := api.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(sl.sqs.dlqURL),
+		MaxNumberOfMessages:   aws.Int64(sqsMaxMessages),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeSeconds),
+		VisibilityTimeout:     aws.Int64(sqsPeekVisibility),
+		AttributeNames:        aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount}),
+		MessageAttributeNames: aws.StringSlice([]string{sqsCorrelationAttribute}),
+	})
+	if err != nil {
+		return err
+	}
+	d := sl.delivery
+	for _, m := range out.Messages {
+		attr, ok := m.MessageAttributes[sqsCorrelationAttribute]
+		ours := ok && aws.StringValue(attr.StringValue) == d.correlationID
+		if !ours && aws.StringValue(m.MessageId) != sl.messageID {
+			continue
+		}
+		receives := int(attributeInt(m.Attributes, sqs.MessageSystemAttributeNameApproximateReceiveCount))
+		d.mu.Lock()
+		d.receiveCount = receives
+		d.advanceLocked(sqsRedriven, time.Now())
+		d.mu.Unlock()
+		return &functionError{fmt.Errorf("the message %s is redriven to the DLQ %s after %s: %s",
+			sl.messageID, sl.sqs.dlqURL, plural(receives, "receive"), aws.StringValue(m.Body))}
+	}
+	return nil
+}
+
+// enqueuedWithin describes -sqs-enqueued-timeout in a plan
+func enqueuedWithin(timeout time.Duration) string {
+	if timeout == 0 {
+		return ""
+	}
+	return " within " + timeout.String()
+}
+
+// attributeInt returns the attribute as a number, 0 when it is absent or not a number
+func attributeInt(attrs map[string]*string, name string) int64 {
+	n, _ := strconv.ParseInt(aws.StringValue(attrs[name]), 10, 64)
+	return n
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQSDelivery(t *testing.T) {
+	setTestLogger(t)
+	sent := time.Unix(1000, 0)
+	d := newSQSDelivery("c-1", "", sent)
+	d.observeDepth(5, 2, sent.Add(time.Second))
+	if d.phase != sqsEnqueued {
+		t.Errorf("got %s", d.phase)
+	}
+	d.advance(sqsInFlight, sent.Add(2*time.Second)) // found in the logs
+	d.observeDepth(0, 3, sent.Add(3*time.Second))
+	d.invoked(sent.Add(4 * time.Second))
+	if d.phase != sqsInFlight {
+		t.Errorf("consumed before the depth agrees: %s", d.phase)
+	}
+	d.observeDepth(0, 0, sent.Add(5*time.Second))
+	s := d.summary()
+	if s.Phase != sqsConsumed || s.QueueWait != 2*time.Second || s.InFlight != 3*time.Second || s.Polls != 3 {
+		t.Errorf("got %+v", s)
+	}
+	// a redriven message disappears from the queue too
+	d.advance(sqsRedriven, sent.Add(6*time.Second))
+	d.advance(sqsInFlight, sent.Add(7*time.Second))
+	if s := d.summary(); s.Phase != sqsRedriven || s.InFlight != 4*time.Second {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestSQSDeliveryEmptyBeforeSeen(t *testing.T) {
+	setTestLogger(t)
+	sent := time.Unix(1000, 0)
+	d := newSQSDelivery("c-1", "", sent)
+	// the depth lags behind SendMessage, the idle queue reads empty
+	d.observeDepth(0, 0, sent.Add(time.Second))
+	d.observeDepth(0, 0, sent.Add(2*time.Second))
+	if d.phase != sqsEnqueued {
+		t.Errorf("got %s before the message is counted or found in the logs", d.phase)
+	}
+	d.observeDepth(1, 0, sent.Add(3*time.Second))
+	d.observeDepth(0, 0, sent.Add(4*time.Second))
+	if s := d.summary(); s.Phase != sqsInFlight || s.QueueWait != 4*time.Second {
+		t.Errorf("got %+v", s)
+	}
+	// the message left the visible ones, but its invocation has not ended
+	d.observeDepth(0, 0, sent.Add(5*time.Second))
+	if d.phase != sqsInFlight {
+		t.Errorf("got %s before the END of the invocation", d.phase)
+	}
+	d.invoked(sent.Add(6 * time.Second))
+	d.observeDepth(0, 0, sent.Add(7*time.Second))
+	if d.phase != sqsConsumed {
+		t.Errorf("got %s", d.phase)
+	}
+}
+
+func TestSQSDeliveryBusyQueue(t *testing.T) {
+	setTestLogger(t)
+	sent := time.Unix(1000, 0)
+	d := newSQSDelivery("c-1", "", sent)
+	// other messages are always visible and in flight
+	d.observeDepth(40, 6, sent.Add(time.Second))
+	if d.phase != sqsEnqueued {
+		t.Errorf("got %s", d.phase)
+	}
+	d.advance(sqsInFlight, sent.Add(2*time.Second)) // found in the logs
+	d.observeDepth(38, 8, sent.Add(3*time.Second))
+	d.invoked(sent.Add(4 * time.Second))
+	d.observeDepth(45, 9, sent.Add(5*time.Second))
+	if d.phase != sqsInFlight {
+		t.Errorf("got %s while more messages are in flight", d.phase)
+	}
+	// the batch of the message is deleted
+	d.observeDepth(44, 7, sent.Add(6*time.Second))
+	if s := d.summary(); s.Phase != sqsConsumed || s.InFlight != 4*time.Second || s.Visible != 44 {
+		t.Errorf("got %+v", s)
+	}
+
+	// the END is seen before the first poll
+	d = newSQSDelivery("c-2", "", sent)
+	d.advance(sqsInFlight, sent.Add(time.Second))
+	d.invoked(sent.Add(2 * time.Second))
+	d.observeDepth(45, 9, sent.Add(3*time.Second))
+	if d.phase != sqsInFlight {
+		t.Errorf("got %s without a poll before the END", d.phase)
+	}
+	d.observeDepth(44, 8, sent.Add(4*time.Second))
+	if d.phase != sqsConsumed {
+		t.Errorf("got %s", d.phase)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	defaultSQSMatchTimeout = 2 * time.Minute
+	sqsMessageGroupID      = "k8s-nodeless" // of a message sent to a FIFO queue
+)
+
+// sqsQueueAPI is the part of SQS API -via sqs uses, sending to the queue and receiving from its DLQ
+type sqsQueueAPI interface {
+	sqsAPI
+	SendMessageWithContext(aws.Context, *sqs.SendMessageInput, ...request.Option) (*sqs.SendMessageOutput, error)
+	GetQueueAttributesWithContext(aws.Context, *sqs.GetQueueAttributesInput, ...request.Option) (*sqs.GetQueueAttributesOutput, error)
+	GetQueueUrlWithContext(aws.Context, *sqs.GetQueueUrlInput, ...request.Option) (*sqs.GetQueueUrlOutput, error)
+}
+
+// sqsTarget is the queue -via sqs sends the payload to instead of invoking the function
+type sqsTarget struct {
+	queueURL        string
+	enqueuedTimeout time.Duration // how long the message may wait in the queue before it is received, 0 for no limit
+	matchTimeout    time.Duration // how long a log line with the message id is waited for after the message is received
+	consumedTimeout time.Duration // how long the message is waited to be deleted after the invocation, 0 not to wait
+	dlqURL          string        // of the redrive policy of the queue, "" if none
+}
+
+// resolveDLQ finds the DLQ of the redrive policy of the queue
+func (t *sqsTarget) resolveDLQ(ctx context.Context, api sqsQueueAPI) error {
+	out, err := api.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(t.queueURL),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameRedrivePolicy}),
+	})
+	if err != nil {
+		return fmt.Errorf("GetQueueAttributes, %s: %w", t.queueURL, err)
+	}
+	policy := aws.StringValue(out.Attributes[sqs.QueueAttributeNameRedrivePolicy])
+	if policy == "" {
+		return nil
+	}
+	var p struct {
+		DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+	}
+	if err := json.Unmarshal([]byte(policy), &p); err != nil {
+		return fmt.Errorf("the redrive policy of %s: %w", t.queueURL, err)
+	}
+	// arn:aws:sqs:REGION:ACCOUNT:NAME
+	parts := strings.SplitN(p.DeadLetterTargetArn, ":", 6)
+	if len(parts) != 6 || parts[2] != "sqs" {
+		return fmt.Errorf("the redrive policy of %s has no queue ARN as deadLetterTargetArn: %s", t.queueURL, policy)
+	}
+	u, err := api.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parts[5]),
+		QueueOwnerAWSAccountId: aws.String(parts[4]),
+	})
+	if err != nil {
+		return fmt.Errorf("GetQueueUrl, %s: %w", p.DeadLetterTargetArn, err)
+	}
+	t.dlqURL = aws.StringValue(u.QueueUrl)
+	return nil
+}
+
+// sendMessage sends the payload as a message to the queue, whose event source mapping invokes the
+// function. The invocation is decided by the message id in the logs, see messageCorrelator.
+func (sl *AWSServerless) sendMessage(ctx context.Context, api sqsQueueAPI) error {
+	t := sl.sqs
+	if err := t.resolveDLQ(ctx, api); err != nil {
+		return err
+	}
+	if t.dlqURL == "" {
+		logger.Infof("%s has no redrive policy, no DLQ is watched", t.queueURL)
+	} else {
+		logger.Infof("the DLQ of %s is %s", t.queueURL, t.dlqURL)
+	}
+
+	body := sl.payload
+	if strings.TrimSpace(body) == "" {
+		body = "{}" // a message can not be empty
+	}
+	correlationID, err := newRequestID()
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(t.queueURL),
+		MessageBody: aws.String(body),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			sqsCorrelationAttribute: {DataType: aws.String("String"), StringValue: aws.String(correlationID)},
+		},
+	}
+	if strings.HasSuffix(t.queueURL, ".fifo") {
+		dedup, err := newRequestID()
+		if err != nil {
+			return err
+		}
+		input.MessageGroupId = aws.String(sqsMessageGroupID)
+		input.MessageDeduplicationId = aws.String(dedup)
+	}
+
+	sl.invokedType = lambda.InvocationTypeEvent
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	out, err := api.SendMessageWithContext(ctx, input)
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+	if err != nil {
+		return fmt.Errorf("SendMessage, %s: %w", t.queueURL, err)
+	}
+	sl.messageID = aws.StringValue(out.MessageId)
+	sl.correlator = newMessageCorrelator(sl.messageID)
+	sl.delivery = newSQSDelivery(correlationID, t.dlqURL, time.Now())
+	logger.Infof("the message %s is sent to %s. the invocation which logs the message id is taken as ours", sl.messageID, t.queueURL)
+	return nil
+}
+
+// noMatchError tells why no invocation was tied to the message
+func (sl *AWSServerless) noMatchError() error {
+	return &timeoutError{fmt.Errorf("no log line of %s mentions the message %s in %s after it is received: the event source mapping of %s may be disabled or not target the function, or the function does not log the message id",
+		sl.funcName, sl.messageID, sl.sqs.matchTimeout, sl.sqs.queueURL)}
+}
+
+// startSeen is START of an invocation in a log stream
+type startSeen struct {
+	requestID string
+	timestamp int64
+}
+
+// messageCorrelator finds the invocation of a message in the log lines. An event source mapping
+// invokes the function with a batch of messages, so ours is the invocation running in the stream
+// of the first line which mentions the message id, typically the logged event.
+type messageCorrelator struct {
+	messageID string
+	running   map[string]startSeen // by log stream
+}
+
+func newMessageCorrelator(messageID string) *messageCorrelator {
+	return &messageCorrelator{messageID: messageID, running: make(map[string]startSeen)}
+}
+
+// match returns START of our invocation when the line mentions the message id
+func (c *messageCorrelator) match(obs observation, stream, message string, timestamp int64) (startSeen, bool) {
+	switch obs.Kind {
+	case lifecycleStart:
+		c.running[stream] = startSeen{requestID: obs.RequestID, timestamp: timestamp}
+	case lifecycleEnd:
+		delete(c.running, stream)
+	case "":
+		if strings.Contains(message, c.messageID) {
+			s, ok := c.running[stream]
+			return s, ok
+		}
+	}
+	return startSeen{}, false
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeQueue is a queue with a redrive policy, whose DLQ holds the messages of dlq. Its depth is
+// each of depths in turn, the last one staying, or given by depth.
+type fakeQueue struct {
+	mu         sync.Mutex
+	policy     string
+	depths     [][2]int64 // visible and not visible
+	depth      func() [2]int64
+	depthErr   error
+	sent       *sqs.SendMessageInput
+	dlq        []*sqs.Message
+	visibility []int64 // VisibilityTimeout of each ReceiveMessage
+}
+
+func (f *fakeQueue) GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs := map[string]*string{}
+	if aws.StringValue(input.AttributeNames[0]) == sqs.QueueAttributeNameRedrivePolicy {
+		if f.policy != "" {
+			attrs[sqs.QueueAttributeNameRedrivePolicy] = aws.String(f.policy)
+		}
+		return &sqs.GetQueueAttributesOutput{Attributes: attrs}, nil
+	}
+	if f.depthErr != nil {
+		return nil, f.depthErr
+	}
+	if f.depth != nil {
+		f.depths = [][2]int64{f.depth()}
+	}
+	if len(f.depths) > 0 {
+		d := f.depths[0]
+		if len(f.depths) > 1 {
+			f.depths = f.depths[1:]
+		}
+		attrs[sqs.QueueAttributeNameApproximateNumberOfMessages] = aws.String(fmt.Sprint(d[0]))
+		attrs[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible] = aws.String(fmt.Sprint(d[1]))
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: attrs}, nil
+}
+
+func (f *fakeQueue) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/" + aws.StringValue(input.QueueOwnerAWSAccountId) + "/" + aws.StringValue(input.QueueName))}, nil
+}
+
+func (f *fakeQueue) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.sent = input
+	return &sqs.SendMessageOutput{MessageId: aws.String("m-1")}, nil
+}
+
+func (f *fakeQueue) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.visibility = append(f.visibility, aws.Int64Value(input.VisibilityTimeout))
+	return &sqs.ReceiveMessageOutput{Messages: f.dlq}, nil
+}
+
+func (f *fakeQueue) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return nil, errors.New("a message of the DLQ must not be deleted")
+}
+
+func TestSendMessage(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeQueue{policy: `{"deadLetterTargetArn":"arn:aws:sqs:us-east-1:123456789012:orders-dlq.fifo","maxReceiveCount":"3"}`}
+	target := &sqsTarget{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/orders.fifo", matchTimeout: time.Minute}
+	sl := &AWSServerless{funcName: "orders-fn", sqs: target, phases: newPhaseTracker(time.Now())}
+	if err := sl.sendMessage(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if target.dlqURL != "https://sqs.us-east-1.amazonaws.com/123456789012/orders-dlq.fifo" {
+		t.Errorf("got %s", target.dlqURL)
+	}
+	if s := api.sent; aws.StringValue(s.MessageBody) != "{}" || aws.StringValue(s.MessageGroupId) != sqsMessageGroupID || aws.StringValue(s.MessageDeduplicationId) == "" {
+		t.Errorf("got %v", s)
+	}
+	if sl.messageID != "m-1" || sl.invokedType != "Event" || sl.correlator == nil {
+		t.Errorf("got %s %s", sl.messageID, sl.invokedType)
+	}
+	attr := api.sent.MessageAttributes[sqsCorrelationAttribute]
+	if attr == nil || aws.StringValue(attr.StringValue) == "" || aws.StringValue(attr.StringValue) != sl.delivery.correlationID {
+		t.Errorf("got the message attributes %v", api.sent.MessageAttributes)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsEnqueued || d.DeadLetterQueue != target.dlqURL {
+		t.Errorf("got %+v", d)
+	}
+
+	api.policy = `{"deadLetterTargetArn":"orders-dlq"}`
+	if err := sl.sendMessage(context.Background(), api); err == nil || !strings.Contains(err.Error(), "deadLetterTargetArn") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLogTailSQS(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each invocation carries a batch, only the one in s2 logs our message
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": {"START RequestId: r1 Version: $LATEST", "r1\tINFO\tprocessing m-0", "END RequestId: r1", "REPORT RequestId: r1\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"},
+		"s2": {"START RequestId: r2 Version: $LATEST", `r2	INFO	{"messageId": "m-1"}`, "END RequestId: r2", "REPORT RequestId: r2\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"},
+	}}
+	sl := &AWSServerless{
+		funcName:   "orders-fn",
+		startTime:  time.Now(),
+		logClient:  logs,
+		emitter:    em,
+		bus:        newBus(),
+		summary:    newSummaryBuilder(),
+		phases:     newPhaseTracker(time.Now()),
+		via:        viaSQS,
+		sqs:        &sqsTarget{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/orders", matchTimeout: time.Minute},
+		messageID:  "m-1",
+		correlator: newMessageCorrelator("m-1"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sl.logTail(ctx, "/aws/lambda/orders-fn"); err != nil {
+		t.Fatal(err)
+	}
+	if sl.requestID != "r2" || sl.invocationState != stateReported {
+		t.Errorf("got %s %s", sl.requestID, sl.invocationState)
+	}
+
+	// no line mentions the message
+	sl.requestID, sl.correlator, sl.logClient = "", newMessageCorrelator("m-2"), quietLogs{}
+	sl.messageID, sl.sqs.matchTimeout, sl.limits = "m-2", 50*time.Millisecond, Limits{PollInterval: 10 * time.Millisecond}
+	if err := sl.logTail(ctx, "/aws/lambda/orders-fn"); err == nil || !strings.Contains(err.Error(), "does not log the message id") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// newQueueTail returns a tail of -via sqs of the message m-1, whose logs are quiet
+func newQueueTail(t *testing.T, target *sqsTarget) *AWSServerless {
+	t.Helper()
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := defaultLimits
+	limits.PollInterval = 10 * time.Millisecond
+	return &AWSServerless{
+		funcName:   "orders-fn",
+		startTime:  time.Now(),
+		logClient:  quietLogs{},
+		emitter:    em,
+		bus:        newBus(),
+		summary:    newSummaryBuilder(),
+		phases:     newPhaseTracker(time.Now()),
+		limits:     limits,
+		via:        viaSQS,
+		sqs:        target,
+		messageID:  "m-1",
+		correlator: newMessageCorrelator("m-1"),
+		delivery:   newSQSDelivery("c-1", target.dlqURL, time.Now()),
+	}
+}
+
+// tailQueue runs tailWatchingQueue, failing the test when it does not end in 5 seconds
+func tailQueue(t *testing.T, sl *AWSServerless, api sqsQueueAPI) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- sl.tailWatchingQueue(context.Background(), api) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tail does not stop")
+		return nil
+	}
+}
+
+func TestTailWatchingQueueRedrive(t *testing.T) {
+	setTestLogger(t)
+	dlqURL := "https://sqs.us-east-1.amazonaws.com/123456789012/orders-dlq"
+	correlation := func(id string) map[string]*sqs.MessageAttributeValue {
+		return map[string]*sqs.MessageAttributeValue{sqsCorrelationAttribute: {DataType: aws.String("String"), StringValue: aws.String(id)}}
+	}
+	api := &fakeQueue{depths: [][2]int64{{0, 1}}, dlq: []*sqs.Message{
+		{MessageId: aws.String("m-0"), ReceiptHandle: aws.String("h-0"), Body: aws.String(`{"id": 0}`), MessageAttributes: correlation("c-0")},
+		{MessageId: aws.String("m-9"), ReceiptHandle: aws.String("h-1"), Body: aws.String(`{"id": 1}`), MessageAttributes: correlation("c-1"),
+			Attributes: map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3")}},
+	}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/orders", matchTimeout: time.Minute, dlqURL: dlqURL})
+	err := tailQueue(t, sl, api)
+	var fe *functionError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), `redriven to the DLQ `+dlqURL+` after 3 receives: {"id": 1}`) {
+		t.Errorf("got %v", err)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsRedriven || d.ReceiveCount != 3 || d.QueueWait <= 0 {
+		t.Errorf("got %+v", d)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for _, v := range api.visibility {
+		if v != sqsPeekVisibility {
+			t.Errorf("the DLQ must be peeked, got the visibility timeouts %v", api.visibility)
+			break
+		}
+	}
+}
+
+func TestTailWatchingQueueEnqueuedTimeout(t *testing.T) {
+	setTestLogger(t)
+	api := &fakeQueue{depths: [][2]int64{{3, 0}}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", enqueuedTimeout: 50 * time.Millisecond, matchTimeout: 10 * time.Millisecond})
+	err := tailQueue(t, sl, api)
+	var te *timeoutError
+	if !errors.As(err, &te) || !strings.Contains(err.Error(), "is not received from https://sqs/orders in -sqs-enqueued-timeout 50ms, 3 messages are visible and 0 in flight") {
+		t.Errorf("got %v", err)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsEnqueued || d.Polls == 0 || d.Visible != 3 {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestTailWatchingQueuePhases(t *testing.T) {
+	setTestLogger(t)
+	// the function logs the message once it is in flight
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": {"START RequestId: r1 Version: $LATEST", `r1	INFO	{"messageId": "m-1"}`, "END RequestId: r1", "REPORT RequestId: r1\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"},
+	}}
+	api := &fakeQueue{depths: [][2]int64{{2, 0}, {2, 0}, {0, 1}, {0, 1}, {0, 0}}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", matchTimeout: time.Minute, consumedTimeout: 5 * time.Second})
+	sl.logClient = logs
+	if err := tailQueue(t, sl, api); err != nil {
+		t.Fatal(err)
+	}
+	if sl.requestID != "r1" {
+		t.Errorf("got %s", sl.requestID)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsConsumed || d.QueueWait <= 0 || d.InFlight <= 0 || d.Visible != 0 || d.NotVisible != 0 {
+		t.Errorf("got %+v", d)
+	}
+
+	// the message is never deleted
+	api = &fakeQueue{depths: [][2]int64{{0, 4}}}
+	sl = newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", matchTimeout: time.Minute, consumedTimeout: 50 * time.Millisecond})
+	sl.logClient = logs
+	err := tailQueue(t, sl, api)
+	var te *timeoutError
+	if !errors.As(err, &te) || !strings.Contains(err.Error(), "is not consumed in -sqs-consumed-timeout 50ms after the invocation: no poll of https://sqs/orders shows fewer messages in flight than before its END, 0 are visible and 4 in flight") {
+		t.Errorf("got %v", err)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsInFlight {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestTailWatchingQueueEmpty(t *testing.T) {
+	setTestLogger(t)
+	// the idle queue reads empty before the message is counted, and it is never found in the logs
+	api := &fakeQueue{depths: [][2]int64{{0, 0}}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", enqueuedTimeout: 50 * time.Millisecond, matchTimeout: time.Minute, consumedTimeout: time.Minute})
+	err := tailQueue(t, sl, api)
+	var te *timeoutError
+	if !errors.As(err, &te) || !strings.Contains(err.Error(), "the queue reads empty, so the message may have been received by an invocation of orders-fn which does not log the message id") {
+		t.Errorf("got %v", err)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsEnqueued || d.Polls == 0 {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestTailWatchingQueueBusy(t *testing.T) {
+	setTestLogger(t)
+	logs := &deniedLogs{streams: map[string][]string{
+		"s1": {"START RequestId: r1 Version: $LATEST", `r1	INFO	{"messageId": "m-1"}`, "END RequestId: r1", "REPORT RequestId: r1\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 10 MB"},
+	}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", matchTimeout: time.Minute, consumedTimeout: 5 * time.Second})
+	sl.logClient = logs
+	// other messages are always visible, and the batch of the message is deleted after its END
+	api := &fakeQueue{depth: func() [2]int64 {
+		sl.delivery.mu.Lock()
+		defer sl.delivery.mu.Unlock()
+		if sl.delivery.invokedAt.IsZero() {
+			return [2]int64{30, 6}
+		}
+		return [2]int64{31, 4}
+	}}
+	if err := tailQueue(t, sl, api); err != nil {
+		t.Fatal(err)
+	}
+	if d := sl.delivery.summary(); d.Phase != sqsConsumed || d.Visible != 31 || d.NotVisible != 4 {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestTailWatchingQueueMatchTimeout(t *testing.T) {
+	setTestLogger(t)
+	// the match timeout starts when the message is received, not when it is sent
+	api := &fakeQueue{depths: [][2]int64{{1, 0}, {1, 0}, {1, 0}, {1, 0}, {1, 0}, {1, 0}, {0, 1}}}
+	sl := newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", matchTimeout: 30 * time.Millisecond})
+	start := time.Now()
+	err := tailQueue(t, sl, api)
+	if err == nil || !strings.Contains(err.Error(), "does not log the message id") {
+		t.Fatalf("got %v", err)
+	}
+	inFlight, ok := sl.delivery.inFlightSince()
+	if !ok || inFlight.Sub(start) < 50*time.Millisecond {
+		t.Errorf("the message went in flight after %s", inFlight.Sub(start))
+	}
+
+	// without the depth, the message is taken as in flight
+	api = &fakeQueue{depthErr: errors.New("AccessDenied")}
+	sl = newQueueTail(t, &sqsTarget{queueURL: "https://sqs/orders", enqueuedTimeout: time.Hour, matchTimeout: 30 * time.Millisecond})
+	if err := tailQueue(t, sl, api); err == nil || !strings.Contains(err.Error(), "does not log the message id") {
+		t.Errorf("got %v", err)
+	}
+}
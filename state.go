@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// stateVersion is the version of the state file format
+const stateVersion = schema.StateVersion
+
+// stateFile is what is remembered across runs to save API calls
+type stateFile = schema.StateFile
+
+// localState is a local file of stateFile. Unlike the journal, losing it is harmless.
+type localState struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newLocalState(path string) *localState {
+	return &localState{path: path}
+}
+
+// defaultStatePath returns the default path of the state file
+func defaultStatePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".k8s-nodeless", "state.json")
+}
+
+// load returns the state. A missing file is an empty state.
+func (s *localState) load() (*stateFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+func (s *localState) loadLocked() (*stateFile, error) {
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &stateFile{Version: stateVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f stateFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, fmt.Errorf("state %s: %w", s.path, err)
+	}
+	if f.Version != stateVersion {
+		return nil, fmt.Errorf("state %s: unsupported version %d", s.path, f.Version)
+	}
+	return &f, nil
+}
+
+// update loads the state, applies fn and saves it
+func (s *localState) update(fn func(*stateFile)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.loadLocked()
+	if err != nil {
+		return err
+	}
+	fn(f)
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
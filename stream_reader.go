@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// strategyGetLogEvents reads each log stream by GetLogEvents, used when FilterLogEvents is denied
+const strategyGetLogEvents filterStrategy = "get-log-events"
+
+// isAccessDenied returns true if err is the denial of the API call by IAM
+func isAccessDenied(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == "AccessDeniedException" || awsErr.Code() == "AccessDenied")
+}
+
+// logEventHandler handles a log event of a stream
+type logEventHandler func(eventID, stream, message string, timestamp int64)
+
+// streamReader reads log streams by GetLogEvents, following the forward token of each stream
+type streamReader struct {
+	max    int                // max number of the most recently active streams read in a poll cycle
+	tokens map[string]*string // next forward token of each stream
+	seq    map[string]int     // number of events read from each stream, which makes the event id
+}
+
+func newStreamReader(max int) *streamReader {
+	return &streamReader{
+		max:    max,
+		tokens: make(map[string]*string),
+		seq:    make(map[string]int),
+	}
+}
+
+// poll reads new events of the streams, at most max of them from the head of streams,
+// and returns the latest ingestion time seen. A stream read for the first time is read from since.
+func (r *streamReader) poll(ctx context.Context, logs logsAPI, logGroupName string, streams []*string, since int64, handle logEventHandler) (int64, error) {
+	if len(streams) > r.max {
+		streams = streams[:r.max]
+	}
+	latest := since
+	for _, s := range streams {
+		stream := aws.StringValue(s)
+		for {
+			input := &cloudwatchlogs.GetLogEventsInput{
+				LogGroupName:  aws.String(logGroupName),
+				LogStreamName: aws.String(stream),
+				StartFromHead: aws.Bool(true),
+			}
+			token := r.tokens[stream]
+			if token != nil {
+				input.NextToken = token
+			} else {
+				input.StartTime = aws.Int64(since)
+			}
+			res, err := logs.GetLogEventsWithContext(ctx, input)
+			if err != nil {
+				return latest, err
+			}
+			for _, event := range res.Events {
+				r.seq[stream]++
+				handle(fmt.Sprintf("%s#%d", stream, r.seq[stream]), stream, aws.StringValue(event.Message), aws.Int64Value(event.Timestamp))
+				if t := aws.Int64Value(event.IngestionTime); t > latest {
+					latest = t
+				}
+			}
+			if res.NextForwardToken != nil {
+				r.tokens[stream] = res.NextForwardToken
+			}
+			// the same token is returned at the end of the stream
+			if len(res.Events) == 0 || res.NextForwardToken == nil || aws.StringValue(res.NextForwardToken) == aws.StringValue(token) {
+				break
+			}
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// errorLineRe matches a log line of the error level in the text or JSON format
+var errorLineRe = regexp.MustCompile(`\bERROR\b|"level"\s*:\s*"(?i:error)"`)
+
+// taskTimeoutRe matches the line Lambda logs when the function timed out
+var taskTimeoutRe = regexp.MustCompile(`Task timed out after ([0-9]+)(?:\.[0-9]+)? seconds`)
+
+// summaryBuilder is a subscriber which collects what the summary reports
+// from the lifecycle and REPORT events of our requests
+type summaryBuilder struct {
+	mu              sync.Mutex
+	logStreams      []string // log streams our requests wrote to
+	logStreamsStart int64    // the earliest timestamp in logStreams
+	reports         map[string]*reportMetrics
+	errorLines      int
+	timeout         string             // the timeout of the function if it timed out, ex: "900s"
+	restores        map[string]float64 // log stream to the restore duration of RESTORE_REPORT not followed by REPORT yet
+}
+
+func newSummaryBuilder() *summaryBuilder {
+	return &summaryBuilder{
+		reports:  make(map[string]*reportMetrics),
+		restores: make(map[string]float64),
+	}
+}
+
+func (s *summaryBuilder) handle(ev busEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e := ev.(type) {
+	case logEvent:
+		if !e.Foreign {
+			if errorLineRe.MatchString(e.Message) {
+				s.errorLines++
+			}
+			if m := taskTimeoutRe.FindStringSubmatch(e.Message); m != nil {
+				s.timeout = m[1] + "s"
+			}
+		}
+		if d, ok := parseRestoreReport(e.Message); ok && e.LogStream != "" {
+			s.restores[e.LogStream] = d
+		}
+	case lifecycleEvent:
+		s.addLogStream(e.LogStream, e.Timestamp)
+	case reportEvent:
+		m := e.Report
+		// the first request after a restore is a restore even if REPORT does not tell it
+		if d, ok := s.restores[e.LogStream]; ok {
+			if m.RestoreDuration == 0 {
+				m.RestoreDuration = d
+			}
+			delete(s.restores, e.LogStream)
+		}
+		s.reports[m.RequestID] = &m
+		s.addLogStream(e.LogStream, e.Timestamp)
+	}
+	return nil
+}
+
+// addLogStream remembers the log stream which our request wrote to. s.mu must be held.
+func (s *summaryBuilder) addLogStream(stream string, timestamp int64) {
+	if stream == "" {
+		return
+	}
+	if s.logStreamsStart == 0 || timestamp < s.logStreamsStart {
+		s.logStreamsStart = timestamp
+	}
+	for _, st := range s.logStreams {
+		if st == stream {
+			return
+		}
+	}
+	s.logStreams = append(s.logStreams, stream)
+}
+
+// streams returns the log streams and the earliest timestamp in them
+func (s *summaryBuilder) streams() ([]string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.logStreams...), s.logStreamsStart
+}
+
+// report returns REPORT of the request, or nil if it has not been seen
+func (s *summaryBuilder) report(requestID string) *reportMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reports[requestID]
+}
+
+// allReports returns REPORT of every request seen, sorted by request id
+func (s *summaryBuilder) allReports() []reportMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]reportMetrics, 0, len(s.reports))
+	for _, r := range s.reports {
+		ret = append(ret, *r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RequestID < ret[j].RequestID })
+	return ret
+}
+
+// errors returns the number of error log lines
+func (s *summaryBuilder) errors() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errorLines
+}
+
+// timedOut returns the timeout of the function, or "" if it did not time out
+func (s *summaryBuilder) timedOut() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeout
+}
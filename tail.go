@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// runTail runs the tail subcommand, which follows the log group of the function without invoking it.
+// There is no END of a request to stop on, so it runs until interrupted, -until or -idle-timeout.
+func runTail(args []string) error {
+	var funcName string
+	var since, until, idleTimeout time.Duration
+	var jsonFormat bool
+
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	fs.StringVar(&funcName, "func", "", "function name or ARN")
+	fs.DurationVar(&since, "since", 0, "print the logs from the duration ago, ex: 10m. 0 starts from now")
+	fs.DurationVar(&until, "until", 0, "stop after the duration, 0 for no limit")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 0, "stop when no new log event is printed for the duration, 0 for no limit")
+	fs.BoolVar(&jsonFormat, "json", false, "enable JSON log format")
+	network := addNetworkFlags(fs)
+	noCredsCache := addCredentialCacheFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	logger = NewLogger(&Config{json: jsonFormat})
+	defer logger.Sync()
+
+	if funcName == "" {
+		return &configError{fmt.Errorf("-func is required")}
+	}
+	if since < 0 || until < 0 || idleTimeout < 0 {
+		return &configError{fmt.Errorf("-since, -until and -idle-timeout must not be negative")}
+	}
+	ref, err := ParseFunctionRef(funcName)
+	if err != nil {
+		return &configError{err}
+	}
+	awsOpts, err := newAWSSessionOptions(ref.Region, *network, *noCredsCache)
+	if err != nil {
+		return &configError{err}
+	}
+	sess, err := session.NewSessionWithOptions(awsOpts)
+	if err != nil {
+		return fmt.Errorf("aws session error: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := cancelOnSignal(ctx, cancel)
+	defer stop()
+	if until > 0 {
+		ctx, cancel = context.WithTimeout(ctx, until)
+		defer cancel()
+	}
+
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		return err
+	}
+	s := newTailStreamer(cloudwatchlogs.New(sess), em, ref.LogGroup(), time.Now().Add(-since), idleTimeout)
+	logger.Infof("tailing %s from %s", ref.LogGroup(), msToTime(s.lastSeen).UTC().Format(time.RFC3339))
+	err = s.streamLogs(ctx)
+	logger.Infof("%s printed", plural(int(em.printedLines()), "log event"))
+	return err
+}
+
+// newTailStreamer returns a streamer which follows every request of the log group from the time
+func newTailStreamer(logs logsAPI, em *emitter, logGroupName string, from time.Time, idle time.Duration) *logStreamer {
+	return &logStreamer{
+		logs:         logs,
+		emitter:      em,
+		logGroupName: logGroupName,
+		follow:       true,
+		poll:         defaultLimits.PollInterval,
+		idle:         idle,
+		current:      map[string]string{},
+		lastSeen:     aws.TimeUnixMilli(from),
+	}
+}
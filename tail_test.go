@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTailStreamerIdle(t *testing.T) {
+	logs := setTestLogger(t)
+	now := time.Now()
+	group := &groupLogs{}
+	group.add("0", "s1", "before the tail", now.Add(-2*time.Minute))
+	group.add("1", "s1", "START RequestId: r-1 Version: $LATEST", now.Add(-30*time.Second))
+	group.add("2", "s1", "r-1 is processing", now.Add(-29*time.Second))
+	group.add("3", "s1", "END RequestId: r-1", now.Add(-28*time.Second))
+
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTailStreamer(group, em, "/aws/lambda/orders-fn", now.Add(-time.Minute), 50*time.Millisecond)
+	s.poll = 5 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() { done <- s.streamLogs(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tail does not stop when it is idle")
+	}
+	if em.printedLines() != 3 || logs.FilterMessageSnippet("before the tail").Len() != 0 {
+		t.Errorf("%d lines printed: %v", em.printedLines(), logs.All())
+	}
+	if l := logs.FilterMessageSnippet("is processing").All(); len(l) != 1 || l[0].ContextMap()["request_id"] != "r-1" {
+		t.Errorf("the line is not tagged by its request: %v", l)
+	}
+	if logs.FilterMessageSnippet("no new log event in 50ms").Len() != 1 {
+		t.Errorf("the idle stop is not logged")
+	}
+}
+
+func TestTailStreamerCancel(t *testing.T) {
+	setTestLogger(t)
+	em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTailStreamer(&groupLogs{}, em, "/aws/lambda/orders-fn", time.Now(), 0)
+	s.poll = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := s.streamLogs(ctx); err != nil {
+		t.Errorf("streamLogs() error = %v, want nil at the end of -until", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+// terminalWidth returns false, the size of a terminal is not known on this platform
+func terminalWidth(f *os.File) (int, bool) {
+	return 0, false
+}
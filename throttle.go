@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// logsOperation is a family of CloudWatch Logs calls of the tail
+type logsOperation string
+
+const (
+	opDiscoverStreams logsOperation = "DescribeLogStreams"
+	opFetchEvents     logsOperation = "FilterLogEvents" // GetLogEvents of the fallback too
+)
+
+// isThrottling returns true if err is the throttling of CloudWatch Logs
+func isThrottling(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "ThrottlingException"
+}
+
+// throttleController coordinates the backoff of the calls to a logs client. The TPS limit of
+// CloudWatch Logs is shared by the account, so a throttling of either operation cools both down,
+// instead of each backing off alone and spending the budget the other needs. Once our request is
+// being tracked, fetching events has priority: stream discovery may lag, event fetching can not.
+type throttleController struct {
+	mu  sync.Mutex
+	now func() time.Time
+
+	minCoolDown    time.Duration
+	maxCoolDown    time.Duration
+	coolDown       time.Duration // length of the current cool-down, doubled by each throttling
+	until          time.Time     // end of the current cool-down
+	prioritized    bool          // events are fetched before streams are discovered
+	throttledTotal int
+	waitedTotal    time.Duration
+}
+
+// newThrottleController returns a controller whose cool-downs start at the ThrottleCoolDown of
+// limits and are doubled up to its MaxCoolDown
+func newThrottleController(now func() time.Time, limits Limits) *throttleController {
+	return &throttleController{now: now, minCoolDown: limits.ThrottleCoolDown, maxCoolDown: limits.MaxCoolDown}
+}
+
+// prioritizeEvents gives event fetching priority over stream discovery
+func (c *throttleController) prioritizeEvents(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prioritized = on
+}
+
+// wait returns how long op must wait before it is called. With priority, discovery waits
+// for another cool-down after event fetching is allowed, so the first slot goes to the events.
+func (c *throttleController) wait(op logsOperation) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.until.Sub(c.now())
+	if op == opDiscoverStreams && c.prioritized {
+		d += c.coolDown
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// sleep waits before a call of op, and adds the wait to the total
+func (c *throttleController) sleep(ctx context.Context, op logsOperation) error {
+	d := c.wait(op)
+	c.mu.Lock()
+	c.waitedTotal += d
+	c.mu.Unlock()
+	return sleepContext(ctx, d)
+}
+
+// skipDiscovery returns true if the streams should not be discovered now but the streams
+// already known be used, because the events have priority during a cool-down
+func (c *throttleController) skipDiscovery() bool {
+	return c.wait(opDiscoverStreams) > 0 && c.isPrioritized()
+}
+
+func (c *throttleController) isPrioritized() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prioritized
+}
+
+// observe records the result of a call of op. A throttling starts or extends the cool-down
+// of both operations, and a success shortens the next one.
+func (c *throttleController) observe(op logsOperation, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isThrottling(err) {
+		c.throttledTotal++
+		c.coolDown *= 2
+		if c.coolDown < c.minCoolDown {
+			c.coolDown = c.minCoolDown
+		}
+		if c.coolDown > c.maxCoolDown {
+			c.coolDown = c.maxCoolDown
+		}
+		if until := c.now().Add(c.coolDown); until.After(c.until) {
+			c.until = until
+		}
+		return
+	}
+	if err == nil {
+		c.coolDown /= 2
+		if c.coolDown < c.minCoolDown {
+			c.coolDown = 0
+		}
+	}
+}
+
+// waited returns how long the calls waited for the cool-downs in total
+func (c *throttleController) waited() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waitedTotal
+}
+
+// throttled returns the number of throttled calls observed
+func (c *throttleController) throttled() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.throttledTotal
+}
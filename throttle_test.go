@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// simClock is a clock which only moves by sleep
+type simClock struct {
+	t time.Time
+}
+
+func (c *simClock) now() time.Time { return c.t }
+
+func (c *simClock) sleep(d time.Duration) { c.t = c.t.Add(d) }
+
+var errThrottled = awserr.New("ThrottlingException", "Rate exceeded", nil)
+
+func TestThrottleControllerSharedCoolDown(t *testing.T) {
+	clock := &simClock{t: time.Unix(0, 0)}
+	c := newThrottleController(clock.now, defaultLimits)
+
+	if c.wait(opDiscoverStreams) != 0 || c.wait(opFetchEvents) != 0 {
+		t.Fatal("no wait before throttling")
+	}
+	c.observe(opDiscoverStreams, errThrottled)
+	if got := c.wait(opFetchEvents); got != defaultLimits.ThrottleCoolDown {
+		t.Errorf("a throttled discovery must cool event fetching down too, got %s", got)
+	}
+	c.observe(opFetchEvents, errThrottled)
+	if got := c.wait(opDiscoverStreams); got != 2*defaultLimits.ThrottleCoolDown {
+		t.Errorf("consecutive throttling doubles the cool-down, got %s", got)
+	}
+	for i := 0; i < 10; i++ {
+		c.observe(opFetchEvents, errThrottled)
+	}
+	if got := c.wait(opFetchEvents); got != defaultLimits.MaxCoolDown {
+		t.Errorf("got %s", got)
+	}
+	if c.throttled() != 12 {
+		t.Errorf("got %d", c.throttled())
+	}
+
+	clock.sleep(defaultLimits.MaxCoolDown)
+	if c.wait(opFetchEvents) != 0 {
+		t.Errorf("the cool-down must be over")
+	}
+	// successes shorten the next cool-down
+	c.observe(opFetchEvents, nil)
+	c.observe(opFetchEvents, nil)
+	c.observe(opFetchEvents, errThrottled)
+	if got := c.wait(opFetchEvents); got != defaultLimits.MaxCoolDown/2 {
+		t.Errorf("got %s", got)
+	}
+	clock.sleep(defaultLimits.MaxCoolDown)
+	for i := 0; i < 10; i++ {
+		c.observe(opDiscoverStreams, nil)
+	}
+	c.observe(opDiscoverStreams, errThrottled)
+	if got := c.wait(opFetchEvents); got != defaultLimits.ThrottleCoolDown {
+		t.Errorf("got %s", got)
+	}
+
+	// other errors are not throttling
+	clock.sleep(defaultLimits.MaxCoolDown)
+	c.observe(opFetchEvents, awserr.New("ResourceNotFoundException", "", nil))
+	if c.wait(opFetchEvents) != 0 {
+		t.Errorf("got %s", c.wait(opFetchEvents))
+	}
+}
+
+func TestThrottleControllerPriority(t *testing.T) {
+	clock := &simClock{t: time.Unix(0, 0)}
+	c := newThrottleController(clock.now, defaultLimits)
+	c.observe(opFetchEvents, errThrottled)
+	if c.skipDiscovery() {
+		t.Errorf("discovery is not skipped before the request is tracked")
+	}
+	if c.wait(opDiscoverStreams) != c.wait(opFetchEvents) {
+		t.Errorf("both wait the same without priority")
+	}
+
+	c.prioritizeEvents(true)
+	if !c.skipDiscovery() {
+		t.Errorf("discovery must yield during a cool-down")
+	}
+	clock.sleep(defaultLimits.ThrottleCoolDown)
+	if c.wait(opFetchEvents) != 0 {
+		t.Errorf("events are fetched as soon as the cool-down is over")
+	}
+	if got := c.wait(opDiscoverStreams); got != defaultLimits.ThrottleCoolDown {
+		t.Errorf("discovery waits for another cool-down, got %s", got)
+	}
+	c.observe(opFetchEvents, nil)
+	if c.skipDiscovery() {
+		t.Errorf("a success ends the priority")
+	}
+}
+
+// tokenServer is a fake CloudWatch Logs whose TPS limit is shared by both operations. Every call
+// is throttled in the outage, and then a call is admitted every interval, as other clients of
+// the account use the rest of the limit.
+type tokenServer struct {
+	clock     *simClock
+	outageEnd time.Time
+	interval  time.Duration
+	next      time.Time
+	calls     int
+}
+
+func (s *tokenServer) call() error {
+	s.calls++
+	now := s.clock.now()
+	if now.Before(s.outageEnd) || now.Before(s.next) {
+		return errThrottled
+	}
+	s.next = now.Add(s.interval)
+	return nil
+}
+
+// backoffPolicy is how the tail backs off
+type backoffPolicy interface {
+	wait(op logsOperation) time.Duration
+	skipDiscovery() bool
+	observe(op logsOperation, err error)
+}
+
+// independentBackoff backs each operation off alone, as the tail did before throttleController
+type independentBackoff struct {
+	clock *simClock
+	ops   map[logsOperation]*throttleController
+}
+
+func (b *independentBackoff) controller(op logsOperation) *throttleController {
+	if b.ops[op] == nil {
+		b.ops[op] = newThrottleController(b.clock.now, defaultLimits)
+	}
+	return b.ops[op]
+}
+
+func (b *independentBackoff) wait(op logsOperation) time.Duration { return b.controller(op).wait(op) }
+func (b *independentBackoff) skipDiscovery() bool                 { return false }
+func (b *independentBackoff) observe(op logsOperation, err error) { b.controller(op).observe(op, err) }
+
+// simulateTail runs the poll cycles of the tail, which knows the streams of our request, and
+// returns how long it takes until events are fetched again, or 0 if they are not in 10 minutes
+func simulateTail(p backoffPolicy, clock *simClock, server *tokenServer) time.Duration {
+	start := clock.now()
+	for clock.now().Sub(start) < 10*time.Minute {
+		clock.sleep(defaultLimits.PollInterval)
+		if !p.skipDiscovery() {
+			clock.sleep(p.wait(opDiscoverStreams))
+			err := server.call()
+			p.observe(opDiscoverStreams, err)
+			if err != nil {
+				continue
+			}
+		}
+		clock.sleep(p.wait(opFetchEvents))
+		err := server.call()
+		p.observe(opFetchEvents, err)
+		if err == nil {
+			return clock.now().Sub(start)
+		}
+	}
+	return 0
+}
+
+func TestThrottleRecovery(t *testing.T) {
+	for _, outage := range []time.Duration{5 * time.Second, 20 * time.Second, time.Minute} {
+		run := func(newPolicy func(*simClock) backoffPolicy) (time.Duration, int) {
+			clock := &simClock{t: time.Unix(0, 0)}
+			server := &tokenServer{clock: clock, outageEnd: clock.now().Add(outage), interval: 2 * time.Second}
+			return simulateTail(newPolicy(clock), clock, server), server.calls
+		}
+		independent, independentCalls := run(func(clock *simClock) backoffPolicy {
+			return &independentBackoff{clock: clock, ops: make(map[logsOperation]*throttleController)}
+		})
+		shared, sharedCalls := run(func(clock *simClock) backoffPolicy {
+			c := newThrottleController(clock.now, defaultLimits)
+			c.prioritizeEvents(true)
+			return c
+		})
+		t.Logf("outage %s: shared recovers in %s with %d calls, independent in %s with %d calls",
+			outage, shared, sharedCalls, independent, independentCalls)
+		if shared == 0 {
+			t.Fatalf("outage %s: shared never recovers", outage)
+		}
+		if sharedCalls > independentCalls {
+			t.Errorf("outage %s: shared must not call more, %d > %d", outage, sharedCalls, independentCalls)
+		}
+		// discovery may take every admitted call from event fetching forever
+		if independent != 0 && shared >= independent {
+			t.Errorf("outage %s: shared %s must recover faster than independent %s", outage, shared, independent)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	timelineBurstGap     = 100 * time.Millisecond // lines closer than this are a burst
+	timelineDefaultWidth = 80                     // when the output is not a terminal
+	timelineLabelWidth   = 13
+	timelineValueWidth   = 9
+	timelineMinColumns   = 10
+)
+
+// timelineLabels are the labels of the bars in the drawing
+var timelineLabels = map[string]string{
+	"queue_wait":    "queue wait",
+	"init":          "init",
+	"restore":       "restore",
+	"execution":     "execution",
+	"ingestion_lag": "ingestion lag",
+}
+
+// timelineLevels are the heights of the columns of the log row, by the lines in a column
+var timelineLevels = []rune("▁▂▃▄▅▆▇█")
+
+// logTimes is a subscriber which records the timestamps of the log lines for -timeline
+type logTimes struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (l *logTimes) handle(ev busEvent) error {
+	if e, ok := ev.(logEvent); ok {
+		l.mu.Lock()
+		l.times = append(l.times, msToTime(e.Timestamp))
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+func (l *logTimes) snapshot() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.times...)
+}
+
+// buildTimeline places the phases and the log lines of a run on an axis from the invocation to
+// the completion. The init or restore of the report is taken out of the queue wait before the
+// START line. It returns false if the function was not invoked.
+func buildTimeline(p *phaseTracker, report *reportMetrics, lines []time.Time) (schema.Timeline, bool) {
+	ret := schema.Timeline{SchemaVersion: schema.TimelineVersion, Bars: []schema.TimelineBar{}, LogBursts: []schema.TimelineBurst{}}
+	origin, ok := p.at(transitionInvokeStart)
+	if !ok {
+		return ret, false
+	}
+	end, ok := p.at(transitionEndObserved)
+	if !ok {
+		end, _ = p.at(transitionRunEnd)
+	}
+	offset := func(t time.Time) time.Duration {
+		if d := t.Sub(origin); d > 0 {
+			return d
+		}
+		return 0
+	}
+	ret.Span = offset(end)
+	bar := func(name string, from, to time.Time) {
+		start, stop := offset(from), offset(to)
+		if stop <= start {
+			return
+		}
+		ret.Bars = append(ret.Bars, schema.TimelineBar{Name: name, Start: start, Duration: stop - start})
+		if stop > ret.Span {
+			ret.Span = stop
+		}
+	}
+
+	if started, ok := p.at(transitionStarted); ok {
+		booted, boot, bootName := started, time.Duration(0), ""
+		if report != nil {
+			bootName, boot = "init", time.Duration(report.InitDuration*float64(time.Millisecond))
+			if report.RestoreDuration > 0 {
+				bootName, boot = "restore", time.Duration(report.RestoreDuration*float64(time.Millisecond))
+			}
+			booted = started.Add(-boot)
+		}
+		if invoked, ok := p.at(transitionInvokeEnd); ok {
+			bar("queue_wait", invoked, booted)
+		}
+		if boot > 0 {
+			bar(bootName, booted, started)
+		}
+		if ended, ok := p.at(transitionEnded); ok {
+			bar("execution", started, ended)
+			if observed, ok := p.at(transitionEndObserved); ok {
+				bar("ingestion_lag", ended, observed)
+			}
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Before(lines[j]) })
+	for i, t := range lines {
+		n := len(ret.LogBursts)
+		if i > 0 && t.Sub(lines[i-1]) < timelineBurstGap {
+			b := &ret.LogBursts[n-1]
+			b.Duration = offset(t) - b.Start
+			b.Lines++
+			continue
+		}
+		ret.LogBursts = append(ret.LogBursts, schema.TimelineBurst{Start: offset(t), Lines: 1})
+	}
+	for _, b := range ret.LogBursts {
+		if e := b.Start + b.Duration; e > ret.Span {
+			ret.Span = e
+		}
+	}
+	return ret, true
+}
+
+// renderTimeline draws the timeline in the width: a row of each phase and a row of the log lines
+// per column, on a scaled axis
+func renderTimeline(tl schema.Timeline, width int) string {
+	cols := width - timelineLabelWidth - 3 - timelineValueWidth
+	if cols < timelineMinColumns {
+		cols = timelineMinColumns
+	}
+	span := tl.Span
+	if span <= 0 {
+		span = time.Millisecond
+	}
+	// column returns the column of the offset
+	column := func(d time.Duration) int {
+		c := int(int64(d) * int64(cols) / int64(span))
+		if c >= cols {
+			c = cols - 1
+		}
+		return c
+	}
+
+	var sb strings.Builder
+	row := func(label string, cells []rune, value string) {
+		fmt.Fprintf(&sb, "%-*s │%s│ %s\n", timelineLabelWidth, label, string(cells), value)
+	}
+	for _, b := range tl.Bars {
+		cells := []rune(strings.Repeat(" ", cols))
+		from, to := column(b.Start), column(b.Start+b.Duration-1)
+		for c := from; c <= to; c++ {
+			cells[c] = '█'
+		}
+		label := timelineLabels[b.Name]
+		if label == "" {
+			label = b.Name
+		}
+		row(label, cells, formatSpan(b.Duration))
+	}
+
+	counts := make([]int, cols)
+	lines, peak := 0, 0
+	for _, b := range tl.LogBursts {
+		// the lines of a burst are spread over its columns
+		from, to := column(b.Start), column(b.Start+b.Duration)
+		for i := 0; i < b.Lines; i++ {
+			c := from + i*(to-from+1)/b.Lines
+			counts[c]++
+			if counts[c] > peak {
+				peak = counts[c]
+			}
+		}
+		lines += b.Lines
+	}
+	cells := []rune(strings.Repeat(" ", cols))
+	for c, n := range counts {
+		if n > 0 {
+			cells[c] = timelineLevels[(n*len(timelineLevels)-1)/peak]
+		}
+	}
+	row("logs", cells, plural(lines, "line"))
+
+	end := formatSpan(tl.Span)
+	fmt.Fprintf(&sb, "%*s0%*s\n", timelineLabelWidth+2, "", cols-1, end)
+	return sb.String()
+}
+
+// formatSpan formats a duration of the timeline, in milliseconds under a second
+func formatSpan(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// printTimeline prints the timeline after a run, as a drawing as wide as the terminal, or as a
+// record in the JSON log format
+func printTimeline(tl schema.Timeline, json bool) {
+	if json {
+		logger.Infow("timeline", recordFields(tl)...)
+		return
+	}
+	width, ok := terminalWidth(os.Stdout)
+	if !ok {
+		width = timelineDefaultWidth
+	}
+	fmt.Fprint(os.Stdout, renderTimeline(tl, width))
+}
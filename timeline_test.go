@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// testPhases returns a run invoked at 0 which starts at queueMs, ends at endMs and whose END is
+// observed at observedMs. A negative time is not marked.
+func testPhases(queueMs, endMs, observedMs int) (*phaseTracker, func(int) time.Time) {
+	base := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	p := newPhaseTracker(base)
+	p.mark(transitionInvokeStart, at(0))
+	p.mark(transitionInvokeEnd, at(50))
+	if queueMs >= 0 {
+		p.mark(transitionStarted, at(queueMs))
+	}
+	if endMs >= 0 {
+		p.mark(transitionEnded, at(endMs))
+	}
+	if observedMs >= 0 {
+		p.mark(transitionEndObserved, at(observedMs))
+	}
+	p.mark(transitionRunEnd, at(observedMs+100))
+	return p, at
+}
+
+func TestBuildTimeline(t *testing.T) {
+	p, at := testPhases(1300, 1500, 4500)
+	lines := []time.Time{at(1350), at(1310), at(1400), at(1600)}
+	tl, ok := buildTimeline(p, &reportMetrics{InitDuration: 250}, lines)
+	if !ok {
+		t.Fatal("no timeline")
+	}
+	want := []schema.TimelineBar{
+		{Name: "queue_wait", Start: 50 * time.Millisecond, Duration: 1000 * time.Millisecond},
+		{Name: "init", Start: 1050 * time.Millisecond, Duration: 250 * time.Millisecond},
+		{Name: "execution", Start: 1300 * time.Millisecond, Duration: 200 * time.Millisecond},
+		{Name: "ingestion_lag", Start: 1500 * time.Millisecond, Duration: 3000 * time.Millisecond},
+	}
+	if len(tl.Bars) != len(want) {
+		t.Fatalf("got %+v", tl.Bars)
+	}
+	for i := range want {
+		if tl.Bars[i] != want[i] {
+			t.Errorf("got %+v, want %+v", tl.Bars[i], want[i])
+		}
+	}
+	// 1310, 1350 and 1400 are a burst, 1600 is another
+	if len(tl.LogBursts) != 2 || tl.LogBursts[0].Lines != 3 || tl.LogBursts[0].Duration != 90*time.Millisecond || tl.LogBursts[1].Start != 1600*time.Millisecond {
+		t.Errorf("got %+v", tl.LogBursts)
+	}
+	if tl.Span != 4500*time.Millisecond {
+		t.Errorf("got %v", tl.Span)
+	}
+
+	p = newPhaseTracker(time.Now())
+	if _, ok := buildTimeline(p, nil, nil); ok {
+		t.Error("a run without an invocation has no timeline")
+	}
+}
+
+func TestRenderTimelineGolden(t *testing.T) {
+	burst := func(p *phaseTracker, at func(int) time.Time, from, n int) []time.Time {
+		var ret []time.Time
+		for i := 0; i < n; i++ {
+			ret = append(ret, at(from+i*10))
+		}
+		return ret
+	}
+	tests := []struct {
+		name  string
+		width int
+		build func() schema.Timeline
+	}{
+		{"cold_start", 80, func() schema.Timeline {
+			p, at := testPhases(1300, 2500, 5500)
+			lines := append(burst(p, at, 1310, 12), burst(p, at, 2400, 3)...)
+			tl, _ := buildTimeline(p, &reportMetrics{InitDuration: 800}, lines)
+			return tl
+		}},
+		{"snapstart_wide", 120, func() schema.Timeline {
+			p, at := testPhases(400, 900, 2100)
+			tl, _ := buildTimeline(p, &reportMetrics{RestoreDuration: 150}, burst(p, at, 450, 5))
+			return tl
+		}},
+		// no START nor END is seen, as when the logging is off
+		{"no_logs_narrow", 20, func() schema.Timeline {
+			p, _ := testPhases(-1, -1, -1)
+			tl, _ := buildTimeline(p, nil, nil)
+			return tl
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderTimeline(tt.build(), tt.width)
+			golden := filepath.Join("testdata", "timeline", tt.name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestPrintTimelineJSON(t *testing.T) {
+	logs := setTestLogger(t)
+	p, at := testPhases(300, 500, 900)
+	tl, _ := buildTimeline(p, nil, []time.Time{at(310)})
+	printTimeline(tl, true)
+	if logs.FilterMessage("timeline").Len() != 1 {
+		t.Errorf("got %v", logs.All())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+var startRequestRe = regexp.MustCompile("START RequestId: (.+) Version:")
+var endRequestRe = regexp.MustCompile("END RequestId: (.+)")
+
+// invocationState is a state of an invocation observed in the logs
+type invocationState int
+
+const (
+	statePending   invocationState = iota // waiting for START
+	stateStarted                          // START is observed
+	stateEnded                            // END is observed, REPORT may follow
+	stateReported                         // END and REPORT are observed
+	stateTimedOut                         // the tail gave up before END
+	stateAbandoned                        // the tail is cancelled before END
+)
+
+var invocationStateNames = []string{"Pending", "Started", "Ended", "Reported", "TimedOut", "Abandoned"}
+
+func (s invocationState) String() string {
+	if int(s) < len(invocationStateNames) {
+		return invocationStateNames[s]
+	}
+	return "Unknown"
+}
+
+// trackerDecision tells the tail what to do next
+type trackerDecision int
+
+const (
+	decisionContinue    trackerDecision = iota // keep tailing
+	decisionAwaitReport                        // END is observed, tail a little more for REPORT
+	decisionComplete                           // stop tailing
+)
+
+// lifecycle kinds of a log line
+const (
+	lifecycleStart  = "START"
+	lifecycleEnd    = "END"
+	lifecycleReport = "REPORT"
+)
+
+// observation is what the tracker found in a log line
+type observation struct {
+	Kind      string // lifecycleStart, lifecycleEnd or lifecycleReport, or "" if the line is not a lifecycle line
+	RequestID string
+	Foreign   bool // the line is of another request
+	Duplicate bool // the lifecycle line of our request was already observed
+	Report    *reportMetrics
+	Decision  trackerDecision
+}
+
+// requestTracker is what the tail asks of the tracker of its invocations
+type requestTracker interface {
+	// ObserveLine feeds a log line of the stream
+	ObserveLine(stream, message string) observation
+	// LineRequestID returns the request which the last line of the stream belongs to
+	LineRequestID(stream string) string
+	RequestID() string
+	State() invocationState
+	Abandon()
+	decision() trackerDecision
+}
+
+// InvocationTracker follows the lifecycle of our invocation in the log lines fed one at a time.
+// If the request id is not known, the first START decides it, or Adopt for an adopting tracker.
+type InvocationTracker struct {
+	requestID string
+	adopting  bool // the request is decided by Adopt instead of the first START
+	state     invocationState
+	report    *reportMetrics
+	running   map[string]bool // log streams whose last START is ours
+}
+
+// NewInvocationTracker returns a tracker of the request. requestID can be empty.
+func NewInvocationTracker(requestID string) *InvocationTracker {
+	return &InvocationTracker{requestID: requestID, running: make(map[string]bool)}
+}
+
+// NewAdoptingTracker returns a tracker whose request is decided by Adopt
+func NewAdoptingTracker() *InvocationTracker {
+	return &InvocationTracker{adopting: true, running: make(map[string]bool)}
+}
+
+// Adopt decides the request, whose START was already fed in the stream. It has no effect once the request is known.
+func (t *InvocationTracker) Adopt(stream, requestID string) {
+	if t.requestID != "" || t.state != statePending {
+		return
+	}
+	t.requestID = requestID
+	t.state = stateStarted
+	t.running[stream] = true
+}
+
+// RequestID returns the request id of our invocation, or "" if not known yet
+func (t *InvocationTracker) RequestID() string {
+	return t.requestID
+}
+
+// State returns the current state
+func (t *InvocationTracker) State() invocationState {
+	return t.state
+}
+
+// Report returns REPORT of our invocation, or nil if not observed
+func (t *InvocationTracker) Report() *reportMetrics {
+	return t.report
+}
+
+// Observe feeds a log line
+func (t *InvocationTracker) Observe(message string) observation {
+	return t.ObserveLine("", message)
+}
+
+// ObserveLine feeds a log line of the stream. A log stream runs one invocation at a time, so a line
+// belongs to our request from its START until the next START in the stream.
+func (t *InvocationTracker) ObserveLine(stream, message string) observation {
+	kind, requestID, report := parseLifecycle(message)
+	if kind == "" {
+		return observation{Decision: t.decision()}
+	}
+	if t.requestID == "" && kind == lifecycleStart && !t.adopting {
+		t.requestID = requestID
+	}
+	if kind == lifecycleStart {
+		t.running[stream] = requestID != "" && requestID == t.requestID
+	}
+	obs := observation{Kind: kind, RequestID: requestID}
+	if requestID != t.requestID {
+		obs.Foreign = true
+		obs.Decision = t.decision()
+		return obs
+	}
+	if t.state == stateTimedOut || t.state == stateAbandoned {
+		obs.Decision = t.decision()
+		return obs
+	}
+
+	switch kind {
+	case lifecycleStart:
+		if t.state == statePending {
+			t.state = stateStarted
+		} else {
+			obs.Duplicate = true
+		}
+	case lifecycleEnd:
+		switch {
+		case t.state >= stateEnded:
+			obs.Duplicate = true
+		case t.report != nil: // REPORT was observed before END
+			t.state = stateReported
+		default:
+			t.state = stateEnded
+		}
+	case lifecycleReport:
+		if t.report != nil {
+			obs.Duplicate = true
+			break
+		}
+		t.report = report
+		obs.Report = report
+		if t.state == stateEnded {
+			t.state = stateReported
+		}
+	}
+	obs.Decision = t.decision()
+	return obs
+}
+
+// LineRequestID returns our request if it is running in the stream, "" otherwise
+func (t *InvocationTracker) LineRequestID(stream string) string {
+	if !t.running[stream] {
+		return ""
+	}
+	return t.requestID
+}
+
+// Timeout tells the tracker that the tail gave up. It has no effect after END.
+func (t *InvocationTracker) Timeout() {
+	if t.state < stateEnded {
+		t.state = stateTimedOut
+	}
+}
+
+// Abandon tells the tracker that the tail is cancelled. It has no effect after END.
+func (t *InvocationTracker) Abandon() {
+	if t.state < stateEnded {
+		t.state = stateAbandoned
+	}
+}
+
+func (t *InvocationTracker) decision() trackerDecision {
+	switch t.state {
+	case stateEnded:
+		return decisionAwaitReport
+	case stateReported, stateTimedOut, stateAbandoned:
+		return decisionComplete
+	}
+	return decisionContinue
+}
+
+// platformRecord is a lifecycle line in the JSON log format
+type platformRecord struct {
+	Type   string `json:"type"`
+	Record struct {
+		RequestID string `json:"requestId"`
+		Version   string `json:"version"` // of platform.start
+		Metrics   struct {
+			DurationMs       float64 `json:"durationMs"`
+			BilledDurationMs float64 `json:"billedDurationMs"`
+			MemorySizeMB     float64 `json:"memorySizeMB"`
+			MaxMemoryUsedMB  float64 `json:"maxMemoryUsedMB"`
+			InitDurationMs   float64 `json:"initDurationMs"`
+
+			RestoreDurationMs       float64 `json:"restoreDurationMs"`
+			BilledRestoreDurationMs float64 `json:"billedRestoreDurationMs"`
+		} `json:"metrics"`
+	} `json:"record"`
+}
+
+// parseLifecycle returns the lifecycle kind and the request id of the line, and REPORT if the line is REPORT
+func parseLifecycle(message string) (string, string, *reportMetrics) {
+	if strings.HasPrefix(message, `{"time":`) {
+		return parsePlatformRecord(message)
+	}
+	if m := startRequestRe.FindStringSubmatch(message); len(m) == 2 {
+		return lifecycleStart, m[1], nil
+	}
+	if m := endRequestRe.FindStringSubmatch(message); len(m) == 2 {
+		return lifecycleEnd, strings.TrimSpace(m[1]), nil
+	}
+	if r, ok := parseReport(message); ok {
+		return lifecycleReport, r.RequestID, &r
+	}
+	return "", "", nil
+}
+
+func parsePlatformRecord(message string) (string, string, *reportMetrics) {
+	var rec platformRecord
+	if err := json.Unmarshal([]byte(message), &rec); err != nil || rec.Record.RequestID == "" {
+		return "", "", nil
+	}
+	switch rec.Type {
+	case "platform.start":
+		return lifecycleStart, rec.Record.RequestID, nil
+	case "platform.runtimeDone":
+		return lifecycleEnd, rec.Record.RequestID, nil
+	case "platform.report":
+		m := rec.Record.Metrics
+		return lifecycleReport, rec.Record.RequestID, &reportMetrics{
+			RequestID:      rec.Record.RequestID,
+			Duration:       m.DurationMs,
+			BilledDuration: m.BilledDurationMs,
+			MemorySize:     m.MemorySizeMB,
+			MaxMemoryUsed:  m.MaxMemoryUsedMB,
+			InitDuration:   m.InitDurationMs,
+			ColdStart:      m.InitDurationMs > 0,
+
+			RestoreDuration:       m.RestoreDurationMs,
+			BilledRestoreDuration: m.BilledRestoreDurationMs,
+		}
+	}
+	return "", "", nil
+}
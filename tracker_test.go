@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+)
+
+const (
+	ourID     = "2e3c63b7-0681-4e60-9767-b025b0714db1"
+	foreignID = "9f1c0000-0000-4000-8000-000000000000"
+)
+
+func TestInvocationTracker(t *testing.T) {
+	start := func(id string) string { return "START RequestId: " + id + " Version: $LATEST" }
+	end := func(id string) string { return "END RequestId: " + id }
+	report := func(id string) string {
+		return "REPORT RequestId: " + id + "\tDuration: 1.85 ms\tBilled Duration: 2 ms\tMemory Size: 128 MB\tMax Memory Used: 64 MB"
+	}
+
+	tests := []struct {
+		name      string
+		requestID string
+		lines     []string
+		want      invocationState
+		decision  trackerDecision
+		gotReport bool
+	}{
+		{"normal", ourID, []string{start(ourID), "hello", end(ourID), report(ourID)}, stateReported, decisionComplete, true},
+		{"report is not yet observed", ourID, []string{start(ourID), end(ourID)}, stateEnded, decisionAwaitReport, false},
+		{"report before end", ourID, []string{start(ourID), report(ourID), end(ourID)}, stateReported, decisionComplete, true},
+		{"duplicate start", ourID, []string{start(ourID), start(ourID)}, stateStarted, decisionContinue, false},
+		{"foreign end", ourID, []string{start(foreignID), start(ourID), end(foreignID), report(foreignID)}, stateStarted, decisionContinue, false},
+		{"interleaved", ourID, []string{start(foreignID), start(ourID), end(foreignID), end(ourID), report(foreignID), report(ourID)}, stateReported, decisionComplete, true},
+		{"first start decides", "", []string{"init", start(ourID), end(foreignID), end(ourID)}, stateEnded, decisionAwaitReport, false},
+		{"end without start", ourID, []string{end(ourID)}, stateEnded, decisionAwaitReport, false},
+		// an async invocation is followed by the request id of its Invoke, a request which ran before it is foreign
+		{"async after a foreign request", ourID, []string{start(foreignID), end(foreignID), report(foreignID), start(ourID), "hello", end(ourID)}, stateEnded, decisionAwaitReport, false},
+		{"async foreign request only", ourID, []string{start(foreignID), end(foreignID), report(foreignID)}, statePending, decisionContinue, false},
+		{"json format", ourID, []string{
+			`{"time":"2023-11-20T10:00:00.000Z","type":"platform.start","record":{"requestId":"` + ourID + `","version":"$LATEST"}}`,
+			`{"time":"2023-11-20T10:00:00.100Z","type":"platform.runtimeDone","record":{"requestId":"` + ourID + `","status":"success"}}`,
+			`{"time":"2023-11-20T10:00:00.200Z","type":"platform.report","record":{"requestId":"` + ourID + `","metrics":{"durationMs":1.5,"billedDurationMs":2,"memorySizeMB":128,"maxMemoryUsedMB":64}}}`,
+		}, stateReported, decisionComplete, true},
+	}
+	for _, tt := range tests {
+		tr := NewInvocationTracker(tt.requestID)
+		for _, line := range tt.lines {
+			tr.Observe(line)
+		}
+		if tr.State() != tt.want {
+			t.Errorf("%s: state %s", tt.name, tr.State())
+		}
+		if tr.decision() != tt.decision {
+			t.Errorf("%s: decision %d", tt.name, tr.decision())
+		}
+		if (tr.Report() != nil) != tt.gotReport {
+			t.Errorf("%s: report %+v", tt.name, tr.Report())
+		}
+		if tr.Report() != nil && tr.Report().RequestID != ourID {
+			t.Errorf("%s: report of %s", tt.name, tr.Report().RequestID)
+		}
+	}
+}
+
+func TestInvocationTrackerObservation(t *testing.T) {
+	tr := NewInvocationTracker(ourID)
+	if obs := tr.Observe("END RequestId: " + foreignID); !obs.Foreign || obs.Kind != lifecycleEnd {
+		t.Errorf("got %+v", obs)
+	}
+	tr.Observe("START RequestId: " + ourID + " Version: 1")
+	if obs := tr.Observe("START RequestId: " + ourID + " Version: 1"); !obs.Duplicate {
+		t.Errorf("got %+v", obs)
+	}
+}
+
+func TestInvocationTrackerLineRequestID(t *testing.T) {
+	tr := NewInvocationTracker(ourID)
+	for _, tt := range []struct {
+		stream, line, want string
+	}{
+		{"s1", "a line before any START", ""},
+		{"s1", "START RequestId: " + foreignID + " Version: 1", ""},
+		{"s1", "ERROR of another request", ""},
+		{"s2", "START RequestId: " + ourID + " Version: 1", ourID},
+		{"s1", "END RequestId: " + foreignID, ""},
+		{"s2", "ERROR of ours", ourID},
+		{"s2", "END RequestId: " + ourID, ourID},
+		{"s2", "Task timed out after 3.00 seconds", ourID},
+		{"s2", "START RequestId: " + foreignID + " Version: 1", ""},
+		{"s2", "a line of the next request", ""},
+	} {
+		tr.ObserveLine(tt.stream, tt.line)
+		if got := tr.LineRequestID(tt.stream); got != tt.want {
+			t.Errorf("%s %q: got %q", tt.stream, tt.line, got)
+		}
+	}
+}
+
+func TestInvocationTrackerAdopt(t *testing.T) {
+	tr := NewAdoptingTracker()
+	if obs := tr.Observe("START RequestId: " + foreignID + " Version: 1"); !obs.Foreign || tr.RequestID() != "" {
+		t.Errorf("an adopting tracker must not take the first START, got %+v", obs)
+	}
+	tr.ObserveLine("s2", "START RequestId: "+ourID+" Version: 1")
+	tr.Adopt("s2", ourID)
+	tr.Adopt("s2", foreignID)
+	if tr.RequestID() != ourID || tr.State() != stateStarted || tr.LineRequestID("s2") != ourID || tr.LineRequestID("") != "" {
+		t.Errorf("got %s %s", tr.RequestID(), tr.State())
+	}
+	tr.Observe("END RequestId: " + ourID)
+	if tr.State() != stateEnded {
+		t.Errorf("got %s", tr.State())
+	}
+}
+
+func TestInvocationTrackerGiveUp(t *testing.T) {
+	tr := NewInvocationTracker(ourID)
+	tr.Observe("START RequestId: " + ourID + " Version: 1")
+	tr.Abandon()
+	if tr.State() != stateAbandoned || tr.decision() != decisionComplete {
+		t.Errorf("got %s", tr.State())
+	}
+	if tr.Observe("END RequestId: " + ourID); tr.State() != stateAbandoned {
+		t.Errorf("abandoned is final, got %s", tr.State())
+	}
+
+	tr = NewInvocationTracker(ourID)
+	tr.Observe("END RequestId: " + ourID)
+	tr.Timeout()
+	if tr.State() != stateEnded {
+		t.Errorf("timeout after END has no effect, got %s", tr.State())
+	}
+}
+
+func TestParsePlatformRecordRestore(t *testing.T) {
+	_, _, m := parsePlatformRecord(`{"time":"2023-11-20T10:00:00.200Z","type":"platform.report","record":{"requestId":"abc","metrics":{"durationMs":6.17,"billedDurationMs":275,"memorySizeMB":512,"maxMemoryUsedMB":127,"restoreDurationMs":368.28,"billedRestoreDurationMs":268}}}`)
+	if m == nil || m.RestoreDuration != 368.28 || m.BilledRestoreDuration != 268 || m.ColdStart {
+		t.Fatalf("got %+v", m)
+	}
+	if startType(m) != startSnapStartRestore {
+		t.Errorf("got %s", startType(m))
+	}
+}
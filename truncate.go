@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// defaultMaxLineLength is the default cap of a log line printed to the console
+const defaultMaxLineLength = 16 * 1024
+
+// defaultShipMaxLineLength is the default cap of a log line posted by -ship-to,
+// the max size of a CloudWatch Logs event so that a line is shipped as it is logged
+const defaultShipMaxLineLength = 256 * 1024
+
+// sinkKind is a kind of output the emitter renders a line for, each with its own cap
+type sinkKind int
+
+const (
+	sinkConsole sinkKind = iota // the lines printed to the console
+	sinkShip                    // the lines posted to the collector of -ship-to
+)
+
+// truncateMiddle cuts out the middle of s so that the result fits in max bytes,
+// and puts a marker with the number of truncated bytes. It never splits a rune.
+// A max too small for the marker only keeps the head. max <= 0 means no limit.
+func truncateMiddle(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	// the marker length depends on the number of truncated bytes, so take the longest one
+	markerLen := len(fmt.Sprintf("… [%d bytes truncated] …", len(s)))
+	keep := max - markerLen
+	if keep < 0 {
+		// no room for the marker, only the head is kept
+		end := max
+		for end > 0 && !utf8.RuneStart(s[end]) {
+			end--
+		}
+		return s[:end]
+	}
+	head := keep / 2
+	tail := len(s) - (keep - head)
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+	return fmt.Sprintf("%s… [%d bytes truncated] …%s", s[:head], tail-head, s[tail:])
+}
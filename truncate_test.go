@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateMiddle(t *testing.T) {
+	if s := truncateMiddle("short", 10); s != "short" {
+		t.Errorf("got %s", s)
+	}
+	if s := truncateMiddle(strings.Repeat("a", 100), 0); len(s) != 100 {
+		t.Errorf("no limit expected, got %d", len(s))
+	}
+
+	s := truncateMiddle(strings.Repeat("a", 50)+strings.Repeat("b", 50), 60)
+	if !strings.HasPrefix(s, "aaaa") || !strings.HasSuffix(s, "bbbb") || !strings.Contains(s, "bytes truncated") {
+		t.Errorf("got %s", s)
+	}
+	if len(s) > 60 {
+		t.Errorf("too long: %d", len(s))
+	}
+}
+
+func TestTruncateMiddleUTF8(t *testing.T) {
+	line := strings.Repeat("日本語", 200)
+	for max := 1; max < 100; max++ {
+		s := truncateMiddle(line, max)
+		if !utf8.ValidString(s) {
+			t.Fatalf("%d: invalid UTF-8, %q", max, s)
+		}
+		if len(s) > max {
+			t.Errorf("%d: too long, %d", max, len(s))
+		}
+	}
+}
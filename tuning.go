@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// presets of -tuning
+const (
+	tuningDefault    = "default"
+	tuningAggressive = "aggressive" // a huge noisy function: lines are shown sooner and more of them are deduplicated
+	tuningGentle     = "gentle"     // a tiny rare function: fewer API calls share the TPS of CloudWatch Logs
+)
+
+// Limits are the intervals and the sizes of the tail of the logs. A preset of -tuning sets all of
+// them, and the flag of each overrides it.
+type Limits struct {
+	PollInterval     time.Duration // between the polls of the log streams and their events
+	ThrottleCoolDown time.Duration // the first cool-down after a throttling, doubled by each next one
+	MaxCoolDown      time.Duration // the longest cool-down
+	EventsWindow     time.Duration // of event time, an event id is remembered to drop the duplicates of the overlapping polls
+	ReportGrace      time.Duration // how long the tail waits for REPORT after END
+	FallbackStreams  int           // most recently active streams read when FilterLogEvents is denied
+}
+
+// tuningPresets are the limits of each preset
+var tuningPresets = map[string]Limits{
+	tuningDefault: {
+		PollInterval:     500 * time.Millisecond,
+		ThrottleCoolDown: 500 * time.Millisecond,
+		MaxCoolDown:      8 * time.Second,
+		EventsWindow:     5 * time.Minute,
+		ReportGrace:      2 * time.Second,
+		FallbackStreams:  10,
+	},
+	tuningAggressive: {
+		PollInterval:     250 * time.Millisecond,
+		ThrottleCoolDown: 250 * time.Millisecond,
+		MaxCoolDown:      4 * time.Second,
+		EventsWindow:     3 * time.Minute,
+		ReportGrace:      2 * time.Second,
+		FallbackStreams:  25,
+	},
+	tuningGentle: {
+		PollInterval:     2 * time.Second,
+		ThrottleCoolDown: time.Second,
+		MaxCoolDown:      16 * time.Second,
+		EventsWindow:     10 * time.Minute,
+		ReportGrace:      4 * time.Second,
+		FallbackStreams:  5,
+	},
+}
+
+// defaultLimits are the limits of the default preset, used where no -tuning applies
+var defaultLimits = tuningPresets[tuningDefault]
+
+// orDefault returns defaultLimits if l is not set
+func (l Limits) orDefault() Limits {
+	if l == (Limits{}) {
+		return defaultLimits
+	}
+	return l
+}
+
+// tuningNames returns the names of the presets, ex: "aggressive, default or gentle"
+func tuningNames() string {
+	names := make([]string, 0, len(tuningPresets))
+	for name := range tuningPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// resolveLimits returns the limits of the preset with the fields of overrides whose flags are given
+func resolveLimits(preset string, overrides Limits, given func(flagName string) bool) (Limits, error) {
+	limits, ok := tuningPresets[strings.ToLower(preset)]
+	if !ok {
+		return Limits{}, fmt.Errorf("tuning must be %s, %s", tuningNames(), preset)
+	}
+	if given("poll-interval") {
+		limits.PollInterval = overrides.PollInterval
+	}
+	if given("throttle-cool-down") {
+		limits.ThrottleCoolDown = overrides.ThrottleCoolDown
+	}
+	if given("max-throttle-cool-down") {
+		limits.MaxCoolDown = overrides.MaxCoolDown
+	}
+	if given("events-window") {
+		limits.EventsWindow = overrides.EventsWindow
+	}
+	if given("report-grace") {
+		limits.ReportGrace = overrides.ReportGrace
+	}
+	if given("fallback-streams") {
+		limits.FallbackStreams = overrides.FallbackStreams
+	}
+
+	switch {
+	case limits.PollInterval <= 0:
+		return Limits{}, fmt.Errorf("poll-interval must be positive")
+	case limits.ThrottleCoolDown <= 0 || limits.MaxCoolDown < limits.ThrottleCoolDown:
+		return Limits{}, fmt.Errorf("throttle-cool-down must be positive and not longer than max-throttle-cool-down")
+	case limits.EventsWindow <= 0:
+		return Limits{}, fmt.Errorf("events-window must be positive")
+	case limits.ReportGrace < 0:
+		return Limits{}, fmt.Errorf("report-grace must not be negative")
+	case limits.FallbackStreams <= 0:
+		return Limits{}, fmt.Errorf("fallback-streams must be positive")
+	}
+	return limits, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestTuningPresets(t *testing.T) {
+	want := map[string]Limits{
+		"default": {
+			PollInterval:     500 * time.Millisecond,
+			ThrottleCoolDown: 500 * time.Millisecond,
+			MaxCoolDown:      8 * time.Second,
+			EventsWindow:     5 * time.Minute,
+			ReportGrace:      2 * time.Second,
+			FallbackStreams:  10,
+		},
+		"aggressive": {
+			PollInterval:     250 * time.Millisecond,
+			ThrottleCoolDown: 250 * time.Millisecond,
+			MaxCoolDown:      4 * time.Second,
+			EventsWindow:     3 * time.Minute,
+			ReportGrace:      2 * time.Second,
+			FallbackStreams:  25,
+		},
+		"gentle": {
+			PollInterval:     2 * time.Second,
+			ThrottleCoolDown: time.Second,
+			MaxCoolDown:      16 * time.Second,
+			EventsWindow:     10 * time.Minute,
+			ReportGrace:      4 * time.Second,
+			FallbackStreams:  5,
+		},
+	}
+	if len(tuningPresets) != len(want) {
+		t.Errorf("got %d presets", len(tuningPresets))
+	}
+	noenv := func(string) string { return "" }
+	for name, limits := range want {
+		config, err := parseArgs([]string{"-func", "f", "-tuning", name}, noenv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.limits != limits {
+			t.Errorf("%s: got %+v", name, config.limits)
+		}
+	}
+	if defaultLimits != want["default"] {
+		t.Errorf("got %+v", defaultLimits)
+	}
+}
+
+func TestParseArgsTuningOverrides(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f"}, noenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.limits != defaultLimits {
+		t.Errorf("got %+v", config.limits)
+	}
+
+	// an override wins over the preset, the other limits stay those of the preset. the deprecated
+	// -events-cache is accepted but ignored
+	env := map[string]string{"FALLBACK_STREAMS": "3"}
+	config, err = parseArgs([]string{"-func", "f", "-tuning", "gentle", "-poll-interval", "1s", "-events-window", "1m", "-events-cache", "500"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tuningPresets[tuningGentle]
+	want.PollInterval, want.EventsWindow, want.FallbackStreams = time.Second, time.Minute, 3
+	if config.limits != want {
+		t.Errorf("got %+v", config.limits)
+	}
+
+	for _, args := range [][]string{
+		{"-tuning", "fast"},
+		{"-poll-interval", "0s"},
+		{"-throttle-cool-down", "10s"}, // longer than max-throttle-cool-down
+		{"-events-window", "0s"},
+		{"-report-grace", "-1s"},
+		{"-fallback-streams", "0"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+}
+
+// countingLogs counts the calls of the tail to an always updated stream, and throttles every
+// FilterLogEvents as a noisy account does
+type countingLogs struct {
+	throttledLogs
+	calls int64
+}
+
+func (l *countingLogs) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	atomic.AddInt64(&l.calls, 1)
+	return l.throttledLogs.FilterLogEventsPagesWithContext(ctx, input, fn, opts...)
+}
+
+func (l *countingLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	atomic.AddInt64(&l.calls, 1)
+	return l.throttledLogs.DescribeLogStreamsPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestTuningGentleCallsLess(t *testing.T) {
+	setTestLogger(t)
+	const run = 2500 * time.Millisecond
+
+	calls := make(map[string]int64)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range []string{tuningDefault, tuningGentle} {
+		em, err := newEmitter(logger, nil, defaultLimits.EventsWindow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs := &countingLogs{throttledLogs: throttledLogs{filtered: make(chan struct{}, 1)}}
+		sl := &AWSServerless{
+			funcName:  "f",
+			startTime: time.Now().Add(-time.Minute),
+			logClient: logs,
+			emitter:   em,
+			bus:       newBus(),
+			summary:   newSummaryBuilder(),
+			phases:    newPhaseTracker(time.Now()),
+			limits:    tuningPresets[name],
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), run)
+			defer cancel()
+			if err := sl.logTail(ctx, "/aws/lambda/f"); err != context.DeadlineExceeded {
+				t.Errorf("%s: got %v", name, err)
+			}
+			mu.Lock()
+			calls[name] = atomic.LoadInt64(&logs.calls)
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	if calls[tuningGentle] == 0 || calls[tuningGentle] >= calls[tuningDefault] {
+		t.Errorf("gentle must make fewer calls than default, got %d and %d", calls[tuningGentle], calls[tuningDefault])
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// prices of x86 functions in us-east-1, used to estimate the cost of an invocation
+const (
+	lambdaPricePerGBSecond = 0.0000166667
+	lambdaPricePerRequest  = 0.0000002
+)
+
+// functionError is an error of the function itself, as opposed to an error of the run
+type functionError struct {
+	err error
+}
+
+func (e *functionError) Error() string { return e.err.Error() }
+func (e *functionError) Unwrap() error { return e.err }
+
+// exitError is an error of a function which exits with the code, such as a container, whose
+// code the process exits with too
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exit codes of a run, see "Exit codes" of README
+const (
+	exitSuccess       = 0
+	exitFunctionError = 1 // the function failed
+	exitRunError      = 2 // the invocation or a call to the vendor failed
+	exitConfigError   = 3 // the flags or the environment are wrong, nothing is invoked
+	exitTimeout       = 4 // the outcome of the function is not known in time
+)
+
+// configError is an error of the configuration, found before the function is invoked
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// timeoutError is an error of waiting for the function, whose outcome is unknown
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string { return e.err.Error() }
+func (e *timeoutError) Unwrap() error { return e.err }
+
+// exitCode returns the code the process exits with for err: that of the function if err carries
+// one, otherwise that of the kind of err
+func exitCode(err error) int {
+	var ee *exitError
+	var ce *configError
+	var te *timeoutError
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.As(err, &ee) && ee.code != 0:
+		return ee.code
+	case errors.As(err, &te):
+		// a function stopped by -timeout is not known to fail
+		return exitTimeout
+	case isFunctionError(err):
+		return exitFunctionError
+	case errors.As(err, &ce):
+		return exitConfigError
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	}
+	return exitRunError
+}
+
+// isFunctionError returns true if err is caused by the function
+func isFunctionError(err error) bool {
+	var fe *functionError
+	return errors.As(err, &fe)
+}
+
+// verdictOutcome is the outcome of a run
+type verdictOutcome string
+
+const (
+	outcomeSuccess verdictOutcome = "success"
+	outcomeFailure verdictOutcome = "failure" // the function failed
+	outcomeError   verdictOutcome = "error"   // the run failed before the outcome of the function is known
+)
+
+// verdict is a single line rating of a run
+type verdict struct {
+	Outcome verdictOutcome
+	Line    string
+}
+
+// verdictInput is the summary data a verdict is made from
+type verdictInput struct {
+	Function  string
+	Qualifier string
+	Report    *reportMetrics
+	Errors    int    // error log lines
+	Timeout   string // the timeout of the function if it timed out, ex: "900s"
+	Note      string // how the outcome is known when it is not from the logs
+	Err       error
+}
+
+// formatVerdict returns the verdict, ex:
+//
+//	✅ orders-fn (live) 812ms, warm, 0 errors, $0.000002
+//	❌ orders-fn task timed out after 900s
+func formatVerdict(in verdictInput) verdict {
+	name := in.Function
+	if in.Qualifier != "" {
+		name += " (" + in.Qualifier + ")"
+	}
+	if in.Err == nil && in.Timeout != "" {
+		return verdict{Outcome: outcomeFailure, Line: fmt.Sprintf("❌ %s timeout after %s", name, in.Timeout)}
+	}
+	if in.Err != nil {
+		outcome := outcomeError
+		if isFunctionError(in.Err) {
+			outcome = outcomeFailure
+		}
+		msg := strings.Replace(in.Err.Error(), "\n", " ", -1)
+		return verdict{Outcome: outcome, Line: fmt.Sprintf("❌ %s %s", name, msg)}
+	}
+	if in.Report == nil && in.Note != "" {
+		return verdict{Outcome: outcomeSuccess, Line: fmt.Sprintf("✅ %s finished, %s", name, in.Note)}
+	}
+	if in.Report == nil {
+		return verdict{Outcome: outcomeSuccess, Line: fmt.Sprintf("✅ %s finished, %s", name, plural(in.Errors, "error"))}
+	}
+	line := fmt.Sprintf("✅ %s %dms, %s, %s", name, int64(math.Round(in.Report.Duration)), startType(in.Report), plural(in.Errors, "error"))
+	// the memory size is unknown to a local function, so is the cost
+	if in.Report.MemorySize > 0 {
+		line += fmt.Sprintf(", $%.6f", invocationCost(in.Report))
+	}
+	return verdict{Outcome: outcomeSuccess, Line: line}
+}
+
+// invocationCost estimates the cost of the invocation in USD
+func invocationCost(r *reportMetrics) float64 {
+	return r.BilledDuration/1000*r.MemorySize/1024*lambdaPricePerGBSecond + lambdaPricePerRequest
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// finishRun prints the verdict as the last line, and posts it as the commit status if gh is set.
+// It does not use the context of the run, so that a cancelled run is reported too.
+func finishRun(v verdict, gh *githubStatus) {
+	logger.Info(v.Line)
+	if gh == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), githubPostTimeout)
+	defer cancel()
+	if err := gh.post(ctx, v); err != nil {
+		logger.Warnf("%s", err)
+		return
+	}
+	logger.Debugf("github status of %s/%s@%s is set to %s", gh.owner, gh.repo, gh.sha, v.Outcome)
+}
+
+// finishStep describes finishRun in a plan. It has no run, since a run finishes in a defer even when a step fails.
+func finishStep(gh *githubStatus) step {
+	return step{
+		name: "verdict",
+		plan: func() ([]plannedCall, error) {
+			if gh == nil {
+				return nil, nil
+			}
+			return []plannedCall{{
+				Service:   "github",
+				Operation: "CreateCommitStatus",
+				Params:    []planParam{{"Repository", gh.owner + "/" + gh.repo}, {"SHA", gh.sha}, {"Context", githubStatusContext}},
+				Note:      "the outcome of the run",
+			}}, nil
+		},
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestFormatVerdict(t *testing.T) {
+	warm := &reportMetrics{Duration: 812.4, BilledDuration: 813, MemorySize: 1024}
+	cold := &reportMetrics{Duration: 1200, BilledDuration: 1500, MemorySize: 512, InitDuration: 300, ColdStart: true}
+
+	tests := []struct {
+		name    string
+		in      verdictInput
+		outcome verdictOutcome
+		want    string
+	}{
+		{"warm", verdictInput{Function: "orders-fn", Qualifier: "live", Report: warm}, outcomeSuccess,
+			"✅ orders-fn (live) 812ms, warm, 0 errors, $0.000014"},
+		{"cold", verdictInput{Function: "orders-fn", Report: cold, Errors: 1}, outcomeSuccess,
+			"✅ orders-fn 1200ms, cold, 1 error, $0.000013"},
+		{"snapstart", verdictInput{Function: "orders-fn", Report: &reportMetrics{Duration: 6.17, BilledDuration: 275, MemorySize: 512, RestoreDuration: 368.28}}, outcomeSuccess,
+			"✅ orders-fn 6ms, snapstart-restore, 0 errors, $0.000002"},
+		{"local", verdictInput{Function: "handler.sh", Report: &reportMetrics{Duration: 10}}, outcomeSuccess,
+			"✅ handler.sh 10ms, warm, 0 errors"},
+		{"no report", verdictInput{Function: "orders-fn", Errors: 2}, outcomeSuccess,
+			"✅ orders-fn finished, 2 errors"},
+		{"timeout", verdictInput{Function: "orders-fn", Report: warm, Timeout: "900s"}, outcomeFailure,
+			"❌ orders-fn timeout after 900s"},
+		{"function error", verdictInput{Function: "orders-fn", Err: &functionError{fmt.Errorf("invoke lambda response error, {}:\nUnhandled")}}, outcomeFailure,
+			"❌ orders-fn invoke lambda response error, {}: Unhandled"},
+		{"run error", verdictInput{Function: "orders-fn", Err: fmt.Errorf("aws credentials error: %w", fmt.Errorf("expired"))}, outcomeError,
+			"❌ orders-fn aws credentials error: expired"},
+	}
+	for _, tt := range tests {
+		got := formatVerdict(tt.in)
+		if got.Line != tt.want || got.Outcome != tt.outcome {
+			t.Errorf("%s: got %s %q, want %s %q", tt.name, got.Outcome, got.Line, tt.outcome, tt.want)
+		}
+	}
+}
+
+func TestIsFunctionError(t *testing.T) {
+	err := fmt.Errorf("attempt 2: %w", &functionError{fmt.Errorf("Unhandled")})
+	if !isFunctionError(err) {
+		t.Errorf("a wrapped function error must be detected")
+	}
+	if isFunctionError(fmt.Errorf("throttled")) {
+		t.Errorf("other errors must not be function errors")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitSuccess},
+		{fmt.Errorf("Invoke error, %w", &functionError{fmt.Errorf("Unhandled")}), exitFunctionError},
+		{fmt.Errorf("Invoke error, %w", fmt.Errorf("ResourceNotFoundException: Function not found")), exitRunError},
+		{&configError{fmt.Errorf("NewAWSServerless, no region")}, exitConfigError},
+		{fmt.Errorf("Invoke error, %w", &timeoutError{fmt.Errorf("no START in 1m0s")}), exitTimeout},
+		{fmt.Errorf("listLogStreams, %w", context.DeadlineExceeded), exitTimeout},
+		{&exitError{code: 137, err: &functionError{fmt.Errorf("OOMKilled")}}, 137},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%v: got %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
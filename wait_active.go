@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const (
+	// defaultWaitActiveTimeout is how long -wait-active waits for a deploy to settle
+	defaultWaitActiveTimeout = 5 * time.Minute
+	waitActivePoll           = 2 * time.Second
+)
+
+// waitActive polls the configuration of the function until its State is Active and its LastUpdateStatus
+// is Successful, logging each change, so that an invocation right after a deploy runs the new code.
+// A Failed state or update fails at once with its reason, ex: an image of a container function which
+// can not be pulled. An Inactive function is activated by the invocation itself, so it is not waited for.
+// Every poll refreshes the metadata cache, so the steps after it see the settled configuration.
+func waitActive(ctx context.Context, metadata *metadataCache, function, qualifier string, timeout, poll time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	name := function
+	if qualifier != "" {
+		name += ":" + qualifier
+	}
+	last := ""
+	for {
+		conf, err := metadata.refresh(ctx, function, qualifier)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return &timeoutError{fmt.Errorf("%s is not active in %s, %s: %w", name, timeout, last, ctx.Err())}
+			}
+			return err
+		}
+		state, update := aws.StringValue(conf.State), aws.StringValue(conf.LastUpdateStatus)
+		if s := fmt.Sprintf("state %s, last update %s", state, update); s != last {
+			logger.Infof("%s is in %s", name, s)
+			last = s
+		}
+		switch {
+		case state == lambda.StateFailed:
+			return fmt.Errorf("%s is in state Failed, %s: %s", name, aws.StringValue(conf.StateReasonCode), aws.StringValue(conf.StateReason))
+		case update == lambda.LastUpdateStatusFailed:
+			return fmt.Errorf("the last update of %s failed, %s: %s", name, aws.StringValue(conf.LastUpdateStatusReasonCode), aws.StringValue(conf.LastUpdateStatusReason))
+		case state == lambda.StateInactive:
+			logger.Infof("%s is Inactive, the invocation activates it", name)
+			return nil
+		// a function created before the states has neither
+		case (state == lambda.StateActive || state == "") && (update == lambda.LastUpdateStatusSuccessful || update == ""):
+			return nil
+		}
+		if sleepContext(ctx, poll) != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return &timeoutError{fmt.Errorf("%s is not active in %s, %s", name, timeout, last)}
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// planWaitActive describes the polling of -wait-active in a plan
+func (sl *AWSServerless) planWaitActive() ([]plannedCall, error) {
+	return []plannedCall{{
+		Service:   "lambda",
+		Operation: "GetFunctionConfiguration",
+		Params:    []planParam{{"FunctionName", sl.funcName}},
+		Note:      fmt.Sprintf("every %s until State is Active and LastUpdateStatus is Successful, up to %s", waitActivePoll, sl.waitActiveTimeout),
+	}}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// deployingFunction returns the configurations in order, and the last one after them
+type deployingFunction struct {
+	noFunctionURL
+	confs []*lambda.FunctionConfiguration
+	calls int
+	input *lambda.GetFunctionConfigurationInput
+}
+
+func (f *deployingFunction) GetFunctionConfigurationWithContext(ctx aws.Context, input *lambda.GetFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	f.input = input
+	i := f.calls
+	if i >= len(f.confs) {
+		i = len(f.confs) - 1
+	}
+	f.calls++
+	return f.confs[i], nil
+}
+
+func functionState(state, update string) *lambda.FunctionConfiguration {
+	return &lambda.FunctionConfiguration{State: aws.String(state), LastUpdateStatus: aws.String(update)}
+}
+
+func TestWaitActive(t *testing.T) {
+	logs := setTestLogger(t)
+	api := &deployingFunction{confs: []*lambda.FunctionConfiguration{
+		functionState(lambda.StatePending, lambda.LastUpdateStatusInProgress),
+		functionState(lambda.StatePending, lambda.LastUpdateStatusInProgress),
+		functionState(lambda.StateActive, lambda.LastUpdateStatusInProgress),
+		functionState(lambda.StateActive, lambda.LastUpdateStatusSuccessful),
+	}}
+	metadata := newMetadataCache(api, false)
+	if err := waitActive(context.Background(), metadata, "orders-fn", "live", time.Minute, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if api.calls != 4 || aws.StringValue(api.input.Qualifier) != "live" {
+		t.Errorf("got %d calls %v", api.calls, api.input)
+	}
+	// the steps after it read the settled configuration from the cache
+	if meta, err := metadata.get(context.Background(), "orders-fn", "live"); err != nil || api.calls != 4 || aws.StringValue(meta.LastUpdateStatus) != lambda.LastUpdateStatusSuccessful {
+		t.Errorf("got %d calls, %v %v", api.calls, meta, err)
+	}
+	// each change is logged once
+	if n := logs.FilterMessageSnippet("orders-fn:live is in state").Len(); n != 3 {
+		t.Errorf("got %d transitions", n)
+	}
+}
+
+func TestWaitActiveFailed(t *testing.T) {
+	setTestLogger(t)
+	failed := functionState(lambda.StateFailed, lambda.LastUpdateStatusFailed)
+	failed.StateReasonCode = aws.String("ImageAccessDenied")
+	failed.StateReason = aws.String("Lambda does not have permission to access the ECR image.")
+	api := &deployingFunction{confs: []*lambda.FunctionConfiguration{functionState(lambda.StatePending, lambda.LastUpdateStatusInProgress), failed}}
+	err := waitActive(context.Background(), newMetadataCache(api, false), "orders-fn", "", time.Minute, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "ImageAccessDenied: Lambda does not have permission") {
+		t.Errorf("got %v", err)
+	}
+
+	update := functionState(lambda.StateActive, lambda.LastUpdateStatusFailed)
+	update.LastUpdateStatusReasonCode = aws.String("EniLimitExceeded")
+	update.LastUpdateStatusReason = aws.String("The ENI limit is reached.")
+	err = waitActive(context.Background(), newMetadataCache(&deployingFunction{confs: []*lambda.FunctionConfiguration{update}}, false), "orders-fn", "", time.Minute, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "the last update of orders-fn failed, EniLimitExceeded") {
+		t.Errorf("got %v", err)
+	}
+
+	if err := waitActive(context.Background(), newMetadataCache(&deployingFunction{confs: []*lambda.FunctionConfiguration{functionState(lambda.StateInactive, lambda.LastUpdateStatusSuccessful)}}, false), "orders-fn", "", time.Minute, time.Millisecond); err != nil {
+		t.Errorf("an Inactive function is activated by the invocation, got %v", err)
+	}
+}
+
+func TestWaitActiveTimeout(t *testing.T) {
+	setTestLogger(t)
+	api := &deployingFunction{confs: []*lambda.FunctionConfiguration{functionState(lambda.StateActive, lambda.LastUpdateStatusInProgress)}}
+	err := waitActive(context.Background(), newMetadataCache(api, false), "orders-fn", "", 50*time.Millisecond, 10*time.Millisecond)
+	var te *timeoutError
+	if !errors.As(err, &te) || !strings.Contains(err.Error(), "last update InProgress") {
+		t.Errorf("got %v", err)
+	}
+}
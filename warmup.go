@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+// defaultWarmupPayload is sent by -warmup, which a function can tell from a real event to return at once
+const defaultWarmupPayload = `{"warmup": true}`
+
+// warmupRun is the invocations of -warmup, made at once to start as many execution environments
+type warmupRun struct {
+	n      int
+	result *schema.Warmup // set when the invocations are done
+}
+
+// summary returns the result for the summary, nil unless warmed up
+func (w *warmupRun) summary() *schema.Warmup {
+	if w == nil {
+		return nil
+	}
+	return w.result
+}
+
+// warmupInvocation is the outcome of one of the invocations of -warmup
+type warmupInvocation struct {
+	requestID     string
+	report        *reportMetrics // from the tail of the log in the response, nil if it is not there
+	initStart     bool           // INIT_START is in the tail of the log
+	functionError string
+	err           error // the invocation was not made
+}
+
+// cold returns true if the invocation started a new execution environment
+func (w warmupInvocation) cold() bool {
+	return w.initStart || (w.report != nil && w.report.ColdStart)
+}
+
+// warmUp invokes the function n times at once synchronously, and counts the cold starts from the tail of
+// the log in each response. No log is tailed from CloudWatch Logs. A throttled invocation is retried with
+// backoff by sl.invokeRetry, and only fails the run after the others are done.
+func (sl *AWSServerless) warmUp(ctx context.Context, svc invokeAPI) error {
+	w := sl.warmup
+	sl.invokedType = lambda.InvocationTypeRequestResponse
+	logger.Infof("warm up %s by %d invocations at once, payload sha256:%s (%d bytes)", sl.funcName, w.n, sl.integrity.sent, len(sl.payload))
+
+	results := make([]warmupInvocation, w.n)
+	var wg sync.WaitGroup
+	sl.phases.mark(transitionInvokeStart, time.Now())
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, requestID, err := sl.callInvoke(ctx, svc, sl.invokeInput(lambda.InvocationTypeRequestResponse))
+			r := warmupInvocation{requestID: requestID, err: err}
+			if err == nil {
+				r.functionError = aws.StringValue(resp.FunctionError)
+				r.report, r.initStart = parseLogResult(aws.StringValue(resp.LogResult))
+			}
+			results[i] = r
+		}(i)
+	}
+	wg.Wait()
+	sl.phases.mark(transitionInvokeEnd, time.Now())
+	sl.summarize = true
+
+	var failed []string
+	for i, r := range results {
+		switch {
+		case r.err != nil:
+			logger.Warnf("warmup invocation %d failed: %s", i+1, r.err)
+			failed = append(failed, r.err.Error())
+		case r.functionError != "":
+			// the environment is started all the same
+			logger.Warnf("%s returned %s to the warmup payload", r.requestID, r.functionError)
+		}
+	}
+	w.result = summarizeWarmup(results)
+	logger.Infof("warmup of %s: %s", sl.funcName, warmupLine(w.result))
+	switch {
+	case len(failed) == w.n:
+		return fmt.Errorf("none of %d warmup invocations of %s was made: %s", w.n, sl.funcName, failed[0])
+	case len(failed) > 0:
+		return fmt.Errorf("%d of %d warmup invocations of %s failed: %s", len(failed), w.n, sl.funcName, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// summarizeWarmup counts the start types of the invocations, with the percentiles of the init durations
+func summarizeWarmup(results []warmupInvocation) *schema.Warmup {
+	ret := &schema.Warmup{Invocations: len(results)}
+	var inits []float64
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			ret.Failed++
+		case r.cold():
+			ret.ColdStarts++
+			if r.report != nil && r.report.InitDuration > 0 {
+				inits = append(inits, r.report.InitDuration)
+			}
+		case r.report != nil:
+			ret.Warm++
+		default:
+			ret.Unknown++
+		}
+	}
+	if len(inits) > 0 {
+		ret.InitDurationP50, ret.InitDurationP95 = percentile(inits, 50), percentile(inits, 95)
+	}
+	return ret
+}
+
+// warmupLine returns the result of -warmup in a line, ex: "8 cold starts, 2 warm of 10 invocations, init p50 812ms, p95 1240ms"
+func warmupLine(w *schema.Warmup) string {
+	line := fmt.Sprintf("%s, %d warm", plural(w.ColdStarts, "cold start"), w.Warm)
+	if w.Unknown > 0 {
+		line += fmt.Sprintf(", %d unknown", w.Unknown)
+	}
+	if w.Failed > 0 {
+		line += fmt.Sprintf(", %d failed", w.Failed)
+	}
+	line += fmt.Sprintf(" of %s", plural(w.Invocations, "invocation"))
+	if w.InitDurationP50 > 0 {
+		line += fmt.Sprintf(", init p50 %dms, p95 %dms", int64(math.Round(w.InitDurationP50)), int64(math.Round(w.InitDurationP95)))
+	}
+	return line
+}
+
+// parseLogResult returns REPORT in the base64-encoded tail of the log of a sync invocation, and whether
+// INIT_START is in it. The tail is the last 4KB, so INIT_START of a verbose invocation may be cut off.
+func parseLogResult(encoded string) (*reportMetrics, bool) {
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	var report *reportMetrics
+	initStart := false
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "INIT_START ") || (strings.HasPrefix(line, `{"time":`) && strings.Contains(line, `"type":"platform.initStart"`)) {
+			initStart = true
+			continue
+		}
+		if kind, _, r := parseLifecycle(line); kind == lifecycleReport {
+			report = r
+		}
+	}
+	return report, initStart
+}
+
+// planWarmup describes the invocations of -warmup in a plan
+func (sl *AWSServerless) planWarmup() ([]plannedCall, error) {
+	params := []planParam{
+		{"FunctionName", sl.unqualifiedName()},
+		{"InvocationType", lambda.InvocationTypeRequestResponse},
+		{"Payload", fmt.Sprintf("%d bytes, sha256:%s", len(sl.payload), sl.integrity.sent)},
+		{"LogType", "Tail"},
+	}
+	if sl.ref.Qualifier != "" {
+		params = append(params, planParam{"Qualifier", sl.ref.Qualifier})
+	}
+	if sl.clientContext != "" {
+		params = append(params, planParam{"ClientContext", fmt.Sprintf("%d bytes base64-encoded", len(sl.clientContext))})
+	}
+	note := fmt.Sprintf("%d times at once to start as many execution environments, the cold starts are counted from the tail of the log in each response, no log is tailed", sl.warmup.n)
+	if p := sl.invokeRetry; p.maxAttempts > 1 {
+		note += fmt.Sprintf("; retried on TooManyRequestsException and other transient errors, up to %d attempts within %s", p.maxAttempts, p.maxElapsed)
+	}
+	return []plannedCall{{Service: "lambda", Operation: "Invoke", Params: params, Note: note}}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+func logResult(lines ...string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+func TestParseLogResult(t *testing.T) {
+	r, initStart := parseLogResult(logResult(
+		"INIT_START Runtime Version: python:3.12.v18\tRuntime Version ARN: arn:aws:lambda:us-east-1::runtime:0123",
+		"START RequestId: r1 Version: $LATEST",
+		"END RequestId: r1",
+		"REPORT RequestId: r1\tDuration: 2.50 ms\tBilled Duration: 3 ms\tMemory Size: 128 MB\tMax Memory Used: 40 MB\tInit Duration: 812.40 ms",
+	))
+	if !initStart || r == nil || !r.ColdStart || r.InitDuration != 812.40 {
+		t.Errorf("got %+v %v", r, initStart)
+	}
+
+	// the JSON log format, whose INIT_START is cut off the 4KB tail
+	r, initStart = parseLogResult(logResult(
+		`{"time":"2026-10-16T00:00:00.000Z","type":"platform.runtimeDone","record":{"requestId":"r2","status":"success"}}`,
+		`{"time":"2026-10-16T00:00:00.000Z","type":"platform.report","record":{"requestId":"r2","metrics":{"durationMs":2.5,"billedDurationMs":3,"memorySizeMB":128,"maxMemoryUsedMB":40,"initDurationMs":640}}}`,
+	))
+	if initStart || r == nil || !r.ColdStart || r.InitDuration != 640 {
+		t.Errorf("got %+v %v", r, initStart)
+	}
+
+	if r, initStart := parseLogResult("not base64!"); r != nil || initStart {
+		t.Errorf("got %+v %v", r, initStart)
+	}
+}
+
+// warmupInvoke throttles the first call, and starts an environment by each of the next colds calls
+type warmupInvoke struct {
+	mu    sync.Mutex
+	calls int
+	colds int
+}
+
+func (f *warmupInvoke) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	f.mu.Lock()
+	f.calls++
+	n := f.calls
+	f.mu.Unlock()
+	if n == 1 {
+		return nil, awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.", nil)
+	}
+	id := fmt.Sprintf("r%d", n)
+	report := "REPORT RequestId: " + id + "\tDuration: 2.50 ms\tBilled Duration: 3 ms\tMemory Size: 128 MB\tMax Memory Used: 40 MB"
+	if n-1 <= f.colds {
+		report += fmt.Sprintf("\tInit Duration: %d.00 ms", (n-1)*100)
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200), LogResult: aws.String(logResult("END RequestId: "+id, report))}, nil
+}
+
+func TestWarmUp(t *testing.T) {
+	setTestLogger(t)
+	sl := &AWSServerless{
+		funcName:    "orders-fn",
+		payload:     defaultWarmupPayload,
+		integrity:   newPayloadIntegrity(defaultWarmupPayload),
+		phases:      newPhaseTracker(time.Now()),
+		warmup:      &warmupRun{n: 4},
+		invokeRetry: invokeRetryPolicy{maxAttempts: 3, maxElapsed: time.Minute, backoff: func(int) time.Duration { return time.Millisecond }},
+	}
+	api := &warmupInvoke{colds: 3}
+	if err := sl.warmUp(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	got := sl.warmup.summary()
+	if api.calls != 5 || got.ColdStarts != 3 || got.Warm != 1 || got.Failed != 0 || got.InitDurationP50 != 200 || got.InitDurationP95 != 300 {
+		t.Fatalf("throttling must be retried, got %d calls %+v", api.calls, got)
+	}
+	if line := warmupLine(got); line != "3 cold starts, 1 warm of 4 invocations, init p50 200ms, p95 300ms" {
+		t.Errorf("got %q", line)
+	}
+	if note := sl.outcomeNote(); !strings.HasPrefix(note, "warmup, 3 cold starts") {
+		t.Errorf("got %q", note)
+	}
+}
+
+func TestParseArgsWarmup(t *testing.T) {
+	noenv := func(string) string { return "" }
+	config, err := parseArgs([]string{"-func", "f", "-warmup", "10"}, noenv)
+	if err != nil || config.warmup == nil || config.warmup.n != 10 || config.payload != defaultWarmupPayload {
+		t.Fatalf("got %v", err)
+	}
+	if config, err := parseArgs([]string{"-func", "f", "-warmup", "10", "-warmup-payload", `{"ping": 1}`}, noenv); err != nil || config.payload != `{"ping": 1}` {
+		t.Errorf("got %v", err)
+	}
+	for _, args := range [][]string{
+		{"-warmup-payload", "{}"},
+		{"-warmup", "-1"},
+		{"-warmup", "10", "-payload", "{}"},
+		{"-warmup", "10", "-concurrency", "2"},
+		{"-warmup", "10", "-invocation-type", "event"},
+	} {
+		if _, err := parseArgs(append([]string{"-func", "f"}, args...), noenv); err == nil {
+			t.Errorf("%v must be an error", args)
+		}
+	}
+}
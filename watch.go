@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+const (
+	defaultWatchDebounce = 500 * time.Millisecond
+	watchPollInterval    = 200 * time.Millisecond
+)
+
+// watchFile sends to changed when the file looks changed. It stats the path instead of
+// the opened file, so an editor which writes a temp file and renames it over the path is followed.
+func watchFile(ctx context.Context, path string, interval time.Duration, changed chan<- struct{}) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st, err := os.Stat(path)
+		if err != nil {
+			// removed, or in the middle of a rename. wait for it to appear again
+			last = nil
+			continue
+		}
+		if last != nil && os.SameFile(last, st) && st.ModTime().Equal(last.ModTime()) && st.Size() == last.Size() {
+			continue
+		}
+		last = st
+		select {
+		case changed <- struct{}{}:
+		default: // a change is already pending
+		}
+	}
+}
+
+// debounce forwards an event to out when no more events arrived in d
+func debounce(ctx context.Context, in <-chan struct{}, d time.Duration, out chan<- struct{}) {
+	timer := time.NewTimer(d)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-in:
+			timer.Stop()
+			timer.Reset(d)
+		case <-timer.C:
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// runWatch invokes the function, and re-invokes it whenever the content of the payload file is changed.
+// Saving the file without changing the content does not re-invoke.
+func runWatch(ctx context.Context, config *Config, invoke func(context.Context, *Config) error) error {
+	changed := make(chan struct{}, 1)
+	debounced := make(chan struct{}, 1)
+	go watchFile(ctx, config.payloadFile, watchPollInterval, changed)
+	go debounce(ctx, changed, config.watchDebounce, debounced)
+
+	lastHash := ""
+	run := 0
+	trigger := func() {
+		payload, err := config.readPayloadFile(config.payloadFile)
+		if err != nil {
+			logger.Warnf("watch: %s", err)
+			return
+		}
+		hash := payloadHash(payload)
+		if hash == lastHash {
+			logger.Debugf("payload is not changed, sha256:%s", hash)
+			return
+		}
+		lastHash = hash
+		if why := suspiciousPayload(payload); why != "" {
+			if config.strictPayload {
+				logger.Errorf("watch: %s %s, not invoked (-strict-payload)", config.payloadFile, why)
+				return
+			}
+			logger.Warnf("watch: %s %s", config.payloadFile, why)
+		}
+		run++
+		logger.Infof("=== run %d, payload sha256:%s ===", run, hash)
+		if config.showPayload {
+			logger.Infof("payload from %s: %s", config.payloadFile, payload)
+		}
+
+		c := *config
+		c.payload = payload
+		if err := invoke(ctx, &c); err != nil {
+			logger.Errorf("run %d: %s", run, err)
+		}
+	}
+
+	trigger()
+	logger.Infof("watching %s", config.payloadFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-debounced:
+			trigger()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan struct{})
+	out := make(chan struct{}, 1)
+	go debounce(ctx, in, 50*time.Millisecond, out)
+
+	// a burst of events is forwarded once
+	for i := 0; i < 5; i++ {
+		in <- struct{}{}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatal("no event after the burst")
+	}
+	select {
+	case <-out:
+		t.Fatal("a burst must be forwarded once")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestWatchFileRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "payload.json")
+	if err := ioutil.WriteFile(path, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go watchFile(ctx, path, 10*time.Millisecond, changed)
+	time.Sleep(50 * time.Millisecond) // let the watcher see the initial file
+
+	// save by writing a temp file and renaming it over the path
+	tmp := filepath.Join(dir, ".payload.json.swp")
+	if err := ioutil.WriteFile(tmp, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("rename is not detected")
+	}
+
+	// the watch continues on the new file
+	if err := ioutil.WriteFile(path, []byte(`{"a":3, "b":4}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("write after rename is not detected")
+	}
+}
+
+func TestRunWatchSkipsSameContent(t *testing.T) {
+	setTestLogger(t)
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "payload.json")
+	if err := ioutil.WriteFile(path, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var payloads []string
+	invoked := make(chan struct{}, 10)
+	invoke := func(ctx context.Context, c *Config) error {
+		mu.Lock()
+		payloads = append(payloads, c.payload)
+		mu.Unlock()
+		invoked <- struct{}{}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &Config{payloadFile: path, watchDebounce: 20 * time.Millisecond}
+	go runWatch(ctx, config, invoke)
+	<-invoked
+
+	// touch without changing the content
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-invoked:
+		t.Fatal("re-invoked without a change of the content")
+	case <-time.After(3 * watchPollInterval):
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-invoked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not re-invoked after a change")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 2 || payloads[0] != `{"a":1}` || payloads[1] != `{"a":2}` {
+		t.Errorf("got %v", payloads)
+	}
+}
+
+func TestRunWatchStrictPayload(t *testing.T) {
+	logs := setTestLogger(t)
+	path := filepath.Join(t.TempDir(), "payload.json")
+	if err := ioutil.WriteFile(path, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invoked := make(chan string, 10)
+	invoke := func(ctx context.Context, c *Config) error {
+		invoked <- c.payload
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &Config{payloadFile: path, watchDebounce: 20 * time.Millisecond, strictPayload: true}
+	go runWatch(ctx, config, invoke)
+	<-invoked
+	// let the watcher stat the file before it is changed
+	time.Sleep(2 * watchPollInterval)
+
+	// an editor truncates the file while saving
+	if err := ioutil.WriteFile(path, []byte("  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.FilterMessageSnippet("not invoked").Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the skip is not logged")
+		}
+		select {
+		case p := <-invoked:
+			t.Fatalf("invoked with %q", p)
+		case <-time.After(watchPollInterval):
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-invoked:
+		if p != `{"a":2}` {
+			t.Errorf("got %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not re-invoked after a change")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsMaxMessage   = 16 << 20
+	wsCloseTimeout = time.Second // for the close frame, the peer may be gone
+)
+
+// wsConn is a WebSocket connection of gorilla/websocket as a tail session uses it: messages are
+// read whole, pings are answered by the default handler, and a close of the peer is io.EOF
+type wsConn struct {
+	conn      *websocket.Conn
+	closeOnce sync.Once
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	conn.SetReadLimit(wsMaxMessage)
+	return &wsConn{conn: conn}
+}
+
+// dialWebSocket opens a WebSocket of the subprotocol at the ws, wss or http(s) URL
+func dialWebSocket(ctx context.Context, rawURL, protocol string, header http.Header) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: 45 * time.Second}
+	if protocol != "" {
+		dialer.Subprotocols = []string{protocol}
+	}
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("websocket %s: %s: %s", u.Host, resp.Status, truncateMiddle(string(body), 512))
+		}
+		return nil, fmt.Errorf("websocket %s: %w", u.Host, err)
+	}
+	return newWSConn(conn), nil
+}
+
+// readMessage returns the next text or binary message, or io.EOF when the peer closes
+func (c *wsConn) readMessage() (int, []byte, error) {
+	op, message, err := c.conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		c.close()
+		return 0, nil, io.EOF
+	}
+	return op, message, err
+}
+
+// writeText sends a text message
+func (c *wsConn) writeText(message []byte) error {
+	return c.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// close sends a normal closure and closes the connection, which unblocks a readMessage
+func (c *wsConn) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsCloseTimeout))
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/xray"
+
+	"github.com/shirou/k8s-nodeless/schema"
+)
+
+const (
+	xrayTraceHeader  = "X-Amzn-Trace-Id"
+	xrayPollInterval = 2 * time.Second
+	xrayTimeout      = time.Minute // X-Ray takes seconds to tens of seconds to make the segments of a trace readable
+
+	xrayOriginLambda   = "AWS::Lambda"
+	xrayOriginFunction = "AWS::Lambda::Function" // only with active tracing
+)
+
+// xrayAPI is the part of the X-Ray API -xray uses
+type xrayAPI interface {
+	BatchGetTracesPagesWithContext(ctx aws.Context, input *xray.BatchGetTracesInput, fn func(*xray.BatchGetTracesOutput, bool) bool, opts ...request.Option) error
+}
+
+// xrayTrace is the trace of -xray, whose id is sent with the invocation
+type xrayTrace struct {
+	id      string
+	poll    time.Duration
+	timeout time.Duration
+	result  *schema.XRayTrace // read after the tail, nil if none
+}
+
+// newXRayTrace returns a trace with a new id of the time
+func newXRayTrace(now time.Time) (*xrayTrace, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &xrayTrace{
+		id:      fmt.Sprintf("1-%08x-%s", now.Unix(), hex.EncodeToString(b)),
+		poll:    xrayPollInterval,
+		timeout: xrayTimeout,
+	}, nil
+}
+
+// summary returns the trace for the summary, nil unless it is read
+func (t *xrayTrace) summary() *schema.XRayTrace {
+	if t == nil {
+		return nil
+	}
+	return t.result
+}
+
+// option returns the request option which sends the trace header with the invocation, sampled so that
+// Lambda records it whatever the sampling rule is
+func (t *xrayTrace) option() request.Option {
+	return request.WithSetRequestHeaders(map[string]string{xrayTraceHeader: "Root=" + t.id + ";Sampled=1"})
+}
+
+// xraySegment is a segment document of X-Ray, or a subsegment in it
+type xraySegment struct {
+	ID         string  `json:"id"`
+	ParentID   string  `json:"parent_id"`
+	Name       string  `json:"name"`
+	Origin     string  `json:"origin"`
+	StartTime  float64 `json:"start_time"`
+	EndTime    float64 `json:"end_time"`
+	InProgress bool    `json:"in_progress"`
+	Error      bool    `json:"error"`
+	Fault      bool    `json:"fault"`
+	Throttle   bool    `json:"throttle"`
+	AWS        struct {
+		Operation string `json:"operation"`
+	} `json:"aws"`
+	Subsegments []*xraySegment `json:"subsegments"`
+
+	children []*xraySegment // the subsegments and the segments whose parent it is
+}
+
+// readXRay polls the trace of the invocation into sl.xray until it has the segment of the function and
+// nothing is in progress, tolerating the ingestion delay of X-Ray up to its timeout. A trace which is still
+// incomplete is printed as it is, it never fails the run.
+func (sl *AWSServerless) readXRay(ctx context.Context, api xrayAPI) error {
+	t := sl.xray
+	want := xrayOriginFunction
+	if meta, err := sl.metadata.get(ctx, sl.funcName, ""); err == nil && meta.TracingConfig != nil && aws.StringValue(meta.TracingConfig.Mode) != lambda.TracingModeActive {
+		logger.Warnf("active tracing of %s is off, the trace has only the segment of the Lambda service", sl.funcName)
+		want = xrayOriginLambda
+	}
+
+	deadline := time.Now().Add(t.timeout)
+	for {
+		docs, err := batchGetTrace(ctx, api, t.id)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isAccessDenied(err) {
+			logger.Warnf("no X-Ray trace, the credentials need xray:BatchGetTraces: %s", err)
+			return nil
+		}
+		if err != nil {
+			logger.Warnf("no X-Ray trace, %s", err)
+			return nil
+		}
+		roots, complete := buildXRayTree(docs, want)
+		if complete || !time.Now().Before(deadline) {
+			if len(roots) == 0 {
+				logger.Infof("no X-Ray trace %s after %s, the invocation may not be traced", t.id, t.timeout)
+				return nil
+			}
+			if !complete {
+				logger.Infof("the X-Ray trace %s is incomplete after %s", t.id, t.timeout)
+			}
+			t.result = flattenXRay(t.id, roots, complete)
+			if !sl.json {
+				fmt.Fprint(os.Stdout, renderXRay(t.result))
+			}
+			return nil
+		}
+		if err := sleepContext(ctx, t.poll); err != nil {
+			return err
+		}
+	}
+}
+
+// batchGetTrace returns the segment documents of the trace, none until X-Ray has processed it
+func batchGetTrace(ctx context.Context, api xrayAPI, id string) ([]string, error) {
+	var docs []string
+	err := api.BatchGetTracesPagesWithContext(ctx, &xray.BatchGetTracesInput{TraceIds: []*string{aws.String(id)}}, func(out *xray.BatchGetTracesOutput, last bool) bool {
+		for _, tr := range out.Traces {
+			for _, s := range tr.Segments {
+				docs = append(docs, aws.StringValue(s.Document))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BatchGetTraces, %s: %w", id, err)
+	}
+	return docs, nil
+}
+
+// buildXRayTree puts each segment under the (sub)segment which is its parent, and returns the segments
+// without a parent in the trace. complete is true when a segment of the origin is in and nothing is in progress.
+func buildXRayTree(docs []string, origin string) ([]*xraySegment, bool) {
+	var segments []*xraySegment
+	byID := map[string]*xraySegment{}
+	var index func(s *xraySegment)
+	index = func(s *xraySegment) {
+		byID[s.ID] = s
+		s.children = append(s.children, s.Subsegments...)
+		for _, sub := range s.Subsegments {
+			index(sub)
+		}
+	}
+	for _, d := range docs {
+		var s xraySegment
+		if err := json.Unmarshal([]byte(d), &s); err != nil {
+			logger.Debugf("a segment of X-Ray is not parsed: %s", err)
+			continue
+		}
+		segments = append(segments, &s)
+		index(&s)
+	}
+
+	var roots []*xraySegment
+	found := false
+	for _, s := range segments {
+		found = found || s.Origin == origin
+		if p, ok := byID[s.ParentID]; ok && s.ParentID != "" {
+			p.children = append(p.children, s)
+			continue
+		}
+		roots = append(roots, s)
+	}
+	complete := found
+	for _, s := range byID {
+		if s.InProgress || s.EndTime == 0 {
+			complete = false
+		}
+	}
+	return roots, complete
+}
+
+// flattenXRay returns the tree depth first, the children in the order they started
+func flattenXRay(id string, roots []*xraySegment, complete bool) *schema.XRayTrace {
+	ret := &schema.XRayTrace{TraceID: id, Complete: complete, Segments: []schema.XRaySegment{}}
+	start := math.MaxFloat64
+	for _, s := range roots {
+		start = math.Min(start, s.StartTime)
+	}
+	offset := func(t float64) time.Duration {
+		return time.Duration(math.Round(t*1000)) * time.Millisecond
+	}
+	var walk func(ss []*xraySegment, depth int)
+	walk = func(ss []*xraySegment, depth int) {
+		sort.SliceStable(ss, func(i, j int) bool { return ss[i].StartTime < ss[j].StartTime })
+		for _, s := range ss {
+			seg := schema.XRaySegment{
+				Name:      s.Name,
+				Origin:    s.Origin,
+				Operation: s.AWS.Operation,
+				Depth:     depth,
+				Start:     offset(s.StartTime - start),
+				Error:     s.Error || s.Fault || s.Throttle,
+			}
+			if s.EndTime > 0 {
+				seg.Duration = offset(s.EndTime - s.StartTime)
+			}
+			ret.Segments = append(ret.Segments, seg)
+			walk(s.children, depth+1)
+		}
+	}
+	walk(roots, 0)
+	return ret
+}
+
+// renderXRay draws the segments of the trace a line each, indented by the depth, ex:
+//
+//	+0s          1.2s  orders-fn (AWS::Lambda)
+//	+20ms       280ms        Initialization
+func renderXRay(tr *schema.XRayTrace) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "X-Ray trace %s\n", tr.TraceID)
+	for _, s := range tr.Segments {
+		label := s.Name
+		if s.Operation != "" {
+			label += " " + s.Operation
+		}
+		if s.Origin != "" {
+			label += " (" + s.Origin + ")"
+		}
+		if s.Error {
+			label += " !"
+		}
+		duration := "-"
+		if s.Duration > 0 {
+			duration = formatSpan(s.Duration)
+		}
+		fmt.Fprintf(&sb, "  +%-8s %7s  %s%s\n", formatSpan(s.Start), duration, strings.Repeat("  ", s.Depth), label)
+	}
+	if !tr.Complete {
+		sb.WriteString("  (incomplete)\n")
+	}
+	return sb.String()
+}
+
+// planXRay describes the read of the trace of -xray in a plan
+func (sl *AWSServerless) planXRay() ([]plannedCall, error) {
+	return []plannedCall{{
+		Service:   "xray",
+		Operation: "BatchGetTraces",
+		Params:    []planParam{{"TraceIds", "the trace id sent in the " + xrayTraceHeader + " header of the invocation"}},
+		Note:      fmt.Sprintf("every %s up to %s until the segment of the function is in and nothing is in progress", xrayPollInterval, xrayTimeout),
+	}}, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/xray"
+)
+
+var xrayDocs = []string{
+	`{"id": "a1", "name": "orders-fn", "origin": "AWS::Lambda", "start_time": 1000.000, "end_time": 1000.900,
+	  "subsegments": [{"id": "a2", "name": "Attempt #1", "start_time": 1000.010, "end_time": 1000.890}]}`,
+	`{"id": "b1", "parent_id": "a2", "name": "orders-fn", "origin": "AWS::Lambda::Function", "start_time": 1000.020, "end_time": 1000.880,
+	  "subsegments": [
+	    {"id": "b3", "name": "Invocation", "start_time": 1000.320, "end_time": 1000.870,
+	     "subsegments": [{"id": "b4", "name": "DynamoDB", "namespace": "aws", "aws": {"operation": "GetItem"}, "start_time": 1000.400, "end_time": 1000.450, "fault": true}]},
+	    {"id": "b2", "name": "Initialization", "start_time": 1000.020, "end_time": 1000.300}]}`,
+}
+
+// pendingTraces returns the documents of the trace from the polls after the first `after`
+type pendingTraces struct {
+	docs  []string
+	after int
+	polls int
+}
+
+func (p *pendingTraces) BatchGetTracesPagesWithContext(ctx aws.Context, input *xray.BatchGetTracesInput, fn func(*xray.BatchGetTracesOutput, bool) bool, opts ...request.Option) error {
+	p.polls++
+	out := &xray.BatchGetTracesOutput{}
+	if p.polls > p.after {
+		tr := &xray.Trace{Id: input.TraceIds[0]}
+		for _, d := range p.docs {
+			tr.Segments = append(tr.Segments, &xray.Segment{Document: aws.String(d)})
+		}
+		out.Traces = append(out.Traces, tr)
+	}
+	fn(out, true)
+	return nil
+}
+
+func TestNewXRayTrace(t *testing.T) {
+	tr, err := newXRayTrace(time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^1-6553f100-[0-9a-f]{24}$`).MatchString(tr.id) {
+		t.Errorf("got %s", tr.id)
+	}
+}
+
+func TestBuildXRayTree(t *testing.T) {
+	roots, complete := buildXRayTree(xrayDocs, xrayOriginFunction)
+	if len(roots) != 1 || !complete {
+		t.Fatalf("got %d roots, complete %v", len(roots), complete)
+	}
+	tr := flattenXRay("1-x", roots, complete)
+	var got []string
+	for _, s := range tr.Segments {
+		got = append(got, strings.Repeat(".", s.Depth)+s.Name+" "+s.Start.String()+" "+s.Duration.String())
+	}
+	want := []string{
+		"orders-fn 0s 900ms",
+		".Attempt #1 10ms 880ms",
+		"..orders-fn 20ms 860ms",
+		"...Initialization 20ms 280ms",
+		"...Invocation 320ms 550ms",
+		"....DynamoDB 400ms 50ms",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s", strings.Join(got, "\n"))
+	}
+
+	out := renderXRay(tr)
+	if !strings.Contains(out, "DynamoDB GetItem !") || !strings.Contains(out, "orders-fn (AWS::Lambda::Function)") {
+		t.Errorf("got\n%s", out)
+	}
+
+	// the segment of the function is not in yet
+	if _, complete := buildXRayTree(xrayDocs[:1], xrayOriginFunction); complete {
+		t.Error("complete without the segment of the function")
+	}
+	inProgress := strings.Replace(xrayDocs[1], `"end_time": 1000.880,`, `"in_progress": true,`, 1)
+	if _, complete := buildXRayTree([]string{xrayDocs[0], inProgress}, xrayOriginFunction); complete {
+		t.Error("complete with a segment in progress")
+	}
+}
+
+func TestReadXRay(t *testing.T) {
+	logs := setTestLogger(t)
+	conf := &lambda.FunctionConfiguration{TracingConfig: &lambda.TracingConfigResponse{Mode: aws.String(lambda.TracingModeActive)}}
+	sl := &AWSServerless{
+		funcName: "orders-fn",
+		json:     true,
+		metadata: newMetadataCache(&deployingFunction{confs: []*lambda.FunctionConfiguration{conf}}, false),
+		xray:     &xrayTrace{id: "1-x", poll: time.Millisecond, timeout: time.Second},
+	}
+	api := &pendingTraces{docs: xrayDocs, after: 2}
+	if err := sl.readXRay(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if api.polls != 3 || sl.xray.summary() == nil || !sl.xray.summary().Complete {
+		t.Errorf("polls %d, got %+v", api.polls, sl.xray.summary())
+	}
+
+	// the segment of the function never comes without active tracing, the one of Lambda is enough
+	conf.TracingConfig.Mode = aws.String(lambda.TracingModePassThrough)
+	sl.metadata = newMetadataCache(&deployingFunction{confs: []*lambda.FunctionConfiguration{conf}}, false)
+	api = &pendingTraces{docs: xrayDocs[:1]}
+	if err := sl.readXRay(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if api.polls != 1 || !sl.xray.summary().Complete || logs.FilterMessageSnippet("active tracing of orders-fn is off").Len() != 1 {
+		t.Errorf("polls %d, got %+v", api.polls, sl.xray.summary())
+	}
+
+	// never traced
+	sl.xray = &xrayTrace{id: "1-y", poll: time.Millisecond, timeout: 20 * time.Millisecond}
+	if err := sl.readXRay(context.Background(), &pendingTraces{after: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if sl.xray.summary() != nil || logs.FilterMessageSnippet("no X-Ray trace 1-y").Len() != 1 {
+		t.Errorf("got %+v", sl.xray.summary())
+	}
+}